@@ -70,6 +70,36 @@ func TestGolden(t *testing.T) {
 	}
 }
 
+func TestVerifyBatch(t *testing.T) {
+	const n = 10
+	pubs := make([]PublicKey, n)
+	hashes := make([]crypto.Hash, n)
+	sigs := make([][]byte, n)
+	for i := range pubs {
+		var priv PrivateKey
+		pubs[i], priv = generateKey()
+		hashes[i] = crypto.Hash{byte(i)}
+		sigs[i] = priv.SignHash(hashes[i])
+	}
+	if !VerifyBatch(nil, nil, nil) {
+		t.Error("empty batch rejected")
+	}
+	if !VerifyBatch(pubs, hashes, sigs) {
+		t.Error("valid batch rejected")
+	}
+	for i := range pubs {
+		hashes[i][31]++
+		if VerifyBatch(pubs, hashes, sigs) {
+			t.Errorf("batch with invalid signature %v accepted", i)
+		}
+		hashes[i][31]--
+	}
+	sigs[3] = sigs[4]
+	if VerifyBatch(pubs, hashes, sigs) {
+		t.Error("batch with swapped signature accepted")
+	}
+}
+
 func BenchmarkHashSigning(b *testing.B) {
 	b.ReportAllocs()
 	_, priv := generateKey()
@@ -90,3 +120,21 @@ func BenchmarkHashVerification(b *testing.B) {
 		pub.VerifyHash(hash, signature)
 	}
 }
+
+func BenchmarkVerifyBatch(b *testing.B) {
+	const n = 64
+	pubs := make([]PublicKey, n)
+	hashes := make([]crypto.Hash, n)
+	sigs := make([][]byte, n)
+	for i := range pubs {
+		var priv PrivateKey
+		pubs[i], priv = generateKey()
+		hashes[i] = sha256.Sum256([]byte{byte(i)})
+		sigs[i] = priv.SignHash(hashes[i])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		VerifyBatch(pubs, hashes, sigs)
+	}
+}
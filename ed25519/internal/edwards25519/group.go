@@ -313,6 +313,69 @@ func GeDoubleScalarMultVartime(r *ProjectiveGroupElement, a *[32]byte, A *Extend
 	}
 }
 
+// GeMultiScalarMultVartime sets r = a[0]*A[0] + a[1]*A[1] + ... + b*B, where
+// B is the Ed25519 base point. Since the doublings are shared, this is
+// considerably faster than computing each product separately.
+func GeMultiScalarMultVartime(r *ProjectiveGroupElement, a [][32]byte, A []ExtendedGroupElement, b *[32]byte) {
+	aSlides := make([][256]int8, len(A))
+	Ai := make([][8]CachedGroupElement, len(A)) // A,3A,5A,7A,9A,11A,13A,15A
+	var bSlide [256]int8
+	var t CompletedGroupElement
+	var u, A2 ExtendedGroupElement
+	var i int
+
+	for j := range A {
+		slide(&aSlides[j], &a[j])
+		A[j].ToCached(&Ai[j][0])
+		A[j].Double(&t)
+		t.ToExtended(&A2)
+		for i := 0; i < 7; i++ {
+			geAdd(&t, &A2, &Ai[j][i])
+			t.ToExtended(&u)
+			u.ToCached(&Ai[j][i+1])
+		}
+	}
+	slide(&bSlide, b)
+
+	r.Zero()
+
+outer:
+	for i = 255; i >= 0; i-- {
+		if bSlide[i] != 0 {
+			break
+		}
+		for j := range aSlides {
+			if aSlides[j][i] != 0 {
+				break outer
+			}
+		}
+	}
+
+	for ; i >= 0; i-- {
+		r.Double(&t)
+
+		for j := range aSlides {
+			if aSlides[j][i] > 0 {
+				t.ToExtended(&u)
+				geAdd(&t, &u, &Ai[j][aSlides[j][i]/2])
+			} else if aSlides[j][i] < 0 {
+				t.ToExtended(&u)
+				geSub(&t, &u, &Ai[j][(-aSlides[j][i])/2])
+			}
+		}
+
+		if bSlide[i] > 0 {
+			t.ToExtended(&u)
+			geMixedAdd(&t, &u, &bi[bSlide[i]/2])
+		} else if bSlide[i] < 0 {
+			t.ToExtended(&u)
+			geMixedSub(&t, &u, &bi[(-bSlide[i])/2])
+		}
+
+		t.ToProjective(r)
+	}
+}
+
 // equal returns 1 if b == c and 0 otherwise, assuming that b and c are
 // non-negative.
 func equal(b, c int32) int32 {
@@ -6,6 +6,7 @@ require (
 	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da
 	github.com/pkg/errors v0.8.1
 	gitlab.com/NebulousLabs/Sia v1.4.1
+	gitlab.com/NebulousLabs/writeaheadlog v0.0.0-20190703190009-cb822c37bc94
 	go.etcd.io/bbolt v1.3.3
 	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
 	golang.org/x/sys v0.0.0-20190626221950-04f50cda93cb
@@ -0,0 +1,115 @@
+package hostdb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// An AlertRule determines when a host is considered failing. A zero value for
+// any field disables the corresponding check; a host is failing if it
+// violates any enabled check.
+type AlertRule struct {
+	// Name identifies the rule in Alerts.
+	Name string
+	// MaxConsecutiveFailures is the number of consecutive failed scans after
+	// which the host is failing.
+	MaxConsecutiveFailures int
+	// MinUptime is the uptime, in [0, 1], below which the host is failing.
+	MinUptime float64
+	// MinScans is the number of scans required before MinUptime is enforced,
+	// so that new hosts are not penalized for a single failure.
+	MinScans int
+}
+
+// Violated reports whether hr violates the rule, along with a description of
+// the violation.
+func (r AlertRule) Violated(hr HostRecord) (string, bool) {
+	if n := hr.ConsecutiveFailures(); r.MaxConsecutiveFailures > 0 && n >= r.MaxConsecutiveFailures {
+		return fmt.Sprintf("host offline for %v consecutive scans", n), true
+	}
+	if r.MinUptime > 0 && len(hr.History) >= r.MinScans && hr.Uptime() < r.MinUptime {
+		return fmt.Sprintf("host uptime %.1f%% is below %.1f%%", hr.Uptime()*100, r.MinUptime*100), true
+	}
+	return "", false
+}
+
+// ConsecutiveFailures returns the number of most recent scans of the host that
+// failed in a row.
+func (hr HostRecord) ConsecutiveFailures() int {
+	var n int
+	for i := len(hr.History) - 1; i >= 0 && !hr.History[i].Success(); i-- {
+		n++
+	}
+	return n
+}
+
+// An Alert indicates that a host began or stopped violating an AlertRule.
+type Alert struct {
+	Rule      string
+	PublicKey HostPublicKey
+	Timestamp time.Time
+	// Reason describes the violation. It is empty if Resolved is true.
+	Reason string
+	// Resolved is true if the host no longer violates the rule.
+	Resolved bool
+}
+
+// checkAlerts evaluates the Scanner's AlertRules against hr, updating the set
+// of failing hosts and returning any new or resolved Alerts. s.mu must be
+// held.
+func (s *Scanner) checkAlerts(hr *HostRecord) []Alert {
+	var alerts []Alert
+	for _, r := range s.AlertRules {
+		reason, violated := r.Violated(*hr)
+		rules := s.failing[hr.PublicKey]
+		if violated == rules[r.Name] {
+			continue
+		}
+		if violated {
+			if rules == nil {
+				if s.failing == nil {
+					s.failing = make(map[HostPublicKey]map[string]bool)
+				}
+				rules = make(map[string]bool)
+				s.failing[hr.PublicKey] = rules
+			}
+			rules[r.Name] = true
+		} else {
+			delete(rules, r.Name)
+			if len(rules) == 0 {
+				delete(s.failing, hr.PublicKey)
+			}
+		}
+		alerts = append(alerts, Alert{
+			Rule:      r.Name,
+			PublicKey: hr.PublicKey,
+			Timestamp: time.Now(),
+			Reason:    reason,
+			Resolved:  !violated,
+		})
+	}
+	return alerts
+}
+
+// Failing reports whether the specified host currently violates any of the
+// Scanner's AlertRules. Its signature is suitable for use as
+// renterutil.Migrator.IsFailing.
+func (s *Scanner) Failing(pubkey HostPublicKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.failing[pubkey]) > 0
+}
+
+// FailingHosts returns the keys of all hosts that currently violate any of the
+// Scanner's AlertRules, sorted.
+func (s *Scanner) FailingHosts() []HostPublicKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]HostPublicKey, 0, len(s.failing))
+	for pubkey := range s.failing {
+		keys = append(keys, pubkey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	return keys
+}
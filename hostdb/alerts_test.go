@@ -0,0 +1,66 @@
+package hostdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+func TestAlertRules(t *testing.T) {
+	online := true
+	s := NewScanner(0)
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		if !online {
+			return ScannedHost{}, errors.New("host is offline")
+		}
+		return ScannedHost{PublicKey: pubkey}, nil
+	}
+	s.AlertRules = []AlertRule{
+		{Name: "offline", MaxConsecutiveFailures: 2},
+		{Name: "uptime", MinUptime: 0.75, MinScans: 4},
+	}
+	var alerts []Alert
+	s.OnAlert = func(a Alert) {
+		s.Failing(a.PublicKey) // must not deadlock
+		alerts = append(alerts, a)
+	}
+	s.AddHost(testKey(1), "foo:1")
+
+	// two successful scans, then one failure: no alerts
+	s.ScanAll(context.Background())
+	s.ScanAll(context.Background())
+	online = false
+	s.ScanAll(context.Background())
+	if len(alerts) != 0 || s.Failing(testKey(1)) {
+		t.Fatal("host should not be failing yet:", alerts)
+	}
+
+	// second failure triggers both rules
+	s.ScanAll(context.Background())
+	if len(alerts) != 2 || alerts[0].Rule != "offline" || alerts[1].Rule != "uptime" || alerts[0].Resolved {
+		t.Fatal("wrong alerts:", alerts)
+	} else if !s.Failing(testKey(1)) {
+		t.Fatal("host should be failing")
+	} else if fh := s.FailingHosts(); len(fh) != 1 || fh[0] != testKey(1) {
+		t.Fatal("wrong failing hosts:", fh)
+	}
+
+	// coming back online resolves the offline rule, but not the uptime rule
+	online = true
+	s.ScanAll(context.Background())
+	if len(alerts) != 3 || alerts[2].Rule != "offline" || !alerts[2].Resolved {
+		t.Fatal("wrong alerts:", alerts)
+	} else if !s.Failing(testKey(1)) {
+		t.Fatal("host should still be failing")
+	}
+	for i := 0; i < 3; i++ {
+		s.ScanAll(context.Background())
+	}
+	if len(alerts) != 4 || alerts[3].Rule != "uptime" || !alerts[3].Resolved {
+		t.Fatal("wrong alerts:", alerts)
+	} else if s.Failing(testKey(1)) {
+		t.Fatal("host should no longer be failing")
+	}
+}
@@ -0,0 +1,93 @@
+package hostdb
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/encoding"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519"
+)
+
+// Errors returned by ParseAnnouncement.
+var (
+	ErrNotAnnouncement        = errors.New("data is not a host announcement")
+	ErrInvalidAnnouncement    = errors.New("host announcement is malformed")
+	ErrAnnouncementSigInvalid = errors.New("host announcement has invalid signature")
+)
+
+// A HostAnnouncement is a signed declaration by a host of its public key and
+// network address, stored in the ArbitraryData of a transaction.
+type HostAnnouncement struct {
+	NetAddress modules.NetAddress
+	PublicKey  HostPublicKey
+}
+
+// ParseAnnouncement decodes a host announcement and verifies its signature. The
+// announced NetAddress is normalized with NormalizeNetAddress.
+func ParseAnnouncement(b []byte) (HostAnnouncement, error) {
+	if !bytes.HasPrefix(b, modules.PrefixHostAnnouncement[:]) {
+		return HostAnnouncement{}, ErrNotAnnouncement
+	}
+	var ha modules.HostAnnouncement
+	var sig crypto.Signature
+	dec := encoding.NewDecoder(bytes.NewReader(b), len(b)*3)
+	if err := dec.DecodeAll(&ha, &sig); err != nil {
+		return HostAnnouncement{}, ErrInvalidAnnouncement
+	}
+	if ha.PublicKey.Algorithm != types.SignatureEd25519 || len(ha.PublicKey.Key) != ed25519.PublicKeySize {
+		return HostAnnouncement{}, errors.Wrap(ErrInvalidAnnouncement, "unsupported public key")
+	}
+	if !ed25519.PublicKey(ha.PublicKey.Key).VerifyHash(crypto.HashObject(ha), sig[:]) {
+		return HostAnnouncement{}, ErrAnnouncementSigInvalid
+	}
+	addr, err := NormalizeNetAddress(ha.NetAddress)
+	if err != nil {
+		return HostAnnouncement{}, errors.Wrap(ErrInvalidAnnouncement, err.Error())
+	}
+	return HostAnnouncement{
+		NetAddress: addr,
+		PublicKey:  HostKeyFromSiaPublicKey(ha.PublicKey),
+	}, nil
+}
+
+// TransactionAnnouncements returns the valid host announcements contained in
+// txn. Invalid announcements are ignored.
+func TransactionAnnouncements(txn types.Transaction) []HostAnnouncement {
+	var anns []HostAnnouncement
+	for _, arb := range txn.ArbitraryData {
+		if ha, err := ParseAnnouncement(arb); err == nil {
+			anns = append(anns, ha)
+		}
+	}
+	return anns
+}
+
+// NormalizeNetAddress returns the canonical form of addr: surrounding
+// whitespace is removed, hostnames are lowercased and stripped of any trailing
+// dot, and IP addresses are written in their shortest form. An error is
+// returned if addr is not of the form host:port, or if the port is invalid.
+func NormalizeNetAddress(addr modules.NetAddress) (modules.NetAddress, error) {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(string(addr)))
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return "", errors.Errorf("invalid port %q", port)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if host == "" {
+			return "", errors.New("missing host")
+		}
+	}
+	return modules.NetAddress(net.JoinHostPort(host, strconv.Itoa(p))), nil
+}
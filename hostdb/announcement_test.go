@@ -0,0 +1,98 @@
+package hostdb
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+)
+
+func TestParseAnnouncement(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	hpk := HostKeyFromPublicKey(key.PublicKey())
+	ann := announcementTxn(key, " Foo.COM.:9982").ArbitraryData[0]
+
+	ha, err := ParseAnnouncement(ann)
+	if err != nil {
+		t.Fatal(err)
+	} else if ha.PublicKey != hpk || ha.NetAddress != "foo.com:9982" {
+		t.Fatal("wrong announcement:", ha)
+	}
+
+	// corrupt the signature
+	bad := append([]byte(nil), ann...)
+	bad[len(bad)-1] ^= 1
+	if _, err := ParseAnnouncement(bad); err != ErrAnnouncementSigInvalid {
+		t.Fatal("expected ErrAnnouncementSigInvalid, got", err)
+	}
+
+	// wrong prefix
+	bad = append([]byte(nil), ann...)
+	bad[0] ^= 1
+	if _, err := ParseAnnouncement(bad); err != ErrNotAnnouncement {
+		t.Fatal("expected ErrNotAnnouncement, got", err)
+	} else if _, err := ParseAnnouncement(nil); err != ErrNotAnnouncement {
+		t.Fatal("expected ErrNotAnnouncement, got", err)
+	}
+
+	// truncated encoding
+	for _, n := range []int{len(modules.PrefixHostAnnouncement), len(ann) / 2, len(ann) - 1} {
+		if _, err := ParseAnnouncement(ann[:n]); err != ErrInvalidAnnouncement {
+			t.Errorf("expected ErrInvalidAnnouncement for %v bytes, got %v", n, err)
+		}
+	}
+
+	// invalid address
+	ann = announcementTxn(key, "foo.com").ArbitraryData[0]
+	if _, err := ParseAnnouncement(ann); errors.Cause(err) != ErrInvalidAnnouncement {
+		t.Fatal("expected ErrInvalidAnnouncement, got", err)
+	}
+
+	// only valid announcements should be returned from transactions
+	txn := announcementTxn(key, "1.2.3.4:9982")
+	txn.ArbitraryData = append(txn.ArbitraryData, bad, []byte("foo"))
+	if anns := TransactionAnnouncements(txn); len(anns) != 1 || anns[0].NetAddress != "1.2.3.4:9982" {
+		t.Fatal("wrong announcements:", anns)
+	}
+	if anns := TransactionAnnouncements(types.Transaction{}); len(anns) != 0 {
+		t.Fatal("expected no announcements, got", anns)
+	}
+}
+
+func TestNormalizeNetAddress(t *testing.T) {
+	tests := []struct {
+		addr modules.NetAddress
+		exp  modules.NetAddress // empty if an error is expected
+	}{
+		{"foo.com:9982", "foo.com:9982"},
+		{"  FOO.com.:9982\n", "foo.com:9982"},
+		{"1.2.3.4:9982", "1.2.3.4:9982"},
+		{"[::1]:9982", "[::1]:9982"},
+		{"[2001:0DB8:0000:0000:0000:0000:0000:0001]:9982", "[2001:db8::1]:9982"},
+		{"[::ffff:1.2.3.4]:9982", "1.2.3.4:9982"},
+		{"foo.com:09982", "foo.com:9982"},
+		{"foo.com", ""},
+		{"foo.com:", ""},
+		{"::1:9982", ""},
+		{"2001:db8::1", ""},
+		{":9982", ""},
+		{".:9982", ""},
+		{"foo.com:0", ""},
+		{"foo.com:65536", ""},
+		{"foo.com:http", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		addr, err := NormalizeNetAddress(test.addr)
+		if test.exp == "" && err == nil {
+			t.Errorf("expected error for %q, got %q", test.addr, addr)
+		} else if test.exp != "" && err != nil {
+			t.Errorf("unexpected error for %q: %v", test.addr, err)
+		} else if addr != test.exp {
+			t.Errorf("expected %q to normalize to %q, got %q", test.addr, test.exp, addr)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package hostdb
+
+import "net"
+
+// ChurnStats records how often a host's identity and availability have
+// changed. Frequent changes suggest a flaky host; many hosts sharing an IP
+// suggests a Sybil attack.
+type ChurnStats struct {
+	// Announcements is the number of times the host has been announced (or
+	// otherwise added to the Scanner via AddHost).
+	Announcements int
+	// AddressChanges is the number of times the host has been announced at a
+	// different NetAddress, i.e. the number of times its key has been reused
+	// across addresses.
+	AddressChanges int
+	// IPChanges is the number of times the host's address has resolved to a
+	// different IP.
+	IPChanges int
+	// Disappearances is the number of times the host has gone offline after
+	// being online.
+	Disappearances int
+	// SharedIP is the number of other hosts that resolved to the same IP as
+	// this host as of its most recent scan.
+	SharedIP int
+}
+
+// Penalty returns a measure of the host's churn, weighting hosts that share
+// an IP more heavily than other kinds of churn.
+func (cs ChurnStats) Penalty() int {
+	return cs.AddressChanges + cs.IPChanges + cs.Disappearances + 2*cs.SharedIP
+}
+
+// countSharedIP returns the number of hosts other than pubkey whose IP is ip.
+// s.mu must be held.
+func (s *Scanner) countSharedIP(pubkey HostPublicKey, ip net.IP) int {
+	var n int
+	for key, hr := range s.hosts {
+		if key != pubkey && hr.IP != nil && hr.IP.Equal(ip) {
+			n++
+		}
+	}
+	return n
+}
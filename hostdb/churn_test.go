@@ -0,0 +1,50 @@
+package hostdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+func TestChurnStats(t *testing.T) {
+	online := true
+	s := NewScanner(0)
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		if !online && pubkey == testKey(1) {
+			return ScannedHost{}, errors.New("host is offline")
+		}
+		return ScannedHost{PublicKey: pubkey}, nil
+	}
+	s.AddHost(testKey(1), "1.0.0.1:9982")
+	s.AddHost(testKey(2), "1.0.0.1:9983") // same IP
+	s.AddHost(testKey(3), "1.0.0.3:9982")
+	s.ScanAll(context.Background())
+	s.ScanAll(context.Background())
+	if hr, _ := s.Host(testKey(1)); hr.Churn.SharedIP != 1 || hr.Churn.Announcements != 1 {
+		t.Fatal("wrong churn stats:", hr.Churn)
+	} else if hr, _ := s.Host(testKey(3)); hr.Churn != (ChurnStats{Announcements: 1}) {
+		t.Fatal("wrong churn stats:", hr.Churn)
+	}
+
+	// re-announce at a new IP, then go offline
+	s.AddHost(testKey(1), "1.0.0.4:9982")
+	s.ScanAll(context.Background())
+	online = false
+	s.ScanAll(context.Background())
+	exp := ChurnStats{Announcements: 2, AddressChanges: 1, IPChanges: 1, Disappearances: 1}
+	if hr, _ := s.Host(testKey(1)); hr.Churn != exp {
+		t.Fatal("wrong churn stats:", hr.Churn)
+	}
+
+	// churn should reduce the score
+	p := DefaultScorePolicy
+	p.UptimeWeight = 0
+	p.AgeWeight = 0
+	hr1, _ := s.Host(testKey(1))
+	hr3, _ := s.Host(testKey(3))
+	if p.Score(hr1) >= p.Score(hr3) {
+		t.Fatal("churning host should score lower")
+	}
+}
@@ -0,0 +1,117 @@
+package hostdb
+
+import (
+	"gitlab.com/NebulousLabs/Sia/build"
+)
+
+// ProtocolFeatures describes the renter-host protocol features supported by
+// a host.
+type ProtocolFeatures struct {
+	// LoopProtocol indicates support for the renter-host protocol used by
+	// this module. Hosts without it cannot form contracts with us.
+	LoopProtocol bool `json:"loopProtocol,omitempty"`
+	// ReadOnlyLock indicates support for the LockReadOnly RPC.
+	ReadOnlyLock bool `json:"readOnlyLock,omitempty"`
+	// EphemeralAccounts indicates support for the FundAccount,
+	// AccountBalance, and ReadAccount RPCs.
+	EphemeralAccounts bool `json:"ephemeralAccounts,omitempty"`
+	// Compression indicates support for compressed RPC messages.
+	Compression bool `json:"compression,omitempty"`
+	// SettingsRevalidation indicates support for the RevalidateSettings RPC.
+	SettingsRevalidation bool `json:"settingsRevalidation,omitempty"`
+
+	// The maximum number of bytes that may be transferred in a single Write
+	// or Read RPC, respectively.
+	MaxReviseBatchSize   uint64 `json:"maxReviseBatchSize,omitempty"`
+	MaxDownloadBatchSize uint64 `json:"maxDownloadBatchSize,omitempty"`
+}
+
+// Supports reports whether f includes every feature enabled in req. Batch
+// sizes in req are treated as minimums.
+func (f ProtocolFeatures) Supports(req ProtocolFeatures) bool {
+	return (f.LoopProtocol || !req.LoopProtocol) &&
+		(f.ReadOnlyLock || !req.ReadOnlyLock) &&
+		(f.EphemeralAccounts || !req.EphemeralAccounts) &&
+		(f.Compression || !req.Compression) &&
+		(f.SettingsRevalidation || !req.SettingsRevalidation) &&
+		f.MaxReviseBatchSize >= req.MaxReviseBatchSize &&
+		f.MaxDownloadBatchSize >= req.MaxDownloadBatchSize
+}
+
+// A CompatEntry records the features supported by hosts running Version or
+// later.
+type CompatEntry struct {
+	Version  string
+	Features ProtocolFeatures
+}
+
+// defaultBatchSize is the default maximum batch size of siad hosts.
+const defaultBatchSize = 17 * (1 << 20)
+
+// CompatibilityMatrix maps host versions to the protocol features they
+// support. Entries are sorted by Version, and each entry applies to all
+// versions up to the next entry.
+var CompatibilityMatrix = []CompatEntry{
+	{"1.0.0", ProtocolFeatures{
+		MaxReviseBatchSize:   defaultBatchSize,
+		MaxDownloadBatchSize: defaultBatchSize,
+	}},
+	{"1.4.0", ProtocolFeatures{
+		LoopProtocol:         true,
+		MaxReviseBatchSize:   defaultBatchSize,
+		MaxDownloadBatchSize: defaultBatchSize,
+	}},
+	{"1.5.0", ProtocolFeatures{
+		LoopProtocol:         true,
+		ReadOnlyLock:         true,
+		EphemeralAccounts:    true,
+		Compression:          true,
+		SettingsRevalidation: true,
+		MaxReviseBatchSize:   defaultBatchSize,
+		MaxDownloadBatchSize: defaultBatchSize,
+	}},
+}
+
+// FeaturesForVersion returns the features supported by the specified host
+// version, according to CompatibilityMatrix. It returns false if version is
+// not a valid version string or predates every entry.
+func FeaturesForVersion(version string) (ProtocolFeatures, bool) {
+	if !build.IsVersion(version) {
+		return ProtocolFeatures{}, false
+	}
+	var f ProtocolFeatures
+	var ok bool
+	for _, e := range CompatibilityMatrix {
+		if build.VersionCmp(version, e.Version) >= 0 {
+			f, ok = e.Features, true
+		}
+	}
+	return f, ok
+}
+
+// Features returns the features supported by a host with the specified
+// settings. Batch sizes reported by the host take precedence over those in
+// CompatibilityMatrix. It returns false if the host's version is unknown.
+func (s HostSettings) Features() (ProtocolFeatures, bool) {
+	f, ok := FeaturesForVersion(s.Version)
+	if !ok {
+		return ProtocolFeatures{}, false
+	}
+	if s.MaxReviseBatchSize != 0 {
+		f.MaxReviseBatchSize = s.MaxReviseBatchSize
+	}
+	if s.MaxDownloadBatchSize != 0 {
+		f.MaxDownloadBatchSize = s.MaxDownloadBatchSize
+	}
+	return f, true
+}
+
+// Compatible returns a filter, suitable for Scanner.Hosts, that selects hosts
+// whose most recent settings support req. Hosts whose version is unknown are
+// rejected.
+func Compatible(req ProtocolFeatures) func(HostRecord) bool {
+	return func(hr HostRecord) bool {
+		f, ok := hr.Settings.Features()
+		return ok && f.Supports(req)
+	}
+}
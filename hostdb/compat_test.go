@@ -0,0 +1,47 @@
+package hostdb
+
+import "testing"
+
+func TestFeatures(t *testing.T) {
+	if _, ok := FeaturesForVersion("foo"); ok {
+		t.Fatal("expected invalid version to be unknown")
+	} else if _, ok := FeaturesForVersion("0.9.9"); ok {
+		t.Fatal("expected ancient version to be unknown")
+	}
+	if f, _ := FeaturesForVersion("1.3.7"); f.LoopProtocol {
+		t.Fatal("1.3.7 should not support the loop protocol")
+	} else if f, _ := FeaturesForVersion("1.4.3"); !f.LoopProtocol || f.EphemeralAccounts {
+		t.Fatal("wrong features for 1.4.3:", f)
+	} else if f, _ := FeaturesForVersion("1.5.1"); !f.EphemeralAccounts || !f.ReadOnlyLock {
+		t.Fatal("wrong features for 1.5.1:", f)
+	}
+
+	// reported batch sizes take precedence
+	hs := HostSettings{Version: "1.4.1", MaxReviseBatchSize: 1 << 20}
+	f, _ := hs.Features()
+	if f.MaxReviseBatchSize != 1<<20 || f.MaxDownloadBatchSize != defaultBatchSize {
+		t.Fatal("wrong batch sizes:", f)
+	}
+
+	req := ProtocolFeatures{LoopProtocol: true, MaxReviseBatchSize: 4 << 20}
+	if Compatible(req)(HostRecord{Settings: hs}) {
+		t.Fatal("host with small batch size should be incompatible")
+	}
+	hs.MaxReviseBatchSize = 0
+	if !Compatible(req)(HostRecord{Settings: hs}) {
+		t.Fatal("host should be compatible")
+	} else if Compatible(req)(HostRecord{}) {
+		t.Fatal("host with unknown version should be incompatible")
+	}
+
+	filter, err := ParseFilter([]byte(`{"features": {"ephemeralAccounts": true}}`))
+	if err != nil {
+		t.Fatal(err)
+	} else if filter.Match(HostRecord{Settings: hs}) {
+		t.Fatal("filter should reject host without ephemeral accounts")
+	}
+	hs.Version = "1.5.0"
+	if !filter.Match(HostRecord{Settings: hs}) {
+		t.Fatal("filter should accept host with ephemeral accounts")
+	}
+}
@@ -0,0 +1,150 @@
+package hostdb
+
+import (
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+// A ContractOutcome describes how a contract with a host ended.
+type ContractOutcome int
+
+// Possible ContractOutcome values.
+const (
+	// OutcomeActive indicates that the contract has not yet ended.
+	OutcomeActive ContractOutcome = iota
+	// OutcomeCompleted indicates that the host submitted a valid storage
+	// proof.
+	OutcomeCompleted
+	// OutcomeMissedProof indicates that the host failed to submit a valid
+	// storage proof.
+	OutcomeMissedProof
+	// OutcomeRenewed indicates that the contract was renewed with the same
+	// host.
+	OutcomeRenewed
+	// OutcomeAbandoned indicates that the renter stopped using the contract
+	// before it ended, e.g. because the host was unreliable.
+	OutcomeAbandoned
+)
+
+// String implements fmt.Stringer.
+func (o ContractOutcome) String() string {
+	switch o {
+	case OutcomeActive:
+		return "active"
+	case OutcomeCompleted:
+		return "completed"
+	case OutcomeMissedProof:
+		return "missed proof"
+	case OutcomeRenewed:
+		return "renewed"
+	case OutcomeAbandoned:
+		return "abandoned"
+	default:
+		return "unknown"
+	}
+}
+
+// A ContractHistoryEntry records a contract formed with a host.
+type ContractHistoryEntry struct {
+	ID       types.FileContractID
+	Formed   time.Time
+	Resolved time.Time // zero if the contract is active
+	Outcome  ContractOutcome
+	// Spent is the total amount paid to the host via the contract.
+	Spent types.Currency
+	// Lost is the value of the data lost when the contract ended, e.g. the
+	// amount spent storing data that the host failed to prove.
+	Lost types.Currency
+}
+
+// ContractStats summarize a host's contract history.
+type ContractStats struct {
+	Formed      int
+	Completed   int
+	MissedProof int
+	Renewed     int
+	Abandoned   int
+	Spent       types.Currency
+	Lost        types.Currency
+}
+
+// ContractStats returns a summary of the host's contract history.
+func (hr HostRecord) ContractStats() ContractStats {
+	var cs ContractStats
+	for _, c := range hr.Contracts {
+		cs.Formed++
+		switch c.Outcome {
+		case OutcomeCompleted:
+			cs.Completed++
+		case OutcomeMissedProof:
+			cs.MissedProof++
+		case OutcomeRenewed:
+			cs.Renewed++
+		case OutcomeAbandoned:
+			cs.Abandoned++
+		}
+		cs.Spent = cs.Spent.Add(c.Spent)
+		cs.Lost = cs.Lost.Add(c.Lost)
+	}
+	return cs
+}
+
+func findContract(hr *HostRecord, id types.FileContractID) *ContractHistoryEntry {
+	for i := range hr.Contracts {
+		if hr.Contracts[i].ID == id {
+			return &hr.Contracts[i]
+		}
+	}
+	return nil
+}
+
+// RecordContract records that a contract was formed with the specified host.
+// It is a no-op if the host is unknown or the contract is already recorded.
+func (s *Scanner) RecordContract(pubkey HostPublicKey, id types.FileContractID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hr, ok := s.hosts[pubkey]
+	if !ok || findContract(hr, id) != nil {
+		return
+	}
+	hr.Contracts = append(hr.Contracts, ContractHistoryEntry{
+		ID:     id,
+		Formed: time.Now(),
+	})
+}
+
+// RecordContractSpending adds amount to the total spent on the specified
+// contract.
+func (s *Scanner) RecordContractSpending(pubkey HostPublicKey, id types.FileContractID, amount types.Currency) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hr, ok := s.hosts[pubkey]; ok {
+		if c := findContract(hr, id); c != nil {
+			c.Spent = c.Spent.Add(amount)
+		}
+	}
+}
+
+// ResolveContract records the outcome of the specified contract, along with
+// the value of any data lost. Resolving a contract as OutcomeActive reverts a
+// previous resolution, e.g. after a reorg.
+func (s *Scanner) ResolveContract(pubkey HostPublicKey, id types.FileContractID, outcome ContractOutcome, lost types.Currency) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hr, ok := s.hosts[pubkey]
+	if !ok {
+		return
+	}
+	c := findContract(hr, id)
+	if c == nil {
+		hr.Contracts = append(hr.Contracts, ContractHistoryEntry{ID: id})
+		c = &hr.Contracts[len(hr.Contracts)-1]
+	}
+	c.Outcome, c.Lost = outcome, lost
+	if outcome == OutcomeActive {
+		c.Resolved = time.Time{}
+	} else {
+		c.Resolved = time.Now()
+	}
+}
@@ -0,0 +1,42 @@
+package hostdb
+
+import (
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+func TestContractHistory(t *testing.T) {
+	s := NewScanner(0)
+	s.AddHost(testKey(1), "1.0.0.1:9982")
+	s.AddHost(testKey(2), "1.0.0.2:9982")
+	for i := byte(0); i < 3; i++ {
+		id := types.FileContractID{i}
+		s.RecordContract(testKey(1), id)
+		s.RecordContract(testKey(1), id) // duplicate
+		s.RecordContractSpending(testKey(1), id, types.NewCurrency64(10))
+		s.RecordContract(testKey(2), id)
+	}
+	s.ResolveContract(testKey(1), types.FileContractID{0}, OutcomeCompleted, types.ZeroCurrency)
+	s.ResolveContract(testKey(1), types.FileContractID{1}, OutcomeRenewed, types.ZeroCurrency)
+	s.ResolveContract(testKey(1), types.FileContractID{2}, OutcomeMissedProof, types.NewCurrency64(7))
+
+	hr, _ := s.Host(testKey(1))
+	cs := hr.ContractStats()
+	if cs.Formed != 3 || cs.Completed != 1 || cs.Renewed != 1 || cs.MissedProof != 1 {
+		t.Fatal("wrong stats:", cs)
+	} else if !cs.Spent.Equals64(30) || !cs.Lost.Equals64(7) {
+		t.Fatal("wrong funds:", cs.Spent, cs.Lost)
+	}
+	hr2, _ := s.Host(testKey(2))
+	if Score(hr) >= Score(hr2) {
+		t.Fatal("host with missed proof should score lower")
+	}
+
+	// a reorg can revert the missed proof
+	s.ResolveContract(testKey(1), types.FileContractID{2}, OutcomeActive, types.ZeroCurrency)
+	hr, _ = s.Host(testKey(1))
+	if cs := hr.ContractStats(); cs.MissedProof != 0 || !cs.Lost.IsZero() || !hr.Contracts[2].Resolved.IsZero() {
+		t.Fatal("missed proof was not reverted:", cs)
+	}
+}
@@ -0,0 +1,125 @@
+package hostdb
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+// A Dialer dials hosts that may be reachable at multiple addresses, e.g. an
+// IPv4 address, an IPv6 address, and an onion address. Addresses are attempted
+// in order, and the address that succeeded is remembered and attempted first
+// on subsequent dials. A Dialer is safe for concurrent use.
+type Dialer struct {
+	// Timeout limits the duration of each attempt. If zero, attempts are
+	// limited only by the context passed to Dial.
+	Timeout time.Duration
+
+	// DialContext is used to dial each address. If nil, a net.Dialer is used.
+	// Callers dialing onion addresses should supply a function that dials via
+	// a Tor proxy.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Resolver, if non-nil, is used to resolve each address before dialing
+	// it. Onion addresses are never resolved.
+	Resolver *CachingResolver
+
+	// HostList, if non-nil, is consulted before and after dialing each host.
+	// If the host's public key or remote IP is not permitted, Dial fails.
+	HostList *HostList
+
+	mu   sync.Mutex
+	last map[HostPublicKey]modules.NetAddress
+}
+
+// LastAddress returns the address at which the host was most recently dialed
+// successfully, if any.
+func (d *Dialer) LastAddress(hostKey HostPublicKey) (modules.NetAddress, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	addr, ok := d.last[hostKey]
+	return addr, ok
+}
+
+func (d *Dialer) setLastAddress(hostKey HostPublicKey, addr modules.NetAddress) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last == nil {
+		d.last = make(map[HostPublicKey]modules.NetAddress)
+	}
+	if addr == "" {
+		delete(d.last, hostKey)
+	} else {
+		d.last[hostKey] = addr
+	}
+}
+
+func (d *Dialer) dialAddr(ctx context.Context, addr modules.NetAddress) (net.Conn, error) {
+	if d.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	dial := d.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	if d.Resolver != nil && !isOnion(addr) {
+		res, err := d.Resolver.Resolve(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = res.Addr
+	}
+	return dial(ctx, "tcp", string(addr))
+}
+
+// Dial dials the host at one of addrs, returning the connection and the
+// address that succeeded. If the host was previously dialed successfully, its
+// last address is attempted first, regardless of whether it appears in addrs.
+func (d *Dialer) Dial(ctx context.Context, hostKey HostPublicKey, addrs []modules.NetAddress) (net.Conn, modules.NetAddress, error) {
+	if last, ok := d.LastAddress(hostKey); ok {
+		ordered := []modules.NetAddress{last}
+		for _, addr := range addrs {
+			if addr != last {
+				ordered = append(ordered, addr)
+			}
+		}
+		addrs = ordered
+	}
+	if len(addrs) == 0 {
+		return nil, "", errors.New("no addresses to dial")
+	} else if d.HostList != nil {
+		if err := d.HostList.Check(hostKey, nil); err != nil {
+			return nil, "", err
+		}
+	}
+
+	var errs []string
+	for _, addr := range addrs {
+		conn, err := d.dialAddr(ctx, addr)
+		if err == nil && d.HostList != nil {
+			if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				if err = d.HostList.Check(hostKey, tcpAddr.IP); err != nil {
+					conn.Close()
+					return nil, "", err
+				}
+			}
+		}
+		if err == nil {
+			d.setLastAddress(hostKey, addr)
+			return conn, addr, nil
+		}
+		errs = append(errs, err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	d.setLastAddress(hostKey, "")
+	return nil, "", errors.Errorf("could not dial host: %v", strings.Join(errs, "; "))
+}
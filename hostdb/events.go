@@ -0,0 +1,140 @@
+package hostdb
+
+import (
+	"math"
+	"time"
+)
+
+// An EventType identifies the kind of change described by an Event.
+type EventType int
+
+// Possible EventType values.
+const (
+	// EventHostDiscovered is emitted when a host is first added to the
+	// Scanner.
+	EventHostDiscovered EventType = iota
+	// EventHostOffline is emitted when a scan of a previously-online host
+	// fails.
+	EventHostOffline
+	// EventHostOnline is emitted when a scan succeeds after the host was
+	// previously offline or had never been scanned.
+	EventHostOnline
+	// EventSettingsChanged is emitted when a host reports new settings. As in
+	// the settings history, changes to RemainingStorage and RevisionNumber
+	// alone are ignored.
+	EventSettingsChanged
+	// EventScoreChanged is emitted when a host's score changes significantly.
+	EventScoreChanged
+)
+
+// String implements fmt.Stringer.
+func (t EventType) String() string {
+	switch t {
+	case EventHostDiscovered:
+		return "discovered"
+	case EventHostOffline:
+		return "offline"
+	case EventHostOnline:
+		return "online"
+	case EventSettingsChanged:
+		return "settings changed"
+	case EventScoreChanged:
+		return "score changed"
+	default:
+		return "unknown"
+	}
+}
+
+// An Event describes a change to a host known to a Scanner.
+type Event struct {
+	Type      EventType
+	PublicKey HostPublicKey
+	Timestamp time.Time
+	// Record is a snapshot of the host's record immediately after the event.
+	Record HostRecord
+	// OldScore and NewScore are only set for EventScoreChanged. OldScore is
+	// zero if the host had not been scored before.
+	OldScore, NewScore float64
+}
+
+// minScoreChange is the minimum relative change in a host's score that
+// triggers an EventScoreChanged.
+const minScoreChange = 0.05
+
+type subscription struct {
+	ch chan Event
+}
+
+// Subscribe returns a channel on which the Scanner will deliver Events, and a
+// function that ends the subscription and closes the channel. The channel has
+// the specified buffer size; if the buffer is full when an event occurs, the
+// event is dropped rather than blocking the Scanner, so subscribers should
+// drain the channel promptly.
+//
+// Score changes are computed using the Scanner's ScorePolicy, or
+// DefaultScorePolicy if it is nil.
+func (s *Scanner) Subscribe(buffer int) (<-chan Event, func()) {
+	sub := &subscription{ch: make(chan Event, buffer)}
+	s.mu.Lock()
+	s.subs = append(s.subs, sub)
+	s.mu.Unlock()
+	return sub.ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i := range s.subs {
+			if s.subs[i] == sub {
+				s.subs = append(s.subs[:i], s.subs[i+1:]...)
+				close(sub.ch)
+				return
+			}
+		}
+	}
+}
+
+// emit delivers an event to all subscribers. s.mu must be held.
+func (s *Scanner) emit(t EventType, hr *HostRecord) {
+	s.emitEvent(Event{
+		Type:      t,
+		PublicKey: hr.PublicKey,
+		Timestamp: time.Now(),
+		Record:    copyRecord(hr),
+	})
+}
+
+func (s *Scanner) emitEvent(e Event) {
+	for _, sub := range s.subs {
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
+
+// rescore recomputes the host's score and emits an EventScoreChanged if it
+// changed significantly. s.mu must be held.
+func (s *Scanner) rescore(hr *HostRecord) {
+	if len(s.subs) == 0 {
+		return
+	}
+	if s.scores == nil {
+		s.scores = make(map[HostPublicKey]float64)
+	}
+	p := DefaultScorePolicy
+	if s.ScorePolicy != nil {
+		p = *s.ScorePolicy
+	}
+	newScore := p.Score(*hr)
+	oldScore, ok := s.scores[hr.PublicKey]
+	if ok && math.Abs(newScore-oldScore) <= minScoreChange*oldScore {
+		return
+	}
+	s.scores[hr.PublicKey] = newScore
+	s.emitEvent(Event{
+		Type:      EventScoreChanged,
+		PublicKey: hr.PublicKey,
+		Timestamp: time.Now(),
+		Record:    copyRecord(hr),
+		OldScore:  oldScore,
+		NewScore:  newScore,
+	})
+}
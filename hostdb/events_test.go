@@ -0,0 +1,71 @@
+package hostdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+func TestSubscribe(t *testing.T) {
+	online := true
+	price := types.NewCurrency64(1)
+	s := NewScanner(0)
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		if !online {
+			return ScannedHost{}, errors.New("host is offline")
+		}
+		host := ScannedHost{PublicKey: pubkey}
+		host.Version = "1.4.1"
+		host.AcceptingContracts = true
+		host.StoragePrice = price
+		return host, nil
+	}
+	events, unsubscribe := s.Subscribe(100)
+	expect := func(types ...EventType) {
+		t.Helper()
+		for _, typ := range types {
+			select {
+			case e := <-events:
+				if e.Type != typ || e.PublicKey != testKey(1) {
+					t.Fatalf("expected %v event, got %v", typ, e.Type)
+				}
+			default:
+				t.Fatalf("expected %v event, got none", typ)
+			}
+		}
+		select {
+		case e := <-events:
+			t.Fatalf("unexpected %v event", e.Type)
+		default:
+		}
+	}
+
+	s.AddHost(testKey(1), "foo:1")
+	expect(EventHostDiscovered)
+	s.AddHost(testKey(1), "foo:2")
+	expect()
+
+	s.ScanAll(context.Background())
+	expect(EventHostOnline, EventScoreChanged)
+	s.ScanAll(context.Background())
+	expect()
+
+	// a large price increase should change both the settings and the score
+	price = types.SiacoinPrecision.Mul64(1e6)
+	s.ScanAll(context.Background())
+	expect(EventSettingsChanged, EventScoreChanged)
+
+	online = false
+	s.ScanAll(context.Background())
+	if e := <-events; e.Type != EventHostOffline || e.Record.Online() {
+		t.Fatal("expected offline event, got", e.Type)
+	}
+
+	unsubscribe()
+	for range events {
+	}
+	s.AddHost(testKey(2), "bar:1") // should not panic
+}
@@ -0,0 +1,124 @@
+package hostdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/build"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+// A Filter is a predicate on HostRecords. Each non-zero field of a Filter
+// imposes a constraint, and a host matches the Filter if it satisfies every
+// constraint. Filters can be composed via the All, Any, and Not fields.
+//
+// Filters are serialized as JSON, so that host selection policies can be
+// stored in configuration files; see ParseFilter.
+type Filter struct {
+	AcceptingContracts  bool            `json:"acceptingContracts,omitempty"`
+	MaxStoragePrice     *types.Currency `json:"maxStoragePrice,omitempty"`
+	MaxUploadPrice      *types.Currency `json:"maxUploadPrice,omitempty"`
+	MaxDownloadPrice    *types.Currency `json:"maxDownloadPrice,omitempty"`
+	MaxContractPrice    *types.Currency `json:"maxContractPrice,omitempty"`
+	MinCollateral       *types.Currency `json:"minCollateral,omitempty"`
+	MinRemainingStorage uint64          `json:"minRemainingStorage,omitempty"`
+	MinVersion          string          `json:"minVersion,omitempty"`
+	MinUptime           float64         `json:"minUptime,omitempty"`
+	Online              bool            `json:"online,omitempty"`
+
+	// Features, if non-nil, restricts hosts to those whose version supports
+	// the specified protocol features. Hosts with an unknown version do not
+	// match.
+	Features *ProtocolFeatures `json:"features,omitempty"`
+
+	// Countries, if non-empty, restricts hosts to the specified ISO 3166-1
+	// country codes. Hosts with an unknown country do not match.
+	Countries []string `json:"countries,omitempty"`
+
+	All []Filter `json:"all,omitempty"`
+	Any []Filter `json:"any,omitempty"`
+	Not *Filter  `json:"not,omitempty"`
+}
+
+// Match reports whether hr satisfies the Filter. Match can be passed directly
+// to Scanner.Hosts.
+func (f Filter) Match(hr HostRecord) bool {
+	s := hr.Settings
+	exceeds := func(c types.Currency, max *types.Currency) bool {
+		return max != nil && c.Cmp(*max) > 0
+	}
+	switch {
+	case f.AcceptingContracts && !s.AcceptingContracts,
+		exceeds(s.StoragePrice, f.MaxStoragePrice),
+		exceeds(s.UploadBandwidthPrice, f.MaxUploadPrice),
+		exceeds(s.DownloadBandwidthPrice, f.MaxDownloadPrice),
+		exceeds(s.ContractPrice, f.MaxContractPrice),
+		f.MinCollateral != nil && s.Collateral.Cmp(*f.MinCollateral) < 0,
+		s.RemainingStorage < f.MinRemainingStorage,
+		f.MinVersion != "" && (!build.IsVersion(s.Version) || build.VersionCmp(s.Version, f.MinVersion) < 0),
+		hr.Uptime() < f.MinUptime,
+		f.Online && !hr.Online(),
+		f.Features != nil && !Compatible(*f.Features)(hr):
+		return false
+	}
+	if len(f.Countries) > 0 {
+		var ok bool
+		for _, c := range f.Countries {
+			ok = ok || (hr.Country != "" && strings.EqualFold(c, hr.Country))
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, sub := range f.All {
+		if !sub.Match(hr) {
+			return false
+		}
+	}
+	if len(f.Any) > 0 {
+		var ok bool
+		for _, sub := range f.Any {
+			ok = ok || sub.Match(hr)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return f.Not == nil || !f.Not.Match(hr)
+}
+
+// ParseFilter parses a JSON-encoded Filter. Unlike json.Unmarshal, unknown
+// fields are rejected, so that typos in configuration files are not silently
+// ignored.
+func ParseFilter(b []byte) (Filter, error) {
+	var f Filter
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return Filter{}, errors.Wrap(err, "could not parse filter")
+	} else if err := f.validate(); err != nil {
+		return Filter{}, errors.Wrap(err, "invalid filter")
+	}
+	return f, nil
+}
+
+func (f Filter) validate() error {
+	if f.MinVersion != "" && !build.IsVersion(f.MinVersion) {
+		return errors.Errorf("invalid version %q", f.MinVersion)
+	} else if f.MinUptime < 0 || f.MinUptime > 1 {
+		return errors.Errorf("minimum uptime %v is not in [0, 1]", f.MinUptime)
+	}
+	for _, subs := range [][]Filter{f.All, f.Any} {
+		for _, sub := range subs {
+			if err := sub.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if f.Not != nil {
+		return f.Not.validate()
+	}
+	return nil
+}
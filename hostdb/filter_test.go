@@ -0,0 +1,66 @@
+package hostdb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+func TestFilter(t *testing.T) {
+	hr := HostRecord{
+		Location: Location{Country: "DE"},
+		Settings: HostSettings{
+			AcceptingContracts: true,
+			StoragePrice:       types.NewCurrency64(100),
+			Collateral:         types.NewCurrency64(200),
+			RemainingStorage:   1 << 40,
+			Version:            "1.4.1",
+		},
+		History: []ScanResult{{}},
+	}
+
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{`{}`, true},
+		{`{"acceptingContracts": true, "online": true, "minUptime": 1}`, true},
+		{`{"maxStoragePrice": "100", "minCollateral": "200"}`, true},
+		{`{"maxStoragePrice": "99"}`, false},
+		{`{"minCollateral": "201"}`, false},
+		{`{"minRemainingStorage": 1099511627777}`, false},
+		{`{"minVersion": "1.4.1"}`, true},
+		{`{"minVersion": "1.4.2"}`, false},
+		{`{"countries": ["us", "de"]}`, true},
+		{`{"countries": ["us"]}`, false},
+		{`{"any": [{"countries": ["us"]}, {"minVersion": "1.4.0"}]}`, true},
+		{`{"all": [{"countries": ["us"]}, {"minVersion": "1.4.0"}]}`, false},
+		{`{"not": {"countries": ["de"]}}`, false},
+	}
+	for _, test := range tests {
+		f, err := ParseFilter([]byte(test.filter))
+		if err != nil {
+			t.Fatal(err)
+		} else if f.Match(hr) != test.match {
+			t.Errorf("filter %v: expected %v, got %v", test.filter, test.match, !test.match)
+		}
+		// filters should survive a round trip
+		js, _ := json.Marshal(f)
+		if f2, err := ParseFilter(js); err != nil {
+			t.Fatal(err)
+		} else if f2.Match(hr) != test.match {
+			t.Errorf("filter %s did not round-trip", js)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"maxStorgePrice": "100"}`,
+		`{"minVersion": "foo"}`,
+		`{"not": {"minUptime": 2}}`,
+	} {
+		if _, err := ParseFilter([]byte(bad)); err == nil {
+			t.Errorf("expected error for filter %v", bad)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package hostdb
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+// A Location describes where a host is located, both geographically and
+// within the network.
+type Location struct {
+	Country  string // ISO 3166-1 code
+	ASN      uint32 // autonomous system number
+	Provider string // e.g. the name of a hosting provider
+}
+
+// A Geolocator determines the Location of an IP address, e.g. using a local
+// GeoIP database or a remote lookup service.
+type Geolocator interface {
+	Locate(ctx context.Context, ip net.IP) (Location, error)
+}
+
+// resolveHost resolves addr to an IP address.
+func resolveHost(ctx context.Context, addr modules.NetAddress) (net.IP, error) {
+	host, _, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return nil, err
+	} else if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not resolve host address")
+	} else if len(ips) == 0 {
+		return nil, errors.New("host address did not resolve to any IPs")
+	}
+	return ips[0].IP, nil
+}
+
+// literalIP returns the IP contained in addr, or nil if addr does not contain
+// a literal IP.
+func literalIP(addr modules.NetAddress) net.IP {
+	host, _, _ := net.SplitHostPort(string(addr))
+	return net.ParseIP(host)
+}
+
+// withIP returns addr with its host replaced by ip.
+func withIP(addr modules.NetAddress, ip net.IP) modules.NetAddress {
+	_, port, _ := net.SplitHostPort(string(addr))
+	return modules.NetAddress(net.JoinHostPort(ip.String(), port))
+}
+
+// A DiversityPolicy limits the number of hosts selected from any one network
+// or jurisdiction, so that a single outage or legal action cannot affect too
+// many hosts at once. A limit of zero means no limit. Hosts with an unknown
+// Country or ASN are not subject to the corresponding limit.
+type DiversityPolicy struct {
+	MaxPerCountry  int
+	MaxPerASN      int
+	MaxPerProvider int
+}
+
+// SelectDiverse selects up to n hosts from ranked, in order, skipping any host
+// that would cause p to be violated. Typically ranked is the output of
+// Scanner.RankedHosts.
+func (p DiversityPolicy) SelectDiverse(ranked []RankedHost, n int) []RankedHost {
+	countries := make(map[string]int)
+	asns := make(map[uint32]int)
+	providers := make(map[string]int)
+	exceeds := func(count, max int) bool {
+		return max > 0 && count >= max
+	}
+	var selected []RankedHost
+	for _, h := range ranked {
+		if len(selected) >= n {
+			break
+		}
+		loc := h.Location
+		if (loc.Country != "" && exceeds(countries[loc.Country], p.MaxPerCountry)) ||
+			(loc.ASN != 0 && exceeds(asns[loc.ASN], p.MaxPerASN)) ||
+			(loc.Provider != "" && exceeds(providers[loc.Provider], p.MaxPerProvider)) {
+			continue
+		}
+		countries[loc.Country]++
+		asns[loc.ASN]++
+		providers[loc.Provider]++
+		selected = append(selected, h)
+	}
+	return selected
+}
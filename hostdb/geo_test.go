@@ -0,0 +1,65 @@
+package hostdb
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+type mapGeolocator map[string]Location
+
+func (g mapGeolocator) Locate(ctx context.Context, ip net.IP) (Location, error) {
+	loc, ok := g[ip.String()]
+	if !ok {
+		return Location{}, errors.New("unknown IP")
+	}
+	return loc, nil
+}
+
+func TestSelectDiverse(t *testing.T) {
+	s := NewScanner(0)
+	s.Geolocator = mapGeolocator{
+		"1.0.0.1": {Country: "US", ASN: 1},
+		"1.0.0.2": {Country: "US", ASN: 1},
+		"1.0.0.3": {Country: "US", ASN: 2},
+		"2.0.0.1": {Country: "DE", ASN: 3},
+	}
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		return ScannedHost{HostSettings: HostSettings{AcceptingContracts: true}}, nil
+	}
+	s.AddHost(testKey(1), "1.0.0.1:9982")
+	s.AddHost(testKey(2), "1.0.0.2:9982")
+	s.AddHost(testKey(3), "1.0.0.3:9982")
+	s.AddHost(testKey(4), "2.0.0.1:9982")
+	s.AddHost(testKey(5), "3.0.0.1:9982") // unknown location
+	s.ScanAll(context.Background())
+
+	if hr, _ := s.Host(testKey(4)); hr.Country != "DE" || hr.ASN != 3 {
+		t.Fatal("host was not geolocated:", hr.Location)
+	} else if hr, _ := s.Host(testKey(5)); hr.Location != (Location{}) {
+		t.Fatal("host should have unknown location:", hr.Location)
+	}
+
+	// all hosts have the same score, so they are ranked by public key
+	ranked := s.RankedHosts(DefaultScorePolicy, -1)
+	p := DiversityPolicy{MaxPerCountry: 2, MaxPerASN: 1}
+	var keys []HostPublicKey
+	for _, h := range p.SelectDiverse(ranked, 10) {
+		keys = append(keys, h.PublicKey)
+	}
+	exp := []HostPublicKey{testKey(1), testKey(3), testKey(4), testKey(5)}
+	if len(keys) != len(exp) {
+		t.Fatal("wrong selection:", keys)
+	}
+	for i := range exp {
+		if keys[i] != exp[i] {
+			t.Fatal("wrong selection:", keys)
+		}
+	}
+	if sel := p.SelectDiverse(ranked, 1); len(sel) != 1 {
+		t.Fatal("expected 1 host, got", len(sel))
+	}
+}
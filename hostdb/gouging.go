@@ -0,0 +1,155 @@
+package hostdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+// ErrPriceGouging is returned by GougingVerdict.Err when a host is gouging.
+var ErrPriceGouging = errors.New("host is price gouging")
+
+// gougingPrices are the prices considered by a GougingPolicy.
+var gougingPrices = []struct {
+	name string
+	get  func(HostSettings) types.Currency
+}{
+	{"contract price", func(s HostSettings) types.Currency { return s.ContractPrice }},
+	{"storage price", func(s HostSettings) types.Currency { return s.StoragePrice }},
+	{"upload bandwidth price", func(s HostSettings) types.Currency { return s.UploadBandwidthPrice }},
+	{"download bandwidth price", func(s HostSettings) types.Currency { return s.DownloadBandwidthPrice }},
+	{"base RPC price", func(s HostSettings) types.Currency { return s.BaseRPCPrice }},
+	{"sector access price", func(s HostSettings) types.Currency { return s.SectorAccessPrice }},
+}
+
+// pricesEqual reports whether a and b have the same prices and collateral.
+func pricesEqual(a, b HostSettings) bool {
+	for _, p := range gougingPrices {
+		if !p.get(a).Equals(p.get(b)) {
+			return false
+		}
+	}
+	return a.Collateral.Equals(b.Collateral)
+}
+
+// A GougingPolicy determines when a host's prices are considered gouging. A
+// zero value for any field disables the corresponding check.
+type GougingPolicy struct {
+	// MaxIncrease is the maximum factor by which any price may increase
+	// relative to the host's previous settings; e.g. 2 permits prices to
+	// double.
+	MaxIncrease float64
+	// MaxMedianMultiple is the maximum factor by which any price may exceed
+	// the network median. Likewise, the host's collateral must be at least
+	// the network median divided by MaxMedianMultiple.
+	MaxMedianMultiple float64
+}
+
+// DefaultGougingPolicy is a reasonable GougingPolicy for most renters.
+var DefaultGougingPolicy = GougingPolicy{
+	MaxIncrease:       2,
+	MaxMedianMultiple: 5,
+}
+
+// A GougingVerdict is the result of evaluating a host's settings against a
+// GougingPolicy. If Gouging is true, Reasons explains why.
+type GougingVerdict struct {
+	Gouging bool
+	Reasons []string
+}
+
+// Err returns an error wrapping ErrPriceGouging if the host is gouging, or nil
+// otherwise.
+func (v GougingVerdict) Err() error {
+	if !v.Gouging {
+		return nil
+	}
+	return errors.Wrap(ErrPriceGouging, strings.Join(v.Reasons, "; "))
+}
+
+// Evaluate compares a host's current settings to its previous settings and to
+// the network median settings. If either previous or median is the zero
+// value, the corresponding comparison is skipped.
+func (p GougingPolicy) Evaluate(current, previous, median HostSettings) GougingVerdict {
+	var v GougingVerdict
+	flag := func(format string, args ...interface{}) {
+		v.Gouging = true
+		v.Reasons = append(v.Reasons, fmt.Sprintf(format, args...))
+	}
+	for _, gp := range gougingPrices {
+		cur, prev, med := gp.get(current), gp.get(previous), gp.get(median)
+		if p.MaxIncrease > 0 && !prev.IsZero() && cur.Cmp(prev.MulFloat(p.MaxIncrease)) > 0 {
+			flag("%v increased from %v H to %v H", gp.name, prev, cur)
+		}
+		if p.MaxMedianMultiple > 0 && !med.IsZero() && cur.Cmp(med.MulFloat(p.MaxMedianMultiple)) > 0 {
+			flag("%v (%v H) is more than %vx the network median (%v H)", gp.name, cur, p.MaxMedianMultiple, med)
+		}
+	}
+	if p.MaxMedianMultiple > 0 && !median.Collateral.IsZero() && current.Collateral.MulFloat(p.MaxMedianMultiple).Cmp(median.Collateral) < 0 {
+		flag("collateral (%v H) is less than 1/%v of the network median (%v H)", current.Collateral, p.MaxMedianMultiple, median.Collateral)
+	}
+	return v
+}
+
+func medianCurrency(cs []types.Currency) types.Currency {
+	if len(cs) == 0 {
+		return types.ZeroCurrency
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Cmp(cs[j]) < 0 })
+	return cs[len(cs)/2]
+}
+
+// MedianSettings returns HostSettings whose prices and collateral are the
+// medians of those of all online hosts. Other fields are left empty.
+func (s *Scanner) MedianSettings() HostSettings {
+	hosts := s.Hosts(HostRecord.Online)
+	column := func(get func(HostSettings) types.Currency) types.Currency {
+		cs := make([]types.Currency, len(hosts))
+		for i, hr := range hosts {
+			cs[i] = get(hr.Settings)
+		}
+		return medianCurrency(cs)
+	}
+	return HostSettings{
+		ContractPrice:          column(func(s HostSettings) types.Currency { return s.ContractPrice }),
+		StoragePrice:           column(func(s HostSettings) types.Currency { return s.StoragePrice }),
+		UploadBandwidthPrice:   column(func(s HostSettings) types.Currency { return s.UploadBandwidthPrice }),
+		DownloadBandwidthPrice: column(func(s HostSettings) types.Currency { return s.DownloadBandwidthPrice }),
+		BaseRPCPrice:           column(func(s HostSettings) types.Currency { return s.BaseRPCPrice }),
+		SectorAccessPrice:      column(func(s HostSettings) types.Currency { return s.SectorAccessPrice }),
+		Collateral:             column(func(s HostSettings) types.Currency { return s.Collateral }),
+	}
+}
+
+// Gouging evaluates the specified host's current settings against p,
+// comparing them to the host's previous settings and to the network medians.
+// It returns false if the host is unknown.
+func (s *Scanner) Gouging(p GougingPolicy, pubkey HostPublicKey) (GougingVerdict, bool) {
+	hr, ok := s.Host(pubkey)
+	if !ok {
+		return GougingVerdict{}, false
+	}
+	return p.Evaluate(hr.Settings, hr.PreviousSettings, s.MedianSettings()), true
+}
+
+// GougingCheck returns a function that evaluates settings reported by the
+// specified host against p. Unlike Gouging, the settings need not have been
+// obtained by the Scanner; they are compared to the most recent settings
+// recorded by the Scanner, or to the host's previous settings if the prices
+// are unchanged. The returned function is suitable for use as
+// proto.PriceLimits.SettingsCheck.
+func (s *Scanner) GougingCheck(p GougingPolicy, pubkey HostPublicKey) func(HostSettings) error {
+	return func(settings HostSettings) error {
+		var prev HostSettings
+		if hr, ok := s.Host(pubkey); ok {
+			prev = hr.Settings
+			if pricesEqual(prev, settings) {
+				prev = hr.PreviousSettings
+			}
+		}
+		return p.Evaluate(settings, prev, s.MedianSettings()).Err()
+	}
+}
@@ -0,0 +1,53 @@
+package hostdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+func TestGouging(t *testing.T) {
+	settings := map[HostPublicKey]HostSettings{
+		testKey(1): {StoragePrice: types.NewCurrency64(10), Collateral: types.NewCurrency64(20)},
+		testKey(2): {StoragePrice: types.NewCurrency64(11), Collateral: types.NewCurrency64(20)},
+		testKey(3): {StoragePrice: types.NewCurrency64(12), Collateral: types.NewCurrency64(20)},
+	}
+	s := NewScanner(0)
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		return ScannedHost{HostSettings: settings[pubkey]}, nil
+	}
+	for key := range settings {
+		s.AddHost(key, "foo:1")
+	}
+	s.ScanAll(context.Background())
+	if med := s.MedianSettings(); !med.StoragePrice.Equals64(11) {
+		t.Fatal("wrong median storage price:", med.StoragePrice)
+	}
+	if v, _ := s.Gouging(DefaultGougingPolicy, testKey(1)); v.Gouging {
+		t.Fatal("host should not be gouging:", v.Reasons)
+	}
+
+	// triple the host's price
+	settings[testKey(1)] = HostSettings{StoragePrice: types.NewCurrency64(30), Collateral: types.NewCurrency64(20)}
+	s.ScanAll(context.Background())
+	if hr, _ := s.Host(testKey(1)); !hr.PreviousSettings.StoragePrice.Equals64(10) {
+		t.Fatal("previous settings were not recorded")
+	}
+	v, _ := s.Gouging(DefaultGougingPolicy, testKey(1))
+	if !v.Gouging || len(v.Reasons) != 1 {
+		t.Fatal("host should be gouging due to a sudden increase:", v.Reasons)
+	} else if errors.Cause(v.Err()) != ErrPriceGouging {
+		t.Fatal("expected ErrPriceGouging, got", v.Err())
+	}
+
+	// settings fetched elsewhere can also be checked
+	check := s.GougingCheck(DefaultGougingPolicy, testKey(2))
+	if err := check(settings[testKey(2)]); err != nil {
+		t.Fatal(err)
+	} else if err := check(HostSettings{StoragePrice: types.NewCurrency64(100)}); err == nil {
+		t.Fatal("expected gouging error")
+	}
+}
@@ -0,0 +1,141 @@
+package hostdb
+
+import (
+	"math/big"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+// maxSettingsHistory is the maximum number of SettingsSnapshots retained for
+// each host.
+const maxSettingsHistory = 256
+
+// A SettingsSnapshot is a set of HostSettings observed at a particular time.
+type SettingsSnapshot struct {
+	Timestamp time.Time
+	Settings  HostSettings
+}
+
+// A SettingsField identifies a price or collateral field of HostSettings.
+type SettingsField int
+
+// Possible SettingsField values.
+const (
+	FieldContractPrice SettingsField = iota
+	FieldStoragePrice
+	FieldUploadBandwidthPrice
+	FieldDownloadBandwidthPrice
+	FieldBaseRPCPrice
+	FieldSectorAccessPrice
+	FieldCollateral
+	FieldMaxCollateral
+)
+
+// Value returns the value of the field in s.
+func (f SettingsField) Value(s HostSettings) types.Currency {
+	switch f {
+	case FieldContractPrice:
+		return s.ContractPrice
+	case FieldStoragePrice:
+		return s.StoragePrice
+	case FieldUploadBandwidthPrice:
+		return s.UploadBandwidthPrice
+	case FieldDownloadBandwidthPrice:
+		return s.DownloadBandwidthPrice
+	case FieldBaseRPCPrice:
+		return s.BaseRPCPrice
+	case FieldSectorAccessPrice:
+		return s.SectorAccessPrice
+	case FieldCollateral:
+		return s.Collateral
+	case FieldMaxCollateral:
+		return s.MaxCollateral
+	default:
+		panic("unknown SettingsField")
+	}
+}
+
+// SettingsAt returns the settings that the host reported at time t, i.e. the
+// most recent snapshot taken at or before t.
+func (hr HostRecord) SettingsAt(t time.Time) (HostSettings, bool) {
+	for i := len(hr.SettingsHistory) - 1; i >= 0; i-- {
+		if !hr.SettingsHistory[i].Timestamp.After(t) {
+			return hr.SettingsHistory[i].Settings, true
+		}
+	}
+	return HostSettings{}, false
+}
+
+// A Trend describes how a SettingsField changed over a period of time.
+type Trend struct {
+	Start, End         types.Currency
+	StartTime, EndTime time.Time
+	// Changes is the number of times the field changed during the period.
+	Changes int
+}
+
+// Change returns the relative change in the field over the period, e.g. 0.5
+// for a 50% increase. If Start is zero, Change returns 0.
+func (t Trend) Change() float64 {
+	if t.Start.IsZero() {
+		return 0
+	}
+	r := new(big.Rat).SetFrac(t.End.Big(), t.Start.Big())
+	f, _ := r.Float64()
+	return f - 1
+}
+
+// Trend returns the Trend of the specified field over the period ending now
+// and beginning window ago. If the host's history does not extend back that
+// far, the period begins with the oldest snapshot. If the host has no
+// history, Trend returns false.
+func (hr HostRecord) Trend(field SettingsField, window time.Duration) (Trend, bool) {
+	if len(hr.SettingsHistory) == 0 {
+		return Trend{}, false
+	}
+	now := time.Now()
+	start := now.Add(-window)
+	first := 0
+	for i, snap := range hr.SettingsHistory {
+		if !snap.Timestamp.After(start) {
+			first = i
+		}
+	}
+	snaps := hr.SettingsHistory[first:]
+	t := Trend{
+		Start:     field.Value(snaps[0].Settings),
+		End:       field.Value(snaps[len(snaps)-1].Settings),
+		StartTime: snaps[0].Timestamp,
+		EndTime:   now,
+	}
+	if t.StartTime.Before(start) {
+		t.StartTime = start
+	}
+	for i := 1; i < len(snaps); i++ {
+		if !field.Value(snaps[i].Settings).Equals(field.Value(snaps[i-1].Settings)) {
+			t.Changes++
+		}
+	}
+	return t, true
+}
+
+// recordSettings appends a snapshot to the host's settings history, unless
+// the settings are identical to the most recent snapshot. Changes to
+// RemainingStorage and RevisionNumber alone are not recorded, since they
+// change constantly. It reports whether a snapshot was appended.
+func (hr *HostRecord) recordSettings(t time.Time, s HostSettings) bool {
+	if n := len(hr.SettingsHistory); n > 0 {
+		last := hr.SettingsHistory[n-1].Settings
+		if pricesEqual(last, s) && last.MaxCollateral.Equals(s.MaxCollateral) &&
+			last.Version == s.Version && last.AcceptingContracts == s.AcceptingContracts &&
+			last.NetAddress == s.NetAddress && last.MaxDuration == s.MaxDuration && last.WindowSize == s.WindowSize {
+			return false
+		}
+	}
+	hr.SettingsHistory = append(hr.SettingsHistory, SettingsSnapshot{t, s})
+	if len(hr.SettingsHistory) > maxSettingsHistory {
+		hr.SettingsHistory = append(hr.SettingsHistory[:0], hr.SettingsHistory[len(hr.SettingsHistory)-maxSettingsHistory:]...)
+	}
+	return true
+}
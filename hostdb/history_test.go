@@ -0,0 +1,48 @@
+package hostdb
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+func TestSettingsHistory(t *testing.T) {
+	day := 24 * time.Hour
+	now := time.Now()
+	settings := func(storagePrice uint64, remaining uint64) HostSettings {
+		return HostSettings{
+			StoragePrice:     types.NewCurrency64(storagePrice),
+			Collateral:       types.NewCurrency64(20),
+			RemainingStorage: remaining,
+		}
+	}
+
+	var hr HostRecord
+	hr.recordSettings(now.Add(-60*day), settings(10, 100))
+	hr.recordSettings(now.Add(-50*day), settings(10, 90)) // not recorded
+	hr.recordSettings(now.Add(-40*day), settings(12, 80))
+	hr.recordSettings(now.Add(-20*day), settings(15, 70))
+	hr.recordSettings(now.Add(-10*day), settings(18, 60))
+	if len(hr.SettingsHistory) != 4 {
+		t.Fatal("expected 4 snapshots, got", len(hr.SettingsHistory))
+	}
+
+	if s, ok := hr.SettingsAt(now.Add(-30 * day)); !ok || !s.StoragePrice.Equals64(12) {
+		t.Fatal("wrong settings 30 days ago:", s.StoragePrice)
+	} else if _, ok := hr.SettingsAt(now.Add(-90 * day)); ok {
+		t.Fatal("should not have settings from before the first snapshot")
+	}
+
+	trend, ok := hr.Trend(FieldStoragePrice, 30*day)
+	if !ok {
+		t.Fatal("expected trend")
+	} else if !trend.Start.Equals64(12) || !trend.End.Equals64(18) || trend.Changes != 2 {
+		t.Fatal("wrong trend:", trend)
+	} else if trend.Change() != 0.5 {
+		t.Fatal("wrong relative change:", trend.Change())
+	}
+	if trend, _ := hr.Trend(FieldCollateral, 365*day); trend.Changes != 0 || trend.Change() != 0 {
+		t.Fatal("collateral should be unchanged:", trend)
+	}
+}
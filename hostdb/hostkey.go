@@ -0,0 +1,204 @@
+package hostdb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/encoding"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519"
+)
+
+// A KeyAlgorithm identifies the signature scheme of a HostPublicKey.
+type KeyAlgorithm uint8
+
+// Supported KeyAlgorithms. The zero value denotes an unset key.
+const (
+	AlgorithmEd25519 KeyAlgorithm = 1
+)
+
+// String implements fmt.Stringer.
+func (a KeyAlgorithm) String() string {
+	switch a {
+	case AlgorithmEd25519:
+		return "ed25519"
+	default:
+		return "unknown"
+	}
+}
+
+// A HostPublicKey is the public key announced on the blockchain by a host. A
+// HostPublicKey can be assumed to uniquely identify a host. Hosts should
+// always be identified by their public key, since other identifying
+// information (like a host's current IP address) may change at a later time.
+//
+// The string format of a HostPublicKey is:
+//
+//    specifier:keydata
+//
+// Where specifier identifies the signature scheme used and keydata contains
+// the hex-encoded bytes of the actual key. Currently, all public keys on Sia
+// use the Ed25519 signature scheme, specified as "ed25519".
+//
+// HostPublicKeys are comparable, and the zero value denotes an unset key.
+// They are marshalled to JSON (and other text formats) in their string form,
+// and encoded with the Sia encoding as a string, so data encoded when
+// HostPublicKey was itself a string remains readable.
+type HostPublicKey struct {
+	alg KeyAlgorithm
+	key [32]byte
+}
+
+// ParseHostPublicKey parses a HostPublicKey from its string form.
+func ParseHostPublicKey(s string) (HostPublicKey, error) {
+	specLen := strings.IndexByte(s, ':')
+	if specLen < 0 {
+		return HostPublicKey{}, errors.Errorf("invalid host key %q: missing specifier", s)
+	} else if s[:specLen] != "ed25519" {
+		return HostPublicKey{}, errors.Errorf("invalid host key %q: unsupported algorithm", s)
+	}
+	hpk := HostPublicKey{alg: AlgorithmEd25519}
+	if n, err := hex.Decode(hpk.key[:], []byte(s[specLen+1:])); err != nil || n != len(hpk.key) {
+		return HostPublicKey{}, errors.Errorf("invalid host key %q: malformed key data", s)
+	}
+	return hpk, nil
+}
+
+// MustParseHostPublicKey is like ParseHostPublicKey, but panics if s is
+// invalid. It is intended for use with hard-coded keys.
+func MustParseHostPublicKey(s string) HostPublicKey {
+	hpk, err := ParseHostPublicKey(s)
+	if err != nil {
+		panic(err)
+	}
+	return hpk
+}
+
+// IsZero reports whether hpk is unset.
+func (hpk HostPublicKey) IsZero() bool {
+	return hpk == HostPublicKey{}
+}
+
+// String returns the string form of hpk. The zero value is represented as
+// the empty string.
+func (hpk HostPublicKey) String() string {
+	if hpk.IsZero() {
+		return ""
+	}
+	return hpk.alg.String() + ":" + hpk.Key()
+}
+
+// Algorithm returns the signature scheme of hpk.
+func (hpk HostPublicKey) Algorithm() KeyAlgorithm {
+	return hpk.alg
+}
+
+// Key returns the hex-encoded keydata portion of a HostPublicKey.
+func (hpk HostPublicKey) Key() string {
+	return hex.EncodeToString(hpk.key[:])
+}
+
+// ShortKey returns the keydata portion of a HostPublicKey, truncated to 8
+// characters. This is 32 bits of entropy, which is sufficient to prevent
+// collisions in typical usage scenarios. A ShortKey is the preferred way to
+// reference a HostPublicKey in user interfaces.
+func (hpk HostPublicKey) ShortKey() string {
+	return hpk.Key()[:8]
+}
+
+// Ed25519 returns the HostPublicKey as an ed25519.PublicKey. The returned key
+// is invalid if hpk is not a Ed25519 key.
+func (hpk HostPublicKey) Ed25519() ed25519.PublicKey {
+	return ed25519.PublicKey(hpk.key[:])
+}
+
+// SiaPublicKey returns the HostPublicKey as a types.SiaPublicKey.
+func (hpk HostPublicKey) SiaPublicKey() types.SiaPublicKey {
+	return types.SiaPublicKey{
+		Algorithm: types.SignatureEd25519,
+		Key:       append([]byte(nil), hpk.key[:]...),
+	}
+}
+
+// VerifyHash verifies that hash was signed by the public key.
+func (hpk HostPublicKey) VerifyHash(hash crypto.Hash, sig []byte) bool {
+	if hpk.alg != AlgorithmEd25519 {
+		panic("unsupported signature algorithm")
+	}
+	return hpk.Ed25519().VerifyHash(hash, sig)
+}
+
+// Less reports whether hpk sorts before other.
+func (hpk HostPublicKey) Less(other HostPublicKey) bool {
+	if hpk.alg != other.alg {
+		return hpk.alg < other.alg
+	}
+	return bytes.Compare(hpk.key[:], other.key[:]) < 0
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (hpk HostPublicKey) MarshalText() ([]byte, error) {
+	return []byte(hpk.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (hpk *HostPublicKey) UnmarshalText(b []byte) (err error) {
+	if len(b) == 0 {
+		*hpk = HostPublicKey{}
+		return nil
+	}
+	*hpk, err = ParseHostPublicKey(string(b))
+	return
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The binary form is the
+// algorithm byte followed by the key data.
+func (hpk HostPublicKey) MarshalBinary() ([]byte, error) {
+	return append([]byte{byte(hpk.alg)}, hpk.key[:]...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (hpk *HostPublicKey) UnmarshalBinary(b []byte) error {
+	if len(b) != 1+len(hpk.key) {
+		return errors.New("invalid host key: wrong length")
+	} else if KeyAlgorithm(b[0]) != AlgorithmEd25519 {
+		return errors.New("invalid host key: unsupported algorithm")
+	}
+	hpk.alg = KeyAlgorithm(b[0])
+	copy(hpk.key[:], b[1:])
+	return nil
+}
+
+// MarshalSia implements encoding.SiaMarshaler.
+func (hpk HostPublicKey) MarshalSia(w io.Writer) error {
+	return encoding.NewEncoder(w).Encode(hpk.String())
+}
+
+// UnmarshalSia implements encoding.SiaUnmarshaler.
+func (hpk *HostPublicKey) UnmarshalSia(r io.Reader) error {
+	var s string
+	if err := encoding.NewDecoder(r, 256).Decode(&s); err != nil {
+		return err
+	}
+	return hpk.UnmarshalText([]byte(s))
+}
+
+// HostKeyFromPublicKey converts an ed25519.PublicKey to a HostPublicKey.
+func HostKeyFromPublicKey(pk ed25519.PublicKey) (hpk HostPublicKey) {
+	hpk.alg = AlgorithmEd25519
+	copy(hpk.key[:], pk)
+	return
+}
+
+// HostKeyFromSiaPublicKey converts an types.SiaPublicKey to a HostPublicKey.
+// The zero HostPublicKey is returned if spk is not a valid Ed25519 key.
+func HostKeyFromSiaPublicKey(spk types.SiaPublicKey) HostPublicKey {
+	if spk.Algorithm != types.SignatureEd25519 || len(spk.Key) != ed25519.PublicKeySize {
+		return HostPublicKey{}
+	}
+	return HostKeyFromPublicKey(spk.Key)
+}
@@ -0,0 +1,89 @@
+package hostdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/encoding"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519"
+)
+
+// testKey returns a HostPublicKey whose key bytes are all b.
+func testKey(b byte) HostPublicKey {
+	return HostKeyFromPublicKey(bytes.Repeat([]byte{b}, ed25519.PublicKeySize))
+}
+
+func TestParseHostPublicKey(t *testing.T) {
+	s := "ed25519:" + strings.Repeat("ab", 32)
+	hpk, err := ParseHostPublicKey(s)
+	if err != nil {
+		t.Fatal(err)
+	} else if hpk.String() != s || hpk.Algorithm() != AlgorithmEd25519 {
+		t.Fatal("wrong key:", hpk)
+	} else if hpk.ShortKey() != "abababab" || hpk.Key() != strings.Repeat("ab", 32) {
+		t.Fatal("wrong key data:", hpk.ShortKey(), hpk.Key())
+	} else if HostKeyFromSiaPublicKey(hpk.SiaPublicKey()) != hpk {
+		t.Fatal("SiaPublicKey conversion did not round-trip")
+	}
+
+	for _, bad := range []string{
+		"",
+		strings.Repeat("ab", 32),
+		"ed25519:" + strings.Repeat("ab", 31),
+		"ed25519:" + strings.Repeat("zz", 32),
+		"secp256k1:" + strings.Repeat("ab", 32),
+	} {
+		if _, err := ParseHostPublicKey(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	if !HostKeyFromSiaPublicKey(types.SiaPublicKey{Algorithm: types.SignatureEd25519, Key: []byte{1}}).IsZero() {
+		t.Error("expected zero key for invalid SiaPublicKey")
+	}
+}
+
+func TestHostPublicKeyMarshalling(t *testing.T) {
+	hpk := testKey(7)
+
+	// JSON uses the string form, including as a map key
+	js, err := json.Marshal(map[HostPublicKey]HostPublicKey{hpk: hpk})
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := `{"` + hpk.String() + `":"` + hpk.String() + `"}`; string(js) != exp {
+		t.Fatal("wrong JSON:", string(js))
+	}
+	var m map[HostPublicKey]HostPublicKey
+	if err := json.Unmarshal(js, &m); err != nil {
+		t.Fatal(err)
+	} else if m[hpk] != hpk {
+		t.Fatal("JSON did not round-trip")
+	}
+
+	// Sia encoding is compatible with the old string representation
+	if !bytes.Equal(encoding.Marshal(hpk), encoding.Marshal(hpk.String())) {
+		t.Fatal("Sia encoding differs from string encoding")
+	}
+	var dec HostPublicKey
+	if err := encoding.Unmarshal(encoding.Marshal(hpk.String()), &dec); err != nil {
+		t.Fatal(err)
+	} else if dec != hpk {
+		t.Fatal("Sia encoding did not round-trip")
+	}
+
+	// binary
+	b, _ := hpk.MarshalBinary()
+	if len(b) != 33 {
+		t.Fatal("wrong binary length:", len(b))
+	}
+	dec = HostPublicKey{}
+	if err := dec.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	} else if dec != hpk {
+		t.Fatal("binary encoding did not round-trip")
+	} else if err := dec.UnmarshalBinary(b[1:]); err == nil {
+		t.Fatal("expected error for truncated key")
+	}
+}
@@ -0,0 +1,225 @@
+package hostdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by HostList.Check.
+var (
+	ErrHostBlocked    = errors.New("host is blocked")
+	ErrHostNotAllowed = errors.New("host is not on the allowlist")
+)
+
+// A ListEntry is an entry in a HostList. Its Target is either a host public
+// key (e.g. "ed25519:...") or an IP address or CIDR subnet (e.g. "1.2.3.0/24").
+type ListEntry struct {
+	Target  string    `json:"target"`
+	Reason  string    `json:"reason,omitempty"`
+	Expires time.Time `json:"expires,omitempty"` // zero means never
+}
+
+func (e ListEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+// parseTarget returns the HostPublicKey or subnet denoted by target.
+func parseTarget(target string) (HostPublicKey, *net.IPNet, error) {
+	if strings.HasPrefix(target, "ed25519:") {
+		hpk, err := ParseHostPublicKey(target)
+		if err != nil {
+			return HostPublicKey{}, nil, err
+		}
+		return hpk, nil, nil
+	}
+	if !strings.Contains(target, "/") {
+		ip := net.ParseIP(target)
+		if ip == nil {
+			return HostPublicKey{}, nil, errors.Errorf("invalid target %q", target)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return HostPublicKey{}, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, subnet, err := net.ParseCIDR(target)
+	if err != nil {
+		return HostPublicKey{}, nil, errors.Errorf("invalid target %q", target)
+	}
+	return HostPublicKey{}, subnet, nil
+}
+
+func (e ListEntry) matches(pubkey HostPublicKey, ip net.IP) bool {
+	hpk, subnet, err := parseTarget(e.Target)
+	if err != nil {
+		return false
+	} else if subnet != nil {
+		return ip != nil && subnet.Contains(ip)
+	}
+	return hpk == pubkey
+}
+
+// A HostList is a persistent blocklist and allowlist of hosts. A host is
+// permitted if it does not match any unexpired blocklist entry, and either the
+// allowlist is empty or the host matches an unexpired allowlist entry. A
+// HostList is safe for concurrent use.
+//
+// HostLists are consulted by Scanner queries and by Dialer.
+type HostList struct {
+	filename string
+
+	mu      sync.Mutex
+	blocked []ListEntry
+	allowed []ListEntry
+}
+
+// persistHostList is the on-disk representation of a HostList.
+type persistHostList struct {
+	Blocked []ListEntry `json:"blocked"`
+	Allowed []ListEntry `json:"allowed"`
+}
+
+// Check returns an error if the host with the specified public key and IP is
+// not permitted. ip may be nil if it is not known, in which case subnet
+// entries are not considered.
+func (hl *HostList) Check(pubkey HostPublicKey, ip net.IP) error {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	now := time.Now()
+	for _, e := range hl.blocked {
+		if !e.expired(now) && e.matches(pubkey, ip) {
+			if e.Reason != "" {
+				return errors.Wrap(ErrHostBlocked, e.Reason)
+			}
+			return ErrHostBlocked
+		}
+	}
+	var anyAllowed bool
+	for _, e := range hl.allowed {
+		if !e.expired(now) {
+			if e.matches(pubkey, ip) {
+				return nil
+			}
+			anyAllowed = true
+		}
+	}
+	if anyAllowed {
+		return ErrHostNotAllowed
+	}
+	return nil
+}
+
+// Block adds an entry to the blocklist, replacing any existing blocklist
+// entry with the same target.
+func (hl *HostList) Block(target, reason string, expires time.Time) error {
+	return hl.add(&hl.blocked, ListEntry{target, reason, expires})
+}
+
+// Allow adds an entry to the allowlist, replacing any existing allowlist
+// entry with the same target.
+func (hl *HostList) Allow(target, reason string, expires time.Time) error {
+	return hl.add(&hl.allowed, ListEntry{target, reason, expires})
+}
+
+func (hl *HostList) add(list *[]ListEntry, e ListEntry) error {
+	if _, _, err := parseTarget(e.Target); err != nil {
+		return err
+	}
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	*list = append(removeTarget(*list, e.Target), e)
+	return hl.save()
+}
+
+func removeTarget(list []ListEntry, target string) []ListEntry {
+	filtered := list[:0]
+	for _, e := range list {
+		if e.Target != target {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// Remove removes all entries with the specified target from both the
+// blocklist and the allowlist.
+func (hl *HostList) Remove(target string) error {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	hl.blocked = removeTarget(hl.blocked, target)
+	hl.allowed = removeTarget(hl.allowed, target)
+	return hl.save()
+}
+
+// Entries returns the unexpired entries of the blocklist and allowlist.
+func (hl *HostList) Entries() (blocked, allowed []ListEntry) {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	now := time.Now()
+	for _, e := range hl.blocked {
+		if !e.expired(now) {
+			blocked = append(blocked, e)
+		}
+	}
+	for _, e := range hl.allowed {
+		if !e.expired(now) {
+			allowed = append(allowed, e)
+		}
+	}
+	return
+}
+
+// save writes the HostList to disk, discarding expired entries. hl.mu must
+// be held.
+func (hl *HostList) save() error {
+	if hl.filename == "" {
+		return nil
+	}
+	now := time.Now()
+	prune := func(list []ListEntry) []ListEntry {
+		pruned := list[:0]
+		for _, e := range list {
+			if !e.expired(now) {
+				pruned = append(pruned, e)
+			}
+		}
+		return pruned
+	}
+	hl.blocked, hl.allowed = prune(hl.blocked), prune(hl.allowed)
+	js, _ := json.MarshalIndent(persistHostList{hl.blocked, hl.allowed}, "", "\t")
+	if err := ioutil.WriteFile(hl.filename+"_tmp", js, 0600); err != nil {
+		return errors.Wrap(err, "could not write host list")
+	} else if err := os.Rename(hl.filename+"_tmp", hl.filename); err != nil {
+		return errors.Wrap(err, "could not atomically replace host list")
+	}
+	return nil
+}
+
+// NewHostList returns a HostList persisted to the specified file, loading any
+// existing entries. If filename is empty, the HostList is not persisted.
+func NewHostList(filename string) (*HostList, error) {
+	hl := &HostList{filename: filename}
+	if filename == "" {
+		return hl, nil
+	}
+	js, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return hl, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read host list")
+	}
+	var p persistHostList
+	if err := json.Unmarshal(js, &p); err != nil {
+		return nil, errors.Wrap(err, "could not decode host list")
+	}
+	hl.blocked, hl.allowed = p.Blocked, p.Allowed
+	return hl, nil
+}
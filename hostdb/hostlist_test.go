@@ -0,0 +1,133 @@
+package hostdb
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+)
+
+func randomHostKey() HostPublicKey {
+	return HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)).PublicKey())
+}
+
+func TestHostList(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "hostlist.json")
+
+	hl, err := NewHostList(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, bad := randomHostKey(), randomHostKey()
+	if err := hl.Block(bad.String(), "misbehaved", time.Time{}); err != nil {
+		t.Fatal(err)
+	} else if err := hl.Block("10.0.0.0/8", "", time.Time{}); err != nil {
+		t.Fatal(err)
+	} else if err := hl.Block("1.2.3.4", "", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	} else if err := hl.Block("not a target", "", time.Time{}); err == nil {
+		t.Fatal("expected error for invalid target")
+	}
+
+	check := func(hl *HostList) {
+		t.Helper()
+		if err := hl.Check(good, net.ParseIP("1.2.3.4")); err != nil {
+			t.Fatal("expired entry should be ignored:", err)
+		} else if err := hl.Check(bad, nil); errors.Cause(err) != ErrHostBlocked {
+			t.Fatal("expected ErrHostBlocked, got", err)
+		} else if err := hl.Check(good, net.ParseIP("10.1.2.3")); err != ErrHostBlocked {
+			t.Fatal("expected ErrHostBlocked, got", err)
+		}
+	}
+	check(hl)
+
+	// reload from disk
+	hl, err = NewHostList(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(hl)
+	if blocked, allowed := hl.Entries(); len(blocked) != 2 || len(allowed) != 0 {
+		t.Fatal("wrong entries:", blocked, allowed)
+	}
+
+	// once the allowlist is non-empty, only allowed hosts are permitted
+	if err := hl.Allow(good.String(), "", time.Time{}); err != nil {
+		t.Fatal(err)
+	} else if err := hl.Check(good, nil); err != nil {
+		t.Fatal(err)
+	} else if err := hl.Check(randomHostKey(), nil); err != ErrHostNotAllowed {
+		t.Fatal("expected ErrHostNotAllowed, got", err)
+	} else if err := hl.Remove(good.String()); err != nil {
+		t.Fatal(err)
+	} else if err := hl.Check(randomHostKey(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// blocked hosts should be excluded from Scanner queries
+	s := NewScanner(0)
+	s.HostList = hl
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		return ScannedHost{}, nil
+	}
+	s.AddHost(good, "10.0.0.1:9982")
+	s.AddHost(bad, "1.2.3.4:9982")
+	s.AddHost(randomHostKey(), "1.2.3.4:9982")
+	if hosts := s.Hosts(nil); len(hosts) != 2 {
+		t.Fatal("expected 2 hosts before scanning, got", len(hosts))
+	}
+	s.ScanAll(context.Background())
+	if hosts := s.Hosts(nil); len(hosts) != 1 {
+		t.Fatal("expected 1 host after scanning, got", len(hosts))
+	}
+}
+
+func TestDialerHostList(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addrs := []modules.NetAddress{modules.NetAddress(l.Addr().String())}
+
+	hl, _ := NewHostList("")
+	d := &Dialer{HostList: hl}
+	hostKey := randomHostKey()
+	conn, _, err := d.Dial(context.Background(), hostKey, addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	hl.Block("127.0.0.0/8", "", time.Time{})
+	if _, _, err := d.Dial(context.Background(), hostKey, addrs); err != ErrHostBlocked {
+		t.Fatal("expected ErrHostBlocked, got", err)
+	}
+	hl.Remove("127.0.0.0/8")
+	hl.Block(hostKey.String(), "", time.Time{})
+	if _, _, err := d.Dial(context.Background(), hostKey, addrs); err != ErrHostBlocked {
+		t.Fatal("expected ErrHostBlocked, got", err)
+	}
+}
@@ -0,0 +1,231 @@
+package hostdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+// An ImportedHost is a host obtained from a third-party host list.
+type ImportedHost struct {
+	PublicKey  HostPublicKey
+	NetAddress modules.NetAddress
+	// Settings is nil if the source did not provide the host's settings.
+	Settings *HostSettings
+	// Uptime is the host's uptime as estimated by the source, in [0, 1], or
+	// -1 if unknown.
+	Uptime  float64
+	Country string
+}
+
+// An Importer fetches a list of hosts from a third-party source.
+type Importer interface {
+	Import(ctx context.Context) ([]ImportedHost, error)
+}
+
+// Merge adds imported hosts to the Scanner. Data obtained by the Scanner
+// itself takes precedence: the settings and location of a host are only
+// imported if the host has never been scanned successfully, and imported
+// hosts are scanned as usual. Imported uptime is not merged, since it cannot
+// be meaningfully combined with the Scanner's own history.
+func (s *Scanner) Merge(hosts []ImportedHost) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = make(map[HostPublicKey]*HostRecord)
+	}
+	for _, ih := range hosts {
+		addr, err := NormalizeNetAddress(ih.NetAddress)
+		if err != nil || ih.PublicKey.IsZero() {
+			continue
+		}
+		hr, ok := s.hosts[ih.PublicKey]
+		if !ok {
+			hr = &HostRecord{
+				PublicKey:  ih.PublicKey,
+				NetAddress: addr,
+				FirstSeen:  time.Now(),
+			}
+			s.hosts[ih.PublicKey] = hr
+		}
+		if hr.Uptime() == 0 {
+			if ih.Settings != nil {
+				hr.Settings = *ih.Settings
+			}
+			if hr.Country == "" {
+				hr.Country = ih.Country
+			}
+		}
+		if !ok {
+			s.emit(EventHostDiscovered, hr)
+		}
+	}
+}
+
+// Import fetches hosts from imp and merges them into the Scanner.
+func (s *Scanner) Import(ctx context.Context, imp Importer) error {
+	hosts, err := imp.Import(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not import hosts")
+	}
+	s.Merge(hosts)
+	return nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%v returned %v", url, resp.Status)
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "could not decode response")
+}
+
+// SiaCentralImporter imports hosts from the SiaCentral API.
+type SiaCentralImporter struct {
+	// BaseURL defaults to "https://api.siacentral.com/v2".
+	BaseURL string
+	Client  *http.Client
+}
+
+type siaCentralSettings struct {
+	AcceptingContracts   bool              `json:"accepting_contracts"`
+	MaxDownloadBatchSize uint64            `json:"max_download_batch_size"`
+	MaxDuration          types.BlockHeight `json:"max_duration"`
+	MaxReviseBatchSize   uint64            `json:"max_revise_batch_size"`
+	NetAddress           string            `json:"net_address"`
+	RemainingStorage     uint64            `json:"remaining_storage"`
+	SectorSize           uint64            `json:"sector_size"`
+	TotalStorage         uint64            `json:"total_storage"`
+	UnlockHash           types.UnlockHash  `json:"unlock_hash"`
+	WindowSize           types.BlockHeight `json:"window_size"`
+	Collateral           types.Currency    `json:"collateral"`
+	MaxCollateral        types.Currency    `json:"max_collateral"`
+	BaseRPCPrice         types.Currency    `json:"base_rpc_price"`
+	ContractPrice        types.Currency    `json:"contract_price"`
+	DownloadPrice        types.Currency    `json:"download_price"`
+	SectorAccessPrice    types.Currency    `json:"sector_access_price"`
+	StoragePrice         types.Currency    `json:"storage_price"`
+	UploadPrice          types.Currency    `json:"upload_price"`
+	RevisionNumber       uint64            `json:"revision_number"`
+	Version              string            `json:"version"`
+}
+
+// Import implements Importer.
+func (sc SiaCentralImporter) Import(ctx context.Context) ([]ImportedHost, error) {
+	base := sc.BaseURL
+	if base == "" {
+		base = "https://api.siacentral.com/v2"
+	}
+	var resp struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+		Hosts   []struct {
+			PublicKey       string              `json:"public_key"`
+			NetAddress      string              `json:"net_address"`
+			EstimatedUptime float64             `json:"estimated_uptime"` // percent
+			CountryCode     string              `json:"country_code"`
+			Settings        *siaCentralSettings `json:"settings"`
+		} `json:"hosts"`
+	}
+	if err := getJSON(ctx, sc.Client, strings.TrimSuffix(base, "/")+"/hosts/list?showinactive=false", &resp); err != nil {
+		return nil, err
+	} else if resp.Type != "" && resp.Type != "success" {
+		return nil, errors.Errorf("SiaCentral returned error: %v", resp.Message)
+	}
+	hosts := make([]ImportedHost, 0, len(resp.Hosts))
+	for _, h := range resp.Hosts {
+		hpk, err := ParseHostPublicKey(h.PublicKey)
+		if err != nil {
+			continue
+		}
+		ih := ImportedHost{
+			PublicKey:  hpk,
+			NetAddress: modules.NetAddress(h.NetAddress),
+			Uptime:     h.EstimatedUptime / 100,
+			Country:    h.CountryCode,
+		}
+		if s := h.Settings; s != nil {
+			ih.Settings = &HostSettings{
+				AcceptingContracts:     s.AcceptingContracts,
+				MaxDownloadBatchSize:   s.MaxDownloadBatchSize,
+				MaxDuration:            s.MaxDuration,
+				MaxReviseBatchSize:     s.MaxReviseBatchSize,
+				NetAddress:             modules.NetAddress(s.NetAddress),
+				RemainingStorage:       s.RemainingStorage,
+				SectorSize:             s.SectorSize,
+				TotalStorage:           s.TotalStorage,
+				UnlockHash:             s.UnlockHash,
+				WindowSize:             s.WindowSize,
+				Collateral:             s.Collateral,
+				MaxCollateral:          s.MaxCollateral,
+				BaseRPCPrice:           s.BaseRPCPrice,
+				ContractPrice:          s.ContractPrice,
+				DownloadBandwidthPrice: s.DownloadPrice,
+				SectorAccessPrice:      s.SectorAccessPrice,
+				StoragePrice:           s.StoragePrice,
+				UploadBandwidthPrice:   s.UploadPrice,
+				RevisionNumber:         s.RevisionNumber,
+				Version:                s.Version,
+			}
+		}
+		hosts = append(hosts, ih)
+	}
+	return hosts, nil
+}
+
+// SiaStatsImporter imports hosts from the SiaStats API. SiaStats does not
+// provide full host settings, so only addresses, uptime, and location are
+// imported.
+type SiaStatsImporter struct {
+	// BaseURL defaults to "https://siastats.info:3510/hosts-api".
+	BaseURL string
+	Client  *http.Client
+}
+
+// Import implements Importer.
+func (ss SiaStatsImporter) Import(ctx context.Context) ([]ImportedHost, error) {
+	base := ss.BaseURL
+	if base == "" {
+		base = "https://siastats.info:3510/hosts-api"
+	}
+	var resp []struct {
+		PubKey      string  `json:"pubkey"`
+		IP          string  `json:"ip"`
+		Uptime      float64 `json:"uptime"` // percent
+		CountryCode string  `json:"countryCode"`
+	}
+	if err := getJSON(ctx, ss.Client, strings.TrimSuffix(base, "/")+"/allhosts", &resp); err != nil {
+		return nil, err
+	}
+	hosts := make([]ImportedHost, 0, len(resp))
+	for _, h := range resp {
+		hpk, err := ParseHostPublicKey(h.PubKey)
+		if err != nil {
+			continue
+		}
+		hosts = append(hosts, ImportedHost{
+			PublicKey:  hpk,
+			NetAddress: modules.NetAddress(h.IP),
+			Uptime:     h.Uptime / 100,
+			Country:    h.CountryCode,
+		})
+	}
+	return hosts, nil
+}
@@ -0,0 +1,66 @@
+package hostdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+func TestImporters(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/hosts/list", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"type": "success", "hosts": [{
+			"public_key": "ed25519:0101010101010101010101010101010101010101010101010101010101010101",
+			"net_address": "Foo.com:9982",
+			"estimated_uptime": 98.5,
+			"country_code": "DE",
+			"settings": {"accepting_contracts": true, "storage_price": "100", "version": "1.4.1"}
+		}]}`))
+	})
+	mux.HandleFunc("/hosts-api/allhosts", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`[
+			{"pubkey": "ed25519:0101010101010101010101010101010101010101010101010101010101010101", "ip": "foo.com:9982", "uptime": 90, "countryCode": "US"},
+			{"pubkey": "ed25519:0202020202020202020202020202020202020202020202020202020202020202", "ip": "bar.com:9982", "uptime": 50, "countryCode": "FR"},
+			{"pubkey": "ed25519:0303030303030303030303030303030303030303030303030303030303030303", "ip": "invalid", "uptime": 50}
+		]`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	sc := SiaCentralImporter{BaseURL: srv.URL + "/v2"}
+	hosts, err := sc.Import(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(hosts) != 1 || hosts[0].Uptime != 0.985 || hosts[0].Settings == nil || !hosts[0].Settings.StoragePrice.Equals64(100) {
+		t.Fatal("wrong SiaCentral hosts:", hosts)
+	}
+
+	// a host that has already been scanned should keep its scanned data
+	s := NewScanner(0)
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		return ScannedHost{HostSettings: HostSettings{Version: "1.4.2"}}, nil
+	}
+	s.AddHost(testKey(2), "bar.com:9982")
+	s.ScanAll(context.Background())
+
+	if err := s.Import(context.Background(), sc); err != nil {
+		t.Fatal(err)
+	} else if err := s.Import(context.Background(), SiaStatsImporter{BaseURL: srv.URL + "/hosts-api"}); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := s.Hosts(nil); len(hosts) != 2 {
+		t.Fatal("expected 2 hosts, got", len(hosts))
+	}
+	if hr, _ := s.Host(testKey(1)); hr.NetAddress != "foo.com:9982" || hr.Country != "DE" || hr.Settings.Version != "1.4.1" {
+		t.Fatal("wrong imported host:", hr)
+	} else if hr, _ := s.Host(testKey(2)); hr.Country != "" || hr.Settings.Version != "1.4.2" {
+		t.Fatal("scanned host should not have been overwritten:", hr)
+	}
+
+	if _, err := (SiaStatsImporter{BaseURL: srv.URL + "/bad"}).Import(context.Background()); err == nil {
+		t.Fatal("expected error for bad URL")
+	}
+}
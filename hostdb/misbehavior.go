@@ -0,0 +1,98 @@
+package hostdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxEvidence is the maximum amount of Evidence retained for each host.
+const maxEvidence = 64
+
+// A MisbehaviorKind identifies a type of host misbehavior.
+type MisbehaviorKind int
+
+// Possible MisbehaviorKind values.
+const (
+	// MisbehaviorInvalidProof indicates that the host supplied an invalid
+	// Merkle proof.
+	MisbehaviorInvalidProof MisbehaviorKind = iota
+	// MisbehaviorRefusedRevision indicates that the host refused to sign, or
+	// supplied an invalid signature for, a valid revision.
+	MisbehaviorRefusedRevision
+	// MisbehaviorCorruptedData indicates that the host returned data that
+	// does not match what the renter stored.
+	MisbehaviorCorruptedData
+	// MisbehaviorPriceBaitAndSwitch indicates that the host raised its
+	// prices beyond the renter's limits after the renter began using it.
+	MisbehaviorPriceBaitAndSwitch
+)
+
+// String implements fmt.Stringer.
+func (k MisbehaviorKind) String() string {
+	switch k {
+	case MisbehaviorInvalidProof:
+		return "invalid proof"
+	case MisbehaviorRefusedRevision:
+		return "refused revision"
+	case MisbehaviorCorruptedData:
+		return "corrupted data"
+	case MisbehaviorPriceBaitAndSwitch:
+		return "price bait-and-switch"
+	default:
+		return fmt.Sprintf("MisbehaviorKind(%d)", int(k))
+	}
+}
+
+// severity returns the penalty incurred by a single instance of k. Misbehavior
+// that implies data loss is penalized more heavily.
+func (k MisbehaviorKind) severity() float64 {
+	switch k {
+	case MisbehaviorInvalidProof, MisbehaviorCorruptedData:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Evidence is a concrete instance of host misbehavior.
+type Evidence struct {
+	Kind      MisbehaviorKind
+	Timestamp time.Time
+	Details   string
+}
+
+// MisbehaviorPenalty returns the total penalty incurred by the host's recorded
+// misbehavior.
+func (hr HostRecord) MisbehaviorPenalty() float64 {
+	var p float64
+	for _, e := range hr.Evidence {
+		p += e.Kind.severity()
+	}
+	return p
+}
+
+// ReportMisbehavior records evidence that the specified host misbehaved. If
+// the Scanner's BlockThreshold is reached and it has a HostList, the host is
+// blocklisted. It is a no-op if the host is unknown.
+func (s *Scanner) ReportMisbehavior(pubkey HostPublicKey, kind MisbehaviorKind, details string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hr, ok := s.hosts[pubkey]
+	if !ok {
+		return nil
+	}
+	hr.Evidence = append(hr.Evidence, Evidence{
+		Kind:      kind,
+		Timestamp: time.Now(),
+		Details:   details,
+	})
+	if len(hr.Evidence) > maxEvidence {
+		hr.Evidence = append(hr.Evidence[:0], hr.Evidence[len(hr.Evidence)-maxEvidence:]...)
+	}
+	s.rescore(hr)
+	if s.BlockThreshold > 0 && s.HostList != nil && hr.MisbehaviorPenalty() >= s.BlockThreshold {
+		reason := fmt.Sprintf("repeated misbehavior (most recently: %v)", kind)
+		return s.HostList.Block(pubkey.String(), reason, time.Time{})
+	}
+	return nil
+}
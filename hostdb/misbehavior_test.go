@@ -0,0 +1,50 @@
+package hostdb
+
+import "testing"
+
+func TestReportMisbehavior(t *testing.T) {
+	hl, _ := NewHostList("")
+	s := NewScanner(0)
+	s.HostList = hl
+	s.BlockThreshold = 4
+	s.AddHost(testKey(1), "1.0.0.1:9982")
+	s.AddHost(testKey(2), "1.0.0.2:9982")
+
+	// reports about unknown hosts are ignored
+	if err := s.ReportMisbehavior(testKey(3), MisbehaviorInvalidProof, "bad proof"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ReportMisbehavior(testKey(1), MisbehaviorRefusedRevision, "bad signature"); err != nil {
+		t.Fatal(err)
+	}
+	hr1, _ := s.Host(testKey(1))
+	hr2, _ := s.Host(testKey(2))
+	if len(hr1.Evidence) != 1 || hr1.Evidence[0].Kind != MisbehaviorRefusedRevision {
+		t.Fatal("evidence not recorded:", hr1.Evidence)
+	} else if Score(hr1) >= Score(hr2) {
+		t.Fatal("misbehaving host should score lower")
+	} else if hl.Check(testKey(1), nil) != nil {
+		t.Fatal("host should not be blocked yet")
+	}
+
+	// invalid proofs are penalized more heavily
+	if err := s.ReportMisbehavior(testKey(1), MisbehaviorInvalidProof, "bad proof"); err != nil {
+		t.Fatal(err)
+	}
+	hr1, _ = s.Host(testKey(1))
+	if p := hr1.MisbehaviorPenalty(); p != 3 {
+		t.Fatal("wrong penalty:", p)
+	} else if hl.Check(testKey(1), nil) != nil {
+		t.Fatal("host should not be blocked yet")
+	}
+
+	// crossing the threshold blocks the host
+	if err := s.ReportMisbehavior(testKey(1), MisbehaviorPriceBaitAndSwitch, "prices doubled"); err != nil {
+		t.Fatal(err)
+	} else if hl.Check(testKey(1), nil) == nil {
+		t.Fatal("host should be blocked")
+	} else if len(s.Hosts(nil)) != 1 {
+		t.Fatal("blocked host should not be returned")
+	}
+}
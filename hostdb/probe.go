@@ -0,0 +1,110 @@
+package hostdb
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxProbeHistory is the maximum number of ProbeResults retained for each
+// host.
+const maxProbeHistory = 32
+
+// A ProbeResult records the outcome of an active benchmark of a host, in
+// which a small amount of data is uploaded and downloaded. See
+// proto.BenchmarkHost.
+type ProbeResult struct {
+	Timestamp          time.Time
+	Latency            time.Duration
+	TimeToFirstByte    time.Duration
+	UploadThroughput   float64 // bytes per second
+	DownloadThroughput float64 // bytes per second
+	Error              string  // empty if the probe succeeded
+}
+
+// Success reports whether the probe succeeded.
+func (pr ProbeResult) Success() bool { return pr.Error == "" }
+
+// A ProbeFunc probes a host. Since probing requires a contract with the host,
+// ProbeFuncs are supplied by the caller, typically by locking a contract and
+// calling proto.BenchmarkHost.
+type ProbeFunc func(ctx context.Context, hr HostRecord) (ProbeResult, error)
+
+// Percentiles summarizes a distribution of measurements.
+type Percentiles struct {
+	P50, P90, P99 float64
+}
+
+func percentiles(xs []float64) Percentiles {
+	if len(xs) == 0 {
+		return Percentiles{}
+	}
+	sort.Float64s(xs)
+	p := func(q float64) float64 {
+		return xs[int(math.Ceil(q*float64(len(xs))))-1]
+	}
+	return Percentiles{p(0.50), p(0.90), p(0.99)}
+}
+
+// ProbeStats summarizes the successful probes in a host's history. Latencies
+// are measured in seconds, and throughputs in bytes per second.
+type ProbeStats struct {
+	Count              int
+	Latency            Percentiles
+	TimeToFirstByte    Percentiles
+	UploadThroughput   Percentiles
+	DownloadThroughput Percentiles
+}
+
+// ProbeStats returns statistics computed from the host's probe history.
+func (hr HostRecord) ProbeStats() ProbeStats {
+	var lat, ttfb, up, down []float64
+	for _, pr := range hr.Probes {
+		if pr.Success() {
+			lat = append(lat, pr.Latency.Seconds())
+			ttfb = append(ttfb, pr.TimeToFirstByte.Seconds())
+			up = append(up, pr.UploadThroughput)
+			down = append(down, pr.DownloadThroughput)
+		}
+	}
+	return ProbeStats{
+		Count:              len(lat),
+		Latency:            percentiles(lat),
+		TimeToFirstByte:    percentiles(ttfb),
+		UploadThroughput:   percentiles(up),
+		DownloadThroughput: percentiles(down),
+	}
+}
+
+// RecordProbe adds a ProbeResult to the history of the specified host.
+func (s *Scanner) RecordProbe(pubkey HostPublicKey, pr ProbeResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hr, ok := s.hosts[pubkey]
+	if !ok {
+		return
+	}
+	hr.Probes = append(hr.Probes, pr)
+	if len(hr.Probes) > maxProbeHistory {
+		hr.Probes = append(hr.Probes[:0], hr.Probes[len(hr.Probes)-maxProbeHistory:]...)
+	}
+}
+
+// Probe probes the specified host using fn and records the result.
+func (s *Scanner) Probe(ctx context.Context, pubkey HostPublicKey, fn ProbeFunc) (ProbeResult, error) {
+	hr, ok := s.Host(pubkey)
+	if !ok {
+		return ProbeResult{}, errors.New("unknown host")
+	}
+	start := time.Now()
+	pr, err := fn(ctx, hr)
+	pr.Timestamp = start
+	if err != nil {
+		pr.Error = err.Error()
+	}
+	s.RecordProbe(pubkey, pr)
+	return pr, err
+}
@@ -0,0 +1,48 @@
+package hostdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestProbe(t *testing.T) {
+	s := NewScanner(0)
+	s.AddHost(testKey(1), "foo:1")
+
+	var n int
+	probe := func(ctx context.Context, hr HostRecord) (ProbeResult, error) {
+		n++
+		if n%10 == 0 {
+			return ProbeResult{}, errors.New("probe failed")
+		}
+		return ProbeResult{
+			Latency:            time.Duration(n) * time.Millisecond,
+			TimeToFirstByte:    time.Duration(n) * time.Millisecond,
+			UploadThroughput:   float64(n),
+			DownloadThroughput: float64(2 * n),
+		}, nil
+	}
+	for i := 0; i < 100; i++ {
+		s.Probe(context.Background(), testKey(1), probe)
+	}
+	if _, err := s.Probe(context.Background(), testKey(2), probe); err == nil {
+		t.Fatal("expected error when probing unknown host")
+	}
+
+	hr, _ := s.Host(testKey(1))
+	if len(hr.Probes) != maxProbeHistory {
+		t.Fatal("probe history should be capped, got", len(hr.Probes))
+	}
+	// history now contains probes 69-100, excluding 70, 80, 90, and 100
+	ps := hr.ProbeStats()
+	if ps.Count != maxProbeHistory-4 {
+		t.Fatal("wrong probe count:", ps.Count)
+	} else if ps.UploadThroughput.P50 != 84 || ps.UploadThroughput.P99 != 99 {
+		t.Fatal("wrong upload percentiles:", ps.UploadThroughput)
+	} else if ps.DownloadThroughput.P90 != 2*97 {
+		t.Fatal("wrong download percentiles:", ps.DownloadThroughput)
+	}
+}
@@ -0,0 +1,161 @@
+package hostdb
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+// A Resolver performs DNS lookups. *net.Resolver implements Resolver; custom
+// implementations can be used to route lookups through a particular DNS
+// server or a proxy.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// A ResolvedAddress is the result of resolving a host's NetAddress.
+type ResolvedAddress struct {
+	// Addr is the dialable IP:port form of the address.
+	Addr modules.NetAddress
+	IP   net.IP
+	// SRV indicates that the address was obtained from an SRV record.
+	SRV bool
+}
+
+type resolveEntry struct {
+	res     ResolvedAddress
+	err     error
+	expires time.Time
+}
+
+// A CachingResolver resolves host NetAddresses, caching the results. A
+// CachingResolver is safe for concurrent use.
+type CachingResolver struct {
+	// Resolver performs the underlying lookups. If nil, net.DefaultResolver
+	// is used.
+	Resolver Resolver
+	// TTL is the duration for which successful lookups are cached.
+	TTL time.Duration
+	// NegativeTTL is the duration for which failed lookups are cached.
+	NegativeTTL time.Duration
+	// SRVService, if non-empty, causes SRV records for the service to be
+	// consulted before the address itself. For example, if SRVService is
+	// "sia-host", the host at "example.com:9982" is resolved via the SRV
+	// record for "_sia-host._tcp.example.com", if one exists.
+	SRVService string
+
+	mu      sync.Mutex
+	entries map[modules.NetAddress]resolveEntry
+}
+
+func (r *CachingResolver) resolver() Resolver {
+	if r.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return r.Resolver
+}
+
+func (r *CachingResolver) lookupIP(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	ips, err := r.resolver().LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	} else if len(ips) == 0 {
+		return nil, errors.New("host address did not resolve to any IPs")
+	}
+	return ips[0].IP, nil
+}
+
+func (r *CachingResolver) resolve(ctx context.Context, addr modules.NetAddress) (ResolvedAddress, error) {
+	host, port, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return ResolvedAddress{}, err
+	}
+	if r.SRVService != "" && net.ParseIP(host) == nil {
+		_, srvs, err := r.resolver().LookupSRV(ctx, r.SRVService, "tcp", host)
+		if err == nil && len(srvs) > 0 {
+			// records are sorted by priority and randomized by weight
+			target := strings.TrimSuffix(srvs[0].Target, ".")
+			ip, err := r.lookupIP(ctx, target)
+			if err != nil {
+				return ResolvedAddress{}, errors.Wrapf(err, "could not resolve SRV target %v", target)
+			}
+			return ResolvedAddress{
+				Addr: modules.NetAddress(net.JoinHostPort(ip.String(), strconv.Itoa(int(srvs[0].Port)))),
+				IP:   ip,
+				SRV:  true,
+			}, nil
+		}
+	}
+	ip, err := r.lookupIP(ctx, host)
+	if err != nil {
+		return ResolvedAddress{}, err
+	}
+	return ResolvedAddress{
+		Addr: modules.NetAddress(net.JoinHostPort(ip.String(), port)),
+		IP:   ip,
+	}, nil
+}
+
+// Resolve resolves addr, returning a cached result if one is available.
+func (r *CachingResolver) Resolve(ctx context.Context, addr modules.NetAddress) (ResolvedAddress, error) {
+	r.mu.Lock()
+	e, ok := r.entries[addr]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.res, e.err
+	}
+
+	res, err := r.resolve(ctx, addr)
+	if err != nil {
+		err = errors.Wrap(err, "could not resolve host address")
+	}
+	if ctx.Err() != nil {
+		return res, err // don't cache failures caused by cancellation
+	}
+	ttl := r.TTL
+	if err != nil {
+		ttl = r.NegativeTTL
+	}
+	if ttl > 0 {
+		r.mu.Lock()
+		if r.entries == nil {
+			r.entries = make(map[modules.NetAddress]resolveEntry)
+		}
+		r.entries[addr] = resolveEntry{res, err, time.Now().Add(ttl)}
+		r.mu.Unlock()
+	}
+	return res, err
+}
+
+// Flush discards all cached results.
+func (r *CachingResolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = nil
+}
+
+// NewCachingResolver returns a CachingResolver that uses net.DefaultResolver,
+// caching successful lookups for ttl and failed lookups for one tenth of ttl.
+func NewCachingResolver(ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		TTL:         ttl,
+		NegativeTTL: ttl / 10,
+	}
+}
+
+// isOnion reports whether addr is a Tor onion address, which must not be
+// resolved via DNS.
+func isOnion(addr modules.NetAddress) bool {
+	host, _, err := net.SplitHostPort(string(addr))
+	return err == nil && strings.HasSuffix(strings.TrimSuffix(host, "."), ".onion")
+}
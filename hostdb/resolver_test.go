@@ -0,0 +1,119 @@
+package hostdb
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+type stubResolver struct {
+	ips  map[string]string
+	srvs map[string]*net.SRV
+
+	mu      sync.Mutex
+	lookups int
+}
+
+func (r *stubResolver) numLookups() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	r.lookups++
+	r.mu.Unlock()
+	ip, ok := r.ips[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	srv, ok := r.srvs["_"+service+"._"+proto+"."+name]
+	if !ok {
+		return "", nil, errors.New("no such record")
+	}
+	return "", []*net.SRV{srv}, nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	stub := &stubResolver{
+		ips: map[string]string{
+			"foo.com":     "1.2.3.4",
+			"bar.com":     "1.2.3.5",
+			"srv.bar.com": "5.6.7.8",
+		},
+		srvs: map[string]*net.SRV{
+			"_sia-host._tcp.bar.com": {Target: "srv.bar.com.", Port: 1234},
+		},
+	}
+	r := &CachingResolver{
+		Resolver:    stub,
+		TTL:         time.Hour,
+		NegativeTTL: time.Hour,
+		SRVService:  "sia-host",
+	}
+	ctx := context.Background()
+
+	if res, err := r.Resolve(ctx, "foo.com:9982"); err != nil {
+		t.Fatal(err)
+	} else if res.Addr != "1.2.3.4:9982" || res.SRV {
+		t.Fatal("wrong resolution:", res)
+	}
+	if res, err := r.Resolve(ctx, "bar.com:9982"); err != nil {
+		t.Fatal(err)
+	} else if res.Addr != "5.6.7.8:1234" || !res.SRV {
+		t.Fatal("wrong SRV resolution:", res)
+	}
+	if _, err := r.Resolve(ctx, "baz.com:9982"); err == nil {
+		t.Fatal("expected resolution failure")
+	}
+
+	// all results, including failures, should be cached
+	n := stub.numLookups()
+	r.Resolve(ctx, "foo.com:9982")
+	r.Resolve(ctx, "bar.com:9982")
+	r.Resolve(ctx, "baz.com:9982")
+	if stub.numLookups() != n {
+		t.Fatal("lookups were not cached")
+	}
+	r.Flush()
+	r.Resolve(ctx, "foo.com:9982")
+	if stub.numLookups() != n+1 {
+		t.Fatal("cache was not flushed")
+	}
+}
+
+func TestScannerResolveFailure(t *testing.T) {
+	var mu sync.Mutex
+	var scanned []modules.NetAddress
+	s := NewScanner(0)
+	s.Resolver = &CachingResolver{Resolver: &stubResolver{ips: map[string]string{"foo.com": "1.2.3.4"}}}
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		scanned = append(scanned, addr)
+		return ScannedHost{PublicKey: pubkey}, nil
+	}
+	s.AddHost(testKey(1), "foo.com:9982")
+	s.AddHost(testKey(2), "bar.com:9982")
+	s.ScanAll(context.Background())
+
+	if len(scanned) != 1 || scanned[0] != "1.2.3.4:9982" {
+		t.Fatal("wrong scanned addresses:", scanned)
+	}
+	if hr, _ := s.Host(testKey(1)); !hr.Online() || !hr.IP.Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatal("wrong record for resolvable host:", hr)
+	}
+	if hr, _ := s.Host(testKey(2)); hr.Online() || !hr.History[0].ResolveFailed {
+		t.Fatal("resolution failure was not recorded:", hr.History)
+	}
+}
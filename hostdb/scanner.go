@@ -0,0 +1,474 @@
+package hostdb
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+// maxScanHistory is the maximum number of ScanResults retained for each host.
+const maxScanHistory = 64
+
+// A ScanResult records the outcome of a single scan.
+type ScanResult struct {
+	Timestamp time.Time
+	Latency   time.Duration
+	Error     string // empty if the scan succeeded
+	// ResolveFailed indicates that the scan failed because the host's
+	// address could not be resolved, rather than because the host could not
+	// be reached.
+	ResolveFailed bool
+}
+
+// Success reports whether the scan succeeded.
+func (sr ScanResult) Success() bool { return sr.Error == "" }
+
+// A HostRecord contains everything a Scanner knows about a host.
+type HostRecord struct {
+	PublicKey  HostPublicKey
+	NetAddress modules.NetAddress
+	FirstSeen  time.Time
+
+	// IP is the address that NetAddress resolved to during the most recent
+	// successful scan. Addresses are only resolved if the Scanner has a
+	// Resolver, Geolocator, or HostList; otherwise, IP is only known if
+	// NetAddress contains a literal IP.
+	IP net.IP
+
+	// Location is the host's location, as determined by the Scanner's
+	// Geolocator. Unknown fields are left empty.
+	Location
+
+	// Settings are the settings reported by the most recent successful scan.
+	// If the host has never been scanned successfully, Settings is the zero
+	// value.
+	Settings HostSettings
+
+	// PreviousSettings are the settings that the host reported before its
+	// prices or collateral last changed.
+	PreviousSettings HostSettings
+
+	// SettingsHistory contains the distinct settings reported by the host,
+	// oldest first.
+	SettingsHistory []SettingsSnapshot
+
+	// History contains the results of the most recent scans, oldest first.
+	History []ScanResult
+
+	// Probes contains the results of the most recent probes, oldest first.
+	Probes []ProbeResult
+
+	// Churn records changes to the host's address and availability.
+	Churn ChurnStats
+
+	// Contracts records the contracts formed with the host, oldest first.
+	Contracts []ContractHistoryEntry
+
+	// Transports records whether the host was reachable via each of the
+	// Scanner's Transports when last attempted.
+	Transports []TransportStatus
+
+	// Evidence records misbehavior reported via Scanner.ReportMisbehavior,
+	// oldest first.
+	Evidence []Evidence
+
+	jitter float64 // see Scanner.rejitter
+}
+
+// LastScan returns the result of the most recent scan of the host, if any.
+func (hr HostRecord) LastScan() (ScanResult, bool) {
+	if len(hr.History) == 0 {
+		return ScanResult{}, false
+	}
+	return hr.History[len(hr.History)-1], true
+}
+
+// Online reports whether the most recent scan of the host succeeded.
+func (hr HostRecord) Online() bool {
+	sr, ok := hr.LastScan()
+	return ok && sr.Success()
+}
+
+// Uptime returns the fraction of scans in the host's history that succeeded.
+// If the host has never been scanned, Uptime returns 0.
+func (hr HostRecord) Uptime() float64 {
+	if len(hr.History) == 0 {
+		return 0
+	}
+	var n int
+	for _, sr := range hr.History {
+		if sr.Success() {
+			n++
+		}
+	}
+	return float64(n) / float64(len(hr.History))
+}
+
+// AverageLatency returns the mean latency of the successful scans in the
+// host's history.
+func (hr HostRecord) AverageLatency() time.Duration {
+	var total time.Duration
+	var n int
+	for _, sr := range hr.History {
+		if sr.Success() {
+			total += sr.Latency
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return total / time.Duration(n)
+}
+
+// A Scanner periodically scans a set of hosts, recording their settings and
+// uptime/latency history. A Scanner is safe for concurrent use.
+type Scanner struct {
+	// Interval is the minimum time between scans of a given host.
+	Interval time.Duration
+	// Timeout limits the duration of each scan. If zero, scans are limited
+	// only by the context passed to ScanAll or Run.
+	Timeout time.Duration
+	// Parallelism is the maximum number of concurrent scans, and thus of
+	// concurrent connections. If zero, hosts are scanned one at a time.
+	Parallelism int
+	// RateLimit is the maximum number of scans started per second, across
+	// all calls to ScanAll. If zero, scans are not rate-limited.
+	RateLimit float64
+	// Jitter randomizes the time between scans of a given host by up to
+	// Jitter*Interval in either direction. It should be in [0, 1).
+	Jitter float64
+	// HasContract, if non-nil, reports whether the renter has a contract
+	// with the host. Such hosts are scanned before all others.
+	HasContract func(HostPublicKey) bool
+	// RecentAge is the age below which a host is considered recently
+	// announced. Recent hosts are scanned before the remaining hosts.
+	RecentAge time.Duration
+	// ScanFunc is used to scan each host. If nil, Scan is used. ScanFunc is
+	// ignored if Transports is non-empty.
+	ScanFunc func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error)
+	// Transports, if non-empty, are used to reach each host, in order,
+	// until one succeeds. A host is considered offline only if it cannot be
+	// reached via any transport; see HostRecord.ReachableVia.
+	Transports []*Transport
+	// Geolocator, if non-nil, is used to determine the Location of each host
+	// that is scanned successfully. Hosts reached via a proxy (see
+	// Transport.Proxy) are not geolocated.
+	Geolocator Geolocator
+	// Resolver, if non-nil, is used to resolve each host's address before
+	// scanning it. Resolution failures are recorded in the host's history
+	// (see ScanResult.ResolveFailed), and hosts are scanned at their
+	// resolved IP address.
+	Resolver *CachingResolver
+	// HostList, if non-nil, is consulted by ScanAll, Hosts, and RankedHosts;
+	// hosts that are not permitted are neither scanned nor returned.
+	HostList *HostList
+	// ScorePolicy, if non-nil, is used to detect score changes for
+	// subscribers. If nil, DefaultScorePolicy is used.
+	ScorePolicy *ScorePolicy
+	// AlertRules are evaluated after each scan. Hosts that violate any rule
+	// are reported by Failing and FailingHosts.
+	AlertRules []AlertRule
+	// BlockThreshold is the misbehavior penalty (see
+	// HostRecord.MisbehaviorPenalty) at which ReportMisbehavior adds a host
+	// to the HostList's blocklist. If zero, hosts are never blocked
+	// automatically.
+	BlockThreshold float64
+	// OnAlert, if non-nil, is called whenever a host begins or stops
+	// violating one of the AlertRules. It is not called with the Scanner's
+	// lock held, so it may call other Scanner methods.
+	OnAlert func(Alert)
+
+	mu      sync.Mutex
+	hosts   map[HostPublicKey]*HostRecord
+	subs    []*subscription
+	scores  map[HostPublicKey]float64 // last score reported to subscribers
+	failing map[HostPublicKey]map[string]bool
+
+	rate rateLimiter
+}
+
+// AddHost adds a host to the set of hosts to be scanned. If the host is
+// already known, its address is updated.
+func (s *Scanner) AddHost(pubkey HostPublicKey, addr modules.NetAddress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = make(map[HostPublicKey]*HostRecord)
+	}
+	if hr, ok := s.hosts[pubkey]; ok {
+		hr.Churn.Announcements++
+		if hr.NetAddress != addr {
+			hr.Churn.AddressChanges++
+		}
+		hr.NetAddress = addr
+		return
+	}
+	hr := &HostRecord{
+		PublicKey:  pubkey,
+		NetAddress: addr,
+		FirstSeen:  time.Now(),
+		Churn:      ChurnStats{Announcements: 1},
+	}
+	s.hosts[pubkey] = hr
+	s.emit(EventHostDiscovered, hr)
+}
+
+// RemoveHost removes a host from the set of hosts to be scanned, discarding
+// its history.
+func (s *Scanner) RemoveHost(pubkey HostPublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hosts, pubkey)
+	delete(s.scores, pubkey)
+	delete(s.failing, pubkey)
+}
+
+func copyRecord(hr *HostRecord) HostRecord {
+	c := *hr
+	c.IP = append(net.IP(nil), hr.IP...)
+	c.History = append([]ScanResult(nil), hr.History...)
+	c.Probes = append([]ProbeResult(nil), hr.Probes...)
+	c.SettingsHistory = append([]SettingsSnapshot(nil), hr.SettingsHistory...)
+	c.Contracts = append([]ContractHistoryEntry(nil), hr.Contracts...)
+	c.Transports = append([]TransportStatus(nil), hr.Transports...)
+	c.Evidence = append([]Evidence(nil), hr.Evidence...)
+	return c
+}
+
+// Host returns the record for the specified host, if it is known.
+func (s *Scanner) Host(pubkey HostPublicKey) (HostRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hr, ok := s.hosts[pubkey]
+	if !ok {
+		return HostRecord{}, false
+	}
+	return copyRecord(hr), true
+}
+
+// permitted reports whether the host is permitted by the Scanner's HostList.
+func (s *Scanner) permitted(hr *HostRecord) bool {
+	return s.HostList == nil || s.HostList.Check(hr.PublicKey, hr.IP) == nil
+}
+
+// Hosts returns the records of all known hosts for which filter returns true,
+// sorted by public key. If filter is nil, all hosts are returned. Hosts that
+// are not permitted by the Scanner's HostList are never returned.
+func (s *Scanner) Hosts(filter func(HostRecord) bool) []HostRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hosts []HostRecord
+	for _, hr := range s.hosts {
+		if !s.permitted(hr) {
+			continue
+		}
+		if c := copyRecord(hr); filter == nil || filter(c) {
+			hosts = append(hosts, c)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].PublicKey.Less(hosts[j].PublicKey)
+	})
+	return hosts
+}
+
+// scanHost scans a single host and records the result.
+func (s *Scanner) scanHost(ctx context.Context, pubkey HostPublicKey, addr modules.NetAddress) {
+	if s.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	scan := s.ScanFunc
+	if scan == nil {
+		scan = Scan
+	}
+	start := time.Now()
+	var statuses []TransportStatus
+	if len(s.Transports) > 0 {
+		scan = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (host ScannedHost, err error) {
+			host, statuses, err = s.scanTransports(ctx, pubkey, addr)
+			return
+		}
+	}
+	var host ScannedHost
+	var ip net.IP
+	var err error
+	var sr ScanResult
+	// the address is resolved at most once, before dialing, so that the
+	// recorded IP is the one that was actually scanned
+	scanAddr := addr
+	proxied := s.proxied(addr)
+	if s.Resolver != nil && !proxied {
+		var res ResolvedAddress
+		if res, err = s.Resolver.Resolve(ctx, addr); err == nil {
+			ip, scanAddr = res.IP, res.Addr
+		}
+	} else if (s.Geolocator != nil || s.HostList != nil) && !proxied {
+		if ip, err = resolveHost(ctx, addr); err == nil {
+			scanAddr = withIP(addr, ip)
+		}
+	} else {
+		ip = literalIP(addr)
+	}
+	if err != nil {
+		sr.ResolveFailed = true
+	} else {
+		host, err = scan(ctx, scanAddr, pubkey)
+	}
+	sr.Timestamp = start
+	sr.Latency = host.Latency
+	if err != nil {
+		sr.Error = err.Error()
+	}
+	var loc Location
+	var located bool
+	if err == nil && ip != nil && s.Geolocator != nil && !proxied {
+		var locErr error
+		loc, locErr = s.Geolocator.Locate(ctx, ip)
+		located = locErr == nil
+	}
+
+	// alerts are delivered after s.mu is released
+	var alerts []Alert
+	defer func() {
+		for _, a := range alerts {
+			s.OnAlert(a)
+		}
+	}()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hr, ok := s.hosts[pubkey]
+	if !ok {
+		return // host was removed during scan
+	}
+	wasOnline := hr.Online()
+	var settingsChanged bool
+	if err == nil {
+		if hr.Uptime() > 0 && !pricesEqual(hr.Settings, host.HostSettings) {
+			hr.PreviousSettings = hr.Settings
+		}
+		hr.Settings = host.HostSettings
+		// the first settings reported by a host are not considered a change
+		hadSettings := len(hr.SettingsHistory) > 0
+		settingsChanged = hr.recordSettings(start, host.HostSettings) && hadSettings
+		if ip != nil {
+			if hr.IP != nil && !hr.IP.Equal(ip) {
+				hr.Churn.IPChanges++
+			}
+			hr.IP = ip
+			hr.Churn.SharedIP = s.countSharedIP(pubkey, ip)
+		}
+	}
+	if located {
+		hr.Location = loc
+	}
+	hr.updateTransports(statuses)
+	hr.History = append(hr.History, sr)
+	if len(hr.History) > maxScanHistory {
+		hr.History = append(hr.History[:0], hr.History[len(hr.History)-maxScanHistory:]...)
+	}
+	s.rejitter(hr)
+
+	if wasOnline && err != nil {
+		hr.Churn.Disappearances++
+		s.emit(EventHostOffline, hr)
+	} else if !wasOnline && err == nil {
+		s.emit(EventHostOnline, hr)
+	}
+	if settingsChanged {
+		s.emit(EventSettingsChanged, hr)
+	}
+	s.rescore(hr)
+	if as := s.checkAlerts(hr); s.OnAlert != nil {
+		alerts = as
+	}
+}
+
+// ScanAll scans every known host that is due to be scanned, i.e. that has not
+// been scanned within the last Interval (subject to Jitter), blocking until
+// all scans have completed or ctx is cancelled. Hosts are scanned in order of
+// priority: first hosts with which the renter has a contract, then recently
+// announced hosts, then all others; within each class, hosts that have waited
+// longest are scanned first.
+func (s *Scanner) ScanAll(ctx context.Context) {
+	type scanTarget struct {
+		pubkey   HostPublicKey
+		addr     modules.NetAddress
+		priority ScanPriority
+		lastScan time.Time
+	}
+	var targets []scanTarget
+	now := time.Now()
+	s.mu.Lock()
+	for _, hr := range s.hosts {
+		if s.permitted(hr) && s.due(hr, now) {
+			sr, _ := hr.LastScan()
+			targets = append(targets, scanTarget{hr.PublicKey, hr.NetAddress, s.priority(hr), sr.Timestamp})
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].priority != targets[j].priority {
+			return targets[i].priority > targets[j].priority
+		}
+		return targets[i].lastScan.Before(targets[j].lastScan)
+	})
+
+	p := s.Parallelism
+	if p <= 0 {
+		p = 1
+	}
+	sem := make(chan struct{}, p)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil || s.waitRate(ctx) != nil {
+			break
+		}
+		wg.Add(1)
+		go func(t scanTarget) {
+			defer wg.Done()
+			s.scanHost(ctx, t.pubkey, t.addr)
+			<-sem
+		}(t)
+	}
+	wg.Wait()
+}
+
+// Run calls ScanAll every Interval until ctx is cancelled, at which point it
+// returns ctx.Err().
+func (s *Scanner) Run(ctx context.Context) error {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.ScanAll(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// NewScanner returns a Scanner that scans each host at most once per
+// interval.
+func NewScanner(interval time.Duration) *Scanner {
+	return &Scanner{
+		Interval:    interval,
+		Timeout:     30 * time.Second,
+		Parallelism: 10,
+	}
+}
@@ -0,0 +1,100 @@
+package hostdb
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+func TestScanner(t *testing.T) {
+	online := map[modules.NetAddress]bool{"good:1": true}
+	s := NewScanner(time.Hour)
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		host := ScannedHost{PublicKey: pubkey, Latency: time.Millisecond}
+		if !online[addr] {
+			return host, errors.New("host is offline")
+		}
+		host.NetAddress = addr
+		host.Version = "1.4.1"
+		return host, nil
+	}
+	s.AddHost(testKey(1), "good:1")
+	s.AddHost(testKey(2), "bad:1")
+
+	s.ScanAll(context.Background())
+	if hr, ok := s.Host(testKey(1)); !ok {
+		t.Fatal("host should be known")
+	} else if !hr.Online() || hr.Uptime() != 1 || hr.Settings.Version != "1.4.1" || hr.AverageLatency() != time.Millisecond {
+		t.Fatal("wrong record for online host:", hr)
+	}
+	if hr, _ := s.Host(testKey(2)); hr.Online() || hr.Uptime() != 0 {
+		t.Fatal("wrong record for offline host:", hr)
+	}
+
+	// hosts scanned within the last Interval should not be rescanned
+	s.ScanAll(context.Background())
+	if hr, _ := s.Host(testKey(1)); len(hr.History) != 1 {
+		t.Fatal("host should not have been rescanned")
+	}
+
+	// take the host offline and scan it again
+	s.Interval = 0
+	online["good:1"] = false
+	s.ScanAll(context.Background())
+	if hr, _ := s.Host(testKey(1)); hr.Online() || hr.Uptime() != 0.5 || hr.Settings.Version != "1.4.1" {
+		t.Fatal("wrong record after failed scan:", hr)
+	}
+
+	if hosts := s.Hosts(HostRecord.Online); len(hosts) != 0 {
+		t.Fatal("expected no online hosts, got", len(hosts))
+	} else if hosts := s.Hosts(nil); len(hosts) != 2 || hosts[0].PublicKey != testKey(1) {
+		t.Fatal("wrong hosts:", hosts)
+	}
+
+	s.RemoveHost(testKey(1))
+	if _, ok := s.Host(testKey(1)); ok {
+		t.Fatal("host should have been removed")
+	}
+}
+
+func TestScannerResolveOnce(t *testing.T) {
+	var mu sync.Mutex
+	scanned := make(map[HostPublicKey]modules.NetAddress)
+	s := NewScanner(0)
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		scanned[pubkey] = addr
+		return ScannedHost{PublicKey: pubkey}, nil
+	}
+	s.AddHost(testKey(1), "foo.invalid:9982")
+	s.AddHost(testKey(2), "1.2.3.4:9982")
+
+	// without a consumer of the IP, hostnames should not be resolved, but
+	// literal IPs should still be recorded
+	s.ScanAll(context.Background())
+	if hr, _ := s.Host(testKey(1)); !hr.Online() || hr.IP != nil || scanned[testKey(1)] != "foo.invalid:9982" {
+		t.Fatal("unexpected resolution:", hr.IP, scanned[testKey(1)])
+	} else if hr, _ := s.Host(testKey(2)); !hr.IP.Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatal("literal IP was not recorded:", hr.IP)
+	}
+
+	// with a Geolocator, the host should be scanned at the same IP that is
+	// recorded and geolocated
+	s.Geolocator = mapGeolocator{
+		"127.0.0.1": {Country: "US"},
+		"::1":       {Country: "US"},
+	}
+	s.AddHost(testKey(3), "localhost:9982")
+	s.ScanAll(context.Background())
+	if hr, _ := s.Host(testKey(3)); hr.IP == nil || hr.Location.Country != "US" {
+		t.Fatal("host was not resolved and located:", hr.IP, hr.Location)
+	} else if addr := scanned[testKey(3)]; addr != modules.NetAddress(net.JoinHostPort(hr.IP.String(), "9982")) {
+		t.Fatalf("scanned %v, but recorded %v", addr, hr.IP)
+	}
+}
@@ -0,0 +1,86 @@
+package hostdb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+// A ScanPriority determines the order in which due hosts are scanned.
+type ScanPriority int
+
+// Possible ScanPriority values, from lowest to highest.
+const (
+	PriorityLongTail ScanPriority = iota
+	PriorityRecent
+	PriorityContract
+)
+
+// priority returns the ScanPriority of hr. s.mu must be held.
+func (s *Scanner) priority(hr *HostRecord) ScanPriority {
+	switch {
+	case s.HasContract != nil && s.HasContract(hr.PublicKey):
+		return PriorityContract
+	case s.RecentAge > 0 && time.Since(hr.FirstSeen) < s.RecentAge:
+		return PriorityRecent
+	default:
+		return PriorityLongTail
+	}
+}
+
+// due reports whether hr should be scanned at time now. s.mu must be held.
+func (s *Scanner) due(hr *HostRecord, now time.Time) bool {
+	sr, ok := hr.LastScan()
+	if !ok {
+		return true
+	}
+	interval := s.Interval + time.Duration(hr.jitter*s.Jitter*float64(s.Interval))
+	return now.Sub(sr.Timestamp) >= interval
+}
+
+// rejitter chooses a new random offset for the next scan of hr, so that hosts
+// added at the same time are not scanned in lockstep. s.mu must be held.
+func (s *Scanner) rejitter(hr *HostRecord) {
+	const res = 1 << 20
+	hr.jitter = float64(frand.Intn(2*res+1)-res) / res // [-1, 1]
+}
+
+// A rateLimiter spaces out events so that no more than a given number occur
+// per second.
+type rateLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until an event may occur without exceeding rate. If rate is not
+// positive, wait returns immediately.
+func (rl *rateLimiter) wait(ctx context.Context, rate float64) error {
+	if rate <= 0 {
+		return nil
+	}
+	gap := time.Duration(float64(time.Second) / rate)
+	now := time.Now()
+	rl.mu.Lock()
+	start := rl.next
+	if start.Before(now) {
+		start = now
+	}
+	rl.next = start.Add(gap)
+	rl.mu.Unlock()
+
+	t := time.NewTimer(start.Sub(now))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitRate blocks until a scan may be started without exceeding RateLimit.
+func (s *Scanner) waitRate(ctx context.Context) error {
+	return s.rate.wait(ctx, s.RateLimit)
+}
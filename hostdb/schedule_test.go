@@ -0,0 +1,73 @@
+package hostdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+func TestScanPriority(t *testing.T) {
+	var order []HostPublicKey
+	s := NewScanner(0)
+	s.Parallelism = 1
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		order = append(order, pubkey)
+		return ScannedHost{PublicKey: pubkey}, nil
+	}
+	s.HasContract = func(pubkey HostPublicKey) bool { return pubkey == testKey(3) }
+	s.RecentAge = time.Hour
+	for i := byte(1); i <= 3; i++ {
+		s.AddHost(testKey(i), "foo:1")
+	}
+	// make host 1 old
+	s.mu.Lock()
+	s.hosts[testKey(1)].FirstSeen = time.Now().Add(-2 * time.Hour)
+	s.mu.Unlock()
+
+	s.ScanAll(context.Background())
+	if len(order) != 3 || order[0] != testKey(3) || order[1] != testKey(2) || order[2] != testKey(1) {
+		t.Fatal("wrong scan order:", order)
+	}
+}
+
+func TestScanRateLimit(t *testing.T) {
+	s := NewScanner(0)
+	s.RateLimit = 100
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		return ScannedHost{PublicKey: pubkey}, nil
+	}
+	for i := byte(1); i <= 5; i++ {
+		s.AddHost(testKey(i), "foo:1")
+	}
+	start := time.Now()
+	s.ScanAll(context.Background())
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatal("scans were not rate-limited:", elapsed)
+	}
+
+	// a cancelled context should abort promptly
+	s.RateLimit = 0.1
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	s.ScanAll(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("ScanAll did not respect context:", elapsed)
+	}
+}
+
+func TestScanJitter(t *testing.T) {
+	s := NewScanner(time.Hour)
+	s.Jitter = 0.5
+	hr := &HostRecord{History: []ScanResult{{Timestamp: time.Now().Add(-40 * time.Minute)}}}
+	hr.jitter = -1
+	if !s.due(hr, time.Now()) {
+		t.Fatal("host should be due after 30 minutes")
+	}
+	hr.jitter = 0
+	if s.due(hr, time.Now()) {
+		t.Fatal("host should not be due until 60 minutes")
+	}
+}
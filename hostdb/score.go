@@ -0,0 +1,241 @@
+package hostdb
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/build"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+// A ScorePolicy determines how hosts are scored. A host's score is the
+// product of several factors, each in the range (0, 1], raised to the power of
+// its weight. A weight of zero causes the corresponding factor to be ignored.
+type ScorePolicy struct {
+	PriceWeight      float64
+	CollateralWeight float64
+	UptimeWeight     float64
+	VersionWeight    float64
+	AgeWeight        float64
+	ChurnWeight      float64
+	ContractWeight   float64
+	EvidenceWeight   float64
+
+	// The expected usage of a contract with the host, used to calculate the
+	// price factor.
+	ExpectedStorage  uint64
+	ExpectedUpload   uint64
+	ExpectedDownload uint64
+	ExpectedDuration types.BlockHeight
+
+	// ReferenceCost is the cost of the expected usage at which the price
+	// factor is 0.5.
+	ReferenceCost types.Currency
+
+	// CollateralRatio is the ratio of collateral to storage price at or above
+	// which the collateral factor is 1.
+	CollateralRatio float64
+
+	// Hosts running a version older than MinVersion receive a version factor
+	// of 0.01.
+	MinVersion string
+
+	// MaturityAge is the age at which the age factor is 0.5.
+	MaturityAge time.Duration
+
+	// ChurnTolerance is the churn penalty (see ChurnStats.Penalty) at which
+	// the churn factor is 0.5.
+	ChurnTolerance float64
+
+	// Override, if non-nil, replaces the factors above entirely; the weights
+	// and other parameters are ignored.
+	Override ScoreFunc
+	// Adjustments are additional factors, each clamped to (0, 1] and
+	// multiplied into the score. They are applied after Override.
+	Adjustments []ScoreFunc
+}
+
+// A ScoreFunc computes a score or score factor for a host.
+type ScoreFunc func(HostRecord) float64
+
+// LatencyFactor returns a ScoreFunc that penalizes hosts whose average scan
+// latency exceeds target. The factor is 1 at or below target and halves for
+// every additional multiple of target. Hosts with no latency information
+// receive a factor of 0.5.
+func LatencyFactor(target time.Duration) ScoreFunc {
+	return func(hr HostRecord) float64 {
+		lat := hr.AverageLatency()
+		if lat == 0 {
+			return 0.5
+		} else if lat <= target {
+			return 1
+		}
+		return math.Pow(0.5, float64(lat-target)/float64(target))
+	}
+}
+
+// DefaultScorePolicy is a reasonable ScorePolicy for most renters.
+var DefaultScorePolicy = ScorePolicy{
+	PriceWeight:      1,
+	CollateralWeight: 1,
+	UptimeWeight:     3,
+	VersionWeight:    1,
+	AgeWeight:        1,
+	ChurnWeight:      1,
+	ContractWeight:   2,
+	EvidenceWeight:   2,
+
+	ExpectedStorage:  1 << 30, // 1 GiB
+	ExpectedUpload:   1 << 30,
+	ExpectedDownload: 1 << 30,
+	ExpectedDuration: 144 * 30, // 1 month
+
+	ReferenceCost:   types.SiacoinPrecision.Mul64(10),
+	CollateralRatio: 2,
+	MinVersion:      "1.4.0",
+	MaturityAge:     30 * 24 * time.Hour,
+	ChurnTolerance:  10,
+}
+
+// minFactor is the minimum value of any score factor. Factors are never zero,
+// so that a host that is very poor in one respect can still be ranked against
+// others.
+const minFactor = 0.01
+
+func clampFactor(f float64) float64 {
+	if math.IsNaN(f) || f < minFactor {
+		return minFactor
+	} else if f > 1 {
+		return 1
+	}
+	return f
+}
+
+func currencyFloat(c types.Currency) float64 {
+	f, _ := c.Float64()
+	return f
+}
+
+// ExpectedCost returns the cost of the policy's expected usage with a host
+// with the specified settings, including the contract fee.
+func (p ScorePolicy) ExpectedCost(s HostSettings) types.Currency {
+	return s.ContractPrice.
+		Add(s.StoragePrice.Mul64(p.ExpectedStorage).Mul64(uint64(p.ExpectedDuration))).
+		Add(s.UploadBandwidthPrice.Mul64(p.ExpectedUpload)).
+		Add(s.DownloadBandwidthPrice.Mul64(p.ExpectedDownload))
+}
+
+func (p ScorePolicy) priceFactor(s HostSettings) float64 {
+	ref := currencyFloat(p.ReferenceCost)
+	if ref == 0 {
+		return 1
+	}
+	return clampFactor(ref / (ref + currencyFloat(p.ExpectedCost(s))))
+}
+
+func (p ScorePolicy) collateralFactor(s HostSettings) float64 {
+	if s.StoragePrice.IsZero() || p.CollateralRatio == 0 {
+		return 1
+	}
+	ratio := currencyFloat(s.Collateral) / currencyFloat(s.StoragePrice)
+	return clampFactor(ratio / p.CollateralRatio)
+}
+
+func (p ScorePolicy) uptimeFactor(hr HostRecord) float64 {
+	if len(hr.History) == 0 {
+		return 0.5 // no information
+	}
+	return clampFactor(hr.Uptime())
+}
+
+func (p ScorePolicy) versionFactor(s HostSettings) float64 {
+	if p.MinVersion == "" {
+		return 1
+	} else if !build.IsVersion(s.Version) || build.VersionCmp(s.Version, p.MinVersion) < 0 {
+		return minFactor
+	}
+	return 1
+}
+
+func (p ScorePolicy) ageFactor(hr HostRecord) float64 {
+	if p.MaturityAge == 0 {
+		return 1
+	}
+	age := time.Since(hr.FirstSeen)
+	return clampFactor(float64(age) / float64(age+p.MaturityAge))
+}
+
+func (p ScorePolicy) churnFactor(hr HostRecord) float64 {
+	if p.ChurnTolerance == 0 {
+		return 1
+	}
+	return clampFactor(p.ChurnTolerance / (p.ChurnTolerance + float64(hr.Churn.Penalty())))
+}
+
+// contractFactor penalizes hosts for missed proofs and, to a lesser extent,
+// abandoned contracts. Hosts with no resolved contracts receive a factor of 1.
+func (p ScorePolicy) contractFactor(hr HostRecord) float64 {
+	cs := hr.ContractStats()
+	good := float64(cs.Completed + cs.Renewed)
+	bad := 4*float64(cs.MissedProof) + float64(cs.Abandoned)
+	return clampFactor((good + 1) / (good + 1 + bad))
+}
+
+// evidenceFactor penalizes hosts for reported misbehavior.
+func (p ScorePolicy) evidenceFactor(hr HostRecord) float64 {
+	return clampFactor(1 / (1 + hr.MisbehaviorPenalty()))
+}
+
+// Score returns the score of the host according to the policy. Higher scores
+// are better.
+func (p ScorePolicy) Score(hr HostRecord) float64 {
+	var score float64
+	if p.Override != nil {
+		score = p.Override(hr)
+	} else {
+		score = math.Pow(p.priceFactor(hr.Settings), p.PriceWeight) *
+			math.Pow(p.collateralFactor(hr.Settings), p.CollateralWeight) *
+			math.Pow(p.uptimeFactor(hr), p.UptimeWeight) *
+			math.Pow(p.versionFactor(hr.Settings), p.VersionWeight) *
+			math.Pow(p.ageFactor(hr), p.AgeWeight) *
+			math.Pow(p.churnFactor(hr), p.ChurnWeight) *
+			math.Pow(p.contractFactor(hr), p.ContractWeight) *
+			math.Pow(p.evidenceFactor(hr), p.EvidenceWeight)
+	}
+	for _, adj := range p.Adjustments {
+		score *= clampFactor(adj(hr))
+	}
+	return score
+}
+
+// Score returns the score of the host according to DefaultScorePolicy.
+func Score(hr HostRecord) float64 {
+	return DefaultScorePolicy.Score(hr)
+}
+
+// A RankedHost is a HostRecord paired with its score.
+type RankedHost struct {
+	HostRecord
+	Score float64
+}
+
+// RankedHosts returns up to n hosts that are online and accepting contracts,
+// sorted by their score under p, best first. If n is negative, all such hosts
+// are returned.
+func (s *Scanner) RankedHosts(p ScorePolicy, n int) []RankedHost {
+	hosts := s.Hosts(func(hr HostRecord) bool {
+		return hr.Online() && hr.Settings.AcceptingContracts
+	})
+	ranked := make([]RankedHost, len(hosts))
+	for i, hr := range hosts {
+		ranked[i] = RankedHost{hr, p.Score(hr)}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score > ranked[j].Score
+	})
+	if n >= 0 && n < len(ranked) {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
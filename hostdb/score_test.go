@@ -0,0 +1,99 @@
+package hostdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+func TestRankedHosts(t *testing.T) {
+	settings := map[HostPublicKey]HostSettings{
+		testKey(1): { // cheap
+			AcceptingContracts: true,
+			StoragePrice:       types.SiacoinPrecision.Div64(1e12),
+			Collateral:         types.SiacoinPrecision.Div64(5e11),
+			Version:            "1.4.1",
+		},
+		testKey(2): { // expensive
+			AcceptingContracts: true,
+			StoragePrice:       types.SiacoinPrecision.Div64(1e10),
+			Collateral:         types.SiacoinPrecision.Div64(5e9),
+			Version:            "1.4.1",
+		},
+		testKey(3): { // outdated
+			AcceptingContracts: true,
+			StoragePrice:       types.SiacoinPrecision.Div64(1e12),
+			Collateral:         types.SiacoinPrecision.Div64(5e11),
+			Version:            "1.3.7",
+		},
+		testKey(4): { // not accepting contracts
+			StoragePrice: types.SiacoinPrecision.Div64(1e12),
+			Collateral:   types.SiacoinPrecision.Div64(5e11),
+			Version:      "1.4.1",
+		},
+	}
+	s := NewScanner(0)
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		return ScannedHost{HostSettings: settings[pubkey], PublicKey: pubkey}, nil
+	}
+	for key := range settings {
+		s.AddHost(key, "foo:1")
+	}
+	s.ScanAll(context.Background())
+
+	ranked := s.RankedHosts(DefaultScorePolicy, -1)
+	if len(ranked) != 3 {
+		t.Fatal("expected 3 ranked hosts, got", len(ranked))
+	}
+	for i, key := range []HostPublicKey{testKey(1), testKey(2), testKey(3)} {
+		if ranked[i].PublicKey != key {
+			t.Fatalf("expected %v at rank %v, got %v", key, i, ranked[i].PublicKey)
+		}
+	}
+	if ranked := s.RankedHosts(DefaultScorePolicy, 1); len(ranked) != 1 {
+		t.Fatal("expected 1 ranked host, got", len(ranked))
+	}
+
+	// with price (and age, which varies with time) ignored, the expensive
+	// host should score the same as the cheap host
+	p := DefaultScorePolicy
+	p.PriceWeight = 0
+	p.AgeWeight = 0
+	cheap, _ := s.Host(testKey(1))
+	expensive, _ := s.Host(testKey(2))
+	if p.Score(cheap) != p.Score(expensive) {
+		t.Fatal("hosts should have equal scores when price is ignored")
+	}
+
+	// older hosts should score higher
+	older := cheap
+	older.FirstSeen = older.FirstSeen.Add(-365 * 24 * time.Hour)
+	if Score(older) <= Score(cheap) {
+		t.Fatal("older host should have a higher score")
+	}
+}
+
+func TestCustomScore(t *testing.T) {
+	fast := HostRecord{History: []ScanResult{{Latency: 10 * time.Millisecond}}}
+	slow := HostRecord{History: []ScanResult{{Latency: 300 * time.Millisecond}}}
+
+	p := DefaultScorePolicy
+	if p.Score(fast) != p.Score(slow) {
+		t.Fatal("latency should not affect default score")
+	}
+	p.Adjustments = []ScoreFunc{LatencyFactor(100 * time.Millisecond)}
+	if p.Score(fast) != DefaultScorePolicy.Score(fast) {
+		t.Fatal("fast host should not be penalized")
+	} else if p.Score(slow) != DefaultScorePolicy.Score(slow)/4 {
+		t.Fatal("slow host should be penalized by a factor of 4, got", p.Score(slow)/DefaultScorePolicy.Score(slow))
+	}
+
+	p.Override = func(hr HostRecord) float64 { return 1 / float64(hr.AverageLatency()) }
+	p.Adjustments = nil
+	if p.Score(fast) <= p.Score(slow) {
+		t.Fatal("override should rank fast host higher")
+	}
+}
@@ -0,0 +1,59 @@
+package hostdb
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInsufficientHosts is returned by SelectHosts when too few hosts satisfy
+// the selection constraints.
+var ErrInsufficientHosts = errors.New("not enough hosts satisfy the constraints")
+
+// SelectionConstraints constrain the hosts chosen by SelectHosts.
+type SelectionConstraints struct {
+	// Filter, if non-nil, must be matched by every selected host. Price
+	// limits are typically expressed here.
+	Filter *Filter
+	// Diversity limits the number of hosts selected from any one network or
+	// jurisdiction.
+	Diversity DiversityPolicy
+	// ScorePolicy is used to rank hosts. If nil, DefaultScorePolicy is used.
+	ScorePolicy *ScorePolicy
+	// MinScore is the minimum score of any selected host.
+	MinScore float64
+}
+
+// SelectHosts selects n hosts, e.g. to store the n shards of an m-of-n
+// erasure-coded file. Only hosts that are online, accepting contracts, and
+// satisfy c are considered; of these, the highest-scoring hosts are chosen,
+// subject to c.Diversity. If fewer than n hosts qualify, SelectHosts returns
+// ErrInsufficientHosts.
+//
+// Selection is deterministic: scores are compared at reduced precision, so
+// that slow drift (e.g. in the age factor) does not reorder hosts between
+// calls, and ties are broken by public key.
+func (s *Scanner) SelectHosts(n int, c SelectionConstraints) ([]RankedHost, error) {
+	p := DefaultScorePolicy
+	if c.ScorePolicy != nil {
+		p = *c.ScorePolicy
+	}
+	var candidates []RankedHost
+	for _, h := range s.RankedHosts(p, -1) {
+		if (c.Filter == nil || c.Filter.Match(h.HostRecord)) && h.Score >= c.MinScore {
+			candidates = append(candidates, h)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		si, sj := float32(candidates[i].Score), float32(candidates[j].Score)
+		if si != sj {
+			return si > sj
+		}
+		return candidates[i].PublicKey.Less(candidates[j].PublicKey)
+	})
+	selected := c.Diversity.SelectDiverse(candidates, n)
+	if len(selected) < n {
+		return nil, errors.Wrapf(ErrInsufficientHosts, "wanted %v, found %v", n, len(selected))
+	}
+	return selected, nil
+}
@@ -0,0 +1,71 @@
+package hostdb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+func TestSelectHosts(t *testing.T) {
+	s := NewScanner(0)
+	s.Geolocator = mapGeolocator{
+		"1.0.0.1": {Country: "US"},
+		"1.0.0.2": {Country: "US"},
+		"1.0.0.3": {Country: "US"},
+		"1.0.0.4": {Country: "DE"},
+		"1.0.0.5": {Country: "FR"},
+	}
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		host := ScannedHost{PublicKey: pubkey}
+		host.AcceptingContracts = true
+		host.Version = "1.4.1"
+		if pubkey == testKey(1) {
+			host.StoragePrice = types.NewCurrency64(1000)
+		}
+		return host, nil
+	}
+	for i := byte(1); i <= 5; i++ {
+		s.AddHost(testKey(i), modules.NetAddress("1.0.0."+string('0'+i)+":9982"))
+	}
+	s.ScanAll(context.Background())
+
+	keys := func(hosts []RankedHost) []HostPublicKey {
+		ks := make([]HostPublicKey, len(hosts))
+		for i := range hosts {
+			ks[i] = hosts[i].PublicKey
+		}
+		return ks
+	}
+
+	// equally-scored hosts should be selected in key order, every time
+	c := SelectionConstraints{ScorePolicy: &ScorePolicy{UptimeWeight: 1}}
+	hosts, err := s.SelectHosts(3, c)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := []HostPublicKey{testKey(1), testKey(2), testKey(3)}; !reflect.DeepEqual(keys(hosts), exp) {
+		t.Fatal("wrong hosts:", keys(hosts))
+	}
+	for i := 0; i < 10; i++ {
+		if again, _ := s.SelectHosts(3, c); !reflect.DeepEqual(keys(again), keys(hosts)) {
+			t.Fatal("selection is not stable")
+		}
+	}
+
+	// apply price and diversity constraints
+	max := types.NewCurrency64(10)
+	c.Filter = &Filter{MaxStoragePrice: &max}
+	c.Diversity.MaxPerCountry = 1
+	hosts, err = s.SelectHosts(3, c)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := []HostPublicKey{testKey(2), testKey(4), testKey(5)}; !reflect.DeepEqual(keys(hosts), exp) {
+		t.Fatal("wrong hosts:", keys(hosts))
+	}
+	if _, err := s.SelectHosts(4, c); errors.Cause(err) != ErrInsufficientHosts {
+		t.Fatal("expected ErrInsufficientHosts, got", err)
+	}
+}
@@ -0,0 +1,92 @@
+package hostdb
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotVersion is the current version of the snapshot format.
+const snapshotVersion = 1
+
+// persistSnapshot is the on-disk representation of a Scanner snapshot.
+type persistSnapshot struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Hosts   []persistHost `json:"hosts"`
+}
+
+type persistHost struct {
+	Record HostRecord `json:"record"`
+	// Score is the host's score at the time of export, under the Scanner's
+	// ScorePolicy. It is informational only; scores are recomputed on use.
+	Score float64 `json:"score"`
+}
+
+// ExportSnapshot writes a versioned snapshot of every known host, including
+// its settings, scan and probe history, and current score, to w. Hosts that
+// are not permitted by the Scanner's HostList are omitted.
+func (s *Scanner) ExportSnapshot(w io.Writer) error {
+	p := DefaultScorePolicy
+	if s.ScorePolicy != nil {
+		p = *s.ScorePolicy
+	}
+	hosts := s.Hosts(nil)
+	snap := persistSnapshot{
+		Version: snapshotVersion,
+		Created: time.Now(),
+		Hosts:   make([]persistHost, len(hosts)),
+	}
+	for i, hr := range hosts {
+		snap.Hosts[i] = persistHost{hr, p.Score(hr)}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return errors.Wrap(enc.Encode(snap), "could not write snapshot")
+}
+
+// ImportSnapshot reads a snapshot written by ExportSnapshot and merges it into
+// the Scanner. A host in the snapshot replaces the Scanner's record for that
+// host only if the snapshot's record was scanned more recently; thus importing
+// the same snapshot twice, or importing a stale snapshot, is harmless.
+func (s *Scanner) ImportSnapshot(r io.Reader) error {
+	var snap persistSnapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return errors.Wrap(err, "could not decode snapshot")
+	} else if snap.Version != snapshotVersion {
+		return errors.Errorf("unsupported snapshot version %v", snap.Version)
+	}
+	for _, ph := range snap.Hosts {
+		if ph.Record.PublicKey.IsZero() {
+			return errors.New("snapshot contains host with no public key")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = make(map[HostPublicKey]*HostRecord)
+	}
+	for _, ph := range snap.Hosts {
+		hr := ph.Record
+		existing, ok := s.hosts[hr.PublicKey]
+		if ok {
+			cur, curOK := existing.LastScan()
+			imp, impOK := hr.LastScan()
+			if curOK && (!impOK || !imp.Timestamp.After(cur.Timestamp)) {
+				continue
+			}
+			if existing.FirstSeen.Before(hr.FirstSeen) {
+				hr.FirstSeen = existing.FirstSeen
+			}
+		}
+		c := copyRecord(&hr)
+		s.hosts[hr.PublicKey] = &c
+		if !ok {
+			s.emit(EventHostDiscovered, &c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package hostdb
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+func TestSnapshot(t *testing.T) {
+	price := types.NewCurrency64(100)
+	s := NewScanner(0)
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		host := ScannedHost{PublicKey: pubkey, Latency: time.Millisecond}
+		host.Version = "1.4.1"
+		host.StoragePrice = price
+		return host, nil
+	}
+	s.AddHost(testKey(1), "foo:1")
+	s.AddHost(testKey(2), "bar:1")
+	s.ScanAll(context.Background())
+	s.RecordProbe(testKey(1), ProbeResult{Timestamp: time.Now(), Latency: time.Second})
+
+	var buf bytes.Buffer
+	if err := s.ExportSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	s2 := NewScanner(0)
+	if err := s2.ImportSnapshot(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	hr, ok := s2.Host(testKey(1))
+	if !ok {
+		t.Fatal("host should have been imported")
+	} else if hr.NetAddress != "foo:1" || !hr.Settings.StoragePrice.Equals(price) || len(hr.History) != 1 || len(hr.Probes) != 1 || len(hr.SettingsHistory) != 1 {
+		t.Fatal("imported record does not match:", hr)
+	} else if len(s2.Hosts(nil)) != 2 {
+		t.Fatal("expected 2 hosts")
+	}
+
+	// newer data should not be overwritten by a stale snapshot
+	price = types.NewCurrency64(200)
+	s.ScanAll(context.Background())
+	if err := s.ImportSnapshot(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	} else if hr, _ := s.Host(testKey(1)); !hr.Settings.StoragePrice.Equals(price) || len(hr.History) != 2 {
+		t.Fatal("stale snapshot overwrote newer record:", hr)
+	}
+
+	// unknown versions should be rejected
+	bad := strings.Replace(string(snapshot), `"version": 1`, `"version": 2`, 1)
+	if err := s2.ImportSnapshot(strings.NewReader(bad)); err == nil {
+		t.Fatal("expected error for unknown version")
+	}
+}
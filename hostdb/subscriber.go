@@ -0,0 +1,111 @@
+package hostdb
+
+import (
+	"sync"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+// A HostSet is a mutable set of hosts. Scanner implements HostSet.
+type HostSet interface {
+	AddHost(pubkey HostPublicKey, addr modules.NetAddress)
+	RemoveHost(pubkey HostPublicKey)
+}
+
+type announcementEntry struct {
+	addr    modules.NetAddress
+	blockID types.BlockID
+}
+
+// An AnnouncementSubscriber ingests host announcements from the blockchain
+// into a HostSet. Each host is added with the address in its most recent
+// announcement; if that announcement is reverted, the host's previous address
+// is restored, or the host is removed if it has no remaining announcements.
+// Duplicate announcements are harmless.
+//
+// AnnouncementSubscriber implements modules.ConsensusSetSubscriber, so it can
+// be subscribed to a local consensus set directly. Consensus changes obtained
+// from other sources, such as a siad API, can be passed to
+// ProcessConsensusChange in the same order.
+type AnnouncementSubscriber struct {
+	hs HostSet
+
+	mu   sync.Mutex
+	ccid modules.ConsensusChangeID
+	anns map[HostPublicKey][]announcementEntry
+}
+
+// ProcessConsensusChange implements modules.ConsensusSetSubscriber.
+func (as *AnnouncementSubscriber) ProcessConsensusChange(cc modules.ConsensusChange) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	for _, b := range cc.RevertedBlocks {
+		bid := b.ID()
+		for _, txn := range b.Transactions {
+			for _, ha := range TransactionAnnouncements(txn) {
+				as.revert(ha.PublicKey, bid)
+			}
+		}
+	}
+	for _, b := range cc.AppliedBlocks {
+		bid := b.ID()
+		for _, txn := range b.Transactions {
+			for _, ha := range TransactionAnnouncements(txn) {
+				as.anns[ha.PublicKey] = append(as.anns[ha.PublicKey], announcementEntry{ha.NetAddress, bid})
+				as.hs.AddHost(ha.PublicKey, ha.NetAddress)
+			}
+		}
+	}
+	as.ccid = cc.ID
+}
+
+// revert removes the host's announcements in the specified block, updating
+// the HostSet accordingly. as.mu must be held.
+func (as *AnnouncementSubscriber) revert(pubkey HostPublicKey, bid types.BlockID) {
+	entries := as.anns[pubkey]
+	for len(entries) > 0 && entries[len(entries)-1].blockID == bid {
+		entries = entries[:len(entries)-1]
+	}
+	if len(entries) == 0 {
+		delete(as.anns, pubkey)
+		as.hs.RemoveHost(pubkey)
+	} else {
+		as.anns[pubkey] = entries
+		as.hs.AddHost(pubkey, entries[len(entries)-1].addr)
+	}
+}
+
+// ConsensusChangeID returns the ID of the most recently processed consensus
+// change.
+func (as *AnnouncementSubscriber) ConsensusChangeID() modules.ConsensusChangeID {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.ccid
+}
+
+// Announced returns the address in the host's most recent announcement, if
+// any.
+func (as *AnnouncementSubscriber) Announced(pubkey HostPublicKey) (modules.NetAddress, bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	entries, ok := as.anns[pubkey]
+	if !ok {
+		return "", false
+	}
+	return entries[len(entries)-1].addr, true
+}
+
+// NewAnnouncementSubscriber returns an AnnouncementSubscriber that adds
+// announced hosts to hs. The subscriber should be subscribed to the consensus
+// set starting from modules.ConsensusChangeBeginning, since announcements
+// made prior to the starting point will not be seen.
+func NewAnnouncementSubscriber(hs HostSet) *AnnouncementSubscriber {
+	return &AnnouncementSubscriber{
+		hs:   hs,
+		ccid: modules.ConsensusChangeBeginning,
+		anns: make(map[HostPublicKey][]announcementEntry),
+	}
+}
+
+var _ HostSet = (*Scanner)(nil)
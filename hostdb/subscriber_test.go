@@ -0,0 +1,66 @@
+package hostdb
+
+import (
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/encoding"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+)
+
+func announcementTxn(key ed25519.PrivateKey, addr modules.NetAddress) types.Transaction {
+	ha := modules.HostAnnouncement{
+		Specifier:  modules.PrefixHostAnnouncement,
+		NetAddress: addr,
+		PublicKey:  HostKeyFromPublicKey(key.PublicKey()).SiaPublicKey(),
+	}
+	var sig crypto.Signature
+	copy(sig[:], key.SignHash(crypto.HashObject(ha)))
+	return types.Transaction{
+		ArbitraryData: [][]byte{encoding.MarshalAll(ha, sig)},
+	}
+}
+
+func TestAnnouncementSubscriber(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	hostKey := HostKeyFromPublicKey(key.PublicKey())
+	s := NewScanner(0)
+	as := NewAnnouncementSubscriber(s)
+
+	block := func(nonce byte, txns ...types.Transaction) types.Block {
+		return types.Block{Nonce: types.BlockNonce{nonce}, Transactions: txns}
+	}
+	b1 := block(1, announcementTxn(key, "foo.com:9982"))
+	b2 := block(2, announcementTxn(key, "bar.com:9982"), announcementTxn(key, "bar.com:9982"))
+
+	as.ProcessConsensusChange(modules.ConsensusChange{
+		ID:            modules.ConsensusChangeID{1},
+		AppliedBlocks: []types.Block{b1, b2},
+	})
+	if hr, ok := s.Host(hostKey); !ok || hr.NetAddress != "bar.com:9982" {
+		t.Fatal("host should have been added with its latest address:", hr.NetAddress)
+	} else if as.ConsensusChangeID() != (modules.ConsensusChangeID{1}) {
+		t.Fatal("wrong consensus change ID")
+	}
+
+	// revert the second block; the first address should be restored
+	as.ProcessConsensusChange(modules.ConsensusChange{
+		RevertedBlocks: []types.Block{b2},
+	})
+	if hr, ok := s.Host(hostKey); !ok || hr.NetAddress != "foo.com:9982" {
+		t.Fatal("host's previous address should have been restored:", hr.NetAddress)
+	}
+
+	// revert the first block; the host should be removed
+	as.ProcessConsensusChange(modules.ConsensusChange{
+		RevertedBlocks: []types.Block{b1},
+	})
+	if _, ok := s.Host(hostKey); ok {
+		t.Fatal("host should have been removed")
+	} else if _, ok := as.Announced(hostKey); ok {
+		t.Fatal("host should have no announcements")
+	}
+}
@@ -0,0 +1,144 @@
+package hostdb
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+)
+
+// A Transport is a means of reaching hosts, such as a direct connection or a
+// Tor or SOCKS proxy. A Transport must not be copied after first use.
+type Transport struct {
+	// Name identifies the transport in HostRecords, e.g. "direct" or "tor".
+	Name string
+	// DialContext is used to dial hosts via the transport. It has the same
+	// signature as Dialer.DialContext, so the same function can be used for
+	// both scanning and forming sessions. If nil, a net.Dialer is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Accepts, if non-nil, reports whether the transport can be used to reach
+	// addr; e.g. a direct transport cannot reach onion addresses.
+	Accepts func(addr modules.NetAddress) bool
+	// Proxy indicates that the transport resolves addresses remotely, as Tor
+	// does. Addresses that may be reached via a proxy are never resolved or
+	// geolocated locally, which would reveal them to the system's DNS
+	// resolver and to the Scanner's Geolocator.
+	Proxy bool
+	// RateLimit is the maximum number of scans started per second via the
+	// transport. If zero, scans are not rate-limited beyond
+	// Scanner.RateLimit.
+	RateLimit float64
+
+	rate rateLimiter
+}
+
+// A TransportStatus records whether a host was reachable via a particular
+// Transport.
+type TransportStatus struct {
+	Transport   string
+	Reachable   bool
+	LastAttempt time.Time
+	Error       string // empty if Reachable
+}
+
+// ReachableVia reports whether the host was reachable via the named transport
+// when last attempted. If the host has never been scanned via the transport,
+// known is false.
+func (hr HostRecord) ReachableVia(transport string) (reachable, known bool) {
+	for _, ts := range hr.Transports {
+		if ts.Transport == transport {
+			return ts.Reachable, true
+		}
+	}
+	return false, false
+}
+
+// updateTransports merges statuses into the host's transport statuses.
+func (hr *HostRecord) updateTransports(statuses []TransportStatus) {
+outer:
+	for _, ts := range statuses {
+		for i := range hr.Transports {
+			if hr.Transports[i].Transport == ts.Transport {
+				hr.Transports[i] = ts
+				continue outer
+			}
+		}
+		hr.Transports = append(hr.Transports, ts)
+	}
+}
+
+// proxied reports whether addr must not be resolved locally, either because
+// it is an onion address or because it may be reached via a proxy Transport.
+func (s *Scanner) proxied(addr modules.NetAddress) bool {
+	if isOnion(addr) {
+		return true
+	}
+	for _, t := range s.Transports {
+		if t.Proxy && (t.Accepts == nil || t.Accepts(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanTransports scans the host via each applicable Transport in turn until
+// one succeeds, returning the status of each transport attempted. Transports
+// via which the host was previously unreachable are attempted last, so that a
+// host that is only reachable via one transport does not repeatedly incur
+// timeouts on the others.
+func (s *Scanner) scanTransports(ctx context.Context, pubkey HostPublicKey, addr modules.NetAddress) (ScannedHost, []TransportStatus, error) {
+	s.mu.Lock()
+	var prev []TransportStatus
+	if hr, ok := s.hosts[pubkey]; ok {
+		prev = append(prev, hr.Transports...)
+	}
+	s.mu.Unlock()
+	unreachable := func(t *Transport) bool {
+		for _, ts := range prev {
+			if ts.Transport == t.Name {
+				return !ts.Reachable
+			}
+		}
+		return false
+	}
+
+	var ts []*Transport
+	for _, t := range s.Transports {
+		if t.Accepts == nil || t.Accepts(addr) {
+			ts = append(ts, t)
+		}
+	}
+	sort.SliceStable(ts, func(i, j int) bool {
+		return !unreachable(ts[i]) && unreachable(ts[j])
+	})
+	if len(ts) == 0 {
+		return ScannedHost{}, nil, errors.New("no transport can reach host address")
+	}
+
+	var statuses []TransportStatus
+	var host ScannedHost
+	var err error
+	for _, t := range ts {
+		if err = t.rate.wait(ctx, t.RateLimit); err != nil {
+			break
+		}
+		status := TransportStatus{Transport: t.Name, LastAttempt: time.Now()}
+		host, err = ScanWith(ctx, t.DialContext, addr, pubkey)
+		if err != nil && ctx.Err() != nil {
+			// don't blame the transport for our own cancellation
+			break
+		}
+		status.Reachable = err == nil
+		if err != nil {
+			status.Error = err.Error()
+		}
+		statuses = append(statuses, status)
+		if err == nil {
+			break
+		}
+	}
+	return host, statuses, err
+}
@@ -0,0 +1,140 @@
+package hostdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/renterhost"
+)
+
+// pipeHost returns a dial function that connects to an in-memory host, which
+// responds to a single settings request.
+func pipeHost(key ed25519.PrivateKey) func(context.Context, string, string) (net.Conn, error) {
+	return func(context.Context, string, string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			defer c2.Close()
+			s, err := renterhost.NewHostSession(c2, key)
+			if err != nil {
+				return
+			}
+			if id, err := s.ReadID(); err != nil || id != renterhost.RPCSettingsID {
+				return
+			}
+			js, _ := json.Marshal(HostSettings{Version: "1.5.0"})
+			s.WriteResponse(&renterhost.RPCSettingsResponse{Settings: js}, nil)
+			s.Close()
+		}()
+		return c1, nil
+	}
+}
+
+func TestTransports(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(frand.Bytes(32))
+	hpk := HostKeyFromPublicKey(key.PublicKey())
+
+	var torDials int
+	tor := &Transport{
+		Name: "tor",
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			torDials++
+			return nil, errors.New("proxy unavailable")
+		},
+	}
+	direct := &Transport{
+		Name:        "direct",
+		DialContext: pipeHost(key),
+		Accepts:     func(addr modules.NetAddress) bool { return !isOnion(addr) },
+	}
+	s := NewScanner(0)
+	s.Transports = []*Transport{tor, direct}
+	s.AddHost(hpk, "1.2.3.4:9982")
+
+	s.ScanAll(context.Background())
+	hr, _ := s.Host(hpk)
+	if !hr.Online() || hr.Settings.Version != "1.5.0" {
+		t.Fatal("host should be online:", hr.History)
+	} else if r, ok := hr.ReachableVia("tor"); !ok || r {
+		t.Fatal("host should be unreachable via tor")
+	} else if r, ok := hr.ReachableVia("direct"); !ok || !r {
+		t.Fatal("host should be reachable directly")
+	}
+
+	// the unreachable transport should now be attempted last, i.e. not at all
+	s.ScanAll(context.Background())
+	if torDials != 1 {
+		t.Fatal("expected tor to be skipped after direct succeeded, got", torDials, "dials")
+	}
+
+	// onion addresses cannot be reached directly
+	s.AddHost(hpk, "foo.onion:9982")
+	s.ScanAll(context.Background())
+	hr, _ = s.Host(hpk)
+	if hr.Online() {
+		t.Fatal("host should be offline")
+	} else if sr, _ := hr.LastScan(); !strings.Contains(sr.Error, "proxy unavailable") || sr.ResolveFailed {
+		t.Fatal("wrong scan error:", sr.Error)
+	}
+}
+
+type geolocatorFunc func(ctx context.Context, ip net.IP) (Location, error)
+
+func (fn geolocatorFunc) Locate(ctx context.Context, ip net.IP) (Location, error) {
+	return fn(ctx, ip)
+}
+
+func TestProxyTransport(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(frand.Bytes(32))
+	hpk := HostKeyFromPublicKey(key.PublicKey())
+
+	var dialed []string
+	tor := &Transport{
+		Name: "tor",
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return pipeHost(key)(ctx, network, addr)
+		},
+		Proxy: true,
+	}
+	stub := &stubResolver{ips: map[string]string{"foo.com": "1.2.3.4"}}
+	var located []net.IP
+	s := NewScanner(0)
+	s.Transports = []*Transport{tor}
+	s.Resolver = &CachingResolver{Resolver: stub}
+	s.Geolocator = geolocatorFunc(func(ctx context.Context, ip net.IP) (Location, error) {
+		located = append(located, ip)
+		return Location{Country: "US"}, nil
+	})
+
+	// addresses reached via a proxy should be neither resolved nor located
+	for _, addr := range []modules.NetAddress{"foo.com:9982", "foo.onion:9982", "1.2.3.4:9982"} {
+		s.AddHost(hpk, addr)
+		s.ScanAll(context.Background())
+		if hr, _ := s.Host(hpk); !hr.Online() {
+			t.Fatal("host should be online:", hr.History)
+		} else if dialed[len(dialed)-1] != string(addr) {
+			t.Fatalf("expected %v to be dialed, got %v", addr, dialed[len(dialed)-1])
+		}
+	}
+	if stub.numLookups() != 0 || len(located) != 0 {
+		t.Fatalf("proxied hosts were resolved (%v lookups) or located (%v)", stub.numLookups(), located)
+	}
+
+	// onion addresses should not be resolved, even without a proxy
+	s.Transports = nil
+	s.ScanFunc = func(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+		return ScannedHost{PublicKey: pubkey}, nil
+	}
+	s.AddHost(hpk, "foo.onion:9982")
+	s.ScanAll(context.Background())
+	if hr, _ := s.Host(hpk); !hr.Online() || stub.numLookups() != 0 || len(located) != 0 {
+		t.Fatal("onion host was resolved or located")
+	}
+}
@@ -4,6 +4,7 @@ package ghost
 
 import (
 	"net"
+	"sync"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
@@ -29,6 +30,14 @@ type Host struct {
 	listener    net.Listener
 	contracts   map[types.FileContractID]*hostContract
 	blockHeight types.BlockHeight
+
+	maxSectors int
+
+	settingsRevision uint64
+
+	mu          sync.Mutex
+	accounts    map[renterhost.AccountID]types.Currency
+	withdrawals map[crypto.Hash]struct{}
 }
 
 func (h *Host) PublicKey() hostdb.HostPublicKey {
@@ -40,12 +49,33 @@ func (h *Host) Settings() hostdb.HostSettings {
 		NetAddress:         h.addr,
 		AcceptingContracts: true,
 		WindowSize:         144,
+		RevisionNumber:     h.settingsRevision,
+		Version:            "1.5.0",
 		// ContractPrice:      types.SiacoinPrecision.Mul64(5),
 		// StoragePrice:       types.NewCurrency64(5),
 		// Collateral:         types.NewCurrency64(1),
 	}
 }
 
+// BumpSettingsRevision increments the revision number of the host's settings,
+// simulating a change to its settings.
+func (h *Host) BumpSettingsRevision() {
+	h.settingsRevision++
+}
+
+// SetMaxSectors limits the total number of sectors that the host will store.
+// If n is zero, the host's storage is unlimited.
+func (h *Host) SetMaxSectors(n int) {
+	h.maxSectors = n
+}
+
+func (h *Host) storedSectors() (n int) {
+	for _, c := range h.contracts {
+		n += len(c.sectorRoots)
+	}
+	return
+}
+
 func (h *Host) listen() error {
 	for {
 		conn, err := h.listener.Accept()
@@ -76,6 +106,9 @@ func New(addr string) (*Host, error) {
 		listener:  l,
 		secretKey: ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)),
 		contracts: make(map[types.FileContractID]*hostContract),
+
+		accounts:    make(map[renterhost.AccountID]types.Currency),
+		withdrawals: make(map[crypto.Hash]struct{}),
 	}
 	go h.listen()
 	return h, nil
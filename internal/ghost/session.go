@@ -1,6 +1,8 @@
 package ghost
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"math/bits"
 	"net"
@@ -10,6 +12,7 @@ import (
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renterhost"
@@ -25,10 +28,43 @@ func (s *session) extendDeadline(d time.Duration) {
 	_ = s.conn.SetDeadline(time.Now().Add(d))
 }
 
+// bufferedConn is a net.Conn whose initial bytes have been peeked.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc bufferedConn) Read(p []byte) (int, error) { return bc.r.Read(p) }
+
 func (h *Host) handleConn(conn net.Conn) error {
 	defer conn.Close()
 	conn.SetDeadline(time.Now().Add(60 * time.Second))
 
+	// check for a multiplexed connection
+	bc := bufferedConn{conn, bufio.NewReader(conn)}
+	if prefix, err := bc.r.Peek(len(renterhost.MuxSpecifier)); err == nil && bytes.Equal(prefix, renterhost.MuxSpecifier[:]) {
+		bc.r.Discard(len(prefix))
+		conn.SetDeadline(time.Time{})
+		m := renterhost.NewHostMux(bc)
+		for {
+			stream, err := m.AcceptStream()
+			if err != nil {
+				return nil
+			}
+			go func() {
+				if err := h.handleSession(stream); err != nil {
+					println(err.Error())
+				}
+			}()
+		}
+	}
+	return h.handleSession(bc)
+}
+
+func (h *Host) handleSession(conn net.Conn) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+
 	// establish Session
 	hs, err := renterhost.NewHostSession(conn, h.secretKey)
 	if err != nil {
@@ -47,6 +83,12 @@ func (h *Host) handleConn(conn net.Conn) error {
 		renterhost.RPCWriteID:        h.rpcWrite,
 		renterhost.RPCSectorRootsID:  h.rpcSectorRoots,
 		renterhost.RPCReadID:         h.rpcRead,
+
+		renterhost.RPCRevalidateSettingsID: h.rpcRevalidateSettings,
+		renterhost.RPCLockReadOnlyID:       h.rpcLockReadOnly,
+		renterhost.RPCFundAccountID:        h.rpcFundAccount,
+		renterhost.RPCAccountBalanceID:     h.rpcAccountBalance,
+		renterhost.RPCReadAccountID:        h.rpcReadAccount,
 		// modules.RPCLoopRenewContract: h.managedRPCLoopRenewContract,
 	}
 	for {
@@ -76,6 +118,22 @@ func (h *Host) rpcSettings(s *session) error {
 	return s.sess.WriteResponse(resp, nil)
 }
 
+func (h *Host) rpcRevalidateSettings(s *session) error {
+	s.extendDeadline(60 * time.Second)
+	var req renterhost.RPCRevalidateSettingsRequest
+	if err := s.sess.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+	settings := h.Settings()
+	resp := &renterhost.RPCRevalidateSettingsResponse{
+		Unchanged: req.RevisionNumber == settings.RevisionNumber,
+	}
+	if !resp.Unchanged {
+		resp.Settings, _ = json.Marshal(settings)
+	}
+	return s.sess.WriteResponse(resp, nil)
+}
+
 func (h *Host) rpcFormContract(s *session) error {
 	s.extendDeadline(120 * time.Second)
 
@@ -191,6 +249,33 @@ func (h *Host) rpcLock(s *session) error {
 	return s.sess.WriteResponse(resp, nil)
 }
 
+func (h *Host) rpcLockReadOnly(s *session) error {
+	s.extendDeadline(60 * time.Second)
+
+	var req renterhost.RPCLockRequest
+	if err := s.sess.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+
+	contract, ok := h.contracts[req.ContractID]
+	if !ok || !s.sess.VerifyChallenge(req.Signature, hostdb.HostKeyFromSiaPublicKey(contract.renterKey)) {
+		err := errors.New("bad signature or no such contract")
+		s.sess.WriteResponse(nil, err)
+		return err
+	}
+
+	var newChallenge [16]byte
+	frand.Read(newChallenge[:])
+	s.sess.SetChallenge(newChallenge)
+	resp := &renterhost.RPCLockResponse{
+		Acquired:     true,
+		NewChallenge: newChallenge,
+		Revision:     contract.rev,
+		Signatures:   contract.sigs[:],
+	}
+	return s.sess.WriteResponse(resp, nil)
+}
+
 func (h *Host) rpcUnlock(s *session) error {
 	s.contract = nil
 	return nil
@@ -296,6 +381,14 @@ func (h *Host) rpcWrite(s *session) error {
 	}
 	_, _ = sectorsGained, sectorsRemoved // TODO: use these
 
+	if h.maxSectors > 0 && h.storedSectors()-len(s.contract.sectorRoots)+len(newRoots) > h.maxSectors {
+		// this isn't fatal; the renter may retry with fewer sectors
+		return s.sess.WriteResponse(nil, &renterhost.RPCError{
+			Type:        renterhost.ErrTypeOutOfStorage,
+			Description: "not enough storage remaining to accept sector",
+		})
+	}
+
 	var storageRevenue, newCollateral types.Currency
 	if len(newRoots) > len(s.contract.sectorRoots) {
 		bytesAdded := renterhost.SectorSize * uint64(len(newRoots)-len(s.contract.sectorRoots))
@@ -595,3 +688,145 @@ func (h *Host) rpcRead(s *session) error {
 	// The stop signal must arrive before RPC is complete.
 	return <-stopSignal
 }
+
+func (h *Host) rpcFundAccount(s *session) error {
+	s.extendDeadline(60 * time.Second)
+
+	var req renterhost.RPCFundAccountRequest
+	if err := s.sess.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+
+	if s.contract == nil {
+		err := errors.New("no contract locked")
+		s.sess.WriteResponse(nil, err)
+		return err
+	}
+
+	currentRevision := s.contract.rev
+	var err error
+	if len(req.NewValidProofValues) != len(currentRevision.NewValidProofOutputs) {
+		err = errors.New("wrong number of valid proof values")
+	} else if len(req.NewMissedProofValues) != len(currentRevision.NewMissedProofOutputs) {
+		err = errors.New("wrong number of missed proof values")
+	} else if req.NewValidProofValues[0].Cmp(currentRevision.NewValidProofOutputs[0].Value) > 0 {
+		err = errors.New("renter cannot increase its own payout")
+	}
+	if err != nil {
+		s.sess.WriteResponse(nil, err)
+		return err
+	}
+
+	// construct the new revision
+	newRevision := currentRevision
+	newRevision.NewRevisionNumber = req.NewRevisionNumber
+	newRevision.NewValidProofOutputs = make([]types.SiacoinOutput, len(currentRevision.NewValidProofOutputs))
+	for i := range newRevision.NewValidProofOutputs {
+		newRevision.NewValidProofOutputs[i] = types.SiacoinOutput{
+			Value:      req.NewValidProofValues[i],
+			UnlockHash: currentRevision.NewValidProofOutputs[i].UnlockHash,
+		}
+	}
+	newRevision.NewMissedProofOutputs = make([]types.SiacoinOutput, len(currentRevision.NewMissedProofOutputs))
+	for i := range newRevision.NewMissedProofOutputs {
+		newRevision.NewMissedProofOutputs[i] = types.SiacoinOutput{
+			Value:      req.NewMissedProofValues[i],
+			UnlockHash: currentRevision.NewMissedProofOutputs[i].UnlockHash,
+		}
+	}
+	deposit := currentRevision.NewValidProofOutputs[0].Value.Sub(newRevision.NewValidProofOutputs[0].Value)
+
+	// commit the new revision and credit the account
+	s.contract.rev = newRevision
+	s.contract.sigs[0].Signature = req.Signature
+	s.contract.sigs[1].Signature = h.secretKey.SignHash(renterhost.HashRevision(newRevision))
+	h.mu.Lock()
+	h.accounts[req.Account] = h.accounts[req.Account].Add(deposit)
+	balance := h.accounts[req.Account]
+	h.mu.Unlock()
+
+	return s.sess.WriteResponse(&renterhost.RPCFundAccountResponse{
+		Balance:   balance,
+		Signature: s.contract.sigs[1].Signature,
+	}, nil)
+}
+
+func (h *Host) rpcAccountBalance(s *session) error {
+	s.extendDeadline(60 * time.Second)
+
+	var req renterhost.RPCAccountBalanceRequest
+	if err := s.sess.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	balance := h.accounts[req.Account]
+	h.mu.Unlock()
+	return s.sess.WriteResponse(&renterhost.RPCAccountBalanceResponse{
+		Balance: balance,
+	}, nil)
+}
+
+func (h *Host) rpcReadAccount(s *session) error {
+	s.extendDeadline(120 * time.Second)
+
+	var req renterhost.RPCReadAccountRequest
+	if err := s.sess.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+
+	// validate the withdrawal
+	withdrawal := renterhost.HashWithdrawal(req.Account, req.Amount, req.Nonce)
+	h.mu.Lock()
+	var err error
+	if !ed25519.PublicKey(req.Account[:]).VerifyHash(withdrawal, req.Signature) {
+		err = errors.New("invalid withdrawal signature")
+	} else if _, ok := h.withdrawals[withdrawal]; ok {
+		err = errors.New("withdrawal has already been processed")
+	} else if h.accounts[req.Account].Cmp(req.Amount) < 0 {
+		err = errors.New("insufficient account balance")
+	} else {
+		h.withdrawals[withdrawal] = struct{}{}
+		h.accounts[req.Account] = h.accounts[req.Account].Sub(req.Amount)
+	}
+	h.mu.Unlock()
+	if err != nil {
+		s.sess.WriteResponse(nil, err)
+		return err
+	}
+
+	for _, sec := range req.Sections {
+		var sector [renterhost.SectorSize]byte
+		var ok bool
+		for _, c := range h.contracts {
+			if sector, ok = c.sectorData[sec.MerkleRoot]; ok {
+				break
+			}
+		}
+		if !ok {
+			err = errors.Errorf("no sector with Merkle root %v", sec.MerkleRoot)
+		} else if uint64(sec.Offset)+uint64(sec.Length) > renterhost.SectorSize {
+			err = errors.New("request is out-of-bounds")
+		} else if sec.Length == 0 {
+			err = errors.New("length cannot be zero")
+		} else if req.MerkleProof && (sec.Offset%merkle.SegmentSize != 0 || sec.Length%merkle.SegmentSize != 0) {
+			err = errors.New("offset and length must be multiples of SegmentSize when requesting a Merkle proof")
+		}
+		if err != nil {
+			s.sess.WriteResponse(nil, err)
+			return err
+		}
+
+		resp := &renterhost.RPCReadResponse{
+			Data: sector[sec.Offset : sec.Offset+sec.Length],
+		}
+		if req.MerkleProof {
+			proofStart := int(sec.Offset) / merkle.SegmentSize
+			proofEnd := int(sec.Offset+sec.Length) / merkle.SegmentSize
+			resp.MerkleProof = merkle.BuildProof(&sector, proofStart, proofEnd, nil)
+		}
+		if err := s.sess.WriteResponse(resp, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
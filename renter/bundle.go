@@ -0,0 +1,283 @@
+package renter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+// A bundle is a streamable container for many metafiles, along with the
+// directories that contain them. It consists of a header, a series of
+// entries, an end marker, a JSON index of the entries, and a trailer locating
+// the index. Bundles can thus be written and read sequentially, e.g. to and
+// from a pipe, or read randomly via the index.
+const (
+	bundleMagic   = "usbundle"
+	bundleVersion = 1
+
+	bundleEntryFile = 0
+	bundleEntryDir  = 1
+	bundleEntryEnd  = 0xFF
+
+	bundleTrailerSize = 8 + 8 + 8 // index offset, index length, magic
+)
+
+// ErrBadBundleChecksum is returned when the contents of a bundle entry do not
+// match its checksum.
+var ErrBadBundleChecksum = errors.New("bundle entry failed checksum validation")
+
+// A BundleEntry describes a file or directory within a bundle.
+type BundleEntry struct {
+	Name     string // slash-separated path, relative to the bundle root
+	Mode     os.FileMode
+	Dir      bool
+	Size     int64
+	Offset   int64 // offset of the entry's contents within the bundle
+	Checksum [32]byte
+}
+
+func validBundleName(name string) bool {
+	return name != "" && name != "." && !path.IsAbs(name) && path.Clean(name) == name &&
+		name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// A BundleWriter writes a bundle to an underlying stream.
+type BundleWriter struct {
+	w       io.Writer
+	off     int64
+	entries []BundleEntry
+	err     error
+}
+
+func (bw *BundleWriter) write(p []byte) {
+	if bw.err == nil {
+		var n int
+		n, bw.err = bw.w.Write(p)
+		bw.off += int64(n)
+	}
+}
+
+func (bw *BundleWriter) writeEntry(e BundleEntry, typ byte, data []byte) error {
+	if !validBundleName(e.Name) {
+		return errors.Errorf("invalid bundle entry name %q", e.Name)
+	} else if len(e.Name) > 1<<16-1 {
+		return errors.New("bundle entry name is too long")
+	}
+	header := make([]byte, 1+2+len(e.Name)+4+8+32)
+	header[0] = typ
+	binary.LittleEndian.PutUint16(header[1:], uint16(len(e.Name)))
+	rest := header[3+copy(header[3:], e.Name):]
+	binary.LittleEndian.PutUint32(rest[0:], uint32(e.Mode))
+	binary.LittleEndian.PutUint64(rest[4:], uint64(e.Size))
+	copy(rest[12:], e.Checksum[:])
+	bw.write(header)
+	e.Offset = bw.off
+	bw.write(data)
+	if bw.err != nil {
+		return errors.Wrap(bw.err, "could not write bundle entry")
+	}
+	bw.entries = append(bw.entries, e)
+	return nil
+}
+
+// WriteDir adds a directory entry to the bundle.
+func (bw *BundleWriter) WriteDir(name string, mode os.FileMode) error {
+	return bw.writeEntry(BundleEntry{
+		Name: name,
+		Mode: mode,
+		Dir:  true,
+	}, bundleEntryDir, nil)
+}
+
+// WriteFile adds a file entry, typically containing the raw bytes of a
+// metafile, to the bundle.
+func (bw *BundleWriter) WriteFile(name string, mode os.FileMode, data []byte) error {
+	return bw.writeEntry(BundleEntry{
+		Name:     name,
+		Mode:     mode,
+		Size:     int64(len(data)),
+		Checksum: blake2b.Sum256(data),
+	}, bundleEntryFile, data)
+}
+
+// Close writes the bundle's index and trailer. It does not close the
+// underlying stream.
+func (bw *BundleWriter) Close() error {
+	bw.write([]byte{bundleEntryEnd})
+	indexOff := bw.off
+	index, _ := json.Marshal(bw.entries)
+	bw.write(index)
+	trailer := make([]byte, bundleTrailerSize)
+	binary.LittleEndian.PutUint64(trailer[0:], uint64(indexOff))
+	binary.LittleEndian.PutUint64(trailer[8:], uint64(len(index)))
+	copy(trailer[16:], bundleMagic)
+	bw.write(trailer)
+	return errors.Wrap(bw.err, "could not write bundle index")
+}
+
+// NewBundleWriter returns a BundleWriter that writes to w.
+func NewBundleWriter(w io.Writer) (*BundleWriter, error) {
+	bw := &BundleWriter{w: w}
+	bw.write(append([]byte(bundleMagic), bundleVersion))
+	if bw.err != nil {
+		return nil, errors.Wrap(bw.err, "could not write bundle header")
+	}
+	return bw, nil
+}
+
+// A BundleReader reads a bundle sequentially from an underlying stream.
+type BundleReader struct {
+	r    *bufio.Reader
+	off  int64
+	cur  BundleEntry
+	rem  int64
+	h    hash.Hash
+	done bool
+}
+
+func (br *BundleReader) readFull(p []byte) error {
+	n, err := io.ReadFull(br.r, p)
+	br.off += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Next advances to the next entry in the bundle, discarding any unread
+// contents of the current entry. It returns io.EOF at the end of the bundle.
+func (br *BundleReader) Next() (*BundleEntry, error) {
+	if br.done {
+		return nil, io.EOF
+	}
+	if br.rem > 0 {
+		if _, err := io.CopyN(ioutil.Discard, br, br.rem); err != nil {
+			return nil, err
+		}
+	}
+	var typ [1]byte
+	if err := br.readFull(typ[:]); err != nil {
+		return nil, errors.Wrap(err, "could not read bundle entry")
+	}
+	switch typ[0] {
+	case bundleEntryEnd:
+		br.done = true
+		return nil, io.EOF
+	case bundleEntryFile, bundleEntryDir:
+	default:
+		return nil, errors.Errorf("unknown bundle entry type %v", typ[0])
+	}
+	var nameLen [2]byte
+	if err := br.readFull(nameLen[:]); err != nil {
+		return nil, errors.Wrap(err, "could not read bundle entry")
+	}
+	buf := make([]byte, int(binary.LittleEndian.Uint16(nameLen[:]))+4+8+32)
+	if err := br.readFull(buf); err != nil {
+		return nil, errors.Wrap(err, "could not read bundle entry")
+	}
+	name, rest := string(buf[:len(buf)-44]), buf[len(buf)-44:]
+	if !validBundleName(name) {
+		return nil, errors.Errorf("invalid bundle entry name %q", name)
+	}
+	br.cur = BundleEntry{
+		Name:   name,
+		Mode:   os.FileMode(binary.LittleEndian.Uint32(rest[0:])),
+		Dir:    typ[0] == bundleEntryDir,
+		Size:   int64(binary.LittleEndian.Uint64(rest[4:])),
+		Offset: br.off,
+	}
+	copy(br.cur.Checksum[:], rest[12:])
+	if br.cur.Dir && br.cur.Size != 0 {
+		return nil, errors.New("bundle directory entry has non-zero size")
+	}
+	br.rem = br.cur.Size
+	br.h, _ = blake2b.New256(nil)
+	e := br.cur
+	return &e, nil
+}
+
+// Read reads the contents of the current entry. It returns
+// ErrBadBundleChecksum, instead of io.EOF, if the contents do not match the
+// entry's checksum.
+func (br *BundleReader) Read(p []byte) (int, error) {
+	if br.rem == 0 {
+		if br.h == nil || br.cur.Dir {
+			return 0, io.EOF
+		}
+		var sum [32]byte
+		if copy(sum[:], br.h.Sum(nil)); sum != br.cur.Checksum {
+			return 0, ErrBadBundleChecksum
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > br.rem {
+		p = p[:br.rem]
+	}
+	n, err := br.r.Read(p)
+	br.h.Write(p[:n])
+	br.off += int64(n)
+	br.rem -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// NewBundleReader returns a BundleReader that reads from r.
+func NewBundleReader(r io.Reader) (*BundleReader, error) {
+	br := &BundleReader{r: bufio.NewReader(r)}
+	header := make([]byte, len(bundleMagic)+1)
+	if err := br.readFull(header); err != nil {
+		return nil, errors.Wrap(err, "could not read bundle header")
+	} else if string(header[:len(bundleMagic)]) != bundleMagic {
+		return nil, errors.New("not a bundle")
+	} else if header[len(bundleMagic)] != bundleVersion {
+		return nil, errors.Errorf("unsupported bundle version %v", header[len(bundleMagic)])
+	}
+	return br, nil
+}
+
+// ReadBundleIndex reads the index of the bundle in r, which is size bytes
+// long. The contents of an entry e can then be read from
+// io.NewSectionReader(r, e.Offset, e.Size).
+func ReadBundleIndex(r io.ReaderAt, size int64) ([]BundleEntry, error) {
+	if size < int64(len(bundleMagic)+1+1+bundleTrailerSize) {
+		return nil, errors.New("bundle is too small")
+	}
+	trailer := make([]byte, bundleTrailerSize)
+	if _, err := r.ReadAt(trailer, size-bundleTrailerSize); err != nil {
+		return nil, errors.Wrap(err, "could not read bundle trailer")
+	} else if string(trailer[16:]) != bundleMagic {
+		return nil, errors.New("not a bundle")
+	}
+	indexOff := int64(binary.LittleEndian.Uint64(trailer[0:]))
+	indexLen := int64(binary.LittleEndian.Uint64(trailer[8:]))
+	if indexOff < 0 || indexLen < 0 || indexOff+indexLen != size-bundleTrailerSize {
+		return nil, errors.New("bundle trailer is corrupted")
+	}
+	index := make([]byte, indexLen)
+	if _, err := r.ReadAt(index, indexOff); err != nil {
+		return nil, errors.Wrap(err, "could not read bundle index")
+	}
+	var entries []BundleEntry
+	if err := json.Unmarshal(index, &entries); err != nil {
+		return nil, errors.Wrap(err, "could not decode bundle index")
+	}
+	for _, e := range entries {
+		if !validBundleName(e.Name) {
+			return nil, errors.Errorf("invalid bundle entry name %q", e.Name)
+		} else if e.Offset < 0 || e.Size < 0 || e.Offset+e.Size > indexOff {
+			return nil, errors.Errorf("bundle entry %q is out of bounds", e.Name)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,99 @@
+package renter
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestBundle(t *testing.T) {
+	files := []struct {
+		name string
+		dir  bool
+		data []byte
+	}{
+		{"foo", true, nil},
+		{"foo/bar.usa", false, frand.Bytes(1000)},
+		{"baz.usa", false, frand.Bytes(5000)},
+		{"empty.usa", false, nil},
+	}
+	var buf bytes.Buffer
+	bw, err := NewBundleWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.dir {
+			err = bw.WriteDir(f.name, 0700)
+		} else {
+			err = bw.WriteFile(f.name, 0600, f.data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"", "/abs", "../up", "a/../b", "./a"} {
+		if err := bw.WriteFile(name, 0600, nil); err == nil {
+			t.Fatalf("expected error for name %q", name)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bundle := buf.Bytes()
+
+	// read sequentially, skipping one file
+	br, err := NewBundleReader(bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range files {
+		e, err := br.Next()
+		if err != nil {
+			t.Fatal(err)
+		} else if e.Name != f.name || e.Dir != f.dir || e.Size != int64(len(f.data)) {
+			t.Fatalf("entry %v does not match: %+v", i, e)
+		}
+		if i == 1 {
+			continue
+		}
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(data, f.data) {
+			t.Fatalf("entry %v contents do not match", i)
+		}
+	}
+	if _, err := br.Next(); err != io.EOF {
+		t.Fatal("expected io.EOF, got", err)
+	}
+
+	// read randomly via the index
+	r := bytes.NewReader(bundle)
+	entries, err := ReadBundleIndex(r, int64(len(bundle)))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != len(files) {
+		t.Fatalf("expected %v entries, got %v", len(files), len(entries))
+	}
+	e := entries[2]
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, e.Offset, e.Size))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, files[2].data) {
+		t.Fatal("indexed entry contents do not match")
+	}
+
+	// corrupted contents should be detected
+	bundle[e.Offset] ^= 1
+	br, _ = NewBundleReader(bytes.NewReader(bundle))
+	for i := 0; i < 3; i++ {
+		br.Next()
+	}
+	if _, err := ioutil.ReadAll(br); err != ErrBadBundleChecksum {
+		t.Fatal("expected ErrBadBundleChecksum, got", err)
+	}
+}
@@ -0,0 +1,234 @@
+package renter
+
+import (
+	"fmt"
+
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+)
+
+// A CheckProblem identifies a kind of inconsistency detected by
+// MetaFile.Check.
+type CheckProblem int
+
+// Possible CheckProblem values.
+const (
+	// ProblemInvalidParams indicates that the redundancy parameters are
+	// invalid, e.g. MinShards exceeds the number of hosts. It cannot be
+	// repaired.
+	ProblemInvalidParams CheckProblem = iota
+	// ProblemDuplicateHost indicates that a host appears more than once in
+	// Hosts. It cannot be repaired.
+	ProblemDuplicateHost
+	// ProblemShardCount indicates that the number of shards does not match
+	// the number of hosts. It is repaired by adding empty shards or
+	// discarding shards that do not correspond to any host.
+	ProblemShardCount
+	// ProblemInvalidSlice indicates that a SectorSlice is empty or extends
+	// beyond the end of its sector, so that chunk offsets are not strictly
+	// increasing. It is repaired by truncating the shard before the slice.
+	ProblemInvalidSlice
+	// ProblemInconsistentChunk indicates that shards disagree on the size of
+	// a chunk. It is repaired by truncating all shards before the chunk.
+	ProblemInconsistentChunk
+	// ProblemMissingContract indicates that no contract exists for a host.
+	// It cannot be repaired by Check; the host's shard must be migrated.
+	ProblemMissingContract
+	// ProblemChunkHashes indicates that the integrity manifest references
+	// more chunks than the shards contain. It is repaired by truncating the
+	// manifest.
+	ProblemChunkHashes
+	// ProblemCriticalExtension indicates that the metafile contains a
+	// critical extension that is not supported. It cannot be repaired.
+	ProblemCriticalExtension
+)
+
+// String implements fmt.Stringer.
+func (p CheckProblem) String() string {
+	switch p {
+	case ProblemInvalidParams:
+		return "invalid parameters"
+	case ProblemDuplicateHost:
+		return "duplicate host"
+	case ProblemShardCount:
+		return "wrong shard count"
+	case ProblemInvalidSlice:
+		return "invalid slice"
+	case ProblemInconsistentChunk:
+		return "inconsistent chunk"
+	case ProblemMissingContract:
+		return "missing contract"
+	case ProblemChunkHashes:
+		return "invalid integrity manifest"
+	case ProblemCriticalExtension:
+		return "unsupported critical extension"
+	default:
+		return fmt.Sprintf("CheckProblem(%d)", int(p))
+	}
+}
+
+// A CheckFinding is a problem detected by MetaFile.Check.
+type CheckFinding struct {
+	Problem CheckProblem
+	Shard   int // -1 if not applicable
+	Chunk   int // -1 if not applicable
+	Details string
+	// Repaired is true if the problem was repaired.
+	Repaired bool
+}
+
+// String implements fmt.Stringer.
+func (f CheckFinding) String() string {
+	s := f.Problem.String()
+	if f.Shard >= 0 {
+		s += fmt.Sprintf(" (shard %v", f.Shard)
+		if f.Chunk >= 0 {
+			s += fmt.Sprintf(", chunk %v", f.Chunk)
+		}
+		s += ")"
+	} else if f.Chunk >= 0 {
+		s += fmt.Sprintf(" (chunk %v)", f.Chunk)
+	}
+	if f.Details != "" {
+		s += ": " + f.Details
+	}
+	if f.Repaired {
+		s += " [repaired]"
+	}
+	return s
+}
+
+// Check validates the internal consistency of m, returning a finding for
+// each problem detected. If contracts is non-nil, Check also reports hosts
+// for which no contract exists. If repair is true, Check repairs any problems
+// that can be repaired, possibly discarding file data that is unrecoverable
+// anyway; the caller is responsible for writing the repaired metafile to
+// disk.
+func (m *MetaFile) Check(contracts ContractSet, repair bool) []CheckFinding {
+	var findings []CheckFinding
+	report := func(p CheckProblem, shard, chunk int, repaired bool, format string, args ...interface{}) {
+		findings = append(findings, CheckFinding{
+			Problem:  p,
+			Shard:    shard,
+			Chunk:    chunk,
+			Details:  fmt.Sprintf(format, args...),
+			Repaired: repaired,
+		})
+	}
+
+	if m.MinShards <= 0 || m.MinShards > len(m.Hosts) {
+		report(ProblemInvalidParams, -1, -1, false, "MinShards is %v, with %v hosts", m.MinShards, len(m.Hosts))
+	}
+	if m.Filesize < 0 {
+		report(ProblemInvalidParams, -1, -1, false, "Filesize is negative (%v)", m.Filesize)
+	}
+	if m.IsInline() {
+		for i, shard := range m.Shards {
+			if len(shard) > 0 {
+				report(ProblemInvalidParams, i, -1, false, "inline file has shard data")
+				break
+			}
+		}
+	}
+	if c := m.Cipher(); !c.Valid() {
+		report(ProblemInvalidParams, -1, -1, false, "unsupported cipher %v", c)
+	}
+	if tiers := m.RedundancyTiers(); len(tiers) > 0 {
+		if err := validateTiers(tiers, m.MinShards, m.Filesize); err != nil {
+			report(ProblemInvalidParams, -1, -1, false, "invalid redundancy tiers: %v", err)
+		}
+	}
+	seen := make(map[hostdb.HostPublicKey]int)
+	for i, h := range m.Hosts {
+		if j, ok := seen[h]; ok {
+			report(ProblemDuplicateHost, i, -1, false, "%v also stores shard %v", h.ShortKey(), j)
+		} else {
+			seen[h] = i
+		}
+		if _, ok := contracts[h]; contracts != nil && !ok {
+			report(ProblemMissingContract, i, -1, false, "no contract with %v", h.ShortKey())
+		}
+	}
+	for _, ext := range m.Extensions {
+		if ext.Critical && !supportedExtensions[ext.Type] {
+			report(ProblemCriticalExtension, -1, -1, false, "extension type %v", ext.Type)
+		}
+	}
+
+	if len(m.Shards) != len(m.Hosts) {
+		report(ProblemShardCount, -1, -1, repair, "%v shards, %v hosts", len(m.Shards), len(m.Hosts))
+		if repair {
+			for len(m.Shards) < len(m.Hosts) {
+				m.Shards = append(m.Shards, nil)
+			}
+			m.Shards = m.Shards[:len(m.Hosts)]
+		}
+	}
+
+	// a shard is considered to end at its first invalid slice, whether or not
+	// it is truncated
+	lens := make([]int, len(m.Shards))
+	for i, shard := range m.Shards {
+		lens[i] = len(shard)
+		for j, ss := range shard {
+			end := uint64(ss.SegmentIndex) + uint64(ss.NumSegments)
+			if ss == (SectorSlice{}) || (ss.NumSegments > 0 && end <= merkle.SegmentsPerSector) {
+				continue // valid or missing
+			}
+			report(ProblemInvalidSlice, i, j, repair, "slice covers segments [%v, %v)", ss.SegmentIndex, end)
+			lens[i] = j
+			if repair {
+				m.Shards[i] = shard[:j]
+			}
+			break
+		}
+	}
+
+	// report the first chunk whose size is inconsistent; subsequent chunks
+	// are unrecoverable after repair
+outer:
+	for chunk := 0; ; chunk++ {
+		first := -1
+		more := false
+		for i := range m.Shards {
+			if chunk >= lens[i] {
+				continue
+			}
+			more = true
+			if m.Shards[i][chunk] == (SectorSlice{}) {
+				continue
+			} else if first == -1 {
+				first = i
+			} else if m.Shards[i][chunk].NumSegments != m.Shards[first][chunk].NumSegments {
+				report(ProblemInconsistentChunk, i, chunk, repair, "%v segments, but shard %v has %v",
+					m.Shards[i][chunk].NumSegments, first, m.Shards[first][chunk].NumSegments)
+				if repair {
+					for k := range m.Shards {
+						if len(m.Shards[k]) > chunk {
+							m.Shards[k] = m.Shards[k][:chunk]
+						}
+					}
+				}
+				break outer
+			}
+		}
+		if !more {
+			break
+		}
+	}
+
+	var numChunks int
+	for _, shard := range m.Shards {
+		if len(shard) > numChunks {
+			numChunks = len(shard)
+		}
+	}
+	if hashes := m.ChunkHashes(); len(hashes) > numChunks {
+		report(ProblemChunkHashes, -1, -1, repair, "%v hashes, %v chunks", len(hashes), numChunks)
+		if repair {
+			m.SetChunkHashes(hashes[:numChunks])
+		}
+	}
+
+	return findings
+}
@@ -0,0 +1,98 @@
+package renter
+
+import (
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+)
+
+func TestMetaFileCheck(t *testing.T) {
+	hosts := make([]hostdb.HostPublicKey, 3)
+	contracts := make(ContractSet)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+		contracts[hosts[i]] = Contract{HostKey: hosts[i]}
+	}
+	newFile := func() *MetaFile {
+		m := NewMetaFile(0660, 0, hosts, 2)
+		for chunk := 0; chunk < 10; chunk++ {
+			for i := range m.Shards {
+				m.Shards[i] = append(m.Shards[i], SectorSlice{SegmentIndex: uint32(chunk), NumSegments: 1})
+			}
+			m.Filesize += m.MinChunkSize()
+		}
+		return m
+	}
+
+	// a consistent metafile should have no findings
+	m := newFile()
+	if fs := m.Check(contracts, true); len(fs) != 0 {
+		t.Fatal("expected no findings, got", fs)
+	}
+
+	// introduce a variety of problems
+	m.Shards = append(m.Shards, nil)
+	m.Shards[0][5].NumSegments = 0
+	m.Shards[1][7].NumSegments = 2
+	m.Shards[2][8].SegmentIndex = merkle.SegmentsPerSector
+	delete(contracts, hosts[2])
+	hashes := make([]crypto.Hash, 10)
+	for i := range hashes {
+		hashes[i] = crypto.Hash{1}
+	}
+	m.SetChunkHashes(hashes)
+
+	// without repair, problems are reported but m is unchanged
+	fs := m.Check(contracts, false)
+	want := []CheckProblem{ProblemMissingContract, ProblemShardCount, ProblemInvalidSlice, ProblemInvalidSlice, ProblemInconsistentChunk}
+	if len(fs) != len(want) {
+		t.Fatal("wrong findings:", fs)
+	}
+	for i := range fs {
+		if fs[i].Problem != want[i] || fs[i].Repaired {
+			t.Fatal("wrong findings:", fs)
+		}
+	}
+	if len(m.Shards) != 4 || len(m.Shards[0]) != 10 {
+		t.Fatal("Check modified m without repair")
+	}
+
+	// repair should truncate each shard before its first invalid slice, and
+	// all shards before the first inconsistent chunk
+	fs = m.Check(contracts, true)
+	want = []CheckProblem{ProblemMissingContract, ProblemShardCount, ProblemInvalidSlice, ProblemInvalidSlice, ProblemInconsistentChunk, ProblemChunkHashes}
+	if len(fs) != len(want) {
+		t.Fatal("wrong findings:", fs)
+	}
+	for i := range fs {
+		if fs[i].Problem != want[i] || fs[i].Repaired != (fs[i].Problem != ProblemMissingContract) {
+			t.Fatal("wrong findings:", fs)
+		}
+	}
+	if len(m.Shards) != 3 || len(m.Shards[0]) != 5 || len(m.Shards[1]) != 7 || len(m.Shards[2]) != 7 {
+		t.Fatal("shards were not repaired correctly")
+	} else if len(m.ChunkHashes()) != 7 {
+		t.Fatal("integrity manifest was not repaired")
+	} else if err := validateShards(m.Shards); err != nil {
+		t.Fatal(err)
+	}
+
+	// after repair, only unrepairable problems remain
+	if fs := m.Check(contracts, true); len(fs) != 1 || fs[0].Problem != ProblemMissingContract {
+		t.Fatal("expected only missing contract, got", fs)
+	}
+
+	// unrepairable problems
+	m = newFile()
+	m.MinShards = 4
+	m.Hosts[1] = m.Hosts[0]
+	m.SetExtension(1000, true, nil)
+	if fs := m.Check(nil, true); len(fs) != 3 || fs[0].Problem != ProblemInvalidParams ||
+		fs[1].Problem != ProblemDuplicateHost || fs[2].Problem != ProblemCriticalExtension || fs[1].Repaired {
+		t.Fatal("wrong findings:", fs)
+	}
+}
@@ -0,0 +1,175 @@
+package renter
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+)
+
+// ExtUploadProgress is a MetaExtension recording the chunks of an upload that
+// are pending, i.e. that were sent to a host, but whose upload was not
+// confirmed before the metafile was written. It contains a series of
+// (shard, chunk) index pairs, each encoded as two little-endian uint32s.
+const ExtUploadProgress MetaExtensionType = 5
+
+// A ChunkStatus describes the upload status of a chunk within a shard.
+type ChunkStatus uint8
+
+// Possible ChunkStatus values.
+const (
+	// ChunkMissing indicates that the chunk has not been uploaded to the
+	// shard's host.
+	ChunkMissing ChunkStatus = iota
+	// ChunkPending indicates that the chunk was sent to the host, but the
+	// upload was not confirmed. The SectorSlice of a pending chunk is valid,
+	// but the host may not be storing it.
+	ChunkPending
+	// ChunkConfirmed indicates that the host is storing the chunk.
+	ChunkConfirmed
+)
+
+type chunkRef struct {
+	shard, chunk int
+}
+
+func (m *MetaFile) pendingChunks() map[chunkRef]struct{} {
+	pending := make(map[chunkRef]struct{})
+	data, _ := m.Extension(ExtUploadProgress)
+	for ; len(data) >= 8; data = data[8:] {
+		pending[chunkRef{
+			shard: int(binary.LittleEndian.Uint32(data[0:])),
+			chunk: int(binary.LittleEndian.Uint32(data[4:])),
+		}] = struct{}{}
+	}
+	return pending
+}
+
+func (m *MetaFile) setPendingChunks(pending map[chunkRef]struct{}) {
+	if len(pending) == 0 {
+		m.RemoveExtension(ExtUploadProgress)
+		return
+	}
+	refs := make([]chunkRef, 0, len(pending))
+	for ref := range pending {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].shard != refs[j].shard {
+			return refs[i].shard < refs[j].shard
+		}
+		return refs[i].chunk < refs[j].chunk
+	})
+	data := make([]byte, 8*len(refs))
+	for i, ref := range refs {
+		binary.LittleEndian.PutUint32(data[i*8:], uint32(ref.shard))
+		binary.LittleEndian.PutUint32(data[i*8+4:], uint32(ref.chunk))
+	}
+	m.SetExtension(ExtUploadProgress, false, data)
+}
+
+// ChunkStatus returns the upload status of the specified chunk of the
+// specified shard. Chunks are considered missing if their SectorSlice is the
+// zero value.
+func (m *MetaFile) ChunkStatus(shard, chunk int) ChunkStatus {
+	if _, ok := m.pendingChunks()[chunkRef{shard, chunk}]; ok {
+		return ChunkPending
+	} else if chunk < len(m.Shards[shard]) && m.Shards[shard][chunk] != (SectorSlice{}) {
+		return ChunkConfirmed
+	}
+	return ChunkMissing
+}
+
+// setSlice stores ss as the specified chunk of the specified shard, extending
+// the shard with missing chunks as necessary.
+func (m *MetaFile) setSlice(shard, chunk int, ss SectorSlice) {
+	for len(m.Shards[shard]) <= chunk {
+		m.Shards[shard] = append(m.Shards[shard], SectorSlice{})
+	}
+	m.Shards[shard][chunk] = ss
+}
+
+// MarkPending stores ss as the specified chunk of the specified shard, and
+// marks the chunk as pending. It should be called, and the metafile written
+// to disk, before the sector containing ss is uploaded.
+func (m *MetaFile) MarkPending(shard, chunk int, ss SectorSlice) {
+	m.setSlice(shard, chunk, ss)
+	pending := m.pendingChunks()
+	pending[chunkRef{shard, chunk}] = struct{}{}
+	m.setPendingChunks(pending)
+}
+
+// MarkConfirmed marks the specified chunk of the specified shard, which must
+// be pending, as confirmed.
+func (m *MetaFile) MarkConfirmed(shard, chunk int) error {
+	pending := m.pendingChunks()
+	if _, ok := pending[chunkRef{shard, chunk}]; !ok {
+		return errors.Errorf("chunk %v of shard %v is not pending", chunk, shard)
+	}
+	delete(pending, chunkRef{shard, chunk})
+	m.setPendingChunks(pending)
+	return nil
+}
+
+// MarkMissing marks the specified chunk of the specified shard as missing,
+// discarding its SectorSlice.
+func (m *MetaFile) MarkMissing(shard, chunk int) {
+	pending := m.pendingChunks()
+	delete(pending, chunkRef{shard, chunk})
+	m.setPendingChunks(pending)
+	if chunk < len(m.Shards[shard]) {
+		m.Shards[shard][chunk] = SectorSlice{}
+		// trim trailing missing chunks
+		s := m.Shards[shard]
+		for len(s) > 0 && s[len(s)-1] == (SectorSlice{}) {
+			s = s[:len(s)-1]
+		}
+		m.Shards[shard] = s
+	}
+}
+
+// PendingChunks returns the indices of the pending chunks of the specified
+// shard, in ascending order.
+func (m *MetaFile) PendingChunks(shard int) []int {
+	var chunks []int
+	for ref := range m.pendingChunks() {
+		if ref.shard == shard {
+			chunks = append(chunks, ref.chunk)
+		}
+	}
+	sort.Ints(chunks)
+	return chunks
+}
+
+// MissingChunks returns the indices of the chunks of the specified shard that
+// must be uploaded, in ascending order, assuming the file comprises numChunks
+// chunks. Pending chunks are not included; they should first be resolved with
+// ResolvePending.
+func (m *MetaFile) MissingChunks(shard, numChunks int) []int {
+	var chunks []int
+	for chunk := 0; chunk < numChunks; chunk++ {
+		if m.ChunkStatus(shard, chunk) == ChunkMissing {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// ResolvePending resolves the pending chunks of the specified shard, given
+// the Merkle roots of the sectors stored by the shard's host. Pending chunks
+// whose sectors are stored by the host are marked as confirmed; the rest are
+// marked as missing.
+func (m *MetaFile) ResolvePending(shard int, roots []crypto.Hash) {
+	stored := make(map[crypto.Hash]struct{}, len(roots))
+	for _, root := range roots {
+		stored[root] = struct{}{}
+	}
+	for _, chunk := range m.PendingChunks(shard) {
+		if _, ok := stored[m.Shards[shard][chunk].MerkleRoot]; ok {
+			m.MarkConfirmed(shard, chunk)
+		} else {
+			m.MarkMissing(shard, chunk)
+		}
+	}
+}
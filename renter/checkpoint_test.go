@@ -0,0 +1,96 @@
+package renter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+)
+
+func TestUploadCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := make([]hostdb.HostPublicKey, 2)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	}
+	m := NewMetaFile(0660, 0, hosts, 1)
+	newSlice := func() SectorSlice {
+		ss := SectorSlice{NumSegments: 1}
+		frand.Read(ss.MerkleRoot[:])
+		return ss
+	}
+
+	// upload chunks out of order, as parallel uploaders would
+	const numChunks = 5
+	slices := make([]SectorSlice, numChunks)
+	for i := range slices {
+		slices[i] = newSlice()
+	}
+	for _, chunk := range []int{0, 1, 3} {
+		m.MarkPending(0, chunk, slices[chunk])
+		if m.ChunkStatus(0, chunk) != ChunkPending {
+			t.Fatal("expected chunk to be pending")
+		}
+	}
+	if err := m.MarkConfirmed(0, 0); err != nil {
+		t.Fatal(err)
+	} else if err := m.MarkConfirmed(0, 0); err == nil {
+		t.Fatal("expected confirmed chunk to not be pending")
+	}
+	m.MarkPending(1, 0, slices[0])
+
+	// the checkpoint should survive a round-trip; simulate a crash
+	filename := filepath.Join(dir, "foo.usa")
+	if err := WriteMetaFile(filename, m); err != nil {
+		t.Fatal(err)
+	}
+	m, err = ReadMetaFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := []ChunkStatus{ChunkConfirmed, ChunkPending, ChunkMissing, ChunkPending, ChunkMissing}
+	for chunk, s := range statuses {
+		if m.ChunkStatus(0, chunk) != s {
+			t.Fatalf("chunk %v: expected status %v, got %v", chunk, s, m.ChunkStatus(0, chunk))
+		}
+	}
+	if !reflect.DeepEqual(m.PendingChunks(0), []int{1, 3}) {
+		t.Fatal("wrong pending chunks:", m.PendingChunks(0))
+	}
+
+	// the host stored chunk 3, but not chunk 1
+	m.ResolvePending(0, []crypto.Hash{slices[0].MerkleRoot, slices[3].MerkleRoot})
+	if len(m.PendingChunks(0)) != 0 {
+		t.Fatal("pending chunks were not resolved")
+	} else if !reflect.DeepEqual(m.MissingChunks(0, numChunks), []int{1, 2, 4}) {
+		t.Fatal("wrong missing chunks:", m.MissingChunks(0, numChunks))
+	}
+	// the other shard is unaffected
+	if !reflect.DeepEqual(m.PendingChunks(1), []int{0}) {
+		t.Fatal("wrong pending chunks:", m.PendingChunks(1))
+	}
+
+	// resume the upload
+	for _, chunk := range m.MissingChunks(0, numChunks) {
+		m.MarkPending(0, chunk, slices[chunk])
+		m.MarkConfirmed(0, chunk)
+	}
+	m.ResolvePending(1, nil)
+	if _, ok := m.Extension(ExtUploadProgress); ok {
+		t.Fatal("progress should not be stored once no chunks are pending")
+	} else if !reflect.DeepEqual(m.Shards[0], slices) {
+		t.Fatal("shard does not match uploaded slices")
+	} else if len(m.Shards[1]) != 0 {
+		t.Fatal("missing chunks should be trimmed")
+	}
+}
@@ -0,0 +1,138 @@
+package renter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/sys/cpu"
+	"lukechampine.com/us/merkle"
+)
+
+// ExtCipher is a critical MetaExtension recording the Cipher used to encrypt
+// the metafile's sectors, as a single byte. Metafiles without this extension
+// use CipherXChaCha20Poly1305.
+const ExtCipher MetaExtensionType = 10
+
+func init() {
+	supportedExtensions[ExtCipher] = true
+	extensionValidators[ExtCipher] = validateCipherExtension
+}
+
+// A Cipher identifies the cipher family used to encrypt sector data.
+//
+// Sectors must be decryptable segment-by-segment, so only a stream cipher is
+// applied to sector data; authenticity is instead provided by the sector
+// Merkle roots and the integrity manifest (see ExtChunkHashes). Inline data,
+// which is not stored on hosts, is sealed with the corresponding AEAD.
+type Cipher uint8
+
+// Supported Ciphers.
+const (
+	// CipherXChaCha20Poly1305 encrypts sectors with XChaCha20. It is fast on
+	// all platforms, and is the default when hardware AES is unavailable.
+	CipherXChaCha20Poly1305 Cipher = iota
+	// CipherAES256CTR encrypts sectors with AES-256 in counter mode, using a
+	// subkey derived from the KeySeed and nonce. Inline data is sealed with
+	// AES-256-GCM.
+	CipherAES256CTR
+)
+
+// cipherMalformed is returned by MetaFile.Cipher if the ExtCipher extension
+// is malformed. It is not a valid Cipher.
+const cipherMalformed Cipher = 0xFF
+
+// String implements fmt.Stringer.
+func (c Cipher) String() string {
+	switch c {
+	case CipherXChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	case CipherAES256CTR:
+		return "AES-256-CTR"
+	default:
+		return fmt.Sprintf("Cipher(%d)", uint8(c))
+	}
+}
+
+// Valid returns true if c is a supported Cipher.
+func (c Cipher) Valid() bool {
+	return c == CipherXChaCha20Poly1305 || c == CipherAES256CTR
+}
+
+// hasHardwareAES reports whether the CPU provides AES instructions; without
+// them, AES is much slower than XChaCha20 and vulnerable to timing attacks.
+var hasHardwareAES = (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) ||
+	(cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) ||
+	(cpu.S390X.HasAESCTR && cpu.S390X.HasAESGCM)
+
+// DefaultCipher returns the Cipher used by NewMetaFile: CipherAES256CTR if
+// the CPU supports hardware-accelerated AES, and CipherXChaCha20Poly1305
+// otherwise.
+func DefaultCipher() Cipher {
+	if hasHardwareAES {
+		return CipherAES256CTR
+	}
+	return CipherXChaCha20Poly1305
+}
+
+// Cipher returns the Cipher used to encrypt m's sectors. Metafiles with an
+// invalid ExtCipher extension are rejected when read, but if m was modified
+// directly, the returned Cipher may not be Valid.
+func (m *MetaFile) Cipher() Cipher {
+	data, ok := m.Extension(ExtCipher)
+	if !ok {
+		return CipherXChaCha20Poly1305
+	} else if len(data) != 1 {
+		return cipherMalformed
+	}
+	return Cipher(data[0])
+}
+
+// validateCipherExtension returns an error if data is not a valid ExtCipher
+// payload.
+func validateCipherExtension(data []byte) error {
+	if len(data) != 1 {
+		return errors.Errorf("cipher extension has wrong length (expected 1, got %v)", len(data))
+	} else if c := Cipher(data[0]); !c.Valid() {
+		return errors.Errorf("unsupported cipher %v", c)
+	}
+	return nil
+}
+
+// SetCipher sets the Cipher used to encrypt m's sectors. Since existing
+// sectors are not re-encrypted, SetCipher should only be called before any
+// data has been uploaded.
+func (m *MetaFile) SetCipher(c Cipher) {
+	if c == CipherXChaCha20Poly1305 {
+		// omit the extension, so that older clients can read the metafile
+		m.RemoveExtension(ExtCipher)
+		return
+	}
+	m.SetExtension(ExtCipher, true, []byte{byte(c)})
+}
+
+// XORKeyStream is like KeySeed.XORKeyStream, but uses the keystream of c.
+func (c Cipher) XORKeyStream(s *KeySeed, msg []byte, nonce []byte, startIndex uint64) {
+	switch c {
+	case CipherXChaCha20Poly1305:
+		s.XORKeyStream(msg, nonce, startIndex)
+	case CipherAES256CTR:
+		if len(msg)%merkle.SegmentSize != 0 {
+			panic("message must be a multiple of segment size")
+		} else if len(nonce) != 24 {
+			panic("nonce must be 24 bytes")
+		}
+		// as with XChaCha20, the nonce is hashed together with the seed to
+		// produce a subkey, so that random 24-byte nonces can be used safely
+		subkey := blake2b.Sum256(append(append([]byte("lukechampine.com/us/renter/aes"), s[:]...), nonce...))
+		block, _ := aes.NewCipher(subkey[:]) // no error possible
+		iv := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], startIndex*(merkle.SegmentSize/aes.BlockSize))
+		cipher.NewCTR(block, iv).XORKeyStream(msg, msg)
+	default:
+		panic("unsupported cipher")
+	}
+}
@@ -0,0 +1,168 @@
+package renter
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+// Errors returned by FormationTracker.Err.
+var (
+	ErrFormationReorged = errors.New("contract formation was reorged out of the blockchain")
+	ErrFormationExpired = errors.New("contract formation did not confirm in time")
+)
+
+// A FormationStatus is the confirmation status of a contract's formation
+// transaction.
+type FormationStatus int
+
+// Possible FormationStatus values.
+const (
+	FormationUnconfirmed FormationStatus = iota
+	FormationConfirmed
+	FormationReorged
+	FormationExpired
+)
+
+// String implements fmt.Stringer.
+func (fs FormationStatus) String() string {
+	switch fs {
+	case FormationUnconfirmed:
+		return "unconfirmed"
+	case FormationConfirmed:
+		return "confirmed"
+	case FormationReorged:
+		return "reorged"
+	case FormationExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// A FormationEvent reports a change in the FormationStatus of a tracked
+// contract.
+type FormationEvent struct {
+	ContractID types.FileContractID
+	Status     FormationStatus
+}
+
+type trackedFormation struct {
+	deadline types.BlockHeight
+	status   FormationStatus
+}
+
+// A FormationTracker watches the blockchain for the formation transactions of
+// contracts, allowing contracts to be used before their formation
+// transactions confirm. If a formation transaction does not confirm by its
+// deadline, or is reorged out of the blockchain, the contract should no longer
+// be used: the host has no obligation to honor it.
+//
+// FormationTracker implements modules.ConsensusSetSubscriber. Its Err method
+// can be passed to proto.Session.SetContractCheck, causing RPCs on
+// unconfirmed contracts to fail once the formation is known to have failed.
+type FormationTracker struct {
+	onEvent func(FormationEvent)
+
+	mu        sync.Mutex
+	height    types.BlockHeight
+	contracts map[types.FileContractID]*trackedFormation
+}
+
+// Track begins tracking the formation of the specified contract. If the
+// formation transaction has not confirmed by the deadline height, the
+// formation is considered expired.
+func (ft *FormationTracker) Track(id types.FileContractID, deadline types.BlockHeight) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if _, ok := ft.contracts[id]; !ok {
+		ft.contracts[id] = &trackedFormation{deadline: deadline}
+	}
+}
+
+// Untrack stops tracking the specified contract.
+func (ft *FormationTracker) Untrack(id types.FileContractID) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	delete(ft.contracts, id)
+}
+
+// Status returns the FormationStatus of the specified contract. Untracked
+// contracts are reported as confirmed.
+func (ft *FormationTracker) Status(id types.FileContractID) FormationStatus {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if c, ok := ft.contracts[id]; ok {
+		return c.status
+	}
+	return FormationConfirmed
+}
+
+// Err returns an error if the formation of the specified contract has failed.
+// Unconfirmed contracts do not return an error.
+func (ft *FormationTracker) Err(id types.FileContractID) error {
+	switch ft.Status(id) {
+	case FormationReorged:
+		return ErrFormationReorged
+	case FormationExpired:
+		return ErrFormationExpired
+	default:
+		return nil
+	}
+}
+
+// ProcessConsensusChange implements modules.ConsensusSetSubscriber.
+func (ft *FormationTracker) ProcessConsensusChange(cc modules.ConsensusChange) {
+	ft.mu.Lock()
+	ft.height -= types.BlockHeight(len(cc.RevertedBlocks))
+	ft.height += types.BlockHeight(len(cc.AppliedBlocks))
+
+	// Revisions and resolutions also produce contract diffs, so only the
+	// net effect of the change is considered.
+	exists := make(map[types.FileContractID]bool)
+	for _, diff := range cc.FileContractDiffs {
+		if _, ok := ft.contracts[diff.ID]; ok {
+			exists[diff.ID] = diff.Direction == modules.DiffApply
+		}
+	}
+
+	var events []FormationEvent
+	for id, c := range ft.contracts {
+		status := c.status
+		if e, ok := exists[id]; ok {
+			if e {
+				status = FormationConfirmed
+			} else if c.status == FormationConfirmed && len(cc.RevertedBlocks) > 0 {
+				status = FormationReorged
+			}
+		}
+		if (status == FormationUnconfirmed || status == FormationReorged) && ft.height > c.deadline {
+			status = FormationExpired
+		}
+		if status != c.status {
+			c.status = status
+			events = append(events, FormationEvent{ContractID: id, Status: status})
+		}
+	}
+	ft.mu.Unlock()
+
+	if ft.onEvent != nil {
+		for _, e := range events {
+			ft.onEvent(e)
+		}
+	}
+}
+
+// NewFormationTracker returns a FormationTracker that calls onEvent whenever
+// the FormationStatus of a tracked contract changes. onEvent may be nil. The
+// tracker should be subscribed to the consensus set starting from the
+// specified height.
+func NewFormationTracker(currentHeight types.BlockHeight, onEvent func(FormationEvent)) *FormationTracker {
+	return &FormationTracker{
+		onEvent:   onEvent,
+		height:    currentHeight,
+		contracts: make(map[types.FileContractID]*trackedFormation),
+	}
+}
@@ -0,0 +1,73 @@
+package renter
+
+import (
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+func TestFormationTracker(t *testing.T) {
+	var events []FormationEvent
+	ft := NewFormationTracker(100, func(e FormationEvent) { events = append(events, e) })
+	confirmed, reorged, expired := types.FileContractID{1}, types.FileContractID{2}, types.FileContractID{3}
+	for _, id := range []types.FileContractID{confirmed, reorged, expired} {
+		ft.Track(id, 103)
+	}
+
+	contractDiff := func(id types.FileContractID, dir modules.DiffDirection) modules.FileContractDiff {
+		return modules.FileContractDiff{Direction: dir, ID: id}
+	}
+
+	// confirm two of the contracts
+	ft.ProcessConsensusChange(modules.ConsensusChange{
+		AppliedBlocks: make([]types.Block, 1),
+		FileContractDiffs: []modules.FileContractDiff{
+			contractDiff(confirmed, modules.DiffApply),
+			contractDiff(reorged, modules.DiffApply),
+		},
+	})
+	if len(events) != 2 || ft.Status(confirmed) != FormationConfirmed || ft.Status(expired) != FormationUnconfirmed {
+		t.Fatal("wrong statuses after confirmation:", events)
+	}
+
+	// revising a contract should not affect its status
+	ft.ProcessConsensusChange(modules.ConsensusChange{
+		AppliedBlocks: make([]types.Block, 1),
+		FileContractDiffs: []modules.FileContractDiff{
+			contractDiff(confirmed, modules.DiffRevert),
+			contractDiff(confirmed, modules.DiffApply),
+		},
+	})
+	if len(events) != 2 || ft.Status(confirmed) != FormationConfirmed {
+		t.Fatal("revision should not change status")
+	}
+
+	// reorg out one of the contracts
+	ft.ProcessConsensusChange(modules.ConsensusChange{
+		RevertedBlocks: make([]types.Block, 2),
+		AppliedBlocks:  make([]types.Block, 3),
+		FileContractDiffs: []modules.FileContractDiff{
+			contractDiff(confirmed, modules.DiffRevert),
+			contractDiff(reorged, modules.DiffRevert),
+			contractDiff(confirmed, modules.DiffApply),
+		},
+	})
+	if ft.Status(reorged) != FormationReorged || ft.Err(reorged) != ErrFormationReorged {
+		t.Fatal("expected reorged status")
+	} else if ft.Status(confirmed) != FormationConfirmed || ft.Err(confirmed) != nil {
+		t.Fatal("re-included contract should remain confirmed")
+	}
+
+	// pass the deadline
+	ft.ProcessConsensusChange(modules.ConsensusChange{
+		AppliedBlocks: make([]types.Block, 1),
+	})
+	if ft.Err(expired) != ErrFormationExpired || ft.Err(reorged) != ErrFormationExpired {
+		t.Fatal("expected expired status")
+	}
+	last := events[len(events)-1]
+	if last.Status != FormationExpired {
+		t.Fatal("expected expiration event, got", last)
+	}
+}
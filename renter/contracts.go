@@ -59,9 +59,13 @@ func LoadContract(filename string) (c Contract, err error) {
 		return Contract{}, errors.Wrap(err, "could not open contract file")
 	}
 	defer f.Close()
+	return readContract(f)
+}
 
+// readContract reads a contract from f.
+func readContract(r io.Reader) (c Contract, err error) {
 	buf := make([]byte, ContractSize)
-	if _, err := io.ReadFull(f, buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return Contract{}, errors.Wrap(err, "could not read contract")
 	}
 	magic := string(buf[0:11])
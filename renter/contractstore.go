@@ -0,0 +1,225 @@
+package renter
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/encoding"
+	"gitlab.com/NebulousLabs/Sia/types"
+	bolt "go.etcd.io/bbolt"
+	"lukechampine.com/us/renter/proto"
+)
+
+// ErrContractNotFound is returned by ContractStores when the requested
+// contract is not present.
+var ErrContractNotFound = errors.New("contract not found")
+
+// A ContractRecord is a Contract along with its most recent revision and the
+// Merkle roots of its sectors.
+type ContractRecord struct {
+	Contract
+	Revision proto.ContractRevision
+	Roots    []crypto.Hash
+}
+
+// A ContractStore persists ContractRecords. Implementations must update each
+// record atomically, so that a record's revision and roots are never out of
+// sync, even after a crash.
+type ContractStore interface {
+	ContractIDs() ([]types.FileContractID, error)
+	LoadRecord(id types.FileContractID) (ContractRecord, error)
+	SaveRecord(rec ContractRecord) error
+	DeleteRecord(id types.FileContractID) error
+}
+
+// MigrateContractStore copies every record in src to dst. Records already
+// present in dst are overwritten. After a successful migration, src may be
+// discarded.
+func MigrateContractStore(dst, src ContractStore) error {
+	ids, err := src.ContractIDs()
+	if err != nil {
+		return errors.Wrap(err, "could not list contracts")
+	}
+	for _, id := range ids {
+		rec, err := src.LoadRecord(id)
+		if err != nil {
+			return errors.Wrapf(err, "could not load contract %v", id)
+		} else if err := dst.SaveRecord(rec); err != nil {
+			return errors.Wrapf(err, "could not save contract %v", id)
+		}
+	}
+	return nil
+}
+
+// A ContractDir is a directory-backed ContractStore. Each record is stored in
+// a separate file, named after the contract ID. Updates are made atomic by
+// writing to a temporary file and renaming it.
+type ContractDir struct {
+	dir string
+}
+
+const contractRecordExt = ".rec"
+
+func (cd *ContractDir) path(id types.FileContractID) string {
+	return filepath.Join(cd.dir, hex.EncodeToString(id[:])+contractRecordExt)
+}
+
+// ContractIDs implements ContractStore.
+func (cd *ContractDir) ContractIDs() ([]types.FileContractID, error) {
+	files, err := ioutil.ReadDir(cd.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read contract directory")
+	}
+	var ids []types.FileContractID
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, contractRecordExt) {
+			continue
+		}
+		var id types.FileContractID
+		if b, err := hex.DecodeString(strings.TrimSuffix(name, contractRecordExt)); err != nil || len(b) != len(id) {
+			continue
+		} else {
+			copy(id[:], b)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LoadRecord implements ContractStore.
+func (cd *ContractDir) LoadRecord(id types.FileContractID) (ContractRecord, error) {
+	b, err := ioutil.ReadFile(cd.path(id))
+	if os.IsNotExist(err) {
+		return ContractRecord{}, ErrContractNotFound
+	} else if err != nil {
+		return ContractRecord{}, errors.Wrap(err, "could not read contract record")
+	}
+	var rec ContractRecord
+	if err := encoding.Unmarshal(b, &rec); err != nil {
+		return ContractRecord{}, errors.Wrap(err, "contract record is invalid")
+	}
+	return rec, nil
+}
+
+// SaveRecord implements ContractStore.
+func (cd *ContractDir) SaveRecord(rec ContractRecord) error {
+	path := cd.path(rec.ID)
+	f, err := os.Create(path + "_tmp")
+	if err != nil {
+		return errors.Wrap(err, "could not create contract record")
+	}
+	defer f.Close()
+	if _, err := f.Write(encoding.Marshal(rec)); err != nil {
+		return errors.Wrap(err, "could not write contract record")
+	} else if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "could not sync contract record")
+	} else if err := f.Close(); err != nil {
+		return errors.Wrap(err, "could not close contract record")
+	} else if err := os.Rename(path+"_tmp", path); err != nil {
+		return errors.Wrap(err, "could not atomically replace contract record")
+	}
+	return nil
+}
+
+// DeleteRecord implements ContractStore.
+func (cd *ContractDir) DeleteRecord(id types.FileContractID) error {
+	if err := os.Remove(cd.path(id)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not delete contract record")
+	}
+	return nil
+}
+
+// NewContractDir returns a ContractDir that stores records in dir, creating
+// dir if necessary.
+func NewContractDir(dir string) (*ContractDir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create contract directory")
+	}
+	return &ContractDir{dir: dir}, nil
+}
+
+// bucketContracts maps FileContractIDs to ContractRecords.
+var bucketContracts = []byte("bucketContracts")
+
+// A BoltContractStore is a ContractStore backed by a Bolt database. Each
+// update is performed in a single database transaction, which Bolt commits
+// atomically and durably.
+type BoltContractStore struct {
+	db *bolt.DB
+}
+
+// ContractIDs implements ContractStore.
+func (s *BoltContractStore) ContractIDs() (ids []types.FileContractID, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketContracts).ForEach(func(k, _ []byte) error {
+			var id types.FileContractID
+			copy(id[:], k)
+			ids = append(ids, id)
+			return nil
+		})
+	})
+	return ids, errors.Wrap(err, "could not list contracts")
+}
+
+// LoadRecord implements ContractStore.
+func (s *BoltContractStore) LoadRecord(id types.FileContractID) (rec ContractRecord, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketContracts).Get(id[:])
+		if b == nil {
+			return ErrContractNotFound
+		}
+		return errors.Wrap(encoding.Unmarshal(b, &rec), "contract record is invalid")
+	})
+	return rec, err
+}
+
+// SaveRecord implements ContractStore.
+func (s *BoltContractStore) SaveRecord(rec ContractRecord) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketContracts).Put(rec.ID[:], encoding.Marshal(rec))
+	})
+	return errors.Wrap(err, "could not save contract record")
+}
+
+// DeleteRecord implements ContractStore.
+func (s *BoltContractStore) DeleteRecord(id types.FileContractID) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketContracts).Delete(id[:])
+	})
+	return errors.Wrap(err, "could not delete contract record")
+}
+
+// Close closes the underlying database.
+func (s *BoltContractStore) Close() error {
+	return s.db.Close()
+}
+
+// NewBoltContractStore returns a BoltContractStore backed by the specified
+// database file, creating it if necessary.
+func NewBoltContractStore(filename string) (*BoltContractStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open contract database")
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketContracts)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "could not initialize contract database")
+	}
+	return &BoltContractStore{db: db}, nil
+}
+
+var (
+	_ ContractStore = (*ContractDir)(nil)
+	_ ContractStore = (*BoltContractStore)(nil)
+)
@@ -0,0 +1,105 @@
+package renter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/encoding"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter/proto"
+)
+
+func randomContractRecord() ContractRecord {
+	var id types.FileContractID
+	frand.Read(id[:])
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	roots := make([]crypto.Hash, 3)
+	for i := range roots {
+		frand.Read(roots[i][:])
+	}
+	return ContractRecord{
+		Contract: Contract{
+			HostKey:   hostdb.HostKeyFromPublicKey(key.PublicKey()),
+			ID:        id,
+			RenterKey: key,
+		},
+		Revision: proto.ContractRevision{
+			Revision: types.FileContractRevision{
+				ParentID:          id,
+				NewRevisionNumber: 7,
+				NewFileSize:       uint64(len(roots)) * 1 << 22,
+			},
+		},
+		Roots: roots,
+	}
+}
+
+func TestContractStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cd, err := NewContractDir(filepath.Join(dir, "contracts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := NewBoltContractStore(filepath.Join(dir, "contracts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	for _, store := range []ContractStore{cd, bs} {
+		rec := randomContractRecord()
+		if _, err := store.LoadRecord(rec.ID); err != ErrContractNotFound {
+			t.Fatal("expected ErrContractNotFound, got", err)
+		} else if err := store.SaveRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+		// update the record
+		rec.Revision.Revision.NewRevisionNumber++
+		rec.Roots = append(rec.Roots, crypto.Hash{1})
+		if err := store.SaveRecord(rec); err != nil {
+			t.Fatal(err)
+		} else if loaded, err := store.LoadRecord(rec.ID); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(encoding.Marshal(loaded), encoding.Marshal(rec)) {
+			t.Fatal("loaded record does not match saved record")
+		} else if ids, err := store.ContractIDs(); err != nil {
+			t.Fatal(err)
+		} else if len(ids) != 1 || ids[0] != rec.ID {
+			t.Fatal("wrong contract IDs:", ids)
+		}
+	}
+
+	// migrate from the directory to the database
+	rec := randomContractRecord()
+	if err := cd.SaveRecord(rec); err != nil {
+		t.Fatal(err)
+	} else if err := MigrateContractStore(bs, cd); err != nil {
+		t.Fatal(err)
+	} else if ids, err := bs.ContractIDs(); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 3 {
+		t.Fatal("expected 3 contracts after migration, got", len(ids))
+	} else if loaded, err := bs.LoadRecord(rec.ID); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(encoding.Marshal(loaded), encoding.Marshal(rec)) {
+		t.Fatal("migrated record does not match original")
+	}
+
+	if err := bs.DeleteRecord(rec.ID); err != nil {
+		t.Fatal(err)
+	} else if _, err := bs.LoadRecord(rec.ID); err != ErrContractNotFound {
+		t.Fatal("expected ErrContractNotFound, got", err)
+	}
+}
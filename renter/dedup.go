@@ -0,0 +1,125 @@
+package renter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+)
+
+// A DedupIndex tracks the sectors stored on each host by their Merkle root,
+// i.e. the hash of the encrypted sector, along with the number of SectorSlices
+// referencing each sector. When sectors are built with AppendConvergent,
+// identical chunks produce identical sectors, so the index can be used to
+// avoid uploading a sector that a host already stores. The reference counts
+// allow callers to determine when a sector can safely be deleted. A
+// DedupIndex is safe for concurrent use.
+type DedupIndex struct {
+	filename string
+
+	mu   sync.Mutex
+	refs map[dedupKey]int
+}
+
+type dedupKey struct {
+	Host hostdb.HostPublicKey
+	Root crypto.Hash
+}
+
+// persistDedupEntry is the on-disk representation of a DedupIndex entry.
+type persistDedupEntry struct {
+	Host hostdb.HostPublicKey `json:"host"`
+	Root crypto.Hash          `json:"root"`
+	Refs int                  `json:"refs"`
+}
+
+// Has reports whether the host is storing the sector with the specified root.
+func (d *DedupIndex) Has(host hostdb.HostPublicKey, root crypto.Hash) bool {
+	return d.Refs(host, root) > 0
+}
+
+// Refs returns the number of references to the sector with the specified
+// root on the host.
+func (d *DedupIndex) Refs(host hostdb.HostPublicKey, root crypto.Hash) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.refs[dedupKey{host, root}]
+}
+
+// AddRef adds a reference to the sector with the specified root on the host.
+// It should be called each time a SectorSlice referencing the sector is
+// stored in a metafile, including when the sector is first uploaded.
+func (d *DedupIndex) AddRef(host hostdb.HostPublicKey, root crypto.Hash) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refs[dedupKey{host, root}]++
+	return d.save()
+}
+
+// Release removes a reference to each of the specified sectors on the host,
+// returning the roots of the sectors that are no longer referenced and can
+// thus be deleted from the host. Sectors not tracked by the index are assumed
+// to have a single reference, and are likewise returned.
+func (d *DedupIndex) Release(host hostdb.HostPublicKey, roots []crypto.Hash) ([]crypto.Hash, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var unreferenced []crypto.Hash
+	for _, root := range roots {
+		key := dedupKey{host, root}
+		if d.refs[key] > 1 {
+			d.refs[key]--
+			continue
+		}
+		delete(d.refs, key)
+		unreferenced = append(unreferenced, root)
+	}
+	return unreferenced, d.save()
+}
+
+// save writes the index to disk. d.mu must be held.
+func (d *DedupIndex) save() error {
+	if d.filename == "" {
+		return nil
+	}
+	entries := make([]persistDedupEntry, 0, len(d.refs))
+	for key, refs := range d.refs {
+		entries = append(entries, persistDedupEntry{key.Host, key.Root, refs})
+	}
+	js, _ := json.Marshal(entries)
+	if err := ioutil.WriteFile(d.filename+"_tmp", js, 0600); err != nil {
+		return errors.Wrap(err, "could not write dedup index")
+	} else if err := os.Rename(d.filename+"_tmp", d.filename); err != nil {
+		return errors.Wrap(err, "could not atomically replace dedup index")
+	}
+	return nil
+}
+
+// NewDedupIndex returns a DedupIndex persisted to the specified file, loading
+// any existing entries. If filename is empty, the index is not persisted.
+func NewDedupIndex(filename string) (*DedupIndex, error) {
+	d := &DedupIndex{
+		filename: filename,
+		refs:     make(map[dedupKey]int),
+	}
+	if filename == "" {
+		return d, nil
+	}
+	js, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read dedup index")
+	}
+	var entries []persistDedupEntry
+	if err := json.Unmarshal(js, &entries); err != nil {
+		return nil, errors.Wrap(err, "could not decode dedup index")
+	}
+	for _, e := range entries {
+		d.refs[dedupKey{e.Host, e.Root}] = e.Refs
+	}
+	return d, nil
+}
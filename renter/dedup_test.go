@@ -0,0 +1,108 @@
+package renter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+)
+
+func TestAppendConvergent(t *testing.T) {
+	var key KeySeed
+	frand.Read(key[:])
+	data := frand.Bytes(merkle.SegmentSize * 10)
+	sectorRoot := func(key KeySeed, data []byte, convergent bool) crypto.Hash {
+		var sb SectorBuilder
+		if convergent {
+			sb.AppendConvergent(data, key, CipherXChaCha20Poly1305)
+		} else {
+			sb.Append(data, key, CipherXChaCha20Poly1305)
+		}
+		return merkle.SectorRoot(sb.Finish())
+	}
+
+	// identical data and keys should produce identical sectors
+	if sectorRoot(key, data, true) != sectorRoot(key, data, true) {
+		t.Fatal("convergent sectors differ")
+	}
+	// ...but only if convergent encryption is used
+	if sectorRoot(key, data, false) == sectorRoot(key, data, false) {
+		t.Fatal("random sectors are identical")
+	}
+	// different data or keys should produce different sectors
+	var key2 KeySeed
+	frand.Read(key2[:])
+	if sectorRoot(key, data, true) == sectorRoot(key2, data, true) {
+		t.Fatal("sectors with different keys are identical")
+	} else if sectorRoot(key, data, true) == sectorRoot(key, frand.Bytes(len(data)), true) {
+		t.Fatal("sectors with different data are identical")
+	}
+
+	// convergent data should still decrypt correctly
+	var sb SectorBuilder
+	sb.AppendConvergent(data, key, CipherXChaCha20Poly1305)
+	ss := sb.Slices()[0]
+	dec := append([]byte(nil), sb.Finish()[:len(data)]...)
+	key.XORKeyStream(dec, ss.Nonce[:], uint64(ss.SegmentIndex))
+	if string(dec) != string(data) {
+		t.Fatal("convergent data did not decrypt correctly")
+	}
+}
+
+func TestDedupIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dedup.json")
+	d, err := NewDedupIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	host2 := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	root1, root2, untracked := crypto.Hash{1}, crypto.Hash{2}, crypto.Hash{3}
+
+	if d.Has(host, root1) {
+		t.Fatal("empty index should not contain sector")
+	}
+	for _, root := range []crypto.Hash{root1, root1, root2} {
+		if err := d.AddRef(host, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !d.Has(host, root1) || d.Refs(host, root1) != 2 || d.Refs(host, root2) != 1 {
+		t.Fatal("wrong refcounts")
+	} else if d.Has(host2, root1) {
+		t.Fatal("sectors should be tracked per host")
+	}
+
+	// reload from disk
+	d, err = NewDedupIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	} else if d.Refs(host, root1) != 2 || d.Refs(host, root2) != 1 {
+		t.Fatal("refcounts were not persisted")
+	}
+
+	// only unreferenced sectors should be returned by Release
+	if free, err := d.Release(host, []crypto.Hash{root1, root2, untracked}); err != nil {
+		t.Fatal(err)
+	} else if len(free) != 2 || free[0] != root2 || free[1] != untracked {
+		t.Fatal("wrong unreferenced sectors:", free)
+	}
+	if free, err := d.Release(host, []crypto.Hash{root1}); err != nil {
+		t.Fatal(err)
+	} else if len(free) != 1 || free[0] != root1 {
+		t.Fatal("wrong unreferenced sectors:", free)
+	} else if d.Has(host, root1) || d.Has(host, root2) {
+		t.Fatal("released sectors should not be tracked")
+	}
+}
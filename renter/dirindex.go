@@ -0,0 +1,178 @@
+package renter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DirIndexVersion is the current version of the DirIndex format. It is
+// incremented after each change to the format.
+const DirIndexVersion = 1
+
+// A DirIndex summarizes the contents of a directory of metafiles, allowing
+// the directory to be listed, and its total size and health to be computed,
+// without reading each metafile. Since a DirIndex is derived entirely from
+// the metafiles it describes, it can be rebuilt at any time.
+type DirIndex struct {
+	Version int
+	Entries []DirEntry // sorted by Name
+}
+
+// A DirEntry describes a metafile or subdirectory within a DirIndex.
+type DirEntry struct {
+	Name    string // base name, without any metafile extension
+	Dir     bool
+	Mode    os.FileMode
+	ModTime time.Time
+
+	// files only
+	Filesize int64   `json:",omitempty"`
+	Health   float64 `json:",omitempty"`
+
+	// directories only; covers the subdirectory recursively
+	Stats DirStats
+}
+
+// DirStats are aggregate statistics of a directory and all of its
+// subdirectories.
+type DirStats struct {
+	NumFiles  int
+	NumDirs   int
+	TotalSize int64
+	// MinHealth is the lowest Health of any file, or 1 if there are no
+	// files.
+	MinHealth float64
+	// LastModified is the latest ModTime of any file or directory.
+	LastModified time.Time
+}
+
+// Health returns a measure of m's redundancy. A Health of 1 indicates that
+// every chunk is stored on every host; 0 indicates that some chunk is stored
+// on only as many hosts as are needed to recover it; and a negative Health
+// indicates that some chunk is unrecoverable.
+func (m *MetaFile) Health() float64 {
+	_, minShards := m.ChunkLayout()
+	health := 1.0
+	for chunk, k := range minShards {
+		var available int
+		for _, shard := range m.Shards {
+			if chunk < len(shard) && shard[chunk] != (SectorSlice{}) {
+				available++
+			}
+		}
+		h := float64(available - k)
+		if extra := len(m.Hosts) - k; extra > 0 {
+			h /= float64(extra)
+		} else if available == k {
+			h = 1 // no redundancy to lose
+		}
+		if h < health {
+			health = h
+		}
+	}
+	return health
+}
+
+// NewDirEntry returns the DirEntry for the metafile m with the specified
+// name.
+func NewDirEntry(name string, m *MetaFile) DirEntry {
+	return DirEntry{
+		Name:     name,
+		Mode:     m.Mode,
+		ModTime:  m.ModTime,
+		Filesize: m.Filesize,
+		Health:   m.Health(),
+	}
+}
+
+// Stats returns the aggregate statistics of the directory described by d.
+func (d *DirIndex) Stats() DirStats {
+	s := DirStats{MinHealth: 1}
+	for _, e := range d.Entries {
+		var es DirStats
+		if e.Dir {
+			es = e.Stats
+			s.NumDirs++
+		} else {
+			es = DirStats{NumFiles: 1, TotalSize: e.Filesize, MinHealth: e.Health}
+		}
+		s.NumFiles += es.NumFiles
+		s.NumDirs += es.NumDirs
+		s.TotalSize += es.TotalSize
+		if es.NumFiles > 0 && es.MinHealth < s.MinHealth {
+			s.MinHealth = es.MinHealth
+		}
+		if e.ModTime.After(s.LastModified) {
+			s.LastModified = e.ModTime
+		}
+		if es.LastModified.After(s.LastModified) {
+			s.LastModified = es.LastModified
+		}
+	}
+	return s
+}
+
+// Entry returns the entry with the specified name, if present.
+func (d *DirIndex) Entry(name string) (DirEntry, bool) {
+	i := sort.Search(len(d.Entries), func(i int) bool { return d.Entries[i].Name >= name })
+	if i < len(d.Entries) && d.Entries[i].Name == name {
+		return d.Entries[i], true
+	}
+	return DirEntry{}, false
+}
+
+// SetEntry adds e to d, replacing any existing entry with the same name.
+func (d *DirIndex) SetEntry(e DirEntry) {
+	i := sort.Search(len(d.Entries), func(i int) bool { return d.Entries[i].Name >= e.Name })
+	if i < len(d.Entries) && d.Entries[i].Name == e.Name {
+		d.Entries[i] = e
+		return
+	}
+	d.Entries = append(d.Entries, DirEntry{})
+	copy(d.Entries[i+1:], d.Entries[i:])
+	d.Entries[i] = e
+}
+
+// RemoveEntry removes the entry with the specified name, returning false if
+// it is not present.
+func (d *DirIndex) RemoveEntry(name string) bool {
+	i := sort.Search(len(d.Entries), func(i int) bool { return d.Entries[i].Name >= name })
+	if i < len(d.Entries) && d.Entries[i].Name == name {
+		d.Entries = append(d.Entries[:i], d.Entries[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// WriteDirIndex writes d to filename. The write is atomic.
+func WriteDirIndex(filename string, d *DirIndex) error {
+	d.Version = DirIndexVersion
+	js, _ := json.Marshal(d)
+	if err := ioutil.WriteFile(filename+"_tmp", js, 0660); err != nil {
+		return errors.Wrap(err, "could not write directory index")
+	} else if err := os.Rename(filename+"_tmp", filename); err != nil {
+		return errors.Wrap(err, "could not write directory index")
+	}
+	return nil
+}
+
+// ReadDirIndex reads the DirIndex stored at filename.
+func ReadDirIndex(filename string) (*DirIndex, error) {
+	js, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read directory index")
+	}
+	var d DirIndex
+	if err := json.Unmarshal(js, &d); err != nil {
+		return nil, errors.Wrap(err, "could not decode directory index")
+	} else if d.Version != DirIndexVersion {
+		return nil, errors.Errorf("incompatible directory index version (%v)", d.Version)
+	}
+	sort.Slice(d.Entries, func(i, j int) bool { return d.Entries[i].Name < d.Entries[j].Name })
+	return &d, nil
+}
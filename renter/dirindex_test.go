@@ -0,0 +1,90 @@
+package renter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+)
+
+func TestMetaFileHealth(t *testing.T) {
+	hosts := make([]hostdb.HostPublicKey, 3)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	}
+	m := NewMetaFile(0660, 100, hosts, 1)
+	if h := m.Health(); h != 1 {
+		t.Fatal("expected empty file to have health 1, got", h)
+	}
+	for i := range m.Shards {
+		m.Shards[i] = []SectorSlice{
+			{MerkleRoot: crypto.Hash{1}, NumSegments: 1},
+			{MerkleRoot: crypto.Hash{2}, NumSegments: 1},
+		}
+	}
+	tests := []struct {
+		missing []int // shards missing chunk 1
+		health  float64
+	}{
+		{nil, 1},
+		{[]int{0}, 0.5},
+		{[]int{0, 1}, 0},
+		{[]int{0, 1, 2}, -0.5},
+	}
+	for _, test := range tests {
+		for i := range m.Shards {
+			m.Shards[i][1] = SectorSlice{MerkleRoot: crypto.Hash{2}, NumSegments: 1}
+		}
+		for _, i := range test.missing {
+			m.Shards[i][1] = SectorSlice{}
+		}
+		if h := m.Health(); h != test.health {
+			t.Errorf("expected health %v with %v missing shards, got %v", test.health, len(test.missing), h)
+		}
+	}
+}
+
+func TestDirIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var d DirIndex
+	d.SetEntry(DirEntry{Name: "foo", Filesize: 10, Health: 1})
+	d.SetEntry(DirEntry{Name: "bar", Dir: true, Stats: DirStats{NumFiles: 2, NumDirs: 1, TotalSize: 30, MinHealth: 0.5}})
+	d.SetEntry(DirEntry{Name: "baz", Dir: true, Stats: DirStats{MinHealth: 1}})
+	d.SetEntry(DirEntry{Name: "foo", Filesize: 20, Health: 0.75})
+	if len(d.Entries) != 3 || d.Entries[0].Name != "bar" || d.Entries[2].Name != "foo" {
+		t.Fatal("entries are not sorted:", d.Entries)
+	} else if e, ok := d.Entry("foo"); !ok || e.Filesize != 20 {
+		t.Fatal("entry was not replaced")
+	}
+	exp := DirStats{NumFiles: 3, NumDirs: 3, TotalSize: 50, MinHealth: 0.5}
+	if s := d.Stats(); s != exp {
+		t.Fatalf("wrong stats: expected %+v, got %+v", exp, s)
+	}
+	if !d.RemoveEntry("bar") || d.RemoveEntry("bar") {
+		t.Fatal("RemoveEntry failed")
+	} else if s := d.Stats(); s.NumFiles != 1 || s.MinHealth != 0.75 {
+		t.Fatal("wrong stats after removal:", s)
+	}
+
+	path := filepath.Join(dir, "index")
+	if err := WriteDirIndex(path, &d); err != nil {
+		t.Fatal(err)
+	}
+	d2, err := ReadDirIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(d2.Entries, d.Entries) {
+		t.Fatal("index did not round-trip")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 
 	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
@@ -24,10 +25,15 @@ type HostKeyResolver interface {
 
 // A ShardDownloader wraps a proto.Session to provide SectorSlice-based
 // data retrieval, transparently decrypting and validating the received data.
+//
+// If SiaKey is non-nil, the data is decrypted using siad's scheme instead of
+// Key and Cipher; see ExtSiaCipher.
 type ShardDownloader struct {
 	Downloader *proto.Session
 	Slices     []SectorSlice
 	Key        KeySeed
+	Cipher     Cipher
+	SiaKey     crypto.CipherKey
 	buf        bytes.Buffer
 }
 
@@ -35,6 +41,8 @@ type cryptWriter struct {
 	w      io.Writer
 	slices []SectorSlice
 	key    KeySeed
+	cipher Cipher
+	siaKey crypto.CipherKey
 	off    int64
 }
 
@@ -106,7 +114,7 @@ func (cw *cryptWriter) Write(p []byte) (int, error) {
 			s.SegmentIndex += uint32(rem / merkle.SegmentSize)
 		}
 		bb := b.Next(int(s.NumSegments) * merkle.SegmentSize)
-		cw.key.XORKeyStream(bb, s.Nonce[:], uint64(s.SegmentIndex))
+		decryptSlice(&cw.key, cw.cipher, cw.siaKey, bb, s)
 	}
 	cw.off += int64(len(p))
 	return cw.w.Write(p)
@@ -119,7 +127,7 @@ func (d *ShardDownloader) CopySection(w io.Writer, offset, length int64) error {
 	if err != nil {
 		return err
 	}
-	cw := &cryptWriter{w, d.Slices, d.Key, offset}
+	cw := &cryptWriter{w, d.Slices, d.Key, d.Cipher, d.SiaKey, offset}
 	return d.Downloader.Read(cw, sections)
 }
 
@@ -146,7 +154,7 @@ func (d *ShardDownloader) DownloadAndDecrypt(chunkIndex int64) ([]byte, error) {
 	}
 	data := d.buf.Bytes()
 	// decrypt segments
-	d.Key.XORKeyStream(data, s.Nonce[:], uint64(s.SegmentIndex))
+	decryptSlice(&d.Key, d.Cipher, d.SiaKey, data, s)
 	return data, nil
 }
 
@@ -177,6 +185,8 @@ func NewShardDownloader(m *MetaFile, c Contract, hkr HostKeyResolver) (*ShardDow
 	return &ShardDownloader{
 		Downloader: d,
 		Key:        m.MasterKey,
+		Cipher:     m.Cipher(),
+		SiaKey:     m.SiaKey(),
 		Slices:     m.Shards[m.HostIndex(hostKey)],
 	}, nil
 }
@@ -0,0 +1,135 @@
+package renter
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/hostdb"
+)
+
+// ExtExportOffset is a MetaExtension present in metafiles created by Export.
+// Its data is the offset, as a little-endian uint64, within the original file
+// at which the exported data begins.
+const ExtExportOffset MetaExtensionType = 2
+
+// ExportOffset returns the offset within the original file at which m's data
+// begins, if m was created by Export.
+func (m *MetaFile) ExportOffset() (int64, bool) {
+	data, ok := m.Extension(ExtExportOffset)
+	if !ok || len(data) != 8 {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(data)), true
+}
+
+// Export returns a copy of m that is suitable for sharing with another party,
+// who may use it to download the specified byte range of the file from the
+// specified hosts. Only the chunks overlapping the range are included, and the
+// shards of all other hosts are omitted. The exported metafile contains the
+// file's decryption key, but nothing that would allow the recipient to modify
+// the file or spend the renter's funds.
+//
+// Since chunks are the smallest unit of data that can be exported, the
+// exported metafile may contain data outside the requested range; its
+// ExportOffset method returns the offset of its first byte within the original
+// file.
+func (m *MetaFile) Export(off, n int64, hosts []hostdb.HostPublicKey) (*MetaFile, error) {
+	if off < 0 || n < 0 || off+n > m.Filesize {
+		return nil, errors.New("range is out of bounds")
+	} else if m.keyOmitted() && m.MasterKey == (KeySeed{}) {
+		return nil, errors.New("metafile key must be derived (via DeriveKey) or unwrapped (via UnwrapKey) before exporting")
+	} else if len(hosts) < m.MinShards {
+		return nil, errors.Errorf("at least %v hosts are required to download the file", m.MinShards)
+	}
+	include := make([]bool, len(m.Hosts))
+	for _, h := range hosts {
+		i := m.HostIndex(h)
+		if i == -1 {
+			return nil, errors.Errorf("host %v is not storing the file", h.ShortKey())
+		}
+		include[i] = true
+	}
+
+	// determine which chunks overlap the range
+	var longest []SectorSlice
+	for _, shard := range m.Shards {
+		if len(shard) > len(longest) {
+			longest = shard
+		}
+	}
+	bounds := m.ChunkBoundaries()
+	var start int64
+	first, last := -1, -1
+	for i := range longest {
+		if bounds[i+1] > off && bounds[i] < off+n {
+			if first == -1 {
+				first, start = i, bounds[i]
+			}
+			last = i
+		}
+	}
+
+	e := &MetaFile{
+		MetaIndex: m.MetaIndex,
+		Shards:    make([][]SectorSlice, len(m.Hosts)),
+	}
+	e.Hosts = append([]hostdb.HostPublicKey(nil), m.Hosts...)
+	e.Filesize = 0
+	if m.IsInline() {
+		// inline data cannot be split, so the whole file is exported
+		e.Filesize = m.Filesize
+	} else if first != -1 {
+		end := bounds[last+1]
+		if end > m.Filesize {
+			end = m.Filesize
+		}
+		e.Filesize = end - start
+		for i, shard := range m.Shards {
+			if include[i] && len(shard) > first {
+				if len(shard) > last+1 {
+					shard = shard[:last+1]
+				}
+				e.Shards[i] = append([]SectorSlice(nil), shard[first:]...)
+			}
+		}
+	}
+	// the recipient does not have our RenterSeed or KeyEncryptionKey, so the
+	// key must be stored explicitly
+	for _, ext := range m.Extensions {
+		switch ext.Type {
+		case ExtKeyDerivation, ExtWrappedKey, ExtExportOffset, ExtChunkHashes, ExtSignature, ExtRedundancyTiers, ExtGarbage:
+		default:
+			e.Extensions = append(e.Extensions, ext)
+		}
+	}
+	if hashes := m.ChunkHashes(); first != -1 && len(hashes) > first {
+		if len(hashes) > last+1 {
+			hashes = hashes[:last+1]
+		}
+		e.SetChunkHashes(hashes[first:])
+	}
+	// tiers are relative to the start of the file
+	var tiers []RedundancyTier
+	for _, t := range m.RedundancyTiers() {
+		tstart, tend := t.Offset-start, t.Offset+t.Length-start
+		if tstart < 0 {
+			tstart = 0
+		}
+		if tend > e.Filesize {
+			tend = e.Filesize
+		}
+		if tstart < tend {
+			tiers = append(tiers, RedundancyTier{tstart, tend - tstart, t.MinShards})
+		}
+	}
+	if err := e.SetRedundancyTiers(tiers); err != nil {
+		return nil, errors.Wrap(err, "could not export redundancy tiers")
+	}
+	if prev, ok := m.ExportOffset(); ok {
+		start += prev
+	}
+	offset := make([]byte, 8)
+	binary.LittleEndian.PutUint64(offset, uint64(start))
+	e.SetExtension(ExtExportOffset, false, offset)
+	return e, nil
+}
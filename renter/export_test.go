@@ -0,0 +1,76 @@
+package renter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+)
+
+func TestExport(t *testing.T) {
+	hosts := make([]hostdb.HostPublicKey, 3)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	}
+	var seed RenterSeed
+	m := NewMetaFileWithSeed(&seed, 0660, 0, hosts, 2)
+	const chunkSize = 10 * merkle.SegmentSize * 2
+	for i := range m.Shards {
+		for j := 0; j < 4; j++ {
+			ss := SectorSlice{SegmentIndex: uint32(j * 10), NumSegments: 10}
+			frand.Read(ss.MerkleRoot[:])
+			m.Shards[i] = append(m.Shards[i], ss)
+		}
+	}
+	m.Filesize = 4*chunkSize - 100
+
+	// export a range within the second chunk
+	e, err := m.Export(chunkSize+20, 100, hosts[:2])
+	if err != nil {
+		t.Fatal(err)
+	} else if off, ok := e.ExportOffset(); !ok || off != chunkSize {
+		t.Fatal("wrong export offset:", off, ok)
+	} else if e.Filesize != chunkSize {
+		t.Fatal("wrong filesize:", e.Filesize)
+	} else if len(e.Shards[0]) != 1 || e.Shards[0][0] != m.Shards[0][1] || len(e.Shards[2]) != 0 {
+		t.Fatal("wrong shards:", e.Shards)
+	} else if _, ok := e.FileID(); ok || e.MasterKey != m.MasterKey {
+		t.Fatal("exported metafile should contain the actual key")
+	}
+
+	// exporting the final chunk should respect the filesize
+	e, err = m.Export(m.Filesize-1, 1, hosts)
+	if err != nil {
+		t.Fatal(err)
+	} else if off, _ := e.ExportOffset(); off != 3*chunkSize || e.Filesize != chunkSize-100 {
+		t.Fatal("wrong final chunk export:", off, e.Filesize)
+	}
+
+	// exported metafiles should survive a round-trip to disk
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	e, _ = m.Export(0, m.Filesize, hosts[1:])
+	path := filepath.Join(dir, "export.usa")
+	if err := WriteMetaFile(path, e); err != nil {
+		t.Fatal(err)
+	} else if e2, err := ReadMetaFile(path); err != nil {
+		t.Fatal(err)
+	} else if len(e2.Shards[0]) != 0 || len(e2.Shards[1]) != 4 {
+		t.Fatal("wrong shards after round-trip")
+	}
+
+	// invalid exports
+	if _, err := m.Export(0, 1, hosts[:1]); err == nil {
+		t.Fatal("expected error for too few hosts")
+	} else if _, err := m.Export(0, m.Filesize+1, hosts); err == nil {
+		t.Fatal("expected error for out-of-bounds range")
+	}
+}
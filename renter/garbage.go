@@ -0,0 +1,63 @@
+package renter
+
+import (
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+)
+
+// ExtGarbage is a MetaExtension recording sector data that the file no longer
+// references, e.g. because it was overwritten or truncated. A later garbage
+// collection pass can use these records to delete unreferenced sectors from
+// their hosts and reclaim the funds spent storing them. Each record is
+// encoded as the binary form of the host's public key (33 bytes) followed by
+// an encoded SectorSlice.
+const ExtGarbage MetaExtensionType = 13
+
+const garbageSliceSize = 33 + SectorSliceSize
+
+// A GarbageSlice is a SectorSlice, stored on a particular host, that is no
+// longer referenced by a file.
+type GarbageSlice struct {
+	Host  hostdb.HostPublicKey
+	Slice SectorSlice
+}
+
+// Garbage returns the GarbageSlices recorded in m.
+func (m *MetaFile) Garbage() []GarbageSlice {
+	data, _ := m.Extension(ExtGarbage)
+	gs := make([]GarbageSlice, 0, len(data)/garbageSliceSize)
+	for ; len(data) >= garbageSliceSize; data = data[garbageSliceSize:] {
+		var g GarbageSlice
+		if err := g.Host.UnmarshalBinary(data[:33]); err != nil {
+			continue
+		}
+		g.Slice = decodeSectorSlice(data[33:])
+		gs = append(gs, g)
+	}
+	return gs
+}
+
+// AddGarbage records gs in m. Slices with a zero MerkleRoot, which indicate
+// missing chunks, are ignored.
+func (m *MetaFile) AddGarbage(gs ...GarbageSlice) {
+	data, _ := m.Extension(ExtGarbage)
+	for _, g := range gs {
+		if g.Slice.MerkleRoot == (crypto.Hash{}) || g.Slice.NumSegments == 0 {
+			continue
+		}
+		b := make([]byte, garbageSliceSize)
+		key, _ := g.Host.MarshalBinary()
+		copy(b, key)
+		encodeSectorSlice(b[33:], g.Slice)
+		data = append(data, b...)
+	}
+	if len(data) > 0 {
+		m.SetExtension(ExtGarbage, false, data)
+	}
+}
+
+// SetGarbage replaces the GarbageSlices recorded in m with gs.
+func (m *MetaFile) SetGarbage(gs []GarbageSlice) {
+	m.RemoveExtension(ExtGarbage)
+	m.AddGarbage(gs...)
+}
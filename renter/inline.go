@@ -0,0 +1,103 @@
+package renter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/frand"
+)
+
+// ExtInlineData is a critical MetaExtension containing the file's contents,
+// stored directly in the metafile rather than on hosts. Storing tiny files
+// inline avoids the overhead of uploading a sector (or part of one) to each
+// host. The extension data contains a nonce followed by the contents, sealed
+// with the AEAD corresponding to the metafile's Cipher, using a key derived
+// from the MasterKey.
+//
+// A metafile with inline data has no shards; its Hosts and MinShards are
+// retained so that the file can be uploaded normally if it grows.
+const ExtInlineData MetaExtensionType = 11
+
+func init() {
+	supportedExtensions[ExtInlineData] = true
+}
+
+// DefaultInlineThreshold is a reasonable maximum size for files stored
+// inline.
+const DefaultInlineThreshold = 4096
+
+func (m *MetaFile) inlineAEAD() (cipher.AEAD, error) {
+	if m.keyOmitted() && m.MasterKey == (KeySeed{}) {
+		return nil, errors.New("metafile key must be derived (via DeriveKey) or unwrapped (via UnwrapKey) before accessing inline data")
+	}
+	key := blake2b.Sum256(append([]byte("lukechampine.com/us/renter/inline"), m.MasterKey[:]...))
+	switch c := m.Cipher(); c {
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key[:])
+	case CipherAES256CTR:
+		block, _ := aes.NewCipher(key[:]) // no error possible
+		return cipher.NewGCM(block)
+	default:
+		return nil, errors.Errorf("unsupported cipher %v", c)
+	}
+}
+
+// IsInline returns true if m's contents are stored inline.
+func (m *MetaFile) IsInline() bool {
+	_, ok := m.Extension(ExtInlineData)
+	return ok
+}
+
+// InlineData returns m's inline contents. The returned slice always has
+// length m.Filesize.
+func (m *MetaFile) InlineData() ([]byte, error) {
+	sealed, ok := m.Extension(ExtInlineData)
+	if !ok {
+		return nil, errors.New("metafile does not contain inline data")
+	}
+	aead, err := m.inlineAEAD()
+	if err != nil {
+		return nil, err
+	} else if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("inline data is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decrypt inline data")
+	}
+	// the file may have been truncated or extended since the data was stored
+	if int64(len(data)) > m.Filesize {
+		data = data[:m.Filesize]
+	} else if int64(len(data)) < m.Filesize {
+		data = append(data, make([]byte, m.Filesize-int64(len(data)))...)
+	}
+	return data, nil
+}
+
+// SetInlineData stores data inline in m, setting m.Filesize accordingly. It
+// returns an error if m has any shard data.
+func (m *MetaFile) SetInlineData(data []byte) error {
+	for _, shard := range m.Shards {
+		if len(shard) > 0 {
+			return errors.New("cannot store data inline in a metafile with shard data")
+		}
+	}
+	aead, err := m.inlineAEAD()
+	if err != nil {
+		return err
+	}
+	nonce := frand.Bytes(aead.NonceSize())
+	m.SetExtension(ExtInlineData, true, aead.Seal(nonce, nonce, data, nil))
+	m.Filesize = int64(len(data))
+	return nil
+}
+
+// RemoveInlineData removes m's inline contents, leaving an empty file.
+func (m *MetaFile) RemoveInlineData() {
+	m.RemoveExtension(ExtInlineData)
+	m.Filesize = 0
+}
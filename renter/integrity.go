@@ -0,0 +1,56 @@
+package renter
+
+import (
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ExtChunkHashes is a MetaExtension containing the integrity manifest of a
+// metafile: the HashChunk of each chunk's plaintext, concatenated. A zero hash
+// indicates that the corresponding chunk cannot be verified, e.g. because it
+// was only partially overwritten.
+const ExtChunkHashes MetaExtensionType = 3
+
+// HashChunk returns the hash of a chunk's plaintext, including any padding
+// added during erasure coding.
+func HashChunk(data []byte) crypto.Hash {
+	return blake2b.Sum256(data)
+}
+
+// ChunkHashes returns m's integrity manifest, if any. The i'th hash
+// corresponds to the i'th SectorSlice of each shard.
+func (m *MetaFile) ChunkHashes() []crypto.Hash {
+	data, _ := m.Extension(ExtChunkHashes)
+	hashes := make([]crypto.Hash, len(data)/crypto.HashSize)
+	for i := range hashes {
+		copy(hashes[i][:], data[i*crypto.HashSize:])
+	}
+	return hashes
+}
+
+// SetChunkHashes sets m's integrity manifest. If no hashes are non-zero, the
+// manifest is removed.
+func (m *MetaFile) SetChunkHashes(hashes []crypto.Hash) {
+	var nonzero bool
+	data := make([]byte, 0, len(hashes)*crypto.HashSize)
+	for _, h := range hashes {
+		nonzero = nonzero || h != (crypto.Hash{})
+		data = append(data, h[:]...)
+	}
+	if !nonzero {
+		m.RemoveExtension(ExtChunkHashes)
+		return
+	}
+	m.SetExtension(ExtChunkHashes, false, data)
+}
+
+// ChunkBoundaries returns the offsets within the file at which each chunk
+// begins, followed by the offset at which the final chunk ends. Chunk i thus
+// spans [b[i], b[i+1]). The final offset may exceed m.Filesize, since chunks
+// are padded during erasure coding. Chunks that are missing from every shard
+// are treated as empty. If m has redundancy tiers, each chunk's size is
+// determined by the MinShards of the tier in which it begins.
+func (m *MetaFile) ChunkBoundaries() []int64 {
+	bounds, _ := m.ChunkLayout()
+	return bounds
+}
@@ -0,0 +1,126 @@
+package renter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// metaJournal is the on-disk representation of a pending WriteMetaFiles
+// transaction.
+type metaJournal struct {
+	Committed bool     `json:"committed"`
+	Files     []string `json:"files"`
+}
+
+func writeJournal(filename string, j metaJournal) error {
+	js, _ := json.Marshal(j)
+	f, err := os.Create(filename + "_tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(js); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	} else if err := os.Rename(filename+"_tmp", filename); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// WriteMetaFiles writes a set of metafiles, keyed by filename, such that
+// either all or none of the writes survive a crash. It uses a write-ahead
+// journal stored at journalPath: the new metafiles are first written to
+// temporary files and synced, then the journal is marked committed, and only
+// then are the temporary files renamed into place. If a crash occurs,
+// RecoverMetaFiles must be called with the same journalPath before the
+// metafiles are next read or written.
+func WriteMetaFiles(journalPath string, files map[string]*MetaFile) error {
+	return writeMetaFiles(journalPath, files, nil)
+}
+
+// WriteEncryptedMetaFiles is like WriteMetaFiles, but encrypts each metafile
+// with key (see WriteEncryptedMetaFile).
+func WriteEncryptedMetaFiles(journalPath string, files map[string]*MetaFile, key *MetaFileKey) error {
+	return writeMetaFiles(journalPath, files, key)
+}
+
+func writeMetaFiles(journalPath string, files map[string]*MetaFile, key *MetaFileKey) error {
+	if err := RecoverMetaFiles(journalPath); err != nil {
+		return err
+	}
+	j := metaJournal{Files: make([]string, 0, len(files))}
+	for filename := range files {
+		j.Files = append(j.Files, filename)
+	}
+	// record intent, so that temporary files can be cleaned up if we crash
+	// before committing
+	if err := writeJournal(journalPath, j); err != nil {
+		return errors.Wrap(err, "could not write journal")
+	}
+	for filename, m := range files {
+		if key == nil {
+			if err := writeMetaArchive(filename+"_tmp", m); err != nil {
+				return err
+			}
+		} else {
+			data, err := encryptMetaArchive(m, key)
+			if err != nil {
+				return err
+			} else if err := writeFileSynced(filename+"_tmp", data); err != nil {
+				return errors.Wrap(err, "could not write encrypted metafile")
+			}
+		}
+	}
+	j.Committed = true
+	if err := writeJournal(journalPath, j); err != nil {
+		return errors.Wrap(err, "could not commit journal")
+	}
+	return RecoverMetaFiles(journalPath)
+}
+
+// RecoverMetaFiles completes or rolls back a WriteMetaFiles transaction that
+// was interrupted by a crash. If the transaction was committed, the new
+// metafiles are renamed into place; otherwise, they are discarded. If no
+// journal exists at journalPath, RecoverMetaFiles is a no-op.
+func RecoverMetaFiles(journalPath string) error {
+	js, err := ioutil.ReadFile(journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "could not read journal")
+	}
+	var j metaJournal
+	if err := json.Unmarshal(js, &j); err != nil {
+		return errors.Wrap(err, "could not decode journal")
+	}
+	dirs := make(map[string]struct{})
+	for _, filename := range j.Files {
+		tmp := filename + "_tmp"
+		if j.Committed {
+			// the rename may already have happened before the crash
+			if err := os.Rename(tmp, filename); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "could not replay journal")
+			}
+		} else if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "could not roll back journal")
+		}
+		dirs[filepath.Dir(filename)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return errors.Wrap(err, "could not sync metafile directory")
+		}
+	}
+	if err := os.Remove(journalPath); err != nil {
+		return errors.Wrap(err, "could not remove journal")
+	}
+	return syncDir(filepath.Dir(journalPath))
+}
@@ -0,0 +1,169 @@
+package renter
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+)
+
+// ExtKeyDerivation is a critical MetaExtension indicating that the metafile's
+// MasterKey is not stored in the metafile, but is instead derived from a
+// RenterSeed and the file ID contained in the extension data.
+const ExtKeyDerivation MetaExtensionType = 1
+
+// ExtWrappedKey is a critical MetaExtension indicating that the metafile's
+// MasterKey is not stored in the metafile in plaintext, but is instead
+// encrypted ("wrapped") with a KeyEncryptionKey. The extension data contains a
+// 24-byte nonce followed by the MasterKey, sealed with XChaCha20-Poly1305.
+const ExtWrappedKey MetaExtensionType = 7
+
+func init() {
+	supportedExtensions[ExtKeyDerivation] = true
+	supportedExtensions[ExtWrappedKey] = true
+}
+
+// A FileID uniquely identifies a metafile for the purpose of key derivation.
+// Unlike a path, it does not change when the metafile is renamed.
+type FileID [16]byte
+
+// A RenterSeed is a secret from which the encryption keys of all of a
+// renter's metafiles can be derived. Together with the metafiles themselves,
+// it is sufficient to recover all of the renter's data.
+type RenterSeed [32]byte
+
+// FileKey derives the KeySeed for the file with the specified ID.
+func (s *RenterSeed) FileKey(id FileID) KeySeed {
+	buf := make([]byte, 0, 32+len(s)+len(id))
+	buf = append(buf, "lukechampine.com/us/renter/filekey"...)
+	buf = append(buf, s[:]...)
+	buf = append(buf, id[:]...)
+	return KeySeed(blake2b.Sum256(buf))
+}
+
+// SnapshotKey derives the key used to encrypt the renter's host-stored
+// snapshots (see proto.Session.UploadSnapshot).
+func (s *RenterSeed) SnapshotKey() [32]byte {
+	buf := make([]byte, 0, 32+len(s))
+	buf = append(buf, "lukechampine.com/us/renter/snapshotkey"...)
+	buf = append(buf, s[:]...)
+	return blake2b.Sum256(buf)
+}
+
+// NewMetaFileWithSeed is like NewMetaFile, but derives the metafile's
+// MasterKey from seed and a random FileID instead of generating it randomly.
+// The MasterKey is not written to disk; after reading the metafile, DeriveKey
+// must be called to restore it.
+func NewMetaFileWithSeed(seed *RenterSeed, mode os.FileMode, size int64, hosts []hostdb.HostPublicKey, minShards int) *MetaFile {
+	m := NewMetaFile(mode, size, hosts, minShards)
+	var id FileID
+	frand.Read(id[:])
+	m.SetExtension(ExtKeyDerivation, true, id[:])
+	m.MasterKey = seed.FileKey(id)
+	return m
+}
+
+// FileID returns the ID from which m's MasterKey is derived, if any.
+func (m *MetaFile) FileID() (FileID, bool) {
+	var id FileID
+	data, ok := m.Extension(ExtKeyDerivation)
+	if !ok || len(data) != len(id) {
+		return FileID{}, false
+	}
+	copy(id[:], data)
+	return id, true
+}
+
+// DeriveKey sets m's MasterKey to the key derived from seed. It returns an
+// error if m's key is not derived from a seed.
+func (m *MetaFile) DeriveKey(seed *RenterSeed) error {
+	id, ok := m.FileID()
+	if !ok {
+		return errors.New("metafile key is not derived from a seed")
+	}
+	m.MasterKey = seed.FileKey(id)
+	return nil
+}
+
+// A KeyEncryptionKey is a secret used to wrap the MasterKeys of metafiles, so
+// that the metafiles can be stored separately from the secret. Unlike a
+// RenterSeed, a KeyEncryptionKey can be rotated: since every sector key is
+// derived from the MasterKey, re-wrapping the MasterKey with a new
+// KeyEncryptionKey re-secures the file without touching its data.
+type KeyEncryptionKey [32]byte
+
+// keyOmitted reports whether m's MasterKey is omitted when m is written to
+// disk.
+func (m *MetaFile) keyOmitted() bool {
+	_, derived := m.FileID()
+	_, wrapped := m.Extension(ExtWrappedKey)
+	return derived || wrapped
+}
+
+// WrapKey wraps m's MasterKey with kek. The MasterKey is not written to disk;
+// after reading the metafile, UnwrapKey must be called to restore it. Keys
+// derived from a RenterSeed cannot be wrapped, since they are never written
+// to disk in the first place.
+func (m *MetaFile) WrapKey(kek *KeyEncryptionKey) error {
+	if _, ok := m.FileID(); ok {
+		return errors.New("metafile key is derived from a seed")
+	} else if m.MasterKey == (KeySeed{}) {
+		return errors.New("metafile key must be unwrapped before it can be wrapped")
+	}
+	aead, _ := chacha20poly1305.NewX(kek[:]) // no error possible
+	data := frand.Bytes(chacha20poly1305.NonceSizeX)
+	data = aead.Seal(data, data, m.MasterKey[:], nil)
+	m.SetExtension(ExtWrappedKey, true, data)
+	return nil
+}
+
+// UnwrapKey sets m's MasterKey to the key wrapped with kek. It returns an
+// error if m's key is not wrapped, or if kek is not the key that wrapped it.
+func (m *MetaFile) UnwrapKey(kek *KeyEncryptionKey) error {
+	data, ok := m.Extension(ExtWrappedKey)
+	if !ok {
+		return errors.New("metafile key is not wrapped")
+	} else if len(data) < chacha20poly1305.NonceSizeX {
+		return errors.New("wrapped key is too short")
+	}
+	aead, _ := chacha20poly1305.NewX(kek[:]) // no error possible
+	nonce, ciphertext := data[:chacha20poly1305.NonceSizeX], data[chacha20poly1305.NonceSizeX:]
+	key, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil || len(key) != len(m.MasterKey) {
+		return errors.New("could not unwrap key: incorrect key-encryption key")
+	}
+	copy(m.MasterKey[:], key)
+	return nil
+}
+
+// RewrapKey re-wraps m's MasterKey, replacing oldKEK with newKEK. The
+// MasterKey itself, and hence the data stored on hosts, is unchanged.
+func (m *MetaFile) RewrapKey(oldKEK, newKEK *KeyEncryptionKey) error {
+	if err := m.UnwrapKey(oldKEK); err != nil {
+		return err
+	}
+	return m.WrapKey(newKEK)
+}
+
+// RewrapMetaFileKey re-wraps the MasterKey of the metafile at filename,
+// replacing oldKEK with newKEK. The metafile is rewritten atomically, in the
+// same layout in which it was read.
+func RewrapMetaFileKey(filename string, oldKEK, newKEK *KeyEncryptionKey) error {
+	indexed, err := isIndexedMetaFile(filename)
+	if err != nil {
+		return err
+	}
+	m, err := ReadMetaFile(filename)
+	if err != nil {
+		return err
+	} else if err := m.RewrapKey(oldKEK, newKEK); err != nil {
+		return err
+	}
+	if indexed {
+		return WriteIndexedMetaFile(filename, m)
+	}
+	return WriteMetaFile(filename, m)
+}
@@ -0,0 +1,61 @@
+package renter
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ErrContractInUse is returned by LockContract when the contract file is
+// already locked by another process.
+var ErrContractInUse = errors.New("contract is in use by another process")
+
+// A ContractLock is an advisory lock on a contract file. It prevents two
+// processes from revising the same contract concurrently, which would
+// desynchronize their revision numbers. Note that the lock is only advisory:
+// it is not enforced by the host. (However, the host will refuse to lock a
+// contract that is already locked by another session; see
+// proto.ErrContractLocked.)
+type ContractLock struct {
+	f *os.File
+}
+
+// Unlock releases the lock.
+func (cl *ContractLock) Unlock() error {
+	if err := unlockFile(cl.f); err != nil {
+		cl.f.Close()
+		return errors.Wrap(err, "could not unlock contract file")
+	}
+	return cl.f.Close()
+}
+
+// LockContract acquires an exclusive lock on the specified contract file. It
+// does not block; if the file is already locked, it returns ErrContractInUse.
+func LockContract(filename string) (*ContractLock, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open contract file")
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ContractLock{f: f}, nil
+}
+
+// LoadLockedContract locks the specified contract file and loads it into
+// memory. The caller must release the lock when it is done with the contract.
+func LoadLockedContract(filename string) (Contract, *ContractLock, error) {
+	cl, err := LockContract(filename)
+	if err != nil {
+		return Contract{}, nil, err
+	}
+	// read through the locked handle; on Windows, the lock is mandatory, so
+	// reading via another handle would fail
+	c, err := readContract(cl.f)
+	if err != nil {
+		cl.Unlock()
+		return Contract{}, nil, err
+	}
+	return c, cl, nil
+}
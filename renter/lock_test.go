@@ -0,0 +1,177 @@
+package renter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+)
+
+func TestContractLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	filename := filepath.Join(dir, "foo.contract")
+	c := Contract{
+		HostKey:   hostdb.HostKeyFromPublicKey(key.PublicKey()),
+		RenterKey: key,
+	}
+	if err := SaveContract(c, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	_, cl, err := LoadLockedContract(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockContract(filename); err != ErrContractInUse {
+		t.Fatal("expected ErrContractInUse, got", err)
+	}
+	if err := cl.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	cl, err = LockContract(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.Unlock()
+}
+
+func TestMetaFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "foo.usa")
+
+	// exclusive locks conflict with all other locks
+	l, err := LockMetaFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := LockMetaFile(filename); err != ErrMetaFileLocked {
+		t.Fatal("expected ErrMetaFileLocked, got", err)
+	} else if _, err := RLockMetaFile(filename); err != ErrMetaFileLocked {
+		t.Fatal("expected ErrMetaFileLocked, got", err)
+	} else if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// shared locks conflict only with exclusive locks
+	r1, err := RLockMetaFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := RLockMetaFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := LockMetaFile(filename); err != ErrMetaFileLocked {
+		t.Fatal("expected ErrMetaFileLocked, got", err)
+	}
+	r1.Unlock()
+	if _, err := LockMetaFile(filename); err != ErrMetaFileLocked {
+		t.Fatal("expected ErrMetaFileLocked, got", err)
+	}
+	r2.Unlock()
+	l, err = LockMetaFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Unlock()
+
+	// lock files should be hidden from directory listings
+	infos, _ := ioutil.ReadDir(dir)
+	if len(infos) != 0 {
+		t.Fatal("lock files were not removed")
+	}
+	for _, name := range []string{"foo.usa.lock", "foo.usa.rlock-0123", "foo.usa.stale-0123"} {
+		if !IsMetaFileLock(name) {
+			t.Errorf("%v should be recognized as a lock file", name)
+		}
+	}
+	if IsMetaFileLock("foo.usa") || IsMetaFileLock("foo.lock.usa") {
+		t.Error("metafiles should not be recognized as lock files")
+	}
+
+	writeLock := func(path string, info lockInfo, modTime time.Time) {
+		t.Helper()
+		js, _ := json.Marshal(info)
+		if err := ioutil.WriteFile(path, js, 0660); err != nil {
+			t.Fatal(err)
+		} else if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hostname, _ := os.Hostname()
+
+	// a lock held by a dead process on this machine is stale
+	writeLock(exclusiveLockPath(filename), lockInfo{ID: "a", PID: 1 << 30, Hostname: hostname}, time.Now())
+	if l, err := RLockMetaFile(filename); err != nil {
+		t.Fatal(err)
+	} else {
+		l.Unlock()
+	}
+	// a lock held by another machine is stale only if it has not been
+	// refreshed recently
+	writeLock(exclusiveLockPath(filename), lockInfo{ID: "b", PID: 1, Hostname: hostname + "-other"}, time.Now())
+	if _, err := LockMetaFile(filename); err != ErrMetaFileLocked {
+		t.Fatal("expected ErrMetaFileLocked, got", err)
+	}
+	writeLock(exclusiveLockPath(filename), lockInfo{ID: "b", PID: 1, Hostname: hostname + "-other"}, time.Now().Add(-2*staleLockAge))
+	if l, err := LockMetaFile(filename); err != nil {
+		t.Fatal(err)
+	} else {
+		l.Unlock()
+	}
+	// likewise for shared locks
+	writeLock(filepath.Join(dir, sharedLockPrefix(filename)+"c"), lockInfo{ID: "c", PID: 1 << 30, Hostname: hostname}, time.Now())
+	if l, err := LockMetaFile(filename); err != nil {
+		t.Fatal(err)
+	} else {
+		l.Unlock()
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Fatal("stale lock files were not removed")
+	}
+
+	// concurrent read-modify-write cycles should not lose updates
+	if err := ioutil.WriteFile(filename, []byte("0"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				l, err := LockMetaFile(filename)
+				for err == ErrMetaFileLocked {
+					time.Sleep(time.Millisecond)
+					l, err = LockMetaFile(filename)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				b, _ := ioutil.ReadFile(filename)
+				n, _ := strconv.Atoi(string(b))
+				ioutil.WriteFile(filename, []byte(strconv.Itoa(n+1)), 0660)
+				l.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if b, _ := ioutil.ReadFile(filename); string(b) != "80" {
+		t.Fatalf("expected 80 updates, got %s", b)
+	}
+}
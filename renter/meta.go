@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 	"unsafe"
@@ -25,7 +26,12 @@ import (
 const (
 	// MetaFileVersion is the current version of the metafile format. It is
 	// incremented after each change to the format.
-	MetaFileVersion = 2
+	MetaFileVersion = 3
+
+	// minMetaFileVersion is the oldest version of the metafile format that
+	// can still be read. Such metafiles are upgraded to MetaFileVersion when
+	// they are next written.
+	minMetaFileVersion = 2
 
 	// SectorSliceSize is the encoded size of a SectorSlice.
 	SectorSliceSize = 64
@@ -39,7 +45,8 @@ var _ [SectorSliceSize]struct{} = [unsafe.Sizeof(SectorSlice{})]struct{}{}
 // A MetaFile is a set of metadata that represents a file stored on Sia hosts.
 type MetaFile struct {
 	MetaIndex
-	Shards [][]SectorSlice
+	Shards     [][]SectorSlice
+	Extensions []MetaExtension
 }
 
 // A MetaIndex contains the traditional file metadata for a MetaFile, along with
@@ -65,6 +72,24 @@ type SectorSlice struct {
 	Nonce        [24]byte
 }
 
+// encodeSectorSlice encodes ss into b, which must be at least SectorSliceSize
+// bytes long.
+func encodeSectorSlice(b []byte, ss SectorSlice) {
+	copy(b, ss.MerkleRoot[:])
+	binary.LittleEndian.PutUint32(b[32:], ss.SegmentIndex)
+	binary.LittleEndian.PutUint32(b[36:], ss.NumSegments)
+	copy(b[40:], ss.Nonce[:])
+}
+
+// decodeSectorSlice decodes a SectorSlice encoded with encodeSectorSlice.
+func decodeSectorSlice(b []byte) (ss SectorSlice) {
+	copy(ss.MerkleRoot[:], b[:32])
+	ss.SegmentIndex = binary.LittleEndian.Uint32(b[32:36])
+	ss.NumSegments = binary.LittleEndian.Uint32(b[36:40])
+	copy(ss.Nonce[:], b[40:64])
+	return
+}
+
 // A KeySeed derives subkeys and uses them to encrypt and decrypt messages.
 type KeySeed [32]byte
 
@@ -108,8 +133,8 @@ func (s *KeySeed) XORKeyStream(msg []byte, nonce []byte, startIndex uint64) {
 // Validate performs basic sanity checks on a MetaIndex.
 func (m *MetaIndex) Validate() error {
 	switch {
-	case m.Version != MetaFileVersion:
-		return errors.Errorf("incompatible version (%v, want %v)", m.Version, MetaFileVersion)
+	case m.Version < minMetaFileVersion || m.Version > MetaFileVersion:
+		return errors.Errorf("incompatible version (%v, want %v-%v)", m.Version, minMetaFileVersion, MetaFileVersion)
 	case m.MinShards == 0:
 		return errors.Errorf("MinShards cannot be 0")
 	case m.MinShards > len(m.Hosts):
@@ -184,38 +209,83 @@ func NewMetaFile(mode os.FileMode, size int64, hosts []hostdb.HostPublicKey, min
 		Shards: make([][]SectorSlice, len(hosts)),
 	}
 	frand.Read(m.MasterKey[:])
+	m.SetCipher(DefaultCipher())
 	return m
 }
 
-// WriteMetaFile creates a gzipped tar archive containing m's index and shards,
-// and writes it to filename. The write is atomic.
+// WriteMetaFile creates a gzipped tar archive containing m's index, shards,
+// and extensions, and writes it to filename. The write is atomic. The archive
+// is always written using the current MetaFileVersion.
 func WriteMetaFile(filename string, m *MetaFile) error {
-	// validate before writing
-	if err := validateShards(m.Shards); err != nil {
-		return errors.Wrap(err, "invalid shards")
+	if err := writeMetaArchive(filename+"_tmp", m); err != nil {
+		return err
+	} else if err := os.Rename(filename+"_tmp", filename); err != nil {
+		return errors.Wrap(err, "could not atomically replace archive file")
+	} else if err := syncDir(filepath.Dir(filename)); err != nil {
+		return errors.Wrap(err, "could not sync archive directory")
 	}
+	return nil
+}
 
-	f, err := os.Create(filename + "_tmp")
+// writeMetaArchive writes m to filename and syncs it to stable storage.
+func writeMetaArchive(filename string, m *MetaFile) error {
+	f, err := os.Create(filename)
 	if err != nil {
 		return errors.Wrap(err, "could not create archive")
 	}
 	defer f.Close()
-	zip := gzip.NewWriter(f)
+	if err := encodeMetaArchive(f, m); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "could not sync archive file")
+	} else if err := f.Close(); err != nil {
+		return errors.Wrap(err, "could not close archive file")
+	}
+	return nil
+}
+
+// encodeMetaArchive writes m to w as a gzipped tar archive.
+func encodeMetaArchive(w io.Writer, m *MetaFile) error {
+	// validate before writing
+	if err := validateShards(m.Shards); err != nil {
+		return errors.Wrap(err, "invalid shards")
+	}
+	index := m.MetaIndex
+	index.Version = MetaFileVersion
+	if m.keyOmitted() {
+		index.MasterKey = KeySeed{} // see DeriveKey and UnwrapKey
+	}
+
+	zip := gzip.NewWriter(w)
 	tw := tar.NewWriter(zip)
 
 	// write index
-	index, _ := json.Marshal(m.MetaIndex)
-	err = tw.WriteHeader(&tar.Header{
+	indexJSON, _ := json.Marshal(index)
+	err := tw.WriteHeader(&tar.Header{
 		Name: indexFilename,
-		Size: int64(len(index)),
+		Size: int64(len(indexJSON)),
 		Mode: 0666,
 	})
 	if err != nil {
 		return errors.Wrap(err, "could not write index header")
-	} else if _, err = tw.Write(index); err != nil {
+	} else if _, err = tw.Write(indexJSON); err != nil {
 		return errors.Wrap(err, "could not write index")
 	}
 
+	// write extensions
+	if len(m.Extensions) > 0 {
+		err = tw.WriteHeader(&tar.Header{
+			Name: extensionsFilename,
+			Size: encodedExtensionsSize(m.Extensions),
+			Mode: 0666,
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not write extensions header")
+		} else if err = writeExtensions(tw, m.Extensions); err != nil {
+			return errors.Wrap(err, "could not write extensions")
+		}
+	}
+
 	// write shards
 	encSlice := make([]byte, SectorSliceSize)
 	for i, hostKey := range m.Hosts {
@@ -228,40 +298,48 @@ func WriteMetaFile(filename string, m *MetaFile) error {
 			return errors.Wrap(err, "could not write shard header")
 		}
 		for _, ss := range m.Shards[i] {
-			copy(encSlice, ss.MerkleRoot[:])
-			binary.LittleEndian.PutUint32(encSlice[32:], ss.SegmentIndex)
-			binary.LittleEndian.PutUint32(encSlice[36:], ss.NumSegments)
-			copy(encSlice[40:], ss.Nonce[:])
+			encodeSectorSlice(encSlice, ss)
 			if _, err = tw.Write(encSlice); err != nil {
 				return errors.Wrap(err, "could not add shard to archive")
 			}
 		}
 	}
 
-	// flush, close, and atomically rename
+	// flush and close
 	if err := tw.Close(); err != nil {
 		return errors.Wrap(err, "could not write tar data")
 	} else if err := zip.Close(); err != nil {
 		return errors.Wrap(err, "could not write gzip data")
-	} else if err := f.Sync(); err != nil {
-		return errors.Wrap(err, "could not sync archive file")
-	} else if err := f.Close(); err != nil {
-		return errors.Wrap(err, "could not close archive file")
-	} else if err := os.Rename(filename+"_tmp", filename); err != nil {
-		return errors.Wrap(err, "could not atomically replace archive file")
 	}
-
 	return nil
 }
 
-// ReadMetaFile reads a metafile archive into memory.
+// ReadMetaFile reads a metafile archive into memory. Older versions of the
+// metafile format are read transparently, and upgraded to MetaFileVersion in
+// memory. Indexed metafiles (see WriteIndexedMetaFile) are also supported.
 func ReadMetaFile(filename string) (*MetaFile, error) {
+	if indexed, err := isIndexedMetaFile(filename); err != nil {
+		return nil, err
+	} else if indexed {
+		im, err := OpenIndexedMetaFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer im.Close()
+		return im.ReadAll()
+	}
+
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not open archive")
 	}
 	defer f.Close()
-	zip, err := gzip.NewReader(f)
+	return decodeMetaArchive(f)
+}
+
+// decodeMetaArchive reads a metafile archive from r.
+func decodeMetaArchive(r io.Reader) (*MetaFile, error) {
+	zip, err := gzip.NewReader(r)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not read gzip header")
 	}
@@ -285,7 +363,11 @@ func ReadMetaFile(filename string) (*MetaFile, error) {
 			if err = json.NewDecoder(tr).Decode(&m.MetaIndex); err != nil {
 				return nil, errors.Wrap(err, "could not decode index")
 			}
-		} else {
+		} else if hdr.Name == extensionsFilename {
+			if m.Extensions, err = readExtensions(tr); err != nil {
+				return nil, errors.Wrap(err, "could not read extensions")
+			}
+		} else if strings.HasSuffix(hdr.Name, ".shard") {
 			// read shard
 			shard := make([]SectorSlice, hdr.Size/SectorSliceSize)
 			buf := make([]byte, SectorSliceSize)
@@ -293,20 +375,25 @@ func ReadMetaFile(filename string) (*MetaFile, error) {
 				if _, err := io.ReadFull(tr, buf); err != nil {
 					return nil, errors.Wrap(err, "could not read shard")
 				}
-				copy(shard[i].MerkleRoot[:], buf[:32])
-				shard[i].SegmentIndex = binary.LittleEndian.Uint32(buf[32:36])
-				shard[i].NumSegments = binary.LittleEndian.Uint32(buf[36:40])
-				copy(shard[i].Nonce[:], buf[40:64])
+				shard[i] = decodeSectorSlice(buf)
 			}
 			// shard files can be in any order within the archive, so use name
 			// to determine index
-			hpk := hostdb.HostPublicKey("ed25519:" + strings.TrimSuffix(hdr.Name, ".shard"))
+			hpk, err := hostdb.ParseHostPublicKey("ed25519:" + strings.TrimSuffix(hdr.Name, ".shard"))
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid shard filename")
+			}
 			shards[hpk] = shard
 		}
 	}
 	if err := zip.Close(); err != nil {
 		return nil, errors.Wrap(err, "archive is corrupted")
+	} else if err := m.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid index")
+	} else if err := checkExtensions(m.Extensions); err != nil {
+		return nil, err
 	}
+	m.Version = MetaFileVersion
 
 	// now that we have the index and all shards in memory, order the shards
 	// according the Hosts list in the index
@@ -331,6 +418,17 @@ func ReadMetaFile(filename string) (*MetaFile, error) {
 
 // ReadMetaIndex reads the index of a metafile without reading any shards.
 func ReadMetaIndex(filename string) (MetaIndex, error) {
+	if indexed, err := isIndexedMetaFile(filename); err != nil {
+		return MetaIndex{}, err
+	} else if indexed {
+		im, err := OpenIndexedMetaFile(filename)
+		if err != nil {
+			return MetaIndex{}, err
+		}
+		defer im.Close()
+		return im.MetaIndex, nil
+	}
+
 	f, err := os.Open(filename)
 	if err != nil {
 		return MetaIndex{}, errors.Wrap(err, "could not open archive")
@@ -387,6 +485,12 @@ func MetaFileCanDownload(filename string) (bool, error) {
 // readMetaFileShards reads a metafile and returns its index and the number of
 // shards that represent fully-uploaded shards of the erasure-encoded file.
 func readMetaFileShards(filename string) (MetaIndex, int, error) {
+	if indexed, err := isIndexedMetaFile(filename); err != nil {
+		return MetaIndex{}, 0, err
+	} else if indexed {
+		return readIndexedMetaFileShards(filename)
+	}
+
 	f, err := os.Open(filename)
 	if err != nil {
 		return MetaIndex{}, 0, errors.Wrap(err, "could not open archive")
@@ -415,7 +519,7 @@ func readMetaFileShards(filename string) (MetaIndex, int, error) {
 				return MetaIndex{}, 0, errors.Wrap(err, "could not decode index")
 			}
 			haveIndex = true
-		} else {
+		} else if strings.HasSuffix(hdr.Name, ".shard") {
 			// read shard contents, adding each length value
 			numSlices := int(hdr.FileInfo().Size() / SectorSliceSize)
 			var numSegments int64
@@ -436,7 +540,12 @@ func readMetaFileShards(filename string) (MetaIndex, int, error) {
 		return MetaIndex{}, 0, errors.Wrap(err, "invalid index")
 	}
 
-	// count full shards
+	return index, countFullShards(index, shardSizes), nil
+}
+
+// countFullShards returns the number of shardSizes that are large enough to
+// represent a fully-uploaded shard of the file described by index.
+func countFullShards(index MetaIndex, shardSizes []int64) int {
 	fullShardSize := index.Filesize / int64(index.MinShards)
 	var fullShards int
 	for _, bs := range shardSizes {
@@ -444,22 +553,31 @@ func readMetaFileShards(filename string) (MetaIndex, int, error) {
 			fullShards++
 		}
 	}
-	return index, fullShards, nil
+	return fullShards
 }
 
 // validateShards checks that a set of shards does not contain any inconsistent
-// chunks.
+// chunks. Shards may have different lengths, e.g. if some have not been fully
+// uploaded, and may contain missing chunks (see ChunkMissing).
 func validateShards(shards [][]SectorSlice) error {
-	if len(shards) < 2 {
-		return nil
-	}
-	for chunkIndex, s := range shards[0] {
-		for j := 1; j < len(shards); j++ {
-			s2 := shards[j][chunkIndex]
-			if s.NumSegments != s2.NumSegments {
-				return errors.Errorf("shards %v and %v differ at chunk %v", 0, j, chunkIndex)
+	for chunkIndex := 0; ; chunkIndex++ {
+		first := -1
+		more := false
+		for j := range shards {
+			if chunkIndex >= len(shards[j]) {
+				continue
 			}
+			more = true
+			if shards[j][chunkIndex] == (SectorSlice{}) {
+				continue
+			} else if first == -1 {
+				first = j
+			} else if shards[j][chunkIndex].NumSegments != shards[first][chunkIndex].NumSegments {
+				return errors.Errorf("shards %v and %v differ at chunk %v", first, j, chunkIndex)
+			}
+		}
+		if !more {
+			return nil
 		}
 	}
-	return nil
 }
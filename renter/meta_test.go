@@ -1,12 +1,18 @@
 package renter
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	"lukechampine.com/frand"
 	"lukechampine.com/us/ed25519"
 	"lukechampine.com/us/hostdb"
@@ -35,6 +41,297 @@ func TestEncryption(t *testing.T) {
 	}
 }
 
+func TestCiphers(t *testing.T) {
+	var key KeySeed
+	frand.Read(key[:])
+	nonce := frand.Bytes(24)
+	plaintext := frand.Bytes(merkle.SegmentSize * 8)
+
+	var prev []byte
+	for _, c := range []Cipher{CipherXChaCha20Poly1305, CipherAES256CTR} {
+		ciphertext := append([]byte(nil), plaintext...)
+		c.XORKeyStream(&key, ciphertext, nonce, 0)
+		if bytes.Equal(ciphertext, plaintext) {
+			t.Fatalf("%v: encryption failed", c)
+		} else if bytes.Equal(ciphertext, prev) {
+			t.Fatalf("%v: ciphers produced identical ciphertext", c)
+		}
+		prev = append([]byte(nil), ciphertext...)
+
+		// decrypt starting at a segment offset
+		off := merkle.SegmentSize * 3
+		c.XORKeyStream(&key, ciphertext[off:], nonce, 3)
+		if !bytes.Equal(ciphertext[off:], plaintext[off:]) {
+			t.Errorf("%v: decryption failed", c)
+		}
+	}
+
+	// cipher should be recorded in the metafile, and omitted if it is the
+	// original cipher
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+	m := NewMetaFile(0660, 0, []hostdb.HostPublicKey{hpk}, 1)
+	if m.Cipher() != DefaultCipher() {
+		t.Fatal("expected new metafile to use default cipher")
+	}
+	m.SetCipher(CipherXChaCha20Poly1305)
+	if _, ok := m.Extension(ExtCipher); ok {
+		t.Fatal("expected XChaCha20 to be implicit")
+	}
+	m.SetCipher(CipherAES256CTR)
+	if m.Cipher() != CipherAES256CTR {
+		t.Fatal("cipher was not set")
+	}
+	m.SetCipher(Cipher(7))
+	if findings := m.Check(nil, false); len(findings) != 1 || findings[0].Problem != ProblemInvalidParams {
+		t.Fatal("expected invalid cipher to be reported, got", findings)
+	}
+}
+
+func TestMetaFileExtensions(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+
+	// extensions should round-trip, including unknown non-critical ones
+	m := NewMetaFile(0660, 0, []hostdb.HostPublicKey{hpk}, 1)
+	m.SetCipher(CipherXChaCha20Poly1305) // no ExtCipher
+	m.SetExtension(1000, false, []byte("foo"))
+	m.SetExtension(1001, false, nil)
+	m.SetExtension(1000, false, []byte("bar"))
+	path := filepath.Join(dir, "ext.usa")
+	if err := WriteMetaFile(path, m); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := ReadMetaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(m2.Extensions) != 2 {
+		t.Fatal("wrong number of extensions:", m2.Extensions)
+	} else if data, ok := m2.Extension(1000); !ok || string(data) != "bar" {
+		t.Fatal("wrong extension data:", data)
+	} else if ok, err := MetaFileFullyUploaded(path); err != nil || !ok {
+		t.Fatal("extensions should not be counted as shards:", ok, err)
+	}
+
+	// unknown critical extensions should be rejected
+	m.SetExtension(1002, true, []byte("baz"))
+	if err := WriteMetaFile(path, m); err != nil {
+		t.Fatal(err)
+	} else if _, err := ReadMetaFile(path); err == nil {
+		t.Fatal("expected unsupported critical extension to be rejected")
+	}
+
+	// malformed or unsupported ciphers should be rejected, rather than
+	// crashing (or producing garbage) when sectors are decrypted
+	m.RemoveExtension(1002)
+	for _, data := range [][]byte{{7}, {}, {byte(CipherAES256CTR), 0}} {
+		m.SetExtension(ExtCipher, true, data)
+		ipath := filepath.Join(dir, "ext-indexed.usa")
+		if err := WriteMetaFile(path, m); err != nil {
+			t.Fatal(err)
+		} else if _, err := ReadMetaFile(path); err == nil {
+			t.Fatalf("expected cipher extension %v to be rejected", data)
+		} else if err := WriteIndexedMetaFile(ipath, m); err != nil {
+			t.Fatal(err)
+		} else if _, err := OpenIndexedMetaFile(ipath); err == nil {
+			t.Fatalf("expected cipher extension %v to be rejected by indexed metafile", data)
+		}
+	}
+	if m.Cipher().Valid() {
+		t.Fatal("malformed cipher extension should not yield a valid cipher")
+	}
+	m.SetCipher(CipherXChaCha20Poly1305)
+
+	// version 2 metafiles should be read transparently
+	path = filepath.Join(dir, "v2.usa")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zip := gzip.NewWriter(f)
+	tw := tar.NewWriter(zip)
+	index := m.MetaIndex
+	index.Version = 2
+	js, _ := json.Marshal(index)
+	tw.WriteHeader(&tar.Header{Name: indexFilename, Size: int64(len(js)), Mode: 0666})
+	tw.Write(js)
+	tw.WriteHeader(&tar.Header{Name: hpk.Key() + ".shard", Size: 0, Mode: 0666})
+	tw.Close()
+	zip.Close()
+	f.Close()
+	m2, err = ReadMetaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if m2.Version != MetaFileVersion || len(m2.Extensions) != 0 {
+		t.Fatal("v2 metafile was not upgraded:", m2.Version)
+	} else if m2.MasterKey != m.MasterKey {
+		t.Fatal("v2 metafile was not read correctly")
+	}
+}
+
+func TestDerivedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+
+	var seed RenterSeed
+	frand.Read(seed[:])
+	m := NewMetaFileWithSeed(&seed, 0660, 0, []hostdb.HostPublicKey{hpk}, 1)
+	m2 := NewMetaFileWithSeed(&seed, 0660, 0, []hostdb.HostPublicKey{hpk}, 1)
+	if m.MasterKey == (KeySeed{}) || m.MasterKey == m2.MasterKey {
+		t.Fatal("files should have distinct keys")
+	}
+
+	// the key should not be written to disk
+	path := filepath.Join(dir, "derived.usa")
+	if err := WriteMetaFile(path, m); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadMetaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if read.MasterKey != (KeySeed{}) {
+		t.Fatal("master key was written to disk")
+	}
+
+	// the key should be recoverable from the seed
+	if err := read.DeriveKey(&seed); err != nil {
+		t.Fatal(err)
+	} else if read.MasterKey != m.MasterKey {
+		t.Fatal("derived key does not match original")
+	}
+
+	// metafiles with random keys cannot be derived
+	if err := NewMetaFile(0660, 0, []hostdb.HostPublicKey{hpk}, 1).DeriveKey(&seed); err == nil {
+		t.Fatal("expected error for non-derived key")
+	}
+}
+
+func TestWrappedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+
+	var kek1, kek2 KeyEncryptionKey
+	frand.Read(kek1[:])
+	frand.Read(kek2[:])
+	m := NewMetaFile(0660, 0, []hostdb.HostPublicKey{hpk}, 1)
+	key := m.MasterKey
+	if err := m.WrapKey(&kek1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the key should not be written to disk, in either layout
+	for _, indexed := range []bool{false, true} {
+		path := filepath.Join(dir, "wrapped.usa")
+		write := WriteMetaFile
+		if indexed {
+			write = WriteIndexedMetaFile
+		}
+		if err := write(path, m); err != nil {
+			t.Fatal(err)
+		}
+		read, err := ReadMetaFile(path)
+		if err != nil {
+			t.Fatal(err)
+		} else if read.MasterKey != (KeySeed{}) {
+			t.Fatal("master key was written to disk")
+		}
+
+		// the wrong KEK should be rejected
+		if err := read.UnwrapKey(&kek2); err == nil {
+			t.Fatal("expected error when unwrapping with wrong key")
+		}
+
+		// rotate the KEK on disk; the layout should be preserved
+		if err := RewrapMetaFileKey(path, &kek1, &kek2); err != nil {
+			t.Fatal(err)
+		} else if isIndexed, _ := isIndexedMetaFile(path); isIndexed != indexed {
+			t.Fatal("metafile layout was not preserved")
+		}
+		read, err = ReadMetaFile(path)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := read.UnwrapKey(&kek1); err == nil {
+			t.Fatal("old key-encryption key should no longer work")
+		} else if err := read.UnwrapKey(&kek2); err != nil {
+			t.Fatal(err)
+		} else if read.MasterKey != key {
+			t.Fatal("unwrapped key does not match original")
+		}
+	}
+
+	// unwrapped and derived keys cannot be unwrapped or wrapped, respectively
+	if err := NewMetaFile(0660, 0, []hostdb.HostPublicKey{hpk}, 1).UnwrapKey(&kek1); err == nil {
+		t.Fatal("expected error for unwrapped key")
+	}
+	var seed RenterSeed
+	if err := NewMetaFileWithSeed(&seed, 0660, 0, []hostdb.HostPublicKey{hpk}, 1).WrapKey(&kek1); err == nil {
+		t.Fatal("expected error for derived key")
+	}
+}
+
+func TestWriteMetaFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+	journal := filepath.Join(dir, "journal")
+	foo, bar := filepath.Join(dir, "foo.usa"), filepath.Join(dir, "bar.usa")
+
+	m := NewMetaFile(0660, 1, []hostdb.HostPublicKey{hpk}, 1)
+	err = WriteMetaFiles(journal, map[string]*MetaFile{foo: m, bar: m})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatal("journal should have been removed")
+	}
+	for _, path := range []string{foo, bar} {
+		if index, err := ReadMetaIndex(path); err != nil || index.Filesize != 1 {
+			t.Fatal("metafile was not written:", err)
+		}
+	}
+
+	// simulate a crash before the transaction was committed
+	m.Filesize = 2
+	if err := writeJournal(journal, metaJournal{Files: []string{foo}}); err != nil {
+		t.Fatal(err)
+	} else if err := writeMetaArchive(foo+"_tmp", m); err != nil {
+		t.Fatal(err)
+	} else if err := RecoverMetaFiles(journal); err != nil {
+		t.Fatal(err)
+	} else if index, _ := ReadMetaIndex(foo); index.Filesize != 1 {
+		t.Fatal("uncommitted write should have been rolled back")
+	} else if _, err := os.Stat(foo + "_tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary file should have been removed")
+	}
+
+	// simulate a crash after the transaction was committed, but before all
+	// files were renamed
+	if err := writeMetaArchive(foo+"_tmp", m); err != nil {
+		t.Fatal(err)
+	} else if err := writeJournal(journal, metaJournal{Committed: true, Files: []string{foo, bar}}); err != nil {
+		t.Fatal(err)
+	} else if err := RecoverMetaFiles(journal); err != nil {
+		t.Fatal(err)
+	} else if index, _ := ReadMetaIndex(foo); index.Filesize != 2 {
+		t.Fatal("committed write should have been replayed")
+	} else if index, _ := ReadMetaIndex(bar); index.Filesize != 1 {
+		t.Fatal("already-renamed file should be unaffected")
+	}
+}
+
 func BenchmarkEncryption(b *testing.B) {
 	var key KeySeed
 	data := make([]byte, renterhost.SectorSize)
@@ -70,3 +367,602 @@ func BenchmarkWriteMetaFile(b *testing.B) {
 		}
 	}
 }
+
+func TestIndexedMetaFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := make([]hostdb.HostPublicKey, 3)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	}
+
+	// create a metafile with chunks of varying size; the final shard is
+	// incomplete
+	m := NewMetaFile(0660, 0, hosts, 2)
+	var hashes []crypto.Hash
+	for chunk := 0; chunk < 100; chunk++ {
+		numSegments := uint32(1 + frand.Intn(100))
+		for i := range m.Shards {
+			if i == 2 && chunk >= 90 {
+				continue
+			}
+			ss := SectorSlice{SegmentIndex: uint32(chunk), NumSegments: numSegments}
+			frand.Read(ss.MerkleRoot[:])
+			m.Shards[i] = append(m.Shards[i], ss)
+		}
+		m.Filesize += int64(numSegments) * m.MinChunkSize()
+		hashes = append(hashes, crypto.Hash{byte(chunk + 1)})
+	}
+	m.Filesize -= 10                     // padding
+	m.ModTime = m.ModTime.Round(0).UTC() // as decoded from JSON
+	m.SetChunkHashes(hashes)
+	m.SetExtension(1000, false, []byte("foo"))
+	filename := filepath.Join(dir, "indexed.usa")
+	if err := WriteIndexedMetaFile(filename, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// the full metafile should round-trip
+	if m2, err := ReadMetaFile(filename); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(m2, m) {
+		t.Fatal("metafile did not round-trip")
+	}
+	if index, err := ReadMetaIndex(filename); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(index, m.MetaIndex) {
+		t.Fatal("index did not round-trip")
+	}
+	if ok, err := MetaFileCanDownload(filename); err != nil || !ok {
+		t.Fatal("expected metafile to be downloadable", err)
+	} else if ok, err := MetaFileFullyUploaded(filename); err != nil || ok {
+		t.Fatal("expected metafile to not be fully uploaded", err)
+	}
+
+	// ranges should load only the chunks that cover them
+	im, err := OpenIndexedMetaFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if im.NumChunks() != 100 {
+		t.Fatal("wrong number of chunks:", im.NumChunks())
+	}
+	bounds := m.ChunkBoundaries()
+	for _, r := range []struct {
+		off, n      int64
+		first, last int
+	}{
+		{0, 1, 0, 0},
+		{bounds[10], bounds[11] - bounds[10], 10, 10},
+		{bounds[10] - 1, 2, 9, 10},
+		{bounds[20] + 5, bounds[95] - bounds[20], 20, 95},
+		{m.Filesize - 1, 1, 99, 99},
+		{0, m.Filesize, 0, 99},
+	} {
+		pm, start, err := im.ReadRange(r.off, r.n)
+		if err != nil {
+			t.Fatal(err)
+		} else if start != bounds[r.first] {
+			t.Errorf("range [%v, %v): expected start %v, got %v", r.off, r.off+r.n, bounds[r.first], start)
+		}
+		for i := range pm.Shards {
+			var want []SectorSlice
+			for j := r.first; j <= r.last && j < len(m.Shards[i]); j++ {
+				want = append(want, m.Shards[i][j])
+			}
+			if !reflect.DeepEqual(pm.Shards[i], want) {
+				t.Errorf("range [%v, %v): wrong shard records for host %v", r.off, r.off+r.n, i)
+			}
+		}
+		if !reflect.DeepEqual(pm.ChunkHashes(), hashes[r.first:r.last+1]) {
+			t.Errorf("range [%v, %v): wrong chunk hashes", r.off, r.off+r.n)
+		}
+	}
+	if _, _, err := im.ReadRange(m.Filesize, 1); err == nil {
+		t.Fatal("expected out-of-bounds range to be rejected")
+	}
+}
+
+func TestMetaFileSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+	key := ed25519.NewKeyFromSeed(frand.Bytes(32))
+
+	m := NewMetaFile(0660, 100, []hostdb.HostPublicKey{hpk}, 1)
+	m.Shards[0] = []SectorSlice{{MerkleRoot: crypto.Hash{1}, NumSegments: 2}}
+	m.SetMetadata(MetadataMIMEType, "text/plain")
+	if _, err := m.VerifySignature(); err != ErrUnsigned {
+		t.Fatal("expected ErrUnsigned, got", err)
+	}
+	m.Sign(key)
+
+	// signature should survive a round-trip to disk
+	path := filepath.Join(dir, "signed.usa")
+	if err := WriteMetaFile(path, m); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadMetaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if pub, err := read.VerifySignature(); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(pub, key.PublicKey()) {
+		t.Fatal("wrong signer")
+	}
+
+	// any modification should invalidate the signature
+	mods := []func(*MetaFile){
+		func(m *MetaFile) { m.Filesize++ },
+		func(m *MetaFile) { m.MasterKey[0] ^= 1 },
+		func(m *MetaFile) { m.Shards[0][0].NumSegments++ },
+		func(m *MetaFile) { m.SetMetadata(MetadataMIMEType, "image/png") },
+	}
+	for i, mod := range mods {
+		read, _ := ReadMetaFile(path)
+		mod(read)
+		if _, err := read.VerifySignature(); err == nil {
+			t.Fatalf("modification %v did not invalidate signature", i)
+		}
+	}
+}
+
+func TestRedundancyTiers(t *testing.T) {
+	hosts := make([]hostdb.HostPublicKey, 3)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	}
+	m := NewMetaFile(0660, 10000, hosts, 2)
+
+	invalid := [][]RedundancyTier{
+		{{Offset: 0, Length: 128, MinShards: 3}},                                         // lowers redundancy
+		{{Offset: 0, Length: 128, MinShards: 1}, {Offset: 64, Length: 64, MinShards: 1}}, // overlapping
+		{{Offset: 0, Length: 100, MinShards: 1}},                                         // unaligned tier
+		{{Offset: 100, Length: 128, MinShards: 1}},                                       // unaligned gap
+	}
+	for i, tiers := range invalid {
+		if err := m.SetRedundancyTiers(tiers); err == nil {
+			t.Errorf("expected error for invalid tiers %v", i)
+		}
+	}
+	if err := m.SetRedundancyTiers([]RedundancyTier{{Offset: 0, Length: 128, MinShards: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if k, size := m.NextChunk(0); k != 1 || size != 128 {
+		t.Fatalf("wrong first chunk: %v bytes at MinShards %v", size, k)
+	} else if k, size := m.NextChunk(128); k != 2 || size != m.MaxChunkSize() {
+		t.Fatalf("wrong second chunk: %v bytes at MinShards %v", size, k)
+	}
+
+	// 128 bytes at 1-of-3, followed by 9872 bytes at 2-of-3
+	for i := range m.Shards {
+		m.Shards[i] = []SectorSlice{
+			{MerkleRoot: crypto.Hash{1}, NumSegments: 2},
+			{MerkleRoot: crypto.Hash{2}, NumSegments: 78},
+		}
+	}
+	bounds, minShards := m.ChunkLayout()
+	if !reflect.DeepEqual(bounds, []int64{0, 128, 128 + 78*64*2}) || !reflect.DeepEqual(minShards, []int{1, 2}) {
+		t.Fatal("wrong chunk layout:", bounds, minShards)
+	} else if findings := m.Check(nil, false); len(findings) != 0 {
+		t.Fatal("unexpected findings:", findings)
+	}
+
+	// exported tiers should be relative to the exported data
+	if e, err := m.Export(0, 10, hosts); err != nil {
+		t.Fatal(err)
+	} else if tiers := e.RedundancyTiers(); len(tiers) != 1 || tiers[0].Length != 128 {
+		t.Fatal("wrong exported tiers:", tiers)
+	}
+	if e, err := m.Export(200, 10, hosts); err != nil {
+		t.Fatal(err)
+	} else if off, _ := e.ExportOffset(); off != 128 || e.RedundancyTiers() != nil {
+		t.Fatal("wrong exported tiers:", off, e.RedundancyTiers())
+	}
+}
+
+func TestInlineData(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+
+	for _, c := range []Cipher{CipherXChaCha20Poly1305, CipherAES256CTR} {
+		m := NewMetaFile(0660, 0, []hostdb.HostPublicKey{hpk}, 1)
+		m.SetCipher(c)
+		data := frand.Bytes(100)
+		if err := m.SetInlineData(data); err != nil {
+			t.Fatal(err)
+		} else if !m.IsInline() || m.Filesize != 100 {
+			t.Fatal("inline data was not set")
+		}
+		path := filepath.Join(dir, "inline.usa")
+		if err := WriteMetaFile(path, m); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ReadMetaFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inline, err := m.InlineData(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(inline, data) {
+			t.Fatalf("%v: inline data did not round-trip", c)
+		}
+		// data should be trimmed or padded to the filesize
+		m.Filesize = 50
+		if inline, _ := m.InlineData(); !bytes.Equal(inline, data[:50]) {
+			t.Fatal("inline data was not trimmed")
+		}
+		m.Filesize = 150
+		if inline, _ := m.InlineData(); !bytes.Equal(inline, append(data, make([]byte, 50)...)) {
+			t.Fatal("inline data was not padded")
+		}
+		// tampering should be detected
+		sealed, _ := m.Extension(ExtInlineData)
+		sealed[len(sealed)-1] ^= 1
+		if _, err := m.InlineData(); err == nil {
+			t.Fatal("expected error for tampered inline data")
+		}
+	}
+
+	// files with shard data cannot be stored inline
+	m := NewMetaFile(0660, 0, []hostdb.HostPublicKey{hpk}, 1)
+	m.Shards[0] = []SectorSlice{{MerkleRoot: crypto.Hash{1}, NumSegments: 1}}
+	if err := m.SetInlineData([]byte("foo")); err == nil {
+		t.Fatal("expected error when storing data inline in file with shards")
+	}
+}
+
+func TestPlacementPolicy(t *testing.T) {
+	var keys []hostdb.HostPublicKey
+	records := make(map[hostdb.HostPublicKey]hostdb.HostRecord)
+	for i, country := range []string{"DE", "DE", "US"} {
+		hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+		records[hpk] = hostdb.HostRecord{PublicKey: hpk, Location: hostdb.Location{Country: country, ASN: uint32(i)}}
+		keys = append(keys, hpk)
+	}
+	lookup := func(hpk hostdb.HostPublicKey) (hostdb.HostRecord, bool) {
+		hr, ok := records[hpk]
+		return hr, ok
+	}
+
+	m := NewMetaFile(0660, 0, keys[:2], 1)
+	if _, ok := m.PlacementPolicy(); ok {
+		t.Fatal("new metafile should not have a placement policy")
+	}
+	p := PlacementPolicy{
+		Filter:   &hostdb.Filter{Countries: []string{"DE"}},
+		Excluded: []hostdb.HostPublicKey{keys[2]},
+	}
+	if err := m.SetPlacementPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := m.PlacementPolicy()
+	if !ok || p.Filter == nil || len(p.Excluded) != 1 || p.Excluded[0] != keys[2] {
+		t.Fatal("placement policy did not round-trip")
+	}
+
+	tests := []struct {
+		hosts []hostdb.HostPublicKey
+		p     PlacementPolicy
+		valid bool
+	}{
+		{keys[:2], p, true},
+		{keys, p, false},
+		{keys[:2], PlacementPolicy{Diversity: hostdb.DiversityPolicy{MaxPerCountry: 1}}, false},
+		{keys[1:], PlacementPolicy{Diversity: hostdb.DiversityPolicy{MaxPerCountry: 1}}, true},
+		{keys[1:], PlacementPolicy{Pinned: keys[:1]}, false},
+		{keys, PlacementPolicy{Pinned: keys[2:], Filter: p.Filter}, true},
+	}
+	for i, test := range tests {
+		if err := test.p.Check(test.hosts, lookup); (err == nil) != test.valid {
+			t.Errorf("%v: expected valid=%v, got %v", i, test.valid, err)
+		}
+	}
+	if err := p.Check(keys[:2], nil); err == nil {
+		t.Error("expected error when enforcing filter without host records")
+	}
+
+	// invalid policies should be rejected
+	if err := m.SetPlacementPolicy(PlacementPolicy{Pinned: keys[:1], Excluded: keys[:1]}); err == nil {
+		t.Error("expected error for host that is both pinned and excluded")
+	} else if err := m.SetPlacementPolicy(PlacementPolicy{Filter: &hostdb.Filter{MinUptime: 2}}); err == nil {
+		t.Error("expected error for invalid filter")
+	}
+}
+
+func TestMetaFileGarbage(t *testing.T) {
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+	m := NewMetaFile(0660, 0, []hostdb.HostPublicKey{hpk}, 1)
+	if len(m.Garbage()) != 0 {
+		t.Fatal("new metafile should not have garbage")
+	}
+	gs := []GarbageSlice{
+		{Host: hpk, Slice: SectorSlice{MerkleRoot: crypto.Hash{1}, SegmentIndex: 3, NumSegments: 4, Nonce: [24]byte{5}}},
+		{Host: hpk, Slice: SectorSlice{NumSegments: 1}}, // missing chunk; ignored
+		{Host: hpk, Slice: SectorSlice{MerkleRoot: crypto.Hash{2}, NumSegments: 1}},
+	}
+	m.AddGarbage(gs[:2]...)
+	m.AddGarbage(gs[2])
+	if got := m.Garbage(); !reflect.DeepEqual(got, []GarbageSlice{gs[0], gs[2]}) {
+		t.Fatal("garbage did not round-trip:", got)
+	}
+	m.SetGarbage(nil)
+	if _, ok := m.Extension(ExtGarbage); ok {
+		t.Fatal("clearing garbage should remove extension")
+	}
+}
+
+func TestMetaFileTruncate(t *testing.T) {
+	hpk1 := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	hpk2 := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	m := NewMetaFile(0660, renterhost.SectorSize*2+renterhost.SectorSize/2, []hostdb.HostPublicKey{hpk1, hpk2}, 1)
+	for i := range m.Shards {
+		for j := 0; j < 3; j++ {
+			ss := SectorSlice{NumSegments: merkle.SegmentsPerSector}
+			frand.Read(ss.MerkleRoot[:])
+			m.Shards[i] = append(m.Shards[i], ss)
+		}
+		m.Shards[i][2].NumSegments /= 2
+	}
+	m.SetChunkHashes([]crypto.Hash{{1}, {2}, {3}})
+	orig := make([][]SectorSlice, len(m.Shards))
+	for i := range orig {
+		orig[i] = append([]SectorSlice(nil), m.Shards[i]...)
+	}
+
+	if err := m.Truncate(m.Filesize + 1); err == nil {
+		t.Fatal("expected error when extending file")
+	}
+
+	// truncate to the middle of the second chunk
+	if err := m.Truncate(renterhost.SectorSize + renterhost.SectorSize/4 + 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := range m.Shards {
+		if len(m.Shards[i]) != 2 || m.Shards[i][0] != orig[i][0] {
+			t.Fatal("wrong chunks after truncation")
+		} else if ss := m.Shards[i][1]; ss.MerkleRoot != orig[i][1].MerkleRoot || ss.NumSegments != merkle.SegmentsPerSector/4+1 {
+			t.Fatal("second chunk was not trimmed correctly:", ss.NumSegments)
+		}
+	}
+	if hashes := m.ChunkHashes(); len(hashes) != 2 || hashes[0] != (crypto.Hash{1}) || hashes[1] != (crypto.Hash{}) {
+		t.Fatal("chunk hashes were not truncated correctly")
+	}
+	// for each host, the removed part of the second chunk and the third
+	// chunk should be garbage
+	gs := m.Garbage()
+	if len(gs) != 4 {
+		t.Fatalf("expected 4 garbage slices, got %v", len(gs))
+	}
+	for _, g := range gs {
+		i := m.HostIndex(g.Host)
+		switch g.Slice.MerkleRoot {
+		case orig[i][1].MerkleRoot:
+			if g.Slice.SegmentIndex != merkle.SegmentsPerSector/4+1 || g.Slice.NumSegments != merkle.SegmentsPerSector*3/4-1 {
+				t.Fatal("wrong garbage for trimmed chunk")
+			}
+		case orig[i][2].MerkleRoot:
+			if g.Slice != orig[i][2] {
+				t.Fatal("wrong garbage for removed chunk")
+			}
+		default:
+			t.Fatal("unexpected garbage slice")
+		}
+	}
+
+	// truncate to zero
+	if err := m.Truncate(0); err != nil {
+		t.Fatal(err)
+	} else if len(m.Shards[0]) != 0 || len(m.Shards[1]) != 0 || m.Filesize != 0 {
+		t.Fatal("file should be empty")
+	} else if len(m.Garbage()) != 8 {
+		t.Fatal("expected 8 garbage slices, got", len(m.Garbage()))
+	}
+}
+
+func TestMetaFileMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := []hostdb.HostPublicKey{hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())}
+	m := NewMetaFile(0660, 0, hosts, 1)
+
+	if err := m.SetMetadata(MetadataMIMEType, "image/png"); err != nil {
+		t.Fatal(err)
+	} else if err := m.SetMetadata("test.tag", "foo"); err != nil {
+		t.Fatal(err)
+	} else if err := m.SetMetadata("", "foo"); err == nil {
+		t.Fatal("expected empty key to be rejected")
+	} else if err := m.SetMetadata("test.big", strings.Repeat("a", MaxMetadataSize)); err != ErrMetadataTooLarge {
+		t.Fatal("expected ErrMetadataTooLarge, got", err)
+	}
+
+	// metadata should survive a round-trip, a repair, and an export
+	filename := filepath.Join(dir, "foo.usa")
+	if err := WriteMetaFile(filename, m); err != nil {
+		t.Fatal(err)
+	}
+	m, err = ReadMetaFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Shards = nil
+	m.Check(nil, true)
+	m, err = m.Export(0, 0, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := m.Metadata()
+	if len(md) != 2 || md[MetadataMIMEType] != "image/png" || md["test.tag"] != "foo" {
+		t.Fatal("wrong metadata:", md)
+	}
+
+	m.DeleteMetadata("test.tag")
+	m.DeleteMetadata(MetadataMIMEType)
+	if len(m.Metadata()) != 0 {
+		t.Fatal("metadata was not deleted")
+	} else if _, ok := m.Extension(ExtMetadata); ok {
+		t.Fatal("empty metadata should not be stored")
+	}
+}
+
+func TestMetaFileShadow(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "foo.usa")
+
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+	m := NewMetaFile(0660, 100, []hostdb.HostPublicKey{hpk}, 1)
+	m.Shards[0] = []SectorSlice{{MerkleRoot: crypto.Hash{1}, NumSegments: 1}}
+	if err := WriteMetaFileShadowed(filename, m); err != nil {
+		t.Fatal(err)
+	}
+	if m2, rec, err := ReadMetaFileShadowed(filename); err != nil {
+		t.Fatal(err)
+	} else if rec != nil {
+		t.Fatal("metafile should not have needed recovery")
+	} else if !reflect.DeepEqual(m2.Shards, m.Shards) {
+		t.Fatal("metafile did not round-trip")
+	}
+
+	// corrupt the metafile; it should be recovered from the shadow copy
+	if err := ioutil.WriteFile(filename, []byte("garbage"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	m2, rec, err := ReadMetaFileShadowed(filename)
+	if err != nil {
+		t.Fatal(err)
+	} else if rec == nil || rec.Filename != filename || rec.Err == nil {
+		t.Fatal("expected recovery to be reported")
+	} else if !reflect.DeepEqual(m2.Shards, m.Shards) {
+		t.Fatal("recovered metafile does not match original")
+	}
+	// the metafile itself should have been restored
+	if _, err := ReadMetaFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// if both copies are corrupted, an error should be returned
+	shadow, _ := ioutil.ReadFile(filename + ShadowSuffix)
+	shadow[len(shadow)-1] ^= 1
+	ioutil.WriteFile(filename+ShadowSuffix, shadow, 0660)
+	ioutil.WriteFile(filename, []byte("garbage"), 0660)
+	if _, _, err := ReadMetaFileShadowed(filename); err == nil {
+		t.Fatal("expected error when both copies are corrupted")
+	}
+
+	// a missing metafile should not be recovered
+	os.Remove(filename)
+	if _, _, err := ReadMetaFileShadowed(filename); err == nil {
+		t.Fatal("expected error for missing metafile")
+	}
+}
+
+func TestEncryptedMetaFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "foo.usa")
+
+	var seed RenterSeed
+	frand.Read(seed[:])
+	key := seed.MetaFileKey()
+	hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+	m := NewMetaFile(0660, 100, []hostdb.HostPublicKey{hpk}, 1)
+	m.Shards[0] = []SectorSlice{{MerkleRoot: crypto.Hash{1}, NumSegments: 1}}
+
+	// plaintext metafiles should only be readable with a key if explicitly
+	// allowed
+	if err := WriteMetaFile(filename, m); err != nil {
+		t.Fatal(err)
+	} else if _, err := ReadEncryptedMetaFile(filename, &key); err != ErrMetaFileUnencrypted {
+		t.Fatal("expected ErrMetaFileUnencrypted, got", err)
+	} else if m2, err := ReadMaybeEncryptedMetaFile(filename, &key); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(m2.Shards, m.Shards) {
+		t.Fatal("metafile did not round-trip")
+	}
+
+	// encrypt in place
+	if err := EncryptMetaFile(filename, &key); err != nil {
+		t.Fatal(err)
+	} else if enc, err := IsEncryptedMetaFile(filename); err != nil || !enc {
+		t.Fatal("metafile should be encrypted", err)
+	} else if data, _ := ioutil.ReadFile(filename); bytes.Contains(data, m.MasterKey[:]) {
+		t.Fatal("encrypted metafile contains plaintext master key")
+	}
+	if _, err := ReadMetaFile(filename); err != ErrMetaFileEncrypted {
+		t.Fatal("expected ErrMetaFileEncrypted, got", err)
+	} else if _, err := ReadMetaIndex(filename); err != ErrMetaFileEncrypted {
+		t.Fatal("expected ErrMetaFileEncrypted, got", err)
+	} else if _, _, err := ReadMetaFileShadowed(filename); err != ErrMetaFileEncrypted {
+		t.Fatal("expected ErrMetaFileEncrypted, got", err)
+	}
+	m2, err := ReadEncryptedMetaFile(filename, &key)
+	if err != nil {
+		t.Fatal(err)
+	} else if m2.MasterKey != m.MasterKey || !reflect.DeepEqual(m2.Shards, m.Shards) {
+		t.Fatal("metafile did not round-trip")
+	} else if m2, err := ReadMaybeEncryptedMetaFile(filename, &key); err != nil {
+		t.Fatal(err)
+	} else if m2.MasterKey != m.MasterKey {
+		t.Fatal("metafile did not round-trip")
+	}
+	// encrypting again should be a no-op
+	if err := EncryptMetaFile(filename, &key); err != nil {
+		t.Fatal(err)
+	}
+
+	// the wrong key should be rejected
+	wrongKey := MetaFileKey{1}
+	if _, err := ReadEncryptedMetaFile(filename, &wrongKey); err == nil {
+		t.Fatal("expected error with wrong key")
+	} else if err := EncryptMetaFile(filename, &wrongKey); err == nil {
+		t.Fatal("expected error with wrong key")
+	}
+
+	// tampering should be detected
+	data, _ := ioutil.ReadFile(filename)
+	data[len(data)-1] ^= 1
+	ioutil.WriteFile(filename+"_bad", data, 0660)
+	if _, err := ReadEncryptedMetaFile(filename+"_bad", &key); err == nil {
+		t.Fatal("expected error for tampered metafile")
+	}
+
+	// decrypt in place
+	if err := DecryptMetaFile(filename, &key); err != nil {
+		t.Fatal(err)
+	} else if m2, err := ReadMetaFile(filename); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(m2.Shards, m.Shards) {
+		t.Fatal("metafile did not round-trip")
+	}
+
+	// journaled writes
+	files := map[string]*MetaFile{filename: m}
+	if err := WriteEncryptedMetaFiles(filepath.Join(dir, "journal"), files, &key); err != nil {
+		t.Fatal(err)
+	} else if enc, err := IsEncryptedMetaFile(filename); err != nil || !enc {
+		t.Fatal("metafile should be encrypted", err)
+	} else if _, err := ReadEncryptedMetaFile(filename, &key); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+package renter
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/frand"
+)
+
+var (
+	// ErrMetaFileEncrypted is returned when an encrypted metafile is read
+	// without a MetaFileKey.
+	ErrMetaFileEncrypted = errors.New("metafile is encrypted")
+
+	// ErrMetaFileUnencrypted is returned when an unencrypted metafile is read
+	// with a MetaFileKey.
+	ErrMetaFileUnencrypted = errors.New("metafile is not encrypted")
+)
+
+// encryptedMagic identifies an encrypted metafile.
+var encryptedMagic = [8]byte{'u', 's', 'm', 'e', 't', 'a', 'e', 'n'}
+
+// A MetaFileKey encrypts metafiles at rest. Metafiles contain the keys needed
+// to decrypt file data (unless the key is derived or wrapped) and the set of
+// hosts storing it, so a renter may wish to protect them even when the
+// metafiles themselves are stored on an untrusted disk.
+type MetaFileKey [32]byte
+
+// MetaFileKey derives the MetaFileKey associated with s.
+func (s *RenterSeed) MetaFileKey() MetaFileKey {
+	buf := make([]byte, 0, 32+len(s))
+	buf = append(buf, "lukechampine.com/us/renter/metafilekey"...)
+	buf = append(buf, s[:]...)
+	return MetaFileKey(blake2b.Sum256(buf))
+}
+
+// encryptMetaArchive encodes m as a metafile archive and seals it with key.
+func encryptMetaArchive(m *MetaFile, key *MetaFileKey) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeMetaArchive(&buf, m); err != nil {
+		return nil, err
+	}
+	aead, _ := chacha20poly1305.NewX(key[:]) // no error possible
+	data := make([]byte, len(encryptedMagic), len(encryptedMagic)+chacha20poly1305.NonceSizeX+buf.Len()+aead.Overhead())
+	copy(data, encryptedMagic[:])
+	nonce := frand.Bytes(chacha20poly1305.NonceSizeX)
+	data = append(data, nonce...)
+	return aead.Seal(data, nonce, buf.Bytes(), encryptedMagic[:]), nil
+}
+
+// decryptMetaArchive opens an encrypted metafile with key and decodes the
+// archive within it.
+func decryptMetaArchive(data []byte, key *MetaFileKey) (*MetaFile, error) {
+	aead, _ := chacha20poly1305.NewX(key[:]) // no error possible
+	data = data[len(encryptedMagic):]
+	if len(data) < chacha20poly1305.NonceSizeX+aead.Overhead() {
+		return nil, errors.New("encrypted metafile is too short")
+	}
+	nonce, ciphertext := data[:chacha20poly1305.NonceSizeX], data[chacha20poly1305.NonceSizeX:]
+	archive, err := aead.Open(nil, nonce, ciphertext, encryptedMagic[:])
+	if err != nil {
+		return nil, errors.New("could not decrypt metafile: wrong key, or metafile is corrupted")
+	}
+	return decodeMetaArchive(bytes.NewReader(archive))
+}
+
+// IsEncryptedMetaFile reports whether filename is an encrypted metafile.
+func IsEncryptedMetaFile(filename string) (bool, error) {
+	_, err := isIndexedMetaFile(filename)
+	if err == ErrMetaFileEncrypted {
+		return true, nil
+	}
+	return false, err
+}
+
+// WriteEncryptedMetaFile is like WriteMetaFile, but encrypts the metafile
+// archive with key. The MetaIndex, extensions, and shards of m are all
+// encrypted; only the fact that the file is an encrypted metafile, and its
+// approximate size, are revealed.
+func WriteEncryptedMetaFile(filename string, m *MetaFile, key *MetaFileKey) error {
+	data, err := encryptMetaArchive(m, key)
+	if err != nil {
+		return err
+	} else if err := writeFileAtomic(filename, data); err != nil {
+		return errors.Wrap(err, "could not write encrypted metafile")
+	}
+	return nil
+}
+
+// ReadEncryptedMetaFile reads a metafile written by WriteEncryptedMetaFile,
+// decrypting it with key. Unencrypted metafiles are rejected with
+// ErrMetaFileUnencrypted, since anyone able to replace the metafile could
+// otherwise substitute an unauthenticated one.
+func ReadEncryptedMetaFile(filename string, key *MetaFileKey) (*MetaFile, error) {
+	if enc, err := IsEncryptedMetaFile(filename); err != nil {
+		return nil, err
+	} else if !enc {
+		return nil, ErrMetaFileUnencrypted
+	}
+	return readEncryptedMetaFile(filename, key)
+}
+
+// ReadMaybeEncryptedMetaFile is like ReadEncryptedMetaFile, but also reads
+// unencrypted metafiles, as if by ReadMetaFile. It should only be used when
+// unencrypted metafiles are trusted, e.g. while migrating a directory that
+// contains both kinds.
+func ReadMaybeEncryptedMetaFile(filename string, key *MetaFileKey) (*MetaFile, error) {
+	if enc, err := IsEncryptedMetaFile(filename); err != nil {
+		return nil, err
+	} else if !enc {
+		return ReadMetaFile(filename)
+	}
+	return readEncryptedMetaFile(filename, key)
+}
+
+func readEncryptedMetaFile(filename string, key *MetaFileKey) (*MetaFile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read encrypted metafile")
+	}
+	return decryptMetaArchive(data, key)
+}
+
+// EncryptMetaFile encrypts the unencrypted metafile at filename in place
+// with key. Indexed metafiles are converted to the standard archive format.
+// If the metafile is already encrypted, EncryptMetaFile is a no-op, provided
+// that it was encrypted with key.
+func EncryptMetaFile(filename string, key *MetaFileKey) error {
+	m, err := ReadMaybeEncryptedMetaFile(filename, key)
+	if err != nil {
+		return err
+	} else if enc, err := IsEncryptedMetaFile(filename); err != nil || enc {
+		return err
+	}
+	return WriteEncryptedMetaFile(filename, m, key)
+}
+
+// DecryptMetaFile replaces the encrypted metafile at filename with its
+// unencrypted form. If the metafile is not encrypted, DecryptMetaFile is a
+// no-op.
+func DecryptMetaFile(filename string, key *MetaFileKey) error {
+	if enc, err := IsEncryptedMetaFile(filename); err != nil || !enc {
+		return err
+	}
+	m, err := ReadEncryptedMetaFile(filename, key)
+	if err != nil {
+		return err
+	}
+	return WriteMetaFile(filename, m)
+}
@@ -0,0 +1,67 @@
+package renter
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ExtMetadata is a MetaExtension containing arbitrary user metadata, encoded
+// as a JSON object mapping string keys to string values.
+const ExtMetadata MetaExtensionType = 4
+
+// MaxMetadataSize is the maximum encoded size of a metafile's user metadata.
+const MaxMetadataSize = 64 << 10
+
+// Well-known metadata keys. Applications may define their own keys; to avoid
+// collisions, such keys should be prefixed with the name of the application,
+// e.g. "myapp.tag".
+const (
+	MetadataMIMEType = "mime-type" // e.g. "image/png"
+	MetadataModTime  = "mtime"     // RFC 3339 timestamp of the original file
+)
+
+// ErrMetadataTooLarge is returned by SetMetadata when the encoded metadata
+// would exceed MaxMetadataSize.
+var ErrMetadataTooLarge = errors.New("metadata exceeds maximum size")
+
+// Metadata returns m's user metadata. The returned map may be modified
+// freely.
+func (m *MetaFile) Metadata() map[string]string {
+	md := make(map[string]string)
+	if data, ok := m.Extension(ExtMetadata); ok {
+		json.Unmarshal(data, &md)
+	}
+	return md
+}
+
+// SetMetadata sets the user metadata key to value, replacing any existing
+// value.
+func (m *MetaFile) SetMetadata(key, value string) error {
+	if key == "" {
+		return errors.New("metadata key cannot be empty")
+	}
+	md := m.Metadata()
+	md[key] = value
+	return m.setMetadata(md)
+}
+
+// DeleteMetadata removes the user metadata key, if present.
+func (m *MetaFile) DeleteMetadata(key string) {
+	md := m.Metadata()
+	delete(md, key)
+	m.setMetadata(md) // cannot exceed MaxMetadataSize
+}
+
+func (m *MetaFile) setMetadata(md map[string]string) error {
+	if len(md) == 0 {
+		m.RemoveExtension(ExtMetadata)
+		return nil
+	}
+	data, _ := json.Marshal(md) // map keys are sorted, so encoding is deterministic
+	if len(data) > MaxMetadataSize {
+		return ErrMetadataTooLarge
+	}
+	m.SetExtension(ExtMetadata, false, data)
+	return nil
+}
@@ -0,0 +1,139 @@
+package renter
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+const extensionsFilename = "extensions"
+
+// A MetaExtensionType identifies the kind of data stored in a MetaExtension.
+type MetaExtensionType uint16
+
+// supportedExtensions are the MetaExtensionTypes understood by this package.
+// Metafiles containing critical extensions not in this set cannot be read.
+var supportedExtensions = map[MetaExtensionType]bool{}
+
+// extensionValidators check the data of supported extensions whose contents
+// must be well-formed for the metafile to be used safely.
+var extensionValidators = map[MetaExtensionType]func([]byte) error{}
+
+// A MetaExtension is an optional section of a metafile, allowing new features
+// to be added to the format without breaking existing files or readers. If
+// Critical is set, readers that do not understand the extension must refuse
+// to read the metafile; otherwise, unknown extensions are preserved but
+// otherwise ignored.
+type MetaExtension struct {
+	Type     MetaExtensionType
+	Critical bool
+	Data     []byte
+}
+
+// Extension returns the data of the extension with the specified type, if
+// present.
+func (m *MetaFile) Extension(t MetaExtensionType) ([]byte, bool) {
+	for _, ext := range m.Extensions {
+		if ext.Type == t {
+			return ext.Data, true
+		}
+	}
+	return nil, false
+}
+
+// SetExtension adds an extension to m, replacing any existing extension with
+// the same type.
+func (m *MetaFile) SetExtension(t MetaExtensionType, critical bool, data []byte) {
+	m.RemoveExtension(t)
+	m.Extensions = append(m.Extensions, MetaExtension{
+		Type:     t,
+		Critical: critical,
+		Data:     append([]byte(nil), data...),
+	})
+}
+
+// RemoveExtension removes the extension with the specified type, if present.
+func (m *MetaFile) RemoveExtension(t MetaExtensionType) {
+	exts := m.Extensions[:0]
+	for _, ext := range m.Extensions {
+		if ext.Type != t {
+			exts = append(exts, ext)
+		}
+	}
+	m.Extensions = exts
+}
+
+// checkExtensions returns an error if exts contains an unsupported critical
+// extension, or a supported extension with invalid data.
+func checkExtensions(exts []MetaExtension) error {
+	for _, ext := range exts {
+		if ext.Critical && !supportedExtensions[ext.Type] {
+			return errors.Errorf("unsupported critical extension %v", ext.Type)
+		} else if validate, ok := extensionValidators[ext.Type]; ok {
+			if err := validate(ext.Data); err != nil {
+				return errors.Wrapf(err, "invalid extension %v", ext.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// encodedExtensionsSize returns the size of exts when encoded with
+// writeExtensions.
+func encodedExtensionsSize(exts []MetaExtension) int64 {
+	var n int64
+	for _, ext := range exts {
+		n += 7 + int64(len(ext.Data))
+	}
+	return n
+}
+
+// writeExtensions writes exts to w. Each extension is encoded as a
+// type-length-value triple: a 2-byte type, a 1-byte flags field, a 4-byte
+// length, and the extension data, with integers in little-endian order.
+func writeExtensions(w io.Writer, exts []MetaExtension) error {
+	var hdr [7]byte
+	for _, ext := range exts {
+		binary.LittleEndian.PutUint16(hdr[0:], uint16(ext.Type))
+		hdr[2] = 0
+		if ext.Critical {
+			hdr[2] = 1
+		}
+		binary.LittleEndian.PutUint32(hdr[3:], uint32(len(ext.Data)))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		} else if _, err := w.Write(ext.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExtensions reads extensions from r until EOF.
+func readExtensions(r io.Reader) ([]MetaExtension, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var exts []MetaExtension
+	for len(b) > 0 {
+		if len(b) < 7 {
+			return nil, errors.New("truncated extension header")
+		}
+		ext := MetaExtension{
+			Type:     MetaExtensionType(binary.LittleEndian.Uint16(b[0:])),
+			Critical: b[2]&1 != 0,
+		}
+		n := binary.LittleEndian.Uint32(b[3:])
+		b = b[7:]
+		if uint64(n) > uint64(len(b)) {
+			return nil, errors.New("truncated extension data")
+		}
+		ext.Data = append([]byte(nil), b[:n]...)
+		b = b[n:]
+		exts = append(exts, ext)
+	}
+	return exts, nil
+}
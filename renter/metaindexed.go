@@ -0,0 +1,377 @@
+package renter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// indexedMagic identifies an indexed metafile.
+var indexedMagic = [8]byte{'u', 's', 'm', 'e', 't', 'a', 'i', 'x'}
+
+// An indexed metafile is an uncompressed alternative to the gzipped tar
+// archive written by WriteMetaFile. Its layout permits the shard records of a
+// particular range of the file to be located and read without reading the
+// rest of the metafile. All integers are little-endian.
+//
+// The file begins with indexedMagic, followed by a 4-byte length and the
+// JSON-encoded MetaIndex, and a 4-byte length and the encoded extensions (see
+// writeExtensions). Next come the 8-byte number of chunks, C, and the 8-byte
+// length of each shard, in the order of MetaIndex.Hosts. Next is the chunk
+// table: C+1 8-byte offsets, where chunk i spans [offset[i], offset[i+1])
+// within the file. Last come the shard records, stored chunk-major: the
+// SectorSlices of chunk i are stored at offset i*len(Hosts)*SectorSliceSize
+// within the records section, in host order. Records beyond the end of a
+// shard are zeroed.
+
+// WriteIndexedMetaFile writes m to filename as an indexed metafile. Like
+// WriteMetaFile, the write is atomic, and the file is always written using
+// the current MetaFileVersion.
+func WriteIndexedMetaFile(filename string, m *MetaFile) error {
+	if err := writeIndexedMetaFile(filename+"_tmp", m); err != nil {
+		return err
+	} else if err := os.Rename(filename+"_tmp", filename); err != nil {
+		return errors.Wrap(err, "could not atomically replace indexed metafile")
+	} else if err := syncDir(filepath.Dir(filename)); err != nil {
+		return errors.Wrap(err, "could not sync metafile directory")
+	}
+	return nil
+}
+
+func writeIndexedMetaFile(filename string, m *MetaFile) error {
+	if err := validateShards(m.Shards); err != nil {
+		return errors.Wrap(err, "invalid shards")
+	}
+	index := m.MetaIndex
+	index.Version = MetaFileVersion
+	if m.keyOmitted() {
+		index.MasterKey = KeySeed{} // see DeriveKey and UnwrapKey
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrap(err, "could not create indexed metafile")
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	var buf [8]byte
+	writeUint32 := func(n int) {
+		binary.LittleEndian.PutUint32(buf[:], uint32(n))
+		w.Write(buf[:4])
+	}
+	writeUint64 := func(n int64) {
+		binary.LittleEndian.PutUint64(buf[:], uint64(n))
+		w.Write(buf[:8])
+	}
+
+	w.Write(indexedMagic[:])
+	indexJSON, _ := json.Marshal(index)
+	writeUint32(len(indexJSON))
+	w.Write(indexJSON)
+	writeUint32(int(encodedExtensionsSize(m.Extensions)))
+	writeExtensions(w, m.Extensions)
+
+	bounds := m.ChunkBoundaries()
+	writeUint64(int64(len(bounds) - 1))
+	for _, shard := range m.Shards {
+		writeUint64(int64(len(shard)))
+	}
+	for _, b := range bounds {
+		writeUint64(b)
+	}
+	var enc [SectorSliceSize]byte
+	for chunk := 0; chunk < len(bounds)-1; chunk++ {
+		for _, shard := range m.Shards {
+			var ss SectorSlice
+			if chunk < len(shard) {
+				ss = shard[chunk]
+			}
+			encodeSectorSlice(enc[:], ss)
+			w.Write(enc[:])
+		}
+	}
+
+	// bufio.Writer retains the first error, so it suffices to check Flush
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "could not write indexed metafile")
+	} else if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "could not sync indexed metafile")
+	} else if err := f.Close(); err != nil {
+		return errors.Wrap(err, "could not close indexed metafile")
+	}
+	return nil
+}
+
+// isIndexedMetaFile reports whether filename is an indexed metafile. If
+// filename is an encrypted metafile, it returns ErrMetaFileEncrypted.
+func isIndexedMetaFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, errors.Wrap(err, "could not open metafile")
+	}
+	defer f.Close()
+	var magic [8]byte
+	if _, err := io.ReadFull(f, magic[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "could not read metafile")
+	} else if magic == encryptedMagic {
+		return false, ErrMetaFileEncrypted
+	}
+	return magic == indexedMagic, nil
+}
+
+// An IndexedMetaFile is an open indexed metafile. Only its index and
+// extensions are held in memory; shard records are read on demand.
+type IndexedMetaFile struct {
+	MetaIndex
+	Extensions []MetaExtension
+
+	f            *os.File
+	numChunks    int64
+	shardLens    []int64
+	boundsOffset int64
+	slicesOffset int64
+}
+
+// NumChunks returns the number of chunks in the metafile.
+func (im *IndexedMetaFile) NumChunks() int64 {
+	return im.numChunks
+}
+
+// Close closes the underlying file.
+func (im *IndexedMetaFile) Close() error {
+	return im.f.Close()
+}
+
+func (im *IndexedMetaFile) readUint64s(off int64, n int64) ([]uint64, error) {
+	buf := make([]byte, n*8)
+	if _, err := im.f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	ns := make([]uint64, n)
+	for i := range ns {
+		ns[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	return ns, nil
+}
+
+// chunkBounds returns the file offsets of chunks [start, end], inclusive.
+func (im *IndexedMetaFile) chunkBounds(start, end int64) ([]uint64, error) {
+	return im.readUint64s(im.boundsOffset+start*8, end-start+1)
+}
+
+// findChunk returns the index of the chunk containing file offset off,
+// performing a binary search over the on-disk chunk table.
+func (im *IndexedMetaFile) findChunk(off int64) (int64, error) {
+	var err error
+	i := sort.Search(int(im.numChunks), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var b []uint64
+		b, err = im.chunkBounds(int64(i)+1, int64(i)+1)
+		return err == nil && int64(b[0]) > off
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read chunk table")
+	}
+	return int64(i), nil
+}
+
+// ReadRange loads the shard records of the chunks overlapping the range [off,
+// off+n) of the file. The returned MetaFile references only those chunks;
+// its Filesize is the number of file bytes they contain, and start is the
+// offset of the first chunk within the original file. If the metafile
+// contains an integrity manifest, it is narrowed to the same chunks.
+func (im *IndexedMetaFile) ReadRange(off, n int64) (m *MetaFile, start int64, err error) {
+	if off < 0 || n < 0 || off+n > im.Filesize {
+		return nil, 0, errors.New("range is out of bounds")
+	}
+	first, err := im.findChunk(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	last := first
+	if n > 0 {
+		if last, err = im.findChunk(off + n - 1); err != nil {
+			return nil, 0, err
+		}
+	}
+	if last >= im.numChunks {
+		last = im.numChunks - 1
+	}
+	return im.readChunks(first, last+1)
+}
+
+// ReadAll loads the entire metafile into memory.
+func (im *IndexedMetaFile) ReadAll() (*MetaFile, error) {
+	m, _, err := im.readChunks(0, im.numChunks)
+	if err != nil {
+		return nil, err
+	}
+	m.Filesize = im.Filesize // the file may not be fully uploaded
+	return m, nil
+}
+
+// readChunks loads the shard records of chunks [first, end).
+func (im *IndexedMetaFile) readChunks(first, end int64) (*MetaFile, int64, error) {
+	m := &MetaFile{
+		MetaIndex:  im.MetaIndex,
+		Shards:     make([][]SectorSlice, len(im.Hosts)),
+		Extensions: append([]MetaExtension(nil), im.Extensions...),
+	}
+	m.Hosts = append(m.Hosts[:0:0], im.Hosts...)
+	if first >= end {
+		m.Filesize = 0
+		return m, 0, nil
+	}
+	bounds, err := im.chunkBounds(first, end)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not read chunk table")
+	}
+	start := int64(bounds[0])
+	if fileEnd := int64(bounds[len(bounds)-1]); fileEnd < im.Filesize {
+		m.Filesize = fileEnd - start
+	} else {
+		m.Filesize = im.Filesize - start
+	}
+
+	recordSize := int64(len(im.Hosts)) * SectorSliceSize
+	buf := make([]byte, (end-first)*recordSize)
+	if _, err := im.f.ReadAt(buf, im.slicesOffset+first*recordSize); err != nil {
+		return nil, 0, errors.Wrap(err, "could not read shard records")
+	}
+	for chunk := first; chunk < end; chunk++ {
+		rec := buf[(chunk-first)*recordSize:]
+		for i := range m.Shards {
+			if chunk < im.shardLens[i] {
+				m.Shards[i] = append(m.Shards[i], decodeSectorSlice(rec[i*SectorSliceSize:]))
+			}
+		}
+	}
+	if err := validateShards(m.Shards); err != nil {
+		return nil, 0, errors.Wrap(err, "invalid shards")
+	}
+
+	if hashes := m.ChunkHashes(); len(hashes) > 0 && (first > 0 || int64(len(hashes)) > end) {
+		if int64(len(hashes)) > end {
+			hashes = hashes[:end]
+		}
+		if int64(len(hashes)) > first {
+			hashes = hashes[first:]
+		} else {
+			hashes = nil
+		}
+		m.SetChunkHashes(hashes)
+	}
+	return m, start, nil
+}
+
+// readIndexedMetaFileShards is the indexed counterpart of readMetaFileShards.
+// Since the chunk table records the extent of each chunk, shard sizes can be
+// computed without reading any shard records.
+func readIndexedMetaFileShards(filename string) (MetaIndex, int, error) {
+	im, err := OpenIndexedMetaFile(filename)
+	if err != nil {
+		return MetaIndex{}, 0, err
+	}
+	defer im.Close()
+	shardSizes := make([]int64, len(im.shardLens))
+	for i, n := range im.shardLens {
+		b, err := im.chunkBounds(n, n)
+		if err != nil {
+			return MetaIndex{}, 0, errors.Wrap(err, "could not read chunk table")
+		}
+		shardSizes[i] = int64(b[0]) / int64(im.MinShards)
+	}
+	return im.MetaIndex, countFullShards(im.MetaIndex, shardSizes), nil
+}
+
+// OpenIndexedMetaFile opens an indexed metafile, reading its index and
+// extensions. As with ReadMetaFile, older versions of the format are upgraded
+// to MetaFileVersion in memory.
+func OpenIndexedMetaFile(filename string) (*IndexedMetaFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open indexed metafile")
+	}
+	im, err := readIndexedHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return im, nil
+}
+
+func readIndexedHeader(f *os.File) (*IndexedMetaFile, error) {
+	r := bufio.NewReader(f)
+	var magic [8]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, errors.Wrap(err, "could not read header")
+	} else if magic != indexedMagic {
+		return nil, errors.New("not an indexed metafile")
+	}
+	var buf [8]byte
+	readSection := func() ([]byte, error) {
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return nil, err
+		}
+		b := make([]byte, binary.LittleEndian.Uint32(buf[:4]))
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	readUint64 := func() (int64, error) {
+		_, err := io.ReadFull(r, buf[:8])
+		return int64(binary.LittleEndian.Uint64(buf[:8])), err
+	}
+
+	im := &IndexedMetaFile{f: f}
+	indexJSON, err := readSection()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read index")
+	} else if err := json.Unmarshal(indexJSON, &im.MetaIndex); err != nil {
+		return nil, errors.Wrap(err, "could not decode index")
+	} else if err := im.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid index")
+	}
+	im.Version = MetaFileVersion
+	extData, err := readSection()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read extensions")
+	} else if im.Extensions, err = readExtensions(bytes.NewReader(extData)); err != nil {
+		return nil, errors.Wrap(err, "could not read extensions")
+	} else if err := checkExtensions(im.Extensions); err != nil {
+		return nil, err
+	}
+	if im.numChunks, err = readUint64(); err != nil {
+		return nil, errors.Wrap(err, "could not read chunk count")
+	}
+	im.shardLens = make([]int64, len(im.Hosts))
+	for i := range im.shardLens {
+		if im.shardLens[i], err = readUint64(); err != nil {
+			return nil, errors.Wrap(err, "could not read shard lengths")
+		} else if im.shardLens[i] > im.numChunks {
+			return nil, errors.New("shard is longer than chunk table")
+		}
+	}
+	im.boundsOffset = int64(len(magic)) + 4 + int64(len(indexJSON)) + 4 + int64(len(extData)) + 8 + 8*int64(len(im.Hosts))
+	im.slicesOffset = im.boundsOffset + 8*(im.numChunks+1)
+
+	// sanity-check the file size, so that ReadRange can trust the header
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not stat indexed metafile")
+	} else if want := im.slicesOffset + im.numChunks*int64(len(im.Hosts))*SectorSliceSize; stat.Size() != want {
+		return nil, errors.Errorf("indexed metafile has wrong size (%v, want %v)", stat.Size(), want)
+	}
+	return im, nil
+}
@@ -0,0 +1,258 @@
+package renter
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/frand"
+)
+
+// ErrMetaFileLocked is returned by LockMetaFile and RLockMetaFile when the
+// metafile is already locked in a conflicting mode.
+var ErrMetaFileLocked = errors.New("metafile is locked")
+
+// staleLockAge is the age beyond which a lock file that has not been
+// refreshed is considered stale. Lock holders refresh their lock files well
+// within this interval.
+var staleLockAge = time.Minute
+
+// lockInfo is the content of a metafile lock file.
+type lockInfo struct {
+	ID       string    `json:"id"`
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Time     time.Time `json:"time"`
+}
+
+// A MetaFileLock is an advisory lock on a metafile, held either exclusively
+// (by one writer) or shared (by any number of readers). Like ContractLock,
+// the lock is only advisory: it protects the metafile from interleaved
+// updates by cooperating processes (and goroutines), but does not prevent
+// the metafile from being accessed directly.
+//
+// Locks are implemented as files alongside the metafile, so that they work
+// on any filesystem. A lock file is considered stale, and is removed, if the
+// process that created it is no longer running, or if it has not been
+// refreshed recently (e.g. because it was created on another machine that
+// crashed). Lock holders refresh their lock files automatically until they
+// are unlocked.
+type MetaFileLock struct {
+	path string
+	id   string
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Unlock releases the lock.
+func (l *MetaFileLock) Unlock() error {
+	close(l.stop)
+	l.wg.Wait()
+	// if our lock was mistakenly considered stale, the lock file may now
+	// belong to someone else
+	if info, _, err := readLockFile(l.path); err != nil || info.ID != l.id {
+		return nil
+	}
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not remove lock file")
+	}
+	return nil
+}
+
+func (l *MetaFileLock) refresh() {
+	defer l.wg.Done()
+	t := time.NewTicker(staleLockAge / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-t.C:
+			os.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+// IsMetaFileLock returns true if name is the name of a file used to lock a
+// metafile (see MetaFileLock). Such files should be ignored when listing a
+// directory of metafiles.
+func IsMetaFileLock(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".lock" || strings.HasPrefix(ext, ".rlock-") || strings.HasPrefix(ext, ".stale-")
+}
+
+func exclusiveLockPath(filename string) string {
+	return filename + ".lock"
+}
+
+func sharedLockPrefix(filename string) string {
+	return filepath.Base(filename) + ".rlock-"
+}
+
+// sharedLockPaths returns the paths of the shared lock files of filename.
+func sharedLockPaths(filename string) ([]string, error) {
+	dir := filepath.Dir(filename)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := sharedLockPrefix(filename)
+	var paths []string
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), prefix) {
+			paths = append(paths, filepath.Join(dir, info.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// createLockFile atomically creates a lock file at path, returning
+// ErrMetaFileLocked if it already exists.
+func createLockFile(path string) (*MetaFileLock, error) {
+	hostname, _ := os.Hostname()
+	info := lockInfo{
+		ID:       hex.EncodeToString(frand.Bytes(8)),
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Time:     time.Now(),
+	}
+	js, _ := json.Marshal(info)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0660)
+	if os.IsExist(err) {
+		return nil, ErrMetaFileLocked
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not create lock file")
+	}
+	if _, err := f.Write(js); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, errors.Wrap(err, "could not write lock file")
+	} else if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, errors.Wrap(err, "could not write lock file")
+	}
+	l := &MetaFileLock{
+		path: path,
+		id:   info.ID,
+		stop: make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.refresh()
+	return l, nil
+}
+
+// readLockFile reads the lock file at path, reporting whether it is stale.
+func readLockFile(path string) (info lockInfo, stale bool, err error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return lockInfo{}, false, err
+	}
+	js, err := ioutil.ReadFile(path)
+	if err != nil {
+		return lockInfo{}, false, err
+	}
+	if json.Unmarshal(js, &info) != nil {
+		// the lock file may still be being written; only consider it stale
+		// once it is old
+		return lockInfo{}, time.Since(stat.ModTime()) > staleLockAge, nil
+	}
+	hostname, _ := os.Hostname()
+	if info.Hostname == hostname && !processExists(info.PID) {
+		return info, true, nil
+	}
+	return info, time.Since(stat.ModTime()) > staleLockAge, nil
+}
+
+// lockHeld returns true if a non-stale lock file for filename exists at path.
+// Stale lock files are removed.
+func lockHeld(filename, path string) (bool, error) {
+	info, stale, err := readLockFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "could not read lock file")
+	} else if !stale {
+		return true, nil
+	}
+
+	// Another process may remove the same stale lock file and replace it
+	// with a new one before we remove it. To avoid deleting the new lock,
+	// move the file aside first, and restore it if it is not the one we
+	// examined.
+	tmp := filename + ".stale-" + hex.EncodeToString(frand.Bytes(8))
+	if err := os.Rename(path, tmp); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "could not remove stale lock file")
+	}
+	defer os.Remove(tmp)
+	if moved, _, err := readLockFile(tmp); err == nil && moved.ID != info.ID {
+		if os.Link(tmp, path) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LockMetaFile acquires an exclusive lock on the specified metafile. It does
+// not block; if the metafile is already locked, it returns
+// ErrMetaFileLocked.
+func LockMetaFile(filename string) (*MetaFileLock, error) {
+	path := exclusiveLockPath(filename)
+	if _, err := lockHeld(filename, path); err != nil {
+		return nil, err
+	}
+	l, err := createLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// a reader may have acquired a shared lock before we created our lock
+	// file; if so, back off
+	shared, err := sharedLockPaths(filename)
+	if err != nil {
+		l.Unlock()
+		return nil, errors.Wrap(err, "could not read shared locks")
+	}
+	for _, path := range shared {
+		if held, err := lockHeld(filename, path); err != nil || held {
+			l.Unlock()
+			if err == nil {
+				err = ErrMetaFileLocked
+			}
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// RLockMetaFile acquires a shared lock on the specified metafile. It does not
+// block; if the metafile is already locked exclusively, it returns
+// ErrMetaFileLocked.
+func RLockMetaFile(filename string) (*MetaFileLock, error) {
+	if held, err := lockHeld(filename, exclusiveLockPath(filename)); err != nil {
+		return nil, err
+	} else if held {
+		return nil, ErrMetaFileLocked
+	}
+	path := filepath.Join(filepath.Dir(filename), sharedLockPrefix(filename)+hex.EncodeToString(frand.Bytes(8)))
+	l, err := createLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// a writer may have acquired an exclusive lock before we created our
+	// lock file; if so, back off
+	if held, err := lockHeld(filename, exclusiveLockPath(filename)); err != nil || held {
+		l.Unlock()
+		if err == nil {
+			err = ErrMetaFileLocked
+		}
+		return nil, err
+	}
+	return l, nil
+}
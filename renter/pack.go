@@ -0,0 +1,151 @@
+package renter
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+// A Packer packs the data of many small files into shared sectors, so that
+// each file does not consume a full sector on each host. Each file's shards
+// reference a contiguous extent of the shared sectors via a SectorSlice.
+//
+// All files added to a Packer must use the same set of hosts, in the same
+// order, and the same MinShards.
+type Packer struct {
+	hosts     []hostdb.HostPublicKey
+	minShards int
+	upload    func(hostdb.HostPublicKey, *[renterhost.SectorSize]byte) (crypto.Hash, error)
+	sectors   []SectorBuilder
+	pending   []packedFile
+}
+
+type packedFile struct {
+	m          *MetaFile
+	sliceIndex int // index within (SectorBuilder).Slices()
+	hash       crypto.Hash
+}
+
+// Pending returns the number of files that have been added to the Packer but
+// not yet uploaded.
+func (p *Packer) Pending() int {
+	return len(p.pending)
+}
+
+func (p *Packer) compatible(m *MetaFile) bool {
+	if m.MinShards != p.minShards || len(m.Hosts) != len(p.hosts) {
+		return false
+	}
+	for i := range m.Hosts {
+		if m.Hosts[i] != p.hosts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Add encodes data as the contents of m and packs the resulting shards into
+// the shared sectors, flushing them first if they are full. m's Shards are
+// not updated until the sectors are uploaded, by Add or Flush. data must not
+// exceed m.MaxChunkSize().
+func (p *Packer) Add(m *MetaFile, data []byte) error {
+	if !p.compatible(m) {
+		return errors.New("metafile hosts and redundancy do not match packer")
+	} else if int64(len(data)) > m.MaxChunkSize() {
+		return errors.New("data is too large to pack")
+	}
+	numChunks := (int64(len(data)) + m.MinChunkSize() - 1) / m.MinChunkSize()
+	if numChunks == 0 {
+		numChunks = 1
+	}
+	shardSize := int(numChunks) * merkle.SegmentSize
+	if shardSize > p.sectors[0].Remaining() {
+		if err := p.Flush(); err != nil {
+			return err
+		}
+	}
+
+	shards := make([][]byte, len(p.hosts))
+	for i := range shards {
+		shards[i] = p.sectors[i].SliceForAppend()
+	}
+	m.ErasureCode().Encode(data, shards)
+	// hash the chunk as it will be recovered, i.e. including padding; this
+	// must happen before the shards are encrypted in place
+	var chunk bytes.Buffer
+	if err := m.ErasureCode().Recover(&chunk, shards, 0, shardSize*m.MinShards); err != nil {
+		return err
+	}
+	var sliceIndex int
+	for i := range shards {
+		sliceIndex = p.sectors[i].Append(shards[i], m.MasterKey, m.Cipher())
+	}
+	m.Filesize = int64(len(data))
+	p.pending = append(p.pending, packedFile{m, sliceIndex, HashChunk(chunk.Bytes())})
+	return nil
+}
+
+// Flush uploads the shared sectors to their respective hosts and sets the
+// Shards of each pending file. If any upload fails, the files remain pending,
+// and Flush may be retried.
+func (p *Packer) Flush() error {
+	if len(p.pending) == 0 {
+		return nil
+	}
+
+	errChan := make(chan *uploadError, len(p.hosts))
+	for i, hostKey := range p.hosts {
+		go func(hostKey hostdb.HostPublicKey, sb *SectorBuilder) {
+			root, err := p.upload(hostKey, sb.Finish())
+			if err != nil {
+				errChan <- &uploadError{hostKey, err}
+				return
+			}
+			sb.SetMerkleRoot(root)
+			errChan <- nil
+		}(hostKey, &p.sectors[i])
+	}
+	var firstErr *uploadError
+	for range p.hosts {
+		if err := <-errChan; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return errors.Wrapf(firstErr.err, "%v: could not upload packed sector", firstErr.hostKey.ShortKey())
+	}
+
+	for _, pf := range p.pending {
+		for i := range p.hosts {
+			pf.m.Shards[i] = []SectorSlice{p.sectors[i].Slices()[pf.sliceIndex]}
+		}
+		pf.m.SetChunkHashes([]crypto.Hash{pf.hash})
+	}
+	for i := range p.sectors {
+		p.sectors[i].Reset()
+	}
+	p.pending = p.pending[:0]
+	return nil
+}
+
+type uploadError struct {
+	hostKey hostdb.HostPublicKey
+	err     error
+}
+
+// NewPacker returns a Packer that packs files stored on the specified hosts
+// with the specified redundancy. The upload function is called to upload each
+// sector once it is full, or when Flush is called, and must return the Merkle
+// root of the uploaded sector; typically it calls proto.Session.Append.
+func NewPacker(hosts []hostdb.HostPublicKey, minShards int, upload func(hostdb.HostPublicKey, *[renterhost.SectorSize]byte) (crypto.Hash, error)) *Packer {
+	return &Packer{
+		hosts:     append([]hostdb.HostPublicKey(nil), hosts...),
+		minShards: minShards,
+		upload:    upload,
+		sectors:   make([]SectorBuilder, len(hosts)),
+	}
+}
@@ -0,0 +1,88 @@
+package renter
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestPacker(t *testing.T) {
+	hosts := make([]hostdb.HostPublicKey, 3)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	}
+	stored := make(map[crypto.Hash][]byte)
+	var uploads int
+	fail := false
+	p := NewPacker(hosts, 2, func(hostKey hostdb.HostPublicKey, sector *[renterhost.SectorSize]byte) (crypto.Hash, error) {
+		if fail {
+			return crypto.Hash{}, errors.New("host is offline")
+		}
+		uploads++
+		root := merkle.SectorRoot(sector)
+		stored[root] = append([]byte(nil), sector[:]...)
+		return root, nil
+	})
+
+	// pack many small files
+	files := make([]*MetaFile, 100)
+	contents := make([][]byte, len(files))
+	for i := range files {
+		files[i] = NewMetaFile(0660, 0, hosts, 2)
+		contents[i] = frand.Bytes(1 + frand.Intn(1000))
+		if err := p.Add(files[i], contents[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.Pending() != len(files) {
+		t.Fatal("expected all files to be pending")
+	}
+
+	// a failed flush leaves the files pending
+	fail = true
+	if err := p.Flush(); err == nil {
+		t.Fatal("expected flush to fail")
+	} else if p.Pending() != len(files) {
+		t.Fatal("expected files to remain pending")
+	}
+	fail = false
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	} else if uploads != len(hosts) {
+		t.Fatal("expected one sector per host, got", uploads)
+	}
+
+	// each file should be recoverable from the shared sectors
+	for i, m := range files {
+		shards := make([][]byte, len(hosts))
+		for j := range shards {
+			ss := m.Shards[j][0]
+			sector := stored[ss.MerkleRoot]
+			start := ss.SegmentIndex * merkle.SegmentSize
+			shard := append([]byte(nil), sector[start:][:ss.NumSegments*merkle.SegmentSize]...)
+			m.Cipher().XORKeyStream(&m.MasterKey, shard, ss.Nonce[:], uint64(ss.SegmentIndex))
+			shards[j] = shard
+		}
+		shards[0] = shards[0][:0] // simulate a missing shard
+		var buf bytes.Buffer
+		if err := m.ErasureCode().Recover(&buf, shards, 0, len(shards[1])*m.MinShards); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes()[:m.Filesize], contents[i]) {
+			t.Fatal("recovered data does not match for file", i)
+		} else if hashes := m.ChunkHashes(); len(hashes) != 1 || HashChunk(buf.Bytes()) != hashes[0] {
+			t.Fatal("recovered data does not match integrity manifest for file", i)
+		}
+	}
+
+	// incompatible metafiles are rejected
+	if err := p.Add(NewMetaFile(0660, 0, hosts, 1), []byte("foo")); err == nil {
+		t.Fatal("expected incompatible metafile to be rejected")
+	}
+}
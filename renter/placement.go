@@ -0,0 +1,181 @@
+package renter
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/hostdb"
+)
+
+// ExtPlacementPolicy is a critical MetaExtension containing the file's
+// PlacementPolicy, encoded as JSON. It is critical so that clients unaware of
+// the policy cannot migrate the file in violation of it.
+const ExtPlacementPolicy MetaExtensionType = 12
+
+func init() {
+	supportedExtensions[ExtPlacementPolicy] = true
+}
+
+// A HostLookup returns the HostRecord of a host, if known. Typically it is
+// the Host method of a hostdb.Scanner.
+type HostLookup func(hostdb.HostPublicKey) (hostdb.HostRecord, bool)
+
+// A PlacementPolicy constrains which hosts may store a file's shards. Unlike
+// the parameters used to select hosts initially, a PlacementPolicy is stored
+// in the metafile, so that it is honored by later uploads and migrations
+// (e.g. to keep data within a particular jurisdiction).
+type PlacementPolicy struct {
+	// Filter, if non-nil, must be matched by every host.
+	Filter *hostdb.Filter `json:"filter,omitempty"`
+	// Diversity limits the number of hosts in any one network or
+	// jurisdiction.
+	Diversity hostdb.DiversityPolicy `json:"diversity"`
+	// Pinned hosts must always be among the file's hosts. They are exempt
+	// from Filter and Diversity, and are never migrated away from.
+	Pinned []hostdb.HostPublicKey `json:"pinned,omitempty"`
+	// Excluded hosts may never store the file's shards.
+	Excluded []hostdb.HostPublicKey `json:"excluded,omitempty"`
+}
+
+func containsHost(hosts []hostdb.HostPublicKey, h hostdb.HostPublicKey) bool {
+	for _, host := range hosts {
+		if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// needsLookup returns true if enforcing p requires host records.
+func (p PlacementPolicy) needsLookup() bool {
+	return p.Filter != nil || p.Diversity != (hostdb.DiversityPolicy{})
+}
+
+// IsPinned returns true if h is pinned by p.
+func (p PlacementPolicy) IsPinned(h hostdb.HostPublicKey) bool {
+	return containsHost(p.Pinned, h)
+}
+
+// Permits returns true if h may store the file's shards, disregarding
+// p.Diversity. Hosts with no record are not permitted if p has a Filter.
+func (p PlacementPolicy) Permits(h hostdb.HostPublicKey, lookup HostLookup) bool {
+	if p.IsPinned(h) {
+		return true
+	} else if containsHost(p.Excluded, h) {
+		return false
+	} else if p.Filter == nil {
+		return true
+	}
+	if lookup == nil {
+		return false
+	}
+	hr, ok := lookup(h)
+	return ok && p.Filter.Match(hr)
+}
+
+// CanAdd returns true if h may be added to hosts without violating p. Pinned
+// hosts can always be added.
+func (p PlacementPolicy) CanAdd(hosts []hostdb.HostPublicKey, h hostdb.HostPublicKey, lookup HostLookup) bool {
+	if p.IsPinned(h) {
+		return true
+	} else if !p.Permits(h, lookup) {
+		return false
+	} else if p.Diversity == (hostdb.DiversityPolicy{}) || lookup == nil {
+		return true
+	}
+	hr, ok := lookup(h)
+	if !ok {
+		return true // unknown location
+	}
+	loc := hr.Location
+	var countries, asns, providers int
+	for _, host := range hosts {
+		if other, ok := lookup(host); ok {
+			if loc.Country != "" && other.Country == loc.Country {
+				countries++
+			}
+			if loc.ASN != 0 && other.ASN == loc.ASN {
+				asns++
+			}
+			if loc.Provider != "" && other.Provider == loc.Provider {
+				providers++
+			}
+		}
+	}
+	exceeds := func(count, max int) bool {
+		return max > 0 && count >= max
+	}
+	d := p.Diversity
+	return !exceeds(countries, d.MaxPerCountry) && !exceeds(asns, d.MaxPerASN) && !exceeds(providers, d.MaxPerProvider)
+}
+
+// Check returns an error if hosts violate p. If p has a Filter or Diversity
+// policy, lookup must be non-nil.
+func (p PlacementPolicy) Check(hosts []hostdb.HostPublicKey, lookup HostLookup) error {
+	if p.needsLookup() && lookup == nil {
+		return errors.New("placement policy cannot be enforced without host records")
+	}
+	for _, h := range p.Pinned {
+		if !containsHost(hosts, h) {
+			return errors.Errorf("pinned host %v is not among the file's hosts", h.ShortKey())
+		}
+	}
+	for i, h := range hosts {
+		if !p.Permits(h, lookup) {
+			return errors.Errorf("host %v is not permitted by placement policy", h.ShortKey())
+		} else if !p.CanAdd(hosts[:i], h, lookup) {
+			return errors.Errorf("host %v violates placement diversity policy", h.ShortKey())
+		}
+	}
+	return nil
+}
+
+func (p PlacementPolicy) validate() error {
+	for _, h := range p.Pinned {
+		if containsHost(p.Excluded, h) {
+			return errors.Errorf("host %v is both pinned and excluded", h.ShortKey())
+		}
+	}
+	if p.Filter != nil {
+		js, _ := json.Marshal(p.Filter)
+		if _, err := hostdb.ParseFilter(js); err != nil {
+			return err
+		}
+	}
+	d := p.Diversity
+	if d.MaxPerCountry < 0 || d.MaxPerASN < 0 || d.MaxPerProvider < 0 {
+		return errors.New("diversity limits cannot be negative")
+	}
+	return nil
+}
+
+// PlacementPolicy returns m's placement policy, if it has one.
+func (m *MetaFile) PlacementPolicy() (PlacementPolicy, bool) {
+	data, ok := m.Extension(ExtPlacementPolicy)
+	if !ok {
+		return PlacementPolicy{}, false
+	}
+	var p PlacementPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		// an unreadable policy must not be silently ignored; exclude every
+		// host instead
+		return PlacementPolicy{Filter: &hostdb.Filter{Not: &hostdb.Filter{}}}, true
+	}
+	return p, true
+}
+
+// SetPlacementPolicy sets m's placement policy. The policy is not checked
+// against m's current hosts; use PlacementPolicy.Check for that.
+func (m *MetaFile) SetPlacementPolicy(p PlacementPolicy) error {
+	if err := p.validate(); err != nil {
+		return errors.Wrap(err, "invalid placement policy")
+	}
+	data, _ := json.Marshal(p)
+	m.SetExtension(ExtPlacementPolicy, true, data)
+	return nil
+}
+
+// RemovePlacementPolicy removes m's placement policy, if present.
+func (m *MetaFile) RemovePlacementPolicy() {
+	m.RemoveExtension(ExtPlacementPolicy)
+}
@@ -0,0 +1,165 @@
+package renter
+
+import (
+	"sync"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// A ProofStatus is the outcome of a contract's storage proof window.
+type ProofStatus int
+
+// Possible ProofStatus values.
+const (
+	ProofPending ProofStatus = iota
+	ProofValid
+	ProofMissed
+)
+
+// String implements fmt.Stringer.
+func (ps ProofStatus) String() string {
+	switch ps {
+	case ProofPending:
+		return "pending"
+	case ProofValid:
+		return "valid"
+	case ProofMissed:
+		return "missed"
+	default:
+		return "unknown"
+	}
+}
+
+// A ProofResult reports a change in the ProofStatus of a watched contract.
+type ProofResult struct {
+	ContractID types.FileContractID
+	Host       hostdb.HostPublicKey
+	Status     ProofStatus
+}
+
+// Outcome returns the hostdb.ContractOutcome corresponding to the result,
+// suitable for passing to hostdb.Scanner.ResolveContract.
+func (pr ProofResult) Outcome() hostdb.ContractOutcome {
+	switch pr.Status {
+	case ProofValid:
+		return hostdb.OutcomeCompleted
+	case ProofMissed:
+		return hostdb.OutcomeMissedProof
+	default:
+		return hostdb.OutcomeActive
+	}
+}
+
+type watchedContract struct {
+	host   hostdb.HostPublicKey
+	status ProofStatus
+}
+
+// A ProofMonitor watches the blockchain for the resolution of file contracts,
+// reporting whether each host submitted a valid storage proof or missed its
+// proof window. A missed proof indicates that the host lost the contract's
+// data (or went offline), and should weigh heavily when scoring the host.
+//
+// ProofMonitor implements modules.ConsensusSetSubscriber. Outcomes are
+// detected via the payouts created when a contract resolves, so the monitor
+// does not need to know the current height, and outcomes are correctly
+// retracted if the resolving block is reorged out of the chain.
+type ProofMonitor struct {
+	onResult func(ProofResult)
+
+	mu        sync.Mutex
+	contracts map[types.FileContractID]*watchedContract
+	payouts   map[types.SiacoinOutputID]types.FileContractID
+}
+
+// Watch begins watching the specified contract.
+func (pm *ProofMonitor) Watch(id types.FileContractID, host hostdb.HostPublicKey) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if _, ok := pm.contracts[id]; ok {
+		return
+	}
+	pm.contracts[id] = &watchedContract{host: host}
+	pm.payouts[id.StorageProofOutputID(types.ProofValid, 0)] = id
+	pm.payouts[id.StorageProofOutputID(types.ProofMissed, 0)] = id
+}
+
+// Unwatch stops watching the specified contract.
+func (pm *ProofMonitor) Unwatch(id types.FileContractID) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	delete(pm.contracts, id)
+	delete(pm.payouts, id.StorageProofOutputID(types.ProofValid, 0))
+	delete(pm.payouts, id.StorageProofOutputID(types.ProofMissed, 0))
+}
+
+// Status returns the current ProofStatus of the specified contract. Contracts
+// that are not being watched are reported as pending.
+func (pm *ProofMonitor) Status(id types.FileContractID) ProofStatus {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if c, ok := pm.contracts[id]; ok {
+		return c.status
+	}
+	return ProofPending
+}
+
+// ProcessConsensusChange implements modules.ConsensusSetSubscriber.
+func (pm *ProofMonitor) ProcessConsensusChange(cc modules.ConsensusChange) {
+	// When a delayed output matures, it is removed from the delayed set and
+	// added to the regular set; such removals must not be mistaken for
+	// reverts.
+	matured := make(map[types.SiacoinOutputID]struct{})
+	for _, diff := range cc.SiacoinOutputDiffs {
+		if diff.Direction == modules.DiffApply {
+			matured[diff.ID] = struct{}{}
+		}
+	}
+
+	pm.mu.Lock()
+	var results []ProofResult
+	for _, diff := range cc.DelayedSiacoinOutputDiffs {
+		id, ok := pm.payouts[diff.ID]
+		if !ok {
+			continue
+		}
+		status := ProofPending
+		if diff.Direction == modules.DiffApply {
+			if diff.ID == id.StorageProofOutputID(types.ProofValid, 0) {
+				status = ProofValid
+			} else {
+				status = ProofMissed
+			}
+		} else if _, ok := matured[diff.ID]; ok {
+			continue
+		}
+		c := pm.contracts[id]
+		if c.status != status {
+			c.status = status
+			results = append(results, ProofResult{
+				ContractID: id,
+				Host:       c.host,
+				Status:     status,
+			})
+		}
+	}
+	pm.mu.Unlock()
+
+	if pm.onResult != nil {
+		for _, r := range results {
+			pm.onResult(r)
+		}
+	}
+}
+
+// NewProofMonitor returns a ProofMonitor that calls onResult whenever the
+// ProofStatus of a watched contract changes. onResult may be nil.
+func NewProofMonitor(onResult func(ProofResult)) *ProofMonitor {
+	return &ProofMonitor{
+		onResult:  onResult,
+		contracts: make(map[types.FileContractID]*watchedContract),
+		payouts:   make(map[types.SiacoinOutputID]types.FileContractID),
+	}
+}
@@ -0,0 +1,73 @@
+package renter
+
+import (
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+)
+
+func TestProofMonitor(t *testing.T) {
+	var results []ProofResult
+	pm := NewProofMonitor(func(r ProofResult) { results = append(results, r) })
+	good, bad := types.FileContractID{1}, types.FileContractID{2}
+	goodHost := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(make([]byte, 32)).PublicKey())
+	badHost := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(append(make([]byte, 31), 1)).PublicKey())
+	pm.Watch(good, goodHost)
+	pm.Watch(bad, badHost)
+
+	delayedDiff := func(id types.FileContractID, ps types.ProofStatus, dir modules.DiffDirection) modules.DelayedSiacoinOutputDiff {
+		return modules.DelayedSiacoinOutputDiff{
+			Direction: dir,
+			ID:        id.StorageProofOutputID(ps, 0),
+		}
+	}
+
+	// resolve both contracts
+	pm.ProcessConsensusChange(modules.ConsensusChange{
+		DelayedSiacoinOutputDiffs: []modules.DelayedSiacoinOutputDiff{
+			delayedDiff(good, types.ProofValid, modules.DiffApply),
+			delayedDiff(good, types.ProofValid, modules.DiffApply), // other outputs
+			delayedDiff(bad, types.ProofMissed, modules.DiffApply),
+			delayedDiff(types.FileContractID{3}, types.ProofMissed, modules.DiffApply), // unwatched
+		},
+	})
+	if len(results) != 2 {
+		t.Fatal("expected 2 results, got", len(results))
+	} else if pm.Status(good) != ProofValid || pm.Status(bad) != ProofMissed {
+		t.Fatal("wrong statuses:", pm.Status(good), pm.Status(bad))
+	} else if results[1].Host != badHost || results[1].Status != ProofMissed {
+		t.Fatal("wrong result:", results[1])
+	}
+
+	// maturing the payouts should not affect the status
+	pm.ProcessConsensusChange(modules.ConsensusChange{
+		SiacoinOutputDiffs: []modules.SiacoinOutputDiff{{
+			Direction: modules.DiffApply,
+			ID:        good.StorageProofOutputID(types.ProofValid, 0),
+		}},
+		DelayedSiacoinOutputDiffs: []modules.DelayedSiacoinOutputDiff{
+			delayedDiff(good, types.ProofValid, modules.DiffRevert),
+		},
+	})
+	if len(results) != 2 || pm.Status(good) != ProofValid {
+		t.Fatal("maturation should not change status")
+	}
+
+	// reverting the resolution should make the contract pending again
+	pm.ProcessConsensusChange(modules.ConsensusChange{
+		DelayedSiacoinOutputDiffs: []modules.DelayedSiacoinOutputDiff{
+			delayedDiff(bad, types.ProofMissed, modules.DiffRevert),
+		},
+	})
+	if len(results) != 3 || pm.Status(bad) != ProofPending {
+		t.Fatal("revert should make status pending")
+	}
+
+	pm.Unwatch(good)
+	if pm.Status(good) != ProofPending {
+		t.Fatal("unwatched contract should be pending")
+	}
+}
@@ -0,0 +1,240 @@
+package proto
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+// ErrInsufficientBalance is returned when an ephemeral account does not
+// contain enough funds to pay for an RPC.
+var ErrInsufficientBalance = errors.New("ephemeral account has insufficient balance")
+
+// An AccountStore persists the balances of ephemeral accounts.
+type AccountStore interface {
+	LoadBalance(host hostdb.HostPublicKey, id renterhost.AccountID) (types.Currency, error)
+	SaveBalance(host hostdb.HostPublicKey, id renterhost.AccountID, balance types.Currency) error
+}
+
+// An Account is an ephemeral account on a particular host. Funds are deposited
+// into the account by revising a contract (see FundAccount), and can then be
+// spent on RPCs without revising the contract again. This is useful when
+// performing many small operations.
+//
+// The balance of an Account is tracked locally; since the host does not report
+// the cost of each RPC, the local balance may drift from the host's. Callers
+// can resynchronize with SyncAccount.
+type Account struct {
+	host  hostdb.HostPublicKey
+	key   ed25519.PrivateKey
+	store AccountStore
+
+	mu      sync.Mutex
+	balance types.Currency
+}
+
+// ID returns the ID of the account.
+func (a *Account) ID() (id renterhost.AccountID) {
+	copy(id[:], a.key.PublicKey())
+	return
+}
+
+// Host returns the public key of the host that the account belongs to.
+func (a *Account) Host() hostdb.HostPublicKey { return a.host }
+
+// Balance returns the locally-tracked balance of the account.
+func (a *Account) Balance() types.Currency {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.balance
+}
+
+// setBalance sets and persists the balance of the account.
+func (a *Account) setBalance(balance types.Currency) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store != nil {
+		if err := a.store.SaveBalance(a.host, a.ID(), balance); err != nil {
+			return errors.Wrap(err, "could not save account balance")
+		}
+	}
+	a.balance = balance
+	return nil
+}
+
+// withdraw deducts amount from the account, persisting the new balance before
+// the funds are spent.
+func (a *Account) withdraw(amount types.Currency) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.balance.Cmp(amount) < 0 {
+		return ErrInsufficientBalance
+	}
+	balance := a.balance.Sub(amount)
+	if a.store != nil {
+		if err := a.store.SaveBalance(a.host, a.ID(), balance); err != nil {
+			return errors.Wrap(err, "could not save account balance")
+		}
+	}
+	a.balance = balance
+	return nil
+}
+
+// NewAccount returns an Account on the specified host, controlled by key. If
+// store is non-nil, the account's balance is loaded from it, and all
+// subsequent balance changes are persisted to it.
+func NewAccount(host hostdb.HostPublicKey, key ed25519.PrivateKey, store AccountStore) (*Account, error) {
+	a := &Account{
+		host:  host,
+		key:   key,
+		store: store,
+	}
+	if store != nil {
+		balance, err := store.LoadBalance(host, a.ID())
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load account balance")
+		}
+		a.balance = balance
+	}
+	return a, nil
+}
+
+// FundAccount calls the FundAccount RPC, transferring amount from the locked
+// contract to acct.
+func (s *Session) FundAccount(acct *Account, amount types.Currency) (err error) {
+	defer wrapErr(&err, "FundAccount")
+	defer s.observeRPC("FundAccount", &err)()
+	if s.readOnly {
+		return ErrReadOnly
+	} else if err := s.requireFeature(supportsEphemeralAccounts); err != nil {
+		return err
+	} else if err := s.checkContract(); err != nil {
+		return err
+	} else if acct.host != s.host.PublicKey {
+		return errors.New("account belongs to a different host")
+	} else if s.rev.RenterFunds().Cmp(amount) < 0 {
+		return ErrInsufficientRenterFunds
+	}
+
+	// construct new revision
+	rev := s.rev.Revision
+	rev.NewRevisionNumber++
+	newValid, newMissed := updateRevisionOutputs(&rev, amount, types.ZeroCurrency)
+
+	s.extendDeadline(60 * time.Second)
+	req := &renterhost.RPCFundAccountRequest{
+		Account: acct.ID(),
+
+		NewRevisionNumber:    rev.NewRevisionNumber,
+		NewValidProofValues:  newValid,
+		NewMissedProofValues: newMissed,
+		Signature:            s.key.SignHash(renterhost.HashRevision(rev)),
+	}
+	var resp renterhost.RPCFundAccountResponse
+	if err := s.call(renterhost.RPCFundAccountID, req, &resp); err != nil {
+		return err
+	} else if err := s.verifyHostSignature(rev, resp.Signature); err != nil {
+		return err
+	}
+	s.rev.Revision = rev
+	s.rev.Signatures[0].Signature = req.Signature
+	s.rev.Signatures[1].Signature = resp.Signature
+	if err := s.commitSequence(); err != nil {
+		return err
+	}
+	return acct.setBalance(resp.Balance)
+}
+
+// SyncAccount calls the AccountBalance RPC, replacing the locally-tracked
+// balance of acct with the balance reported by the host.
+func (s *Session) SyncAccount(acct *Account) (_ types.Currency, err error) {
+	defer wrapErr(&err, "SyncAccount")
+	defer s.observeRPC("SyncAccount", &err)()
+	if err := s.requireFeature(supportsEphemeralAccounts); err != nil {
+		return types.ZeroCurrency, err
+	} else if acct.host != s.host.PublicKey {
+		return types.ZeroCurrency, errors.New("account belongs to a different host")
+	}
+	s.extendDeadline(10 * time.Second)
+	req := &renterhost.RPCAccountBalanceRequest{
+		Account: acct.ID(),
+	}
+	var resp renterhost.RPCAccountBalanceResponse
+	if err := s.call(renterhost.RPCAccountBalanceID, req, &resp); err != nil {
+		return types.ZeroCurrency, err
+	}
+	return resp.Balance, acct.setBalance(resp.Balance)
+}
+
+// ReadWithAccount calls the ReadAccount RPC, writing the requested sections of
+// sector data to w. Unlike Read, the RPC is paid for by withdrawing from acct,
+// so the Session need not have a locked contract. Merkle proofs are always
+// requested.
+func (s *Session) ReadWithAccount(w io.Writer, acct *Account, sections []renterhost.RPCReadRequestSection) (err error) {
+	defer wrapErr(&err, "ReadWithAccount")
+	defer s.observeRPC("ReadWithAccount", &err)()
+	if len(sections) == 0 {
+		return nil
+	} else if acct == nil {
+		return errors.New("no account specified")
+	} else if acct.host != s.host.PublicKey {
+		return errors.New("account belongs to a different host")
+	} else if err := s.requireFeature(supportsEphemeralAccounts); err != nil {
+		return err
+	}
+	w, sections = s.alignSections(w, sections)
+
+	if err := s.refreshPrices(); err != nil {
+		return err
+	}
+	cost, bandwidth := s.readCost(sections)
+	if err := s.checkCost(cost); err != nil {
+		return err
+	}
+	price := cost.Total()
+	if err := acct.withdraw(price); err != nil {
+		return err
+	}
+	req := &renterhost.RPCReadAccountRequest{
+		Sections:    sections,
+		MerkleProof: true,
+		Account:     acct.ID(),
+		Amount:      price,
+	}
+	frand.Read(req.Nonce[:])
+	req.Signature = acct.key.SignHash(renterhost.HashWithdrawal(req.Account, req.Amount, req.Nonce))
+
+	s.extendDeadline(60*time.Second + time.Duration(bandwidth)/time.Microsecond)
+	defer s.stats.measureTransfer(false)()
+	if err := s.sess.WriteRequest(renterhost.RPCReadAccountID, req); err != nil {
+		return err
+	}
+	resp := renterhost.RPCReadResponse{
+		Data: s.readBuf[:0], // avoid reallocating
+	}
+	for _, sec := range sections {
+		if err := s.sess.ReadResponse(&resp, 4096+uint64(sec.Length)); err != nil {
+			return s.wrapResponseErr(err, "couldn't read sector data", "host rejected ReadAccount request")
+		}
+		if len(resp.Data) != int(sec.Length) {
+			return errors.New("host did not send enough sector data")
+		}
+		proofStart := int(sec.Offset) / merkle.SegmentSize
+		proofEnd := int(sec.Offset+sec.Length) / merkle.SegmentSize
+		if !merkle.VerifyProof(resp.MerkleProof, resp.Data, proofStart, proofEnd, sec.MerkleRoot) {
+			return s.misbehaved(hostdb.MisbehaviorInvalidProof, ErrInvalidMerkleProof)
+		}
+		if _, err := w.Write(resp.Data); err != nil {
+			return errors.Wrap(err, "couldn't write sector data")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package proto
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A Priority classifies the traffic of a Session for the purpose of
+// bandwidth scheduling. Lower values are more urgent.
+type Priority int
+
+// Possible Priority values.
+const (
+	// PriorityInteractive is for traffic that a user is waiting on, such as
+	// reading a file. It is the default.
+	PriorityInteractive Priority = iota
+	// PriorityRepair is for traffic that restores redundancy, such as
+	// migrating shards to new hosts.
+	PriorityRepair
+	// PriorityScrub is for traffic that merely verifies data, such as
+	// periodic integrity checks.
+	PriorityScrub
+
+	numPriorities
+)
+
+// bandwidthChunk is the maximum number of bytes transferred per request to a
+// BandwidthScheduler. It bounds how long a transfer of one priority can delay
+// a transfer of a higher priority.
+const bandwidthChunk = 32 << 10
+
+// A bandwidthBucket is a token bucket that serves waiters in priority order.
+type bandwidthBucket struct {
+	mu      sync.Mutex
+	rate    float64 // bytes per second; 0 means unlimited
+	tokens  float64
+	last    time.Time
+	waiting [numPriorities]int
+}
+
+func (b *bandwidthBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(rate)
+	b.tokens = 0
+	b.last = time.Now()
+}
+
+// burst returns the maximum number of tokens the bucket can hold.
+func (b *bandwidthBucket) burst() float64 {
+	if burst := b.rate / 10; burst > bandwidthChunk {
+		return burst
+	}
+	return bandwidthChunk
+}
+
+// take blocks until n tokens are available and no waiter of a more urgent
+// priority is waiting, and then consumes them. n must not exceed
+// bandwidthChunk.
+func (b *bandwidthBucket) take(p Priority, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	queued := false
+	for {
+		if b.rate == 0 {
+			break
+		}
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if burst := b.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+		urgent := false
+		for q := Priority(0); q < p; q++ {
+			urgent = urgent || b.waiting[q] > 0
+		}
+		deficit := float64(n) - b.tokens
+		if !urgent && deficit <= 0 {
+			b.tokens -= float64(n)
+			break
+		}
+		if !queued {
+			b.waiting[p]++
+			queued = true
+		}
+		wait := time.Millisecond
+		if d := time.Duration(deficit / b.rate * float64(time.Second)); d > wait {
+			wait = d
+		}
+		b.mu.Unlock()
+		time.Sleep(wait)
+		b.mu.Lock()
+	}
+	if queued {
+		b.waiting[p]--
+	}
+}
+
+// A BandwidthScheduler enforces aggregate upload and download rate limits
+// across any number of Sessions. When the limits are saturated, traffic is
+// served in order of Priority; traffic of the same priority is served
+// roughly fairly. Limits are approximate, since the protocol's framing and
+// encryption overhead is counted along with the data itself.
+type BandwidthScheduler struct {
+	up, down bandwidthBucket
+}
+
+// SetLimits sets the maximum upload and download rates, in bytes per second.
+// A rate of 0 is unlimited.
+func (bs *BandwidthScheduler) SetLimits(upload, download int64) {
+	bs.up.setRate(upload)
+	bs.down.setRate(download)
+}
+
+// NewBandwidthScheduler returns a BandwidthScheduler with the specified
+// upload and download rates, in bytes per second. A rate of 0 is unlimited.
+func NewBandwidthScheduler(upload, download int64) *BandwidthScheduler {
+	bs := new(BandwidthScheduler)
+	bs.SetLimits(upload, download)
+	return bs
+}
+
+// bandwidthConn wraps a net.Conn, subjecting its traffic to a
+// BandwidthScheduler, if one is set.
+type bandwidthConn struct {
+	net.Conn
+	mu    sync.Mutex
+	sched *BandwidthScheduler
+	prio  Priority
+}
+
+func (bc *bandwidthConn) scheduler() (*BandwidthScheduler, Priority) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.sched, bc.prio
+}
+
+func (bc *bandwidthConn) Read(p []byte) (int, error) {
+	bs, prio := bc.scheduler()
+	if bs == nil {
+		return bc.Conn.Read(p)
+	}
+	if len(p) > bandwidthChunk {
+		p = p[:bandwidthChunk]
+	}
+	n, err := bc.Conn.Read(p)
+	if n > 0 {
+		bs.down.take(prio, n)
+	}
+	return n, err
+}
+
+func (bc *bandwidthConn) Write(p []byte) (int, error) {
+	bs, prio := bc.scheduler()
+	if bs == nil {
+		return bc.Conn.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > bandwidthChunk {
+			chunk = chunk[:bandwidthChunk]
+		}
+		bs.up.take(prio, len(chunk))
+		n, err := bc.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// SetBandwidthScheduler subjects the Session's subsequent traffic to bs. A
+// nil scheduler removes any limits. It may be called concurrently with other
+// methods.
+func (s *Session) SetBandwidthScheduler(bs *BandwidthScheduler) {
+	s.bw.mu.Lock()
+	defer s.bw.mu.Unlock()
+	s.bw.sched = bs
+}
+
+// SetPriority sets the priority of the Session's subsequent traffic. It may
+// be called concurrently with other methods.
+func (s *Session) SetPriority(p Priority) {
+	s.bw.mu.Lock()
+	defer s.bw.mu.Unlock()
+	s.bw.prio = p
+}
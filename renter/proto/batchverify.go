@@ -0,0 +1,122 @@
+package proto
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renterhost"
+)
+
+type verifyRequest struct {
+	pub  ed25519.PublicKey
+	hash crypto.Hash
+	sig  []byte
+	res  chan bool
+}
+
+// A SignatureBatcher verifies host signatures in batches, reducing the CPU
+// cost of verification when many Sessions are performing RPCs concurrently.
+// Requests are collected until MaxBatch requests are pending or Delay has
+// elapsed since the first pending request, whichever comes first. If a batch
+// fails, its signatures are verified individually, so that only the invalid
+// signatures are rejected.
+//
+// A SignatureBatcher is safe for concurrent use, and may be shared by any
+// number of Sessions; see Session.SetSignatureBatcher.
+type SignatureBatcher struct {
+	MaxBatch int
+	Delay    time.Duration
+
+	mu      sync.Mutex
+	pending []verifyRequest
+	timer   *time.Timer
+}
+
+// Verify reports whether sig is a valid signature of hash by pub. It blocks
+// until the batch containing the signature has been verified.
+func (sb *SignatureBatcher) Verify(pub ed25519.PublicKey, hash crypto.Hash, sig []byte) bool {
+	res := make(chan bool, 1)
+	sb.mu.Lock()
+	sb.pending = append(sb.pending, verifyRequest{pub, hash, sig, res})
+	var batch []verifyRequest
+	if len(sb.pending) >= sb.MaxBatch {
+		batch = sb.takeBatch()
+	} else if sb.timer == nil {
+		sb.timer = time.AfterFunc(sb.Delay, func() {
+			sb.mu.Lock()
+			batch := sb.takeBatch()
+			sb.mu.Unlock()
+			verifyBatch(batch)
+		})
+	}
+	sb.mu.Unlock()
+	if batch != nil {
+		verifyBatch(batch)
+	}
+	return <-res
+}
+
+// takeBatch removes and returns all pending requests. sb.mu must be held.
+func (sb *SignatureBatcher) takeBatch() []verifyRequest {
+	if sb.timer != nil {
+		sb.timer.Stop()
+		sb.timer = nil
+	}
+	batch := sb.pending
+	sb.pending = nil
+	return batch
+}
+
+func verifyBatch(batch []verifyRequest) {
+	if len(batch) == 0 {
+		return
+	}
+	pubs := make([]ed25519.PublicKey, len(batch))
+	hashes := make([]crypto.Hash, len(batch))
+	sigs := make([][]byte, len(batch))
+	for i, req := range batch {
+		pubs[i], hashes[i], sigs[i] = req.pub, req.hash, req.sig
+	}
+	if len(batch) > 1 && ed25519.VerifyBatch(pubs, hashes, sigs) {
+		for _, req := range batch {
+			req.res <- true
+		}
+		return
+	}
+	for _, req := range batch {
+		req.res <- req.pub.VerifyHash(req.hash, req.sig)
+	}
+}
+
+// SetSignatureBatcher causes the Session to verify the host's signature on
+// each new revision using sb. If no SignatureBatcher is set, the host's
+// signatures are not verified, since the renter can always fall back to a
+// revision that the host did sign.
+func (s *Session) SetSignatureBatcher(sb *SignatureBatcher) {
+	s.sigs = sb
+}
+
+// verifyHostSignature verifies the host's signature on rev, if a
+// SignatureBatcher has been set.
+func (s *Session) verifyHostSignature(rev types.FileContractRevision, sig []byte) error {
+	if s.sigs == nil {
+		return nil
+	} else if !s.sigs.Verify(s.host.PublicKey.Ed25519(), renterhost.HashRevision(rev), sig) {
+		return s.misbehaved(hostdb.MisbehaviorRefusedRevision, errors.New("host's signature on revision is invalid"))
+	}
+	return nil
+}
+
+// NewSignatureBatcher returns a SignatureBatcher with the specified
+// parameters.
+func NewSignatureBatcher(maxBatch int, delay time.Duration) *SignatureBatcher {
+	return &SignatureBatcher{
+		MaxBatch: maxBatch,
+		Delay:    delay,
+	}
+}
@@ -0,0 +1,137 @@
+package proto
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+// HostBenchmark contains the results of BenchmarkHost.
+type HostBenchmark struct {
+	// HandshakeLatency is the time required to establish a new session with
+	// the host.
+	HandshakeLatency time.Duration
+	// RPCLatency is the round-trip time of a Settings RPC.
+	RPCLatency time.Duration
+	// TimeToFirstByte is the time between initiating a Read RPC and receiving
+	// the first byte of sector data.
+	TimeToFirstByte time.Duration
+	// UploadThroughput and DownloadThroughput are measured in bytes per
+	// second.
+	UploadThroughput   float64
+	DownloadThroughput float64
+}
+
+// ProbeResult converts hb to a hostdb.ProbeResult, for use in a
+// hostdb.ProbeFunc.
+func (hb HostBenchmark) ProbeResult() hostdb.ProbeResult {
+	return hostdb.ProbeResult{
+		Latency:            hb.RPCLatency,
+		TimeToFirstByte:    hb.TimeToFirstByte,
+		UploadThroughput:   hb.UploadThroughput,
+		DownloadThroughput: hb.DownloadThroughput,
+	}
+}
+
+// firstByteWriter records when it is first written to.
+type firstByteWriter struct {
+	w     io.Writer
+	first time.Time
+}
+
+func (fbw *firstByteWriter) Write(p []byte) (int, error) {
+	if fbw.first.IsZero() && len(p) > 0 {
+		fbw.first = time.Now()
+	}
+	return fbw.w.Write(p)
+}
+
+// BenchmarkHost measures the performance of the host by uploading and then
+// downloading n random sectors. The sectors are deleted afterwards. Note that
+// the host will charge for the storage and bandwidth used, so n should be
+// small.
+func BenchmarkHost(s *Session, n int) (_ HostBenchmark, err error) {
+	defer wrapErr(&err, "BenchmarkHost")
+	if n <= 0 {
+		return HostBenchmark{}, errors.New("must benchmark at least one sector")
+	}
+	var hb HostBenchmark
+
+	// measure handshake latency
+	start := time.Now()
+	hs, err := newUnlockedSession(modules.NetAddress(s.conn.RemoteAddr().String()), s.host.PublicKey, s.height)
+	if err != nil {
+		return HostBenchmark{}, errors.Wrap(err, "could not establish new session")
+	}
+	hb.HandshakeLatency = time.Since(start)
+	hs.Close()
+
+	// measure RPC latency
+	start = time.Now()
+	if _, err := s.Settings(); err != nil {
+		return HostBenchmark{}, err
+	}
+	hb.RPCLatency = time.Since(start)
+
+	// upload sectors
+	actions := make([]renterhost.RPCWriteAction, n)
+	for i := range actions {
+		actions[i] = renterhost.RPCWriteAction{
+			Type: renterhost.RPCWriteActionAppend,
+			Data: frand.Bytes(renterhost.SectorSize),
+		}
+	}
+	start = time.Now()
+	if err := s.Write(actions); err != nil {
+		return HostBenchmark{}, err
+	}
+	hb.UploadThroughput = float64(n*renterhost.SectorSize) / time.Since(start).Seconds()
+	roots := append([]crypto.Hash(nil), s.appendRoots...)
+	// delete the sectors when we're done
+	defer func() {
+		if trimErr := s.Write([]renterhost.RPCWriteAction{{
+			Type: renterhost.RPCWriteActionTrim,
+			A:    uint64(n),
+		}}); trimErr != nil && err == nil {
+			err = errors.Wrap(trimErr, "could not delete benchmark sectors")
+		}
+	}()
+
+	// measure time to first byte using a single segment
+	fbw := &firstByteWriter{w: ioutil.Discard}
+	start = time.Now()
+	err = s.Read(fbw, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: roots[0],
+		Offset:     0,
+		Length:     merkle.SegmentSize,
+	}})
+	if err != nil {
+		return HostBenchmark{}, err
+	}
+	hb.TimeToFirstByte = fbw.first.Sub(start)
+
+	// download sectors
+	sections := make([]renterhost.RPCReadRequestSection, n)
+	for i := range sections {
+		sections[i] = renterhost.RPCReadRequestSection{
+			MerkleRoot: roots[i],
+			Offset:     0,
+			Length:     renterhost.SectorSize,
+		}
+	}
+	start = time.Now()
+	if err := s.Read(ioutil.Discard, sections); err != nil {
+		return HostBenchmark{}, err
+	}
+	hb.DownloadThroughput = float64(n*renterhost.SectorSize) / time.Since(start).Seconds()
+
+	return hb, nil
+}
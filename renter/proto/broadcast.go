@@ -0,0 +1,45 @@
+package proto
+
+import (
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+)
+
+type finalBroadcast struct {
+	w      Wallet
+	tpool  TransactionPool
+	window types.BlockHeight
+}
+
+// SetFinalBroadcast configures the Session to submit the latest revision of
+// the locked contract when the contract is unlocked or the Session is closed,
+// if the contract was revised during the Session and its proof window begins
+// within window blocks of the Session's current height.
+//
+// Once the proof window begins, the renter can no longer submit a revision.
+// If the host then submits an outdated revision (or none at all), the renter
+// loses the ability to punish it. Broadcasting the final revision of contracts
+// that are about to expire guards against this, e.g. when the renter process
+// is shutting down and will not be able to revisit the contract in time.
+func (s *Session) SetFinalBroadcast(w Wallet, tpool TransactionPool, window types.BlockHeight) {
+	s.final = &finalBroadcast{
+		w:      w,
+		tpool:  tpool,
+		window: window,
+	}
+}
+
+// broadcastFinalRevision submits the latest revision of the locked contract,
+// if necessary. See SetFinalBroadcast.
+func (s *Session) broadcastFinalRevision() error {
+	if s.final == nil || s.key == nil || s.rev.Revision.NewRevisionNumber == s.finalRevNum {
+		return nil
+	} else if s.height+s.final.window < s.rev.EndHeight() {
+		return nil
+	}
+	if err := SubmitContractRevision(s.rev, s.final.w, s.final.tpool); err != nil {
+		return errors.Wrap(err, "could not broadcast final revision")
+	}
+	s.finalRevNum = s.rev.Revision.NewRevisionNumber
+	return nil
+}
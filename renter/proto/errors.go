@@ -0,0 +1,166 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renterhost"
+)
+
+var (
+	// ErrInvalidMerkleProof is returned by various RPCs when the host supplies
+	// an invalid Merkle proof.
+	ErrInvalidMerkleProof = errors.New("host supplied invalid Merkle proof")
+
+	// ErrContractLocked is returned by the Lock RPC when the contract in
+	// question is already locked by another party. This is a transient error;
+	// the caller should retry later.
+	ErrContractLocked = errors.New("contract is locked by another party")
+
+	// ErrHostOutOfStorage is returned when the host does not have enough
+	// storage available to accept new sectors.
+	ErrHostOutOfStorage = errors.New("host is out of storage")
+
+	// ErrBadRevisionNumber is returned when the host rejects a revision
+	// because its revision number is incorrect. This typically indicates that
+	// the renter and host have desynchronized.
+	ErrBadRevisionNumber = errors.New("host rejected revision number")
+
+	// ErrInsufficientRenterFunds is returned when the contract does not
+	// contain enough renter funds to pay for an RPC.
+	ErrInsufficientRenterFunds = errors.New("contract has insufficient renter funds")
+
+	// ErrInsufficientCollateral is returned when the host rejects an RPC
+	// because the contract does not contain enough collateral.
+	ErrInsufficientCollateral = errors.New("contract has insufficient host collateral")
+
+	// ErrReadOnly is returned when attempting to modify a contract that was
+	// locked with LockReadOnly.
+	ErrReadOnly = errors.New("contract is locked read-only")
+
+	// ErrReadOnlyRefused is returned by LockReadOnly when the host does not
+	// permit read-only access.
+	ErrReadOnlyRefused = errors.New("host does not permit read-only access")
+
+	// ErrPriceGouging is returned when the cost of an RPC, or one of the
+	// host's prices, exceeds the limits set by SetPriceLimits.
+	ErrPriceGouging = errors.New("host prices exceed limits")
+
+	// ErrUnsupportedFeature is returned when an RPC requires a protocol
+	// feature that the host's version is known not to support.
+	ErrUnsupportedFeature = errors.New("host version does not support the requested feature")
+
+	// ErrSectorNotFound is returned when the host does not have a requested
+	// sector.
+	ErrSectorNotFound = errors.New("host does not have the requested sector")
+)
+
+// A HostError is an error sent by a host in response to an RPC. If the error
+// corresponds to one of the errors defined by this package, Err wraps that
+// error with the host's description, and errors.Cause returns it; otherwise,
+// Err is the RPCError itself.
+type HostError struct {
+	Host     hostdb.HostPublicKey
+	RPCError *renterhost.RPCError
+	Err      error
+}
+
+// Error implements error.
+func (e *HostError) Error() string {
+	return fmt.Sprintf("%v (host %v)", e.RPCError.Description, e.Host.ShortKey())
+}
+
+// Cause returns the classified error.
+func (e *HostError) Cause() error { return e.Err }
+
+// rpcErrorTypes maps the Types of RPCErrors to the errors defined by this
+// package.
+var rpcErrorTypes = map[renterhost.Specifier]error{
+	renterhost.ErrTypeOutOfStorage: ErrHostOutOfStorage,
+}
+
+// rpcErrorPhrases maps phrases in the descriptions of RPCErrors to the errors
+// defined by this package, for hosts that do not set the Type. Phrases are
+// matched as whole words, so that e.g. "unlocked" does not match "locked".
+var rpcErrorPhrases = []struct {
+	re  *regexp.Regexp
+	err error
+}{
+	{regexp.MustCompile(`(?i)\b(not enough|out of) storage\b`), ErrHostOutOfStorage},
+	{regexp.MustCompile(`(?i)\b(bad|invalid|incorrect|wrong) revision number\b`), ErrBadRevisionNumber},
+	{regexp.MustCompile(`(?i)\b(insufficient|not enough) (host )?collateral\b`), ErrInsufficientCollateral},
+	{regexp.MustCompile(`(?i)\b(insufficient|not enough) (renter )?funds\b`), ErrInsufficientRenterFunds},
+	{regexp.MustCompile(`(?i)\b(contract is locked|locked by another)\b`), ErrContractLocked},
+	{regexp.MustCompile(`(?i)\b(no sector|sector not found)\b`), ErrSectorNotFound},
+}
+
+// classifyRPCError maps an RPCError to one of the errors defined by this
+// package, wrapping it with the host's description. The Type of the RPCError
+// is preferred, but hosts do not consistently set it, so the description is
+// consulted as well. If the error is not recognized, re is returned.
+func classifyRPCError(re *renterhost.RPCError) error {
+	if err, ok := rpcErrorTypes[re.Type]; ok {
+		return errors.Wrap(err, re.Description)
+	}
+	for _, p := range rpcErrorPhrases {
+		if p.re.MatchString(re.Description) {
+			return errors.Wrap(p.err, re.Description)
+		}
+	}
+	return re
+}
+
+// wrapResponseErr formats RPC response errors nicely, wrapping them in either
+// readCtx or rejectCtx depending on whether we encountered an I/O error or the
+// host sent an explicit error message. Explicit error messages are converted
+// to a *HostError.
+func (s *Session) wrapResponseErr(err error, readCtx, rejectCtx string) error {
+	err = errors.Cause(err)
+	if re, ok := err.(*renterhost.RPCError); ok {
+		s.stats.recordError(re, true)
+		return errors.Wrap(&HostError{
+			Host:     s.host.PublicKey,
+			RPCError: re,
+			Err:      classifyRPCError(re),
+		}, rejectCtx)
+	}
+	return errors.Wrap(err, readCtx)
+}
+
+// IsRetryable reports whether the operation that produced err may succeed if
+// retried. Network errors and contention are retryable; rejections by the
+// host, invalid proofs, and insufficient funds are not.
+func IsRetryable(err error) bool {
+	switch cause := errors.Cause(err); cause {
+	case nil:
+		return false
+	case ErrContractLocked, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	default:
+		ne, ok := cause.(net.Error)
+		return ok && (ne.Timeout() || ne.Temporary())
+	}
+}
+
+// A PartialAppendError is returned by AppendBatch when only some of the
+// sectors were stored by the host.
+type PartialAppendError struct {
+	// Stored contains the Merkle roots of the sectors that were stored, in
+	// order.
+	Stored []crypto.Hash
+	// NotStored contains the indices of the sectors that were not stored.
+	NotStored []int
+	// Err is the error that prevented the remaining sectors from being
+	// stored. Typically, its errors.Cause is ErrHostOutOfStorage.
+	Err error
+}
+
+// Error implements error.
+func (e *PartialAppendError) Error() string {
+	return fmt.Sprintf("host stored %v of %v sectors: %v", len(e.Stored), len(e.Stored)+len(e.NotStored), e.Err)
+}
@@ -36,28 +36,83 @@ func FormContract(w Wallet, tpool TransactionPool, key ed25519.PrivateKey, host
 // renterPayout coins in the renter output.
 func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.PrivateKey, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (_ ContractRevision, _ []types.Transaction, err error) {
 	defer wrapErr(&err, "FormContract")
+	txn, toSign, err := buildContractTransaction(s.host, w, tpool, key.PublicKey(), renterPayout, startHeight, endHeight)
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+
+	// include any unconfirmed parent transactions
+	parents, err := w.UnconfirmedParents(txn)
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+
+	// send request
+	resp, err := s.sendContractRequest(txn, parents, key.PublicKey())
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+
+	// merge host additions with txn
+	txn.SiacoinInputs = append(txn.SiacoinInputs, resp.Inputs...)
+	txn.SiacoinOutputs = append(txn.SiacoinOutputs, resp.Outputs...)
+
+	// sign the txn
+	// NOTE: it is not necessary to explicitly check that the host supplied
+	// collateral before signing; underpayment will result in an invalid
+	// transaction.
+	for _, id := range toSign {
+		txn.TransactionSignatures = append(txn.TransactionSignatures, types.TransactionSignature{
+			ParentID:       id,
+			PublicKeyIndex: 0,
+			CoveredFields:  types.CoveredFields{WholeTransaction: true},
+		})
+	}
+	err = w.SignTransaction(&txn, toSign)
+	if err != nil {
+		err = errors.Wrap(err, "failed to sign transaction")
+		s.sess.WriteResponse(nil, errors.New("internal error")) // don't want to reveal too much
+		return ContractRevision{}, nil, err
+	}
+
+	// calculate signatures added
+	var addedSignatures []types.TransactionSignature
+	for _, sig := range txn.TransactionSignatures {
+		for _, id := range toSign {
+			if id == sig.ParentID {
+				addedSignatures = append(addedSignatures, sig)
+				break
+			}
+		}
+	}
+	txn.TransactionSignatures = addedSignatures
+
+	return s.exchangeContractSignatures(txn, parents, resp.Parents, key)
+}
+
+// buildContractTransaction creates a funded, unsigned transaction containing a
+// new file contract with host. It also returns the IDs of the inputs that the
+// renter must sign.
+func buildContractTransaction(host hostdb.ScannedHost, w Wallet, tpool TransactionPool, renterKey ed25519.PublicKey, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (types.Transaction, []crypto.Hash, error) {
 	if endHeight < startHeight {
-		return ContractRevision{}, nil, errors.New("end height must be greater than start height")
+		return types.Transaction{}, nil, errors.New("end height must be greater than start height")
 	}
 	// get two renter addresses: one for the renter refund output, one for the
 	// change output
 	refundAddr, err := w.NewWalletAddress()
 	if err != nil {
-		return ContractRevision{}, nil, errors.Wrap(err, "could not get an address to use")
+		return types.Transaction{}, nil, errors.Wrap(err, "could not get an address to use")
 	}
 	changeAddr, err := w.NewWalletAddress()
 	if err != nil {
-		return ContractRevision{}, nil, errors.Wrap(err, "could not get an address to use")
+		return types.Transaction{}, nil, errors.Wrap(err, "could not get an address to use")
 	}
 
 	// create unlock conditions
 	uc := types.UnlockConditions{
 		PublicKeys: []types.SiaPublicKey{
-			{
-				Algorithm: types.SignatureEd25519,
-				Key:       []byte(key.PublicKey()),
-			},
-			s.host.PublicKey.SiaPublicKey(),
+			renterSiaKey(renterKey),
+			host.PublicKey.SiaPublicKey(),
 		},
 		SignaturesRequired: 2,
 	}
@@ -66,21 +121,21 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 	// Note that it's okay to estimate the collateral: the host only cares if
 	// we exceed MaxCollateral, and we only care about the tax we pay on it.
 	var hostCollateral types.Currency
-	blockBytes := s.host.UploadBandwidthPrice.Add(s.host.StoragePrice).Add(s.host.DownloadBandwidthPrice).Mul64(uint64(endHeight - startHeight))
+	blockBytes := host.UploadBandwidthPrice.Add(host.StoragePrice).Add(host.DownloadBandwidthPrice).Mul64(uint64(endHeight - startHeight))
 	if !blockBytes.IsZero() {
 		bytes := renterPayout.Div(blockBytes)
-		hostCollateral = s.host.Collateral.Mul(bytes).Mul64(uint64(endHeight - startHeight))
+		hostCollateral = host.Collateral.Mul(bytes).Mul64(uint64(endHeight - startHeight))
 	}
 	// hostCollateral can't be greater than MaxCollateral, and (due to a host-
 	// side bug) it can't be zero either.
-	if hostCollateral.Cmp(s.host.MaxCollateral) > 0 {
-		hostCollateral = s.host.MaxCollateral
+	if hostCollateral.Cmp(host.MaxCollateral) > 0 {
+		hostCollateral = host.MaxCollateral
 	} else if hostCollateral.IsZero() {
 		hostCollateral = types.NewCurrency64(1)
 	}
 
 	// calculate payouts
-	hostPayout := s.host.ContractPrice.Add(hostCollateral)
+	hostPayout := host.ContractPrice.Add(hostCollateral)
 	payout := taxAdjustedPayout(renterPayout.Add(hostPayout))
 
 	// create file contract
@@ -88,7 +143,7 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 		FileSize:       0,
 		FileMerkleRoot: crypto.Hash{}, // no proof possible without data
 		WindowStart:    endHeight,
-		WindowEnd:      endHeight + s.host.WindowSize,
+		WindowEnd:      endHeight + host.WindowSize,
 		Payout:         payout,
 		UnlockHash:     uc.UnlockHash(),
 		RevisionNumber: 0,
@@ -96,13 +151,13 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 			// outputs need to account for tax
 			{Value: renterPayout, UnlockHash: refundAddr},
 			// collateral is returned to host
-			{Value: hostPayout, UnlockHash: s.host.UnlockHash},
+			{Value: hostPayout, UnlockHash: host.UnlockHash},
 		},
 		MissedProofOutputs: []types.SiacoinOutput{
 			// same as above
 			{Value: renterPayout, UnlockHash: refundAddr},
 			// same as above
-			{Value: hostPayout, UnlockHash: s.host.UnlockHash},
+			{Value: hostPayout, UnlockHash: host.UnlockHash},
 			// once we start doing revisions, we'll move some coins to the host and some to the void
 			{Value: types.ZeroCurrency, UnlockHash: types.UnlockHash{}},
 		},
@@ -113,10 +168,10 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 	// tax, and a transaction fee.
 	_, maxFee, err := tpool.FeeEstimate()
 	if err != nil {
-		return ContractRevision{}, nil, errors.Wrap(err, "could not estimate transaction fee")
+		return types.Transaction{}, nil, errors.Wrap(err, "could not estimate transaction fee")
 	}
 	fee := maxFee.Mul64(estTxnSize)
-	totalCost := renterPayout.Add(s.host.ContractPrice).Add(types.Tax(startHeight, fc.Payout)).Add(fee)
+	totalCost := renterPayout.Add(host.ContractPrice).Add(types.Tax(startHeight, fc.Payout)).Add(fee)
 
 	// create and fund a transaction containing fc
 	txn := types.Transaction{
@@ -125,67 +180,43 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 	}
 	toSign, err := fundSiacoins(&txn, totalCost, changeAddr, w)
 	if err != nil {
-		return ContractRevision{}, nil, err
-	}
-
-	// include any unconfirmed parent transactions
-	parents, err := w.UnconfirmedParents(txn)
-	if err != nil {
-		return ContractRevision{}, nil, err
+		return types.Transaction{}, nil, err
 	}
+	return txn, toSign, nil
+}
 
-	// send request
+// sendContractRequest initiates the FormContract RPC and returns the host's
+// additions to the contract transaction.
+func (s *Session) sendContractRequest(txn types.Transaction, parents []types.Transaction, renterKey ed25519.PublicKey) (renterhost.RPCFormContractAdditions, error) {
 	s.extendDeadline(120 * time.Second)
 	req := &renterhost.RPCFormContractRequest{
 		Transactions: append(parents, txn),
-		RenterKey:    uc.PublicKeys[0],
+		RenterKey:    renterSiaKey(renterKey),
 	}
 	if err := s.sess.WriteRequest(renterhost.RPCFormContractID, req); err != nil {
-		return ContractRevision{}, nil, err
+		return renterhost.RPCFormContractAdditions{}, err
 	}
-
 	var resp renterhost.RPCFormContractAdditions
 	if err := s.sess.ReadResponse(&resp, 65536); err != nil {
-		return ContractRevision{}, nil, err
-	}
-
-	// merge host additions with txn
-	txn.SiacoinInputs = append(txn.SiacoinInputs, resp.Inputs...)
-	txn.SiacoinOutputs = append(txn.SiacoinOutputs, resp.Outputs...)
-
-	// sign the txn
-	// NOTE: it is not necessary to explicitly check that the host supplied
-	// collateral before signing; underpayment will result in an invalid
-	// transaction.
-	for _, id := range toSign {
-		txn.TransactionSignatures = append(txn.TransactionSignatures, types.TransactionSignature{
-			ParentID:       id,
-			PublicKeyIndex: 0,
-			CoveredFields:  types.CoveredFields{WholeTransaction: true},
-		})
-	}
-	err = w.SignTransaction(&txn, toSign)
-	if err != nil {
-		err = errors.Wrap(err, "failed to sign transaction")
-		s.sess.WriteResponse(nil, errors.New("internal error")) // don't want to reveal too much
-		return ContractRevision{}, nil, err
-	}
-
-	// calculate signatures added
-	var addedSignatures []types.TransactionSignature
-	for _, sig := range txn.TransactionSignatures {
-		for _, id := range toSign {
-			if id == sig.ParentID {
-				addedSignatures = append(addedSignatures, sig)
-				break
-			}
-		}
+		return renterhost.RPCFormContractAdditions{}, s.wrapResponseErr(err, "couldn't read host additions", "host rejected FormContract request")
 	}
+	return resp, nil
+}
 
+// exchangeContractSignatures completes the FormContract RPC. The signatures of
+// txn must be the renter's contract signatures, and nothing else.
+func (s *Session) exchangeContractSignatures(txn types.Transaction, parents, hostParents []types.Transaction, key ed25519.PrivateKey) (ContractRevision, []types.Transaction, error) {
 	// create initial (no-op) revision, transaction, and signature
+	fc := txn.FileContracts[0]
 	initRevision := types.FileContractRevision{
-		ParentID:          txn.FileContractID(0),
-		UnlockConditions:  uc,
+		ParentID: txn.FileContractID(0),
+		UnlockConditions: types.UnlockConditions{
+			PublicKeys: []types.SiaPublicKey{
+				renterSiaKey(key.PublicKey()),
+				s.host.PublicKey.SiaPublicKey(),
+			},
+			SignaturesRequired: 2,
+		},
 		NewRevisionNumber: 1,
 
 		NewFileSize:           fc.FileSize,
@@ -205,7 +236,7 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 
 	// Send signatures.
 	renterSigs := &renterhost.RPCFormContractSignatures{
-		ContractSignatures: addedSignatures,
+		ContractSignatures: txn.TransactionSignatures,
 		RevisionSignature:  renterRevisionSig,
 	}
 	if err := s.sess.WriteResponse(renterSigs, nil); err != nil {
@@ -215,10 +246,10 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 	// Read the host signatures.
 	var hostSigs renterhost.RPCFormContractSignatures
 	if err := s.sess.ReadResponse(&hostSigs, 4096); err != nil {
-		return ContractRevision{}, nil, err
+		return ContractRevision{}, nil, s.wrapResponseErr(err, "couldn't read host signatures", "host rejected contract signatures")
 	}
 	txn.TransactionSignatures = append(txn.TransactionSignatures, hostSigs.ContractSignatures...)
-	signedTxnSet := append(resp.Parents, append(parents, txn)...)
+	signedTxnSet := append(hostParents, append(parents, txn)...)
 
 	return ContractRevision{
 		Revision:   initRevision,
@@ -226,6 +257,13 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 	}, signedTxnSet, nil
 }
 
+func renterSiaKey(pk ed25519.PublicKey) types.SiaPublicKey {
+	return types.SiaPublicKey{
+		Algorithm: types.SignatureEd25519,
+		Key:       []byte(pk),
+	}
+}
+
 func fundSiacoins(txn *types.Transaction, amount types.Currency, changeAddr types.UnlockHash, w Wallet) ([]crypto.Hash, error) {
 	// contract formation generally requires chained transactions, so use
 	// unconfirmed outputs
@@ -0,0 +1,141 @@
+package proto
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/renterhost"
+)
+
+// migrateBatchSize is the number of sectors appended per Write RPC during a
+// migration.
+const migrateBatchSize = 4
+
+// A MigrationStore persists the state of contract migrations, allowing them to
+// resume after interruption.
+type MigrationStore interface {
+	// LoadMigration returns the number of sectors that the destination
+	// contract contained when the migration began, or -1 if the migration has
+	// not begun.
+	LoadMigration(from, to types.FileContractID) (int, error)
+	// SaveMigration records the state of a migration. When the migration
+	// completes, destOffset is -1, and the store may discard the migration.
+	SaveMigration(from, to types.FileContractID, destOffset int) error
+}
+
+// MigrateSectors copies each sector of the contract locked by from to the end
+// of the contract locked by to, in order. Sectors are downloaded and verified
+// concurrently with uploading. If non-nil, progress is called after each batch
+// of sectors is uploaded.
+//
+// The progress of the migration is determined by the number of sectors in the
+// destination contract, so the destination contract must not be modified by
+// anything else while the migration is in progress. If store is non-nil, the
+// migration can be resumed after an interruption by calling MigrateSectors
+// again with the same contracts and store. Once the migration completes, its
+// state is cleared, so a later call with the same contracts begins a new
+// migration. Without a store, MigrateSectors assumes that the migration is
+// beginning.
+func MigrateSectors(from, to *Session, store MigrationStore, progress func(migrated, total int)) (err error) {
+	defer wrapErr(&err, "MigrateSectors")
+	fromID, toID := from.rev.ID(), to.rev.ID()
+	total := from.rev.NumSectors()
+	offset := to.rev.NumSectors()
+	if store != nil {
+		saved, err := store.LoadMigration(fromID, toID)
+		if err != nil {
+			return errors.Wrap(err, "could not load migration state")
+		} else if saved >= 0 {
+			offset = saved
+		} else if err := store.SaveMigration(fromID, toID, offset); err != nil {
+			return errors.Wrap(err, "could not save migration state")
+		}
+	}
+	migrated := to.rev.NumSectors() - offset
+	finish := func() error {
+		if store == nil {
+			return nil
+		} else if err := store.SaveMigration(fromID, toID, -1); err != nil {
+			return errors.Wrap(err, "could not clear migration state")
+		}
+		return nil
+	}
+	if migrated < 0 || migrated > total {
+		return errors.New("destination contract is inconsistent with migration state")
+	} else if migrated == total {
+		return finish()
+	}
+	roots, err := from.SectorRoots(migrated, total-migrated)
+	if err != nil {
+		return errors.Wrap(err, "could not download sector roots")
+	}
+
+	// download sectors in a separate goroutine
+	type batch struct {
+		roots   []crypto.Hash
+		sectors []*[renterhost.SectorSize]byte
+		err     error
+	}
+	batches := make(chan batch, 1)
+	stop := make(chan struct{})
+	go func() {
+		defer close(batches)
+		for i := 0; i < len(roots); i += migrateBatchSize {
+			j := i + migrateBatchSize
+			if j > len(roots) {
+				j = len(roots)
+			}
+			b := batch{roots: roots[i:j]}
+			for _, root := range b.roots {
+				var buf bytes.Buffer
+				b.err = from.Read(&buf, []renterhost.RPCReadRequestSection{{
+					MerkleRoot: root,
+					Offset:     0,
+					Length:     renterhost.SectorSize,
+				}})
+				if b.err != nil {
+					break
+				}
+				sector := new([renterhost.SectorSize]byte)
+				copy(sector[:], buf.Bytes())
+				b.sectors = append(b.sectors, sector)
+			}
+			select {
+			case batches <- b:
+			case <-stop:
+				return
+			}
+			if b.err != nil {
+				return
+			}
+		}
+	}()
+	// ensure that the goroutine has exited before we return
+	defer func() {
+		close(stop)
+		for range batches {
+		}
+	}()
+
+	for b := range batches {
+		if b.err != nil {
+			return errors.Wrap(b.err, "could not download sectors")
+		}
+		newRoots, err := to.AppendBatch(b.sectors)
+		if err != nil {
+			return errors.Wrap(err, "could not upload sectors")
+		}
+		for i := range newRoots {
+			if newRoots[i] != b.roots[i] {
+				return errors.New("uploaded sector does not match downloaded sector")
+			}
+		}
+		migrated += len(newRoots)
+		if progress != nil {
+			progress(migrated, total)
+		}
+	}
+	return finish()
+}
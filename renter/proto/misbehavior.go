@@ -0,0 +1,20 @@
+package proto
+
+import "lukechampine.com/us/hostdb"
+
+// SetMisbehaviorReporter sets a function that is called whenever the Session
+// observes concrete evidence of host misbehavior, such as an invalid Merkle
+// proof. Typically, the function forwards the evidence to
+// hostdb.Scanner.ReportMisbehavior.
+func (s *Session) SetMisbehaviorReporter(report func(kind hostdb.MisbehaviorKind, details string)) {
+	s.report = report
+}
+
+// misbehaved reports err as evidence of the specified misbehavior, and then
+// returns it.
+func (s *Session) misbehaved(kind hostdb.MisbehaviorKind, err error) error {
+	if s.report != nil {
+		s.report(kind, err.Error())
+	}
+	return err
+}
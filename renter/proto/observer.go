@@ -0,0 +1,26 @@
+package proto
+
+import "sync/atomic"
+
+// SetRPCObserver sets a function that is called with the name and outcome of
+// each RPC the Session performs, e.g. to feed a renter.UtilityTracker. RPCs
+// performed on behalf of other RPCs, such as the Settings RPC that Read uses
+// to refresh prices, are not reported separately; their failures are
+// reflected in the outcome of the enclosing RPC. Nor are RPCs that fail
+// after Interrupt is called, since the host is not to blame for them.
+func (s *Session) SetRPCObserver(observe func(rpc string, err error)) {
+	s.observe = observe
+}
+
+// observeRPC marks the start of the named RPC. The returned function, which
+// should be deferred, reports the outcome of the RPC to the Session's
+// observer.
+func (s *Session) observeRPC(rpc string, err *error) func() {
+	s.rpcDepth++
+	return func() {
+		s.rpcDepth--
+		if s.rpcDepth == 0 && s.observe != nil && atomic.LoadInt32(&s.interrupted) == 0 {
+			s.observe(rpc, *err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package proto
+
+import (
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+)
+
+// An UnsignedContract is a funded contract transaction awaiting signatures
+// from an offline wallet. The transaction contains a TransactionSignature for
+// each input in ToSign; only the Signature fields need to be filled in.
+//
+// The renter's signatures do not cover the whole transaction, since the host
+// will add its own inputs and outputs after the transaction has been signed.
+// Instead, they cover the file contract, the miner fee, and the renter's own
+// inputs and outputs.
+type UnsignedContract struct {
+	Transaction types.Transaction
+	Parents     []types.Transaction
+	ToSign      []crypto.Hash
+}
+
+// SignRequest returns a SignRequest for the contract transaction, suitable for
+// an ExternalSigner.
+func (uc UnsignedContract) SignRequest() SignRequest {
+	return NewSignRequest(uc.Transaction, uc.ToSign)
+}
+
+// PrepareContract creates an unsigned contract transaction with host, which
+// can be exported to an offline wallet for signing. The resulting contract
+// will have renterPayout coins in the renter output. The SignTransaction
+// method of w is never called, so w may be a watch-only wallet.
+//
+// No connection to the host is made; however, host must contain the host's
+// current settings.
+func PrepareContract(w Wallet, tpool TransactionPool, renterKey ed25519.PublicKey, host hostdb.ScannedHost, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (_ UnsignedContract, err error) {
+	defer wrapErr(&err, "PrepareContract")
+	txn, toSign, err := buildContractTransaction(host, w, tpool, renterKey, renterPayout, startHeight, endHeight)
+	if err != nil {
+		return UnsignedContract{}, err
+	}
+	parents, err := w.UnconfirmedParents(txn)
+	if err != nil {
+		return UnsignedContract{}, err
+	}
+
+	// cover everything the renter added to the transaction; at this point,
+	// that's the whole transaction
+	cf := types.CoveredFields{
+		FileContracts: []uint64{0},
+		MinerFees:     []uint64{0},
+	}
+	for i := range txn.SiacoinInputs {
+		cf.SiacoinInputs = append(cf.SiacoinInputs, uint64(i))
+	}
+	for i := range txn.SiacoinOutputs {
+		cf.SiacoinOutputs = append(cf.SiacoinOutputs, uint64(i))
+	}
+	for _, id := range toSign {
+		txn.TransactionSignatures = append(txn.TransactionSignatures, types.TransactionSignature{
+			ParentID:       id,
+			PublicKeyIndex: 0,
+			CoveredFields:  cf,
+		})
+	}
+	return UnsignedContract{
+		Transaction: txn,
+		Parents:     parents,
+		ToSign:      toSign,
+	}, nil
+}
+
+// FormSignedContract forms a contract with a host, using a transaction
+// prepared by PrepareContract and signed by an offline wallet. key must be the
+// private key corresponding to the renterKey passed to PrepareContract.
+func FormSignedContract(host hostdb.ScannedHost, uc UnsignedContract, signed types.Transaction, key ed25519.PrivateKey) (ContractRevision, []types.Transaction, error) {
+	s, err := NewUnlockedSession(host.NetAddress, host.PublicKey, 0)
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+	s.host = host
+	defer s.Close()
+	return s.FormSignedContract(uc, signed, key)
+}
+
+// FormSignedContract forms a contract with a host, using a transaction
+// prepared by PrepareContract and signed by an offline wallet. key must be the
+// private key corresponding to the renterKey passed to PrepareContract.
+func (s *Session) FormSignedContract(uc UnsignedContract, signed types.Transaction, key ed25519.PrivateKey) (_ ContractRevision, _ []types.Transaction, err error) {
+	defer wrapErr(&err, "FormSignedContract")
+	sigs, err := validateContractSignatures(uc, signed)
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+
+	// send request, without the renter's signatures
+	txn := uc.Transaction
+	txn.TransactionSignatures = nil
+	resp, err := s.sendContractRequest(txn, uc.Parents, key.PublicKey())
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+
+	// merge host additions with txn; since the host's inputs and outputs are
+	// appended, the renter's signatures remain valid
+	txn.SiacoinInputs = append(txn.SiacoinInputs, resp.Inputs...)
+	txn.SiacoinOutputs = append(txn.SiacoinOutputs, resp.Outputs...)
+	txn.TransactionSignatures = sigs
+
+	return s.exchangeContractSignatures(txn, uc.Parents, resp.Parents, key)
+}
+
+// validateContractSignatures checks that signed is uc.Transaction with a valid
+// signature for each input in uc.ToSign, and returns those signatures.
+func validateContractSignatures(uc UnsignedContract, signed types.Transaction) ([]types.TransactionSignature, error) {
+	if signed.ID() != uc.Transaction.ID() {
+		return nil, errors.New("signed transaction does not match unsigned transaction")
+	} else if len(signed.TransactionSignatures) != len(uc.Transaction.TransactionSignatures) {
+		return nil, errors.New("signed transaction has wrong number of signatures")
+	}
+	sigs := make([]types.TransactionSignature, len(signed.TransactionSignatures))
+	for i, sig := range signed.TransactionSignatures {
+		// only the Signature field may differ
+		unsigned := uc.Transaction.TransactionSignatures[i]
+		unsigned.Signature = sig.Signature
+		if !deepEqualSig(sig, unsigned) {
+			return nil, errors.Errorf("signature for %v was modified", sig.ParentID)
+		} else if len(sig.Signature) == 0 {
+			return nil, errors.Errorf("missing signature for %v", sig.ParentID)
+		}
+		if pk, ok := inputPublicKey(signed, sig); ok && !pk.VerifyHash(signed.SigHash(i, types.ASICHardforkHeight+1), sig.Signature) {
+			return nil, errors.Errorf("invalid signature for %v", sig.ParentID)
+		}
+		sigs[i] = sig
+	}
+	return sigs, nil
+}
+
+func deepEqualSig(a, b types.TransactionSignature) bool {
+	return crypto.HashObject(a) == crypto.HashObject(b)
+}
@@ -0,0 +1,116 @@
+package proto
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// A CostBreakdown itemizes the cost of an RPC.
+type CostBreakdown struct {
+	Base         types.Currency
+	Storage      types.Currency
+	Upload       types.Currency
+	Download     types.Currency
+	SectorAccess types.Currency
+	// Collateral is the amount risked by the host. It is not paid by the
+	// renter, and is thus not included in Total.
+	Collateral types.Currency
+}
+
+// Total returns the total amount paid by the renter.
+func (cb CostBreakdown) Total() types.Currency {
+	return cb.Base.Add(cb.Storage).Add(cb.Upload).Add(cb.Download).Add(cb.SectorAccess)
+}
+
+// PriceLimits are the maximum prices that a renter is willing to pay. A zero
+// value indicates no limit.
+type PriceLimits struct {
+	MaxBaseRPCPrice           types.Currency
+	MaxDownloadBandwidthPrice types.Currency
+	MaxSectorAccessPrice      types.Currency
+	MaxStoragePrice           types.Currency
+	MaxUploadBandwidthPrice   types.Currency
+	// MaxRPCCost limits the total cost of any single RPC.
+	MaxRPCCost types.Currency
+	// SettingsCheck, if non-nil, is called with the host's settings before
+	// each paid RPC, and may reject them by returning an error, e.g. the
+	// function returned by hostdb.Scanner.GougingCheck.
+	SettingsCheck func(hostdb.HostSettings) error
+}
+
+// check returns an error if the settings or cost exceed the limits.
+func (pl PriceLimits) check(settings hostdb.HostSettings, cost CostBreakdown) error {
+	if pl.SettingsCheck != nil {
+		if err := pl.SettingsCheck(settings); err != nil {
+			return errors.Wrap(ErrPriceGouging, err.Error())
+		}
+	}
+	limits := []struct {
+		name         string
+		price, limit types.Currency
+	}{
+		{"base RPC price", settings.BaseRPCPrice, pl.MaxBaseRPCPrice},
+		{"download bandwidth price", settings.DownloadBandwidthPrice, pl.MaxDownloadBandwidthPrice},
+		{"sector access price", settings.SectorAccessPrice, pl.MaxSectorAccessPrice},
+		{"storage price", settings.StoragePrice, pl.MaxStoragePrice},
+		{"upload bandwidth price", settings.UploadBandwidthPrice, pl.MaxUploadBandwidthPrice},
+		{"RPC cost", cost.Total(), pl.MaxRPCCost},
+	}
+	for _, l := range limits {
+		if !l.limit.IsZero() && l.price.Cmp(l.limit) > 0 {
+			return errors.Wrapf(ErrPriceGouging, "%v (%v H) exceeds limit (%v H)", l.name, l.price, l.limit)
+		}
+	}
+	return nil
+}
+
+// SetPriceLimits sets the maximum prices that the Session will pay. Before
+// each paid RPC, the host's settings are re-fetched if they are older than
+// ttl, and the cost of the RPC is checked against limits; if a limit is
+// exceeded, the RPC fails with ErrPriceGouging. If ttl is zero, the settings
+// are never re-fetched. If the Session has a SettingsCache, the settings are
+// obtained via CachedSettings instead.
+func (s *Session) SetPriceLimits(limits PriceLimits, ttl time.Duration) {
+	s.limits = &limits
+	s.pricesTTL = ttl
+}
+
+// LastCost returns the cost breakdown of the most recent paid RPC, including
+// RPCs that were rejected for exceeding the Session's price limits.
+func (s *Session) LastCost() CostBreakdown {
+	return s.lastCost
+}
+
+// refreshPrices re-fetches the host's settings if they have expired. If the
+// previous settings were within the Session's price limits and the new
+// settings are not, the host is reported for a price bait-and-switch.
+func (s *Session) refreshPrices() error {
+	if s.limits == nil || s.pricesTTL == 0 || time.Since(s.pricesFetched) < s.pricesTTL {
+		return nil
+	}
+	prev := s.host.HostSettings
+	var err error
+	if s.settingsCache != nil {
+		_, err = s.CachedSettings()
+	} else {
+		_, err = s.Settings()
+	}
+	if err == nil && s.limits.check(prev, CostBreakdown{}) == nil {
+		if err := s.limits.check(s.host.HostSettings, CostBreakdown{}); err != nil {
+			s.misbehaved(hostdb.MisbehaviorPriceBaitAndSwitch, err)
+		}
+	}
+	return err
+}
+
+// checkCost records cost and checks it against the Session's price limits.
+func (s *Session) checkCost(cost CostBreakdown) error {
+	s.lastCost = cost
+	if s.limits == nil {
+		return nil
+	}
+	return s.limits.check(s.host.HostSettings, cost)
+}
@@ -4,6 +4,7 @@ package proto // import "lukechampine.com/us/renter/proto"
 import (
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/encoding"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/us/hostdb"
@@ -88,22 +89,37 @@ func SubmitContractRevision(c ContractRevision, w Wallet, tpool TransactionPool)
 		TransactionSignatures: c.Signatures[:],
 	}
 
-	// add the transaction fee
+	// add the transaction fee and fund it. Since the fee depends on the size
+	// of the transaction, which depends on the number of funding inputs, the
+	// fee is recalculated after funding; if it increased, the transaction is
+	// funded again.
 	_, maxFee, err := tpool.FeeEstimate()
 	if err != nil {
 		return errors.Wrap(err, "could not estimate transaction fee")
 	}
-	fee := maxFee.Mul64(estTxnSize)
-	txn.MinerFees = append(txn.MinerFees, fee)
-
-	// pay for the fee by adding outputs and signing them
 	changeAddr, err := w.NewWalletAddress()
 	if err != nil {
 		return errors.Wrap(err, "could not get a change address to use")
 	}
-	toSign, err := fundSiacoins(&txn, fee, changeAddr, w)
-	if err != nil {
-		return err
+	fee := maxFee.Mul64(estimatedTxnSize(txn))
+	var toSign []crypto.Hash
+	for {
+		txn.MinerFees = []types.Currency{fee}
+		txn.SiacoinInputs, txn.SiacoinOutputs = nil, nil
+		toSign, err = fundSiacoins(&txn, fee, changeAddr, w)
+		if err != nil {
+			return err
+		}
+		actualFee := maxFee.Mul64(estimatedTxnSize(txn))
+		if actualFee.Cmp(fee) <= 0 {
+			// return any overpayment via the change output, if present
+			if n := len(txn.SiacoinOutputs); n > 0 {
+				txn.SiacoinOutputs[n-1].Value = txn.SiacoinOutputs[n-1].Value.Add(fee.Sub(actualFee))
+				txn.MinerFees[0] = actualFee
+			}
+			break
+		}
+		fee = actualFee
 	}
 	if err := w.SignTransaction(&txn, toSign); err != nil {
 		return errors.Wrap(err, "failed to sign transaction")
@@ -115,3 +131,19 @@ func SubmitContractRevision(c ContractRevision, w Wallet, tpool TransactionPool)
 	}
 	return nil
 }
+
+// sizeofTransactionSignature is the encoded size of a TransactionSignature
+// containing an Ed25519 signature.
+var sizeofTransactionSignature = uint64(len(encoding.Marshal(types.TransactionSignature{
+	Signature: make([]byte, crypto.SignatureSize),
+})))
+
+// estimatedTxnSize returns the encoded size of txn after each of its
+// SiacoinInputs has been signed.
+func estimatedTxnSize(txn types.Transaction) uint64 {
+	size := uint64(txn.MarshalSiaSize())
+	for _, sci := range txn.SiacoinInputs {
+		size += sizeofTransactionSignature * sci.UnlockConditions.SignaturesRequired
+	}
+	return size
+}
@@ -0,0 +1,67 @@
+package proto
+
+import (
+	"gitlab.com/NebulousLabs/Sia/crypto"
+)
+
+// DefaultRootBatchSize is the number of sector roots requested per SectorRoots
+// RPC by ReconcileRoots, if no batch size is specified.
+const DefaultRootBatchSize = 1 << 16 // 2 MiB of roots
+
+// A RootDiff reports the differences between the sector roots stored on a host
+// and those stored locally.
+type RootDiff struct {
+	// Missing contains the local roots that the host is not storing.
+	Missing []crypto.Hash
+	// Extra contains the roots that the host is storing, but that are not
+	// known locally.
+	Extra []crypto.Hash
+}
+
+// InSync returns true if the host and local roots contain the same set of
+// sectors.
+func (d RootDiff) InSync() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+// ReconcileRoots downloads the full set of sector roots stored by the host, in
+// batches of batchSize, and compares them to local. The order of the roots is
+// not considered. If batchSize is 0, DefaultRootBatchSize is used.
+func (s *Session) ReconcileRoots(local []crypto.Hash, batchSize int) (_ RootDiff, err error) {
+	defer wrapErr(&err, "ReconcileRoots")
+	if batchSize <= 0 {
+		batchSize = DefaultRootBatchSize
+	}
+	localSet := make(map[crypto.Hash]struct{}, len(local))
+	for _, r := range local {
+		localSet[r] = struct{}{}
+	}
+	var diff RootDiff
+	hostSet := make(map[crypto.Hash]struct{}, s.rev.NumSectors())
+	for offset := 0; offset < s.rev.NumSectors(); offset += batchSize {
+		n := batchSize
+		if rem := s.rev.NumSectors() - offset; n > rem {
+			n = rem
+		}
+		roots, err := s.SectorRoots(offset, n)
+		if err != nil {
+			return RootDiff{}, err
+		}
+		for _, r := range roots {
+			if _, ok := hostSet[r]; ok {
+				continue
+			}
+			hostSet[r] = struct{}{}
+			if _, ok := localSet[r]; !ok {
+				diff.Extra = append(diff.Extra, r)
+			}
+		}
+	}
+	for _, r := range local {
+		if _, ok := hostSet[r]; !ok {
+			diff.Missing = append(diff.Missing, r)
+			hostSet[r] = struct{}{} // guard against duplicates in local
+		}
+	}
+	return diff, nil
+}
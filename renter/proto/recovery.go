@@ -0,0 +1,140 @@
+package proto
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renterhost"
+)
+
+// A Divergence describes a mismatch between the renter's record of a contract
+// and the revision reported by the host.
+type Divergence struct {
+	Local Sequence
+	Host  types.FileContractRevision
+}
+
+// A RecoveryPolicy attempts to recover from a Divergence detected during the
+// Lock RPC. When Recover is called, the contract is locked and the Session's
+// revision is the host's revision, so Recover may call other RPCs. If Recover
+// returns nil, the Session's current revision is accepted as the new
+// committed revision; otherwise, Lock fails with the returned error.
+type RecoveryPolicy interface {
+	Recover(s *Session, d Divergence) error
+}
+
+// SetRecoveryPolicy sets the policy used to recover from divergent revisions.
+// If no policy is set, Lock fails with ErrStaleRevision.
+func (s *Session) SetRecoveryPolicy(p RecoveryPolicy) {
+	s.recovery = p
+}
+
+// recover consults the Session's RecoveryPolicy, if any, after a Divergence
+// is detected.
+func (s *Session) recover(d Divergence) error {
+	if s.recovery == nil {
+		return ErrStaleRevision
+	}
+	if err := s.recovery.Recover(s, d); err != nil {
+		// the policy may have revised the contract before failing, committing
+		// a revision older than the renter's; restore the renter's record, so
+		// that the divergence is detected again on the next Lock
+		if serr := s.seq.SaveSequence(d.Host.ParentID, d.Local); serr != nil {
+			return errors.Wrapf(serr, "could not recover from stale revision (%v) or restore revision sequence", err)
+		}
+		return errors.Wrap(err, "could not recover from stale revision")
+	}
+	return s.commitSequence()
+}
+
+// RollbackPolicy accepts the host's revision if it is at most Max revisions
+// behind the renter's.
+type RollbackPolicy struct {
+	Max uint64
+}
+
+// Recover implements RecoveryPolicy.
+func (p RollbackPolicy) Recover(s *Session, d Divergence) error {
+	if d.Local.RevisionNumber-d.Host.NewRevisionNumber > p.Max {
+		return errors.Errorf("host revision is %v revisions behind (max rollback is %v)", d.Local.RevisionNumber-d.Host.NewRevisionNumber, p.Max)
+	}
+	return nil
+}
+
+// An AppendJournal records sectors appended to contracts.
+type AppendJournal interface {
+	// UnackedAppends returns the sectors appended to the contract after the
+	// specified revision number, in order.
+	UnackedAppends(id types.FileContractID, revisionNumber uint64) ([]*[renterhost.SectorSize]byte, error)
+}
+
+// ReplayPolicy recovers by re-appending any sectors that the host has lost,
+// as reported by Journal.
+type ReplayPolicy struct {
+	Journal AppendJournal
+}
+
+// Recover implements RecoveryPolicy.
+func (p ReplayPolicy) Recover(s *Session, d Divergence) error {
+	sectors, err := p.Journal.UnackedAppends(d.Host.ParentID, d.Host.NewRevisionNumber)
+	if err != nil {
+		return errors.Wrap(err, "could not read append journal")
+	}
+	for _, sector := range sectors {
+		if _, err := s.Append(sector); err != nil {
+			return errors.Wrap(err, "could not replay append")
+		}
+	}
+	return nil
+}
+
+// VerifyRootsPolicy accepts the host's revision if the host's sector roots
+// match those stored locally, as reported by Roots.
+type VerifyRootsPolicy struct {
+	Roots func(id types.FileContractID) ([]crypto.Hash, error)
+}
+
+// Recover implements RecoveryPolicy.
+func (p VerifyRootsPolicy) Recover(s *Session, d Divergence) error {
+	local, err := p.Roots(d.Host.ParentID)
+	if err != nil {
+		return errors.Wrap(err, "could not load local sector roots")
+	} else if len(local) != s.rev.NumSectors() {
+		return errors.Errorf("host has %v sectors, but %v are stored locally", s.rev.NumSectors(), len(local))
+	} else if len(local) == 0 {
+		return nil
+	}
+	host, err := s.SectorRoots(0, len(local))
+	if err != nil {
+		return err
+	}
+	for i := range host {
+		if host[i] != local[i] {
+			return s.misbehaved(hostdb.MisbehaviorCorruptedData, errors.Errorf("host sector root %v does not match local root", i))
+		}
+	}
+	return nil
+}
+
+// A RecoveryChain tries each of its policies in order, stopping at the first
+// that succeeds. Since a policy may revise the contract before failing (e.g.
+// ReplayPolicy may replay some appends), each policy is passed a Divergence
+// reflecting the Session's current revision.
+type RecoveryChain []RecoveryPolicy
+
+// Recover implements RecoveryPolicy.
+func (rc RecoveryChain) Recover(s *Session, d Divergence) error {
+	errs := make([]string, 0, len(rc))
+	for _, p := range rc {
+		d.Host = s.rev.Revision
+		err := p.Recover(s, d)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return errors.New("all recovery policies failed: " + strings.Join(errs, "; "))
+}
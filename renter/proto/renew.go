@@ -31,6 +31,7 @@ func RenewContract(w Wallet, tpool TransactionPool, id types.FileContractID, key
 // already stored with a host.
 func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (_ ContractRevision, _ []types.Transaction, err error) {
 	defer wrapErr(&err, "RenewContract")
+	defer s.observeRPC("RenewContract", &err)()
 	if endHeight < startHeight {
 		return ContractRevision{}, nil, errors.New("end height must be greater than start height")
 	}
@@ -136,7 +137,7 @@ func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout ty
 
 	var resp renterhost.RPCFormContractAdditions
 	if err := s.sess.ReadResponse(&resp, 65536); err != nil {
-		return ContractRevision{}, nil, err
+		return ContractRevision{}, nil, s.wrapResponseErr(err, "couldn't read host additions", "host rejected RenewContract request")
 	}
 
 	// merge host additions with txn
@@ -202,7 +203,7 @@ func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout ty
 	// Read the host signatures.
 	var hostSigs renterhost.RPCFormContractSignatures
 	if err := s.sess.ReadResponse(&hostSigs, 4096); err != nil {
-		return ContractRevision{}, nil, err
+		return ContractRevision{}, nil, s.wrapResponseErr(err, "couldn't read host signatures", "host rejected contract signatures")
 	}
 	txn.TransactionSignatures = append(txn.TransactionSignatures, hostSigs.ContractSignatures...)
 	signedTxnSet := append(resp.Parents, append(parents, txn)...)
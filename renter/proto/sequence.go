@@ -0,0 +1,117 @@
+package proto
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/us/renterhost"
+)
+
+// ErrStaleRevision is returned by the Lock RPC when the host's most recent
+// revision is older than the last revision known to have been committed. This
+// indicates that the host has lost state, or that an old revision is being
+// replayed. See RecoveryPolicy.
+var ErrStaleRevision = errors.New("host revision is older than last committed revision")
+
+// A Sequence records the revision state of a contract, as last observed by the
+// renter. If Pending is non-zero, an operation identified by Token was in
+// flight when the Sequence was recorded, and would have produced a revision
+// with number Pending.
+type Sequence struct {
+	RevisionNumber uint64
+	Pending        uint64
+	Token          crypto.Hash
+}
+
+// A SequenceStore persists the Sequence of each contract, allowing a Session
+// to detect replayed revisions and to avoid re-applying an operation that
+// completed on the host before the renter crashed.
+type SequenceStore interface {
+	LoadSequence(id types.FileContractID) (Sequence, error)
+	SaveSequence(id types.FileContractID, seq Sequence) error
+}
+
+// SetSequenceStore sets the store used to persist the revision sequence of
+// the locked contract. It must be called before Lock in order for the stored
+// sequence to be checked against the host's revision.
+func (s *Session) SetSequenceStore(ss SequenceStore) {
+	s.seq = ss
+}
+
+// syncSequence reconciles the stored sequence of a contract with the revision
+// reported by the host. If an in-flight operation is found to have been applied
+// by the host, its token is remembered so that the operation is not applied
+// again when it is re-issued. If the host's revision is stale, the Session's
+// RecoveryPolicy is consulted.
+func (s *Session) syncSequence(rev types.FileContractRevision) error {
+	s.applied = crypto.Hash{}
+	if s.seq == nil {
+		return nil
+	}
+	seq, err := s.seq.LoadSequence(rev.ParentID)
+	if err != nil {
+		return errors.Wrap(err, "could not load revision sequence")
+	}
+	hostNum := rev.NewRevisionNumber
+	if hostNum < seq.RevisionNumber {
+		return s.recover(Divergence{Local: seq, Host: rev})
+	}
+	if seq.Pending != 0 && hostNum >= seq.Pending {
+		s.applied = seq.Token
+	}
+	seq = Sequence{RevisionNumber: hostNum}
+	if err := s.seq.SaveSequence(rev.ParentID, seq); err != nil {
+		return errors.Wrap(err, "could not save revision sequence")
+	}
+	return nil
+}
+
+// beginSequence records that an operation identified by token is about to
+// produce a new revision.
+func (s *Session) beginSequence(token crypto.Hash) error {
+	if s.seq == nil {
+		return nil
+	}
+	seq := Sequence{
+		RevisionNumber: s.rev.Revision.NewRevisionNumber,
+		Pending:        s.rev.Revision.NewRevisionNumber + 1,
+		Token:          token,
+	}
+	if err := s.seq.SaveSequence(s.rev.ID(), seq); err != nil {
+		return errors.Wrap(err, "could not save revision sequence")
+	}
+	return nil
+}
+
+// commitSequence records the current revision as committed.
+func (s *Session) commitSequence() error {
+	if s.seq == nil {
+		return nil
+	}
+	seq := Sequence{RevisionNumber: s.rev.Revision.NewRevisionNumber}
+	if err := s.seq.SaveSequence(s.rev.ID(), seq); err != nil {
+		return errors.Wrap(err, "could not save revision sequence")
+	}
+	return nil
+}
+
+// WriteToken returns the idempotency token for a set of write actions. Two
+// Write calls with the same token are assumed to be equivalent.
+func WriteToken(actions []renterhost.RPCWriteAction) crypto.Hash {
+	h, _ := blake2b.New256(nil)
+	buf := make([]byte, 24)
+	for _, action := range actions {
+		h.Write(action.Type[:])
+		binary.LittleEndian.PutUint64(buf[0:], action.A)
+		binary.LittleEndian.PutUint64(buf[8:], action.B)
+		binary.LittleEndian.PutUint64(buf[16:], uint64(len(action.Data)))
+		h.Write(buf)
+		h.Write(action.Data)
+	}
+	var token crypto.Hash
+	h.Sum(token[:0])
+	return token
+}
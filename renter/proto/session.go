@@ -1,12 +1,14 @@
 package proto
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/bits"
 	"net"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -19,32 +21,12 @@ import (
 	"lukechampine.com/us/renterhost"
 )
 
-var (
-	// ErrInvalidMerkleProof is returned by various RPCs when the host supplies
-	// an invalid Merkle proof.
-	ErrInvalidMerkleProof = errors.New("host supplied invalid Merkle proof")
-
-	// ErrContractLocked is returned by the Lock RPC when the contract in
-	// question is already locked by another party. This is a transient error;
-	// the caller should retry later.
-	ErrContractLocked = errors.New("contract is locked by another party")
-)
-
-// wrapResponseErr formats RPC response errors nicely, wrapping them in either
-// readCtx or rejectCtx depending on whether we encountered an I/O error or the
-// host sent an explicit error message.
-func wrapResponseErr(err error, readCtx, rejectCtx string) error {
-	err = errors.Cause(err)
-	if _, ok := err.(*renterhost.RPCError); ok {
-		return errors.Wrap(err, rejectCtx)
-	}
-	return errors.Wrap(err, readCtx)
-}
-
 // A Session is an ongoing exchange of RPCs via the renter-host protocol.
 type Session struct {
 	sess        *renterhost.Session
 	conn        net.Conn
+	stats       *sessionStats
+	bw          *bandwidthConn
 	readBuf     [renterhost.SectorSize]byte
 	appendRoots []crypto.Hash
 
@@ -52,6 +34,32 @@ type Session struct {
 	height types.BlockHeight
 	rev    ContractRevision
 	key    ed25519.PrivateKey
+
+	seq      SequenceStore
+	applied  crypto.Hash
+	recovery RecoveryPolicy
+
+	final       *finalBroadcast
+	finalRevNum uint64
+
+	readOnly bool
+	acct     *Account
+
+	limits        *PriceLimits
+	pricesTTL     time.Duration
+	pricesFetched time.Time
+	lastCost      CostBreakdown
+	settingsCache *SettingsCache
+
+	sigs *SignatureBatcher
+
+	check       func(types.FileContractID) error
+	report      func(hostdb.MisbehaviorKind, string)
+	observe     func(string, error)
+	rpcDepth    int
+	interrupted int32 // atomic
+
+	shape renterhost.TrafficShape
 }
 
 // HostKey returns the public key of the host.
@@ -60,25 +68,120 @@ func (s *Session) HostKey() hostdb.HostPublicKey { return s.host.PublicKey }
 // Revision returns the most recent revision of the locked contract.
 func (s *Session) Revision() ContractRevision { return s.rev }
 
+// Compressed reports whether RPC messages sent over the Session are
+// compressed.
+func (s *Session) Compressed() bool { return s.sess.Compressed() }
+
+// Features returns the protocol features supported by the host, as determined
+// by the version in its most recent settings. It returns false if the version
+// is unknown, e.g. because Settings has not been called.
+func (s *Session) Features() (hostdb.ProtocolFeatures, bool) {
+	return s.host.HostSettings.Features()
+}
+
+// requireFeature returns ErrUnsupportedFeature if the host's version is known
+// and supported returns false for its features. Hosts of unknown version are
+// given the benefit of the doubt.
+func (s *Session) requireFeature(supported func(hostdb.ProtocolFeatures) bool) error {
+	if f, ok := s.Features(); ok && !supported(f) {
+		return ErrUnsupportedFeature
+	}
+	return nil
+}
+
+func supportsReadOnlyLock(f hostdb.ProtocolFeatures) bool      { return f.ReadOnlyLock }
+func supportsEphemeralAccounts(f hostdb.ProtocolFeatures) bool { return f.EphemeralAccounts }
+
 func (s *Session) extendDeadline(d time.Duration) {
 	_ = s.conn.SetDeadline(time.Now().Add(d))
 }
 
-// call is a helper method that writes a request and then reads a response.
-func (s *Session) call(rpcID renterhost.Specifier, req, resp renterhost.ProtocolObject) error {
+// ExtendDeadline extends the deadline of the underlying connection by d. RPCs
+// implemented by this package extend the deadline automatically; callers using
+// RawSession should do so as well.
+func (s *Session) ExtendDeadline(d time.Duration) { s.extendDeadline(d) }
+
+// Interrupt causes any RPC in progress on the Session to fail promptly, by
+// setting the deadline of the underlying connection to the past. It may be
+// called concurrently with other methods. Since the interrupted RPC may leave
+// the session in an inconsistent state, the Session should be closed
+// afterward.
+func (s *Session) Interrupt() {
+	atomic.StoreInt32(&s.interrupted, 1)
+	_ = s.conn.SetDeadline(time.Unix(1, 0))
+}
+
+// RawSession returns the underlying renterhost.Session, allowing callers to
+// implement RPCs that this package does not support. Callers are responsible
+// for maintaining the integrity of the session; in particular, any changes to
+// the locked contract must be reported via SetRevision.
+func (s *Session) RawSession() *renterhost.Session { return s.sess }
+
+// Call writes an RPC request and reads the host's response, which may be at
+// most maxLen bytes. It is a convenience method for implementing simple
+// request-response RPCs; see RawSession.
+func (s *Session) Call(rpcID renterhost.Specifier, req, resp renterhost.ProtocolObject, maxLen uint64) error {
 	if err := s.sess.WriteRequest(rpcID, req); err != nil {
 		return err
 	}
+	err := s.sess.ReadResponse(resp, maxLen)
+	return s.wrapResponseErr(err, fmt.Sprintf("couldn't read %v response", rpcID), fmt.Sprintf("host rejected %v request", rpcID))
+}
+
+// SignRevision signs rev with the renter key of the locked contract.
+func (s *Session) SignRevision(rev types.FileContractRevision) []byte {
+	return s.key.SignHash(renterhost.HashRevision(rev))
+}
+
+// SetRevision replaces the Session's record of the locked contract's revision.
+// Both signatures are verified, and the revision must have a higher revision
+// number than the current revision.
+func (s *Session) SetRevision(rev ContractRevision) error {
+	revHash := renterhost.HashRevision(rev.Revision)
+	if rev.ID() != s.rev.ID() {
+		return errors.New("revision is for a different contract")
+	} else if rev.Revision.NewRevisionNumber <= s.rev.Revision.NewRevisionNumber {
+		return errors.New("revision number must increase")
+	} else if !s.key.PublicKey().VerifyHash(revHash, rev.Signatures[0].Signature) {
+		return errors.New("renter's signature on revision is invalid")
+	} else if !s.host.PublicKey.VerifyHash(revHash, rev.Signatures[1].Signature) {
+		return errors.New("host's signature on revision is invalid")
+	}
+	s.rev = rev
+	return s.commitSequence()
+}
+
+// SetContractCheck sets a function that is called with the ID of the locked
+// contract before each RPC that revises it. If the function returns an error,
+// the RPC is aborted. This allows RPCs to fail promptly if the contract is
+// known to be unusable, e.g. because its formation transaction was reorged out
+// of the blockchain.
+func (s *Session) SetContractCheck(check func(types.FileContractID) error) {
+	s.check = check
+}
+
+func (s *Session) checkContract() error {
+	if s.check == nil {
+		return nil
+	}
+	return s.check(s.rev.ID())
+}
+
+// call is a helper method that writes a request and then reads a response.
+func (s *Session) call(rpcID renterhost.Specifier, req, resp renterhost.ProtocolObject) error {
 	// use a maxlen large enough for all RPCs except Read and Write (which don't
 	// use call anyway)
-	err := s.sess.ReadResponse(resp, 4096)
-	return wrapResponseErr(err, fmt.Sprintf("couldn't read %v response", rpcID), fmt.Sprintf("host rejected %v request", rpcID))
+	start := time.Now()
+	if err := s.Call(rpcID, req, resp, 4096); err != nil {
+		return err
+	}
+	s.stats.recordRTT(time.Since(start))
+	return nil
 }
 
-// Lock calls the Lock RPC, locking the supplied contract and synchronizing its
-// state with the host's most recent revision.
-func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey) (err error) {
-	defer wrapErr(&err, "Lock")
+// lock calls the specified variant of the Lock RPC and verifies the
+// revision returned by the host.
+func (s *Session) lock(rpcID renterhost.Specifier, id types.FileContractID, key ed25519.PrivateKey) (renterhost.RPCLockResponse, error) {
 	req := &renterhost.RPCLockRequest{
 		ContractID: id,
 		Signature:  s.sess.SignChallenge(key),
@@ -86,21 +189,32 @@ func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey) (err err
 	}
 	s.extendDeadline(15 * time.Second)
 	var resp renterhost.RPCLockResponse
-	if err := s.call(renterhost.RPCLockID, req, &resp); err != nil {
-		return err
+	if err := s.call(rpcID, req, &resp); err != nil {
+		return renterhost.RPCLockResponse{}, err
 	}
 	s.sess.SetChallenge(resp.NewChallenge)
 	// verify claimed revision
 	if len(resp.Signatures) != 2 {
-		return errors.Errorf("host returned wrong number of signatures (expected 2, got %v)", len(resp.Signatures))
+		return renterhost.RPCLockResponse{}, errors.Errorf("host returned wrong number of signatures (expected 2, got %v)", len(resp.Signatures))
 	}
 	revHash := renterhost.HashRevision(resp.Revision)
 	if !key.PublicKey().VerifyHash(revHash, resp.Signatures[0].Signature) {
-		return errors.New("renter's signature on claimed revision is invalid")
+		return renterhost.RPCLockResponse{}, errors.New("renter's signature on claimed revision is invalid")
 	} else if !s.host.PublicKey.VerifyHash(revHash, resp.Signatures[1].Signature) {
-		return errors.New("host's signature on claimed revision is invalid")
+		return renterhost.RPCLockResponse{}, errors.New("host's signature on claimed revision is invalid")
 	}
-	if !resp.Acquired {
+	return resp, nil
+}
+
+// Lock calls the Lock RPC, locking the supplied contract and synchronizing its
+// state with the host's most recent revision.
+func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey) (err error) {
+	defer wrapErr(&err, "Lock")
+	defer s.observeRPC("Lock", &err)()
+	resp, err := s.lock(renterhost.RPCLockID, id, key)
+	if err != nil {
+		return err
+	} else if !resp.Acquired {
 		return ErrContractLocked
 	}
 	s.rev = ContractRevision{
@@ -108,7 +222,43 @@ func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey) (err err
 		Signatures: [2]types.TransactionSignature{resp.Signatures[0], resp.Signatures[1]},
 	}
 	s.key = key
+	s.finalRevNum = resp.Revision.NewRevisionNumber
+	s.readOnly, s.acct = false, nil
+
+	if err := s.syncSequence(resp.Revision); err != nil {
+		// don't leave the contract locked with an unsynchronized revision,
+		// and don't broadcast it either
+		s.releaseLock()
+		s.rev = ContractRevision{}
+		s.key = nil
+		return err
+	}
+	return nil
+}
 
+// LockReadOnly calls the LockReadOnly RPC, which grants access to the supplied
+// contract without locking it exclusively. This allows multiple Sessions to
+// download from the same contract concurrently. The contract cannot be
+// modified; in particular, Read is paid for by withdrawing from acct rather
+// than revising the contract.
+func (s *Session) LockReadOnly(id types.FileContractID, key ed25519.PrivateKey, acct *Account) (err error) {
+	defer wrapErr(&err, "LockReadOnly")
+	defer s.observeRPC("LockReadOnly", &err)()
+	if err := s.requireFeature(supportsReadOnlyLock); err != nil {
+		return err
+	}
+	resp, err := s.lock(renterhost.RPCLockReadOnlyID, id, key)
+	if err != nil {
+		return err
+	} else if !resp.Acquired {
+		return ErrReadOnlyRefused
+	}
+	s.rev = ContractRevision{
+		Revision:   resp.Revision,
+		Signatures: [2]types.TransactionSignature{resp.Signatures[0], resp.Signatures[1]},
+	}
+	s.key = nil
+	s.readOnly, s.acct = true, acct
 	return nil
 }
 
@@ -118,21 +268,38 @@ func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey) (err err
 // automatically unlock any locked contracts when the connection closes.
 func (s *Session) Unlock() (err error) {
 	defer wrapErr(&err, "Unlock")
-	if s.key == nil {
+	defer s.observeRPC("Unlock", &err)()
+	if s.readOnly {
+		// nothing to unlock
+		s.rev = ContractRevision{}
+		s.readOnly, s.acct = false, nil
+		return nil
+	} else if s.key == nil {
 		return errors.New("no contract locked")
 	}
+	broadcastErr := s.broadcastFinalRevision()
+	if err := s.releaseLock(); err != nil {
+		return err
+	}
+	return broadcastErr
+}
+
+// releaseLock calls the Unlock RPC without broadcasting the final revision.
+func (s *Session) releaseLock() error {
 	s.extendDeadline(10 * time.Second)
 	if err := s.sess.WriteRequest(renterhost.RPCUnlockID, nil); err != nil {
 		return err
 	}
 	s.rev = ContractRevision{}
 	s.key = nil
+	s.applied = crypto.Hash{}
 	return nil
 }
 
 // Settings calls the Settings RPC, returning the host's reported settings.
 func (s *Session) Settings() (_ hostdb.HostSettings, err error) {
 	defer wrapErr(&err, "Settings")
+	defer s.observeRPC("Settings", &err)()
 	s.extendDeadline(10 * time.Second)
 	var resp renterhost.RPCSettingsResponse
 	if err := s.call(renterhost.RPCSettingsID, nil, &resp); err != nil {
@@ -140,6 +307,10 @@ func (s *Session) Settings() (_ hostdb.HostSettings, err error) {
 	} else if err := json.Unmarshal(resp.Settings, &s.host.HostSettings); err != nil {
 		return hostdb.HostSettings{}, errors.Wrap(err, "couldn't unmarshal json")
 	}
+	s.pricesFetched = time.Now()
+	if s.settingsCache != nil {
+		s.settingsCache.store(s.host.PublicKey, s.host.HostSettings, false)
+	}
 	return s.host.HostSettings, nil
 }
 
@@ -147,10 +318,17 @@ func (s *Session) Settings() (_ hostdb.HostSettings, err error) {
 // sector Merkle roots of the currently-locked contract.
 func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 	defer wrapErr(&err, "SectorRoots")
-	if offset < 0 || n < 0 || offset+n > s.rev.NumSectors() {
+	defer s.observeRPC("SectorRoots", &err)()
+	if s.readOnly {
+		return nil, ErrReadOnly
+	} else if offset < 0 || n < 0 || offset+n > s.rev.NumSectors() {
 		return nil, errors.New("requested range is out-of-bounds")
 	} else if n == 0 {
 		return nil, nil
+	} else if err := s.checkContract(); err != nil {
+		return nil, err
+	} else if err := s.refreshPrices(); err != nil {
+		return nil, err
 	}
 
 	// calculate price
@@ -159,10 +337,16 @@ func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 	if bandwidth < renterhost.MinMessageSize {
 		bandwidth = renterhost.MinMessageSize
 	}
-	bandwidthPrice := s.host.DownloadBandwidthPrice.Mul64(uint64(bandwidth))
-	price := s.host.BaseRPCPrice.Add(bandwidthPrice)
+	cost := CostBreakdown{
+		Base:     s.host.BaseRPCPrice,
+		Download: s.host.DownloadBandwidthPrice.Mul64(uint64(bandwidth)),
+	}
+	if err := s.checkCost(cost); err != nil {
+		return nil, err
+	}
+	price := cost.Total()
 	if s.rev.RenterFunds().Cmp(price) < 0 {
-		return nil, errors.New("contract has insufficient funds to support sector roots download")
+		return nil, ErrInsufficientRenterFunds
 	}
 
 	// construct new revision
@@ -181,27 +365,26 @@ func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 		Signature:            s.key.SignHash(renterhost.HashRevision(rev)),
 	}
 	var resp renterhost.RPCSectorRootsResponse
-	if err := s.call(renterhost.RPCSectorRootsID, req, &resp); err != nil {
+	if err := s.Call(renterhost.RPCSectorRootsID, req, &resp, 4096+uint64(bandwidth)); err != nil {
+		return nil, err
+	} else if err := s.verifyHostSignature(rev, resp.Signature); err != nil {
 		return nil, err
 	}
 	s.rev.Revision = rev
 	s.rev.Signatures[0].Signature = req.Signature
 	s.rev.Signatures[1].Signature = resp.Signature
+	if err := s.commitSequence(); err != nil {
+		return nil, err
+	}
 	if !merkle.VerifySectorRangeProof(resp.MerkleProof, resp.SectorRoots, offset, offset+n, s.rev.NumSectors(), rev.NewFileMerkleRoot) {
-		return nil, ErrInvalidMerkleProof
+		return nil, s.misbehaved(hostdb.MisbehaviorInvalidProof, ErrInvalidMerkleProof)
 	}
 	return resp.SectorRoots, nil
 }
 
-// Read calls the Read RPC, writing the requested sections of sector data to w.
-// Merkle proofs are always requested.
-func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection) (err error) {
-	defer wrapErr(&err, "Read")
-	if len(sections) == 0 {
-		return nil
-	}
-
-	// calculate price
+// readCost returns the cost of reading the specified sections, along with the
+// estimated bandwidth required.
+func (s *Session) readCost(sections []renterhost.RPCReadRequestSection) (CostBreakdown, uint64) {
 	sectorAccesses := make(map[crypto.Hash]struct{})
 	for _, sec := range sections {
 		sectorAccesses[sec.MerkleRoot] = struct{}{}
@@ -217,10 +400,38 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 	if bandwidth < renterhost.MinMessageSize {
 		bandwidth = renterhost.MinMessageSize
 	}
-	bandwidthPrice := s.host.DownloadBandwidthPrice.Mul64(bandwidth)
-	price := s.host.BaseRPCPrice.Add(sectorAccessPrice).Add(bandwidthPrice)
+	return CostBreakdown{
+		Base:         s.host.BaseRPCPrice,
+		Download:     s.host.DownloadBandwidthPrice.Mul64(bandwidth),
+		SectorAccess: sectorAccessPrice,
+	}, bandwidth
+}
+
+// Read calls the Read RPC, writing the requested sections of sector data to w.
+// Merkle proofs are always requested.
+func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection) (err error) {
+	defer wrapErr(&err, "Read")
+	defer s.observeRPC("Read", &err)()
+	if len(sections) == 0 {
+		return nil
+	} else if s.readOnly {
+		return s.ReadWithAccount(w, s.acct, sections)
+	}
+	w, sections = s.alignSections(w, sections)
+
+	// calculate price
+	if err := s.checkContract(); err != nil {
+		return err
+	} else if err := s.refreshPrices(); err != nil {
+		return err
+	}
+	cost, bandwidth := s.readCost(sections)
+	if err := s.checkCost(cost); err != nil {
+		return err
+	}
+	price := cost.Total()
 	if s.rev.RenterFunds().Cmp(price) < 0 {
-		return errors.New("contract has insufficient funds to support download")
+		return ErrInsufficientRenterFunds
 	}
 
 	// construct new revision
@@ -231,6 +442,7 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 
 	// send request
 	s.extendDeadline(60*time.Second + time.Duration(bandwidth)/time.Microsecond)
+	defer s.stats.measureTransfer(false)()
 	req := &renterhost.RPCReadRequest{
 		Sections:    sections,
 		MerkleProof: true,
@@ -253,7 +465,7 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 	var hostSig []byte
 	for _, sec := range sections {
 		if err := s.sess.ReadResponse(&resp, 4096+uint64(sec.Length)); err != nil {
-			return wrapResponseErr(err, "couldn't read sector data", "host rejected Read request")
+			return s.wrapResponseErr(err, "couldn't read sector data", "host rejected Read request")
 		}
 		// The host may have sent data, a signature, or both. If they sent data,
 		// validate it.
@@ -264,7 +476,7 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 			proofStart := int(sec.Offset) / merkle.SegmentSize
 			proofEnd := int(sec.Offset+sec.Length) / merkle.SegmentSize
 			if !merkle.VerifyProof(resp.MerkleProof, resp.Data, proofStart, proofEnd, sec.MerkleRoot) {
-				return ErrInvalidMerkleProof
+				return s.misbehaved(hostdb.MisbehaviorInvalidProof, ErrInvalidMerkleProof)
 			}
 			if _, err := w.Write(resp.Data); err != nil {
 				return errors.Wrap(err, "couldn't write sector data")
@@ -282,24 +494,52 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 		// yet, they should send an empty ReadResponse containing just the
 		// signature.
 		if err := s.sess.ReadResponse(&resp, 4096); err != nil {
-			return wrapResponseErr(err, "couldn't read signature", "host rejected Read request")
+			return s.wrapResponseErr(err, "couldn't read signature", "host rejected Read request")
 		}
 		hostSig = resp.Signature
 	}
+	if err := s.verifyHostSignature(rev, hostSig); err != nil {
+		return err
+	}
 
 	s.rev.Revision = rev
 	s.rev.Signatures[0].Signature = renterSig
 	s.rev.Signatures[1].Signature = hostSig
 
-	return nil
+	return s.commitSequence()
 }
 
 // Write implements the Write RPC, except for ActionUpdate. A Merkle proof is
 // always requested.
 func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	defer wrapErr(&err, "Write")
+	defer s.observeRPC("Write", &err)()
+	return s.write(actions, nil)
+}
+
+// write implements Write. If verifyRoot is non-nil, it is called with the
+// host's new Merkle root before the new revision is signed.
+func (s *Session) write(actions []renterhost.RPCWriteAction, verifyRoot func(crypto.Hash) bool) error {
 	if len(actions) == 0 {
 		return nil
+	} else if s.readOnly {
+		return ErrReadOnly
+	} else if err := s.checkContract(); err != nil {
+		return err
+	} else if err := s.refreshPrices(); err != nil {
+		return err
+	}
+	if s.seq != nil {
+		token := WriteToken(actions)
+		if token == s.applied {
+			// the host applied these actions before we could record the new
+			// revision; don't apply them again
+			s.applied = crypto.Hash{}
+			s.appendRoots = merkle.PrecomputeAppendRoots(actions)
+			return nil
+		} else if err := s.beginSequence(token); err != nil {
+			return err
+		}
 	}
 	rev := s.rev.Revision
 
@@ -341,14 +581,22 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	// TODO: calculate exact sizes
 	proofSize := merkle.DiffProofSize(actions, s.rev.NumSectors())
 	downloadBandwidth := uint64(proofSize) * crypto.HashSize
-	bandwidthPrice := s.host.UploadBandwidthPrice.Mul64(uploadBandwidth).Add(s.host.DownloadBandwidthPrice.Mul64(downloadBandwidth))
+	cost := CostBreakdown{
+		Base:       s.host.BaseRPCPrice,
+		Storage:    storagePrice,
+		Upload:     s.host.UploadBandwidthPrice.Mul64(uploadBandwidth),
+		Download:   s.host.DownloadBandwidthPrice.Mul64(downloadBandwidth),
+		Collateral: collateral,
+	}
+	if err := s.checkCost(cost); err != nil {
+		return err
+	}
 
 	// check that enough funds are available
-	price := s.host.BaseRPCPrice.Add(bandwidthPrice).Add(storagePrice)
 	// NOTE: hosts can be picky about price, so add 5% just to be sure.
-	price = price.MulFloat(1.05)
+	price := cost.Total().MulFloat(1.05)
 	if rev.NewValidProofOutputs[0].Value.Cmp(price) < 0 {
-		return errors.New("contract has insufficient funds to support modification")
+		return ErrInsufficientRenterFunds
 	}
 
 	// cap the collateral to whatever is left; no sense complaining if there is
@@ -372,6 +620,7 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 
 	// send request
 	s.extendDeadline(60*time.Second + time.Duration(uploadBandwidth)/time.Microsecond)
+	defer s.stats.measureTransfer(true)()
 	req := &renterhost.RPCWriteRequest{
 		Actions:     actions,
 		MerkleProof: true,
@@ -387,7 +636,7 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	// read and verify Merkle proof
 	var merkleResp renterhost.RPCWriteMerkleProof
 	if err := s.sess.ReadResponse(&merkleResp, 4096); err != nil {
-		return wrapResponseErr(err, "couldn't read Merkle proof response", "host rejected Write request")
+		return s.wrapResponseErr(err, "couldn't read Merkle proof response", "host rejected Write request")
 	}
 	proofHashes := merkleResp.OldSubtreeHashes
 	leafHashes := merkleResp.OldLeafHashes
@@ -398,7 +647,11 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	// they valid?) and reconcile those with our Merkle algorithms.
 	<-precompChan
 	if newFileSize > 0 && !merkle.VerifyDiffProof(actions, s.rev.NumSectors(), proofHashes, leafHashes, oldRoot, newRoot, s.appendRoots) {
-		err := ErrInvalidMerkleProof
+		err := s.misbehaved(hostdb.MisbehaviorInvalidProof, ErrInvalidMerkleProof)
+		s.sess.WriteResponse(nil, err)
+		return err
+	} else if verifyRoot != nil && !verifyRoot(newRoot) {
+		err := s.misbehaved(hostdb.MisbehaviorInvalidProof, ErrInvalidMerkleProof)
 		s.sess.WriteResponse(nil, err)
 		return err
 	}
@@ -415,14 +668,16 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	}
 	var hostSig renterhost.RPCWriteResponse
 	if err := s.sess.ReadResponse(&hostSig, 4096); err != nil {
-		return wrapResponseErr(err, "couldn't read signature response", "host rejected Write signature")
+		return s.wrapResponseErr(err, "couldn't read signature response", "host rejected Write signature")
+	} else if err := s.verifyHostSignature(rev, hostSig.Signature); err != nil {
+		return err
 	}
 
 	s.rev.Revision = rev
 	s.rev.Signatures[0].Signature = renterSig.Signature
 	s.rev.Signatures[1].Signature = hostSig.Signature
 
-	return nil
+	return s.commitSequence()
 }
 
 // Append calls the Write RPC with a single action, appending the provided
@@ -438,6 +693,42 @@ func (s *Session) Append(sector *[renterhost.SectorSize]byte) (crypto.Hash, erro
 	return s.appendRoots[0], nil
 }
 
+// AppendBatch calls the Write RPC, appending the provided sectors, and returns
+// their Merkle roots. If the host rejects the batch for lack of storage,
+// AppendBatch appends the sectors one at a time until the host's storage is
+// exhausted. In that case, the sectors that were stored are committed to the
+// contract, and a *PartialAppendError identifying the remaining sectors is
+// returned along with the roots of the stored sectors.
+func (s *Session) AppendBatch(sectors []*[renterhost.SectorSize]byte) ([]crypto.Hash, error) {
+	actions := make([]renterhost.RPCWriteAction, len(sectors))
+	for i := range actions {
+		actions[i] = renterhost.RPCWriteAction{
+			Type: renterhost.RPCWriteActionAppend,
+			Data: sectors[i][:],
+		}
+	}
+	err := s.Write(actions)
+	if err == nil {
+		return append([]crypto.Hash(nil), s.appendRoots...), nil
+	} else if errors.Cause(err) != ErrHostOutOfStorage {
+		return nil, err
+	}
+
+	roots := make([]crypto.Hash, 0, len(sectors))
+	for i, sector := range sectors {
+		root, err := s.Append(sector)
+		if err != nil {
+			pe := &PartialAppendError{Stored: roots, Err: err}
+			for j := i; j < len(sectors); j++ {
+				pe.NotStored = append(pe.NotStored, j)
+			}
+			return roots, pe
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
 // DeleteSectors calls the Write RPC with a set of Swap and Trim actions that
 // delete the specified sectors.
 func (s *Session) DeleteSectors(roots []crypto.Hash) error {
@@ -498,10 +789,44 @@ func (s *Session) DeleteSectors(roots []crypto.Hash) error {
 	return s.Write(actions)
 }
 
+// TrimSectors calls the Write RPC with a single Trim action, removing the last
+// n sectors from the contract. roots must be the current sector roots of the
+// contract. Before the new revision is signed, the host's new Merkle root is
+// compared to the root of the remaining sectors, which are returned.
+func (s *Session) TrimSectors(n int, roots []crypto.Hash) (_ []crypto.Hash, err error) {
+	defer wrapErr(&err, "TrimSectors")
+	defer s.observeRPC("TrimSectors", &err)()
+	if n == 0 {
+		return roots, nil
+	} else if n < 0 || n > len(roots) {
+		return nil, errors.New("invalid number of sectors to trim")
+	} else if len(roots) != s.rev.NumSectors() || merkle.MetaRoot(roots) != s.rev.Revision.NewFileMerkleRoot {
+		return nil, errors.New("supplied sector roots do not match contract")
+	}
+	remaining := roots[:len(roots)-n]
+	expected := merkle.MetaRoot(remaining)
+	err = s.write([]renterhost.RPCWriteAction{{
+		Type: renterhost.RPCWriteActionTrim,
+		A:    uint64(n),
+	}}, func(newRoot crypto.Hash) bool {
+		return newRoot == expected
+	})
+	if err != nil {
+		return nil, err
+	}
+	return remaining, nil
+}
+
 // Close gracefully terminates the session and closes the underlying connection.
+// If SetFinalBroadcast was called, the latest revision of the locked contract
+// may be submitted first.
 func (s *Session) Close() (err error) {
 	defer wrapErr(&err, "Close")
-	return s.sess.Close()
+	broadcastErr := s.broadcastFinalRevision()
+	if err := s.sess.Close(); err != nil {
+		return err
+	}
+	return broadcastErr
 }
 
 // NewSession initiates a new renter-host protocol session with the specified
@@ -537,8 +862,99 @@ func newUnlockedSession(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey,
 	if err != nil {
 		return nil, err
 	}
+	return newSessionOverConn(conn, hostKey, currentHeight, false)
+}
+
+// NewUnlockedCompressedSession is like NewUnlockedSession, but proposes that
+// RPC messages be compressed. Compression is most effective for RPCs with
+// highly-redundant payloads, such as settings and sector root lists. If the
+// host does not support compression, the session falls back to uncompressed
+// messages; see Session.Compressed.
+func NewUnlockedCompressedSession(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (_ *Session, err error) {
+	defer wrapErr(&err, "NewUnlockedCompressedSession")
+	conn, err := net.Dial("tcp", string(hostIP))
+	if err != nil {
+		return nil, err
+	}
+	return newSessionOverConn(conn, hostKey, currentHeight, true)
+}
+
+// DialSession initiates a new renter-host protocol session with a host that
+// may be reachable at multiple addresses, using d to dial them. Like
+// NewUnlockedSession, no contract is locked and the host's settings are not
+// requested.
+func DialSession(ctx context.Context, d *hostdb.Dialer, hostKey hostdb.HostPublicKey, addrs []modules.NetAddress, currentHeight types.BlockHeight) (_ *Session, err error) {
+	defer wrapErr(&err, "DialSession")
+	conn, _, err := d.Dial(ctx, hostKey, addrs)
+	if err != nil {
+		return nil, err
+	}
+	return newSessionOverConn(conn, hostKey, currentHeight, false)
+}
+
+// NewMuxedSession initiates a new renter-host protocol session over a new
+// stream of m. The supplied contract will be locked and synchronized with the
+// host. The host's settings will also be requested.
+func NewMuxedSession(m *renterhost.Mux, hostKey hostdb.HostPublicKey, id types.FileContractID, key ed25519.PrivateKey, currentHeight types.BlockHeight) (_ *Session, err error) {
+	defer wrapErr(&err, "NewMuxedSession")
+	s, err := newUnlockedMuxedSession(m, hostKey, currentHeight)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Lock(id, key); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := s.Settings(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewUnlockedMuxedSession initiates a new renter-host protocol session over a
+// new stream of m, without locking an associated contract or requesting the
+// host's settings.
+func NewUnlockedMuxedSession(m *renterhost.Mux, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (_ *Session, err error) {
+	defer wrapErr(&err, "NewUnlockedMuxedSession")
+	return newUnlockedMuxedSession(m, hostKey, currentHeight)
+}
+
+func newUnlockedMuxedSession(m *renterhost.Mux, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (*Session, error) {
+	stream, err := m.DialStream()
+	if err != nil {
+		return nil, err
+	}
+	return newSessionOverConn(stream, hostKey, currentHeight, false)
+}
+
+// DialMux initiates a multiplexed connection with the specified host. Sessions
+// can be created over the connection with NewMuxedSession.
+func DialMux(hostIP modules.NetAddress) (*renterhost.Mux, error) {
+	conn, err := net.Dial("tcp", string(hostIP))
+	if err != nil {
+		return nil, errors.Wrap(err, "DialMux")
+	}
+	m, err := renterhost.NewRenterMux(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "DialMux")
+	}
+	return m, nil
+}
+
+func newSessionOverConn(conn net.Conn, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight, compress bool) (*Session, error) {
+	stats := new(sessionStats)
+	bw := &bandwidthConn{Conn: statsConn{conn, stats}}
+	conn = bw
 	conn.SetDeadline(time.Now().Add(60 * time.Second))
-	s, err := renterhost.NewRenterSession(conn, hostKey)
+	var s *renterhost.Session
+	var err error
+	if compress {
+		s, err = renterhost.NewRenterSessionCompressed(conn, hostKey)
+	} else {
+		s, err = renterhost.NewRenterSession(conn, hostKey)
+	}
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -546,6 +962,8 @@ func newUnlockedSession(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey,
 	return &Session{
 		sess:   s,
 		conn:   conn,
+		stats:  stats,
+		bw:     bw,
 		height: currentHeight,
 		host: hostdb.ScannedHost{
 			PublicKey: hostKey,
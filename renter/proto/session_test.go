@@ -2,14 +2,22 @@ package proto
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/encoding"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
 	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/internal/ghost"
 	"lukechampine.com/us/renterhost"
 )
@@ -103,6 +111,605 @@ func TestSession(t *testing.T) {
 	}
 }
 
+func TestTrimSectors(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	var roots []crypto.Hash
+	for i := 0; i < 3; i++ {
+		sector := [renterhost.SectorSize]byte{0: byte(i)}
+		root, err := renter.Append(&sector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, root)
+	}
+
+	if _, err := renter.TrimSectors(1, roots[:2]); err == nil {
+		t.Fatal("expected mismatched roots to be rejected")
+	}
+	remaining, err := renter.TrimSectors(2, roots)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(remaining) != 1 || renter.Revision().NumSectors() != 1 {
+		t.Fatal("sectors were not trimmed")
+	}
+	if remaining, err = renter.TrimSectors(1, remaining); err != nil {
+		t.Fatal(err)
+	} else if len(remaining) != 0 || renter.Revision().NumSectors() != 0 {
+		t.Fatal("sectors were not trimmed")
+	}
+}
+
+func TestAppendBatch(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	sectors := make([]*[renterhost.SectorSize]byte, 3)
+	for i := range sectors {
+		sectors[i] = &[renterhost.SectorSize]byte{0: byte(i)}
+	}
+	roots, err := renter.AppendBatch(sectors[:1])
+	if err != nil {
+		t.Fatal(err)
+	} else if len(roots) != 1 {
+		t.Fatal("wrong number of roots:", len(roots))
+	}
+
+	// host can only store one more sector
+	host.SetMaxSectors(2)
+	roots, err = renter.AppendBatch(sectors[1:])
+	pe, ok := err.(*PartialAppendError)
+	if !ok {
+		t.Fatal("expected PartialAppendError, got", err)
+	} else if errors.Cause(pe.Err) != ErrHostOutOfStorage {
+		t.Fatal("expected ErrHostOutOfStorage, got", pe.Err)
+	} else if len(roots) != 1 || len(pe.Stored) != 1 || len(pe.NotStored) != 1 || pe.NotStored[0] != 1 {
+		t.Fatal("wrong partial result:", roots, pe.NotStored)
+	} else if renter.Revision().NumSectors() != 2 {
+		t.Fatal("stored sectors were not committed")
+	}
+
+	// session should still be usable
+	hostRoots, err := renter.SectorRoots(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if hostRoots[1] != roots[0] {
+		t.Fatal("host has wrong sector root")
+	}
+}
+
+func TestHostErrors(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	err := renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: crypto.Hash{1},
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if errors.Cause(err) != ErrSectorNotFound {
+		t.Fatal("expected ErrSectorNotFound, got", err)
+	} else if IsRetryable(err) {
+		t.Fatal("sector not found should not be retryable")
+	}
+
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{ErrContractLocked, true},
+		{errors.Wrap(io.ErrUnexpectedEOF, "ReadResponse"), true},
+		{ErrInsufficientRenterFunds, false},
+		{&HostError{RPCError: &renterhost.RPCError{}, Err: ErrHostOutOfStorage}, false},
+	}
+	for _, test := range tests {
+		if IsRetryable(test.err) != test.retryable {
+			t.Errorf("IsRetryable(%v) should be %v", test.err, test.retryable)
+		}
+	}
+
+	classifyTests := []struct {
+		re  renterhost.RPCError
+		err error // nil if the RPCError should not be classified
+	}{
+		{renterhost.RPCError{Type: renterhost.ErrTypeOutOfStorage, Description: "disk full"}, ErrHostOutOfStorage},
+		{renterhost.RPCError{Description: "not enough storage remaining to accept sector"}, ErrHostOutOfStorage},
+		{renterhost.RPCError{Description: "bad revision number"}, ErrBadRevisionNumber},
+		{renterhost.RPCError{Description: "renter has insufficient collateral"}, ErrInsufficientCollateral},
+		{renterhost.RPCError{Description: "Insufficient funds to pay for download"}, ErrInsufficientRenterFunds},
+		{renterhost.RPCError{Description: "contract is locked by another renter"}, ErrContractLocked},
+		{renterhost.RPCError{Description: "no sector with Merkle root 1234"}, ErrSectorNotFound},
+		{renterhost.RPCError{Description: "contract is unlocked"}, nil},
+		{renterhost.RPCError{Description: "another contract is already locked"}, nil},
+		{renterhost.RPCError{Description: "revision number must increase"}, nil},
+		{renterhost.RPCError{Description: "something went wrong"}, nil},
+	}
+	for _, test := range classifyTests {
+		re := test.re
+		err := classifyRPCError(&re)
+		if test.err == nil && err != &re {
+			t.Errorf("%q should not be classified, got %v", re.Description, err)
+		} else if test.err != nil && errors.Cause(err) != test.err {
+			t.Errorf("%q should be classified as %v, got %v", re.Description, test.err, err)
+		} else if !strings.Contains(err.Error(), re.Description) {
+			t.Errorf("classified error %q does not contain host's description", err)
+		}
+	}
+}
+
+func TestReconcileRoots(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	var roots []crypto.Hash
+	for i := 0; i < 5; i++ {
+		sector := [renterhost.SectorSize]byte{0: byte(i)}
+		root, err := renter.Append(&sector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, root)
+	}
+
+	if diff, err := renter.ReconcileRoots(roots, 2); err != nil {
+		t.Fatal(err)
+	} else if !diff.InSync() {
+		t.Fatal("expected roots to be in sync:", diff)
+	}
+
+	local := append([]crypto.Hash{{1}}, roots[1:]...)
+	diff, err := renter.ReconcileRoots(local, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(diff.Missing) != 1 || diff.Missing[0] != local[0] {
+		t.Fatal("wrong missing roots:", diff.Missing)
+	} else if len(diff.Extra) != 1 || diff.Extra[0] != roots[0] {
+		t.Fatal("wrong extra roots:", diff.Extra)
+	}
+}
+
+func TestBenchmarkHost(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	hb, err := BenchmarkHost(renter, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if hb.HandshakeLatency <= 0 || hb.TimeToFirstByte <= 0 || hb.UploadThroughput <= 0 || hb.DownloadThroughput <= 0 {
+		t.Fatal("benchmark results are incomplete:", hb)
+	} else if renter.Revision().NumSectors() != 0 {
+		t.Fatal("benchmark sectors were not deleted")
+	}
+}
+
+func TestMuxedSession(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer host.Close()
+	sector := [renterhost.SectorSize]byte{0: 1}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, key := renter.Revision().ID(), renter.key
+	renter.Close()
+
+	m, err := DialMux(host.Settings().NetAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// run several sessions concurrently
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs)-1; i++ {
+		go func() {
+			s, err := NewUnlockedMuxedSession(m, host.PublicKey(), 0)
+			if err == nil {
+				_, err = s.Settings()
+				s.Close()
+			}
+			errs <- err
+		}()
+	}
+	go func() {
+		s, err := NewMuxedSession(m, host.PublicKey(), id, key, 0)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer s.Close()
+		var buf bytes.Buffer
+		err = s.Read(&buf, []renterhost.RPCReadRequestSection{{
+			MerkleRoot: root,
+			Offset:     0,
+			Length:     renterhost.SectorSize,
+		}})
+		if err == nil && !bytes.Equal(buf.Bytes(), sector[:]) {
+			err = errors.New("downloaded sector does not match uploaded sector")
+		}
+		errs <- err
+	}()
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type memSequenceStore map[types.FileContractID]Sequence
+
+func (ss memSequenceStore) LoadSequence(id types.FileContractID) (Sequence, error) {
+	return ss[id], nil
+}
+
+func (ss memSequenceStore) SaveSequence(id types.FileContractID, seq Sequence) error {
+	ss[id] = seq
+	return nil
+}
+
+type memAccountStore map[renterhost.AccountID]types.Currency
+
+func (m memAccountStore) LoadBalance(host hostdb.HostPublicKey, id renterhost.AccountID) (types.Currency, error) {
+	return m[id], nil
+}
+
+func (m memAccountStore) SaveBalance(host hostdb.HostPublicKey, id renterhost.AccountID, balance types.Currency) error {
+	m[id] = balance
+	return nil
+}
+
+func TestAccount(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	sector := [renterhost.SectorSize]byte{0: 1}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := make(memAccountStore)
+	acct, err := NewAccount(renter.HostKey(), ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the testing contract has no renter funds
+	if err := renter.FundAccount(acct, types.NewCurrency64(1)); err == nil {
+		t.Fatal("expected FundAccount to fail with insufficient contract funds")
+	}
+	revNum := renter.Revision().Revision.NewRevisionNumber
+	if err := renter.FundAccount(acct, types.ZeroCurrency); err != nil {
+		t.Fatal(err)
+	} else if renter.Revision().Revision.NewRevisionNumber != revNum+1 {
+		t.Fatal("FundAccount did not revise contract")
+	}
+	if bal, err := renter.SyncAccount(acct); err != nil {
+		t.Fatal(err)
+	} else if !bal.IsZero() || !acct.Balance().IsZero() {
+		t.Fatal("wrong account balance:", bal)
+	}
+
+	// read using the account; the contract should not be revised
+	revNum = renter.Revision().Revision.NewRevisionNumber
+	var buf bytes.Buffer
+	err = renter.ReadWithAccount(&buf, acct, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), sector[:]) {
+		t.Fatal("downloaded data does not match uploaded data")
+	} else if renter.Revision().Revision.NewRevisionNumber != revNum {
+		t.Fatal("ReadWithAccount revised contract")
+	}
+
+	// balance changes should be persisted
+	if err := acct.setBalance(types.NewCurrency64(5)); err != nil {
+		t.Fatal(err)
+	} else if err := acct.withdraw(types.NewCurrency64(6)); err != ErrInsufficientBalance {
+		t.Fatal("expected ErrInsufficientBalance, got", err)
+	} else if err := acct.withdraw(types.NewCurrency64(2)); err != nil {
+		t.Fatal(err)
+	}
+	acct2, err := NewAccount(acct.Host(), acct.key, store)
+	if err != nil {
+		t.Fatal(err)
+	} else if !acct2.Balance().Equals(types.NewCurrency64(3)) {
+		t.Fatal("account balance was not persisted:", acct2.Balance())
+	}
+}
+
+func TestSequence(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+	id, key := renter.Revision().ID(), renter.key
+
+	seqs := make(memSequenceStore)
+	renter.Unlock()
+	renter.SetSequenceStore(seqs)
+	if err := renter.Lock(id, key); err != nil {
+		t.Fatal(err)
+	}
+	sector := [renterhost.SectorSize]byte{0: 1}
+	if _, err := renter.Append(&sector); err != nil {
+		t.Fatal(err)
+	} else if seqs[id].RevisionNumber != renter.Revision().Revision.NewRevisionNumber || seqs[id].Pending != 0 {
+		t.Fatal("sequence was not committed:", seqs[id])
+	}
+
+	// simulate a crash after the host applied a write, but before the renter
+	// committed the new revision
+	sector[0] = 2
+	actions := []renterhost.RPCWriteAction{{Type: renterhost.RPCWriteActionAppend, Data: sector[:]}}
+	seqs[id] = Sequence{
+		RevisionNumber: renter.Revision().Revision.NewRevisionNumber,
+		Pending:        renter.Revision().Revision.NewRevisionNumber + 1,
+		Token:          WriteToken(actions),
+	}
+	renter.SetSequenceStore(nil)
+	if err := renter.Write(actions); err != nil {
+		t.Fatal(err)
+	}
+	renter.Unlock()
+
+	// after relocking, re-issuing the write should not append another sector
+	renter.SetSequenceStore(seqs)
+	if err := renter.Lock(id, key); err != nil {
+		t.Fatal(err)
+	}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	} else if renter.Revision().NumSectors() != 2 {
+		t.Fatal("write was applied twice")
+	} else if roots, err := renter.SectorRoots(1, 1); err != nil {
+		t.Fatal(err)
+	} else if roots[0] != root {
+		t.Fatal("wrong root returned for skipped write")
+	}
+
+	// a stale revision should be rejected
+	renter.Unlock()
+	seqs[id] = Sequence{RevisionNumber: renter.rev.Revision.NewRevisionNumber + 100}
+	if err := renter.Lock(id, key); errors.Cause(err) != ErrStaleRevision {
+		t.Fatal("expected ErrStaleRevision, got", err)
+	} else if renter.key != nil || renter.Revision().ID() == id {
+		t.Fatal("failed Lock did not reset session state")
+	}
+
+	// the failed Lock should not have left the contract locked
+	delete(seqs, id)
+	if err := renter.Lock(id, key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type memJournal map[uint64]*[renterhost.SectorSize]byte
+
+func (j memJournal) UnackedAppends(id types.FileContractID, revisionNumber uint64) ([]*[renterhost.SectorSize]byte, error) {
+	var sectors []*[renterhost.SectorSize]byte
+	for i := revisionNumber + 1; j[i] != nil; i++ {
+		sectors = append(sectors, j[i])
+	}
+	return sectors, nil
+}
+
+type recoverFunc func(*Session, Divergence) error
+
+func (fn recoverFunc) Recover(s *Session, d Divergence) error { return fn(s, d) }
+
+func TestRecoveryPolicy(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+	id, key := renter.Revision().ID(), renter.key
+	sector := [renterhost.SectorSize]byte{0: 1}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostNum := renter.Revision().Revision.NewRevisionNumber
+
+	seqs := make(memSequenceStore)
+	renter.SetSequenceStore(seqs)
+	relock := func(p RecoveryPolicy) error {
+		renter.Unlock()
+		seqs[id] = Sequence{RevisionNumber: hostNum + 2}
+		renter.SetRecoveryPolicy(p)
+		return renter.Lock(id, key)
+	}
+
+	if err := relock(RollbackPolicy{Max: 1}); err == nil {
+		t.Fatal("expected rollback of 2 revisions to be rejected")
+	}
+	if err := relock(RollbackPolicy{Max: 2}); err != nil {
+		t.Fatal(err)
+	} else if seqs[id].RevisionNumber != hostNum {
+		t.Fatal("host revision was not accepted")
+	}
+
+	badRoots := func(types.FileContractID) ([]crypto.Hash, error) { return []crypto.Hash{{1}}, nil }
+	goodRoots := func(types.FileContractID) ([]crypto.Hash, error) { return []crypto.Hash{root}, nil }
+	if err := relock(VerifyRootsPolicy{badRoots}); err == nil {
+		t.Fatal("expected mismatched roots to be rejected")
+	} else if err := relock(RecoveryChain{VerifyRootsPolicy{badRoots}, VerifyRootsPolicy{goodRoots}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the host lost two appends
+	hostNum = renter.Revision().Revision.NewRevisionNumber
+	journal := memJournal{hostNum + 1: &sector, hostNum + 2: &sector}
+	if err := relock(ReplayPolicy{journal}); err != nil {
+		t.Fatal(err)
+	} else if renter.Revision().NumSectors() != 3 {
+		t.Fatal("appends were not replayed")
+	} else if seqs[id].RevisionNumber != renter.Revision().Revision.NewRevisionNumber {
+		t.Fatal("replayed revision was not committed")
+	}
+
+	// a policy that revises the contract and then fails should not cause
+	// later policies to see a stale Divergence, nor should the partially
+	// recovered revision be broadcast or committed
+	hostNum = renter.Revision().Revision.NewRevisionNumber
+	renter.Unlock()
+	var txn types.Transaction
+	renter.SetFinalBroadcast(signingWallet{coldWallet{types.UnlockConditions{SignaturesRequired: 1}}}, feeTpool{txn: &txn}, 10)
+	var seen Divergence
+	partial := recoverFunc(func(s *Session, d Divergence) error {
+		if _, err := s.Append(&sector); err != nil {
+			return err
+		}
+		return errors.New("journal truncated")
+	})
+	observe := recoverFunc(func(s *Session, d Divergence) error {
+		seen = d
+		return errors.New("giving up")
+	})
+	if err := relock(RecoveryChain{partial, observe}); err == nil {
+		t.Fatal("expected recovery to fail")
+	} else if seen.Host.NewRevisionNumber != hostNum+1 || seen.Local.RevisionNumber != hostNum+2 {
+		t.Fatalf("second policy saw stale divergence: host %v, local %v", seen.Host.NewRevisionNumber, seen.Local.RevisionNumber)
+	} else if len(txn.FileContractRevisions) != 0 {
+		t.Fatal("failed Lock broadcast the partially recovered revision")
+	} else if seqs[id].RevisionNumber != hostNum+2 {
+		t.Fatal("failed recovery did not restore the renter's sequence:", seqs[id])
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	var key [32]byte
+	frand.Read(key[:])
+	if _, err := renter.DownloadSnapshot(key); errors.Cause(err) != ErrNoSnapshot {
+		t.Fatal("expected ErrNoSnapshot, got", err)
+	}
+
+	// upload a snapshot spanning multiple sectors, followed by an unrelated
+	// sector
+	data := frand.Bytes(renterhost.SectorSize + 100)
+	if err := renter.UploadSnapshot(key, data); err != nil {
+		t.Fatal(err)
+	}
+	sector := [renterhost.SectorSize]byte{0: 1}
+	if _, err := renter.Append(&sector); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := renter.DownloadSnapshot(key)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(snap, data) {
+		t.Fatal("snapshot does not match uploaded data")
+	}
+
+	// the most recent snapshot should be returned
+	if err := renter.UploadSnapshot(key, []byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if snap, err := renter.DownloadSnapshot(key); err != nil {
+		t.Fatal(err)
+	} else if string(snap) != "foo" {
+		t.Fatal("wrong snapshot returned:", string(snap))
+	}
+
+	// the wrong key should not find a snapshot
+	var wrongKey [32]byte
+	if _, err := renter.DownloadSnapshot(wrongKey); errors.Cause(err) != ErrNoSnapshot {
+		t.Fatal("expected ErrNoSnapshot, got", err)
+	}
+}
+
+// a watch-only wallet controlling a single output
+type coldWallet struct {
+	uc types.UnlockConditions
+}
+
+func (w coldWallet) NewWalletAddress() (types.UnlockHash, error) { return w.uc.UnlockHash(), nil }
+func (coldWallet) SignTransaction(*types.Transaction, []crypto.Hash) error {
+	return errors.New("cold wallet cannot sign")
+}
+func (w coldWallet) UnspentOutputs(bool) ([]modules.UnspentOutput, error) {
+	return []modules.UnspentOutput{{
+		FundType:   types.SpecifierSiacoinOutput,
+		Value:      types.SiacoinPrecision,
+		UnlockHash: w.uc.UnlockHash(),
+	}}, nil
+}
+func (coldWallet) UnconfirmedParents(types.Transaction) ([]types.Transaction, error) { return nil, nil }
+func (w coldWallet) UnlockConditions(types.UnlockHash) (types.UnlockConditions, error) {
+	return w.uc, nil
+}
+
+func TestFormSignedContract(t *testing.T) {
+	host, err := ghost.New(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	sh := hostdb.ScannedHost{HostSettings: host.Settings(), PublicKey: host.PublicKey()}
+
+	walletKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	w := coldWallet{types.UnlockConditions{
+		PublicKeys:         []types.SiaPublicKey{{Algorithm: types.SignatureEd25519, Key: walletKey.PublicKey()}},
+		SignaturesRequired: 1,
+	}}
+	key := ed25519.NewKeyFromSeed(append(make([]byte, ed25519.SeedSize-1), 1))
+	uc, err := PrepareContract(w, stubTpool{}, key.PublicKey(), sh, types.SiacoinPrecision.Div64(2), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(uc.ToSign) != 1 {
+		t.Fatal("expected one input to sign, got", len(uc.ToSign))
+	}
+
+	// sign offline
+	req := uc.SignRequest()
+	signed := req.Transaction
+	for i, sigIndex := range req.SigIndices {
+		signed.TransactionSignatures[sigIndex].Signature = walletKey.SignHash(req.SigHashes[i])
+	}
+
+	// tampering should be detected before contacting the host
+	tampered := signed
+	tampered.MinerFees = []types.Currency{types.NewCurrency64(1)}
+	if _, _, err := FormSignedContract(sh, uc, tampered, key); err == nil {
+		t.Fatal("expected tampered transaction to be rejected")
+	}
+	if _, _, err := FormSignedContract(sh, uc, uc.Transaction, key); err == nil {
+		t.Fatal("expected unsigned transaction to be rejected")
+	}
+
+	rev, txnSet, err := FormSignedContract(sh, uc, signed, key)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(txnSet) == 0 || rev.ID() != txnSet[len(txnSet)-1].FileContractID(0) {
+		t.Fatal("returned transaction set does not contain contract")
+	}
+
+	// contract should be usable
+	s, err := NewSession(sh.NetAddress, sh.PublicKey, rev.ID(), key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	sector := [renterhost.SectorSize]byte{0: 1}
+	if _, err := s.Append(&sector); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkWrite(b *testing.B) {
 	renter, host := createTestingPair(b)
 	defer renter.Close()
@@ -148,3 +755,688 @@ func BenchmarkRead(b *testing.B) {
 		}
 	}
 }
+
+type feeTpool struct {
+	fee types.Currency
+	txn *types.Transaction
+}
+
+func (tp feeTpool) AcceptTransactionSet(txns []types.Transaction) error {
+	*tp.txn = txns[len(txns)-1]
+	return nil
+}
+func (tp feeTpool) FeeEstimate() (min, max types.Currency, err error) { return tp.fee, tp.fee, nil }
+
+type signingWallet struct{ coldWallet }
+
+func (signingWallet) SignTransaction(*types.Transaction, []crypto.Hash) error { return nil }
+
+func TestSubmitContractRevisionFee(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	w := signingWallet{coldWallet{types.UnlockConditions{
+		PublicKeys:         []types.SiaPublicKey{{Algorithm: types.SignatureEd25519, Key: make([]byte, 32)}},
+		SignaturesRequired: 1,
+	}}}
+	var txn types.Transaction
+	tpool := feeTpool{fee: types.NewCurrency64(10), txn: &txn}
+	if err := SubmitContractRevision(renter.Revision(), w, tpool); err != nil {
+		t.Fatal(err)
+	}
+	if len(txn.SiacoinInputs) != 1 || len(txn.SiacoinOutputs) != 1 || len(txn.MinerFees) != 1 {
+		t.Fatal("transaction was not funded correctly")
+	}
+	// the fee should cover the signed transaction exactly
+	size := uint64(txn.MarshalSiaSize()) + sizeofTransactionSignature
+	if exp := tpool.fee.Mul64(size); !txn.MinerFees[0].Equals(exp) {
+		t.Fatalf("expected fee of %v, got %v", exp, txn.MinerFees[0])
+	}
+	// inputs and outputs should balance
+	if !txn.SiacoinOutputs[0].Value.Add(txn.MinerFees[0]).Equals(types.SiacoinPrecision) {
+		t.Fatal("inputs and outputs do not balance")
+	}
+}
+
+type memMigrationStore map[[2]types.FileContractID]int
+
+func (m memMigrationStore) LoadMigration(from, to types.FileContractID) (int, error) {
+	if n, ok := m[[2]types.FileContractID{from, to}]; ok {
+		return n, nil
+	}
+	return -1, nil
+}
+
+func (m memMigrationStore) SaveMigration(from, to types.FileContractID, destOffset int) error {
+	m[[2]types.FileContractID{from, to}] = destOffset
+	return nil
+}
+
+func TestMigrateSectors(t *testing.T) {
+	from, fromHost := createTestingPair(t)
+	defer from.Close()
+	defer fromHost.Close()
+	to, toHost := createTestingPair(t)
+	defer to.Close()
+	defer toHost.Close()
+
+	// destination contract already contains a sector
+	if _, err := to.Append(&[renterhost.SectorSize]byte{0: 0xFF}); err != nil {
+		t.Fatal(err)
+	}
+	sectors := make([]*[renterhost.SectorSize]byte, 6)
+	for i := range sectors {
+		sectors[i] = &[renterhost.SectorSize]byte{0: byte(i)}
+	}
+	var roots []crypto.Hash
+	for i := 0; i < len(sectors); i += 3 {
+		batchRoots, err := from.AppendBatch(sectors[i : i+3])
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, batchRoots...)
+	}
+
+	// interrupt the migration by limiting the destination host's storage
+	store := make(memMigrationStore)
+	toHost.SetMaxSectors(4)
+	var lastMigrated int
+	progress := func(migrated, total int) {
+		if total != len(sectors) || migrated <= lastMigrated {
+			t.Errorf("invalid progress: %v/%v", migrated, total)
+		}
+		lastMigrated = migrated
+	}
+	if err := MigrateSectors(from, to, store, progress); err == nil {
+		t.Fatal("expected migration to be interrupted")
+	} else if to.Revision().NumSectors() != 4 {
+		t.Fatal("expected 3 sectors to be migrated, got", to.Revision().NumSectors()-1)
+	}
+
+	// resume
+	toHost.SetMaxSectors(0)
+	if err := MigrateSectors(from, to, store, progress); err != nil {
+		t.Fatal(err)
+	} else if lastMigrated != len(sectors) {
+		t.Fatal("progress was not reported")
+	}
+	toRoots, err := to.SectorRoots(1, len(sectors))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range roots {
+		if toRoots[i] != roots[i] {
+			t.Fatal("migrated roots do not match", i)
+		}
+	}
+
+	// the completed migration should be cleared, so that migrating again
+	// copies every sector, rather than resuming from a stale offset
+	if n, _ := store.LoadMigration(from.Revision().ID(), to.Revision().ID()); n != -1 {
+		t.Fatal("migration state was not cleared:", n)
+	}
+	if err := MigrateSectors(from, to, store, nil); err != nil {
+		t.Fatal(err)
+	} else if to.Revision().NumSectors() != 2*len(sectors)+1 {
+		t.Fatal("expected sectors to be migrated again, got", to.Revision().NumSectors())
+	}
+}
+
+func TestFinalBroadcast(t *testing.T) {
+	w := signingWallet{coldWallet{types.UnlockConditions{SignaturesRequired: 1}}}
+	var txn types.Transaction
+	tpool := feeTpool{txn: &txn}
+
+	// an unmodified contract should not be broadcast
+	renter, host := createTestingPair(t)
+	defer host.Close()
+	renter.SetFinalBroadcast(w, tpool, 10)
+	if err := renter.Close(); err != nil {
+		t.Fatal(err)
+	} else if len(txn.FileContractRevisions) != 0 {
+		t.Fatal("unmodified contract was broadcast")
+	}
+
+	// a modified contract should be
+	renter, host = createTestingPair(t)
+	defer host.Close()
+	renter.SetFinalBroadcast(w, tpool, 10)
+	if _, err := renter.Append(&[renterhost.SectorSize]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	rev := renter.Revision()
+	if err := renter.Close(); err != nil {
+		t.Fatal(err)
+	} else if len(txn.FileContractRevisions) != 1 {
+		t.Fatal("modified contract was not broadcast")
+	} else if txn.FileContractRevisions[0].NewRevisionNumber != rev.Revision.NewRevisionNumber {
+		t.Fatal("broadcast revision is not the latest revision")
+	}
+}
+
+func TestLockReadOnly(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+	sector := [renterhost.SectorSize]byte{0: 1}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acct, err := NewAccount(renter.HostKey(), ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// open multiple read-only sessions while the contract is locked
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	for i := 0; i < 2; i++ {
+		reader, err := NewUnlockedSession(host.Settings().NetAddress, host.PublicKey(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		if err := reader.LockReadOnly(renter.Revision().ID(), key, acct); err != nil {
+			t.Fatal(err)
+		} else if reader.Revision().NumSectors() != 1 {
+			t.Fatal("wrong revision")
+		}
+		var buf bytes.Buffer
+		err = reader.Read(&buf, []renterhost.RPCReadRequestSection{{
+			MerkleRoot: root,
+			Offset:     0,
+			Length:     renterhost.SectorSize,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf.Bytes(), sector[:]) {
+			t.Fatal("downloaded data does not match uploaded data")
+		}
+		if _, err := reader.Append(&sector); errors.Cause(err) != ErrReadOnly {
+			t.Fatal("expected ErrReadOnly, got", err)
+		}
+	}
+
+	// hosts known to predate read-only access should be refused locally
+	reader, err := NewUnlockedSession(host.Settings().NetAddress, host.PublicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	reader.host.Version = "1.4.1"
+	if err := reader.LockReadOnly(renter.Revision().ID(), key, acct); errors.Cause(err) != ErrUnsupportedFeature {
+		t.Fatal("expected ErrUnsupportedFeature, got", err)
+	}
+}
+
+func TestPriceLimits(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+	sector := [renterhost.SectorSize]byte{0: 1}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}}
+
+	// pretend that the host raised its prices
+	renter.host.DownloadBandwidthPrice = types.NewCurrency64(5)
+	renter.SetPriceLimits(PriceLimits{
+		MaxDownloadBandwidthPrice: types.NewCurrency64(2),
+	}, 0)
+	if err := renter.Read(ioutil.Discard, sections); errors.Cause(err) != ErrPriceGouging {
+		t.Fatal("expected ErrPriceGouging, got", err)
+	} else if renter.LastCost().Download.IsZero() {
+		t.Fatal("expected non-zero download cost")
+	}
+
+	// once the prices are refreshed, the read should succeed
+	renter.SetPriceLimits(PriceLimits{
+		MaxDownloadBandwidthPrice: types.NewCurrency64(2),
+	}, time.Nanosecond)
+	if err := renter.Read(ioutil.Discard, sections); err != nil {
+		t.Fatal(err)
+	} else if !renter.LastCost().Download.IsZero() {
+		t.Fatal("expected zero download cost")
+	}
+
+	// a SettingsCheck can also reject the host's settings
+	renter.SetPriceLimits(PriceLimits{
+		SettingsCheck: func(hostdb.HostSettings) error { return errors.New("bad settings") },
+	}, 0)
+	if err := renter.Read(ioutil.Discard, sections); errors.Cause(err) != ErrPriceGouging {
+		t.Fatal("expected ErrPriceGouging, got", err)
+	}
+}
+
+func TestMisbehaviorReporter(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+	sector := [renterhost.SectorSize]byte{0: 1}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []hostdb.MisbehaviorKind
+	renter.SetMisbehaviorReporter(func(kind hostdb.MisbehaviorKind, details string) {
+		reports = append(reports, kind)
+	})
+
+	// simulate the host raising its prices after the session began
+	var checks int
+	renter.SetPriceLimits(PriceLimits{
+		SettingsCheck: func(hostdb.HostSettings) error {
+			if checks++; checks > 1 {
+				return errors.New("prices too high")
+			}
+			return nil
+		},
+	}, time.Nanosecond)
+	err = renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if errors.Cause(err) != ErrPriceGouging {
+		t.Fatal("expected ErrPriceGouging, got", err)
+	} else if len(reports) != 1 || reports[0] != hostdb.MisbehaviorPriceBaitAndSwitch {
+		t.Fatal("expected bait-and-switch report, got", reports)
+	}
+}
+
+func TestRPCObserver(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+	type outcome struct {
+		rpc string
+		err error
+	}
+	var outcomes []outcome
+	renter.SetRPCObserver(func(rpc string, err error) {
+		outcomes = append(outcomes, outcome{rpc, err})
+	})
+
+	// Append and Read each count as one RPC, even though Read refreshes the
+	// host's prices with the Settings RPC
+	sector := [renterhost.SectorSize]byte{0: 1}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renter.SetPriceLimits(PriceLimits{}, time.Nanosecond)
+	section := []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}}
+	if err := renter.Read(ioutil.Discard, section); err != nil {
+		t.Fatal(err)
+	}
+	section[0].MerkleRoot = crypto.Hash{1}
+	if err := renter.Read(ioutil.Discard, section); err == nil {
+		t.Fatal("expected error reading nonexistent sector")
+	}
+	if len(outcomes) != 3 {
+		t.Fatal("expected 3 outcomes, got", outcomes)
+	} else if outcomes[0].rpc != "Write" || outcomes[0].err != nil {
+		t.Fatal("wrong outcome for Append:", outcomes[0])
+	} else if outcomes[1].rpc != "Read" || outcomes[1].err != nil {
+		t.Fatal("wrong outcome for Read:", outcomes[1])
+	} else if outcomes[2].rpc != "Read" || outcomes[2].err == nil {
+		t.Fatal("wrong outcome for failed Read:", outcomes[2])
+	}
+
+	// interrupted RPCs should not be reported
+	renter.Interrupt()
+	if _, err := renter.Settings(); err == nil {
+		t.Fatal("expected interrupted RPC to fail")
+	} else if len(outcomes) != 3 {
+		t.Fatal("interrupted RPC should not be reported, got", outcomes[3:])
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+	if stats := renter.Stats(); stats.RTT == 0 {
+		t.Fatal("expected non-zero RTT after Lock and Settings")
+	}
+
+	sector := [renterhost.SectorSize]byte{0: 1}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := renter.Stats()
+	if stats.BytesWritten < renterhost.SectorSize || stats.BytesRead < renterhost.SectorSize {
+		t.Fatal("expected at least one sector to be transferred in each direction:", stats.BytesWritten, stats.BytesRead)
+	} else if stats.UploadThroughput == 0 || stats.DownloadThroughput == 0 {
+		t.Fatal("expected non-zero throughput")
+	} else if stats.IOErrors != 0 || stats.HostErrors != 0 {
+		t.Fatal("expected no errors, got", stats.LastError)
+	}
+
+	// a rejected RPC should be recorded as a host error
+	renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: crypto.Hash{1},
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if stats := renter.Stats(); stats.HostErrors != 1 {
+		t.Fatal("expected 1 host error, got", stats.HostErrors)
+	}
+}
+
+func TestDialSession(t *testing.T) {
+	host, err := ghost.New(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	// obtain an address that will refuse connections
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	badAddr := modules.NetAddress(l.Addr().String())
+	l.Close()
+
+	d := &hostdb.Dialer{Timeout: time.Second}
+	addrs := []modules.NetAddress{badAddr, host.Settings().NetAddress}
+	s, err := DialSession(context.Background(), d, host.PublicKey(), addrs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if addr, ok := d.LastAddress(host.PublicKey()); !ok || addr != host.Settings().NetAddress {
+		t.Fatal("dialer did not remember successful address:", addr)
+	}
+
+	// the remembered address should be attempted first
+	s, err = DialSession(context.Background(), d, host.PublicKey(), addrs[:1], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// if no address succeeds, the remembered address is forgotten
+	host.Close()
+	if _, err := DialSession(context.Background(), d, host.PublicKey(), addrs, 0); err == nil {
+		t.Fatal("expected dial to fail")
+	} else if _, ok := d.LastAddress(host.PublicKey()); ok {
+		t.Fatal("dialer should have forgotten failed address")
+	}
+}
+
+func TestSignatureBatcher(t *testing.T) {
+	// invalid signatures should be rejected without affecting the rest of
+	// the batch
+	sb := NewSignatureBatcher(4, time.Minute)
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	results := make(chan bool, 4)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			hash := crypto.Hash{byte(i)}
+			sig := key.SignHash(hash)
+			if i == 2 {
+				hash[0]++
+			}
+			results <- sb.Verify(key.PublicKey(), hash, sig)
+		}(i)
+	}
+	var valid int
+	for i := 0; i < 4; i++ {
+		if <-results {
+			valid++
+		}
+	}
+	if valid != 3 {
+		t.Fatal("expected 3 valid signatures, got", valid)
+	}
+
+	// sessions sharing a batcher should verify each other's revisions
+	sb = NewSignatureBatcher(8, 10*time.Millisecond)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		renter, host := createTestingPair(t)
+		defer renter.Close()
+		defer host.Close()
+		renter.SetSignatureBatcher(sb)
+		go func() {
+			_, err := renter.Append(&[renterhost.SectorSize]byte{})
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestContractCheck(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	errUnusable := errors.New("contract is unusable")
+	var unusable bool
+	renter.SetContractCheck(func(id types.FileContractID) error {
+		if id != renter.Revision().ID() {
+			t.Error("check called with wrong contract ID")
+		}
+		if unusable {
+			return errUnusable
+		}
+		return nil
+	})
+	if _, err := renter.Append(&[renterhost.SectorSize]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	unusable = true
+	if _, err := renter.Append(&[renterhost.SectorSize]byte{}); errors.Cause(err) != errUnusable {
+		t.Fatal("expected check error, got", err)
+	} else if _, err := renter.SectorRoots(0, 1); errors.Cause(err) != errUnusable {
+		t.Fatal("expected check error, got", err)
+	}
+}
+
+func TestCompressedSession(t *testing.T) {
+	host, err := ghost.New(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	s, err := NewUnlockedCompressedSession(host.Settings().NetAddress, host.PublicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.Compressed() {
+		t.Fatal("host should have accepted compression")
+	}
+	settings, err := s.Settings()
+	if err != nil {
+		t.Fatal(err)
+	} else if !deepEqual(settings, host.Settings()) {
+		t.Fatal("received settings do not match host's actual settings")
+	}
+
+	// upload and download a sector over the compressed session
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rev, _, err := s.FormContract(stubWallet{}, stubTpool{}, key, types.ZeroCurrency, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := s.Lock(rev.ID(), key); err != nil {
+		t.Fatal(err)
+	}
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:256])
+	root, err := s.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = s.Read(&buf, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), sector[:]) {
+		t.Fatal("downloaded data does not match uploaded data")
+	}
+}
+
+func TestTrafficShape(t *testing.T) {
+	s, host := createTestingPair(t)
+	defer s.Close()
+	defer host.Close()
+
+	// most RPC requests are limited to MinMessageSize, so larger padding
+	// would be rejected by the host
+	const padding = renterhost.MinMessageSize
+	s.SetTrafficShape(renterhost.TrafficShape{
+		Padding:  padding,
+		MaxDelay: time.Millisecond,
+	})
+
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	before := s.Stats().BytesWritten
+	root, err := s.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	} else if written := s.Stats().BytesWritten - before; written%padding != 0 {
+		t.Fatalf("wrote %v bytes, which is not a multiple of %v", written, padding)
+	}
+
+	// read an unaligned section; the Session should request an aligned
+	// section and discard the excess
+	var buf bytes.Buffer
+	before = s.Stats().BytesRead
+	err = s.Read(&buf, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     padding + 64,
+		Length:     128,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), sector[padding+64:][:128]) {
+		t.Fatal("downloaded data does not match uploaded data")
+	} else if read := s.Stats().BytesRead - before; read < padding {
+		t.Fatal("expected to download at least one aligned section, got", read)
+	}
+}
+
+func TestBandwidthScheduler(t *testing.T) {
+	s, host := createTestingPair(t)
+	defer s.Close()
+	defer host.Close()
+
+	// uploading a sector at 16 MiB/s should take at least 1/4 second
+	bs := NewBandwidthScheduler(16<<20, 0)
+	s.SetBandwidthScheduler(bs)
+	s.SetPriority(PriorityRepair)
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	start := time.Now()
+	if _, err := s.Append(&sector); err != nil {
+		t.Fatal(err)
+	} else if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatal("upload was not rate-limited:", elapsed)
+	}
+
+	// a scrub should wait for an interactive transfer
+	bs.SetLimits(0, 1<<20)
+	bs.down.mu.Lock()
+	bs.down.waiting[PriorityInteractive]++
+	bs.down.tokens = bandwidthChunk
+	bs.down.mu.Unlock()
+	took := make(chan struct{})
+	go func() {
+		bs.down.take(PriorityScrub, bandwidthChunk)
+		close(took)
+	}()
+	select {
+	case <-took:
+		t.Fatal("scrub should have waited")
+	case <-time.After(50 * time.Millisecond):
+	}
+	bs.down.mu.Lock()
+	bs.down.waiting[PriorityInteractive]--
+	bs.down.mu.Unlock()
+	select {
+	case <-took:
+	case <-time.After(time.Second):
+		t.Fatal("scrub should have proceeded")
+	}
+}
+
+func TestSettingsCache(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	cache := NewSettingsCache(time.Hour)
+	renter.SetSettingsCache(cache)
+	if _, err := renter.Settings(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second Session should use the cached settings
+	s2, err := NewUnlockedSession(host.Settings().NetAddress, host.PublicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	s2.SetSettingsCache(cache)
+	if _, err := s2.CachedSettings(); err != nil {
+		t.Fatal(err)
+	} else if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 0 {
+		t.Fatal("expected cache hit:", stats)
+	} else if s2.SettingsAge() > time.Minute {
+		t.Fatal("settings should be fresh")
+	}
+
+	// expired settings should be revalidated
+	cache.ttl = 0
+	if _, changed, err := renter.RevalidateSettings(); err != nil {
+		t.Fatal(err)
+	} else if changed {
+		t.Fatal("settings should be unchanged")
+	} else if stats := cache.Stats(); stats.Revalidated != 1 {
+		t.Fatal("expected revalidation:", stats)
+	}
+	host.BumpSettingsRevision()
+	if settings, err := renter.CachedSettings(); err != nil {
+		t.Fatal(err)
+	} else if settings.RevisionNumber != 1 {
+		t.Fatal("settings were not updated")
+	} else if stats := cache.Stats(); stats.Changed != 1 || stats.Misses != 1 {
+		t.Fatal("expected changed settings:", stats)
+	}
+	if _, _, ok := cache.Lookup(host.PublicKey()); ok {
+		t.Fatal("expired entry should not be returned")
+	}
+}
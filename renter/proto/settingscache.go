@@ -0,0 +1,179 @@
+package proto
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renterhost"
+)
+
+// SettingsCacheStats are the cumulative statistics of a SettingsCache.
+type SettingsCacheStats struct {
+	// Hits is the number of lookups satisfied by a fresh entry.
+	Hits uint64
+	// Misses is the number of lookups that found no entry, or an expired
+	// entry, and thus required contacting the host.
+	Misses uint64
+	// Revalidated is the number of expired entries that the host confirmed
+	// were unchanged.
+	Revalidated uint64
+	// Changed is the number of expired entries that the host replaced with
+	// new settings.
+	Changed uint64
+}
+
+type cachedSettings struct {
+	settings hostdb.HostSettings
+	fetched  time.Time
+}
+
+// A SettingsCache caches host settings across Sessions. Entries older than
+// TTL are expired; Sessions revalidate expired entries with the host, using
+// the lightweight RevalidateSettings RPC if the host supports it. A
+// SettingsCache is safe for concurrent use.
+type SettingsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[hostdb.HostPublicKey]cachedSettings
+	stats   SettingsCacheStats
+}
+
+// lookup returns the cached settings for the host and when they were fetched.
+// fresh is false if the entry has expired.
+func (c *SettingsCache) lookup(hostKey hostdb.HostPublicKey) (e cachedSettings, ok, fresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok = c.entries[hostKey]
+	fresh = ok && time.Since(e.fetched) < c.ttl
+	if fresh {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+	return
+}
+
+// store records settings fetched from the host. revalidated indicates that
+// the host confirmed that a cached entry was unchanged.
+func (c *SettingsCache) store(hostKey hostdb.HostPublicKey, settings hostdb.HostSettings, revalidated bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, ok := c.entries[hostKey]
+	if revalidated {
+		c.stats.Revalidated++
+	} else if ok && prev.settings.RevisionNumber != settings.RevisionNumber {
+		c.stats.Changed++
+	}
+	c.entries[hostKey] = cachedSettings{settings, time.Now()}
+}
+
+// Lookup returns the cached settings for the host, along with their age. It
+// returns false if the settings are not cached or have expired.
+func (c *SettingsCache) Lookup(hostKey hostdb.HostPublicKey) (hostdb.HostSettings, time.Duration, bool) {
+	e, _, fresh := c.lookup(hostKey)
+	if !fresh {
+		return hostdb.HostSettings{}, 0, false
+	}
+	return e.settings, time.Since(e.fetched), true
+}
+
+// Invalidate removes the host's settings from the cache.
+func (c *SettingsCache) Invalidate(hostKey hostdb.HostPublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, hostKey)
+}
+
+// Stats returns the cache's statistics.
+func (c *SettingsCache) Stats() SettingsCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// NewSettingsCache returns a SettingsCache whose entries expire after ttl.
+func NewSettingsCache(ttl time.Duration) *SettingsCache {
+	return &SettingsCache{
+		ttl:     ttl,
+		entries: make(map[hostdb.HostPublicKey]cachedSettings),
+	}
+}
+
+// SetSettingsCache sets the cache used by CachedSettings and by the price
+// checks enabled by SetPriceLimits. Settings fetched by the Session are
+// stored in the cache.
+func (s *Session) SetSettingsCache(c *SettingsCache) {
+	s.settingsCache = c
+}
+
+// SettingsAge returns the time elapsed since the Session's copy of the host's
+// settings was fetched from the host. Callers can use it to determine whether
+// quoted prices are fresh before committing funds.
+func (s *Session) SettingsAge() time.Duration {
+	if s.pricesFetched.IsZero() {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Since(s.pricesFetched)
+}
+
+// CachedSettings returns the host's settings from the Session's
+// SettingsCache if they are fresh. Otherwise, it revalidates them with the
+// host (see RevalidateSettings) and updates the cache. If the Session has no
+// SettingsCache, CachedSettings is equivalent to RevalidateSettings.
+func (s *Session) CachedSettings() (_ hostdb.HostSettings, err error) {
+	defer wrapErr(&err, "CachedSettings")
+	if s.settingsCache != nil {
+		e, ok, fresh := s.settingsCache.lookup(s.host.PublicKey)
+		if fresh {
+			s.host.HostSettings = e.settings
+			s.pricesFetched = e.fetched
+			return e.settings, nil
+		} else if ok && s.pricesFetched.Before(e.fetched) {
+			// revalidate against the cached entry
+			s.host.HostSettings = e.settings
+			s.pricesFetched = e.fetched
+		}
+	}
+	settings, _, err := s.RevalidateSettings()
+	return settings, err
+}
+
+// RevalidateSettings fetches the host's settings if they have changed since
+// the Session last fetched them, reporting whether they changed. If the host
+// supports it, the RevalidateSettings RPC is used, which avoids transferring
+// the settings when they are unchanged; otherwise, it falls back to the
+// Settings RPC.
+func (s *Session) RevalidateSettings() (_ hostdb.HostSettings, changed bool, err error) {
+	defer wrapErr(&err, "RevalidateSettings")
+	f, ok := s.Features()
+	if !ok || !f.SettingsRevalidation || s.pricesFetched.IsZero() {
+		old := s.host.HostSettings
+		settings, err := s.Settings()
+		return settings, err == nil && old.RevisionNumber != settings.RevisionNumber, err
+	}
+
+	s.extendDeadline(10 * time.Second)
+	req := &renterhost.RPCRevalidateSettingsRequest{
+		RevisionNumber: s.host.RevisionNumber,
+	}
+	var resp renterhost.RPCRevalidateSettingsResponse
+	if err := s.call(renterhost.RPCRevalidateSettingsID, req, &resp); err != nil {
+		return hostdb.HostSettings{}, false, err
+	}
+	if !resp.Unchanged {
+		var settings hostdb.HostSettings
+		if err := json.Unmarshal(resp.Settings, &settings); err != nil {
+			return hostdb.HostSettings{}, false, errors.Wrap(err, "couldn't unmarshal json")
+		}
+		s.host.HostSettings = settings
+	}
+	s.pricesFetched = time.Now()
+	if s.settingsCache != nil {
+		s.settingsCache.store(s.host.PublicKey, s.host.HostSettings, resp.Unchanged)
+	}
+	return s.host.HostSettings, !resp.Unchanged, nil
+}
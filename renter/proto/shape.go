@@ -0,0 +1,74 @@
+package proto
+
+import (
+	"io"
+
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+// SetTrafficShape causes the Session to disguise the size and timing of its
+// messages according to ts; see renterhost.TrafficShape.
+//
+// Padding messages alone does not hide the amount of data downloaded, since
+// the size of each Read response is determined by the host. So, if
+// ts.Padding is a multiple of merkle.SegmentSize, the Session additionally
+// expands each section requested via Read to a multiple of ts.Padding (or the
+// full sector), discarding the extra data. Note that the host charges for the
+// expanded sections.
+func (s *Session) SetTrafficShape(ts renterhost.TrafficShape) {
+	s.shape = ts
+	s.sess.SetTrafficShape(ts)
+}
+
+// A trimWriter discards the padding added to each section by alignSections.
+// It assumes that the data for each section is written in a single call.
+type trimWriter struct {
+	w     io.Writer
+	trims []sectionTrim
+}
+
+type sectionTrim struct {
+	offset, length uint32
+}
+
+func (tw *trimWriter) Write(p []byte) (int, error) {
+	t := tw.trims[0]
+	tw.trims = tw.trims[1:]
+	if _, err := tw.w.Write(p[t.offset:][:t.length]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// alignSections expands each section to a multiple of the Session's padding,
+// returning the expanded sections along with a writer that discards the
+// padding before writing to w. If the padding is not a multiple of
+// merkle.SegmentSize, the sections and w are returned unmodified.
+func (s *Session) alignSections(w io.Writer, sections []renterhost.RPCReadRequestSection) (io.Writer, []renterhost.RPCReadRequestSection) {
+	align := uint32(s.shape.Padding)
+	if align == 0 || align%merkle.SegmentSize != 0 {
+		return w, sections
+	} else if align > renterhost.SectorSize {
+		align = renterhost.SectorSize
+	}
+	tw := &trimWriter{w: w, trims: make([]sectionTrim, len(sections))}
+	aligned := make([]renterhost.RPCReadRequestSection, len(sections))
+	for i, sec := range sections {
+		start := sec.Offset - sec.Offset%align
+		end := sec.Offset + sec.Length
+		if end%align != 0 {
+			end += align - end%align
+		}
+		if end > renterhost.SectorSize {
+			end = renterhost.SectorSize
+		}
+		aligned[i] = renterhost.RPCReadRequestSection{
+			MerkleRoot: sec.MerkleRoot,
+			Offset:     start,
+			Length:     end - start,
+		}
+		tw.trims[i] = sectionTrim{sec.Offset - start, sec.Length}
+	}
+	return tw, aligned
+}
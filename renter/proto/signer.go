@@ -0,0 +1,153 @@
+package proto
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/encoding"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519"
+)
+
+// ErrSignerTimeout is returned when an ExternalSigner does not respond within
+// the allotted time.
+var ErrSignerTimeout = errors.New("external signer did not respond in time")
+
+// A SignRequest contains everything an external signer needs to sign a
+// transaction: the unsigned transaction itself, the indices of the signatures
+// that must be filled in, and the hash that each signature must cover.
+type SignRequest struct {
+	Transaction types.Transaction
+	SigIndices  []uint64
+	SigHashes   []crypto.Hash
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (req SignRequest) MarshalBinary() ([]byte, error) {
+	return encoding.Marshal(req), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (req *SignRequest) UnmarshalBinary(b []byte) error {
+	return encoding.Unmarshal(b, req)
+}
+
+// NewSignRequest prepares a SignRequest for the inputs of txn identified by
+// toSign. If txn does not already contain a TransactionSignature for one of
+// the inputs, a signature covering the whole transaction is added.
+func NewSignRequest(txn types.Transaction, toSign []crypto.Hash) SignRequest {
+	// copy txn to avoid sharing memory
+	var req SignRequest
+	encoding.Unmarshal(encoding.Marshal(txn), &req.Transaction)
+outer:
+	for _, id := range toSign {
+		for i, sig := range req.Transaction.TransactionSignatures {
+			if sig.ParentID == id {
+				req.SigIndices = append(req.SigIndices, uint64(i))
+				continue outer
+			}
+		}
+		req.Transaction.TransactionSignatures = append(req.Transaction.TransactionSignatures, types.TransactionSignature{
+			ParentID:      id,
+			CoveredFields: types.CoveredFields{WholeTransaction: true},
+		})
+		req.SigIndices = append(req.SigIndices, uint64(len(req.Transaction.TransactionSignatures)-1))
+	}
+	for _, i := range req.SigIndices {
+		// NOTE: all transactions signed today are post-hardfork
+		req.SigHashes = append(req.SigHashes, req.Transaction.SigHash(int(i), types.ASICHardforkHeight+1))
+	}
+	return req
+}
+
+// An ExternalSigner signs transactions out-of-process, e.g. on a hardware
+// wallet or an air-gapped machine. SignHashes returns one signature for each
+// hash in req.SigHashes, in order. Implementations should abort when ctx is
+// cancelled.
+type ExternalSigner interface {
+	SignHashes(ctx context.Context, req SignRequest) ([][]byte, error)
+}
+
+// An ExternalWallet satisfies the Wallet interface by delegating transaction
+// signing to an ExternalSigner. All other methods are provided by the embedded
+// Wallet, whose SignTransaction method is never called.
+type ExternalWallet struct {
+	Wallet
+	Signer  ExternalSigner
+	Timeout time.Duration // if zero, no timeout is applied
+}
+
+// SignTransaction implements Wallet. The signatures returned by the signer are
+// verified before they are added to txn.
+func (w ExternalWallet) SignTransaction(txn *types.Transaction, toSign []crypto.Hash) error {
+	req := NewSignRequest(*txn, toSign)
+	ctx := context.Background()
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Timeout)
+		defer cancel()
+	}
+
+	// run the signer in a separate goroutine, so that a signer that ignores
+	// ctx cannot block us indefinitely
+	type result struct {
+		sigs [][]byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		sigs, err := w.Signer.SignHashes(ctx, req)
+		ch <- result{sigs, err}
+	}()
+	var res result
+	select {
+	case <-ctx.Done():
+		return ErrSignerTimeout
+	case res = <-ch:
+	}
+	if res.err != nil {
+		return errors.Wrap(res.err, "external signer failed")
+	} else if len(res.sigs) != len(req.SigHashes) {
+		return errors.Errorf("external signer returned wrong number of signatures (expected %v, got %v)", len(req.SigHashes), len(res.sigs))
+	}
+
+	for i, sigIndex := range req.SigIndices {
+		sig := req.Transaction.TransactionSignatures[sigIndex]
+		if pk, ok := inputPublicKey(req.Transaction, sig); ok && !pk.VerifyHash(req.SigHashes[i], res.sigs[i]) {
+			return errors.Errorf("external signer returned invalid signature for %v", sig.ParentID)
+		}
+		req.Transaction.TransactionSignatures[sigIndex].Signature = res.sigs[i]
+	}
+	*txn = req.Transaction
+	return nil
+}
+
+// inputPublicKey returns the Ed25519 public key that must produce sig, if it
+// can be determined.
+func inputPublicKey(txn types.Transaction, sig types.TransactionSignature) (ed25519.PublicKey, bool) {
+	var uc types.UnlockConditions
+	var found bool
+	for _, sci := range txn.SiacoinInputs {
+		if crypto.Hash(sci.ParentID) == sig.ParentID {
+			uc, found = sci.UnlockConditions, true
+		}
+	}
+	for _, sfi := range txn.SiafundInputs {
+		if crypto.Hash(sfi.ParentID) == sig.ParentID {
+			uc, found = sfi.UnlockConditions, true
+		}
+	}
+	if !found || sig.PublicKeyIndex >= uint64(len(uc.PublicKeys)) {
+		return nil, false
+	}
+	spk := uc.PublicKeys[sig.PublicKeyIndex]
+	if spk.Algorithm != types.SignatureEd25519 || len(spk.Key) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return ed25519.PublicKey(spk.Key), true
+}
+
+// verify that ExternalWallet satisfies the Wallet interface
+var _ Wallet = ExternalWallet{}
@@ -0,0 +1,93 @@
+package proto
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+)
+
+// a signer that processes requests in a separate goroutine, as an
+// out-of-process signer would
+type chanSigner struct {
+	reqs chan SignRequest
+	resp chan [][]byte
+}
+
+func (cs chanSigner) SignHashes(ctx context.Context, req SignRequest) ([][]byte, error) {
+	b, _ := req.MarshalBinary()
+	var decoded SignRequest
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	select {
+	case cs.reqs <- decoded:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case sigs := <-cs.resp:
+		return sigs, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestExternalWallet(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	uc := types.UnlockConditions{
+		PublicKeys: []types.SiaPublicKey{{
+			Algorithm: types.SignatureEd25519,
+			Key:       key.PublicKey(),
+		}},
+		SignaturesRequired: 1,
+	}
+	var parentID types.SiacoinOutputID
+	frand.Read(parentID[:])
+	txn := types.Transaction{
+		SiacoinInputs: []types.SiacoinInput{{ParentID: parentID, UnlockConditions: uc}},
+		MinerFees:     []types.Currency{types.NewCurrency64(1)},
+	}
+	toSign := []crypto.Hash{crypto.Hash(parentID)}
+
+	signer := chanSigner{make(chan SignRequest), make(chan [][]byte)}
+	w := ExternalWallet{Wallet: stubWallet{}, Signer: signer, Timeout: time.Second}
+
+	// valid signature
+	go func() {
+		req := <-signer.reqs
+		sigs := make([][]byte, len(req.SigHashes))
+		for i, h := range req.SigHashes {
+			sigs[i] = key.SignHash(h)
+		}
+		signer.resp <- sigs
+	}()
+	signed := txn
+	if err := w.SignTransaction(&signed, toSign); err != nil {
+		t.Fatal(err)
+	} else if len(signed.TransactionSignatures) != 1 || len(signed.TransactionSignatures[0].Signature) == 0 {
+		t.Fatal("transaction was not signed")
+	} else if len(txn.TransactionSignatures) != 0 {
+		t.Fatal("original transaction was modified")
+	}
+
+	// invalid signature
+	go func() {
+		<-signer.reqs
+		signer.resp <- [][]byte{make([]byte, 64)}
+	}()
+	signed = txn
+	if err := w.SignTransaction(&signed, toSign); err == nil {
+		t.Fatal("expected invalid signature to be rejected")
+	}
+
+	// no response
+	w.Timeout = 10 * time.Millisecond
+	if err := w.SignTransaction(&signed, toSign); err != ErrSignerTimeout {
+		t.Fatal("expected ErrSignerTimeout, got", err)
+	}
+}
@@ -0,0 +1,140 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renterhost"
+)
+
+// ErrNoSnapshot is returned by DownloadSnapshot when no snapshot encrypted
+// with the specified key could be found.
+var ErrNoSnapshot = errors.New("no snapshot found")
+
+// A snapshot is stored as a series of consecutive sectors. Each sector
+// contains a random nonce, the index of the sector within the snapshot, the
+// total number of sectors in the snapshot, and a chunk of the encrypted
+// snapshot data. The first 8 bytes of the decrypted data contain the length of
+// the snapshot.
+const (
+	snapshotHeaderSize = chacha20poly1305.NonceSizeX + 8
+	snapshotChunkSize  = renterhost.SectorSize - snapshotHeaderSize - poly1305.TagSize
+
+	// maxSnapshotScan is the number of sectors, starting from the end of the
+	// contract, that DownloadSnapshot will search for a snapshot.
+	maxSnapshotScan = 8
+)
+
+// UploadSnapshot encrypts data with key and appends it to the contract. The
+// snapshot can later be retrieved with DownloadSnapshot, so long as no more
+// than a handful of sectors are appended to the contract after it.
+//
+// Snapshots are intended for small amounts of metadata, such as a serialized
+// contract set, that is needed to recover from the loss of local state.
+func (s *Session) UploadSnapshot(key [32]byte, data []byte) (err error) {
+	defer wrapErr(&err, "UploadSnapshot")
+	aead, _ := chacha20poly1305.NewX(key[:]) // no error possible
+
+	plaintext := make([]byte, 8+len(data))
+	binary.LittleEndian.PutUint64(plaintext, uint64(len(data)))
+	copy(plaintext[8:], data)
+	numSectors := (len(plaintext) + snapshotChunkSize - 1) / snapshotChunkSize
+
+	actions := make([]renterhost.RPCWriteAction, numSectors)
+	for i := range actions {
+		chunk := make([]byte, snapshotChunkSize)
+		copy(chunk, plaintext[i*snapshotChunkSize:])
+		sector := make([]byte, snapshotHeaderSize, renterhost.SectorSize)
+		frand.Read(sector[:chacha20poly1305.NonceSizeX])
+		binary.LittleEndian.PutUint32(sector[chacha20poly1305.NonceSizeX:], uint32(i))
+		binary.LittleEndian.PutUint32(sector[chacha20poly1305.NonceSizeX+4:], uint32(numSectors))
+		sector = aead.Seal(sector, sector[:chacha20poly1305.NonceSizeX], chunk, sector[chacha20poly1305.NonceSizeX:])
+		actions[i] = renterhost.RPCWriteAction{
+			Type: renterhost.RPCWriteActionAppend,
+			Data: sector,
+		}
+	}
+	return s.Write(actions)
+}
+
+// DownloadSnapshot retrieves the most recent snapshot encrypted with key. If
+// no such snapshot exists, it returns ErrNoSnapshot.
+func (s *Session) DownloadSnapshot(key [32]byte) (_ []byte, err error) {
+	defer wrapErr(&err, "DownloadSnapshot")
+	aead, _ := chacha20poly1305.NewX(key[:]) // no error possible
+
+	n := s.rev.NumSectors()
+	scan := maxSnapshotScan
+	if scan > n {
+		scan = n
+	}
+	if scan == 0 {
+		return nil, ErrNoSnapshot
+	}
+	roots, err := s.SectorRoots(n-scan, scan)
+	if err != nil {
+		return nil, err
+	}
+	readChunk := func(root crypto.Hash) (chunk []byte, index, count int, err error) {
+		var buf bytes.Buffer
+		err = s.Read(&buf, []renterhost.RPCReadRequestSection{{
+			MerkleRoot: root,
+			Offset:     0,
+			Length:     renterhost.SectorSize,
+		}})
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		sector := buf.Bytes()
+		nonce, header := sector[:chacha20poly1305.NonceSizeX], sector[chacha20poly1305.NonceSizeX:snapshotHeaderSize]
+		chunk, err = aead.Open(nil, nonce, sector[snapshotHeaderSize:], header)
+		if err != nil {
+			return nil, 0, 0, ErrNoSnapshot
+		}
+		index = int(binary.LittleEndian.Uint32(header[0:]))
+		count = int(binary.LittleEndian.Uint32(header[4:]))
+		return chunk, index, count, nil
+	}
+
+	// search backwards for the final sector of a snapshot
+	end, count := -1, 0
+	for i := len(roots) - 1; i >= 0 && end < 0; i-- {
+		_, index, c, err := readChunk(roots[i])
+		if err == ErrNoSnapshot {
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if index == c-1 {
+			end, count = n-scan+i, c
+		}
+	}
+	if end < 0 || end-count+1 < 0 {
+		return nil, ErrNoSnapshot
+	}
+
+	// read each sector of the snapshot
+	roots, err = s.SectorRoots(end-count+1, count)
+	if err != nil {
+		return nil, err
+	}
+	var plaintext []byte
+	for i, root := range roots {
+		chunk, index, c, err := readChunk(root)
+		if err != nil {
+			return nil, err
+		} else if index != i || c != count {
+			return nil, errors.New("snapshot is corrupted")
+		}
+		plaintext = append(plaintext, chunk...)
+	}
+	length := binary.LittleEndian.Uint64(plaintext)
+	if length > uint64(len(plaintext)-8) {
+		return nil, errors.New("snapshot is corrupted")
+	}
+	return plaintext[8:][:length], nil
+}
@@ -0,0 +1,163 @@
+package proto
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// numThroughputSamples is the number of transfers over which throughput is
+// averaged.
+const numThroughputSamples = 16
+
+// SessionStats summarizes the health of a Session's connection.
+type SessionStats struct {
+	BytesRead    uint64
+	BytesWritten uint64
+	// RTT is a moving average of the round-trip time of small RPCs, such as
+	// Settings and Lock. It is zero if no such RPCs have completed.
+	RTT time.Duration
+	// UploadThroughput and DownloadThroughput are measured in bytes per
+	// second, averaged over recent Write and Read RPCs. They are zero if no
+	// such RPCs have been performed.
+	UploadThroughput   float64
+	DownloadThroughput float64
+	// IOErrors counts failed reads and writes on the underlying connection,
+	// including timeouts. HostErrors counts RPCs rejected by the host.
+	IOErrors   int
+	HostErrors int
+	LastError  error
+}
+
+// A throughputSample records the transfer of n bytes over duration d.
+type throughputSample struct {
+	n int64
+	d time.Duration
+}
+
+// sessionStats tracks the health of a connection. It is safe for concurrent
+// use, so that a Session's stats may be inspected while an RPC is in progress.
+type sessionStats struct {
+	mu           sync.Mutex
+	bytesRead    uint64
+	bytesWritten uint64
+	rtt          time.Duration
+	uploads      []throughputSample
+	downloads    []throughputSample
+	ioErrors     int
+	hostErrors   int
+	lastErr      error
+}
+
+func (ss *sessionStats) recordRTT(d time.Duration) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.rtt == 0 {
+		ss.rtt = d
+	} else {
+		// same smoothing factor as TCP (RFC 6298)
+		ss.rtt = (7*ss.rtt + d) / 8
+	}
+}
+
+func (ss *sessionStats) recordError(err error, fromHost bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if fromHost {
+		ss.hostErrors++
+	} else {
+		ss.ioErrors++
+	}
+	ss.lastErr = err
+}
+
+func (ss *sessionStats) bytes() (read, written uint64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.bytesRead, ss.bytesWritten
+}
+
+func addSample(samples []throughputSample, s throughputSample) []throughputSample {
+	if len(samples) == numThroughputSamples {
+		samples = append(samples[:0], samples[1:]...)
+	}
+	return append(samples, s)
+}
+
+func meanThroughput(samples []throughputSample) float64 {
+	var n int64
+	var d time.Duration
+	for _, s := range samples {
+		n += s.n
+		d += s.d
+	}
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// measureTransfer begins measuring the throughput of a Read or Write RPC. The
+// returned function records the sample.
+func (ss *sessionStats) measureTransfer(upload bool) func() {
+	start := time.Now()
+	startRead, startWritten := ss.bytes()
+	return func() {
+		d := time.Since(start)
+		read, written := ss.bytes()
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		if upload {
+			ss.uploads = addSample(ss.uploads, throughputSample{int64(written - startWritten), d})
+		} else {
+			ss.downloads = addSample(ss.downloads, throughputSample{int64(read - startRead), d})
+		}
+	}
+}
+
+// Stats returns a summary of the health of the Session's connection. It may be
+// called concurrently with other methods.
+func (s *Session) Stats() SessionStats {
+	ss := s.stats
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return SessionStats{
+		BytesRead:          ss.bytesRead,
+		BytesWritten:       ss.bytesWritten,
+		RTT:                ss.rtt,
+		UploadThroughput:   meanThroughput(ss.uploads),
+		DownloadThroughput: meanThroughput(ss.downloads),
+		IOErrors:           ss.ioErrors,
+		HostErrors:         ss.hostErrors,
+		LastError:          ss.lastErr,
+	}
+}
+
+// statsConn wraps a net.Conn, recording the number of bytes transferred and
+// any errors encountered.
+type statsConn struct {
+	net.Conn
+	stats *sessionStats
+}
+
+func (sc statsConn) Read(p []byte) (int, error) {
+	n, err := sc.Conn.Read(p)
+	sc.stats.mu.Lock()
+	sc.stats.bytesRead += uint64(n)
+	sc.stats.mu.Unlock()
+	if err != nil {
+		sc.stats.recordError(err, false)
+	}
+	return n, err
+}
+
+func (sc statsConn) Write(p []byte) (int, error) {
+	n, err := sc.Conn.Write(p)
+	sc.stats.mu.Lock()
+	sc.stats.bytesWritten += uint64(n)
+	sc.stats.mu.Unlock()
+	if err != nil {
+		sc.stats.recordError(err, false)
+	}
+	return n, err
+}
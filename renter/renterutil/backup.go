@@ -0,0 +1,92 @@
+package renterutil
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter"
+)
+
+// BackupMetaFiles writes every metafile within dir, along with the directory
+// structure containing them, to w as a bundle (see renter.BundleWriter). The
+// metafiles are copied verbatim. Since a bundle can be written to any stream,
+// the backup can be stored on another medium, or, if it is small enough,
+// uploaded as a host snapshot (see proto.Session.UploadSnapshot). The trash
+// (see PseudoFS.SetTrashRetention) is not included.
+func BackupMetaFiles(w io.Writer, dir string) error {
+	bw, err := renter.NewBundleWriter(w)
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		} else if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if info.IsDir() && rel == trashDirname {
+			return filepath.SkipDir
+		} else if info.IsDir() {
+			return bw.WriteDir(name, info.Mode().Perm())
+		} else if !strings.HasSuffix(path, metafileExt) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "could not read metafile")
+		}
+		return bw.WriteFile(name, info.Mode().Perm(), data)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+// RestoreMetaFiles reads a bundle written by BackupMetaFiles from r,
+// recreating its directories and metafiles within dir. It does not overwrite
+// existing metafiles. Metafiles that fail checksum validation are not
+// written.
+func RestoreMetaFiles(r io.Reader, dir string) error {
+	br, err := renter.NewBundleReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		e, err := br.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.FromSlash(e.Name))
+		if e.Dir {
+			if err := os.MkdirAll(path, e.Mode); err != nil {
+				return errors.Wrap(err, "could not create directory")
+			}
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return errors.Errorf("%v already exists", e.Name)
+		}
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return errors.Wrapf(err, "could not read %v", e.Name)
+		} else if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return errors.Wrap(err, "could not create directory")
+		} else if err := ioutil.WriteFile(path+"_tmp", data, e.Mode); err != nil {
+			return errors.Wrapf(err, "could not write %v", e.Name)
+		} else if err := os.Rename(path+"_tmp", path); err != nil {
+			return errors.Wrapf(err, "could not write %v", e.Name)
+		}
+	}
+}
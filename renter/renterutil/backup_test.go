@@ -0,0 +1,69 @@
+package renterutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+func TestBackupMetaFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+
+	hosts := []hostdb.HostPublicKey{hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())}
+	names := []string{"foo" + metafileExt, filepath.Join("bar", "baz"+metafileExt)}
+	for _, name := range names {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := renter.WriteMetaFile(path, renter.NewMetaFile(0600, 0, hosts, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// non-metafiles should be skipped
+	if err := ioutil.WriteFile(filepath.Join(src, journalFilename), []byte("journal"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := BackupMetaFiles(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	backup := buf.Bytes()
+	if err := RestoreMetaFiles(bytes.NewReader(backup), dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		orig, _ := ioutil.ReadFile(filepath.Join(src, name))
+		restored, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(orig, restored) {
+			t.Fatalf("%v does not match original", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, journalFilename)); !os.IsNotExist(err) {
+		t.Fatal("non-metafile was backed up")
+	} else if info, err := os.Stat(filepath.Join(dst, "empty")); err != nil || !info.IsDir() {
+		t.Fatal("empty directory was not restored")
+	}
+
+	// existing metafiles should not be overwritten
+	if err := RestoreMetaFiles(bytes.NewReader(backup), dst); err == nil {
+		t.Fatal("expected error when restoring over existing metafiles")
+	}
+}
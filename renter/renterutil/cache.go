@@ -0,0 +1,357 @@
+package renterutil
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+)
+
+// A SectorCache is a disk-backed cache of downloaded sector data, allowing
+// hot data to be re-read without contacting hosts or paying for bandwidth.
+// Each entry holds the contents of one renter.SectorSlice. When the total
+// size of the entries exceeds the cache's limit, the least-recently-used
+// entries are evicted.
+//
+// Entries may be stored encrypted, exactly as they were received from the
+// host, or decrypted. Decrypted entries are cheaper to read, but expose file
+// contents to anyone with access to the cache directory.
+//
+// A SectorCache may be shared by multiple PseudoFSs, but its directory
+// should not be used by more than one SectorCache at a time.
+type SectorCache struct {
+	dir       string
+	maxSize   int64
+	decrypted bool
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry; most recently used at front
+	entries map[string]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// SectorCacheStats reports statistics about a SectorCache.
+type SectorCacheStats struct {
+	Entries int
+	Size    int64
+	Hits    uint64
+	Misses  uint64
+}
+
+// Stats returns statistics about the cache. Hits and Misses count the
+// lookups made since the cache was created.
+func (c *SectorCache) Stats() SectorCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return SectorCacheStats{
+		Entries: len(c.entries),
+		Size:    c.size,
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
+
+// entryName returns the filename of the entry holding ss. Decrypted entries
+// depend on the key used to decrypt them, so the key is included in their
+// name.
+func (c *SectorCache) entryName(ss renter.SectorSlice, key *renter.KeySeed) string {
+	buf := make([]byte, 0, 1+len(ss.MerkleRoot)+8+len(ss.Nonce)+len(key))
+	if c.decrypted {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = append(buf, ss.MerkleRoot[:]...)
+	buf = append(buf, make([]byte, 8)...)
+	binary.LittleEndian.PutUint32(buf[len(buf)-8:], ss.SegmentIndex)
+	binary.LittleEndian.PutUint32(buf[len(buf)-4:], ss.NumSegments)
+	buf = append(buf, ss.Nonce[:]...)
+	if c.decrypted {
+		buf = append(buf, key[:]...)
+	}
+	h := blake2b.Sum256(buf)
+	return hex.EncodeToString(h[:])
+}
+
+// get returns the contents of the named entry.
+func (c *SectorCache) get(name string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if !ok {
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	c.mu.Unlock()
+
+	path := filepath.Join(c.dir, name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil || int64(len(data)) != e.Value.(*cacheEntry).size {
+		// the entry is missing or corrupt; forget it
+		c.remove(name)
+		return nil, false
+	}
+	// record the access, so that the LRU order survives a restart
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+// put adds the named entry to the cache, evicting other entries as
+// necessary.
+func (c *SectorCache) put(name string, data []byte) error {
+	c.mu.Lock()
+	tooBig := int64(len(data)) > c.maxSize
+	c.mu.Unlock()
+	if tooBig {
+		return nil
+	}
+	path := filepath.Join(c.dir, name)
+	if err := ioutil.WriteFile(path+"_tmp", data, 0600); err != nil {
+		return errors.Wrap(err, "could not write cache entry")
+	} else if err := os.Rename(path+"_tmp", path); err != nil {
+		return errors.Wrap(err, "could not write cache entry")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{name, int64(len(data))})
+	c.size += int64(len(data))
+	return c.evict()
+}
+
+// remove removes the named entry from the cache.
+func (c *SectorCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+		delete(c.entries, name)
+		os.Remove(filepath.Join(c.dir, name))
+	}
+}
+
+// evict removes least-recently-used entries until the cache is within its
+// size limit. The caller must hold c.mu.
+func (c *SectorCache) evict() error {
+	for c.size > c.maxSize {
+		ce := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, ce.name)
+		c.size -= ce.size
+		if err := os.Remove(filepath.Join(c.dir, ce.name)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "could not evict cache entry")
+		}
+	}
+	return nil
+}
+
+// SetMaxSize sets the maximum total size, in bytes, of the cache's entries,
+// evicting entries as necessary.
+func (c *SectorCache) SetMaxSize(maxSize int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSize = maxSize
+	return c.evict()
+}
+
+// Clear removes every entry from the cache.
+func (c *SectorCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	maxSize := c.maxSize
+	c.maxSize = 0
+	defer func() { c.maxSize = maxSize }()
+	return c.evict()
+}
+
+// NewSectorCache returns a SectorCache that stores its entries in dir,
+// creating it if necessary, and evicts entries when their total size exceeds
+// maxSize bytes. If decrypted is true, entries are stored decrypted. Entries
+// left in dir by a previous SectorCache are reused, ordered by their last
+// access.
+func NewSectorCache(dir string, maxSize int64, decrypted bool) (*SectorCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create cache directory")
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read cache directory")
+	}
+	// add entries from least to most recently used
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	c := &SectorCache{
+		dir:       dir,
+		maxSize:   maxSize,
+		decrypted: decrypted,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, "_tmp") {
+			// left by a crash
+			os.Remove(filepath.Join(dir, name))
+			continue
+		} else if _, err := hex.DecodeString(name); err != nil || len(name) != 2*blake2b.Size256 || info.IsDir() {
+			continue
+		}
+		c.entries[name] = c.lru.PushFront(&cacheEntry{name, info.Size()})
+		c.size += info.Size()
+	}
+	if err := c.evict(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetSectorCache sets the cache used to store downloaded sector data. Files
+// imported from siad (see renter.ImportSiaFile) are never cached. A nil
+// cache disables caching, which is the default.
+//
+// When caching is enabled, a download that misses the cache fetches each
+// SectorSlice it touches in its entirety, so that the slice can be cached;
+// this makes small random reads more expensive, but subsequent reads of the
+// same data free.
+func (fs *PseudoFS) SetSectorCache(c *SectorCache) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.cache = c
+}
+
+// sectionSlices returns the slices of shard that overlap the section
+// [offset, offset+length), along with the offset of the section within the
+// first slice.
+func sectionSlices(shard []renter.SectorSlice, offset, length int64) ([]renter.SectorSlice, int64, error) {
+	if offset < 0 || length < 0 {
+		return nil, 0, errors.New("offset and length must be positive")
+	}
+	var start int64
+	for i, ss := range shard {
+		size := int64(ss.NumSegments) * merkle.SegmentSize
+		if start+size <= offset {
+			start += size
+			continue
+		}
+		skip := offset - start
+		for j, ss := range shard[i:] {
+			length -= int64(ss.NumSegments) * merkle.SegmentSize
+			if j == 0 {
+				length += skip
+			}
+			if length <= 0 {
+				return shard[i : i+j+1], skip, nil
+			}
+		}
+		break
+	}
+	return nil, 0, errors.New("offset+length is out of bounds")
+}
+
+// decrypt decrypts the contents of ss in place, if they were cached
+// encrypted.
+func (c *SectorCache) decrypt(data []byte, ss renter.SectorSlice, key *renter.KeySeed, cipher renter.Cipher) []byte {
+	if !c.decrypted {
+		cipher.XORKeyStream(key, data, ss.Nonce[:], uint64(ss.SegmentIndex))
+	}
+	return data
+}
+
+// readSection returns the specified section of shard, if all of the slices
+// it overlaps are cached.
+func (c *SectorCache) readSection(shard []renter.SectorSlice, key *renter.KeySeed, cipher renter.Cipher, offset, length int64) ([]byte, bool) {
+	slices, skip, err := sectionSlices(shard, offset, length)
+	if err != nil {
+		return nil, false
+	}
+	buf := make([]byte, 0, skip+length+renterhost.SectorSize)
+	for _, ss := range slices {
+		data, ok := c.get(c.entryName(ss, key))
+		if !ok {
+			return nil, false
+		}
+		buf = append(buf, c.decrypt(data, ss, key, cipher)...)
+	}
+	return buf[skip:][:length], true
+}
+
+// downloadSection downloads the specified section of shard from s,
+// decrypting it and writing it to w. Any slices that the section overlaps,
+// but which are not cached, are downloaded in their entirety and added to
+// the cache.
+func (c *SectorCache) downloadSection(w io.Writer, s *proto.Session, shard []renter.SectorSlice, key *renter.KeySeed, cipher renter.Cipher, offset, length int64) error {
+	slices, skip, err := sectionSlices(shard, offset, length)
+	if err != nil {
+		return err
+	}
+	// download the missing slices in a single RPC
+	cached := make([][]byte, len(slices))
+	var sections []renterhost.RPCReadRequestSection
+	for i, ss := range slices {
+		if data, ok := c.get(c.entryName(ss, key)); ok {
+			cached[i] = c.decrypt(data, ss, key, cipher)
+			continue
+		}
+		sections = append(sections, renterhost.RPCReadRequestSection{
+			MerkleRoot: ss.MerkleRoot,
+			Offset:     ss.SegmentIndex * merkle.SegmentSize,
+			Length:     ss.NumSegments * merkle.SegmentSize,
+		})
+	}
+	var raw bytes.Buffer
+	if len(sections) > 0 {
+		if err := s.Read(&raw, sections); err != nil {
+			return err
+		}
+	}
+
+	// failing to add an entry to the cache is not fatal
+	buf := make([]byte, 0, skip+length+renterhost.SectorSize)
+	for i, ss := range slices {
+		if cached[i] == nil {
+			data := raw.Next(int(ss.NumSegments) * merkle.SegmentSize)
+			name := c.entryName(ss, key)
+			if !c.decrypted {
+				_ = c.put(name, data)
+			}
+			cipher.XORKeyStream(key, data, ss.Nonce[:], uint64(ss.SegmentIndex))
+			if c.decrypted {
+				_ = c.put(name, data)
+			}
+			cached[i] = data
+		}
+		buf = append(buf, cached[i]...)
+	}
+	_, err = w.Write(buf[skip:][:length])
+	return err
+}
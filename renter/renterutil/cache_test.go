@@ -0,0 +1,130 @@
+package renterutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestSectorCache(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(filepath.Join(dir, "fs"), fs.hosts)
+	if err := os.Mkdir(filepath.Join(dir, "fs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err := fs.Create("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := frand.Bytes(10000)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	readFile := func() error {
+		t.Helper()
+		pf, err := fs.Open("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		p, err := ioutil.ReadAll(pf)
+		if err == nil && !bytes.Equal(p, data) {
+			t.Fatal("contents do not match data")
+		}
+		return err
+	}
+	// make every host unreachable
+	disconnect := func() func() {
+		hkr := fs.hosts.hkr.(testHKR)
+		old := make(testHKR)
+		for hostKey, addr := range hkr {
+			old[hostKey] = addr
+			hkr[hostKey] = "127.0.0.1:1"
+			fs.hosts.acquire(hostKey)
+			fs.hosts.invalidate(hostKey)
+			fs.hosts.release(hostKey)
+		}
+		return func() {
+			for hostKey, addr := range old {
+				hkr[hostKey] = addr
+			}
+		}
+	}
+
+	for _, decrypted := range []bool{false, true} {
+		cacheDir := filepath.Join(dir, "cache")
+		os.RemoveAll(cacheDir)
+		cache, err := NewSectorCache(cacheDir, 1<<30, decrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.SetSectorCache(cache)
+
+		// the first read should populate the cache
+		if err := readFile(); err != nil {
+			t.Fatal(err)
+		} else if stats := cache.Stats(); stats.Entries == 0 || stats.Misses == 0 {
+			t.Fatalf("unexpected cache stats after first read: %+v", stats)
+		}
+		// entries should only contain plaintext if decrypted
+		entries, _ := ioutil.ReadDir(cacheDir)
+		var plaintext bool
+		for _, e := range entries {
+			b, _ := ioutil.ReadFile(filepath.Join(cacheDir, e.Name()))
+			plaintext = plaintext || bytes.Contains(b, data[:64])
+		}
+		if plaintext != decrypted {
+			t.Fatalf("expected plaintext entries: %v, got %v", decrypted, plaintext)
+		}
+
+		// subsequent reads should not contact any hosts
+		reconnect := disconnect()
+		if err := readFile(); err != nil {
+			t.Fatal(err)
+		} else if stats := cache.Stats(); stats.Hits == 0 {
+			t.Fatalf("unexpected cache stats after second read: %+v", stats)
+		}
+
+		// the cache should survive a restart
+		cache, err = NewSectorCache(cacheDir, 1<<30, decrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.SetSectorCache(cache)
+		if err := readFile(); err != nil {
+			t.Fatal(err)
+		}
+
+		// shrinking the cache should evict entries, forcing a download
+		if err := cache.SetMaxSize(0); err != nil {
+			t.Fatal(err)
+		} else if stats := cache.Stats(); stats.Entries != 0 || stats.Size != 0 {
+			t.Fatalf("unexpected cache stats after eviction: %+v", stats)
+		} else if err := readFile(); err == nil {
+			t.Fatal("expected read to fail without cache or hosts")
+		}
+		reconnect()
+		if err := readFile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -110,20 +110,20 @@ func (c *SiadClient) LookupHost(prefix string) (hostdb.HostPublicKey, error) {
 	}
 	hdag, err := c.siad.HostDbAllGet()
 	if err != nil {
-		return "", err
+		return hostdb.HostPublicKey{}, err
 	}
 	var hpk hostdb.HostPublicKey
 	for i := range hdag.Hosts {
-		key := hostdb.HostPublicKey(hdag.Hosts[i].PublicKeyString)
-		if strings.HasPrefix(string(key), prefix) {
-			if hpk != "" {
-				return "", errors.New("ambiguous pubkey")
+		key := hostdb.HostKeyFromSiaPublicKey(hdag.Hosts[i].PublicKey)
+		if !key.IsZero() && strings.HasPrefix(key.String(), prefix) {
+			if !hpk.IsZero() {
+				return hostdb.HostPublicKey{}, errors.New("ambiguous pubkey")
 			}
 			hpk = key
 		}
 	}
-	if hpk == "" {
-		return "", errors.New("no host with that pubkey")
+	if hpk.IsZero() {
+		return hostdb.HostPublicKey{}, errors.New("no host with that pubkey")
 	}
 	return hpk, nil
 }
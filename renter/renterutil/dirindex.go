@@ -0,0 +1,239 @@
+package renterutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter"
+)
+
+// dirIndexFilename is the name of the renter.DirIndex stored in each
+// directory of a PseudoFS.
+const dirIndexFilename = ".usdir"
+
+// BuildDirIndexes builds a renter.DirIndex for dir and each of its
+// subdirectories, reading every metafile within them, and writes each index
+// to its directory. Existing indexes are replaced.
+func BuildDirIndexes(dir string) (*renter.DirIndex, error) {
+	return buildDirIndex(dir, true, nil)
+}
+
+// buildDirIndex builds and writes the index of dir, decrypting its metafiles
+// with key if key is non-nil. If recursive is false, existing indexes of
+// subdirectories are used as-is; otherwise, they are rebuilt.
+func buildDirIndex(dir string, recursive bool, key *metaFileKey) (*renter.DirIndex, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read directory")
+	}
+	d := new(renter.DirIndex)
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if isInternalFile(info.Name()) {
+			continue
+		} else if info.IsDir() {
+			sub, err := loadDirIndex(path, recursive, key)
+			if err != nil {
+				return nil, err
+			}
+			d.SetEntry(renter.DirEntry{
+				Name:    info.Name(),
+				Dir:     true,
+				Mode:    info.Mode(),
+				ModTime: info.ModTime(),
+				Stats:   sub.Stats(),
+			})
+		} else if strings.HasSuffix(info.Name(), metafileExt) {
+			m, err := readMetaFile(path, key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%v", path)
+			}
+			d.SetEntry(renter.NewDirEntry(strings.TrimSuffix(info.Name(), metafileExt), m))
+		}
+	}
+	if err := renter.WriteDirIndex(filepath.Join(dir, dirIndexFilename), d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// loadDirIndex reads the index of dir, building it if it does not exist (or
+// if rebuild is true).
+func loadDirIndex(dir string, rebuild bool, key *metaFileKey) (*renter.DirIndex, error) {
+	if !rebuild {
+		d, err := renter.ReadDirIndex(filepath.Join(dir, dirIndexFilename))
+		if !os.IsNotExist(errors.Cause(err)) {
+			return d, err
+		}
+	}
+	return buildDirIndex(dir, rebuild, key)
+}
+
+// relName normalizes a PseudoFS name, returning "." for the root.
+func relName(name string) string {
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// indexingEnabled reports whether the filesystem's directory indexes are
+// being maintained, i.e. whether the root directory has an index.
+func (fs *PseudoFS) indexingEnabled() bool {
+	_, err := os.Stat(filepath.Join(fs.root, dirIndexFilename))
+	return err == nil
+}
+
+// updateDirIndexes sets the entry for the named file or directory in the
+// index of its parent directory, propagating the change to each ancestor. If
+// e is nil, the entry is removed.
+func (fs *PseudoFS) updateDirIndexes(name string, e *renter.DirEntry) error {
+	if !fs.indexingEnabled() {
+		return nil
+	}
+	name = relName(name)
+	for name != "." {
+		dir := filepath.Dir(name)
+		d, err := loadDirIndex(fs.path(dir), false, fs.metaKey)
+		if err != nil {
+			return errors.Wrap(err, "could not update directory index")
+		}
+		if e == nil {
+			d.RemoveEntry(filepath.Base(name))
+		} else {
+			e.Name = filepath.Base(name)
+			d.SetEntry(*e)
+		}
+		if err := renter.WriteDirIndex(fs.path(filepath.Join(dir, dirIndexFilename)), d); err != nil {
+			return errors.Wrap(err, "could not update directory index")
+		}
+
+		// update the parent's entry for dir
+		if dir != "." {
+			info, err := os.Stat(fs.path(dir))
+			if err != nil {
+				return errors.Wrap(err, "could not update directory index")
+			}
+			e = &renter.DirEntry{
+				Dir:     true,
+				Mode:    info.Mode(),
+				ModTime: info.ModTime(),
+				Stats:   d.Stats(),
+			}
+		}
+		name = dir
+	}
+	return nil
+}
+
+// updateDirIndexesForFile updates the directory indexes after the metafile
+// for the named file was written.
+func (fs *PseudoFS) updateDirIndexesForFile(name string, m *renter.MetaFile) error {
+	e := renter.NewDirEntry("", m)
+	return fs.updateDirIndexes(name, &e)
+}
+
+// updateDirIndexesForDir updates the directory indexes after the named
+// directory was created or moved.
+func (fs *PseudoFS) updateDirIndexesForDir(name string) error {
+	if !fs.indexingEnabled() {
+		return nil
+	}
+	path := fs.path(name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "could not update directory index")
+	}
+	d, err := loadDirIndex(path, false, fs.metaKey)
+	if err != nil {
+		return errors.Wrap(err, "could not update directory index")
+	}
+	return fs.updateDirIndexes(name, &renter.DirEntry{
+		Dir:     true,
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		Stats:   d.Stats(),
+	})
+}
+
+// DirIndex returns the index of the named directory, which summarizes the
+// directory's contents without reading each metafile. The index reflects the
+// committed state of each file; changes that have not yet been flushed are
+// not included.
+//
+// Directory indexes are not maintained until DirIndex is first called, at
+// which point the indexes of the entire filesystem are built. Thereafter,
+// they are updated whenever the filesystem modifies a metafile or directory.
+// Changes made to the filesystem's directory by other means are not
+// detected; BuildDirIndexes can be used to rebuild the indexes after such
+// changes.
+func (fs *PseudoFS) DirIndex(name string) (*renter.DirIndex, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.indexingEnabled() {
+		if _, err := buildDirIndex(fs.root, true, fs.metaKey); err != nil {
+			return nil, errors.Wrapf(err, "dirindex %v", name)
+		}
+	}
+	path := fs.path(name)
+	if !isDir(path) {
+		return nil, errors.Wrapf(ErrNotDirectory, "dirindex %v", name)
+	}
+	d, err := loadDirIndex(path, false, fs.metaKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dirindex %v", name)
+	}
+	return d, nil
+}
+
+// WalkIndex walks the file tree rooted at the named directory, calling fn for
+// each file and directory in the tree, excluding the root. Entries are
+// visited in lexical order, and are read from directory indexes (see
+// DirIndex) rather than the metafiles themselves. If fn returns
+// filepath.SkipDir for a directory, its contents are skipped.
+func (fs *PseudoFS) WalkIndex(name string, fn func(name string, e renter.DirEntry) error) error {
+	d, err := fs.DirIndex(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range d.Entries {
+		child := filepath.Join(name, e.Name)
+		if err := fn(child, e); err == filepath.SkipDir && e.Dir {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if e.Dir {
+			if err := fs.WalkIndex(child, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isInternalFile returns true if name is the name of a file used internally
+// by the filesystem, i.e. a directory index (or a temporary file left by an
+// interrupted write of one), a metafile lock, a metafile shadow copy, the
+// journal, the write-back log, or the trash.
+func isInternalFile(name string) bool {
+	return strings.HasPrefix(name, dirIndexFilename) || renter.IsMetaFileLock(name) ||
+		strings.HasSuffix(name, renter.ShadowSuffix) ||
+		name == journalFilename || strings.HasPrefix(name, writeBackFilename) ||
+		name == trashDirname
+}
+
+// filterInternalFiles removes internal files from a directory listing.
+func filterInternalFiles(infos []os.FileInfo) []os.FileInfo {
+	filtered := infos[:0]
+	for _, info := range infos {
+		if !isInternalFile(info.Name()) {
+			filtered = append(filtered, info)
+		}
+	}
+	return filtered
+}
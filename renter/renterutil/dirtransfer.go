@@ -0,0 +1,373 @@
+package renterutil
+
+import (
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/us/hostdb"
+)
+
+// Metadata keys recorded by UploadDir and consulted by DownloadDir.
+const (
+	// MetadataModTime is the modification time of the local file, formatted
+	// as RFC 3339.
+	MetadataModTime = "mtime"
+	// MetadataHash is the hex-encoded BLAKE2b-256 hash of the file's
+	// contents.
+	MetadataHash = "blake2b"
+)
+
+// DirOptions configures UploadDir and DownloadDir.
+type DirOptions struct {
+	// Concurrency is the maximum number of files transferred at once across
+	// the entire tree. If Concurrency is zero, 4 is used.
+	Concurrency int
+
+	// MinShards is the number of shards required to recover each uploaded
+	// file. It is ignored by DownloadDir.
+	MinShards int
+
+	// Force disables the skipping of unchanged files.
+	Force bool
+}
+
+// DirTransferStats summarizes the result of UploadDir or DownloadDir.
+type DirTransferStats struct {
+	Transferred int
+	Skipped     int
+	Bytes       int64 // bytes transferred, excluding skipped files
+}
+
+// A dirTransfer runs file transfers with bounded concurrency, stopping at the
+// first error.
+type dirTransfer struct {
+	jobs  chan func() error
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	err   error
+	stats DirTransferStats
+}
+
+func newDirTransfer(concurrency int) *dirTransfer {
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	t := &dirTransfer{jobs: make(chan func() error)}
+	for i := 0; i < concurrency; i++ {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			for job := range t.jobs {
+				if err := job(); err != nil {
+					t.fail(err)
+				}
+			}
+		}()
+	}
+	return t
+}
+
+func (t *dirTransfer) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *dirTransfer) failed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err != nil
+}
+
+func (t *dirTransfer) record(transferred bool, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if transferred {
+		t.stats.Transferred++
+		t.stats.Bytes += n
+	} else {
+		t.stats.Skipped++
+	}
+}
+
+// wait waits for every job to finish, and returns the first error
+// encountered, if any.
+func (t *dirTransfer) wait(walkErr error) (DirTransferStats, error) {
+	close(t.jobs)
+	t.wg.Wait()
+	if walkErr != nil {
+		t.fail(walkErr)
+	}
+	return t.stats, t.err
+}
+
+// newFileHash returns the hash used to compute MetadataHash.
+func newFileHash() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+// hashFile returns the MetadataHash of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newFileHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// UploadDir uploads every regular file within localDir, recursively, to the
+// directory dir, creating directories as necessary. The mode of each file is
+// preserved, and its modification time and hash are recorded in its user
+// metadata (see MetadataModTime and MetadataHash). Unless opts.Force is set,
+// a file is skipped if a file of the same size already exists at its
+// destination and was uploaded from a file with the same modification time or
+// contents.
+//
+// Uploaded data is buffered like any other write, so UploadDir flushes the
+// filesystem before returning.
+//
+// UploadDir stops early if ctx is cancelled, and reports its progress to the
+// ProgressFunc of ctx (see WithProgress). Since files are discovered as the
+// transfer proceeds, the reported Total grows over time.
+func (fs *PseudoFS) UploadDir(ctx context.Context, localDir, dir string, opts DirOptions) (DirTransferStats, error) {
+	t := newDirTransfer(opts.Concurrency)
+	progress := newProgressTracker(ctx, 0)
+	walkErr := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		} else if t.failed() {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(localDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, rel)
+		if info.IsDir() {
+			if err := fs.MkdirAll(name, info.Mode().Perm()); err != nil {
+				return errors.Wrapf(err, "could not create %v", name)
+			}
+			return nil
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+		progress.addTotal(info.Size())
+		t.jobs <- func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			pr := &progressReader{ctx: ctx, p: progress}
+			transferred, err := fs.uploadFile(pr, path, name, info, opts)
+			if err != nil {
+				return errors.Wrapf(err, "could not upload %v", path)
+			}
+			if !transferred {
+				progress.add(info.Size(), hostdb.HostPublicKey{})
+			}
+			t.record(transferred, info.Size())
+			return nil
+		}
+		return nil
+	})
+	stats, err := t.wait(walkErr)
+	if err != nil {
+		return stats, err
+	}
+	return stats, fs.Flush()
+}
+
+// uploadFile uploads the file at path to name, unless it is unchanged. The
+// file's contents are read through pr.
+func (fs *PseudoFS) uploadFile(pr *progressReader, path, name string, info os.FileInfo, opts DirOptions) (bool, error) {
+	mtime := info.ModTime().Format(time.RFC3339Nano)
+	if !opts.Force {
+		if stat, err := fs.Stat(name); err == nil && stat.Size() == info.Size() {
+			md, err := fs.Metadata(name)
+			if err != nil {
+				return false, err
+			}
+			unchanged := md[MetadataModTime] == mtime
+			if !unchanged && md[MetadataHash] != "" {
+				sum, err := hashFile(path)
+				if err != nil {
+					return false, err
+				}
+				unchanged = md[MetadataHash] == sum
+			}
+			if unchanged {
+				if stat.Mode() != info.Mode().Perm() {
+					if err := fs.Chmod(name, info.Mode().Perm()); err != nil {
+						return false, err
+					}
+				}
+				return false, fs.SetMetadata(name, MetadataModTime, mtime)
+			}
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	pf, err := fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm(), opts.MinShards)
+	if err != nil {
+		return false, err
+	}
+	h := newFileHash()
+	pr.r = f
+	if _, err := io.Copy(pf, io.TeeReader(pr, h)); err != nil {
+		pf.Close()
+		return false, err
+	} else if err := pf.Close(); err != nil {
+		return false, err
+	}
+	if err := fs.Chmod(name, info.Mode().Perm()); err != nil {
+		return false, err
+	} else if err := fs.SetMetadata(name, MetadataHash, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return false, err
+	} else if err := fs.SetMetadata(name, MetadataModTime, mtime); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DownloadDir downloads every file within the directory dir, recursively, to
+// localDir, creating directories as necessary. The mode of each file is
+// preserved, and its modification time is set to the time recorded by
+// UploadDir, if any, or else to the file's ModTime. Unless opts.Force is set,
+// a file is skipped if a local file of the same size already exists at its
+// destination and has the same modification time or contents. Files are
+// written to a temporary file and renamed into place, so an interrupted
+// download never leaves a partial file behind.
+//
+// Like UploadDir, DownloadDir stops early if ctx is cancelled, and reports its
+// progress to the ProgressFunc of ctx.
+func (fs *PseudoFS) DownloadDir(ctx context.Context, dir, localDir string, opts DirOptions) (DirTransferStats, error) {
+	t := newDirTransfer(opts.Concurrency)
+	progress := newProgressTracker(ctx, 0)
+	root := fs.path(dir)
+	walkErr := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		} else if t.failed() {
+			return filepath.SkipDir
+		} else if isInternalFile(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir // the trash
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, strings.TrimSuffix(path, metafileExt))
+		if err != nil {
+			return err
+		}
+		localPath := filepath.Join(localDir, rel)
+		if info.IsDir() {
+			if err := os.MkdirAll(localPath, info.Mode().Perm()); err != nil {
+				return errors.Wrapf(err, "could not create %v", localPath)
+			}
+			return nil
+		} else if !strings.HasSuffix(path, metafileExt) {
+			return nil
+		}
+		name := filepath.Join(dir, rel)
+		t.jobs <- func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			pr := &progressReader{ctx: ctx, p: progress}
+			transferred, n, err := fs.downloadFile(pr, name, localPath, opts)
+			if err != nil {
+				return errors.Wrapf(err, "could not download %v", name)
+			}
+			t.record(transferred, n)
+			return nil
+		}
+		return nil
+	})
+	return t.wait(walkErr)
+}
+
+// downloadFile downloads name to localPath, unless it is unchanged. The
+// file's contents are read through pr.
+func (fs *PseudoFS) downloadFile(pr *progressReader, name, localPath string, opts DirOptions) (bool, int64, error) {
+	stat, err := fs.Stat(name)
+	if err != nil {
+		return false, 0, err
+	}
+	pr.p.addTotal(stat.Size())
+	md, err := fs.Metadata(name)
+	if err != nil {
+		return false, 0, err
+	}
+	mtime := stat.ModTime()
+	if t, err := time.Parse(time.RFC3339Nano, md[MetadataModTime]); err == nil {
+		mtime = t
+	}
+	if info, err := os.Stat(localPath); err == nil && !opts.Force && info.Size() == stat.Size() {
+		unchanged := info.ModTime().Equal(mtime)
+		if !unchanged && md[MetadataHash] != "" {
+			sum, err := hashFile(localPath)
+			if err != nil {
+				return false, 0, err
+			}
+			unchanged = md[MetadataHash] == sum
+		}
+		if unchanged {
+			if err := os.Chmod(localPath, stat.Mode().Perm()); err != nil {
+				return false, 0, err
+			}
+			pr.p.add(stat.Size(), hostdb.HostPublicKey{})
+			return false, 0, os.Chtimes(localPath, mtime, mtime)
+		}
+	}
+
+	pf, err := fs.Open(name)
+	if err != nil {
+		return false, 0, err
+	}
+	defer pf.Close()
+	f, err := ioutil.TempFile(filepath.Dir(localPath), "."+filepath.Base(localPath)+"_tmp")
+	if err != nil {
+		return false, 0, err
+	}
+	defer os.Remove(f.Name()) // no-op after rename
+	pr.r = pf
+	n, err := io.Copy(f, pr)
+	if err != nil {
+		f.Close()
+		return false, 0, err
+	} else if err := f.Close(); err != nil {
+		return false, 0, err
+	} else if err := os.Chmod(f.Name(), stat.Mode().Perm()); err != nil {
+		return false, 0, err
+	} else if err := os.Chtimes(f.Name(), mtime, mtime); err != nil {
+		return false, 0, err
+	} else if err := os.Rename(f.Name(), localPath); err != nil {
+		return false, 0, err
+	}
+	return true, n, nil
+}
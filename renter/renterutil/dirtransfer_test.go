@@ -0,0 +1,123 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/frand"
+)
+
+func TestDirTransfer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(filepath.Join(dir, "fs"), fs.hosts)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+
+	// create a local tree
+	files := map[string][]byte{
+		"foo":         frand.Bytes(1000),
+		"sub/bar":     frand.Bytes(20000),
+		"sub/sub/baz": nil,
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for name, data := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(path, data, 0640); err != nil {
+			t.Fatal(err)
+		} else if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(fs.root, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DirOptions{Concurrency: 2, MinShards: 1}
+	if stats, err := fs.UploadDir(context.Background(), src, "backup", opts); err != nil {
+		t.Fatal(err)
+	} else if stats.Transferred != 3 || stats.Skipped != 0 || stats.Bytes != 21000 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+	// nothing has changed, so nothing should be uploaded
+	if stats, err := fs.UploadDir(context.Background(), src, "backup", opts); err != nil {
+		t.Fatal(err)
+	} else if stats.Transferred != 0 || stats.Skipped != 3 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+	// touching a file should not cause it to be uploaded, but modifying it
+	// should
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(src, "foo"), now, now); err != nil {
+		t.Fatal(err)
+	}
+	files["sub/bar"] = frand.Bytes(20000)
+	if err := ioutil.WriteFile(filepath.Join(src, "sub/bar"), files["sub/bar"], 0640); err != nil {
+		t.Fatal(err)
+	}
+	var last TransferProgress
+	ctx := WithProgress(context.Background(), func(tp TransferProgress) { last = tp })
+	if stats, err := fs.UploadDir(ctx, src, "backup", opts); err != nil {
+		t.Fatal(err)
+	} else if stats.Transferred != 1 || stats.Skipped != 2 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+	var total int64
+	for _, data := range files {
+		total += int64(len(data))
+	}
+	if last.Done != total || last.Total != total {
+		t.Fatalf("wrong final progress: %+v", last)
+	}
+
+	// download the tree
+	if stats, err := fs.DownloadDir(context.Background(), "backup", dst, opts); err != nil {
+		t.Fatal(err)
+	} else if stats.Transferred != 3 || stats.Skipped != 0 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+	for name, data := range files {
+		srcInfo, err := os.Stat(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dst, name)
+		if got, err := ioutil.ReadFile(path); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatal("contents do not match data:", name)
+		} else if info, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		} else if info.Mode() != 0640 || !info.ModTime().Equal(srcInfo.ModTime()) {
+			t.Fatal("metadata was not preserved:", name, info.Mode(), info.ModTime(), srcInfo.ModTime())
+		}
+	}
+	if stats, err := fs.DownloadDir(context.Background(), "backup", dst, opts); err != nil {
+		t.Fatal(err)
+	} else if stats.Transferred != 0 || stats.Skipped != 3 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+
+	// a cancelled transfer should fail
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fs.DownloadDir(ctx, "backup", dst, DirOptions{Force: true}); errors.Cause(err) != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+}
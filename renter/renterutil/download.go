@@ -0,0 +1,212 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+// downloadSuffix is appended to the target of DownloadFile to form the
+// filename of its progress sidecar.
+const downloadSuffix = ".usdownload"
+
+// fileIdentity returns a hash of m's layout and contents, so that a resumed
+// download can detect whether the file has changed since it began.
+func fileIdentity(m *renter.MetaFile) (id crypto.Hash) {
+	h := newFileHash()
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(m.Filesize))
+	h.Write(buf)
+	for _, shard := range m.Shards {
+		binary.LittleEndian.PutUint64(buf, uint64(len(shard)))
+		h.Write(buf)
+		for _, ss := range shard {
+			h.Write(ss.MerkleRoot[:])
+			binary.LittleEndian.PutUint32(buf[:4], ss.SegmentIndex)
+			binary.LittleEndian.PutUint32(buf[4:], ss.NumSegments)
+			h.Write(buf)
+		}
+	}
+	if data, err := m.InlineData(); err == nil {
+		h.Write(data)
+	}
+	h.Sum(id[:0])
+	return
+}
+
+// downloadRanges returns the byte ranges of m that DownloadFile downloads and
+// records separately, namely its chunks, clipped to its filesize.
+func downloadRanges(m *renter.MetaFile) [][2]int64 {
+	bounds := m.ChunkBoundaries()
+	if m.IsInline() || len(bounds) < 2 {
+		return [][2]int64{{0, m.Filesize}}
+	}
+	var ranges [][2]int64
+	for i := 0; i+1 < len(bounds) && bounds[i] < m.Filesize; i++ {
+		end := bounds[i+1]
+		if end > m.Filesize {
+			end = m.Filesize
+		}
+		ranges = append(ranges, [2]int64{bounds[i], end})
+	}
+	return ranges
+}
+
+// A downloadSidecar records the progress of DownloadFile. It consists of the
+// identity of the file being downloaded, followed by the hash of each range
+// that has been written to disk, or zeros for each range that has not.
+type downloadSidecar struct {
+	f      *os.File
+	hashes []crypto.Hash
+}
+
+// openDownloadSidecar opens the sidecar at path, resetting it if it does not
+// match id and numRanges. It reports whether the sidecar was reset.
+func openDownloadSidecar(path string, id crypto.Hash, numRanges int) (*downloadSidecar, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	sc := &downloadSidecar{f: f, hashes: make([]crypto.Hash, numRanges)}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	if len(data) == crypto.HashSize*(1+numRanges) && bytes.Equal(data[:crypto.HashSize], id[:]) {
+		for i := range sc.hashes {
+			copy(sc.hashes[i][:], data[crypto.HashSize*(1+i):])
+		}
+		return sc, false, nil
+	}
+	data = make([]byte, crypto.HashSize*(1+numRanges))
+	copy(data, id[:])
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, false, err
+	} else if _, err := f.WriteAt(data, 0); err != nil {
+		f.Close()
+		return nil, false, err
+	} else if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	return sc, true, nil
+}
+
+// markDone records that range i, with the specified hash, has been written to
+// disk.
+func (sc *downloadSidecar) markDone(i int, h crypto.Hash) error {
+	sc.hashes[i] = h
+	if _, err := sc.f.WriteAt(h[:], int64(crypto.HashSize*(1+i))); err != nil {
+		return err
+	}
+	return sc.f.Sync()
+}
+
+// DownloadFile downloads the named file to localPath, such that the download
+// can be resumed if it is interrupted. The file is downloaded one chunk at a
+// time into a sparse file at localPath, and the hash of each chunk is recorded
+// in a sidecar file alongside it once the chunk has been written to disk. If
+// a sidecar already exists, DownloadFile first re-hashes the chunks it
+// records and resumes from the first chunk that is missing or does not match;
+// if the file has changed since the sidecar was written, the download starts
+// over. Chunks covered by the file's integrity manifest (see
+// renter.ExtChunkHashes) are verified against it before they are written.
+// Once every chunk has been downloaded, the sidecar is removed, and the mode
+// and modification time of localPath are set to those of the file.
+//
+// Uncommitted writes to the file are not included; the metafile as last
+// committed is downloaded. DownloadFile stops between chunks if ctx is
+// cancelled, and reports its progress to the ProgressFunc of ctx (see
+// WithProgress); chunks recovered from a previous attempt count towards the
+// progress immediately.
+func (fs *PseudoFS) DownloadFile(ctx context.Context, name, localPath string) error {
+	fs.mu.RLock()
+	m, err := readMetaFile(fs.path(name)+metafileExt, fs.metaKey)
+	fs.mu.RUnlock()
+	if err != nil {
+		return errors.Wrapf(err, "could not read %v", name)
+	}
+	ranges := downloadRanges(m)
+	sc, reset, err := openDownloadSidecar(localPath+downloadSuffix, fileIdentity(m), len(ranges))
+	if err != nil {
+		return errors.Wrap(err, "could not open progress sidecar")
+	}
+	defer sc.f.Close()
+	f, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE, m.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if stat, err := f.Stat(); err != nil {
+		return err
+	} else if reset || stat.Size() != m.Filesize {
+		// start over with an empty, sparse file
+		for i := range sc.hashes {
+			sc.hashes[i] = crypto.Hash{}
+		}
+		if err := f.Truncate(0); err != nil {
+			return err
+		} else if err := f.Truncate(m.Filesize); err != nil {
+			return err
+		}
+	}
+
+	progress := newProgressTracker(ctx, m.Filesize)
+	var maxLen int64
+	for _, r := range ranges {
+		if r[1]-r[0] > maxLen {
+			maxLen = r[1] - r[0]
+		}
+	}
+	buf := make([]byte, maxLen)
+	of := &openMetaFile{name: name, m: m}
+	for i, r := range ranges {
+		chunk := buf[:r[1]-r[0]]
+		if sc.hashes[i] != (crypto.Hash{}) {
+			// verify the chunk written by a previous attempt
+			if _, err := f.ReadAt(chunk, r[0]); err != nil && err != io.EOF {
+				return err
+			} else if renter.HashChunk(chunk) == sc.hashes[i] {
+				progress.add(int64(len(chunk)), hostdb.HostPublicKey{})
+				continue
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fs.mu.RLock()
+		_, err := fs.fileReadAt(of, chunk, r[0])
+		fs.mu.RUnlock()
+		if err != nil && err != io.EOF {
+			return errors.Wrapf(err, "could not download chunk %v", i)
+		}
+		if _, err := f.WriteAt(chunk, r[0]); err != nil {
+			return err
+		} else if err := f.Sync(); err != nil {
+			return err
+		} else if err := sc.markDone(i, renter.HashChunk(chunk)); err != nil {
+			return errors.Wrap(err, "could not update progress sidecar")
+		}
+		progress.add(int64(len(chunk)), hostdb.HostPublicKey{})
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	} else if err := os.Chmod(localPath, m.Mode.Perm()); err != nil {
+		return err
+	} else if err := os.Chtimes(localPath, m.ModTime, m.ModTime); err != nil {
+		return err
+	}
+	sc.f.Close()
+	return os.Remove(sc.f.Name())
+}
@@ -0,0 +1,101 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestDownloadFile(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(filepath.Join(dir, "fs"), fs.hosts)
+	if err := os.MkdirAll(fs.root, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// upload a file spanning three chunks
+	data := frand.Bytes(renterhost.SectorSize*2 + 1000)
+	pf, err := fs.Create("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupt the download after the first chunk
+	localPath := filepath.Join(dir, "foo")
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = WithProgress(ctx, func(tp TransferProgress) { cancel() })
+	if err := fs.DownloadFile(ctx, "foo", localPath); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	} else if _, err := os.Stat(localPath + downloadSuffix); err != nil {
+		t.Fatal("expected sidecar to exist:", err)
+	} else if info, err := os.Stat(localPath); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != int64(len(data)) {
+		t.Fatal("expected sparse file of full size, got", info.Size())
+	}
+
+	// resume the download; the first chunk should not be downloaded again
+	var first TransferProgress
+	ctx = WithProgress(context.Background(), func(tp TransferProgress) {
+		if first.Done == 0 {
+			first = tp
+		}
+	})
+	if err := fs.DownloadFile(ctx, "foo", localPath); err != nil {
+		t.Fatal(err)
+	} else if first.Done != renterhost.SectorSize || first.Total != int64(len(data)) {
+		t.Fatalf("expected first chunk to be recovered, got %+v", first)
+	} else if got, err := ioutil.ReadFile(localPath); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatal("contents do not match data")
+	} else if _, err := os.Stat(localPath + downloadSuffix); !os.IsNotExist(err) {
+		t.Fatal("expected sidecar to be removed:", err)
+	}
+
+	// a chunk corrupted on disk should be downloaded again
+	ctx, cancel = context.WithCancel(context.Background())
+	ctx = WithProgress(ctx, func(tp TransferProgress) { cancel() })
+	if err := os.Remove(localPath); err != nil {
+		t.Fatal(err)
+	} else if err := fs.DownloadFile(ctx, "foo", localPath); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	f, err := os.OpenFile(localPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := f.WriteAt([]byte("corrupt"), 10); err != nil {
+		t.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.DownloadFile(context.Background(), "foo", localPath); err != nil {
+		t.Fatal(err)
+	} else if got, err := ioutil.ReadFile(localPath); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatal("contents do not match data")
+	}
+}
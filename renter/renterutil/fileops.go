@@ -2,8 +2,12 @@ package renterutil
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"math"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -12,6 +16,7 @@ import (
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renterhost"
 )
 
@@ -20,8 +25,21 @@ type openMetaFile struct {
 	m             *renter.MetaFile
 	pendingWrites []pendingWrite
 	pendingChunks []pendingChunk
-	offset        int64
-	closed        bool
+	refs          int  // number of open descriptors
+	logged        bool // pending writes are recorded in the write-back log
+}
+
+// A fileDesc is an open file descriptor. Each descriptor has its own offset;
+// descriptors for the same file share an openMetaFile, so writes made via
+// one are immediately visible via the others.
+type fileDesc struct {
+	f      *openMetaFile
+	offset int64
+
+	// sequential access detection; see readAhead
+	lastEnd    int64 // end of the previous Read
+	seqReads   int   // number of consecutive sequential Reads
+	prefetched int64 // end of the data prefetched so far
 }
 
 type pendingWrite struct {
@@ -35,6 +53,7 @@ type pendingChunk struct {
 	offset     int64 // in segments
 	length     int64 // in segments
 	sliceIndex int   // index within (SectorBuilder).Slices()
+	hash       crypto.Hash
 }
 
 func mergePendingWrites(pendingWrites []pendingWrite, pw pendingWrite) []pendingWrite {
@@ -89,6 +108,14 @@ func (f *openMetaFile) calcShardSize(offset int64, n int) int {
 	return numSegments * merkle.SegmentSize
 }
 
+// addGarbage records the numSegments segments of the shardIndex'th shard's
+// slice ss, beginning at segment index start, as garbage.
+func (f *openMetaFile) addGarbage(shardIndex int, ss renter.SectorSlice, start, numSegments uint32) {
+	ss.SegmentIndex = start
+	ss.NumSegments = numSegments
+	f.m.AddGarbage(renter.GarbageSlice{Host: f.m.Hosts[shardIndex], Slice: ss})
+}
+
 // use f.pendingChunks to lookup new slices for each shard, and overwrite f's
 // shards with these
 func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*renter.SectorBuilder) {
@@ -99,8 +126,15 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 	oldShards := f.m.Shards
 	newShards := make([][]renter.SectorSlice, len(oldShards))
 	for i := range newShards {
-		newShards[i] = oldShards[i][:0]
+		newShards[i] = make([]renter.SectorSlice, 0, len(oldShards[i])+len(f.pendingChunks))
+	}
+	// the integrity manifest is updated in lockstep with the shards; chunks
+	// that are only partially overwritten can no longer be verified
+	oldHashes := f.m.ChunkHashes()
+	for len(oldHashes) < len(oldShards[0]) {
+		oldHashes = append(oldHashes, crypto.Hash{})
 	}
+	var newHashes []crypto.Hash
 	pending := f.pendingChunks
 	var offset int64
 	for len(oldShards[0])+len(pending) > 0 {
@@ -115,6 +149,7 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 				ss := sectors[hostKey].Slices()[pc.sliceIndex]
 				newShards[i] = append(newShards[i], ss)
 			}
+			newHashes = append(newHashes, pc.hash)
 			offset += pc.length
 			// consume old slices that we overwrote
 			overlap := pc.length
@@ -122,16 +157,20 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 				ss := oldShards[0][0]
 				if int64(ss.NumSegments) <= overlap {
 					for i := range oldShards {
+						f.addGarbage(i, oldShards[i][0], oldShards[i][0].SegmentIndex, oldShards[i][0].NumSegments)
 						oldShards[i] = oldShards[i][1:]
 					}
+					oldHashes = oldHashes[1:]
 					overlap -= int64(ss.NumSegments)
 				} else {
 					// trim the beginning of this chunk
-					delta := ss.NumSegments - uint32(overlap)
+					delta := uint32(overlap)
 					for i := range oldShards {
+						f.addGarbage(i, oldShards[i][0], oldShards[i][0].SegmentIndex, delta)
 						oldShards[i][0].SegmentIndex += delta
 						oldShards[i][0].NumSegments -= delta
 					}
+					oldHashes[0] = crypto.Hash{}
 					break
 				}
 			}
@@ -143,12 +182,17 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 				newShards[i] = append(newShards[i], oldShards[i][0])
 				oldShards[i] = oldShards[i][1:]
 			}
+			newHashes = append(newHashes, oldHashes[0])
+			oldHashes = oldHashes[1:]
 			// truncate if we would overlap a pending chunk
 			if len(pending) > 0 && offset+numSegments > pending[0].offset {
 				numSegments = pending[0].offset - offset
 				for i := range newShards {
-					newShards[i][len(newShards[i])-1].NumSegments = uint32(numSegments)
+					ss := &newShards[i][len(newShards[i])-1]
+					f.addGarbage(i, *ss, ss.SegmentIndex+uint32(numSegments), ss.NumSegments-uint32(numSegments))
+					ss.NumSegments = uint32(numSegments)
 				}
+				newHashes[len(newHashes)-1] = crypto.Hash{}
 			}
 			offset += numSegments
 
@@ -158,6 +202,7 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 	}
 
 	f.m.Shards = newShards
+	f.m.SetChunkHashes(newHashes)
 	f.m.Filesize = f.filesize()
 }
 
@@ -165,7 +210,10 @@ func (fs *PseudoFS) commitChanges(f *openMetaFile) error {
 	if !f.m.ModTime.After(fs.lastCommitTime) {
 		return nil
 	}
-	return renter.WriteMetaFile(fs.path(f.name)+metafileExt, f.m)
+	if err := writeMetaFile(fs.path(f.name)+metafileExt, f.m, fs.metaKey); err != nil {
+		return err
+	}
+	return fs.updateDirIndexesForFile(f.name, f.m)
 }
 
 func (fs *PseudoFS) canFit(f *openMetaFile, shardSize int) bool {
@@ -189,6 +237,49 @@ func (fs *PseudoFS) canFit(f *openMetaFile, shardSize int) bool {
 	return true
 }
 
+// applyInline stores f's pending writes inline in its metafile, if f is small
+// enough and has no data on hosts. If f is already inline but has outgrown
+// the inline threshold, its inline data is instead converted to a pending
+// write, so that it will be uploaded along with the rest of the file.
+func (fs *PseudoFS) applyInline(f *openMetaFile) error {
+	if len(f.pendingWrites) == 0 {
+		return nil
+	}
+	for _, shard := range f.m.Shards {
+		if len(shard) > 0 {
+			return nil
+		}
+	}
+	var data []byte
+	if f.m.IsInline() {
+		var err error
+		if data, err = f.m.InlineData(); err != nil {
+			return err
+		}
+	}
+	if size := f.filesize(); size > fs.inlineSize {
+		if f.m.IsInline() {
+			pending := []pendingWrite{{data: data, offset: 0}}
+			for _, pw := range f.pendingWrites {
+				pending = mergePendingWrites(pending, pw)
+			}
+			f.pendingWrites = pending
+			f.m.RemoveInlineData()
+		}
+		return nil
+	} else if int64(len(data)) < size {
+		data = append(data, make([]byte, size-int64(len(data)))...)
+	}
+	for _, pw := range f.pendingWrites {
+		copy(data[pw.offset:], pw.data)
+	}
+	if err := f.m.SetInlineData(data); err != nil {
+		return err
+	}
+	f.pendingWrites = f.pendingWrites[:0]
+	return nil
+}
+
 // fill shared sectors with encoded chunks from pending writes; creates
 // pendingChunks from pendingWrites
 func (fs *PseudoFS) fillSectors(f *openMetaFile) error {
@@ -241,13 +332,20 @@ func (fs *PseudoFS) fillSectors(f *openMetaFile) error {
 		}
 		f.m.ErasureCode().Encode(pw.data, shards)
 
+		// hash the chunk as it will be recovered, i.e. including padding
+		var chunk bytes.Buffer
+		if err := f.m.ErasureCode().Recover(&chunk, shards, 0, len(shards[0])*f.m.MinShards); err != nil {
+			return err
+		}
+
 		// append the shards to each sector
 		pc := pendingChunk{
 			offset: pw.offset / f.m.MinChunkSize(),
-			length: int64(len(shards[0])),
+			length: int64(len(shards[0]) / merkle.SegmentSize),
+			hash:   renter.HashChunk(chunk.Bytes()),
 		}
 		for shardIndex, hostKey := range f.m.Hosts {
-			pc.sliceIndex = fs.sectors[hostKey].Append(shards[shardIndex], f.m.MasterKey)
+			pc.sliceIndex = fs.sectors[hostKey].Append(shards[shardIndex], f.m.MasterKey, f.m.Cipher())
 			// TODO: may need a separate sliceIndex for each sector...
 		}
 		f.pendingChunks = append(f.pendingChunks, pc)
@@ -266,7 +364,9 @@ func (fs *PseudoFS) flushSectors() error {
 
 	// construct sectors by concatenating uncommitted writes in all files
 	for _, f := range fs.files {
-		if err := fs.fillSectors(f); err != nil {
+		if err := fs.applyInline(f); err != nil {
+			return err
+		} else if err := fs.fillSectors(f); err != nil {
 			return err
 		}
 	}
@@ -306,63 +406,90 @@ func (fs *PseudoFS) flushSectors() error {
 		return errors.Wrap(errs, "could not upload to some hosts")
 	}
 
-	// update files
-	for fd, f := range fs.files {
+	// update files; all metafiles are committed together, so that a crash
+	// cannot leave some of them referencing the new sectors and others not
+	changed := make(map[string]*renter.MetaFile)
+	var changedFiles []*openMetaFile
+	for _, f := range fs.files {
 		f.commitPendingSlices(fs.sectors)
-		if err := fs.commitChanges(f); err != nil {
-			return err
+		if f.m.ModTime.After(fs.lastCommitTime) {
+			changed[fs.path(f.name)+metafileExt] = f.m
+			changedFiles = append(changedFiles, f)
 		}
+	}
+	if err := writeMetaFiles(fs.journalPath(), changed, fs.metaKey); err != nil {
+		return err
+	}
+	for id, f := range fs.files {
 		f.pendingWrites = f.pendingWrites[:0]
-		if f.closed {
-			delete(fs.files, fd)
+		if f.refs == 0 {
+			delete(fs.files, id)
 		}
 	}
 	fs.lastCommitTime = time.Now()
+	if err := fs.rewriteWriteBack(); err != nil {
+		return err
+	}
+	for _, f := range changedFiles {
+		if err := fs.updateDirIndexesForFile(f.name, f.m); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (fs *PseudoFS) fileRead(f *openMetaFile, p []byte) (int, error) {
-	if size := f.filesize(); f.offset >= size {
+func (fs *PseudoFS) fileRead(d *fileDesc, p []byte) (int, error) {
+	f := d.f
+	if size := f.filesize(); d.offset >= size {
 		return 0, io.EOF
-	} else if int64(len(p)) > size-f.offset {
+	} else if int64(len(p)) > size-d.offset {
 		// partial read at EOF
-		p = p[:size-f.offset]
+		p = p[:size-d.offset]
 	} else if int64(len(p)) > f.m.MaxChunkSize() {
 		// never download more than SectorSize bytes from each host
 		p = p[:f.m.MaxChunkSize()]
 	}
 
-	_, err := fs.fileReadAt(f, p, f.offset)
+	if d.offset == d.lastEnd {
+		d.seqReads++
+	} else {
+		d.seqReads = 0
+	}
+	_, err := fs.fileReadAt(f, p, d.offset)
 	if err != nil {
 		return 0, err
 	}
-	f.offset += int64(len(p))
+	d.offset += int64(len(p))
+	d.lastEnd = d.offset
+	fs.readAhead(d)
 	return len(p), err
 }
 
-func (fs *PseudoFS) fileWrite(f *openMetaFile, p []byte) (int, error) {
-	if _, err := fs.fileWriteAt(f, p, f.offset); err != nil {
+func (fs *PseudoFS) fileWrite(d *fileDesc, p []byte) (int, error) {
+	if _, err := fs.fileWriteAt(d.f, p, d.offset); err != nil {
 		return 0, err
 	}
-	f.offset += int64(len(p))
+	d.offset += int64(len(p))
 	return len(p), nil
 }
 
-func (fs *PseudoFS) fileSeek(f *openMetaFile, offset int64, whence int) (int64, error) {
-	newOffset := f.offset
+func (fs *PseudoFS) fileSeek(d *fileDesc, offset int64, whence int) (int64, error) {
+	newOffset := d.offset
 	switch whence {
 	case io.SeekStart:
 		newOffset = offset
 	case io.SeekCurrent:
 		newOffset += offset
 	case io.SeekEnd:
-		newOffset = f.filesize() - offset
+		newOffset = d.f.filesize() + offset
+	default:
+		return 0, errors.New("invalid whence")
 	}
 	if newOffset < 0 {
 		return 0, errors.New("seek position cannot be negative")
 	}
-	f.offset = newOffset
-	return f.offset, nil
+	d.offset = newOffset
+	return d.offset, nil
 }
 
 func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error) {
@@ -383,6 +510,24 @@ func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error
 			return lenp, nil
 		}
 	}
+	// inline files need not be downloaded
+	if f.m.IsInline() {
+		data, err := f.m.InlineData()
+		if err != nil {
+			return 0, err
+		}
+		buf := make([]byte, f.filesize())
+		copy(buf, data)
+		for _, pw := range f.pendingWrites {
+			copy(buf[pw.offset:], pw.data)
+		}
+		copy(p, buf[off:])
+		if partial {
+			return lenp, io.EOF
+		}
+		return lenp, nil
+	}
+
 	// check for a pending write that partially overlaps p at the end of the
 	// file; we won't be able to download this data, since it hasn't been
 	// uploaded to hosts yet
@@ -396,114 +541,405 @@ func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error
 		}
 	}
 
-	start := (off / f.m.MinChunkSize()) * merkle.SegmentSize
-	end := ((off + int64(len(p))) / f.m.MinChunkSize()) * merkle.SegmentSize
-	if (off+int64(len(p)))%f.m.MinChunkSize() != 0 {
+	// files with redundancy tiers are read-only, so there are no pending
+	// writes to apply
+	if len(f.m.RedundancyTiers()) > 0 {
+		if err := fs.tieredReadAt(f, p, off); err != nil {
+			return 0, err
+		}
+		if partial {
+			return lenp, io.EOF
+		}
+		return lenp, nil
+	}
+
+	// if the integrity manifest covers any of the chunks overlapping p, expand
+	// the read to span those chunks in full, so that they can be verified
+	readOff, readEnd := off, off+int64(len(p))
+	var verify []int
+	if hashes := f.m.ChunkHashes(); len(hashes) > 0 {
+		bounds := f.m.ChunkBoundaries()
+		for i := 0; i < len(hashes) && i+1 < len(bounds); i++ {
+			if bounds[i] >= off+int64(len(p)) || bounds[i+1] <= off || hashes[i] == (crypto.Hash{}) {
+				continue
+			}
+			verify = append(verify, i)
+			if bounds[i] < readOff {
+				readOff = bounds[i]
+			}
+			if bounds[i+1] > readEnd {
+				readEnd = bounds[i+1]
+			}
+		}
+	}
+
+	start := (readOff / f.m.MinChunkSize()) * merkle.SegmentSize
+	end := (readEnd / f.m.MinChunkSize()) * merkle.SegmentSize
+	if readEnd%f.m.MinChunkSize() != 0 {
 		end += merkle.SegmentSize
 	}
 	offset, length := start, end-start
 
-	// download shards in parallel, stopping when we have any f.m.MinShards of
-	// them
-	shards := make([][]byte, len(f.m.Hosts))
-	for i := range shards {
-		shards[i] = make([]byte, 0, length)
+	shards, err := fs.downloadShards(f, offset, length, f.m.MinShards)
+	if err != nil {
+		return 0, err
 	}
+
+	if len(verify) == 0 {
+		// recover data shards directly into p
+		skip := int(off % f.m.MinChunkSize())
+		err := f.m.ErasureCode().Recover(bytes.NewBuffer(p[:0]), shards, skip, len(p))
+		if err != nil {
+			return 0, errors.Wrap(err, "could not recover chunk")
+		}
+	} else {
+		// recover the full chunks and verify them before copying into p
+		buf := make([]byte, readEnd-readOff)
+		skip := int(readOff % f.m.MinChunkSize())
+		err := f.m.ErasureCode().Recover(bytes.NewBuffer(buf[:0]), shards, skip, len(buf))
+		if err != nil {
+			return 0, errors.Wrap(err, "could not recover chunk")
+		}
+		hashes, bounds := f.m.ChunkHashes(), f.m.ChunkBoundaries()
+		for _, i := range verify {
+			chunk := buf[bounds[i]-readOff : bounds[i+1]-readOff]
+			if renter.HashChunk(chunk) != hashes[i] {
+				return 0, errors.Wrapf(renter.ErrBadChecksum, "chunk %v does not match integrity manifest", i)
+			}
+		}
+		copy(p, buf[off-readOff:])
+	}
+
+	// apply any pending writes
+	//
+	// TODO: do this *before* downloading, and only download what we don't have
+	for _, pw := range f.pendingWrites {
+		if off <= pw.offset && pw.offset <= off+int64(len(p)) {
+			copy(p[pw.offset-off:], pw.data)
+		} else if off <= pw.end() && pw.end() <= off+int64(len(p)) {
+			copy(p, pw.data[off-pw.offset:])
+		}
+	}
+
+	if partial {
+		return lenp, io.EOF
+	}
+	return lenp, nil
+}
+
+// tieredReadAt reads p from a file with redundancy tiers. Since the chunks of
+// such files are not uniformly sized, each chunk overlapping p is downloaded
+// and recovered separately.
+func (fs *PseudoFS) tieredReadAt(f *openMetaFile, p []byte, off int64) error {
+	bounds, minShards := f.m.ChunkLayout()
+	hashes := f.m.ChunkHashes()
+	end := off + int64(len(p))
+	var shardOff int64
+	for i := 0; i+1 < len(bounds) && bounds[i] < end; i++ {
+		chunkShardSize := (bounds[i+1] - bounds[i]) / int64(minShards[i])
+		if bounds[i+1] <= off {
+			shardOff += chunkShardSize
+			continue
+		}
+		// read only the necessary segments, unless the chunk must be verified
+		readOff, readEnd := bounds[i], bounds[i+1]
+		verify := i < len(hashes) && hashes[i] != (crypto.Hash{})
+		if !verify {
+			if off > readOff {
+				readOff = off
+			}
+			if end < readEnd {
+				readEnd = end
+			}
+		}
+		segSize := merkle.SegmentSize * int64(minShards[i])
+		start := ((readOff - bounds[i]) / segSize) * merkle.SegmentSize
+		length := ((readEnd-bounds[i]+segSize-1)/segSize)*merkle.SegmentSize - start
+		shards, err := fs.downloadShards(f, shardOff+start, length, minShards[i])
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, readEnd-readOff)
+		skip := int((readOff - bounds[i]) % segSize)
+		if err := f.m.ChunkErasureCode(minShards[i]).Recover(bytes.NewBuffer(buf[:0]), shards, skip, len(buf)); err != nil {
+			return errors.Wrap(err, "could not recover chunk")
+		}
+		if verify && renter.HashChunk(buf) != hashes[i] {
+			return errors.Wrapf(renter.ErrBadChecksum, "chunk %v does not match integrity manifest", i)
+		}
+		// copy the overlapping portion into p
+		lo, hi := off, end
+		if readOff > lo {
+			lo = readOff
+		}
+		if readEnd < hi {
+			hi = readEnd
+		}
+		copy(p[lo-off:hi-off], buf[lo-readOff:])
+		shardOff += chunkShardSize
+	}
+	return nil
+}
+
+// stragglerSlack is added to a download's expected duration to determine
+// when it is considered a straggler, so that ordinary jitter does not trigger
+// speculative downloads.
+const stragglerSlack = 100 * time.Millisecond
+
+// A shardDownload is an in-progress download of a single shard.
+type shardDownload struct {
+	start    time.Time
+	expected time.Duration // 0 if unknown
+	raced    bool          // a speculative download was started in its place
+
+	mu        sync.Mutex
+	s         *proto.Session
+	cancelled bool
+}
+
+// cancel prevents the download from starting, if it has not already. If
+// interrupt is true, a download in progress is interrupted; otherwise, it is
+// allowed to finish, but its result is discarded. Interrupting a download
+// forces the host to be reconnected, so it is only worthwhile for downloads
+// that are expected to take a long time.
+func (d *shardDownload) cancel(interrupt bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cancelled = true
+	if d.s != nil && interrupt {
+		d.s.Interrupt()
+	}
+}
+
+// deadline returns the time after which the download is considered a
+// straggler. It returns false if the download has already been raced, or if
+// its duration cannot be estimated.
+func (d *shardDownload) deadline() (time.Time, bool) {
+	if d.raced || d.expected <= 0 || d.expected == math.MaxInt64 {
+		return time.Time{}, false
+	}
+	return d.start.Add(2*d.expected + stragglerSlack), true
+}
+
+// setSession sets the session used by the download, returning false if the
+// download has been cancelled.
+func (d *shardDownload) setSession(s *proto.Session) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.s = s
+	return !d.cancelled
+}
+
+// A ttfbWriter records the time at which it was first written to.
+type ttfbWriter struct {
+	buf   *bytes.Buffer
+	start time.Time
+	ttfb  time.Duration
+}
+
+func (w *ttfbWriter) Write(p []byte) (int, error) {
+	if w.ttfb == 0 && len(p) > 0 {
+		w.ttfb = time.Since(w.start)
+	}
+	return w.buf.Write(p)
+}
+
+// downloadShards downloads the specified section of f's shards in parallel,
+// stopping when any minShards of them have been downloaded. The shards that
+// were not downloaded are left empty.
+//
+// Hosts are tried in order of their expected download time, as learned from
+// previous downloads (see HostSet.DownloadPerformance). To hide the latency of
+// slow hosts, extra shards are downloaded speculatively: initially, the
+// filesystem's download overdrive, and thereafter, one more for each download
+// that takes much longer than expected. Once minShards have been downloaded,
+// any downloads still in progress are cancelled.
+func (fs *PseudoFS) downloadShards(f *openMetaFile, offset, length int64, minShards int) ([][]byte, error) {
+	return fs.downloadShardsWith(context.Background(), fs.cache, fs.overdrive, f, offset, length, minShards)
+}
+
+// downloadShardsWith is like downloadShards, but uses the specified cache and
+// overdrive rather than the filesystem's, so that it may be called without
+// holding fs.mu. If ctx is cancelled, any downloads in progress are
+// interrupted, and ctx.Err() is returned.
+func (fs *PseudoFS) downloadShardsWith(ctx context.Context, cache *SectorCache, overdrive int, f *openMetaFile, offset, length int64, minShards int) ([][]byte, error) {
+	shards := make([][]byte, len(f.m.Hosts))
 	type req struct {
 		shardIndex int
 		block      bool // wait to acquire
 	}
-	reqChan := make(chan req, f.m.MinShards)
-	respChan := make(chan *HostError, f.m.MinShards)
-	reqQueue := make([]req, len(f.m.Hosts))
-	// initialize queue in random order
-	for i, shardIndex := range frand.Perm(len(reqQueue)) {
-		reqQueue[i] = req{shardIndex, false}
+	type resp struct {
+		shardIndex int
+		data       []byte
+		err        *HostError
+	}
+	c, siaKey := f.m.Cipher(), f.m.SiaKey()
+	key := f.m.MasterKey
+	if siaKey != nil {
+		cache = nil
+	}
+	// respChan is large enough to hold a response for every download, so that
+	// cancelled downloads never block
+	respChan := make(chan resp, len(f.m.Hosts))
+	expected := make([]time.Duration, len(f.m.Hosts))
+	for i, hostKey := range f.m.Hosts {
+		expected[i] = fs.hosts.expectedDownloadTime(hostKey, length)
 	}
-	for len(reqQueue) > len(f.m.Hosts)-f.m.MinShards {
+	inflight := make(map[int]*shardDownload)
+	startDownload := func(r req) {
+		hostKey := f.m.Hosts[r.shardIndex]
+		d := &shardDownload{
+			start:    time.Now(),
+			expected: expected[r.shardIndex],
+		}
+		// downloads may outlive the call, so they must not access f
+		shard := f.m.Shards[r.shardIndex]
+		inflight[r.shardIndex] = d
+		fs.hosts.background.Add(1)
 		go func() {
-			for req := range reqChan {
-				hostKey := f.m.Hosts[req.shardIndex]
-				s, err := fs.hosts.tryAcquire(hostKey)
-				if err == errHostAcquired && req.block {
-					s, err = fs.hosts.acquire(hostKey)
-				}
-				if err != nil {
-					respChan <- &HostError{hostKey, err}
-					continue
-				}
-				buf := bytes.NewBuffer(shards[req.shardIndex])
+			defer fs.hosts.background.Done()
+			s, err := fs.hosts.tryAcquire(hostKey)
+			if err == errHostAcquired && r.block {
+				s, err = fs.hosts.acquire(hostKey)
+			}
+			if err != nil {
+				respChan <- resp{r.shardIndex, nil, &HostError{hostKey, err}}
+				return
+			}
+			defer fs.hosts.release(hostKey)
+			if !d.setSession(s) {
+				return
+			}
+			w := &ttfbWriter{buf: bytes.NewBuffer(make([]byte, 0, length)), start: time.Now()}
+			if cache != nil {
+				err = cache.downloadSection(w, s, shard, &key, c, offset, length)
+			} else {
 				err = (&renter.ShardDownloader{
 					Downloader: s,
-					Key:        f.m.MasterKey,
-					Slices:     f.m.Shards[req.shardIndex],
-				}).CopySection(buf, offset, length)
-				fs.hosts.release(hostKey)
-				if err != nil {
-					respChan <- &HostError{hostKey, err}
-					continue
-				}
-				shards[req.shardIndex] = buf.Bytes()
-				respChan <- nil
+					Key:        key,
+					Cipher:     c,
+					SiaKey:     siaKey,
+					Slices:     shard,
+				}).CopySection(w, offset, length)
+			}
+			elapsed := time.Since(w.start)
+			if !d.setSession(nil) && err != nil {
+				// assume the download was interrupted
+				fs.hosts.recordCancelled(hostKey, elapsed)
+				fs.hosts.invalidate(hostKey)
+				return
+			} else if err != nil {
+				fs.hosts.recordFailure(hostKey)
+				respChan <- resp{r.shardIndex, nil, &HostError{hostKey, err}}
+				return
 			}
+			fs.hosts.recordDownload(hostKey, length, w.ttfb, elapsed)
+			respChan <- resp{r.shardIndex, w.buf.Bytes(), nil}
 		}()
-		reqChan <- reqQueue[0]
-		reqQueue = reqQueue[1:]
 	}
 
+	// use cached shards where possible
 	var goodShards int
+	reqQueue := make([]req, 0, len(f.m.Hosts))
+	for _, shardIndex := range frand.Perm(len(f.m.Hosts)) {
+		if cache != nil && goodShards < minShards {
+			if data, ok := cache.readSection(f.m.Shards[shardIndex], &key, c, offset, length); ok {
+				shards[shardIndex] = data
+				goodShards++
+				continue
+			}
+		}
+		reqQueue = append(reqQueue, req{shardIndex, false})
+	}
+
+	// order the queue by expected download time, breaking ties randomly
+	sort.SliceStable(reqQueue, func(i, j int) bool {
+		return expected[reqQueue[i].shardIndex] < expected[reqQueue[j].shardIndex]
+	})
+
 	var errs HostErrorSet
-	for goodShards < f.m.MinShards && goodShards+len(errs) < len(f.m.Hosts) {
-		err := <-respChan
-		if err == nil {
-			goodShards++
-		} else {
-			if err.Err == errHostAcquired {
-				// host could not be acquired without blocking; add it to the back
-				// of the queue, but next time, block
-				reqQueue = append(reqQueue, req{
-					shardIndex: f.m.HostIndex(err.HostKey),
-					block:      true,
+	for goodShards < minShards && ctx.Err() == nil {
+		// keep enough downloads in flight to finish, plus the overdrive
+		for len(inflight) < minShards-goodShards+overdrive && len(reqQueue) > 0 {
+			startDownload(reqQueue[0])
+			reqQueue = reqQueue[1:]
+		}
+		if len(inflight) == 0 {
+			break
+		}
+
+		// if there are hosts left to try, race the next one against the
+		// first download to become a straggler
+		var timer *time.Timer
+		var stragglerChan <-chan time.Time
+		if len(reqQueue) > 0 {
+			var next time.Duration = -1
+			for _, d := range inflight {
+				if t, ok := d.deadline(); ok {
+					if rem := time.Until(t); next < 0 || rem < next {
+						next = rem
+					}
+				}
+			}
+			if next >= 0 {
+				timer = time.NewTimer(next)
+				stragglerChan = timer.C
+			}
+		}
+
+		select {
+		case r := <-respChan:
+			delete(inflight, r.shardIndex)
+			if r.err == nil {
+				shards[r.shardIndex] = r.data
+				goodShards++
+			} else if r.err.Err == errHostAcquired {
+				// host could not be acquired without blocking; requeue it behind
+				// any host that is expected to be as fast, but next time, block
+				i := sort.Search(len(reqQueue), func(i int) bool {
+					return expected[reqQueue[i].shardIndex] > expected[r.shardIndex]
 				})
+				reqQueue = append(reqQueue[:i], append([]req{{r.shardIndex, true}}, reqQueue[i:]...)...)
 			} else {
 				// downloading from this host failed; don't try it again
-				errs = append(errs, err)
+				errs = append(errs, r.err)
+			}
+		case <-stragglerChan:
+			var stragglers int
+			for _, d := range inflight {
+				if t, ok := d.deadline(); ok && !time.Now().Before(t) {
+					d.raced = true
+					stragglers++
+				}
 			}
-			// try the next host in the queue
-			if len(reqQueue) > 0 {
-				reqChan <- reqQueue[0]
+			for ; stragglers > 0 && len(reqQueue) > 0; stragglers-- {
+				startDownload(reqQueue[0])
 				reqQueue = reqQueue[1:]
 			}
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
 		}
 	}
-	close(reqChan)
-	if goodShards < f.m.MinShards {
-		return 0, errors.Wrapf(errs, "too many hosts did not supply their shard (needed %v, got %v)",
-			f.m.MinShards, goodShards)
+	for _, d := range inflight {
+		// interrupt stragglers, but let the rest finish, so that we learn
+		// from them
+		d.cancel(d.raced || ctx.Err() != nil)
 	}
-
-	// recover data shards directly into p
-	skip := int(off % f.m.MinChunkSize())
-	err := f.m.ErasureCode().Recover(bytes.NewBuffer(p[:0]), shards, skip, len(p))
-	if err != nil {
-		return 0, errors.Wrap(err, "could not recover chunk")
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-
-	// apply any pending writes
-	//
-	// TODO: do this *before* downloading, and only download what we don't have
-	for _, pw := range f.pendingWrites {
-		if off <= pw.offset && pw.offset <= off+int64(len(p)) {
-			copy(p[pw.offset-off:], pw.data)
-		} else if off <= pw.end() && pw.end() <= off+int64(len(p)) {
-			copy(p, pw.data[off-pw.offset:])
-		}
+	if goodShards < minShards {
+		return nil, errors.Wrapf(errs, "too many hosts did not supply their shard (needed %v, got %v)",
+			minShards, goodShards)
 	}
-
-	if partial {
-		return lenp, io.EOF
+	for i := range shards {
+		if shards[i] == nil {
+			shards[i] = make([]byte, 0, length)
+		}
 	}
-	return lenp, nil
+	return shards, nil
 }
 
 func (fs *PseudoFS) fileWriteAt(f *openMetaFile, p []byte, off int64) (int, error) {
@@ -523,6 +959,9 @@ func (fs *PseudoFS) fileWriteAt(f *openMetaFile, p []byte, off int64) (int, erro
 			return 0, err
 		}
 	}
+	if err := fs.logWrite(f, p, off); err != nil {
+		return 0, err
+	}
 
 	// merge this write with the other pending writes
 	f.pendingWrites = mergePendingWrites(f.pendingWrites, pendingWrite{
@@ -553,28 +992,13 @@ func (fs *PseudoFS) fileTruncate(f *openMetaFile, size int64) error {
 		newPending = append(newPending, pw)
 	}
 	f.pendingWrites = newPending
+	if err := fs.rewriteWriteBack(); err != nil {
+		return err
+	}
 
 	if size < f.m.Filesize {
-		f.m.Filesize = size
-		// update shards
-		for shardIndex, slices := range f.m.Shards {
-			var n int64
-			for i, s := range slices {
-				sliceSize := int64(s.NumSegments) * f.m.MinChunkSize()
-				if n+sliceSize > f.m.Filesize {
-					// trim number of segments
-					s.NumSegments -= uint32(n+sliceSize-f.m.Filesize) / uint32(f.m.MinChunkSize())
-					if s.NumSegments == 0 {
-						slices = slices[:i]
-					} else {
-						slices[i] = s
-						slices = slices[:i+1]
-					}
-					break
-				}
-				n += sliceSize
-			}
-			f.m.Shards[shardIndex] = slices
+		if err := f.m.Truncate(size); err != nil {
+			return err
 		}
 	}
 
@@ -586,6 +1010,9 @@ func (fs *PseudoFS) fileFree(f *openMetaFile) error {
 	// discard pending writes
 	f.pendingWrites = f.pendingWrites[:0]
 	f.pendingChunks = f.pendingChunks[:0]
+	if err := fs.rewriteWriteBack(); err != nil {
+		return err
+	}
 
 	// delete from each host
 	//
@@ -602,6 +1029,9 @@ func (fs *PseudoFS) fileFree(f *openMetaFile) error {
 			for _, ss := range shard {
 				if ss.NumSegments == merkle.SegmentsPerSector {
 					roots = append(roots, ss.MerkleRoot)
+				} else {
+					// the sector may be shared with other files
+					f.addGarbage(shardIndex, ss, ss.SegmentIndex, ss.NumSegments)
 				}
 			}
 			if err := h.DeleteSectors(roots); err != nil {
@@ -615,9 +1045,9 @@ func (fs *PseudoFS) fileFree(f *openMetaFile) error {
 		// delete the shard
 		f.m.Shards[shardIndex] = nil
 	}
+	f.m.SetChunkHashes(nil)
 
 	f.m.Filesize = 0
-	f.offset = 0
 	f.m.ModTime = time.Now()
 	return nil
 }
@@ -626,7 +1056,8 @@ func (fs *PseudoFS) fileSync(f *openMetaFile) error {
 	if len(f.pendingWrites) > 0 {
 		return fs.flushSectors()
 	}
-	return nil
+	// metadata-only changes (e.g. Chmod) must be committed too
+	return fs.commitChanges(f)
 }
 
 func (fs *PseudoFS) fileStat(f *openMetaFile) (os.FileInfo, error) {
@@ -2,6 +2,7 @@ package renterutil
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
 	"path/filepath"
@@ -38,10 +39,20 @@ type PseudoFS struct {
 	root           string
 	curFD          int
 	files          map[int]*openMetaFile
+	fds            map[int]*fileDesc
 	dirs           map[int]*os.File
 	hosts          *HostSet
 	sectors        map[hostdb.HostPublicKey]*renter.SectorBuilder
 	lastCommitTime time.Time
+	inlineSize     int64
+	metaKey        *metaFileKey
+	overdrive      int
+	cache          *SectorCache
+	readAheadN     int
+	trashRetention time.Duration
+	isFailing      func(hostdb.HostPublicKey) bool
+	writeBack      *os.File
+	writeBackStop  chan struct{}
 	mu             sync.RWMutex
 }
 
@@ -49,6 +60,12 @@ func (fs *PseudoFS) path(name string) string {
 	return filepath.Join(fs.root, name)
 }
 
+// journalPath returns the path of the journal used to commit metafile
+// changes; see renter.WriteMetaFiles.
+func (fs *PseudoFS) journalPath() string {
+	return filepath.Join(fs.root, journalFilename)
+}
+
 func isDir(path string) bool {
 	stat, err := os.Stat(path)
 	return err == nil && stat.IsDir()
@@ -58,29 +75,98 @@ func isDir(path string) bool {
 func (fs *PseudoFS) Chmod(name string, mode os.FileMode) error {
 	path := fs.path(name)
 	if isDir(path) {
-		return os.Chmod(path, mode)
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return fs.updateDirIndexesForDir(name)
 	}
-	path += metafileExt
+	return fs.updateMetaFile(name, "chmod", func(m *renter.MetaFile) error {
+		m.Mode = mode
+		return nil
+	})
+}
+
+// Metadata returns the user metadata of the named file.
+func (fs *PseudoFS) Metadata(name string) (map[string]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, of := range fs.files {
+		if of.name == name {
+			return of.m.Metadata(), nil
+		}
+	}
+	m, err := readMetaFile(fs.path(name)+metafileExt, fs.metaKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "metadata %v", name)
+	}
+	return m.Metadata(), nil
+}
+
+// SetMetadata sets the user metadata key of the named file to value.
+func (fs *PseudoFS) SetMetadata(name, key, value string) error {
+	return fs.updateMetaFile(name, "setmetadata", func(m *renter.MetaFile) error {
+		return m.SetMetadata(key, value)
+	})
+}
+
+// DeleteMetadata removes the user metadata key of the named file.
+func (fs *PseudoFS) DeleteMetadata(name, key string) error {
+	return fs.updateMetaFile(name, "deletemetadata", func(m *renter.MetaFile) error {
+		m.DeleteMetadata(key)
+		return nil
+	})
+}
+
+// SetPlacementPolicy sets the placement policy of the named file. It returns
+// an error if the file's current hosts do not satisfy the policy.
+func (fs *PseudoFS) SetPlacementPolicy(name string, p renter.PlacementPolicy) error {
+	return fs.updateMetaFile(name, "setplacementpolicy", func(m *renter.MetaFile) error {
+		if err := p.Check(m.Hosts, fs.hosts.lookup); err != nil {
+			return err
+		}
+		return m.SetPlacementPolicy(p)
+	})
+}
+
+// updateMetaFile applies fn to the metafile of the named file, which may be
+// open, and updates its ModTime. If the file is not open, the metafile is
+// written back to disk.
+func (fs *PseudoFS) updateMetaFile(name, op string, fn func(*renter.MetaFile) error) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	path := fs.path(name) + metafileExt
 
 	// check for open file
 	for _, of := range fs.files {
 		if of.name == name {
-			of.m.Mode = mode
+			if err := fn(of.m); err != nil {
+				return errors.Wrapf(err, "%v %v", op, path)
+			}
 			of.m.ModTime = time.Now()
 			return nil
 		}
 	}
 
-	m, err := renter.ReadMetaFile(path)
+	// lock the metafile, so that other processes do not modify it
+	// concurrently
+	l, err := renter.LockMetaFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "%v %v", op, path)
+	}
+	defer l.Unlock()
+	m, err := readMetaFile(path, fs.metaKey)
 	if err != nil {
-		return errors.Wrapf(err, "chmod %v", path)
+		return errors.Wrapf(err, "%v %v", op, path)
+	} else if err := fn(m); err != nil {
+		return errors.Wrapf(err, "%v %v", op, path)
 	}
-	m.Mode = mode
 	m.ModTime = time.Now()
-	if err := renter.WriteMetaFile(path, m); err != nil {
-		return errors.Wrapf(err, "chmod %v", path)
+	if err := writeMetaFile(path, m, fs.metaKey); err != nil {
+		return errors.Wrapf(err, "%v %v", op, path)
 	}
-	return nil
+	return fs.updateDirIndexesForFile(name, m)
 }
 
 // Create creates the named file with the specified redundancy and mode 0666
@@ -93,7 +179,12 @@ func (fs *PseudoFS) Create(name string, minShards int) (*PseudoFile, error) {
 // Mkdir creates a new directory with the specified name and permission bits
 // (before umask).
 func (fs *PseudoFS) Mkdir(name string, perm os.FileMode) error {
-	return os.Mkdir(fs.path(name), perm)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := os.Mkdir(fs.path(name), perm); err != nil {
+		return err
+	}
+	return fs.updateDirIndexesForDir(name)
 }
 
 // MkdirAll creates a directory named path, along with any necessary parents,
@@ -101,7 +192,12 @@ func (fs *PseudoFS) Mkdir(name string, perm os.FileMode) error {
 // umask) are used for all directories that MkdirAll creates. If path is already
 // a directory, MkdirAll does nothing and returns nil.
 func (fs *PseudoFS) MkdirAll(path string, perm os.FileMode) error {
-	return os.MkdirAll(fs.path(path), perm)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := os.MkdirAll(fs.path(path), perm); err != nil {
+		return err
+	}
+	return fs.updateDirIndexesForDir(path)
 }
 
 // Open opens the named file for reading. The returned file is read-only.
@@ -112,6 +208,14 @@ func (fs *PseudoFS) Open(name string) (*PseudoFile, error) {
 // OpenFile is the generalized open call; most users will use Open or Create
 // instead. It opens the named file with specified flag (os.O_RDONLY etc.) and perm
 // (before umask), if applicable.
+//
+// The flags follow POSIX semantics: os.O_CREATE creates the file if it does
+// not exist, and fails if it does exist and os.O_EXCL is also specified;
+// os.O_TRUNC truncates the file, if it is opened for writing; and
+// os.O_APPEND causes every write to occur at the end of the file. If the file
+// is created, its data will be striped across the filesystem's hosts, with
+// minShards shards required to recover it. If the file is already open, the
+// new descriptor shares its contents, but has its own offset.
 func (fs *PseudoFS) OpenFile(name string, flag int, perm os.FileMode, minShards int) (*PseudoFile, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -131,81 +235,67 @@ func (fs *PseudoFS) OpenFile(name string, flag int, perm os.FileMode, minShards
 		}, nil
 	}
 	path += metafileExt
+	create := flag&os.O_CREATE == os.O_CREATE
+	excl := create && flag&os.O_EXCL == os.O_EXCL
+	trunc := flag&os.O_TRUNC == os.O_TRUNC && flag&rwmask != os.O_RDONLY
 
 	// first check open files
-	//
-	// TODO: handle more flag combos here
-	for fd, of := range fs.files {
-		if of.name == name {
-			of.closed = false
-			of.offset = 0
-			if flag&os.O_APPEND == os.O_APPEND {
-				of.offset = of.filesize()
+	of := fs.lookupFile(name)
+	if of != nil {
+		if excl {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		} else if trunc && create && of.refs == 0 {
+			// no one else is using the file, so replace it outright
+			fs.forgetFile(of)
+			of = nil
+		} else if trunc {
+			if err := fs.fileTruncate(of, 0); err != nil {
+				return nil, errors.Wrapf(err, "open %v", name)
 			}
-			return &PseudoFile{
-				name:  name,
-				flags: flag,
-				fd:    fd,
-				fs:    fs,
-			}, nil
 		}
 	}
 
 	// no open file; create/open a metafile on disk
-	var m *renter.MetaFile
-	if flag&os.O_CREATE == os.O_CREATE {
-		if len(fs.hosts.sessions) < minShards {
-			return nil, errors.New("minShards cannot be greater than the number of hosts")
-		}
-		if flag&os.O_TRUNC == os.O_TRUNC {
-			// remove existing file
-			for fd, f := range fs.files {
-				if f.name == name && f.closed {
-					delete(fs.files, fd)
-					break
-				}
-			}
+	if of == nil {
+		_, err := os.Stat(path)
+		exists := err == nil
+		if excl && exists {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
 		}
-		hosts := make([]hostdb.HostPublicKey, 0, len(fs.hosts.sessions))
-		for hostKey := range fs.hosts.sessions {
-			hosts = append(hosts, hostKey)
-		}
-		m = renter.NewMetaFile(perm, 0, hosts, minShards)
-	} else {
-		var err error
-		m, err = renter.ReadMetaFile(path)
-		if err != nil {
-			return nil, errors.Wrapf(err, "open %v", name)
-		}
-		// check whether we have a session for each of the file's hosts
-		var missing []string
-		for _, hostKey := range m.Hosts {
-			if _, ok := fs.hosts.sessions[hostKey]; !ok {
-				missing = append(missing, hostKey.ShortKey())
+		var m *renter.MetaFile
+		if create && (!exists || trunc) {
+			if len(fs.hosts.sessions) < minShards {
+				return nil, errors.New("minShards cannot be greater than the number of hosts")
 			}
-		}
-		if flag&rwmask == os.O_RDONLY {
-			// only need m.MinShards hosts in order to read
-			if have := len(m.Hosts) - len(missing); have < m.MinShards {
-				return nil, errors.Errorf("insufficient contracts: need a contract from at least %v of these hosts: %v",
-					m.MinShards-have, strings.Join(missing, " "))
+			hosts := make([]hostdb.HostPublicKey, 0, len(fs.hosts.sessions))
+			for hostKey := range fs.hosts.sessions {
+				hosts = append(hosts, hostKey)
 			}
+			m = renter.NewMetaFile(perm, 0, hosts, minShards)
 		} else {
-			// need all hosts in order to write
-			if len(missing) > 0 {
-				return nil, errors.Errorf("insufficient contracts: need a contract from each of these hosts: %v",
-					strings.Join(missing, " "))
+			m, err = fs.loadMetaFile(name, path, flag)
+			if err != nil {
+				return nil, err
+			} else if trunc && m.Filesize > 0 {
+				if err := m.Truncate(0); err != nil {
+					return nil, errors.Wrapf(err, "open %v", name)
+				}
+				m.ModTime = time.Now()
 			}
 		}
+		of = &openMetaFile{
+			name: name,
+			m:    m,
+		}
+		fs.files[fs.curFD] = of
 	}
-	of := &openMetaFile{
-		name: name,
-		m:    m,
-	}
+
+	desc := &fileDesc{f: of}
 	if flag&os.O_APPEND == os.O_APPEND {
-		of.offset = m.Filesize
+		desc.offset = of.filesize()
 	}
-	fs.files[fs.curFD] = of
+	of.refs++
+	fs.fds[fs.curFD] = desc
 	fs.curFD++
 	return &PseudoFile{
 		name:  name,
@@ -215,42 +305,144 @@ func (fs *PseudoFS) OpenFile(name string, flag int, perm os.FileMode, minShards
 	}, nil
 }
 
+// loadMetaFile reads the metafile at path, checking that the file can be
+// opened with the specified flags.
+func (fs *PseudoFS) loadMetaFile(name, path string, flag int) (*renter.MetaFile, error) {
+	m, err := readMetaFile(path, fs.metaKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %v", name)
+	}
+	// check whether we have a session for each of the file's hosts
+	var missing []string
+	for _, hostKey := range m.Hosts {
+		if _, ok := fs.hosts.sessions[hostKey]; !ok {
+			missing = append(missing, hostKey.ShortKey())
+		}
+	}
+	if flag&rwmask == os.O_RDONLY {
+		// only need m.MinShards hosts in order to read
+		if have := len(m.Hosts) - len(missing); have < m.MinShards {
+			return nil, errors.Errorf("insufficient contracts: need a contract from at least %v of these hosts: %v",
+				m.MinShards-have, strings.Join(missing, " "))
+		}
+	} else {
+		// need all hosts in order to write
+		if _, ok := m.Extension(renter.ExtSiaCipher); ok {
+			return nil, errors.Errorf("open %v: file was imported from siad and is read-only", name)
+		}
+		if _, ok := m.Extension(renter.ExtRedundancyTiers); ok {
+			return nil, errors.Errorf("open %v: file has redundancy tiers and is read-only", name)
+		}
+		if len(missing) > 0 {
+			return nil, errors.Errorf("insufficient contracts: need a contract from each of these hosts: %v",
+				strings.Join(missing, " "))
+		}
+	}
+	return m, nil
+}
+
+// lookupFile returns the open file with the specified name, or nil if no
+// such file is open.
+func (fs *PseudoFS) lookupFile(name string) *openMetaFile {
+	for _, f := range fs.files {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// forgetFile removes f from the set of open files.
+func (fs *PseudoFS) forgetFile(f *openMetaFile) {
+	for id, of := range fs.files {
+		if of == f {
+			delete(fs.files, id)
+			return
+		}
+	}
+}
+
 // Remove removes the named file or (empty) directory. It does NOT delete the
-// file data on the host; use (PseudoFS).GC and (PseudoFile).Free for that.
+// file data on the host; use (PseudoFS).GC and (PseudoFile).Free for that. If
+// the trash is enabled, files are moved to the trash instead (see
+// SetTrashRetention).
 func (fs *PseudoFS) Remove(name string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
+	if fs.trashRetention > 0 {
+		if err := fs.flushBeforeTrash(name); err != nil {
+			return err
+		}
+	}
 	// remove the file from fs.files if it is closed
-	for fd, f := range fs.files {
-		if f.name == name && f.closed {
-			delete(fs.files, fd)
+	for id, f := range fs.files {
+		if f.name == name && f.refs == 0 {
+			delete(fs.files, id)
+			if err := fs.rewriteWriteBack(); err != nil {
+				return err
+			}
 			break
 		}
 	}
 	// delete the directory or metafile on disk
 	path := fs.path(name)
-	if !isDir(path) {
+	dir := isDir(path)
+	if dir {
+		// the directory's index does not count towards its contents; if the
+		// directory is not empty, the index is rebuilt when next needed
+		os.Remove(filepath.Join(path, dirIndexFilename))
+	} else {
 		path += metafileExt
 	}
-	return os.Remove(path)
+	if fs.trashRetention > 0 && !dir {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		} else if err := fs.moveToTrash(name, path); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path); err != nil {
+		return err
+	}
+	return fs.updateDirIndexes(name, nil)
 }
 
 // RemoveAll removes path and any children it contains. It removes everything it
 // can but returns the first error it encounters. If the path does not exist,
-// RemoveAll returns nil (no error).
+// RemoveAll returns nil (no error). If the trash is enabled, path is moved to
+// the trash instead (see SetTrashRetention).
 func (fs *PseudoFS) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.trashRetention > 0 {
+		if err := fs.flushBeforeTrash(path); err != nil {
+			return err
+		}
+	}
 	// if the remove affects closed files in fs.files, delete them
-	for fd, f := range fs.files {
-		if strings.HasPrefix(f.name, path) && f.closed {
-			delete(fs.files, fd)
+	for id, f := range fs.files {
+		if strings.HasPrefix(f.name, path) && f.refs == 0 {
+			delete(fs.files, id)
 		}
 	}
+	if err := fs.rewriteWriteBack(); err != nil {
+		return err
+	}
 	// delete the directories and metafiles on disk
+	name := path
 	path = fs.path(path)
 	if !isDir(path) {
 		path += metafileExt
 	}
-	return os.RemoveAll(path)
+	if fs.trashRetention > 0 {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil
+		} else if err := fs.moveToTrash(name, path); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return fs.updateDirIndexes(name, nil)
 }
 
 // GC deletes unused data from the filesystem's host set. Any data not
@@ -309,7 +501,7 @@ func (fs *PseudoFS) GC() error {
 		if info.IsDir() || !strings.HasSuffix(path, ".usa") {
 			return nil
 		}
-		m, err := renter.ReadMetaFile(path)
+		m, err := readMetaFile(path, fs.metaKey)
 		if err != nil {
 			// don't continue if a file couldn't be read; the user needs to be
 			// confident that all files were checked
@@ -358,31 +550,179 @@ func (fs *PseudoFS) GC() error {
 	return nil
 }
 
+// ReclaimGarbage deletes sectors that files in the filesystem stopped
+// referencing when they were overwritten, truncated, or freed (see
+// renter.ExtGarbage), and clears the corresponding records. A sector is only
+// deleted if no file within the filesystem still references it; as with GC,
+// this means that sectors referenced only by shared metafiles may be deleted.
+// Records of sectors stored on hosts outside the filesystem's host set are
+// retained.
+//
+// ReclaimGarbage is much cheaper than GC, since it does not need to enumerate
+// the sectors stored on each host, but it cannot reclaim sectors that were
+// never recorded, e.g. those of removed files.
+func (fs *PseudoFS) ReclaimGarbage() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// commit any pending changes, so that the metafiles on disk are current
+	if err := fs.flushSectors(); err != nil {
+		return err
+	}
+
+	// gather the garbage and referenced roots of every file
+	garbage := make(map[hostdb.HostPublicKey]map[crypto.Hash]struct{})
+	referenced := make(map[hostdb.HostPublicKey]map[crypto.Hash]struct{})
+	addRoot := func(set map[hostdb.HostPublicKey]map[crypto.Hash]struct{}, hostKey hostdb.HostPublicKey, root crypto.Hash) {
+		if set[hostKey] == nil {
+			set[hostKey] = make(map[crypto.Hash]struct{})
+		}
+		set[hostKey][root] = struct{}{}
+	}
+	var withGarbage []string
+	err := filepath.Walk(fs.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() || !strings.HasSuffix(path, metafileExt) {
+			return nil
+		}
+		m, err := readMetaFile(path, fs.metaKey)
+		if err != nil {
+			// as in GC, all files must be checked
+			return err
+		}
+		for i, hostKey := range m.Hosts {
+			for _, ss := range m.Shards[i] {
+				addRoot(referenced, hostKey, ss.MerkleRoot)
+			}
+		}
+		if gs := m.Garbage(); len(gs) > 0 {
+			for _, g := range gs {
+				addRoot(garbage, g.Host, g.Slice.MerkleRoot)
+			}
+			withGarbage = append(withGarbage, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// delete unreferenced sectors
+	for hostKey, rootsMap := range garbage {
+		if !fs.hosts.HasHost(hostKey) {
+			continue
+		}
+		var roots []crypto.Hash
+		for root := range rootsMap {
+			if _, ok := referenced[hostKey][root]; !ok {
+				roots = append(roots, root)
+			}
+		}
+		if len(roots) == 0 {
+			continue
+		}
+		err := func() error {
+			h, err := fs.hosts.acquire(hostKey)
+			if err != nil {
+				return err
+			}
+			defer fs.hosts.release(hostKey)
+			return h.DeleteSectors(roots)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	// clear the records of sectors that were deleted or are still referenced
+	for _, path := range withGarbage {
+		m, err := readMetaFile(path, fs.metaKey)
+		if err != nil {
+			return err
+		}
+		var remaining []renter.GarbageSlice
+		for _, g := range m.Garbage() {
+			if !fs.hosts.HasHost(g.Host) {
+				remaining = append(remaining, g)
+			}
+		}
+		m.SetGarbage(remaining)
+		if err := writeMetaFile(path, m, fs.metaKey); err != nil {
+			return err
+		}
+		for _, of := range fs.files {
+			if fs.path(of.name)+metafileExt == path {
+				of.m.SetGarbage(remaining)
+			}
+		}
+	}
+	return nil
+}
+
 // Rename renames (moves) oldpath to newpath. If newpath already exists and is
 // not a directory, Rename replaces it. OS-specific restrictions may apply when
-// oldpath and newpath are in different directories.
+// oldpath and newpath are in different directories. Open files are renamed
+// along with their metafiles, so their descriptors remain valid.
 func (fs *PseudoFS) Rename(oldname, newname string) error {
-	// if there is an open file with oldname, we must sync its contents first
 	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// if there is an open file within oldname, we must sync its contents
+	// first, so that its metafile exists on disk
+	renamed := func(name string) (string, bool) {
+		if name == oldname {
+			return newname, true
+		} else if rel := strings.TrimPrefix(name, oldname+string(filepath.Separator)); rel != name {
+			return filepath.Join(newname, rel), true
+		}
+		return "", false
+	}
 	for _, f := range fs.files {
-		if f.name == oldname && len(f.pendingWrites) > 0 {
+		if _, ok := renamed(f.name); ok && (len(f.pendingWrites) > 0 || f.m.ModTime.After(fs.lastCommitTime)) {
 			if err := fs.flushSectors(); err != nil {
 				return err
 			}
 			break
 		}
 	}
-	fs.mu.Unlock()
 
-	// TODO: how does this interact with open files?
 	oldpath, newpath := fs.path(oldname), fs.path(newname)
-	if !isDir(oldpath) {
+	dir := isDir(oldpath)
+	if !dir {
 		oldpath += metafileExt
+		if !isDir(newpath) {
+			newpath += metafileExt
+		}
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	// a closed file being replaced no longer exists
+	if f := fs.lookupFile(newname); f != nil && f.refs == 0 {
+		fs.forgetFile(f)
+		if err := fs.rewriteWriteBack(); err != nil {
+			return err
+		}
+	}
+	for _, f := range fs.files {
+		if name, ok := renamed(f.name); ok {
+			f.name = name
+		}
+	}
+
+	if !fs.indexingEnabled() {
+		return nil
+	} else if err := fs.updateDirIndexes(oldname, nil); err != nil {
+		return err
+	} else if dir {
+		return fs.updateDirIndexesForDir(newname)
 	}
-	if !isDir(newpath) {
-		newpath += metafileExt
+	m, err := readMetaFile(newpath, fs.metaKey)
+	if err != nil {
+		return errors.Wrap(err, "could not update directory index")
 	}
-	return os.Rename(oldpath, newpath)
+	return fs.updateDirIndexesForFile(newname, m)
 }
 
 // Stat returns the FileInfo structure describing file.
@@ -392,7 +732,7 @@ func (fs *PseudoFS) Stat(name string) (os.FileInfo, error) {
 		if f.name == name {
 			info := pseudoFileInfo{name: f.name, m: f.m.MetaIndex}
 			info.m.Filesize = f.filesize()
-			fs.mu.Unlock()
+			fs.mu.RUnlock()
 			return info, nil
 		}
 	}
@@ -403,7 +743,7 @@ func (fs *PseudoFS) Stat(name string) (os.FileInfo, error) {
 		return os.Stat(path)
 	}
 	path += metafileExt
-	index, err := renter.ReadMetaIndex(path)
+	index, err := readMetaIndex(path, fs.metaKey)
 	if err != nil {
 		return nil, errors.Wrapf(err, "stat %v", name)
 	}
@@ -418,11 +758,43 @@ func (fs *PseudoFS) Close() error {
 	if err := fs.flushSectors(); err != nil {
 		return err
 	}
-	for fd, f := range fs.files {
+	return fs.closeAll()
+}
+
+// Flush uploads any uncommitted writes to hosts and updates the metafiles of
+// the affected files. Unlike Close, Flush does not close any files.
+func (fs *PseudoFS) Flush() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.flushSectors()
+}
+
+// RegisterShutdown registers the filesystem with g. Uncommitted writes are
+// flushed during StageFlush, and open files and host sessions are closed
+// during StageRevisions.
+func (fs *PseudoFS) RegisterShutdown(g *ShutdownGroup) {
+	g.Add(StageFlush, "flush filesystem", func(context.Context) error {
+		return fs.Flush()
+	})
+	g.Add(StageRevisions, "close filesystem", func(context.Context) error {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		return fs.closeAll()
+	})
+}
+
+func (fs *PseudoFS) closeAll() error {
+	if err := fs.closeWriteBack(); err != nil {
+		return err
+	}
+	for id, f := range fs.files {
 		if err := fs.commitChanges(f); err != nil {
 			return err
 		}
-		delete(fs.files, fd)
+		delete(fs.files, id)
+	}
+	for fd := range fs.fds {
+		delete(fs.fds, fd)
 	}
 	for fd, d := range fs.dirs {
 		d.Close()
@@ -432,8 +804,13 @@ func (fs *PseudoFS) Close() error {
 }
 
 // NewFileSystem returns a new pseudo-filesystem rooted at root, which must be a
-// directory containing only metafiles and other directories.
+// directory containing only metafiles and other directories. If a previous
+// filesystem rooted at root crashed while committing changes, the changes are
+// recovered.
 func NewFileSystem(root string, hosts *HostSet) *PseudoFS {
+	// if recovery fails here, it will be retried (and its error reported) by
+	// the next flush
+	renter.RecoverMetaFiles(filepath.Join(root, journalFilename))
 	sectors := make(map[hostdb.HostPublicKey]*renter.SectorBuilder)
 	for hostKey := range hosts.sessions {
 		sectors[hostKey] = new(renter.SectorBuilder)
@@ -441,13 +818,41 @@ func NewFileSystem(root string, hosts *HostSet) *PseudoFS {
 	return &PseudoFS{
 		root:           root,
 		files:          make(map[int]*openMetaFile),
+		fds:            make(map[int]*fileDesc),
 		dirs:           make(map[int]*os.File),
 		hosts:          hosts,
 		sectors:        sectors,
 		lastCommitTime: time.Now(),
+		overdrive:      1,
 	}
 }
 
+// SetDownloadOverdrive sets the number of extra shards that are downloaded
+// speculatively when reading a file, if the file has more hosts than it needs.
+// Whichever shards arrive first are used, and the remaining downloads are
+// cancelled, so a higher overdrive hides the latency of slow hosts at the
+// cost of additional bandwidth. The default is 1. Regardless of the
+// overdrive, a speculative download is also started whenever a download takes
+// much longer than the host's past performance suggests.
+func (fs *PseudoFS) SetDownloadOverdrive(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.overdrive = n
+}
+
+// SetInlineThreshold sets the maximum size of files that are stored inline
+// in their metafiles rather than on hosts (see renter.ExtInlineData). Only
+// files that have not been uploaded to hosts are stored inline; once an
+// inline file grows beyond the threshold, it is uploaded normally. Inline
+// storage is disabled by default, since older versions of this package
+// cannot read inline files; renter.DefaultInlineThreshold is a reasonable
+// threshold.
+func (fs *PseudoFS) SetInlineThreshold(n int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.inlineSize = n
+}
+
 // A PseudoFile presents a file-like interface for a metafile stored on Sia
 // hosts.
 type PseudoFile struct {
@@ -485,9 +890,8 @@ func (pf PseudoFile) appendOnly() bool {
 }
 
 func (pf PseudoFile) lookupFD() (file *openMetaFile, dir *os.File) {
-	file = pf.fs.files[pf.fd]
-	if file != nil && file.closed {
-		file = nil
+	if desc, ok := pf.fs.fds[pf.fd]; ok {
+		file = desc.f
 	}
 	return file, pf.fs.dirs[pf.fd]
 }
@@ -503,10 +907,18 @@ func (pf PseudoFile) Close() error {
 		delete(pf.fs.dirs, pf.fd)
 		return d.Close()
 	}
+	delete(pf.fs.fds, pf.fd)
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
 	// f is only truly deleted if it has no pending writes; otherwise, it sticks
 	// around until the next flush
 	if len(f.pendingWrites) == 0 {
-		delete(pf.fs.files, pf.fd)
+		if err := pf.fs.commitChanges(f); err != nil {
+			return err
+		}
+		pf.fs.forgetFile(f)
 	}
 	return nil
 }
@@ -525,7 +937,7 @@ func (pf PseudoFile) Read(p []byte) (int, error) {
 	} else if d != nil {
 		return 0, ErrDirectory
 	}
-	return pf.fs.fileRead(f, p)
+	return pf.fs.fileRead(pf.fs.fds[pf.fd], p)
 }
 
 // Write implements io.Writer.
@@ -541,7 +953,12 @@ func (pf PseudoFile) Write(p []byte) (int, error) {
 	} else if d != nil {
 		return 0, ErrDirectory
 	}
-	return pf.fs.fileWrite(f, p)
+	desc := pf.fs.fds[pf.fd]
+	if pf.appendOnly() {
+		// the file may have been extended via another descriptor
+		desc.offset = f.filesize()
+	}
+	return pf.fs.fileWrite(desc, p)
 }
 
 // ReadAt implements io.ReaderAt.
@@ -645,7 +1062,7 @@ func (pf PseudoFile) Seek(offset int64, whence int) (int64, error) {
 	} else if d != nil {
 		return 0, ErrDirectory
 	}
-	return pf.fs.fileSeek(f, offset, whence)
+	return pf.fs.fileSeek(pf.fs.fds[pf.fd], offset, whence)
 }
 
 // Name returns the file's name, as passed to OpenFile.
@@ -674,11 +1091,12 @@ func (pf PseudoFile) Readdir(n int) ([]os.FileInfo, error) {
 		return nil, ErrNotDirectory
 	}
 	files, err := d.Readdir(n)
+	files = filterInternalFiles(files)
 	for i := range files {
 		if files[i].IsDir() {
 			continue
 		}
-		index, err := renter.ReadMetaIndex(filepath.Join(d.Name(), files[i].Name()))
+		index, err := readMetaIndex(filepath.Join(d.Name(), files[i].Name()), pf.fs.metaKey)
 		if err != nil {
 			return nil, err
 		}
@@ -728,9 +1146,24 @@ func (pf PseudoFile) Readdirnames(n int) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	for i := 0; i < len(dirnames); i++ {
+		if isInternalFile(dirnames[i]) {
+			dirnames = append(dirnames[:i], dirnames[i+1:]...)
+			i--
+			continue
+		}
+		dirnames[i] = strings.TrimSuffix(dirnames[i], metafileExt)
+	}
+outer:
 	for _, f := range pf.fs.files {
 		if filepath.Dir(filepath.Join(pf.fs.root, f.name)) == d.Name() {
-			dirnames = append(dirnames, filepath.Base(f.name))
+			name := filepath.Base(f.name)
+			for _, dn := range dirnames {
+				if dn == name {
+					continue outer
+				}
+			}
+			dirnames = append(dirnames, name)
 		}
 	}
 	return dirnames, nil
@@ -755,6 +1188,13 @@ func (pf PseudoFile) Stat() (os.FileInfo, error) {
 // match the current state of the file. Calling Sync on one file may cause other
 // files to be synced as well. Sync typically results in a full sector of data
 // being uploaded to each host.
+//
+// Like fsync, once Sync returns, the file's contents survive a crash: the
+// hosts have signed contract revisions covering the new data, and the
+// metafile has been written and synced to disk. Changes to the file's
+// metadata (e.g. via Chmod) are committed as well. Closing the last
+// descriptor of a file commits its metadata, but not its uncommitted writes,
+// which are committed by the next Sync or Flush.
 func (pf PseudoFile) Sync() error {
 	if !pf.writeable() {
 		return nil
@@ -770,8 +1210,10 @@ func (pf PseudoFile) Sync() error {
 	return pf.fs.fileSync(f)
 }
 
-// Truncate changes the size of the file. It does not change the I/O offset. The
-// new size must not exceed the current size.
+// Truncate changes the size of the file. It does not change the I/O offset. If
+// the file is extended, the new bytes are zeros, and are uploaded like any
+// other write; shrinking the file does not require any data to be uploaded
+// (see renter.MetaFile.Truncate).
 func (pf PseudoFile) Truncate(size int64) error {
 	if !pf.writeable() {
 		return ErrNotWriteable
@@ -808,5 +1250,9 @@ func (pf PseudoFile) Free() error {
 	} else if d != nil {
 		return ErrDirectory
 	}
-	return pf.fs.fileFree(f)
+	if err := pf.fs.fileFree(f); err != nil {
+		return err
+	}
+	pf.fs.fds[pf.fd].offset = 0
+	return nil
 }
@@ -3,9 +3,15 @@ package renterutil
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
@@ -15,6 +21,7 @@ import (
 	"lukechampine.com/us/ed25519"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/internal/ghost"
+	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renter"
 	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renterhost"
@@ -123,6 +130,187 @@ func TestHostErrorSet(t *testing.T) {
 	}
 }
 
+func TestHostSetReplaceContract(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+
+	// form a new contract with each host, as if renewing the old one, and
+	// add it to the set
+	for hostKey, lh := range fs.hosts.sessions {
+		old := lh.contract
+		h, err := fs.hosts.acquire(hostKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings, err := h.Settings()
+		fs.hosts.release(hostKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sh := hostdb.ScannedHost{HostSettings: settings, PublicKey: hostKey}
+		rev, _, err := proto.FormContract(stubWallet{}, stubTpool{}, old.RenterKey, sh, types.ZeroCurrency, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.hosts.AddHost(renter.Contract{
+			HostKey:   hostKey,
+			ID:        rev.ID(),
+			RenterKey: old.RenterKey,
+		})
+		if len(fs.hosts.sessions) != 2 {
+			t.Fatal("contract should have been replaced, not added")
+		}
+		h, err = fs.hosts.acquire(hostKey)
+		if err != nil {
+			t.Fatal(err)
+		} else if h.Revision().ID() != rev.ID() {
+			t.Fatal("session should use new contract")
+		}
+		fs.hosts.release(hostKey)
+	}
+
+	// the new contracts should be usable
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(metaName)
+	data := frand.Bytes(1000)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	p := make([]byte, len(data))
+	if _, err := io.ReadFull(pf, p); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Fatal("contents do not match data")
+	}
+}
+
+func TestHostSetUtility(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	// every transfer is slow
+	ut := renter.NewUtilityTracker(renter.UtilityPolicy{MinThroughput: 1e18})
+	fs.hosts.SetUtilityTracker(ut)
+
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(metaName)
+	data := frand.Bytes(1000)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	if _, err := io.ReadFull(pf, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// each host should have been connected to and uploaded to, and at least
+	// one should have been downloaded from
+	var slow int
+	for _, lh := range fs.hosts.sessions {
+		cs := ut.Stats(lh.contract.ID)
+		if cs.RPCSuccesses < 2 || cs.RPCFailures != 0 {
+			t.Fatalf("wrong RPC stats: %+v", cs)
+		}
+		slow += cs.SlowTransfers
+	}
+	if slow == 0 {
+		t.Fatal("download was not recorded")
+	}
+
+	// errors indicating a desync should make the contract unrenewable
+	var id types.FileContractID
+	for _, lh := range fs.hosts.sessions {
+		id = lh.contract.ID
+	}
+	fs.hosts.recordRPC(id, errors.Wrap(proto.ErrBadRevisionNumber, "Write"))
+	if cs := ut.Stats(id); cs.RPCFailures != 1 || cs.Desyncs != 1 {
+		t.Fatalf("wrong stats after desync: %+v", cs)
+	} else if ut.Utility(id).GoodForRenew {
+		t.Fatal("desynced contract should not be renewed")
+	}
+}
+
+func TestHostSetContractLock(t *testing.T) {
+	host, c := createHostWithContract(t)
+	defer host.Close()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldPath := filepath.Join(dir, "old.contract")
+	newPath := filepath.Join(dir, "new.contract")
+	for _, path := range []string{oldPath, newPath} {
+		if err := renter.SaveContract(c, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hkr := testHKR{host.PublicKey(): host.Settings().NetAddress}
+
+	// a contract held by one set cannot be used by another
+	hs := NewHostSet(hkr, 0)
+	if err := hs.AddContractFile(oldPath); err != nil {
+		t.Fatal(err)
+	}
+	hs2 := NewHostSet(hkr, 0)
+	defer hs2.Close()
+	if err := hs2.AddContractFile(oldPath); err != renter.ErrContractInUse {
+		t.Fatal("expected ErrContractInUse, got", err)
+	}
+	if _, err := hs.acquire(host.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	hs.release(host.PublicKey())
+
+	// replacing the contract should release the old lock
+	if err := hs.AddContractFile(newPath); err != nil {
+		t.Fatal(err)
+	} else if err := hs2.AddContractFile(oldPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the set should release the new lock
+	if err := hs.Close(); err != nil {
+		t.Fatal(err)
+	} else if cl, err := renter.LockContract(newPath); err != nil {
+		t.Fatal(err)
+	} else {
+		cl.Unlock()
+	}
+}
+
 func TestFileSystemBasic(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
@@ -197,6 +385,15 @@ func TestFileSystemBasic(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// set metadata
+	if err := fs.SetMetadata("foo", renter.MetadataMIMEType, "text/plain"); err != nil {
+		t.Fatal(err)
+	} else if md, err := fs.Metadata("foo"); err != nil {
+		t.Fatal(err)
+	} else if len(md) != 1 || md[renter.MetadataMIMEType] != "text/plain" {
+		t.Error("incorrect metadata", md)
+	}
+
 	// open file for reading
 	pf, err = fs.Open("foo")
 	if err != nil {
@@ -249,7 +446,7 @@ func TestFileSystemBasic(t *testing.T) {
 	checkRead(data[1 : 1+1024])
 
 	// partial read at end
-	if _, err := pf.Seek(500, io.SeekEnd); err != nil {
+	if _, err := pf.Seek(-500, io.SeekEnd); err != nil {
 		t.Fatal(err)
 	}
 	if n, err := pf.Read(p); err != nil {
@@ -336,122 +533,986 @@ func TestFileSystemUploadDir(t *testing.T) {
 		}
 		check(pf.Close())
 	}
-	checkContents(metaName1, data1)
-	checkContents(metaName2, data2)
-	checkContents(metaName3, data3)
+	checkContents(metaName1, data1)
+	checkContents(metaName2, data2)
+	checkContents(metaName3, data3)
+
+	// remove files
+	if err := fs.Remove(metaName1); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(metaName2); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(metaName3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemLargeWrite(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	// create metafile
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write just over 1 sector
+	data := frand.Bytes(renterhost.SectorSize + 1)
+	if _, err = pf.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// check contents
+	p := make([]byte, len(data))
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Error("contents do not match data")
+	}
+
+	// sync and check again
+	if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Error("contents do not match data")
+	}
+
+	// close and cleanup
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(metaName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemIntegrity(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	// create metafile
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(metaName)
+	defer pf.Close()
+	data := frand.Bytes(1000)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	f := fs.fds[pf.fd].f
+	hashes := f.m.ChunkHashes()
+	if len(hashes) != 1 || hashes[0] == (crypto.Hash{}) {
+		t.Fatal("expected integrity manifest to contain one chunk hash")
+	}
+
+	// reads should succeed, including reads of part of a chunk
+	p := make([]byte, 10)
+	if _, err := pf.ReadAt(p, 500); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data[500:510]) {
+		t.Fatal("contents do not match data")
+	}
+
+	// corrupt the manifest; reads should fail
+	f.m.SetChunkHashes([]crypto.Hash{{1}})
+	if _, err := pf.ReadAt(p, 500); errors.Cause(err) != renter.ErrBadChecksum {
+		t.Fatal("expected ErrBadChecksum, got", err)
+	}
+	f.m.SetChunkHashes(hashes)
+
+	// overwrite part of the file; the new chunk should be hashed
+	if _, err := pf.WriteAt([]byte("foo"), 100); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[100:], "foo")
+	p = make([]byte, len(data))
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Fatal("contents do not match data")
+	} else if len(f.m.ChunkHashes()) != len(f.m.Shards[0]) {
+		t.Fatal("integrity manifest does not match shards")
+	}
+}
+
+func TestReencodeFile(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	// create a 2-of-3 file spanning multiple chunks
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(metaName)
+	data := frand.Bytes(renterhost.SectorSize*2 + 1000)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	metaPath := fs.path(metaName) + metafileExt
+	old, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// convert to 1-of-2
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReencodeFile(metaPath, pf, fs.hosts, old.Hosts[:2], 1); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if m.MinShards != 1 || len(m.Hosts) != 2 {
+		t.Fatalf("expected 1-of-2 file, got %v-of-%v", m.MinShards, len(m.Hosts))
+	} else if m.MasterKey != old.MasterKey || m.Filesize != old.Filesize {
+		t.Fatal("metadata was not preserved")
+	} else if len(m.ChunkHashes()) != len(m.Shards[0]) {
+		t.Fatal("integrity manifest does not match shards")
+	} else if _, err := os.Stat(metaPath + reencodeSuffix); !os.IsNotExist(err) {
+		t.Fatal("checkpoint was not removed")
+	}
+
+	// file should still be readable
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	p := make([]byte, len(data))
+	if _, err := io.ReadFull(pf, p); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Fatal("contents do not match data")
+	}
+}
+
+func TestRedundancyTiers(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	// create a 2-of-3 file spanning multiple chunks
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(metaName)
+	data := frand.Bytes(renterhost.SectorSize*2 + 1000)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	metaPath := fs.path(metaName) + metafileExt
+	old, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// store the first 4 KiB with 1-of-3 redundancy
+	tiers := []renter.RedundancyTier{{Offset: 0, Length: 4096, MinShards: 1}}
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReencodeFileWithTiers(metaPath, pf, fs.hosts, old.Hosts, 2, tiers); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(m.RedundancyTiers()) != 1 || m.RedundancyTiers()[0] != tiers[0] {
+		t.Fatal("tiers were not stored")
+	} else if findings := m.Check(nil, false); len(findings) != 0 {
+		t.Fatal("unexpected findings:", findings)
+	}
+	bounds, minShards := m.ChunkLayout()
+	if bounds[1] != 4096 || minShards[0] != 1 || minShards[1] != 2 {
+		t.Fatal("wrong chunk layout:", bounds, minShards)
+	}
+
+	// tiered files are read-only
+	if _, err := fs.OpenFile(metaName, os.O_RDWR, 0, 0); err == nil {
+		t.Fatal("expected error when opening tiered file for writing")
+	}
+
+	// read the whole file, and a range spanning the tier boundary
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	p := make([]byte, len(data))
+	if _, err := io.ReadFull(pf, p); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Fatal("contents do not match data")
+	}
+	p = make([]byte, 200)
+	if _, err := pf.ReadAt(p, 4000); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data[4000:4200]) {
+		t.Fatal("contents do not match data")
+	}
+}
+
+func TestDirIndex(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	createFile := func(name string, size int) {
+		t.Helper()
+		pf, err := fs.Create(name, 2)
+		check(err)
+		_, err = pf.Write(frand.Bytes(size))
+		check(err)
+		check(pf.Close())
+	}
+	rootStats := func() renter.DirStats {
+		t.Helper()
+		d, err := fs.DirIndex("")
+		check(err)
+		return d.Stats()
+	}
+
+	check(fs.MkdirAll("a/b", 0700))
+	createFile("a/f1", 1000)
+	createFile("a/b/f2", 2000)
+	check(fs.Flush())
+	if s := rootStats(); s.NumFiles != 2 || s.NumDirs != 2 || s.TotalSize != 3000 || s.MinHealth != 1 {
+		t.Fatalf("wrong stats: %+v", s)
+	}
+
+	// indexes should not be visible
+	pf, err := fs.Open("")
+	check(err)
+	names, err := pf.Readdirnames(-1)
+	check(err)
+	check(pf.Close())
+	if len(names) != 1 || names[0] != "a" {
+		t.Fatal("wrong directory listing:", names)
+	}
+
+	// indexes should be updated as the filesystem changes
+	createFile("a/b/f3", 500)
+	check(fs.Flush())
+	if s := rootStats(); s.NumFiles != 3 || s.TotalSize != 3500 {
+		t.Fatalf("wrong stats after create: %+v", s)
+	}
+	check(fs.Remove("a/b/f2"))
+	if s := rootStats(); s.NumFiles != 2 || s.TotalSize != 1500 {
+		t.Fatalf("wrong stats after remove: %+v", s)
+	}
+	check(fs.Rename("a/b", "a/c"))
+	var walked []string
+	check(fs.WalkIndex("", func(name string, e renter.DirEntry) error {
+		walked = append(walked, name)
+		return nil
+	}))
+	if exp := []string{"a", "a/c", "a/c/f3", "a/f1"}; !reflect.DeepEqual(walked, exp) {
+		t.Fatalf("expected walk to visit %v, got %v", exp, walked)
+	}
+
+	// maintained indexes should match rebuilt ones
+	s := rootStats()
+	d, err := BuildDirIndexes(dir)
+	check(err)
+	if rs := d.Stats(); rs.NumFiles != s.NumFiles || rs.NumDirs != s.NumDirs || rs.TotalSize != s.TotalSize {
+		t.Fatalf("maintained stats %+v do not match rebuilt stats %+v", s, rs)
+	}
+}
+
+func TestFileSystemInline(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	fs.SetInlineThreshold(renter.DefaultInlineThreshold)
+
+	// write a small file; it should be stored inline
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Remove(metaName)
+	data := frand.Bytes(1000)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := renter.ReadMetaFile(fs.path(metaName) + metafileExt)
+	if err != nil {
+		t.Fatal(err)
+	} else if !m.IsInline() || len(m.Shards[0]) != 0 || m.Filesize != int64(len(data)) {
+		t.Fatal("expected file to be stored inline")
+	}
+
+	checkContents := func(data []byte) {
+		t.Helper()
+		pf, err := fs.Open(metaName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		p := make([]byte, len(data))
+		if _, err := io.ReadFull(pf, p); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatal("contents do not match data")
+		}
+	}
+	checkContents(data)
+
+	// overwrite part of the file; it should remain inline
+	pf, err = fs.OpenFile(metaName, os.O_RDWR, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pf.WriteAt([]byte("foo"), 10); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	copy(data[10:], "foo")
+	checkContents(data)
+
+	// grow the file beyond the threshold; it should be uploaded
+	pf, err = fs.OpenFile(metaName, os.O_WRONLY|os.O_APPEND, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	more := frand.Bytes(renter.DefaultInlineThreshold)
+	if _, err := pf.Write(more); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, more...)
+	m, err = renter.ReadMetaFile(fs.path(metaName) + metafileExt)
+	if err != nil {
+		t.Fatal(err)
+	} else if m.IsInline() || len(m.Shards[0]) == 0 || m.Filesize != int64(len(data)) {
+		t.Fatal("expected file to be uploaded")
+	}
+	checkContents(data)
+}
+
+func TestFileSystemTruncate(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	// create metafile
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write some data
+	if _, err := pf.Write([]byte("one two three four five")); err != nil {
+		t.Fatal(err)
+	}
+	// extend with zeros via Truncate
+	if err := pf.Truncate(1000); err != nil {
+		t.Fatal(err)
+	}
+	// check size via Stat
+	if stat, err := pf.Stat(); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != 1000 {
+		t.Error("incorrect size")
+	}
+
+	// check contents
+	data := make([]byte, 1000)
+	copy(data, "one two three four five")
+	p := make([]byte, len(data))
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Error("contents do not match data")
+	}
+
+	// sync and check again
+	if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Error("contents do not match data")
+	}
+
+	// close and cleanup
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(metaName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReclaimGarbage(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+
+	expectStoredSectors := func(n int) {
+		t.Helper()
+		for hostKey := range fs.hosts.sessions {
+			h, err := fs.hosts.acquire(hostKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.hosts.release(hostKey)
+			if h.Revision().NumSectors() != n {
+				t.Fatalf("expected %v stored sectors, got %v", n, h.Revision().NumSectors())
+			}
+		}
+	}
+	readGarbage := func(name string) []renter.GarbageSlice {
+		t.Helper()
+		m, err := renter.ReadMetaFile(fs.path(name) + metafileExt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Garbage()
+	}
+
+	// write one full sector and one partial sector
+	pf, err := fs.Create("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	data := frand.Bytes(renterhost.SectorSize + 1024)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredSectors(2)
+	if len(readGarbage("foo")) != 0 {
+		t.Fatal("new file should not have garbage")
+	}
+
+	// overwrite the full sector; the old sector should be recorded as garbage
+	if _, err := pf.WriteAt(data[:renterhost.SectorSize], 0); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredSectors(3)
+	if gs := readGarbage("foo"); len(gs) != 2 {
+		t.Fatalf("expected 2 garbage slices, got %v", len(gs))
+	}
+
+	// truncate away the partial sector; it should also be recorded
+	if err := pf.Truncate(renterhost.SectorSize); err != nil {
+		t.Fatal(err)
+	} else if gs := readGarbage("foo"); len(gs) != 4 {
+		t.Fatalf("expected 4 garbage slices, got %v", len(gs))
+	}
+	data = data[:renterhost.SectorSize]
+
+	// reclaim the garbage; only the new sector should remain
+	if err := fs.ReclaimGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredSectors(1)
+	if len(readGarbage("foo")) != 0 {
+		t.Fatal("garbage should have been cleared")
+	}
+	p := make([]byte, len(data))
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Fatal("contents do not match data")
+	}
+
+	// sectors shared with other files should not be deleted
+	small1, err := fs.Create("small1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small1.Close()
+	small2, err := fs.Create("small2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small2.Close()
+	if _, err := small1.Write([]byte("foo bar baz")); err != nil {
+		t.Fatal(err)
+	} else if _, err := small2.Write([]byte("foo bar baz")); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredSectors(2)
+	if err := small1.Truncate(0); err != nil {
+		t.Fatal(err)
+	} else if err := fs.ReclaimGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	expectStoredSectors(2)
+	if len(readGarbage("small1")) != 0 {
+		t.Fatal("garbage should have been cleared")
+	}
+}
+
+func TestFileSystemPOSIX(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+
+	checkContents := func(name string, data []byte) {
+		t.Helper()
+		pf, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		if p, err := ioutil.ReadAll(pf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatal("contents do not match data")
+		}
+	}
+
+	// O_EXCL should fail if the file exists, even if it has not been flushed
+	pf, err := fs.OpenFile("foo", os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello, world!")
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.OpenFile("foo", os.O_CREATE|os.O_EXCL|os.O_RDWR, 0666, 1); !os.IsExist(err) {
+		t.Fatal("expected ErrExist, got", err)
+	}
+
+	// a second descriptor should share contents, but not the offset
+	pf2, err := fs.OpenFile("foo", os.O_RDWR, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 5)
+	if _, err := io.ReadFull(pf2, p); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data[:5]) {
+		t.Fatal("contents do not match data")
+	}
+	if _, err := pf.Write([]byte("!!")); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, "!!"...)
+	if off, err := pf2.Seek(0, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	} else if off != 5 {
+		t.Fatal("descriptor offset changed:", off)
+	} else if off, err := pf2.Seek(-2, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	} else if off != int64(len(data)-2) {
+		t.Fatal("wrong offset after SeekEnd:", off)
+	}
+
+	// closing one descriptor should not affect the other, even with
+	// uncommitted writes
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data); err != ErrInvalidFileDescriptor {
+		t.Fatal("expected ErrInvalidFileDescriptor, got", err)
+	}
+	if _, err := io.ReadFull(pf2, p[:2]); err != nil {
+		t.Fatal(err)
+	} else if string(p[:2]) != "!!" {
+		t.Fatal("contents do not match data")
+	}
+
+	// appends should occur at the end of the file, even if it was extended
+	// via another descriptor
+	pf3, err := fs.OpenFile("foo", os.O_WRONLY|os.O_APPEND, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pf2.Write([]byte("?")); err != nil {
+		t.Fatal(err)
+	} else if _, err := pf3.Write([]byte("*")); err != nil {
+		t.Fatal(err)
+	} else if err := pf3.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, "?*"...)
+
+	// rename the open file; the descriptor should remain usable
+	if err := fs.Rename("foo", "bar"); err != nil {
+		t.Fatal(err)
+	} else if _, err := fs.Stat("foo"); err == nil {
+		t.Fatal("expected old name to be gone")
+	}
+	if _, err := pf2.WriteAt([]byte("J"), 7); err != nil {
+		t.Fatal(err)
+	} else if err := pf2.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	data[7] = 'J'
+	if m, err := renter.ReadMetaFile(filepath.Join(dir, "bar") + metafileExt); err != nil {
+		t.Fatal(err)
+	} else if m.Filesize != int64(len(data)) {
+		t.Fatal("Sync did not commit metafile")
+	}
+	checkContents("bar", data)
+
+	// metadata-only changes should be committed by Sync
+	if err := fs.Chmod("bar", 0600); err != nil {
+		t.Fatal(err)
+	} else if err := pf2.Sync(); err != nil {
+		t.Fatal(err)
+	} else if m, err := renter.ReadMetaFile(filepath.Join(dir, "bar") + metafileExt); err != nil {
+		t.Fatal(err)
+	} else if m.Mode != 0600 {
+		t.Fatal("Sync did not commit mode change")
+	}
 
-	// remove files
-	if err := fs.Remove(metaName1); err != nil {
+	// extending the file should fill it with zeros
+	if err := pf2.Truncate(int64(len(data)) + 10); err != nil {
 		t.Fatal(err)
 	}
-	if err := fs.Remove(metaName2); err != nil {
+	data = append(data, make([]byte, 10)...)
+	checkContents("bar", data)
+	if err := pf2.Close(); err != nil {
 		t.Fatal(err)
 	}
-	if err := fs.Remove(metaName3); err != nil {
+
+	// O_CREATE without O_TRUNC should open the existing file
+	pf, err = fs.OpenFile("bar", os.O_CREATE|os.O_RDWR, 0666, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if stat, err := pf.Stat(); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != int64(len(data)) {
+		t.Fatal("O_CREATE truncated existing file")
+	} else if err := pf.Close(); err != nil {
 		t.Fatal(err)
 	}
+
+	// O_TRUNC should truncate it
+	pf, err = fs.OpenFile("bar", os.O_TRUNC|os.O_RDWR, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if stat, err := pf.Stat(); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != 0 {
+		t.Fatal("O_TRUNC did not truncate file")
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if stat, err := fs.Stat("bar"); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != 0 {
+		t.Fatal("truncation was not committed on Close")
+	}
+
+	// directory listings should not include duplicates or metafile extensions
+	d, err := fs.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if names, err := d.Readdirnames(-1); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 || names[0] != "bar" {
+		t.Fatal("wrong directory listing:", names)
+	}
 }
 
-func TestFileSystemLargeWrite(t *testing.T) {
+func TestFileSystemEncryptedMetaFiles(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
 	}
 
-	fs, cleanup := createTestingFS(t, 3)
+	fs, cleanup := createTestingFS(t, 2)
 	defer cleanup()
-
-	// create metafile
-	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
-	pf, err := fs.Create(metaName, 1)
+	dir, err := ioutil.TempDir("", t.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
-	// write just over 1 sector
-	data := frand.Bytes(renterhost.SectorSize + 1)
-	if _, err = pf.Write(data); err != nil {
-		t.Fatal(err)
+	defer os.RemoveAll(dir)
+	hosts := fs.hosts
+	var seed renter.RenterSeed
+	frand.Read(seed[:])
+	key := seed.MetaFileKey()
+
+	writeFile := func(fs *PseudoFS, name string, data []byte) {
+		t.Helper()
+		pf, err := fs.Create(name, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := pf.Write(data); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := fs.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkContents := func(fs *PseudoFS, name string, data []byte) {
+		t.Helper()
+		pf, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		if p, err := ioutil.ReadAll(pf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatal("contents do not match data")
+		}
+	}
+	isEncrypted := func(name string) bool {
+		t.Helper()
+		enc, err := renter.IsEncryptedMetaFile(filepath.Join(dir, name) + metafileExt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc
 	}
 
-	// check contents
-	p := make([]byte, len(data))
-	if _, err := pf.ReadAt(p, 0); err != nil {
-		t.Fatal(err)
-	} else if !bytes.Equal(p, data) {
-		t.Error("contents do not match data")
+	// write a plaintext file
+	plainData := frand.Bytes(100)
+	writeFile(NewFileSystem(dir, hosts), "plain", plainData)
+
+	// write an encrypted file
+	fs = NewFileSystem(dir, hosts)
+	fs.SetMetaFileKey(&key, false)
+	encData := frand.Bytes(100)
+	writeFile(fs, "enc", encData)
+	if isEncrypted("plain") || !isEncrypted("enc") {
+		t.Fatal("only the second file should be encrypted")
 	}
 
-	// sync and check again
-	if err := pf.Sync(); err != nil {
+	// the plaintext file should be rejected unless explicitly allowed
+	if _, err := fs.Open("plain"); errors.Cause(err) != renter.ErrMetaFileUnencrypted {
+		t.Fatal("expected ErrMetaFileUnencrypted, got", err)
+	}
+	checkContents(fs, "enc", encData)
+	fs.SetMetaFileKey(&key, true)
+	checkContents(fs, "plain", plainData)
+	checkContents(fs, "enc", encData)
+	if stat, err := fs.Stat("enc"); err != nil {
 		t.Fatal(err)
-	} else if _, err := pf.ReadAt(p, 0); err != nil {
+	} else if stat.Size() != int64(len(encData)) {
+		t.Fatal("wrong size:", stat.Size())
+	}
+	if _, err := fs.DirIndex("."); err != nil {
 		t.Fatal(err)
-	} else if !bytes.Equal(p, data) {
-		t.Error("contents do not match data")
 	}
 
-	// close and cleanup
-	if err := pf.Close(); err != nil {
+	// without the key, the encrypted file should be unreadable
+	if _, err := NewFileSystem(dir, hosts).Open("enc"); errors.Cause(err) != renter.ErrMetaFileEncrypted {
+		t.Fatal("expected ErrMetaFileEncrypted, got", err)
+	}
+
+	// migrate the plaintext file
+	if err := EncryptMetaFiles(dir, &key); err != nil {
 		t.Fatal(err)
+	} else if !isEncrypted("plain") {
+		t.Fatal("file should be encrypted")
 	}
-	if err := fs.Remove(metaName); err != nil {
+	fs = NewFileSystem(dir, hosts)
+	fs.SetMetaFileKey(&key, false)
+	checkContents(fs, "plain", plainData)
+
+	// migrate back
+	if err := DecryptMetaFiles(dir, &key); err != nil {
 		t.Fatal(err)
+	} else if isEncrypted("plain") || isEncrypted("enc") {
+		t.Fatal("files should not be encrypted")
 	}
+	checkContents(NewFileSystem(dir, hosts), "enc", encData)
 }
 
-func TestFileSystemTruncate(t *testing.T) {
+func TestTruncateFile(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
 	}
 
-	fs, cleanup := createTestingFS(t, 3)
+	fs, cleanup := createTestingFS(t, 2)
 	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
 
-	// create metafile
-	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
-	pf, err := fs.Create(metaName, 2)
+	expectStoredSectors := func(n int) {
+		t.Helper()
+		for hostKey := range fs.hosts.sessions {
+			h, err := fs.hosts.acquire(hostKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.hosts.release(hostKey)
+			if h.Revision().NumSectors() != n {
+				t.Fatalf("expected %v stored sectors, got %v", n, h.Revision().NumSectors())
+			}
+		}
+	}
+
+	// upload two full sectors and one partial sector
+	pf, err := fs.Create("foo", 1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// write some data
-	if _, err := pf.Write([]byte("one two three four five")); err != nil {
+	data := frand.Bytes(renterhost.SectorSize*2 + 1024)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
 		t.Fatal(err)
 	}
-	// extend with zeros via Truncate
-	if err := pf.Truncate(1000); err != nil {
+	expectStoredSectors(3)
+
+	// truncate to one sector; the second (full) sector should be deleted,
+	// while the partial sector should remain recorded as garbage
+	metaPath := fs.path("foo") + metafileExt
+	if err := TruncateFile(metaPath, renterhost.SectorSize, fs.hosts); err != nil {
 		t.Fatal(err)
 	}
-	// check size via Stat
-	if stat, err := pf.Stat(); err != nil {
+	expectStoredSectors(2)
+	m, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
 		t.Fatal(err)
-	} else if stat.Size() != 1000 {
-		t.Error("incorrect size")
+	} else if m.Filesize != renterhost.SectorSize || len(m.Shards[0]) != 1 {
+		t.Fatal("metafile was not truncated")
+	} else if gs := m.Garbage(); len(gs) != 2 || gs[0].Slice.NumSegments == merkle.SegmentsPerSector {
+		t.Fatal("expected partial sectors to remain recorded as garbage")
 	}
 
-	// check contents
-	data := make([]byte, 1000)
-	copy(data, "one two three four five")
-	p := make([]byte, len(data))
-	if _, err := pf.ReadAt(p, 0); err != nil {
+	// the remaining data should be intact; use a new PseudoFS, since the
+	// old one caches the untruncated metafile
+	fs = NewFileSystem(dir, fs.hosts)
+	pf, err = fs.Open("foo")
+	if err != nil {
 		t.Fatal(err)
-	} else if !bytes.Equal(p, data) {
-		t.Error("contents do not match data")
 	}
-
-	// sync and check again
-	if err := pf.Sync(); err != nil {
+	defer pf.Close()
+	p, err := ioutil.ReadAll(pf)
+	if err != nil {
 		t.Fatal(err)
-	} else if _, err := pf.ReadAt(p, 0); err != nil {
+	} else if !bytes.Equal(p, data[:renterhost.SectorSize]) {
+		t.Fatal("contents do not match data")
+	}
+	pf.Close()
+
+	// the partial sectors can be reclaimed
+	if err := fs.ReclaimGarbage(); err != nil {
 		t.Fatal(err)
-	} else if !bytes.Equal(p, data) {
-		t.Error("contents do not match data")
 	}
+	expectStoredSectors(1)
 
-	// close and cleanup
-	if err := pf.Close(); err != nil {
+	// without a HostSet, nothing should be deleted
+	if err := TruncateFile(metaPath, 100, nil); err != nil {
 		t.Fatal(err)
 	}
-	if err := fs.Remove(metaName); err != nil {
+	expectStoredSectors(1)
+	if m, err := renter.ReadMetaFile(metaPath); err != nil {
 		t.Fatal(err)
+	} else if len(m.Garbage()) != 2 {
+		t.Fatal("expected trimmed sectors to be recorded as garbage")
 	}
 }
 
@@ -669,6 +1730,140 @@ func TestFileSystemDelete(t *testing.T) {
 	expectStoredSectors(0)
 }
 
+// slowProxy relays connections to addr, delaying each write from addr by
+// delay.
+func slowProxy(tb testing.TB, addr string, delay time.Duration) (modules.NetAddress, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				hconn, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer hconn.Close()
+				go io.Copy(hconn, conn)
+				buf := make([]byte, 64*1024)
+				for {
+					n, err := hconn.Read(buf)
+					if err != nil {
+						return
+					}
+					time.Sleep(delay)
+					if _, err := conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return modules.NetAddress(l.Addr().String()), func() { l.Close() }
+}
+
+func TestFileSystemHostRacing(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+
+	// upload a file that can be recovered from any one host
+	pf, err := fs.Create("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := frand.Bytes(4096)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// route one host through a slow proxy, closing its existing session so
+	// that the next download reconnects
+	var slowHost hostdb.HostPublicKey
+	for hostKey := range fs.hosts.sessions {
+		slowHost = hostKey
+		break
+	}
+	hkr := fs.hosts.hkr.(testHKR)
+	proxyAddr, closeProxy := slowProxy(t, string(hkr[slowHost]), 500*time.Millisecond)
+	defer closeProxy()
+	hkr[slowHost] = proxyAddr
+	if _, err := fs.hosts.acquire(slowHost); err != nil {
+		t.Fatal(err)
+	}
+	fs.hosts.invalidate(slowHost)
+	fs.hosts.release(slowHost)
+
+	// with no overdrive, every host is eventually used; the slow host should
+	// be ranked last once its performance is known
+	fs.SetDownloadOverdrive(0)
+	readFile := func() {
+		t.Helper()
+		pf, err := fs.Open("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		if p, err := ioutil.ReadAll(pf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(p, data) {
+			t.Fatal("contents do not match data")
+		}
+	}
+	for i := 0; i < 5; i++ {
+		readFile()
+	}
+	fs.SetDownloadOverdrive(1)
+	for i := 0; i < 5; i++ {
+		readFile()
+	}
+	slowLatency, _, ok := fs.hosts.DownloadPerformance(slowHost)
+	if !ok {
+		t.Fatal("slow host was never downloaded from")
+	}
+	for hostKey := range fs.hosts.sessions {
+		if hostKey == slowHost {
+			continue
+		}
+		latency, _, ok := fs.hosts.DownloadPerformance(hostKey)
+		if !ok {
+			t.Fatal("fast host was never downloaded from")
+		} else if latency >= slowLatency {
+			t.Fatalf("fast host has higher latency (%v) than slow host (%v)", latency, slowLatency)
+		}
+		if fs.hosts.expectedDownloadTime(hostKey, 4096) >= fs.hosts.expectedDownloadTime(slowHost, 4096) {
+			t.Fatal("slow host should be expected to be slower")
+		}
+	}
+
+	// once the slow host is known, it should not be used at all
+	for i := 0; i < 3; i++ {
+		readFile()
+	}
+	if latency, _, _ := fs.hosts.DownloadPerformance(slowHost); latency != slowLatency {
+		t.Fatal("slow host was downloaded from")
+	}
+}
+
 func BenchmarkFileSystemWrite(b *testing.B) {
 	const numHosts = 4
 	const minShards = 4
@@ -761,3 +1956,120 @@ func BenchmarkFileSystemReadAtP(b *testing.B) {
 		}
 	}
 }
+
+func TestFileSystemWriteBack(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+	if err := fs.SetWriteBack(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// make some small writes, then "crash" before they are uploaded
+	pf, err := fs.Create("foo", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := frand.Bytes(1000)
+	for i := 0; i < len(data); i += 100 {
+		if _, err := pf.Write(data[i:][:100]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkContents := func(fs *PseudoFS, name string, data []byte) {
+		t.Helper()
+		pf, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		p := make([]byte, len(data)+1)
+		if n, err := io.ReadFull(pf, p); err != io.ErrUnexpectedEOF || !bytes.Equal(p[:n], data) {
+			t.Fatal("contents do not match data", n, err)
+		}
+	}
+	checkContents(fs, "foo", data)
+
+	// the writes should be restored from the log
+	fs = NewFileSystem(dir, fs.hosts)
+	if err := fs.SetWriteBack(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	checkContents(fs, "foo", data)
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(filepath.Join(dir, writeBackFilename)); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != 0 {
+		t.Fatal("expected log to be empty after flush, got", stat.Size())
+	}
+	checkContents(fs, "foo", data)
+
+	// with a short interval, writes should be uploaded automatically
+	if err := fs.SetWriteBack(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	pf, err = fs.OpenFile("foo", os.O_WRONLY|os.O_APPEND, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	more := frand.Bytes(500)
+	if _, err := pf.Write(more); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, more...)
+	for i := 0; ; i++ {
+		m, err := renter.ReadMetaFile(filepath.Join(dir, "foo"+metafileExt))
+		if err != nil {
+			t.Fatal(err)
+		} else if m.Filesize == int64(len(data)) {
+			break
+		} else if i > 100 {
+			t.Fatal("writes were not uploaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	checkContents(fs, "foo", data)
+
+	// removing files while the log is being flushed in the background should
+	// be safe
+	if err := fs.MkdirAll("dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		pf, err := fs.Create(fmt.Sprintf("dir/bar%d", i), 2)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := pf.Write(more); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err := fs.RemoveAll(fmt.Sprintf("dir/bar%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// closing the filesystem should remove the log
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(filepath.Join(dir, writeBackFilename)); !os.IsNotExist(err) {
+		t.Fatal("expected log to be removed")
+	}
+}
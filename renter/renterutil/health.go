@@ -0,0 +1,264 @@
+package renterutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+// A HealthSeverity classifies the health of a file. Higher severities are
+// more urgent.
+type HealthSeverity int
+
+// Possible HealthSeverity values.
+const (
+	// HealthOK indicates that every shard of the file is available.
+	HealthOK HealthSeverity = iota
+	// HealthDegraded indicates that some shards are unavailable, but the file
+	// can tolerate the loss of at least one more host.
+	HealthDegraded
+	// HealthCritical indicates that some chunk is available from only as
+	// many hosts as are needed to recover it, so the loss of any of them
+	// would make the file unrecoverable.
+	HealthCritical
+	// HealthUnrecoverable indicates that some chunk cannot be recovered from
+	// the available shards.
+	HealthUnrecoverable
+)
+
+// String implements fmt.Stringer.
+func (s HealthSeverity) String() string {
+	switch s {
+	case HealthOK:
+		return "ok"
+	case HealthDegraded:
+		return "degraded"
+	case HealthCritical:
+		return "critical"
+	case HealthUnrecoverable:
+		return "unrecoverable"
+	default:
+		return fmt.Sprintf("HealthSeverity(%d)", int(s))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s HealthSeverity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// A HostStatus describes the availability of a host storing a shard.
+type HostStatus int
+
+// Possible HostStatus values.
+const (
+	// HostOK indicates that the host is usable.
+	HostOK HostStatus = iota
+	// HostFailing indicates that the host is failing, according to the
+	// function passed to SetIsFailing.
+	HostFailing
+	// HostNoContract indicates that the filesystem has no contract with the
+	// host.
+	HostNoContract
+)
+
+// String implements fmt.Stringer.
+func (s HostStatus) String() string {
+	switch s {
+	case HostOK:
+		return "ok"
+	case HostFailing:
+		return "failing"
+	case HostNoContract:
+		return "no contract"
+	default:
+		return fmt.Sprintf("HostStatus(%d)", int(s))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s HostStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// A ShardHealth describes one shard of a file.
+type ShardHealth struct {
+	Host   hostdb.HostPublicKey
+	Status HostStatus
+	// Chunks is the number of chunks stored in the shard, regardless of
+	// Status.
+	Chunks int
+}
+
+// A FileHealth describes the recoverability of a file.
+type FileHealth struct {
+	Name     string
+	Filesize int64
+	Severity HealthSeverity
+	// Health is a measure of the file's remaining redundancy, defined as in
+	// renter.MetaFile.Health, but counting only shards that are available.
+	Health float64
+	// Available is the number of shards available for the file's least
+	// available chunk, and Required is the number of shards needed to
+	// recover that chunk. They are zero if the file has no chunks, e.g.
+	// because it is empty or stored inline.
+	Available int
+	Required  int
+	Shards    []ShardHealth
+}
+
+// A HealthReport describes the health of every file within a directory.
+type HealthReport struct {
+	// Files is sorted from least to most healthy, i.e. in the order in which
+	// they should be repaired.
+	Files []FileHealth
+	// Counts is the number of files with each severity.
+	Counts map[HealthSeverity]int
+	// Worst is the highest severity of any file, or HealthOK if there are no
+	// files.
+	Worst HealthSeverity
+}
+
+// SetIsFailing sets the function used to report whether a host is failing,
+// e.g. the Failing method of a hostdb.Scanner configured with AlertRules.
+// Health reports treat shards stored on failing hosts as unavailable. A nil
+// function, the default, treats every host with a contract as available.
+func (fs *PseudoFS) SetIsFailing(isFailing func(hostdb.HostPublicKey) bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.isFailing = isFailing
+}
+
+func (fs *PseudoFS) hostStatus(h hostdb.HostPublicKey) HostStatus {
+	if !fs.hosts.HasHost(h) {
+		return HostNoContract
+	} else if fs.isFailing != nil && fs.isFailing(h) {
+		return HostFailing
+	}
+	return HostOK
+}
+
+// fileHealth computes the health of m, the metafile of the named file.
+func (fs *PseudoFS) fileHealth(name string, m *renter.MetaFile) FileHealth {
+	fh := FileHealth{
+		Name:     name,
+		Filesize: m.Filesize,
+		Health:   1,
+		Shards:   make([]ShardHealth, len(m.Hosts)),
+	}
+	for i, h := range m.Hosts {
+		fh.Shards[i] = ShardHealth{Host: h, Status: fs.hostStatus(h)}
+		if i < len(m.Shards) {
+			for _, ss := range m.Shards[i] {
+				if ss != (renter.SectorSlice{}) {
+					fh.Shards[i].Chunks++
+				}
+			}
+		}
+	}
+
+	_, minShards := m.ChunkLayout()
+	for chunk, k := range minShards {
+		var available int
+		for i, shard := range m.Shards {
+			if i < len(fh.Shards) && fh.Shards[i].Status == HostOK && chunk < len(shard) && shard[chunk] != (renter.SectorSlice{}) {
+				available++
+			}
+		}
+		h := float64(available - k)
+		if extra := len(m.Hosts) - k; extra > 0 {
+			h /= float64(extra)
+		} else if available == k {
+			h = 1 // no redundancy to lose
+		}
+		if chunk == 0 || available-k < fh.Available-fh.Required {
+			fh.Available, fh.Required = available, k
+		}
+		if h < fh.Health {
+			fh.Health = h
+		}
+
+		var sev HealthSeverity
+		switch {
+		case available < k:
+			sev = HealthUnrecoverable
+		case available == k && len(m.Hosts) > k:
+			sev = HealthCritical
+		case available < len(m.Hosts):
+			sev = HealthDegraded
+		}
+		if sev > fh.Severity {
+			fh.Severity = sev
+		}
+	}
+	return fh
+}
+
+// Health reports the recoverability of the named file. If the file is open,
+// its uncommitted writes are not considered.
+func (fs *PseudoFS) Health(name string) (FileHealth, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	if f := fs.lookupFile(name); f != nil {
+		return fs.fileHealth(name, f.m), nil
+	}
+	m, err := readMetaFile(fs.path(name)+metafileExt, fs.metaKey)
+	if err != nil {
+		return FileHealth{}, errors.Wrapf(err, "health %v", name)
+	}
+	return fs.fileHealth(name, m), nil
+}
+
+// HealthTree reports the recoverability of every file within the named
+// directory and its subdirectories.
+func (fs *PseudoFS) HealthTree(dir string) (*HealthReport, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	r := &HealthReport{Counts: make(map[HealthSeverity]int)}
+	err := filepath.Walk(fs.path(dir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() && info.Name() == trashDirname {
+			return filepath.SkipDir
+		} else if info.IsDir() || !strings.HasSuffix(path, metafileExt) || isInternalFile(info.Name()) {
+			return nil
+		}
+		name, err := filepath.Rel(fs.root, strings.TrimSuffix(path, metafileExt))
+		if err != nil {
+			return err
+		}
+		var fh FileHealth
+		if f := fs.lookupFile(name); f != nil {
+			fh = fs.fileHealth(name, f.m)
+		} else {
+			m, err := readMetaFile(path, fs.metaKey)
+			if err != nil {
+				return errors.Wrapf(err, "health %v", name)
+			}
+			fh = fs.fileHealth(name, m)
+		}
+		r.Files = append(r.Files, fh)
+		r.Counts[fh.Severity]++
+		if fh.Severity > r.Worst {
+			r.Worst = fh.Severity
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(r.Files, func(i, j int) bool {
+		a, b := r.Files[i], r.Files[j]
+		if a.Severity != b.Severity {
+			return a.Severity > b.Severity
+		}
+		return a.Health < b.Health
+	})
+	return r, nil
+}
@@ -0,0 +1,96 @@
+package renterutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+)
+
+func TestHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// hosts[0] is failing, and there is no contract with hosts[4]
+	hosts := make([]hostdb.HostPublicKey, 5)
+	hs := NewHostSet(make(testHKR), 0)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+		if i < 4 {
+			hs.AddHost(renter.Contract{HostKey: hosts[i]})
+		}
+	}
+	fs := NewFileSystem(dir, hs)
+	fs.SetIsFailing(func(h hostdb.HostPublicKey) bool { return h == hosts[0] })
+
+	writeFile := func(name string, minShards int, hosts ...hostdb.HostPublicKey) {
+		t.Helper()
+		m := renter.NewMetaFile(0666, 0, hosts, minShards)
+		for i := range m.Shards {
+			m.Shards[i] = []renter.SectorSlice{{MerkleRoot: crypto.HashBytes(frand.Bytes(8)), NumSegments: 1}}
+		}
+		m.Filesize = merkle.SegmentSize * int64(minShards)
+		path := filepath.Join(dir, name+metafileExt)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := renter.WriteMetaFile(path, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("ok", 2, hosts[1], hosts[2], hosts[3])
+	writeFile("sub/degraded", 2, hosts[1], hosts[2], hosts[3], hosts[4])
+	writeFile("sub/critical", 2, hosts[0], hosts[1], hosts[2])
+	writeFile("lost", 2, hosts[0], hosts[1], hosts[4])
+
+	fh, err := fs.Health("sub/critical")
+	if err != nil {
+		t.Fatal(err)
+	} else if fh.Severity != HealthCritical || fh.Available != 2 || fh.Required != 2 || fh.Health != 0 {
+		t.Fatalf("wrong health: %+v", fh)
+	} else if fh.Shards[0].Status != HostFailing || fh.Shards[0].Chunks != 1 || fh.Shards[1].Status != HostOK {
+		t.Fatalf("wrong shard health: %+v", fh.Shards)
+	}
+	if _, err := fs.Health("missing"); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+
+	r, err := fs.HealthTree("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []struct {
+		name string
+		sev  HealthSeverity
+	}{
+		{"lost", HealthUnrecoverable},
+		{"sub/critical", HealthCritical},
+		{"sub/degraded", HealthDegraded},
+		{"ok", HealthOK},
+	}
+	if len(r.Files) != len(exp) {
+		t.Fatalf("expected %v files, got %v", len(exp), len(r.Files))
+	}
+	for i, e := range exp {
+		if f := r.Files[i]; f.Name != e.name || f.Severity != e.sev {
+			t.Errorf("expected %v to be %v, got %v (%v)", e.name, e.sev, f.Name, f.Severity)
+		}
+	}
+	if r.Worst != HealthUnrecoverable || r.Counts[HealthOK] != 1 || r.Counts[HealthDegraded] != 1 {
+		t.Fatalf("wrong summary: %+v", r)
+	}
+	if r, err := fs.HealthTree("sub"); err != nil {
+		t.Fatal(err)
+	} else if len(r.Files) != 2 || r.Worst != HealthCritical {
+		t.Fatalf("wrong subdirectory report: %+v", r)
+	}
+}
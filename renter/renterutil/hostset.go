@@ -1,6 +1,7 @@
 package renterutil
 
 import (
+	"math"
 	"strings"
 	"sync"
 	"time"
@@ -71,8 +72,30 @@ func (mu *tryLock) Unlock() {
 
 type lockedHost struct {
 	reconnect func() error
+	contract  renter.Contract
 	s         *proto.Session
 	mu        tryLock
+	lock      *renter.ContractLock // nil if added via AddHost
+
+	// the host's settings as of the last reconnect, for detecting price
+	// increases
+	settings    hostdb.HostSettings
+	hasSettings bool
+}
+
+// hostPerf tracks the observed download performance of a host.
+type hostPerf struct {
+	latency    time.Duration // time to first byte
+	throughput float64       // bytes per second; 0 if unknown
+	failures   float64       // decaying count of failed downloads
+	samples    int           // number of successful downloads
+}
+
+// perfDecay is the weight given to each new sample of a host's performance.
+const perfDecay = 0.2
+
+func ewma(old, sample float64) float64 {
+	return (1-perfDecay)*old + perfDecay*sample
 }
 
 // A HostSet is a collection of renter-host protocol sessions.
@@ -80,6 +103,15 @@ type HostSet struct {
 	sessions      map[hostdb.HostPublicKey]*lockedHost
 	hkr           renter.HostKeyResolver
 	currentHeight types.BlockHeight
+	lookup        renter.HostLookup
+	bandwidth     *proto.BandwidthScheduler
+	utility       *renter.UtilityTracker
+
+	perfMu sync.Mutex
+	perf   map[hostdb.HostPublicKey]*hostPerf
+
+	// operations that may outlive their caller, e.g. cancelled downloads
+	background sync.WaitGroup
 }
 
 // HasHost returns true if the specified host is in the set.
@@ -88,20 +120,71 @@ func (set *HostSet) HasHost(hostKey hostdb.HostPublicKey) bool {
 	return ok
 }
 
-// Close closes all of the sessions in the set.
+// SetHostLookup sets the function used to look up the records of hosts,
+// which is required to enforce placement policies (see
+// renter.PlacementPolicy) that constrain host locations or settings.
+func (set *HostSet) SetHostLookup(lookup renter.HostLookup) {
+	set.lookup = lookup
+}
+
+// SetBandwidthScheduler subjects the traffic of every session in the set to
+// bs. Reads of files are scheduled with proto.PriorityInteractive, and
+// migrations and re-encodings with proto.PriorityRepair. A nil scheduler, the
+// default, removes any limits.
+func (set *HostSet) SetBandwidthScheduler(bs *proto.BandwidthScheduler) {
+	set.bandwidth = bs
+}
+
+// SetUtilityTracker records observations of the set's hosts in ut: the outcome
+// of each RPC, including those that reveal a desynchronized contract, the
+// throughput of each download, and any price increases seen when checking
+// whether a host is still connected. A nil tracker, the default, disables
+// recording. SetUtilityTracker should be called before the set is used.
+func (set *HostSet) SetUtilityTracker(ut *renter.UtilityTracker) {
+	set.utility = ut
+}
+
+// recordRPC records the outcome of an RPC on contract id.
+func (set *HostSet) recordRPC(id types.FileContractID, err error) {
+	if set.utility == nil {
+		return
+	}
+	set.utility.RecordRPC(id, err)
+	if errors.Cause(err) == proto.ErrBadRevisionNumber {
+		set.utility.RecordDesync(id)
+	}
+}
+
+// Close closes all of the sessions in the set, after waiting for any
+// background operations to finish, and releases any contract locks held by
+// the set.
 func (set *HostSet) Close() error {
+	set.background.Wait()
+	var err error
 	for hostKey, lh := range set.sessions {
 		lh.mu.Lock()
 		if lh.s != nil {
 			lh.s.Close()
 			lh.s = nil
 		}
+		if lh.lock != nil {
+			if uerr := lh.lock.Unlock(); uerr != nil && err == nil {
+				err = uerr
+			}
+			lh.lock = nil
+		}
 		delete(set.sessions, hostKey)
 	}
-	return nil
+	return err
 }
 
 func (set *HostSet) acquire(host hostdb.HostPublicKey) (*proto.Session, error) {
+	return set.acquirePriority(host, proto.PriorityInteractive)
+}
+
+// acquirePriority is like acquire, but schedules the session's traffic with
+// the specified priority.
+func (set *HostSet) acquirePriority(host hostdb.HostPublicKey, p proto.Priority) (*proto.Session, error) {
 	ls, ok := set.sessions[host]
 	if !ok {
 		return nil, errNoHost
@@ -111,6 +194,8 @@ func (set *HostSet) acquire(host hostdb.HostPublicKey) (*proto.Session, error) {
 		ls.mu.Unlock()
 		return nil, err
 	}
+	ls.s.SetBandwidthScheduler(set.bandwidth)
+	ls.s.SetPriority(p)
 	return ls.s, nil
 }
 
@@ -126,6 +211,8 @@ func (set *HostSet) tryAcquire(host hostdb.HostPublicKey) (*proto.Session, error
 		ls.mu.Unlock()
 		return nil, err
 	}
+	ls.s.SetBandwidthScheduler(set.bandwidth)
+	ls.s.SetPriority(proto.PriorityInteractive)
 	return ls.s, nil
 }
 
@@ -133,9 +220,160 @@ func (set *HostSet) release(host hostdb.HostPublicKey) {
 	set.sessions[host].mu.Unlock()
 }
 
-// AddHost adds a host to the set for later use.
+// invalidate closes the session of an acquired host, forcing the next
+// acquirer to reconnect. It is used when an RPC was interrupted, leaving the
+// session in an unknown state.
+func (set *HostSet) invalidate(host hostdb.HostPublicKey) {
+	if ls := set.sessions[host]; ls.s != nil {
+		ls.s.Close()
+		ls.s = nil
+	}
+}
+
+// perfOf returns the performance record of host, creating it if necessary.
+// The caller must hold set.perfMu.
+func (set *HostSet) perfOf(host hostdb.HostPublicKey) *hostPerf {
+	if set.perf == nil {
+		set.perf = make(map[hostdb.HostPublicKey]*hostPerf)
+	}
+	hp, ok := set.perf[host]
+	if !ok {
+		hp = new(hostPerf)
+		set.perf[host] = hp
+	}
+	return hp
+}
+
+// recordDownload records that n bytes were downloaded from host in total
+// time, with the first byte arriving after ttfb.
+func (set *HostSet) recordDownload(host hostdb.HostPublicKey, n int64, ttfb, total time.Duration) {
+	if lh, ok := set.sessions[host]; ok && set.utility != nil {
+		set.utility.RecordTransfer(lh.contract.ID, n, total)
+	}
+	set.perfMu.Lock()
+	defer set.perfMu.Unlock()
+	hp := set.perfOf(host)
+	if hp.samples == 0 {
+		hp.latency = ttfb
+	} else {
+		hp.latency = time.Duration(ewma(float64(hp.latency), float64(ttfb)))
+	}
+	// if the transfer took less than a millisecond, the sample says more
+	// about our clock than about the host's throughput
+	if transfer := total - ttfb; transfer >= time.Millisecond {
+		sample := float64(n) / transfer.Seconds()
+		if hp.throughput == 0 {
+			hp.throughput = sample
+		} else {
+			hp.throughput = ewma(hp.throughput, sample)
+		}
+	}
+	hp.failures = ewma(hp.failures, 0)
+	hp.samples++
+}
+
+// recordCancelled records that a download from host was cancelled after
+// elapsed time. Since the download might have taken much longer, elapsed is
+// only a lower bound; thus, the sample can worsen the host's record, but
+// never improve it.
+func (set *HostSet) recordCancelled(host hostdb.HostPublicKey, elapsed time.Duration) {
+	set.perfMu.Lock()
+	defer set.perfMu.Unlock()
+	hp := set.perfOf(host)
+	if hp.samples == 0 {
+		hp.latency = elapsed
+		hp.samples++
+	} else if elapsed > hp.latency {
+		hp.latency = time.Duration(ewma(float64(hp.latency), float64(elapsed)))
+	}
+}
+
+// recordFailure records that a download from host failed.
+func (set *HostSet) recordFailure(host hostdb.HostPublicKey) {
+	set.perfMu.Lock()
+	defer set.perfMu.Unlock()
+	hp := set.perfOf(host)
+	hp.failures = ewma(hp.failures, 1)
+}
+
+// expectedDownloadTime estimates how long it will take to download n bytes
+// from host, based on its past performance. Hosts that have recently failed
+// are penalized. If nothing is known about the host, it returns 0, so that
+// untried hosts are preferred until their performance is learned.
+func (set *HostSet) expectedDownloadTime(host hostdb.HostPublicKey, n int64) time.Duration {
+	set.perfMu.Lock()
+	defer set.perfMu.Unlock()
+	hp, ok := set.perf[host]
+	if !ok {
+		return 0
+	} else if hp.samples == 0 {
+		// every download from the host has failed
+		return math.MaxInt64
+	}
+	d := float64(hp.latency)
+	if hp.throughput > 0 {
+		d += float64(n) / hp.throughput * float64(time.Second)
+	}
+	// a host that always fails is treated as ten times slower
+	return time.Duration(d * (1 + 9*hp.failures))
+}
+
+// DownloadPerformance returns the observed download latency (time to first
+// byte) and throughput (in bytes per second) of the specified host. Both are
+// exponentially-weighted moving averages. The throughput is 0 if not enough
+// data has been downloaded to estimate it, and ok is false if no download from
+// the host has succeeded.
+func (set *HostSet) DownloadPerformance(host hostdb.HostPublicKey) (latency time.Duration, throughput float64, ok bool) {
+	set.perfMu.Lock()
+	defer set.perfMu.Unlock()
+	hp, ok := set.perf[host]
+	if !ok || hp.samples == 0 {
+		return 0, 0, false
+	}
+	return hp.latency, hp.throughput, true
+}
+
+// AddHost adds a host to the set for later use. If the set already contains
+// a contract with the host, e.g. because the contract was renewed, c replaces
+// it: any session using the old contract is closed once it is no longer in
+// use, and subsequent operations use c. Since metafiles reference hosts, not
+// contracts, no changes to metafiles are necessary.
 func (set *HostSet) AddHost(c renter.Contract) {
-	lh := new(lockedHost)
+	set.addHost(c, nil)
+}
+
+// AddContractFile loads the contract at filename and adds it to the set, as
+// if by AddHost. The contract file remains locked (see renter.ContractLock)
+// until the contract is replaced or the set is closed, so that another
+// process cannot use the contract concurrently. If the file is already
+// locked, AddContractFile returns renter.ErrContractInUse.
+func (set *HostSet) AddContractFile(filename string) error {
+	c, cl, err := renter.LoadLockedContract(filename)
+	if err != nil {
+		return err
+	}
+	set.addHost(c, cl)
+	return nil
+}
+
+// addHost adds c to the set, taking ownership of cl, which may be nil. Any
+// lock held on a replaced contract is released.
+func (set *HostSet) addHost(c renter.Contract, cl *renter.ContractLock) {
+	if lh, ok := set.sessions[c.HostKey]; ok {
+		lh.mu.Lock()
+		if lh.s != nil {
+			lh.s.Close()
+			lh.s = nil
+		}
+		if lh.lock != nil {
+			lh.lock.Unlock()
+		}
+		lh.contract = c
+		lh.lock = cl
+		lh.mu.Unlock()
+		return
+	}
+	lh := &lockedHost{contract: c, lock: cl}
 	// lazy connection function
 	var lastSeen time.Time
 	lh.reconnect = func() error {
@@ -154,7 +392,11 @@ func (set *HostSet) AddHost(c renter.Contract) {
 			// caller to handle the reconnection logic after calling whatever
 			// RPC it wants to call; that way, we only do extra work if the host
 			// has actually disconnected. But that feels too burdensome.
-			if _, err := lh.s.Settings(); err == nil {
+			if settings, err := lh.s.Settings(); err == nil {
+				if set.utility != nil && lh.hasSettings {
+					set.utility.RecordSettings(lh.contract.ID, lh.settings, settings)
+				}
+				lh.settings, lh.hasSettings = settings, true
 				return nil
 			}
 			// connection timed out, or some other error occurred; close our
@@ -162,12 +404,20 @@ func (set *HostSet) AddHost(c renter.Contract) {
 			lh.s.Close()
 			lh.s = nil
 		}
+		c := lh.contract
 		hostIP, err := set.hkr.ResolveHostKey(c.HostKey)
 		if err != nil {
 			return errors.Wrap(err, "could not resolve host key")
 		}
 		lh.s, err = proto.NewSession(hostIP, c.HostKey, c.ID, c.RenterKey, set.currentHeight)
-		return err
+		set.recordRPC(c.ID, err)
+		if err != nil {
+			return err
+		}
+		lh.s.SetRPCObserver(func(rpc string, err error) {
+			set.recordRPC(c.ID, err)
+		})
+		return nil
 	}
 	set.sessions[c.HostKey] = lh
 }
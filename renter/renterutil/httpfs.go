@@ -0,0 +1,68 @@
+package renterutil
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// httpFS adapts a PseudoFS to the http.FileSystem interface.
+type httpFS struct {
+	fs *PseudoFS
+}
+
+// httpName converts a slash-rooted request path to a PseudoFS name; PseudoFS
+// identifies open files by the names they were opened with, so the leading
+// slash must be removed.
+func httpName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Open implements http.FileSystem.
+func (hfs httpFS) Open(name string) (http.File, error) {
+	pf, err := hfs.fs.Open(httpName(name))
+	if err != nil {
+		// http.FileServer inspects the error to choose a status code
+		if cause := errors.Cause(err); os.IsNotExist(cause) || os.IsPermission(cause) {
+			return nil, cause
+		}
+		return nil, err
+	}
+	return pf, nil
+}
+
+type fileServer struct {
+	fs *PseudoFS
+	h  http.Handler
+}
+
+// ServeHTTP implements http.Handler.
+func (s fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// http.FileServer honors conditional requests, but only sets
+	// Last-Modified; supply an ETag as well
+	if info, err := s.fs.Stat(httpName(r.URL.Path)); err == nil && !info.IsDir() {
+		w.Header().Set("ETag", fileETag(info))
+	}
+	s.h.ServeHTTP(w, r)
+}
+
+// NewFileServer returns an http.Handler that serves the files within fs, in
+// the manner of http.FileServer. Range requests are supported, and are served
+// by downloading only the segments covering the requested range, so clients
+// such as media players can seek within a file without fetching all of it.
+// Each response includes an ETag derived from the file's size and
+// modification time, and conditional requests (If-None-Match,
+// If-Modified-Since, If-Range, etc.) are honored. Files that have not yet
+// been flushed are served with their current contents.
+//
+// As with http.FileServer, directories are served as HTML listings, and
+// http.StripPrefix can be used to serve fs under a path prefix.
+func NewFileServer(fs *PseudoFS) http.Handler {
+	return fileServer{
+		fs: fs,
+		h:  http.FileServer(httpFS{fs}),
+	}
+}
@@ -0,0 +1,119 @@
+package renterutil
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestFileServer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+
+	data := frand.Bytes(100000)
+	pf, err := fs.Create("video.mp4", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.StripPrefix("/files", NewFileServer(fs)))
+	defer srv.Close()
+	get := func(method, path string, status int, hdrs ...string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(hdrs); i += 2 {
+			req.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != status {
+			t.Fatalf("expected status %v, got %v (%s)", status, resp.StatusCode, body)
+		}
+		return resp, body
+	}
+
+	// full download
+	resp, body := get("GET", "/files/video.mp4", http.StatusOK)
+	if !bytes.Equal(body, data) {
+		t.Fatal("wrong data")
+	} else if resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatal("missing Accept-Ranges")
+	} else if resp.Header.Get("Content-Type") != "video/mp4" {
+		t.Fatal("wrong Content-Type:", resp.Header.Get("Content-Type"))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+
+	// range requests
+	resp, body = get("GET", "/files/video.mp4", http.StatusPartialContent, "Range", "bytes=70000-70999")
+	if !bytes.Equal(body, data[70000:71000]) {
+		t.Fatal("wrong data for range")
+	} else if cr := resp.Header.Get("Content-Range"); cr != fmt.Sprintf("bytes 70000-70999/%v", len(data)) {
+		t.Fatal("wrong Content-Range:", cr)
+	}
+	if _, body = get("GET", "/files/video.mp4", http.StatusPartialContent, "Range", "bytes=-100"); !bytes.Equal(body, data[len(data)-100:]) {
+		t.Fatal("wrong data for suffix range")
+	}
+	get("GET", "/files/video.mp4", http.StatusRequestedRangeNotSatisfiable, "Range", "bytes=200000-")
+
+	// conditional requests
+	get("GET", "/files/video.mp4", http.StatusNotModified, "If-None-Match", etag)
+	get("GET", "/files/video.mp4", http.StatusPreconditionFailed, "If-Match", `"bogus"`)
+	if _, body = get("GET", "/files/video.mp4", http.StatusPartialContent, "Range", "bytes=0-9", "If-Range", etag); !bytes.Equal(body, data[:10]) {
+		t.Fatal("wrong data for If-Range")
+	}
+	get("GET", "/files/video.mp4", http.StatusOK, "Range", "bytes=0-9", "If-Range", `"stale"`)
+
+	// modifying the file should change its ETag
+	pf, err = fs.OpenFile("video.mp4", os.O_WRONLY|os.O_APPEND, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := get("HEAD", "/files/video.mp4", http.StatusOK); resp.Header.Get("ETag") == etag {
+		t.Fatal("ETag did not change")
+	} else if resp.ContentLength != int64(len(data)+4) {
+		t.Fatal("wrong Content-Length:", resp.ContentLength)
+	}
+
+	// directory listing and missing files
+	if _, body := get("GET", "/files/", http.StatusOK); !strings.Contains(string(body), "video.mp4") || strings.Contains(string(body), metafileExt) {
+		t.Fatal("wrong directory listing:", string(body))
+	}
+	get("GET", "/files/nope", http.StatusNotFound)
+}
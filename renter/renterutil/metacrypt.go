@@ -0,0 +1,110 @@
+package renterutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter"
+)
+
+// A metaFileKey is the key used to encrypt a filesystem's metafiles at rest.
+type metaFileKey struct {
+	key              renter.MetaFileKey
+	allowUnencrypted bool // see SetMetaFileKey
+}
+
+// readMetaFile reads the metafile at path, decrypting it with key if key is
+// non-nil.
+func readMetaFile(path string, key *metaFileKey) (*renter.MetaFile, error) {
+	if key != nil && key.allowUnencrypted {
+		return renter.ReadMaybeEncryptedMetaFile(path, &key.key)
+	} else if key != nil {
+		return renter.ReadEncryptedMetaFile(path, &key.key)
+	}
+	return renter.ReadMetaFile(path)
+}
+
+// readMetaIndex reads the index of the metafile at path, decrypting it with
+// key if key is non-nil. Encrypted metafiles must be read in their entirety.
+func readMetaIndex(path string, key *metaFileKey) (renter.MetaIndex, error) {
+	if key != nil {
+		m, err := readMetaFile(path, key)
+		if err != nil {
+			return renter.MetaIndex{}, err
+		}
+		return m.MetaIndex, nil
+	}
+	return renter.ReadMetaIndex(path)
+}
+
+// writeMetaFile writes m to path, encrypting it with key if key is non-nil.
+func writeMetaFile(path string, m *renter.MetaFile, key *metaFileKey) error {
+	if key != nil {
+		return renter.WriteEncryptedMetaFile(path, m, &key.key)
+	}
+	return renter.WriteMetaFile(path, m)
+}
+
+// writeMetaFiles writes files atomically using the journal at journalPath
+// (see renter.WriteMetaFiles), encrypting them with key if key is non-nil.
+func writeMetaFiles(journalPath string, files map[string]*renter.MetaFile, key *metaFileKey) error {
+	if key != nil {
+		return renter.WriteEncryptedMetaFiles(journalPath, files, &key.key)
+	}
+	return renter.WriteMetaFiles(journalPath, files)
+}
+
+// SetMetaFileKey sets the key used to encrypt the filesystem's metafiles at
+// rest (see renter.WriteEncryptedMetaFile). Once set, metafiles are encrypted
+// whenever they are written, and encrypted metafiles are decrypted
+// transparently when read. Unencrypted metafiles are rejected with
+// renter.ErrMetaFileUnencrypted unless allowUnencrypted is true, in which
+// case they remain readable, and are encrypted the next time they are
+// modified. EncryptMetaFiles can be used to encrypt all of them at once. A
+// nil key disables encryption.
+func (fs *PseudoFS) SetMetaFileKey(key *renter.MetaFileKey, allowUnencrypted bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.metaKey = nil
+	if key != nil {
+		fs.metaKey = &metaFileKey{*key, allowUnencrypted}
+	}
+}
+
+// walkMetaFiles calls fn on each locked metafile within dir.
+func walkMetaFiles(dir string, fn func(path string) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() || !strings.HasSuffix(path, metafileExt) {
+			return nil
+		}
+		l, err := renter.LockMetaFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "%v", path)
+		}
+		defer l.Unlock()
+		return errors.Wrapf(fn(path), "%v", path)
+	})
+}
+
+// EncryptMetaFiles encrypts every unencrypted metafile within dir with key
+// (see renter.EncryptMetaFile). Metafiles already encrypted with key are
+// skipped, so EncryptMetaFiles can safely be re-run if it is interrupted.
+// Each metafile is locked while it is encrypted, but dir should not be in use
+// by a PseudoFS that lacks key.
+func EncryptMetaFiles(dir string, key *renter.MetaFileKey) error {
+	return walkMetaFiles(dir, func(path string) error {
+		return renter.EncryptMetaFile(path, key)
+	})
+}
+
+// DecryptMetaFiles reverses EncryptMetaFiles, replacing every metafile within
+// dir that is encrypted with key with its unencrypted form.
+func DecryptMetaFiles(dir string, key *renter.MetaFileKey) error {
+	return walkMetaFiles(dir, func(path string) error {
+		return renter.DecryptMetaFile(path, key)
+	})
+}
@@ -1,19 +1,23 @@
 package renterutil
 
 import (
-	"errors"
+	"context"
 	"io"
 	"io/ioutil"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"lukechampine.com/us/hostdb"
-	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renterhost"
 )
 
-func replaceHosts(oldHosts []hostdb.HostPublicKey, hs *HostSet) []hostdb.HostPublicKey {
+func replaceHosts(oldHosts []hostdb.HostPublicKey, hs *HostSet, isFailing func(hostdb.HostPublicKey) bool, p renter.PlacementPolicy) []hostdb.HostPublicKey {
+	usable := func(h hostdb.HostPublicKey) bool {
+		return hs.HasHost(h) && (isFailing == nil || !isFailing(h)) && p.Permits(h, hs.lookup)
+	}
 	isOld := func(h hostdb.HostPublicKey) bool {
 		for i := range oldHosts {
 			if oldHosts[i] == h {
@@ -23,12 +27,36 @@ func replaceHosts(oldHosts []hostdb.HostPublicKey, hs *HostSet) []hostdb.HostPub
 		return false
 	}
 
+	// pinned hosts are always kept; other hosts are kept if they are usable
+	// and do not violate the diversity policy
 	r := append([]hostdb.HostPublicKey(nil), oldHosts...)
+	keep := make([]bool, len(r))
+	var kept []hostdb.HostPublicKey
+	for i, h := range r {
+		if p.IsPinned(h) || (usable(h) && p.CanAdd(kept, h, hs.lookup)) {
+			keep[i] = true
+			kept = append(kept, h)
+		}
+	}
+	// pinned hosts are preferred as replacements
+	var candidates []hostdb.HostPublicKey
+	for _, host := range p.Pinned {
+		if hs.HasHost(host) {
+			candidates = append(candidates, host)
+		}
+	}
 	for host := range hs.sessions {
-		if !isOld(host) {
+		if !p.IsPinned(host) {
+			candidates = append(candidates, host)
+		}
+	}
+	for _, host := range candidates {
+		if !isOld(host) && usable(host) && p.CanAdd(kept, host, hs.lookup) {
 			for i := range r {
-				if !hs.HasHost(r[i]) {
+				if !keep[i] && !p.IsPinned(r[i]) {
 					r[i] = host
+					keep[i] = true
+					kept = append(kept, host)
 					break
 				}
 			}
@@ -39,6 +67,11 @@ func replaceHosts(oldHosts []hostdb.HostPublicKey, hs *HostSet) []hostdb.HostPub
 
 // A Migrator facilitates migrating metafiles from one set of hosts to another.
 type Migrator struct {
+	// IsFailing, if non-nil, reports whether a host should be migrated away
+	// from even though it is present in the Migrator's HostSet. Typically it
+	// is the Failing method of a hostdb.Scanner configured with AlertRules.
+	IsFailing func(hostdb.HostPublicKey) bool
+
 	hosts   *HostSet
 	shards  map[hostdb.HostPublicKey]*renter.SectorBuilder
 	onFlush []func() error
@@ -57,9 +90,10 @@ func (m *Migrator) canFit(shardLen int, oldHosts, newHosts []hostdb.HostPublicKe
 }
 
 // NeedsMigrate returns true if at least one of the hosts of f is not present in
-// the Migrator's HostSet.
+// the Migrator's HostSet, or is failing according to IsFailing.
 func (m *Migrator) NeedsMigrate(f *renter.MetaFile) bool {
-	newHosts := replaceHosts(f.Hosts, m.hosts)
+	p, _ := f.PlacementPolicy()
+	newHosts := replaceHosts(f.Hosts, m.hosts, m.IsFailing, p)
 	for i := range newHosts {
 		if newHosts[i] != f.Hosts[i] {
 			return true
@@ -72,8 +106,17 @@ func (m *Migrator) NeedsMigrate(f *renter.MetaFile) bool {
 // set. Since the Migrator buffers data internally, the migration may not be
 // complete until the Flush method has been called. onFinish is called on the
 // new metafile when the file has been fully migrated.
+//
+// If f has a placement policy, hosts that violate it are migrated away from,
+// and AddFile returns an error if the resulting hosts would not satisfy it.
 func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*renter.MetaFile) error) error {
-	newHosts := replaceHosts(f.Hosts, m.hosts)
+	p, _ := f.PlacementPolicy()
+	newHosts := replaceHosts(f.Hosts, m.hosts, m.IsFailing, p)
+	if _, ok := f.PlacementPolicy(); ok {
+		if err := p.Check(newHosts, m.hosts.lookup); err != nil {
+			return errors.Wrap(err, "could not find hosts satisfying placement policy")
+		}
+	}
 	newShards := make([][]renter.SectorSlice, len(newHosts))
 
 	chunk := make([]byte, f.MaxChunkSize())
@@ -82,9 +125,10 @@ func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*
 		shards[i] = make([]byte, 0, renterhost.SectorSize)
 	}
 	remaining := f.Filesize
-	for _, ss := range f.Shards[0] {
+	bounds, minShards := f.ChunkLayout()
+	for i := range f.Shards[0] {
 		// read next chunk
-		chunkSize := int64(ss.NumSegments*merkle.SegmentSize) * int64(f.MinShards)
+		chunkSize := bounds[i+1] - bounds[i]
 		if chunkSize > remaining {
 			chunkSize = remaining
 		}
@@ -93,8 +137,8 @@ func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*
 			return err
 		}
 		remaining -= int64(n)
-		// erasure-encode
-		f.ErasureCode().Encode(chunk[:n], shards)
+		// erasure-encode, using the chunk's tier if the file has any
+		f.ChunkErasureCode(minShards[i]).Encode(chunk[:n], shards)
 		// make room if necessary
 		if !m.canFit(len(shards[0]), f.Hosts, newHosts) {
 			if err := m.Flush(); err != nil {
@@ -108,7 +152,7 @@ func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*
 				continue // no migration necessary
 			}
 			s := m.shards[hostKey]
-			s.Append(shards[i], f.MasterKey)
+			s.Append(shards[i], f.MasterKey, f.Cipher())
 			sliceIndices[i] = len(s.Slices()) - 1
 		}
 		// append to newShards when this sector is flushed (which should be on
@@ -159,7 +203,7 @@ func (m *Migrator) Flush() error {
 		wg.Add(1)
 		go func(hostKey hostdb.HostPublicKey, s *renter.SectorBuilder) {
 			defer wg.Done()
-			h, err := m.hosts.acquire(hostKey)
+			h, err := m.hosts.acquirePriority(hostKey, proto.PriorityRepair)
 			if err != nil {
 				mu.Lock()
 				errs = append(errs, &HostError{hostKey, err})
@@ -197,6 +241,14 @@ func (m *Migrator) Flush() error {
 	return nil
 }
 
+// RegisterShutdown registers the Migrator with g. Any un-uploaded migration
+// data is flushed during StageFlush.
+func (m *Migrator) RegisterShutdown(g *ShutdownGroup) {
+	g.Add(StageFlush, "flush migrator", func(context.Context) error {
+		return m.Flush()
+	})
+}
+
 // NewMigrator creates a Migrator that migrates files to the specified host set.
 func NewMigrator(hosts *HostSet) *Migrator {
 	shards := make(map[hostdb.HostPublicKey]*renter.SectorBuilder)
@@ -2,6 +2,7 @@ package renterutil
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"io/ioutil"
 	"os"
@@ -9,6 +10,8 @@ import (
 	"testing"
 
 	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
 )
 
@@ -127,3 +130,168 @@ func TestMigrate(t *testing.T) {
 		}
 	}
 }
+
+func TestReplaceHostsPlacement(t *testing.T) {
+	// create a HostSet with five hosts, in two countries
+	hs := NewHostSet(make(testHKR), 0)
+	records := make(map[hostdb.HostPublicKey]hostdb.HostRecord)
+	var keys []hostdb.HostPublicKey
+	for i, country := range []string{"DE", "DE", "FR", "US", "US"} {
+		hpk := hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+		hs.AddHost(renter.Contract{HostKey: hpk})
+		records[hpk] = hostdb.HostRecord{PublicKey: hpk, Location: hostdb.Location{Country: country, ASN: uint32(i + 1)}}
+		keys = append(keys, hpk)
+	}
+	hs.SetHostLookup(func(hpk hostdb.HostPublicKey) (hostdb.HostRecord, bool) {
+		hr, ok := records[hpk]
+		return hr, ok
+	})
+
+	// without a policy, usable hosts are never replaced
+	old := []hostdb.HostPublicKey{keys[0], keys[3]}
+	if r := replaceHosts(old, hs, nil, renter.PlacementPolicy{}); r[0] != keys[0] || r[1] != keys[3] {
+		t.Fatal("hosts should not have been replaced")
+	}
+
+	// restrict to EU hosts; the US host should be replaced
+	p := renter.PlacementPolicy{Filter: &hostdb.Filter{Countries: []string{"DE", "FR"}}}
+	r := replaceHosts(old, hs, nil, p)
+	if r[0] != keys[0] || (r[1] != keys[1] && r[1] != keys[2]) {
+		t.Fatal("US host should have been replaced with an EU host")
+	} else if err := p.Check(r, hs.lookup); err != nil {
+		t.Fatal(err)
+	}
+
+	// additionally require one host per country; only FR remains
+	p.Diversity.MaxPerCountry = 1
+	r = replaceHosts(old, hs, nil, p)
+	if r[0] != keys[0] || r[1] != keys[2] {
+		t.Fatal("US host should have been replaced with FR host")
+	}
+	// a third host cannot be found
+	r = replaceHosts(append(old, keys[4]), hs, nil, p)
+	if err := p.Check(r, hs.lookup); err == nil {
+		t.Fatal("expected placement policy to be violated")
+	}
+
+	// pinned hosts are never replaced, even if failing, and are preferred as
+	// replacements
+	p = renter.PlacementPolicy{Pinned: []hostdb.HostPublicKey{keys[3], keys[4]}, Excluded: []hostdb.HostPublicKey{keys[0]}}
+	isFailing := func(hpk hostdb.HostPublicKey) bool { return hpk == keys[3] }
+	r = replaceHosts(old, hs, isFailing, p)
+	if r[0] != keys[4] || r[1] != keys[3] {
+		t.Fatal("pinned hosts were not honored")
+	} else if err := p.Check(r, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateHost(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+
+	// upload some files
+	if err := fs.Mkdir("sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"foo":     frand.Bytes(1000),
+		"sub/bar": frand.Bytes(100000),
+	}
+	for name, data := range files {
+		pf, err := fs.Create(name, 2)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := pf.Write(data); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// keep one file open during the migration
+	pf, err := fs.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	// add a new host, and take one of the old hosts offline, so that its
+	// shards must be reconstructed
+	h, c := createHostWithContract(t)
+	defer h.Close()
+	hkr := fs.hosts.hkr.(testHKR)
+	hkr[h.PublicKey()] = h.Settings().NetAddress
+	fs.hosts.AddHost(c)
+	newHost := h.PublicKey()
+	m, err := renter.ReadMetaFile(filepath.Join(dir, "foo"+metafileExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHost, otherHost := m.Hosts[0], m.Hosts[1]
+	disconnect := func(hostKey hostdb.HostPublicKey) {
+		hkr[hostKey] = "127.0.0.1:1"
+		fs.hosts.acquire(hostKey)
+		fs.hosts.invalidate(hostKey)
+		fs.hosts.release(hostKey)
+	}
+	disconnect(oldHost)
+
+	if err := fs.MigrateHost(context.Background(), oldHost, newHost); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		m, err := renter.ReadMetaFile(filepath.Join(dir, name+metafileExt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hasOld, hasNew bool
+		for _, h := range m.Hosts {
+			hasOld = hasOld || h == oldHost
+			hasNew = hasNew || h == newHost
+		}
+		if hasOld || !hasNew {
+			t.Fatal("file was not migrated:", name)
+		}
+	}
+
+	// with another host offline, the files should be recoverable from the new
+	// host
+	disconnect(otherHost)
+	for name, data := range files {
+		pf, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(pf)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, data) {
+			t.Fatal("contents do not match data:", name)
+		}
+		pf.Close()
+	}
+	p := make([]byte, len(files["foo"]))
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, files["foo"]) {
+		t.Fatal("contents of open file do not match data")
+	}
+
+	// the files already store a shard on the new host
+	if err := fs.MigrateHost(context.Background(), otherHost, newHost); err == nil {
+		t.Fatal("expected migration to a host already in use to fail")
+	}
+}
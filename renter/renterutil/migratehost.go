@@ -0,0 +1,258 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+)
+
+// A hostMigration records the migration of one file's shard.
+type hostMigration struct {
+	f        *openMetaFile
+	shard    int
+	newShard []renter.SectorSlice
+}
+
+// MigrateHost moves every shard stored on oldHost, across all of the files
+// within the filesystem, to newHost. The data of each shard is downloaded
+// from oldHost if possible; otherwise, it is reconstructed from the file's
+// other hosts. The affected metafiles are locked for the duration of the
+// migration, and are rewritten together once all of the data has been
+// uploaded, so a failed migration leaves every file referencing oldHost; any
+// data already uploaded to newHost can be reclaimed with GC.
+//
+// Files imported from siad, files that already store a shard on newHost, and
+// files whose placement policy forbids newHost cannot be migrated; if any
+// such file references oldHost, MigrateHost returns an error before
+// uploading anything.
+//
+// MigrateHost stops early if ctx is cancelled, leaving every file unchanged,
+// and reports its progress, in bytes of shard data uploaded to newHost, to
+// the ProgressFunc of ctx (see WithProgress).
+func (fs *PseudoFS) MigrateHost(ctx context.Context, oldHost, newHost hostdb.HostPublicKey) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if oldHost == newHost {
+		return errors.New("old and new host are the same")
+	} else if !fs.hosts.HasHost(newHost) {
+		return errors.Errorf("%v: no contract with host", newHost.ShortKey())
+	}
+	// upload any pending writes, so that every metafile is current
+	if err := fs.flushSectors(); err != nil {
+		return err
+	}
+
+	// find the affected files
+	var migrations []*hostMigration
+	var locks []*renter.MetaFileLock
+	defer func() {
+		for _, l := range locks {
+			l.Unlock()
+		}
+	}()
+	err := filepath.Walk(fs.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() || !strings.HasSuffix(path, metafileExt) {
+			return nil
+		}
+		name, err := filepath.Rel(fs.root, strings.TrimSuffix(path, metafileExt))
+		if err != nil {
+			return err
+		}
+		l, err := renter.LockMetaFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "%v", path)
+		}
+		f := fs.lookupFile(name)
+		if f == nil {
+			m, err := readMetaFile(path, fs.metaKey)
+			if err != nil {
+				l.Unlock()
+				return errors.Wrapf(err, "%v", path)
+			}
+			f = &openMetaFile{name: name, m: m}
+		}
+		shard := -1
+		for i, h := range f.m.Hosts {
+			if h == newHost {
+				l.Unlock()
+				return errors.Errorf("%v: file already stores a shard on %v", path, newHost.ShortKey())
+			} else if h == oldHost {
+				shard = i
+			}
+		}
+		if shard == -1 {
+			l.Unlock()
+			return nil
+		}
+		locks = append(locks, l)
+		if _, ok := f.m.Extension(renter.ExtSiaCipher); ok {
+			return errors.Errorf("%v: file was imported from siad", path)
+		}
+		if p, ok := f.m.PlacementPolicy(); ok {
+			newHosts := append([]hostdb.HostPublicKey(nil), f.m.Hosts...)
+			newHosts[shard] = newHost
+			if err := p.Check(newHosts, fs.hosts.lookup); err != nil {
+				return errors.Wrapf(err, "%v", path)
+			}
+		}
+		migrations = append(migrations, &hostMigration{
+			f:        f,
+			shard:    shard,
+			newShard: make([]renter.SectorSlice, len(f.m.Shards[shard])),
+		})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not find files to migrate")
+	}
+
+	// upload the shards, packing them into sectors
+	var total int64
+	for _, mig := range migrations {
+		for _, ss := range mig.f.m.Shards[mig.shard] {
+			total += int64(ss.NumSegments) * merkle.SegmentSize
+		}
+	}
+	progress := newProgressTracker(ctx, total)
+	sb := new(renter.SectorBuilder)
+	var pending []func()
+	var pendingBytes int64
+	flush := func() error {
+		if sb.Len() == 0 {
+			return nil
+		}
+		h, err := fs.hosts.acquirePriority(newHost, proto.PriorityRepair)
+		if err != nil {
+			return &HostError{newHost, err}
+		}
+		root, err := h.Append(sb.Finish())
+		fs.hosts.release(newHost)
+		if err != nil {
+			return &HostError{newHost, err}
+		}
+		sb.SetMerkleRoot(root)
+		for _, fn := range pending {
+			fn()
+		}
+		pending = pending[:0]
+		sb.Reset()
+		progress.add(pendingBytes, newHost)
+		pendingBytes = 0
+		return nil
+	}
+	oldHostOK := fs.hosts.HasHost(oldHost)
+	for _, mig := range migrations {
+		bounds, minShards := mig.f.m.ChunkLayout()
+		var offset int64
+		for i, ss := range mig.f.m.Shards[mig.shard] {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			length := (bounds[i+1] - bounds[i]) / int64(minShards[i])
+			data, err := fs.migrationShard(mig.f, mig.shard, i, offset, length, minShards[i], &oldHostOK)
+			if err != nil {
+				return errors.Wrapf(err, "could not migrate %v", mig.f.name)
+			}
+			data = data[:ss.NumSegments*merkle.SegmentSize]
+			offset += length
+
+			if sb.Remaining() < len(data) {
+				if err := flush(); err != nil {
+					return errors.Wrap(err, "could not upload to new host")
+				}
+			}
+			sliceIndex := sb.Append(data, mig.f.m.MasterKey, mig.f.m.Cipher())
+			pendingBytes += int64(len(data))
+			mig, i := mig, i
+			pending = append(pending, func() {
+				mig.newShard[i] = sb.Slices()[sliceIndex]
+			})
+		}
+	}
+	if err := flush(); err != nil {
+		return errors.Wrap(err, "could not upload to new host")
+	}
+
+	// commit every metafile at once
+	changed := make(map[string]*renter.MetaFile)
+	now := time.Now()
+	for _, mig := range migrations {
+		m := *mig.f.m
+		m.Hosts = append([]hostdb.HostPublicKey(nil), m.Hosts...)
+		m.Hosts[mig.shard] = newHost
+		m.Shards = append([][]renter.SectorSlice(nil), m.Shards...)
+		m.Shards[mig.shard] = mig.newShard
+		m.ModTime = now
+		changed[fs.path(mig.f.name)+metafileExt] = &m
+	}
+	if err := writeMetaFiles(fs.journalPath(), changed, fs.metaKey); err != nil {
+		return err
+	}
+	if fs.sectors[newHost] == nil {
+		fs.sectors[newHost] = new(renter.SectorBuilder)
+	}
+	for _, mig := range migrations {
+		m := changed[fs.path(mig.f.name)+metafileExt]
+		// update the open file, if any
+		mig.f.m.Hosts, mig.f.m.Shards, mig.f.m.ModTime = m.Hosts, m.Shards, m.ModTime
+		if err := fs.updateDirIndexesForFile(mig.f.name, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrationShard returns the plaintext of the specified slice of f's shard,
+// downloading it from the shard's host if *hostOK is true, and otherwise
+// reconstructing it from the other shards. If downloading fails, *hostOK is
+// set to false, so that subsequent calls do not try the host again.
+func (fs *PseudoFS) migrationShard(f *openMetaFile, shard, slice int, offset, length int64, minShards int, hostOK *bool) ([]byte, error) {
+	if *hostOK {
+		hostKey := f.m.Hosts[shard]
+		ss := f.m.Shards[shard][slice]
+		var buf bytes.Buffer
+		err := func() error {
+			s, err := fs.hosts.acquirePriority(hostKey, proto.PriorityRepair)
+			if err != nil {
+				return err
+			}
+			defer fs.hosts.release(hostKey)
+			return (&renter.ShardDownloader{
+				Downloader: s,
+				Key:        f.m.MasterKey,
+				Cipher:     f.m.Cipher(),
+				Slices:     []renter.SectorSlice{ss},
+			}).CopySection(&buf, 0, int64(ss.NumSegments)*merkle.SegmentSize)
+		}()
+		if err == nil {
+			return buf.Bytes(), nil
+		}
+		*hostOK = false
+	}
+
+	// download the other shards; replacing the shard's host with one that is
+	// not in the HostSet prevents downloadShards from trying it
+	m := *f.m
+	m.Hosts = append([]hostdb.HostPublicKey(nil), m.Hosts...)
+	m.Hosts[shard] = hostdb.HostPublicKey{}
+	others := &openMetaFile{name: f.name, m: &m}
+	shards, err := fs.downloadShards(others, offset, length, minShards)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.m.ChunkErasureCode(minShards).Reconstruct(shards); err != nil {
+		return nil, errors.Wrap(err, "could not reconstruct shard")
+	}
+	return shards[shard], nil
+}
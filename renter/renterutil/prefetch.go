@@ -0,0 +1,103 @@
+package renterutil
+
+import (
+	"context"
+
+	"lukechampine.com/us/renter"
+)
+
+// seqReadThreshold is the number of consecutive sequential Reads after which
+// a descriptor is considered to be streaming.
+const seqReadThreshold = 2
+
+// SetReadAhead sets the number of chunks that are prefetched ahead of a
+// sequential reader. Once a file descriptor has been read sequentially a few
+// times in a row, each subsequent Read causes the next n chunks of the file to
+// be downloaded in the background and stored in the filesystem's sector cache
+// (see SetSectorCache), so that the reader finds them there rather than
+// waiting on hosts. Seeking elsewhere resets the detection. Prefetching
+// requires a sector cache, and only applies to Read, not ReadAt. The default
+// is 0, which disables prefetching.
+func (fs *PseudoFS) SetReadAhead(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.readAheadN = n
+}
+
+// snapshotMetaFile returns a copy of m that shares no mutable state with it,
+// so that it may be used by a background download.
+func snapshotMetaFile(m *renter.MetaFile) *renter.MetaFile {
+	c := *m
+	c.Hosts = append(c.Hosts[:0:0], m.Hosts...)
+	c.Shards = make([][]renter.SectorSlice, len(m.Shards))
+	for i := range c.Shards {
+		c.Shards[i] = append([]renter.SectorSlice(nil), m.Shards[i]...)
+	}
+	c.Extensions = append(c.Extensions[:0:0], m.Extensions...)
+	return &c
+}
+
+// readAhead prefetches the chunks following d's offset into the sector
+// cache, if d is being read sequentially. The caller must hold fs.mu.
+func (fs *PseudoFS) readAhead(d *fileDesc) {
+	f := d.f
+	if fs.readAheadN <= 0 || fs.cache == nil || d.seqReads < seqReadThreshold || f.m.IsInline() {
+		return
+	} else if _, ok := f.m.Extension(renter.ExtSiaCipher); ok {
+		return // never cached
+	}
+
+	// determine which chunks to prefetch: those following the one containing
+	// d.offset, excluding any that have already been prefetched
+	bounds, minShards := f.m.ChunkLayout()
+	first := -1
+	for i := 0; i+1 < len(bounds); i++ {
+		if bounds[i+1] > d.offset {
+			first = i + 1
+			break
+		}
+	}
+	if first == -1 || first+1 >= len(bounds) {
+		return
+	}
+	last := first + fs.readAheadN
+	if last > len(bounds)-1 {
+		last = len(bounds) - 1
+	}
+	if d.prefetched < bounds[first-1] || d.prefetched > bounds[last] {
+		d.prefetched = bounds[first] // the reader seeked
+	}
+	for first < last && bounds[first] < d.prefetched {
+		first++
+	}
+	if first >= last {
+		return
+	}
+	d.prefetched = bounds[last]
+
+	type chunkSection struct {
+		offset, length int64
+		minShards      int
+	}
+	var sections []chunkSection
+	var shardOff int64
+	for i := 0; i < last; i++ {
+		length := (bounds[i+1] - bounds[i]) / int64(minShards[i])
+		if i >= first {
+			sections = append(sections, chunkSection{shardOff, length, minShards[i]})
+		}
+		shardOff += length
+	}
+	snap := &openMetaFile{name: f.name, m: snapshotMetaFile(f.m)}
+	cache, overdrive := fs.cache, fs.overdrive
+	fs.hosts.background.Add(1)
+	go func() {
+		defer fs.hosts.background.Done()
+		for _, s := range sections {
+			// prefetching is best-effort; the reader will retry on failure
+			if _, err := fs.downloadShardsWith(context.Background(), cache, overdrive, snap, s.offset, s.length, s.minShards); err != nil {
+				return
+			}
+		}
+	}()
+}
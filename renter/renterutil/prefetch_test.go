@@ -0,0 +1,85 @@
+package renterutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestReadAhead(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(filepath.Join(dir, "fs"), fs.hosts)
+	if err := os.Mkdir(filepath.Join(dir, "fs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewSectorCache(filepath.Join(dir, "cache"), 1<<30, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetSectorCache(cache)
+	fs.SetReadAhead(2)
+
+	// upload a file spanning four chunks
+	data := frand.Bytes(renterhost.SectorSize*3 + 1000)
+	pf, err := fs.Create("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// read the start of the file sequentially, which should trigger a
+	// prefetch of the next two chunks
+	pf, err = fs.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	buf := make([]byte, 4096)
+	for i := 0; i < seqReadThreshold; i++ {
+		if _, err := io.ReadFull(pf, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.hosts.background.Wait()
+
+	// make every host unreachable; the first three chunks should still be
+	// readable from the cache
+	hkr := fs.hosts.hkr.(testHKR)
+	for hostKey := range hkr {
+		hkr[hostKey] = "127.0.0.1:1"
+		fs.hosts.acquire(hostKey)
+		fs.hosts.invalidate(hostKey)
+		fs.hosts.release(hostKey)
+	}
+	rest := make([]byte, renterhost.SectorSize*3-len(buf)*seqReadThreshold)
+	if _, err := io.ReadFull(pf, rest); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(rest, data[len(buf)*seqReadThreshold:][:len(rest)]) {
+		t.Fatal("contents do not match data")
+	}
+	// the last chunk was not prefetched
+	if _, err := io.ReadFull(pf, buf[:1000]); err == nil {
+		t.Fatal("expected read of last chunk to fail")
+	}
+}
@@ -0,0 +1,108 @@
+package renterutil
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"lukechampine.com/us/hostdb"
+)
+
+// TransferProgress describes the progress of an upload or download.
+type TransferProgress struct {
+	// Done is the number of bytes of file data transferred so far, and Total
+	// is the number that will be transferred in all, or 0 if unknown.
+	Done  int64
+	Total int64
+	// Host is the host most recently transferred to or from, or the zero
+	// value if the transfer does not involve a specific host, e.g. because
+	// it goes through a PseudoFS.
+	Host hostdb.HostPublicKey
+	// ETA is the estimated time remaining, extrapolated from the average
+	// rate of the transfer so far, or 0 if unknown.
+	ETA time.Duration
+}
+
+// A ProgressFunc is called as a transfer progresses. Calls are serialized,
+// and the transfer waits for each one, so a ProgressFunc should return
+// quickly.
+type ProgressFunc func(TransferProgress)
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx that carries fn. Every upload and
+// download operation in this package that accepts a context calls fn to
+// report its progress, and stops early if ctx is cancelled.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// A progressTracker reports the progress of a transfer to the ProgressFunc
+// of a context, if any. A nil progressTracker is valid, and reports nothing.
+type progressTracker struct {
+	fn    ProgressFunc
+	start time.Time
+	mu    sync.Mutex
+	done  int64
+	total int64
+}
+
+func newProgressTracker(ctx context.Context, total int64) *progressTracker {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	if fn == nil {
+		return nil
+	}
+	return &progressTracker{fn: fn, start: time.Now(), total: total}
+}
+
+// addTotal increases the total size of the transfer, e.g. when the files
+// to be transferred are discovered incrementally.
+func (p *progressTracker) addTotal(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.total += n
+	p.mu.Unlock()
+}
+
+// add records that n bytes were transferred to or from host, and reports the
+// new progress.
+func (p *progressTracker) add(n int64, host hostdb.HostPublicKey) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	tp := TransferProgress{
+		Done:  p.done,
+		Total: p.total,
+		Host:  host,
+	}
+	if p.total > 0 && p.done > 0 && p.done <= p.total {
+		elapsed := time.Since(p.start)
+		tp.ETA = time.Duration(float64(elapsed) * float64(p.total-p.done) / float64(p.done))
+	}
+	p.fn(tp)
+}
+
+// A progressReader reports the progress of reads from r, and fails once ctx
+// is cancelled.
+type progressReader struct {
+	ctx context.Context
+	r   io.Reader
+	p   *progressTracker
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	if err := pr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := pr.r.Read(b)
+	if n > 0 {
+		pr.p.add(int64(n), hostdb.HostPublicKey{})
+	}
+	return n, err
+}
@@ -0,0 +1,319 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+)
+
+// reencodeSuffix is appended to a metafile's filename to form the filename of
+// the checkpoint used by ReencodeFile.
+const reencodeSuffix = "_reencode"
+
+// ReencodeFile converts the metafile at filename to minShards-of-len(newHosts)
+// redundancy. The file's plaintext is read from source, e.g. a PseudoFile,
+// re-encoded, and uploaded to newHosts, using sessions from hosts. Reading
+// and encoding proceed concurrently with uploading, so only a few chunks are
+// buffered in memory at once.
+//
+// Progress is checkpointed to a separate metafile alongside filename. If a
+// previous conversion with the same parameters was interrupted,
+// ReencodeFile resumes it, discarding the corresponding data from source
+// rather than uploading it again. The metafile at filename is only replaced,
+// atomically, once the conversion is complete. The file's old sectors are not
+// deleted from its old hosts. The metafile is locked exclusively (see
+// renter.LockMetaFile) for the duration of the conversion.
+//
+// ReencodeFile can also be used to convert a file imported from siad (see
+// renter.ImportSiaFile) to this package's encryption scheme.
+//
+// The file's redundancy tiers, if any, are preserved; to change them, use
+// ReencodeFileWithTiers. If the file has a placement policy, newHosts must
+// satisfy it.
+func ReencodeFile(filename string, source io.Reader, hosts *HostSet, newHosts []hostdb.HostPublicKey, minShards int) error {
+	f, err := renter.ReadMetaFile(filename)
+	if err != nil {
+		return err
+	}
+	return ReencodeFileWithTiers(filename, source, hosts, newHosts, minShards, f.RedundancyTiers())
+}
+
+// ReencodeFileWithTiers is like ReencodeFile, but also assigns the specified
+// redundancy tiers to the re-encoded file. If tiers is empty, the file is
+// encoded uniformly with minShards.
+func ReencodeFileWithTiers(filename string, source io.Reader, hosts *HostSet, newHosts []hostdb.HostPublicKey, minShards int, tiers []renter.RedundancyTier) error {
+	return ReencodeFileContext(context.Background(), filename, source, hosts, newHosts, minShards, tiers)
+}
+
+// ReencodeFileContext is like ReencodeFileWithTiers, but stops between chunks
+// if ctx is cancelled, leaving a checkpoint from which the conversion can be
+// resumed, and reports its progress to the ProgressFunc of ctx (see
+// WithProgress). Chunks completed by a previous conversion count towards the
+// progress immediately.
+func ReencodeFileContext(ctx context.Context, filename string, source io.Reader, hosts *HostSet, newHosts []hostdb.HostPublicKey, minShards int, tiers []renter.RedundancyTier) error {
+	l, err := renter.LockMetaFile(filename)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	f, err := renter.ReadMetaFile(filename)
+	if err != nil {
+		return err
+	} else if f.MasterKey == (renter.KeySeed{}) {
+		return errors.New("metafile key is not stored in the metafile")
+	} else if minShards <= 0 || minShards > len(newHosts) {
+		return errors.New("invalid redundancy parameters")
+	}
+	for _, h := range newHosts {
+		if !hosts.HasHost(h) {
+			return errors.Errorf("%v: no contract with host", h.ShortKey())
+		}
+	}
+
+	nm := renter.NewMetaFile(f.Mode, f.Filesize, newHosts, minShards)
+	nm.MasterKey = f.MasterKey
+	nm.ModTime = f.ModTime
+	for _, ext := range f.Extensions {
+		switch ext.Type {
+		case renter.ExtChunkHashes, renter.ExtUploadProgress, renter.ExtRedundancyTiers, renter.ExtInlineData:
+			// chunk layout is changing; hashes are recomputed below
+		case renter.ExtSiaCipher, renter.ExtCipher:
+			// new sectors are encrypted with MasterKey and the default cipher
+		case renter.ExtSignature:
+			// signature would be invalid
+		default:
+			nm.Extensions = append(nm.Extensions, ext)
+		}
+	}
+	if err := nm.SetRedundancyTiers(tiers); err != nil {
+		return err
+	}
+	if p, ok := nm.PlacementPolicy(); ok {
+		if err := p.Check(newHosts, hosts.lookup); err != nil {
+			return errors.Wrap(err, "new hosts do not satisfy placement policy")
+		}
+	}
+
+	// load checkpoint, if present
+	progressPath := filename + reencodeSuffix
+	if _, err := os.Stat(progressPath); err == nil {
+		cm, err := renter.ReadMetaFile(progressPath)
+		if err != nil {
+			return errors.Wrap(err, "could not read checkpoint")
+		} else if !sameHosts(cm.Hosts, newHosts) || cm.MinShards != minShards || cm.Filesize != f.Filesize ||
+			!reflect.DeepEqual(cm.RedundancyTiers(), nm.RedundancyTiers()) {
+			return errors.New("a conversion with different parameters is already in progress")
+		} else if err := resolveReencodePending(cm, hosts); err != nil {
+			return err
+		}
+		nm = cm
+	}
+	checkpoint := func() error {
+		return errors.Wrap(renter.WriteMetaFile(progressPath, nm), "could not write checkpoint")
+	}
+
+	// each chunk fills one sector on each host, unless it ends at a tier
+	// boundary
+	type chunkParams struct {
+		size      int64
+		minShards int
+	}
+	var params []chunkParams
+	for off := int64(0); off < f.Filesize; {
+		k, size := nm.NextChunk(off)
+		if rem := f.Filesize - off; rem < size {
+			size = rem
+		}
+		params = append(params, chunkParams{size, k})
+		off += size
+	}
+	type encodedChunk struct {
+		index  int
+		shards [][]byte
+		hash   crypto.Hash
+	}
+	progress := newProgressTracker(ctx, f.Filesize)
+	complete := make([]bool, len(params))
+	for i := range complete {
+		complete[i] = chunkComplete(nm, i)
+		if complete[i] {
+			progress.add(params[i].size, hostdb.HostPublicKey{})
+		}
+	}
+	chunks := make(chan encodedChunk, 1)
+	done := make(chan struct{})
+	defer close(done)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, nm.MaxChunkSize())
+		for i, p := range params {
+			n := p.size
+			if complete[i] {
+				if _, err := io.CopyN(ioutil.Discard, source, n); err != nil {
+					readErr <- errors.Wrap(err, "could not read source")
+					return
+				}
+				continue
+			}
+			if _, err := io.ReadFull(source, buf[:n]); err != nil {
+				readErr <- errors.Wrap(err, "could not read source")
+				return
+			}
+			c := encodedChunk{index: i, shards: make([][]byte, len(newHosts))}
+			for j := range c.shards {
+				c.shards[j] = make([]byte, 0, renterhost.SectorSize)
+			}
+			rsc := nm.ChunkErasureCode(p.minShards)
+			rsc.Encode(buf[:n], c.shards)
+			var padded bytes.Buffer
+			if err := rsc.Recover(&padded, c.shards, 0, len(c.shards[0])*p.minShards); err != nil {
+				readErr <- err
+				return
+			}
+			c.hash = renter.HashChunk(padded.Bytes())
+			select {
+			case chunks <- c:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex // guards nm
+	for c := range chunks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// build each host's sector and mark it pending
+		sectors := make(map[int]*renter.SectorBuilder)
+		mu.Lock()
+		for j := range nm.Hosts {
+			if nm.ChunkStatus(j, c.index) == renter.ChunkConfirmed {
+				continue
+			}
+			sb := new(renter.SectorBuilder)
+			sb.Append(c.shards[j], nm.MasterKey, nm.Cipher())
+			sb.SetMerkleRoot(merkle.SectorRoot(sb.Finish()))
+			nm.MarkPending(j, c.index, sb.Slices()[0])
+			sectors[j] = sb
+		}
+		hashes := nm.ChunkHashes()
+		for len(hashes) <= c.index {
+			hashes = append(hashes, crypto.Hash{})
+		}
+		hashes[c.index] = c.hash
+		nm.SetChunkHashes(hashes)
+		mu.Unlock()
+		if err := checkpoint(); err != nil {
+			return err
+		}
+
+		// upload in parallel
+		var wg sync.WaitGroup
+		var errs HostErrorSet
+		left := len(sectors)
+		for j, sb := range sectors {
+			wg.Add(1)
+			go func(j int, sb *renter.SectorBuilder) {
+				defer wg.Done()
+				hostKey := nm.Hosts[j]
+				err := func() error {
+					h, err := hosts.acquirePriority(hostKey, proto.PriorityRepair)
+					if err != nil {
+						return err
+					}
+					defer hosts.release(hostKey)
+					_, err = h.Append(sb.Finish())
+					return err
+				}()
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, &HostError{hostKey, err})
+					return
+				}
+				nm.MarkConfirmed(j, c.index)
+				var n int64
+				if left--; left == 0 && len(errs) == 0 {
+					n = params[c.index].size
+				}
+				progress.add(n, hostKey)
+			}(j, sb)
+		}
+		wg.Wait()
+		if err := checkpoint(); err != nil {
+			return err
+		} else if len(errs) > 0 {
+			return errors.Wrapf(errs, "could not upload chunk %v", c.index)
+		}
+	}
+	select {
+	case err := <-readErr:
+		return err
+	default:
+	}
+
+	// replace the original metafile
+	if err := renter.WriteMetaFile(filename, nm); err != nil {
+		return err
+	}
+	return os.Remove(progressPath)
+}
+
+// chunkComplete reports whether every shard of the specified chunk has been
+// uploaded.
+func chunkComplete(m *renter.MetaFile, chunk int) bool {
+	for j := range m.Hosts {
+		if m.ChunkStatus(j, chunk) != renter.ChunkConfirmed {
+			return false
+		}
+	}
+	return true
+}
+
+func sameHosts(a, b []hostdb.HostPublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveReencodePending resolves any pending chunks left in m by an
+// interrupted conversion.
+func resolveReencodePending(m *renter.MetaFile, hosts *HostSet) error {
+	for j, hostKey := range m.Hosts {
+		if len(m.PendingChunks(j)) == 0 {
+			continue
+		}
+		h, err := hosts.acquirePriority(hostKey, proto.PriorityRepair)
+		if err != nil {
+			return &HostError{hostKey, err}
+		}
+		roots, err := h.SectorRoots(0, h.Revision().NumSectors())
+		hosts.release(hostKey)
+		if err != nil {
+			return &HostError{hostKey, err}
+		}
+		m.ResolvePending(j, roots)
+	}
+	return nil
+}
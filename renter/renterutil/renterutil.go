@@ -9,5 +9,16 @@ import (
 // assume metafiles have this extension
 const metafileExt = ".usa"
 
+// journalFilename is the name of the PseudoFS journal, relative to its root.
+const journalFilename = ".usjournal"
+
+// writeBackFilename is the name of the PseudoFS write-back log, relative to its
+// root; see (*PseudoFS).SetWriteBack.
+const writeBackFilename = ".uswriteback"
+
+// trashDirname is the name of the directory, relative to the root of a
+// PseudoFS, that holds removed files; see (*PseudoFS).SetTrashRetention.
+const trashDirname = ".ustrash"
+
 // ErrCanceled indicates that the Operation was canceled.
 var ErrCanceled = errors.New("canceled")
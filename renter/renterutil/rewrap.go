@@ -0,0 +1,34 @@
+package renterutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter"
+)
+
+// RewrapKeys re-wraps the MasterKey of every metafile within dir, replacing
+// oldKEK with newKEK (see renter.MetaFile.WrapKey). File data stored on hosts
+// is not affected. Metafiles whose keys are not wrapped are skipped, as are
+// metafiles already wrapped with newKEK, so RewrapKeys can safely be re-run
+// if it is interrupted.
+func RewrapKeys(dir string, oldKEK, newKEK *renter.KeyEncryptionKey) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() || !strings.HasSuffix(path, metafileExt) {
+			return nil
+		}
+		m, err := renter.ReadMetaFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "%v", path)
+		} else if _, ok := m.Extension(renter.ExtWrappedKey); !ok {
+			return nil
+		} else if m.UnwrapKey(newKEK) == nil {
+			return nil // already rewrapped
+		}
+		return errors.Wrapf(renter.RewrapMetaFileKey(path, oldKEK, newKEK), "%v", path)
+	})
+}
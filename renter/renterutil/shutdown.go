@@ -0,0 +1,143 @@
+package renterutil
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A ShutdownStage determines when a subsystem is shut down relative to other
+// subsystems. Stages are shut down in increasing order.
+type ShutdownStage int
+
+// Shutdown stages, in the order that they are executed.
+const (
+	// StageQuiesce stops the acceptance of new work, e.g. by a scheduler.
+	StageQuiesce ShutdownStage = iota
+	// StageFlush flushes buffered data, e.g. write-back caches, to hosts.
+	StageFlush
+	// StageRevisions finalizes any open contract revisions and terminates
+	// host sessions.
+	StageRevisions
+	// StageJournals persists any remaining on-disk state.
+	StageJournals
+	// StageBackground stops background processes, e.g. scanners and
+	// repairers.
+	StageBackground
+
+	numShutdownStages
+)
+
+// A ShutdownError reports the subsystems that failed to shut down cleanly.
+type ShutdownError []error
+
+// Error implements error.
+func (se ShutdownError) Error() string {
+	strs := make([]string, len(se))
+	for i := range strs {
+		strs[i] = se[i].Error()
+	}
+	// include a leading newline so that the first error isn't printed on the
+	// same line as the error context
+	return "\n" + strings.Join(strs, "\n")
+}
+
+type shutdownFunc struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// A ShutdownGroup shuts down a set of subsystems in dependency order.
+// Subsystems within the same stage are shut down concurrently.
+type ShutdownGroup struct {
+	mu     sync.Mutex
+	stages [numShutdownStages][]shutdownFunc
+	done   bool
+}
+
+// Add registers a subsystem to be shut down during the specified stage. The
+// function should return promptly once ctx is cancelled.
+func (g *ShutdownGroup) Add(stage ShutdownStage, name string, fn func(context.Context) error) {
+	if stage < 0 || stage >= numShutdownStages {
+		panic("invalid shutdown stage")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stages[stage] = append(g.stages[stage], shutdownFunc{name, fn})
+}
+
+// Go runs fn, a long-running process such as hostdb.Scanner.Run, in a new
+// goroutine. When the specified stage is reached, the context passed to fn is
+// cancelled, and the stage waits for fn to return. Errors returned by fn,
+// other than context.Canceled, are reported by Shutdown.
+func (g *ShutdownGroup) Go(stage ShutdownStage, name string, fn func(context.Context) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+	g.Add(stage, name, func(shutdownCtx context.Context) error {
+		cancel()
+		select {
+		case err := <-done:
+			if errors.Cause(err) == context.Canceled {
+				err = nil
+			}
+			return err
+		case <-shutdownCtx.Done():
+			return shutdownCtx.Err()
+		}
+	})
+}
+
+// Shutdown shuts down each registered subsystem, stage by stage. If ctx is
+// cancelled, Shutdown stops waiting for the current stage and proceeds to the
+// next; each subsystem is still given the opportunity to shut down, but is
+// expected to abort any lengthy operations. Shutdown may only be called once.
+func (g *ShutdownGroup) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	if g.done {
+		g.mu.Unlock()
+		return errors.New("already shut down")
+	}
+	g.done = true
+	stages := g.stages
+	g.mu.Unlock()
+
+	var errs ShutdownError
+	var timedOut bool
+	for _, stage := range stages {
+		errChan := make(chan error, len(stage))
+		for _, sf := range stage {
+			go func(sf shutdownFunc) {
+				errChan <- errors.Wrap(sf.fn(ctx), sf.name)
+			}(sf)
+		}
+	wait:
+		for range stage {
+			select {
+			case err := <-errChan:
+				if err != nil {
+					errs = append(errs, err)
+				}
+			case <-ctx.Done():
+				if !timedOut {
+					errs = append(errs, errors.Wrap(ctx.Err(), "shutdown did not complete"))
+					timedOut = true
+				}
+				break wait
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Close shuts down each registered subsystem without a deadline.
+func (g *ShutdownGroup) Close() error {
+	return g.Shutdown(context.Background())
+}
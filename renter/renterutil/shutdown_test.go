@@ -0,0 +1,88 @@
+package renterutil
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/hostdb"
+)
+
+func TestShutdownGroup(t *testing.T) {
+	var g ShutdownGroup
+	var mu sync.Mutex
+	var order []ShutdownStage
+	for _, stage := range []ShutdownStage{StageBackground, StageFlush, StageQuiesce, StageJournals, StageRevisions, StageFlush} {
+		stage := stage
+		g.Add(stage, "test", func(context.Context) error {
+			mu.Lock()
+			order = append(order, stage)
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] < order[i-1] {
+			t.Fatal("stages shut down out of order:", order)
+		}
+	}
+	if err := g.Close(); err == nil {
+		t.Fatal("expected error when shutting down twice")
+	}
+
+	// a stuck subsystem should not prevent later stages from running
+	g = ShutdownGroup{}
+	ran := make(chan struct{}, 1)
+	stuckCtx, unstick := context.WithCancel(context.Background())
+	defer unstick()
+	g.Add(StageFlush, "stuck", func(context.Context) error {
+		<-stuckCtx.Done()
+		return stuckCtx.Err()
+	})
+	g.Add(StageRevisions, "failing", func(ctx context.Context) error {
+		ran <- struct{}{}
+		return errors.New("failed")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// the failing subsystem may or may not be reported, depending on timing,
+	// but the timeout must be
+	if se, ok := g.Shutdown(ctx).(ShutdownError); !ok || len(se) == 0 {
+		t.Fatal("expected ShutdownError, got", se)
+	}
+	<-ran
+}
+
+func TestShutdownGroupGo(t *testing.T) {
+	var g ShutdownGroup
+	scanner := hostdb.NewScanner(time.Hour)
+	g.Go(StageBackground, "scanner", scanner.Run)
+	stopped := make(chan struct{})
+	var flushed bool
+	g.Go(StageQuiesce, "scheduler", func(ctx context.Context) error {
+		<-ctx.Done()
+		close(stopped)
+		return ctx.Err()
+	})
+	g.Add(StageFlush, "flush", func(context.Context) error {
+		select {
+		case <-stopped:
+			flushed = true
+		default:
+		}
+		return nil
+	})
+	g.Go(StageBackground, "failing", func(context.Context) error {
+		return errors.New("failed")
+	})
+	if se, ok := g.Close().(ShutdownError); !ok || len(se) != 1 || errors.Cause(se[0]).Error() != "failed" {
+		t.Fatal("expected only the failing process to be reported, got", se)
+	} else if !flushed {
+		t.Fatal("process was not stopped before the next stage")
+	}
+}
@@ -0,0 +1,177 @@
+package renterutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+)
+
+const (
+	// fileSetMagic identifies a fileset snapshot.
+	fileSetMagic = "us-fileset"
+
+	// fileSetVersion is the current version of the fileset snapshot format.
+	fileSetVersion uint8 = 1
+
+	// fileSetContractSize is the size in bytes of each contract within a
+	// fileset snapshot: a host key, a contract ID, and a renter key seed.
+	fileSetContractSize = 32 + 32 + 32
+)
+
+// encodeFileSet writes a fileset snapshot, comprising contracts and a bundle
+// of the metafiles within dir, to w.
+func encodeFileSet(w io.Writer, contracts []renter.Contract, dir string) error {
+	buf := make([]byte, len(fileSetMagic)+1+4, len(fileSetMagic)+1+4+len(contracts)*fileSetContractSize)
+	copy(buf, fileSetMagic)
+	buf[len(fileSetMagic)] = fileSetVersion
+	binary.LittleEndian.PutUint32(buf[len(fileSetMagic)+1:], uint32(len(contracts)))
+	for _, c := range contracts {
+		buf = append(buf, c.HostKey.Ed25519()...)
+		buf = append(buf, c.ID[:]...)
+		buf = append(buf, c.RenterKey[:ed25519.SeedSize]...)
+	}
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	return BackupMetaFiles(w, dir)
+}
+
+// decodeFileSet reads the contracts of a fileset snapshot from r, leaving r
+// positioned at the start of the snapshot's metafile bundle.
+func decodeFileSet(r io.Reader) ([]renter.Contract, error) {
+	header := make([]byte, len(fileSetMagic)+1+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "could not read snapshot header")
+	}
+	magic := string(header[:len(fileSetMagic)])
+	version := header[len(fileSetMagic)]
+	if magic != fileSetMagic {
+		return nil, errors.Errorf("snapshot is invalid: wrong magic bytes (%q)", magic)
+	} else if version != fileSetVersion {
+		return nil, errors.Errorf("snapshot is invalid: incompatible version (v%d)", version)
+	}
+	n := binary.LittleEndian.Uint32(header[len(fileSetMagic)+1:])
+	contracts := make([]renter.Contract, 0, n)
+	buf := make([]byte, fileSetContractSize)
+	for i := uint32(0); i < n; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, errors.Wrap(err, "could not read snapshot contracts")
+		}
+		var c renter.Contract
+		c.HostKey = hostdb.HostKeyFromPublicKey(buf[0:32])
+		copy(c.ID[:], buf[32:64])
+		c.RenterKey = ed25519.NewKeyFromSeed(buf[64:96])
+		contracts = append(contracts, c)
+	}
+	return contracts, nil
+}
+
+// Snapshot serializes every metafile within the filesystem, along with the
+// contracts of its host set, encrypts the result with a key derived from
+// seed, and stores it on up to copies hosts. Together with seed and a
+// contract with any one of those hosts, the snapshot is sufficient to rebuild
+// the filesystem (see RestoreSnapshot).
+//
+// Pending writes are flushed before the snapshot is taken. Hosts are tried in
+// random order until copies of them have stored the snapshot; if fewer than
+// copies succeed, Snapshot returns a HostErrorSet. Since a host only searches
+// the last few sectors of a contract for a snapshot, the snapshot should be
+// retaken after uploading data to the hosts that store it.
+func (fs *PseudoFS) Snapshot(seed *renter.RenterSeed, copies int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if copies <= 0 {
+		return errors.New("number of copies must be positive")
+	} else if err := fs.flushSectors(); err != nil {
+		return err
+	}
+
+	contracts := make([]renter.Contract, 0, len(fs.hosts.sessions))
+	for _, lh := range fs.hosts.sessions {
+		lh.mu.Lock()
+		contracts = append(contracts, lh.contract)
+		lh.mu.Unlock()
+	}
+	var buf bytes.Buffer
+	if err := encodeFileSet(&buf, contracts, fs.root); err != nil {
+		return errors.Wrap(err, "could not encode snapshot")
+	}
+
+	key := seed.SnapshotKey()
+	var errs HostErrorSet
+	stored := 0
+	for hostKey := range fs.hosts.sessions {
+		if stored == copies {
+			break
+		}
+		h, err := fs.hosts.acquirePriority(hostKey, proto.PriorityRepair)
+		if err != nil {
+			errs = append(errs, &HostError{hostKey, err})
+			continue
+		}
+		err = h.UploadSnapshot(key, buf.Bytes())
+		fs.hosts.release(hostKey)
+		if err != nil {
+			errs = append(errs, &HostError{hostKey, err})
+			continue
+		}
+		stored++
+	}
+	if stored < copies {
+		if len(errs) == 0 {
+			return errors.Errorf("could not store %v copies: only %v hosts available", copies, stored)
+		}
+		return errs
+	}
+	return nil
+}
+
+// RestoreSnapshot retrieves the most recent snapshot stored by Snapshot from
+// any host in hosts, decrypting it with a key derived from seed, and
+// recreates its metafiles within dir. Contracts in the snapshot with hosts
+// not already in hosts are added to it; the full set of contracts in the
+// snapshot is returned, so that the caller may save them. The restored
+// filesystem can then be opened with NewFileSystem(dir, hosts).
+//
+// As with RestoreMetaFiles, existing metafiles are not overwritten.
+func RestoreSnapshot(seed *renter.RenterSeed, hosts *HostSet, dir string) ([]renter.Contract, error) {
+	key := seed.SnapshotKey()
+	var errs HostErrorSet
+	for hostKey := range hosts.sessions {
+		h, err := hosts.acquire(hostKey)
+		if err != nil {
+			errs = append(errs, &HostError{hostKey, err})
+			continue
+		}
+		data, err := h.DownloadSnapshot(key)
+		hosts.release(hostKey)
+		if err != nil {
+			errs = append(errs, &HostError{hostKey, err})
+			continue
+		}
+
+		r := bytes.NewReader(data)
+		contracts, err := decodeFileSet(r)
+		if err != nil {
+			return nil, err
+		} else if err := RestoreMetaFiles(r, dir); err != nil {
+			return nil, errors.Wrap(err, "could not restore metafiles")
+		}
+		for _, c := range contracts {
+			if !hosts.HasHost(c.HostKey) {
+				hosts.AddHost(c)
+			}
+		}
+		return contracts, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("host set is empty")
+	}
+	return nil, errors.Wrap(errs, "could not retrieve snapshot")
+}
@@ -0,0 +1,87 @@
+package renterutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestSnapshot(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(filepath.Join(dir, "fs"), fs.hosts)
+	if err := os.MkdirAll(fs.root, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	data := frand.Bytes(renterhost.SectorSize + 1000)
+	if err := fs.MkdirAll("bar", 0700); err != nil {
+		t.Fatal(err)
+	}
+	pf, err := fs.Create("bar/foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var seed renter.RenterSeed
+	frand.Read(seed[:])
+	if err := fs.Snapshot(&seed, 3); err == nil {
+		t.Fatal("expected error when storing more copies than hosts")
+	} else if err := fs.Snapshot(&seed, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// restore using a contract with just one of the hosts
+	var first renter.Contract
+	for _, lh := range fs.hosts.sessions {
+		first = lh.contract
+		break
+	}
+	hosts := NewHostSet(fs.hosts.hkr, 0)
+	defer hosts.Close()
+	hosts.AddHost(first)
+
+	// the wrong seed should not work
+	var wrongSeed renter.RenterSeed
+	restoreDir := filepath.Join(dir, "restored")
+	if _, err := RestoreSnapshot(&wrongSeed, hosts, restoreDir); err == nil {
+		t.Fatal("expected error with wrong seed")
+	}
+
+	contracts, err := RestoreSnapshot(&seed, hosts, restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(contracts) != 2 || len(hosts.sessions) != 2 {
+		t.Fatal("expected both contracts to be restored, got", len(contracts))
+	}
+	restored := NewFileSystem(restoreDir, hosts)
+	pf, err = restored.Open("bar/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	if got, err := ioutil.ReadAll(pf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatal("restored contents do not match data")
+	}
+}
@@ -0,0 +1,368 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/renter"
+)
+
+// StreamOptions configures a StreamReader.
+type StreamOptions struct {
+	// Window is the maximum number of chunks buffered at or ahead of the read
+	// position, all of which are downloaded in parallel. If Window is zero,
+	// 4 is used.
+	Window int
+
+	// IndexChunks is the number of chunks at each end of the file that are
+	// downloaded as soon as the StreamReader is opened, and retained until it
+	// is closed. Media containers typically store their headers and indexes
+	// (e.g. an MP4 moov atom) at one end of the file, and players read them
+	// before anything else, and repeatedly while seeking. If IndexChunks is
+	// zero, 1 is used; if it is negative, no chunks are retained.
+	IndexChunks int
+}
+
+// A streamChunk is a chunk buffered by a StreamReader.
+type streamChunk struct {
+	done   chan struct{} // closed once data or err is set
+	data   []byte
+	err    error
+	cancel context.CancelFunc
+	pinned bool
+}
+
+// A StreamReader reads a file from a PseudoFS in a manner suited to streaming
+// media. It downloads a bounded window of chunks ahead of the read position in
+// parallel, retains the chunks at either end of the file, where media indexes
+// are typically stored, and, when seeking, cancels the downloads of any chunks
+// that fall outside the new window, so that the chunks at the new position are
+// not delayed by stale ones.
+//
+// A StreamReader reads a snapshot of the file taken when it was opened;
+// subsequent writes, and writes that had not yet been flushed, are not
+// visible. It is not safe for concurrent use.
+type StreamReader struct {
+	fs        *PseudoFS
+	f         *openMetaFile
+	size      int64
+	bounds    []int64
+	minShards []int
+	shardOffs []int64
+	hashes    []crypto.Hash
+	inline    []byte
+	window    int
+	offset    int64
+
+	mu     sync.Mutex
+	chunks map[int]*streamChunk
+	closed bool
+}
+
+// OpenStream opens the named file for streaming.
+func (fs *PseudoFS) OpenStream(name string, opts StreamOptions) (*StreamReader, error) {
+	fs.mu.RLock()
+	var m *renter.MetaFile
+	if f := fs.lookupFile(name); f != nil {
+		m = snapshotMetaFile(f.m)
+	} else {
+		var err error
+		m, err = readMetaFile(fs.path(name)+metafileExt, fs.metaKey)
+		if err != nil {
+			fs.mu.RUnlock()
+			return nil, errors.Wrapf(err, "open %v", name)
+		}
+	}
+	fs.mu.RUnlock()
+
+	sr := &StreamReader{
+		fs:     fs,
+		f:      &openMetaFile{name: name, m: m},
+		size:   m.Filesize,
+		hashes: m.ChunkHashes(),
+		window: opts.Window,
+		chunks: make(map[int]*streamChunk),
+	}
+	if sr.window <= 0 {
+		sr.window = 4
+	}
+	if m.IsInline() {
+		data, err := m.InlineData()
+		if err != nil {
+			return nil, err
+		}
+		sr.inline = data
+		return sr, nil
+	}
+	sr.bounds, sr.minShards = m.ChunkLayout()
+	sr.shardOffs = make([]int64, len(sr.minShards))
+	for i := 1; i < len(sr.shardOffs); i++ {
+		sr.shardOffs[i] = sr.shardOffs[i-1] + (sr.bounds[i]-sr.bounds[i-1])/int64(sr.minShards[i-1])
+	}
+
+	// prefetch the ends of the file
+	index := opts.IndexChunks
+	if index == 0 {
+		index = 1
+	}
+	sr.mu.Lock()
+	for i := 0; i < index && i < sr.numChunks(); i++ {
+		sr.fetch(i).pinned = true
+		sr.fetch(sr.numChunks() - 1 - i).pinned = true
+	}
+	sr.mu.Unlock()
+	return sr, nil
+}
+
+// numChunks returns the number of chunks containing file data.
+func (sr *StreamReader) numChunks() int {
+	n := 0
+	for n+1 < len(sr.bounds) && sr.bounds[n] < sr.size {
+		n++
+	}
+	return n
+}
+
+// fetch returns the specified chunk, starting its download if necessary. The
+// caller must hold sr.mu.
+func (sr *StreamReader) fetch(i int) *streamChunk {
+	if c, ok := sr.chunks[i]; ok {
+		return c
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &streamChunk{done: make(chan struct{}), cancel: cancel}
+	sr.chunks[i] = c
+
+	sr.fs.mu.RLock()
+	cache, overdrive := sr.fs.cache, sr.fs.overdrive
+	sr.fs.mu.RUnlock()
+	sr.fs.hosts.background.Add(1)
+	go func() {
+		defer sr.fs.hosts.background.Done()
+		defer close(c.done)
+		c.data, c.err = sr.downloadChunk(ctx, cache, overdrive, i)
+	}()
+	return c
+}
+
+// downloadChunk downloads and recovers the specified chunk.
+func (sr *StreamReader) downloadChunk(ctx context.Context, cache *SectorCache, overdrive int, i int) ([]byte, error) {
+	length := (sr.bounds[i+1] - sr.bounds[i]) / int64(sr.minShards[i])
+	shards, err := sr.fs.downloadShardsWith(ctx, cache, overdrive, sr.f, sr.shardOffs[i], length, sr.minShards[i])
+	if err != nil {
+		return nil, err
+	}
+	end := sr.bounds[i+1]
+	verify := i < len(sr.hashes) && sr.hashes[i] != (crypto.Hash{})
+	if end > sr.size && !verify {
+		end = sr.size
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, end-sr.bounds[i]))
+	if err := sr.f.m.ChunkErasureCode(sr.minShards[i]).Recover(buf, shards, 0, int(end-sr.bounds[i])); err != nil {
+		return nil, errors.Wrap(err, "could not recover chunk")
+	} else if verify && renter.HashChunk(buf.Bytes()) != sr.hashes[i] {
+		return nil, errors.Wrapf(renter.ErrBadChecksum, "chunk %v does not match integrity manifest", i)
+	}
+	return buf.Bytes(), nil
+}
+
+// chunkAt returns the index of the chunk containing off.
+func (sr *StreamReader) chunkAt(off int64) int {
+	for i := 0; i+1 < len(sr.bounds); i++ {
+		if off < sr.bounds[i+1] {
+			return i
+		}
+	}
+	return len(sr.bounds) - 1
+}
+
+// Read implements io.Reader.
+func (sr *StreamReader) Read(p []byte) (int, error) {
+	if sr.closed {
+		return 0, ErrInvalidFileDescriptor
+	} else if sr.offset >= sr.size {
+		return 0, io.EOF
+	} else if int64(len(p)) > sr.size-sr.offset {
+		p = p[:sr.size-sr.offset]
+	}
+	if sr.inline != nil {
+		n := copy(p, sr.inline[sr.offset:])
+		sr.offset += int64(n)
+		return n, nil
+	}
+
+	// discard the chunks outside the window, cancelling their downloads, and
+	// start downloading the chunks within it
+	first := sr.chunkAt(sr.offset)
+	last := first + sr.window
+	if n := sr.numChunks(); last > n {
+		last = n
+	}
+	sr.mu.Lock()
+	for i, c := range sr.chunks {
+		if !c.pinned && (i < first || i >= last) {
+			c.cancel()
+			delete(sr.chunks, i)
+		}
+	}
+	for i := first; i < last; i++ {
+		sr.fetch(i)
+	}
+	c := sr.chunks[first]
+	sr.mu.Unlock()
+
+	<-c.done
+	if c.err != nil {
+		// allow the chunk to be retried
+		sr.mu.Lock()
+		if sr.chunks[first] == c {
+			delete(sr.chunks, first)
+		}
+		sr.mu.Unlock()
+		return 0, c.err
+	}
+	n := copy(p, c.data[sr.offset-sr.bounds[first]:])
+	sr.offset += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker. Seeking is cheap; the window is moved, and
+// stale downloads cancelled, by the next call to Read.
+func (sr *StreamReader) Seek(offset int64, whence int) (int64, error) {
+	if sr.closed {
+		return 0, ErrInvalidFileDescriptor
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.offset
+	case io.SeekEnd:
+		offset += sr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek position cannot be negative")
+	}
+	sr.offset = offset
+	return offset, nil
+}
+
+// Size returns the size of the file.
+func (sr *StreamReader) Size() int64 { return sr.size }
+
+// Close cancels any downloads in progress and releases the buffered chunks.
+func (sr *StreamReader) Close() error {
+	if sr.closed {
+		return ErrInvalidFileDescriptor
+	}
+	sr.closed = true
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for i, c := range sr.chunks {
+		c.cancel()
+		delete(sr.chunks, i)
+	}
+	return nil
+}
+
+// HLSOptions configures NewHLSHandler.
+type HLSOptions struct {
+	// SegmentSize is the size of each segment, in bytes. Segments are byte
+	// ranges of the file, so SegmentSize should be a multiple of the
+	// container's packet size, e.g. 188 for MPEG-TS. If SegmentSize is zero,
+	// the largest multiple of 188 not exceeding 1 MiB is used.
+	SegmentSize int64
+
+	// SegmentDuration is the nominal duration of each segment, which players
+	// use to estimate the length of the stream. If SegmentDuration is zero,
+	// 6 seconds is used.
+	SegmentDuration time.Duration
+
+	// Stream configures the StreamReader used to serve each request.
+	Stream StreamOptions
+}
+
+type hlsHandler struct {
+	fs   *PseudoFS
+	name string
+	opts HLSOptions
+}
+
+// ServeHTTP implements http.Handler.
+func (h hlsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "index.m3u8":
+		info, err := h.fs.Stat(h.name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("ETag", fileETag(info))
+		http.ServeContent(w, r, "", info.ModTime(), strings.NewReader(h.playlist(info.Size())))
+	case "media":
+		sr, err := h.fs.OpenStream(h.name, h.opts.Stream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer sr.Close()
+		info, err := h.fs.Stat(h.name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("ETag", fileETag(info))
+		http.ServeContent(w, r, "", info.ModTime(), sr)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// playlist returns a VOD playlist that divides a file of the specified size
+// into byte-range segments.
+func (h hlsHandler) playlist(size int64) string {
+	secs := h.opts.SegmentDuration.Seconds()
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n", int64(secs+0.999))
+	for off := int64(0); off < size; off += h.opts.SegmentSize {
+		n := h.opts.SegmentSize
+		if size-off < n {
+			n = size - off
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n#EXT-X-BYTERANGE:%d@%d\nmedia\n", secs, n, off)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// NewHLSHandler returns an http.Handler that exposes the named file as an HTTP
+// Live Streaming (HLS) playlist of byte-range segments. The playlist is
+// served at index.m3u8, relative to the handler's root, and refers to the
+// segments as ranges of the file itself, which is served at media, via a
+// StreamReader. The file is not transcoded, so it must already be in a format
+// suitable for HLS, such as MPEG-TS; and since segment boundaries are not
+// aligned with keyframes, players may need to decode from the start of a
+// segment to reach the desired frame. Use http.StripPrefix to serve the
+// handler under a path prefix.
+func NewHLSHandler(fs *PseudoFS, name string, opts HLSOptions) http.Handler {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = (1 << 20) / 188 * 188
+	}
+	if opts.SegmentDuration <= 0 {
+		opts.SegmentDuration = 6 * time.Second
+	}
+	return hlsHandler{fs: fs, name: name, opts: opts}
+}
@@ -0,0 +1,119 @@
+package renterutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestStreamReader(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(filepath.Join(dir, "fs"), fs.hosts)
+	if err := os.Mkdir(filepath.Join(dir, "fs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// upload a file spanning four chunks
+	data := frand.Bytes(renterhost.SectorSize*3 + 1000)
+	pf, err := fs.Create("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := fs.OpenStream("foo", StreamOptions{Window: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	if sr.Size() != int64(len(data)) {
+		t.Fatal("wrong size:", sr.Size())
+	}
+	readAt := func(off int64, n int) {
+		t.Helper()
+		if _, err := sr.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(sr, buf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, data[off:][:n]) {
+			t.Fatalf("contents at %v do not match data", off)
+		}
+	}
+	readAt(0, 100)
+	readAt(int64(len(data))-100, 100)
+	readAt(renterhost.SectorSize*2-50, 100) // spans two chunks
+	readAt(renterhost.SectorSize+10, 100)
+
+	// only the window and the ends of the file should be buffered
+	sr.mu.Lock()
+	buffered := len(sr.chunks)
+	_, ok := sr.chunks[1]
+	sr.mu.Unlock()
+	if buffered != 3 || !ok {
+		t.Fatal("expected chunks 0, 1, and 3 to be buffered, got", buffered)
+	}
+
+	// reading the whole file should work
+	if _, err := sr.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	} else if got, err := ioutil.ReadAll(sr); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatal("contents do not match data")
+	}
+
+	// serve the file via HLS
+	srv := httptest.NewServer(NewHLSHandler(fs, "foo", HLSOptions{SegmentSize: renterhost.SectorSize}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(string(playlist), "#EXTM3U") || strings.Count(string(playlist), "#EXT-X-BYTERANGE") != 4 {
+		t.Fatalf("wrong playlist:\n%s", playlist)
+	} else if exp := fmt.Sprintf("#EXT-X-BYTERANGE:1000@%d\n", renterhost.SectorSize*3); !strings.Contains(string(playlist), exp) {
+		t.Fatalf("playlist is missing final segment:\n%s", playlist)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/media", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", renterhost.SectorSize*3, len(data)-1))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatal("expected partial content, got", resp.Status)
+	} else if !bytes.Equal(segment, data[renterhost.SectorSize*3:]) {
+		t.Fatal("segment does not match data")
+	}
+}
@@ -0,0 +1,434 @@
+package renterutil
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/us/renterhost"
+)
+
+// MetadataBlockHashes is the metadata key, recorded by SyncDir, of the
+// hex-encoded BLAKE2b-256 hashes of each syncBlockSize block of the file's
+// contents. SyncDir uses them to upload only the blocks of a file that have
+// changed.
+const MetadataBlockHashes = "blake2b-blocks"
+
+// syncBlockSize is the granularity at which SyncDir detects changes within a
+// file.
+const syncBlockSize = renterhost.SectorSize
+
+// A SyncDeletePolicy determines how SyncDir treats remote files that do not
+// exist locally.
+type SyncDeletePolicy int
+
+const (
+	// SyncKeep leaves remote files that do not exist locally untouched.
+	SyncKeep SyncDeletePolicy = iota
+
+	// SyncDelete removes remote files and directories that do not exist
+	// locally. If the trash is enabled, they are moved to the trash (see
+	// PseudoFS.SetTrashRetention).
+	SyncDelete
+)
+
+// SyncOptions configures SyncDir.
+type SyncOptions struct {
+	// Concurrency is the maximum number of files uploaded at once. If
+	// Concurrency is zero, 4 is used.
+	Concurrency int
+
+	// MinShards is the number of shards required to recover each newly
+	// uploaded file.
+	MinShards int
+
+	// Delete determines how remote files that do not exist locally are
+	// treated.
+	Delete SyncDeletePolicy
+
+	// DryRun causes SyncDir to return its plan without modifying the
+	// filesystem.
+	DryRun bool
+}
+
+// A SyncActionType is a kind of change made by SyncDir.
+type SyncActionType int
+
+const (
+	// SyncMkdir creates a directory.
+	SyncMkdir SyncActionType = iota
+	// SyncUpload uploads an entire file, replacing the remote file, if any.
+	SyncUpload
+	// SyncUpdate uploads the changed ranges of a file, and updates its mode
+	// and metadata. Ranges may be empty if only the latter have changed.
+	SyncUpdate
+	// SyncRemove removes a remote file or directory.
+	SyncRemove
+)
+
+// String implements fmt.Stringer.
+func (t SyncActionType) String() string {
+	switch t {
+	case SyncMkdir:
+		return "mkdir"
+	case SyncUpload:
+		return "upload"
+	case SyncUpdate:
+		return "update"
+	case SyncRemove:
+		return "remove"
+	default:
+		return "unknown"
+	}
+}
+
+// A SyncRange is a range of a local file that must be uploaded.
+type SyncRange struct {
+	Offset int64
+	Length int64
+}
+
+// A SyncAction is a single change made by SyncDir.
+type SyncAction struct {
+	Type      SyncActionType
+	Name      string // within the filesystem
+	LocalPath string // empty for SyncRemove
+	Ranges    []SyncRange
+	Bytes     int64 // total length of Ranges
+
+	// state of the local file when the plan was made
+	size   int64
+	mode   os.FileMode
+	mtime  string
+	hash   string
+	blocks string
+}
+
+// A SyncPlan describes the changes made, or to be made, by SyncDir.
+type SyncPlan struct {
+	Actions   []SyncAction
+	Unchanged int // number of files that did not need to be uploaded
+}
+
+// hashBlocks returns the MetadataHash and MetadataBlockHashes of the file at
+// path.
+func hashBlocks(path string) (sum, blocks string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	h := newFileHash()
+	var blockHashes []byte
+	buf := make([]byte, syncBlockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			bh := blake2b.Sum256(buf[:n])
+			blockHashes = append(blockHashes, bh[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), hex.EncodeToString(blockHashes), nil
+}
+
+// changedRanges returns the ranges of a file of the specified size, with the
+// specified block hashes, that differ from a remote file with remoteBlocks.
+// If remoteBlocks is not valid for a file of remoteSize bytes, ok is false.
+func changedRanges(size int64, blocks string, remoteSize int64, remoteBlocks string) (ranges []SyncRange, ok bool) {
+	numBlocks := func(size int64) int {
+		return int((size + syncBlockSize - 1) / syncBlockSize)
+	}
+	const hashLen = 2 * blake2b.Size256
+	if len(remoteBlocks) != numBlocks(remoteSize)*hashLen {
+		return nil, false
+	}
+	for i := 0; i < numBlocks(size); i++ {
+		block := blocks[i*hashLen:][:hashLen]
+		if i < numBlocks(remoteSize) && remoteBlocks[i*hashLen:][:hashLen] == block {
+			continue
+		}
+		off := int64(i) * syncBlockSize
+		length := int64(syncBlockSize)
+		if off+length > size {
+			length = size - off
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == off {
+			ranges[n-1].Length += length
+		} else {
+			ranges = append(ranges, SyncRange{off, length})
+		}
+	}
+	return ranges, true
+}
+
+// planFile returns the action required to synchronize the named file with
+// the local file at path, or nil if the file is unchanged.
+func (fs *PseudoFS) planFile(path, name string, info os.FileInfo) (*SyncAction, error) {
+	a := &SyncAction{
+		Name:      name,
+		LocalPath: path,
+		size:      info.Size(),
+		mode:      info.Mode().Perm(),
+		mtime:     info.ModTime().Format(time.RFC3339Nano),
+	}
+	stat, err := fs.Stat(name)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	} else if exists && stat.IsDir() {
+		return nil, errors.Errorf("%v is a directory", name)
+	}
+	var md map[string]string
+	if exists {
+		if md, err = fs.Metadata(name); err != nil {
+			return nil, err
+		}
+		// as in UploadDir, a file with the same size and modification time is
+		// assumed to be unchanged
+		if stat.Size() == a.size && stat.Mode().Perm() == a.mode && md[MetadataModTime] == a.mtime && md[MetadataBlockHashes] != "" {
+			return nil, nil
+		}
+	}
+
+	if a.hash, a.blocks, err = hashBlocks(path); err != nil {
+		return nil, err
+	}
+	if !exists {
+		a.Type = SyncUpload
+	} else if ranges, ok := changedRanges(a.size, a.blocks, stat.Size(), md[MetadataBlockHashes]); ok {
+		if len(ranges) == 0 && stat.Size() == a.size && stat.Mode().Perm() == a.mode && md[MetadataModTime] == a.mtime {
+			return nil, nil
+		}
+		a.Type = SyncUpdate
+		a.Ranges = ranges
+	} else if md[MetadataHash] == a.hash && stat.Size() == a.size {
+		// the contents are unchanged, but the block hashes must be recorded
+		a.Type = SyncUpdate
+	} else {
+		a.Type = SyncUpload
+	}
+	if a.Type == SyncUpload && a.size > 0 {
+		a.Ranges = []SyncRange{{0, a.size}}
+	}
+	for _, r := range a.Ranges {
+		a.Bytes += r.Length
+	}
+	return a, nil
+}
+
+// planSync computes the changes required to synchronize dir with localDir.
+func (fs *PseudoFS) planSync(ctx context.Context, localDir, dir string, opts SyncOptions) (*SyncPlan, error) {
+	plan := new(SyncPlan)
+	local := make(map[string]bool)
+	err := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, rel)
+		if info.IsDir() {
+			local[name] = true
+			if !isDir(fs.path(name)) {
+				plan.Actions = append(plan.Actions, SyncAction{Type: SyncMkdir, Name: name, LocalPath: path, mode: info.Mode().Perm()})
+			}
+			return nil
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+		local[name] = true
+		a, err := fs.planFile(path, name, info)
+		if err != nil {
+			return errors.Wrapf(err, "could not compare %v", path)
+		} else if a == nil {
+			plan.Unchanged++
+			return nil
+		}
+		plan.Actions = append(plan.Actions, *a)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.Delete != SyncDelete || !isDir(fs.path(dir)) {
+		return plan, nil
+	}
+
+	root := fs.path(dir)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if isInternalFile(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir // the trash
+			}
+			return nil
+		} else if !info.IsDir() && !strings.HasSuffix(path, metafileExt) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, strings.TrimSuffix(path, metafileExt))
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(dir, rel)
+		if local[name] {
+			return nil
+		}
+		plan.Actions = append(plan.Actions, SyncAction{Type: SyncRemove, Name: name})
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read remote directory")
+	}
+	return plan, nil
+}
+
+// SyncDir makes the directory dir a copy of localDir, in the manner of rsync,
+// and returns the changes made. Each local file is compared with its remote
+// counterpart by size, modification time, and contents, in that order; only
+// files that differ are uploaded. If SyncDir uploaded the remote file
+// previously, its block hashes (see MetadataBlockHashes) are compared with
+// those of the local file, and only the changed ranges are uploaded;
+// otherwise, the entire file is uploaded. Remote files that do not exist
+// locally are removed according to opts.Delete, after every upload has
+// succeeded. If opts.DryRun is set, the plan is returned without any changes
+// being made.
+//
+// Changed ranges are detected using the metadata recorded by SyncDir, so a
+// file modified by other means should be uploaded in full, e.g. by removing
+// it first. As with UploadDir, the filesystem is flushed before SyncDir
+// returns.
+//
+// SyncDir stops early if ctx is cancelled, and reports its progress, in bytes
+// of file data uploaded, to the ProgressFunc of ctx (see WithProgress).
+func (fs *PseudoFS) SyncDir(ctx context.Context, localDir, dir string, opts SyncOptions) (*SyncPlan, error) {
+	plan, err := fs.planSync(ctx, localDir, dir, opts)
+	if err != nil || opts.DryRun {
+		return plan, err
+	}
+
+	var total int64
+	for _, a := range plan.Actions {
+		total += a.Bytes
+	}
+	progress := newProgressTracker(ctx, total)
+	t := newDirTransfer(opts.Concurrency)
+	var walkErr error
+	for i := range plan.Actions {
+		a := &plan.Actions[i]
+		if walkErr = ctx.Err(); walkErr != nil || t.failed() {
+			break
+		}
+		switch a.Type {
+		case SyncMkdir:
+			if err := fs.MkdirAll(a.Name, a.mode); err != nil {
+				walkErr = errors.Wrapf(err, "could not create %v", a.Name)
+			}
+		case SyncUpload, SyncUpdate:
+			t.jobs <- func() error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				pr := &progressReader{ctx: ctx, p: progress}
+				if err := fs.syncFile(pr, a, opts); err != nil {
+					return errors.Wrapf(err, "could not upload %v", a.LocalPath)
+				}
+				t.record(true, a.Bytes)
+				return nil
+			}
+		}
+		if walkErr != nil {
+			break
+		}
+	}
+	if _, err := t.wait(walkErr); err != nil {
+		return plan, err
+	}
+
+	// remove files only once every upload has finished, so that they do not
+	// race with the uploads, and so that a failed sync removes nothing
+	for _, a := range plan.Actions {
+		if a.Type != SyncRemove {
+			continue
+		} else if err := ctx.Err(); err != nil {
+			return plan, err
+		} else if err := fs.RemoveAll(a.Name); err != nil {
+			return plan, errors.Wrapf(err, "could not remove %v", a.Name)
+		}
+	}
+	return plan, fs.Flush()
+}
+
+// syncFile uploads the ranges of a, reading the local file through pr, and
+// records the file's mode and metadata.
+func (fs *PseudoFS) syncFile(pr *progressReader, a *SyncAction, opts SyncOptions) error {
+	f, err := os.Open(a.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	flag := os.O_WRONLY
+	if a.Type == SyncUpload {
+		flag |= os.O_CREATE | os.O_TRUNC
+	}
+	pf, err := fs.OpenFile(a.Name, flag, a.mode, opts.MinShards)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, syncBlockSize)
+	for _, r := range a.Ranges {
+		pr.r = io.NewSectionReader(f, r.Offset, r.Length)
+		for off := r.Offset; off < r.Offset+r.Length; {
+			n, err := io.ReadFull(pr, buf)
+			if err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+			if err == nil {
+				_, err = pf.WriteAt(buf[:n], off)
+			}
+			if err != nil {
+				pf.Close()
+				return err
+			}
+			off += int64(n)
+		}
+	}
+	if stat, err := pf.Stat(); err != nil {
+		pf.Close()
+		return err
+	} else if stat.Size() != a.size {
+		if err := pf.Truncate(a.size); err != nil {
+			pf.Close()
+			return err
+		}
+	}
+	if err := pf.Close(); err != nil {
+		return err
+	} else if err := fs.Chmod(a.Name, a.mode); err != nil {
+		return err
+	} else if err := fs.SetMetadata(a.Name, MetadataHash, a.hash); err != nil {
+		return err
+	} else if err := fs.SetMetadata(a.Name, MetadataBlockHashes, a.blocks); err != nil {
+		return err
+	}
+	return fs.SetMetadata(a.Name, MetadataModTime, a.mtime)
+}
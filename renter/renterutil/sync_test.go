@@ -0,0 +1,130 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestSyncDir(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(filepath.Join(dir, "fs"), fs.hosts)
+	if err := os.MkdirAll(fs.root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+
+	files := map[string][]byte{
+		"foo":     frand.Bytes(renterhost.SectorSize*2 + 1000),
+		"sub/bar": frand.Bytes(1000),
+		"sub/baz": frand.Bytes(1000),
+	}
+	for name, data := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(path, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkContents := func() {
+		t.Helper()
+		for name, data := range files {
+			pf, err := fs.Open(filepath.Join("backup", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(pf)
+			pf.Close()
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(got, data) {
+				t.Fatalf("%v: contents do not match data", name)
+			}
+		}
+	}
+	countActions := func(plan *SyncPlan) map[SyncActionType]int {
+		counts := make(map[SyncActionType]int)
+		for _, a := range plan.Actions {
+			counts[a.Type]++
+		}
+		return counts
+	}
+
+	// a dry run should not change anything
+	opts := SyncOptions{MinShards: 1, Delete: SyncDelete, DryRun: true}
+	plan, err := fs.SyncDir(context.Background(), src, "backup", opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if c := countActions(plan); c[SyncMkdir] != 2 || c[SyncUpload] != 3 || len(plan.Actions) != 5 {
+		t.Fatalf("wrong plan: %+v", plan.Actions)
+	} else if _, err := fs.Stat("backup"); !os.IsNotExist(errors.Cause(err)) {
+		t.Fatal("dry run modified filesystem")
+	}
+
+	opts.DryRun = false
+	if _, err := fs.SyncDir(context.Background(), src, "backup", opts); err != nil {
+		t.Fatal(err)
+	}
+	checkContents()
+	if plan, err := fs.SyncDir(context.Background(), src, "backup", opts); err != nil {
+		t.Fatal(err)
+	} else if len(plan.Actions) != 0 || plan.Unchanged != 3 {
+		t.Fatalf("expected no changes, got %+v", plan)
+	}
+
+	// modify the middle of foo and remove baz; only the changed block of foo
+	// should be uploaded
+	copy(files["foo"][renterhost.SectorSize+10:], "modified")
+	if err := ioutil.WriteFile(filepath.Join(src, "foo"), files["foo"], 0640); err != nil {
+		t.Fatal(err)
+	} else if err := os.Remove(filepath.Join(src, "sub/baz")); err != nil {
+		t.Fatal(err)
+	}
+	delete(files, "sub/baz")
+	var last TransferProgress
+	ctx := WithProgress(context.Background(), func(tp TransferProgress) { last = tp })
+	plan, err = fs.SyncDir(ctx, src, "backup", opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if c := countActions(plan); c[SyncUpdate] != 1 || c[SyncRemove] != 1 || len(plan.Actions) != 2 {
+		t.Fatalf("wrong plan: %+v", plan.Actions)
+	}
+	for _, a := range plan.Actions {
+		if a.Type == SyncUpdate && (len(a.Ranges) != 1 || a.Ranges[0] != SyncRange{renterhost.SectorSize, renterhost.SectorSize}) {
+			t.Fatalf("wrong ranges: %+v", a.Ranges)
+		}
+	}
+	if last.Done != renterhost.SectorSize || last.Total != renterhost.SectorSize {
+		t.Fatalf("wrong progress: %+v", last)
+	} else if _, err := fs.Stat("backup/sub/baz"); !os.IsNotExist(errors.Cause(err)) {
+		t.Fatal("expected baz to be removed, got", err)
+	}
+	checkContents()
+
+	// shrinking a file should truncate it
+	files["foo"] = files["foo"][:renterhost.SectorSize+5]
+	if err := ioutil.WriteFile(filepath.Join(src, "foo"), files["foo"], 0640); err != nil {
+		t.Fatal(err)
+	} else if _, err := fs.SyncDir(context.Background(), src, "backup", opts); err != nil {
+		t.Fatal(err)
+	}
+	checkContents()
+}
@@ -0,0 +1,293 @@
+package renterutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+)
+
+const (
+	// trashNameFilename is the name of the file, within a trash entry, that
+	// records the original name of the entry's item.
+	trashNameFilename = "name"
+
+	// trashItemName is the name of the removed file or directory within a
+	// trash entry. Files retain their metafile extension.
+	trashItemName = "item"
+)
+
+// A TrashEntry describes a file or directory in the trash.
+type TrashEntry struct {
+	ID      string
+	Name    string // the name of the item before it was removed
+	Dir     bool
+	Deleted time.Time
+}
+
+// SetTrashRetention enables the trash. While enabled, Remove and RemoveAll
+// move files and directories to the trash rather than deleting them, and the
+// sectors they reference are retained on hosts until the trash is emptied (see
+// EmptyTrash), even if GC is called in the meantime. Removed items can be
+// restored with Undelete. Items are eligible for deletion once they have been
+// in the trash for at least d. The default is 0, which disables the trash;
+// items already in the trash remain there.
+func (fs *PseudoFS) SetTrashRetention(d time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.trashRetention = d
+}
+
+func (fs *PseudoFS) trashPath() string {
+	return filepath.Join(fs.root, trashDirname)
+}
+
+// flushBeforeTrash commits any pending changes to files at or within name, so
+// that the metafiles moved to the trash are current. The caller must hold
+// fs.mu.
+func (fs *PseudoFS) flushBeforeTrash(name string) error {
+	for _, f := range fs.files {
+		within := f.name == name || strings.HasPrefix(f.name, name+string(filepath.Separator))
+		if within && (len(f.pendingWrites) > 0 || f.m.ModTime.After(fs.lastCommitTime)) {
+			return fs.flushSectors()
+		}
+	}
+	return nil
+}
+
+// moveToTrash moves the file or directory at path, which is the location of
+// the named item, into a new trash entry. The caller must hold fs.mu.
+func (fs *PseudoFS) moveToTrash(name, path string) error {
+	id := fmt.Sprintf("%016x-%x", time.Now().UnixNano(), frand.Bytes(4))
+	entry := filepath.Join(fs.trashPath(), id)
+	item := filepath.Join(entry, trashItemName)
+	if strings.HasSuffix(path, metafileExt) {
+		item += metafileExt
+	}
+	if err := os.MkdirAll(entry, 0700); err != nil {
+		return errors.Wrap(err, "could not create trash entry")
+	} else if err := ioutil.WriteFile(filepath.Join(entry, trashNameFilename), []byte(filepath.ToSlash(relName(name))), 0600); err != nil {
+		os.RemoveAll(entry)
+		return errors.Wrap(err, "could not create trash entry")
+	} else if err := os.Rename(path, item); err != nil {
+		os.RemoveAll(entry)
+		return err
+	}
+	return nil
+}
+
+// trashEntries returns the entries in the trash, oldest first.
+func (fs *PseudoFS) trashEntries() ([]TrashEntry, error) {
+	infos, err := ioutil.ReadDir(fs.trashPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read trash")
+	}
+	var entries []TrashEntry
+	for _, info := range infos {
+		id := info.Name()
+		nanos, err := strconv.ParseInt(strings.Split(id, "-")[0], 16, 64)
+		if !info.IsDir() || err != nil {
+			continue
+		}
+		entry := filepath.Join(fs.trashPath(), id)
+		name, err := ioutil.ReadFile(filepath.Join(entry, trashNameFilename))
+		if os.IsNotExist(err) {
+			continue // incomplete entry
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "could not read trash entry %v", id)
+		}
+		entries = append(entries, TrashEntry{
+			ID:      id,
+			Name:    filepath.FromSlash(string(name)),
+			Dir:     isDir(filepath.Join(entry, trashItemName)),
+			Deleted: time.Unix(0, nanos),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.Before(entries[j].Deleted)
+	})
+	return entries, nil
+}
+
+// Trash returns the entries in the trash, oldest first.
+func (fs *PseudoFS) Trash() ([]TrashEntry, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.trashEntries()
+}
+
+// Undelete restores the most recently removed item with the specified name
+// from the trash. It returns an error if the item is not in the trash, or if
+// a file or directory with the same name already exists.
+func (fs *PseudoFS) Undelete(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entries, err := fs.trashEntries()
+	if err != nil {
+		return err
+	}
+	name = relName(name)
+	var e *TrashEntry
+	for i := range entries {
+		if entries[i].Name == name {
+			e = &entries[i]
+		}
+	}
+	if e == nil {
+		return errors.Wrapf(os.ErrNotExist, "undelete %v", name)
+	}
+
+	path := fs.path(name)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return errors.Wrapf(os.ErrExist, "undelete %v", name)
+	} else if _, err := os.Stat(path + metafileExt); !os.IsNotExist(err) || fs.lookupFile(name) != nil {
+		return errors.Wrapf(os.ErrExist, "undelete %v", name)
+	}
+	entry := filepath.Join(fs.trashPath(), e.ID)
+	item := filepath.Join(entry, trashItemName)
+	if !e.Dir {
+		item += metafileExt
+		path += metafileExt
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "undelete %v", name)
+	} else if err := os.Rename(item, path); err != nil {
+		return errors.Wrapf(err, "undelete %v", name)
+	} else if err := os.RemoveAll(entry); err != nil {
+		return errors.Wrapf(err, "undelete %v", name)
+	}
+
+	if !fs.indexingEnabled() {
+		return nil
+	} else if e.Dir {
+		return fs.updateDirIndexesForDir(name)
+	}
+	m, err := readMetaFile(path, fs.metaKey)
+	if err != nil {
+		return errors.Wrap(err, "could not update directory index")
+	}
+	return fs.updateDirIndexesForFile(name, m)
+}
+
+// EmptyTrash permanently deletes the items that have been in the trash for
+// at least the trash's retention period (see SetTrashRetention), or every
+// item in the trash if all is true. The sectors referenced by the deleted
+// items are deleted from hosts, unless they are also referenced by other files
+// within the filesystem (including items remaining in the trash). As with GC,
+// this means that sectors referenced only by shared metafiles may be deleted.
+//
+// If a host cannot be reached, EmptyTrash returns an error, and the items
+// remain in the trash, so that their sectors can be deleted later.
+func (fs *PseudoFS) EmptyTrash(all bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// commit any pending changes, so that the metafiles on disk are current
+	if err := fs.flushSectors(); err != nil {
+		return err
+	}
+
+	entries, err := fs.trashEntries()
+	if err != nil {
+		return err
+	}
+	expired := make(map[string]bool)
+	for _, e := range entries {
+		if all || time.Since(e.Deleted) >= fs.trashRetention {
+			expired[filepath.Join(fs.trashPath(), e.ID)] = true
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	// gather the roots referenced by the expired items, and by everything
+	// else
+	trashed := make(map[hostdb.HostPublicKey]map[crypto.Hash]struct{})
+	referenced := make(map[hostdb.HostPublicKey]map[crypto.Hash]struct{})
+	addRoot := func(set map[hostdb.HostPublicKey]map[crypto.Hash]struct{}, hostKey hostdb.HostPublicKey, root crypto.Hash) {
+		if set[hostKey] == nil {
+			set[hostKey] = make(map[crypto.Hash]struct{})
+		}
+		set[hostKey][root] = struct{}{}
+	}
+	walk := func(dir string, set map[hostdb.HostPublicKey]map[crypto.Hash]struct{}, skip map[string]bool) error {
+		return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if info.IsDir() && skip[path] {
+				return filepath.SkipDir
+			} else if info.IsDir() || !strings.HasSuffix(path, metafileExt) {
+				return nil
+			}
+			m, err := readMetaFile(path, fs.metaKey)
+			if err != nil {
+				// as in GC, all files must be checked
+				return err
+			}
+			for i, hostKey := range m.Hosts {
+				for _, ss := range m.Shards[i] {
+					addRoot(set, hostKey, ss.MerkleRoot)
+				}
+			}
+			for _, g := range m.Garbage() {
+				addRoot(set, g.Host, g.Slice.MerkleRoot)
+			}
+			return nil
+		})
+	}
+	for entry := range expired {
+		if err := walk(entry, trashed, nil); err != nil {
+			return errors.Wrap(err, "could not read trash")
+		}
+	}
+	if err := walk(fs.root, referenced, expired); err != nil {
+		return err
+	}
+
+	// delete unreferenced sectors
+	for hostKey, rootsMap := range trashed {
+		if !fs.hosts.HasHost(hostKey) {
+			continue
+		}
+		var roots []crypto.Hash
+		for root := range rootsMap {
+			if _, ok := referenced[hostKey][root]; !ok {
+				roots = append(roots, root)
+			}
+		}
+		if len(roots) == 0 {
+			continue
+		}
+		err := func() error {
+			h, err := fs.hosts.acquire(hostKey)
+			if err != nil {
+				return err
+			}
+			defer fs.hosts.release(hostKey)
+			return h.DeleteSectors(roots)
+		}()
+		if err != nil {
+			return &HostError{hostKey, err}
+		}
+	}
+
+	// delete the expired items
+	for entry := range expired {
+		if err := os.RemoveAll(entry); err != nil {
+			return errors.Wrap(err, "could not delete trash entry")
+		}
+	}
+	return nil
+}
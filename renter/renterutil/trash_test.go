@@ -0,0 +1,188 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestTrash(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(filepath.Join(dir, "fs"), fs.hosts)
+	if err := os.MkdirAll(fs.root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetTrashRetention(time.Hour)
+
+	numSectors := func() (n int) {
+		t.Helper()
+		for hostKey := range fs.hosts.sessions {
+			h, err := fs.hosts.acquire(hostKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n += h.Revision().NumSectors()
+			fs.hosts.release(hostKey)
+		}
+		return
+	}
+	checkContents := func(name string, data []byte) {
+		t.Helper()
+		pf, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		if got, err := ioutil.ReadAll(pf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatalf("%v: contents do not match data", name)
+		}
+	}
+
+	data := frand.Bytes(renterhost.SectorSize)
+	if err := fs.MkdirAll("bar", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo", "bar/baz"} {
+		pf, err := fs.Create(name, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := pf.Write(data); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// removed items should move to the trash, and should not be collected
+	// by GC
+	if err := fs.Remove("foo"); err != nil {
+		t.Fatal(err)
+	} else if err := fs.RemoveAll("bar"); err != nil {
+		t.Fatal(err)
+	} else if _, err := fs.Stat("foo"); !os.IsNotExist(errors.Cause(err)) {
+		t.Fatal("expected foo to be removed, got", err)
+	}
+	root, err := fs.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	} else if names, err := root.Readdirnames(-1); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Fatal("expected trash to be hidden, got", names)
+	} else if err := root.Close(); err != nil {
+		t.Fatal(err)
+	}
+	localDir := filepath.Join(dir, "local")
+	if _, err := fs.DownloadDir(context.Background(), ".", localDir, DirOptions{}); err != nil {
+		t.Fatal(err)
+	} else if infos, err := ioutil.ReadDir(localDir); err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 0 {
+		t.Fatal("expected trash not to be downloaded, got", infos[0].Name())
+	}
+	entries, err := fs.Trash()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || entries[0].Name != "foo" || entries[0].Dir || entries[1].Name != "bar" || !entries[1].Dir {
+		t.Fatalf("wrong trash entries: %+v", entries)
+	}
+	before := numSectors()
+	if err := fs.GC(); err != nil {
+		t.Fatal(err)
+	} else if numSectors() != before {
+		t.Fatal("GC deleted sectors of trashed files")
+	}
+
+	// undelete both items
+	if err := fs.Undelete("foo"); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Undelete("bar"); err != nil {
+		t.Fatal(err)
+	} else if err := fs.Undelete("bar"); !os.IsNotExist(errors.Cause(err)) {
+		t.Fatal("expected IsNotExist, got", err)
+	}
+	checkContents("foo", data)
+	checkContents("bar/baz", data)
+
+	// items within the retention period should not be deleted
+	if err := fs.Remove("foo"); err != nil {
+		t.Fatal(err)
+	} else if err := fs.EmptyTrash(false); err != nil {
+		t.Fatal(err)
+	} else if entries, _ := fs.Trash(); len(entries) != 1 {
+		t.Fatal("expected item to remain in trash")
+	} else if numSectors() != before {
+		t.Fatal("sectors of trashed file were deleted")
+	}
+
+	// emptying the trash should delete the file's sectors
+	if err := fs.EmptyTrash(true); err != nil {
+		t.Fatal(err)
+	} else if entries, _ := fs.Trash(); len(entries) != 0 {
+		t.Fatal("expected trash to be empty")
+	} else if err := fs.Undelete("foo"); err == nil {
+		t.Fatal("expected undelete to fail after emptying trash")
+	} else if numSectors() != before-2 {
+		t.Fatalf("expected 2 sectors to be deleted, %v -> %v", before, numSectors())
+	}
+	checkContents("bar/baz", data)
+
+	// trashing a directory should be safe while other files are being
+	// written
+	done := make(chan error)
+	go func() {
+		pf, err := fs.Create("qux", 1)
+		if err != nil {
+			done <- err
+			return
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := pf.Write(data[:1000]); err != nil {
+				pf.Close()
+				done <- err
+				return
+			}
+		}
+		done <- pf.Close()
+	}()
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("dir%d/foo", i)
+		if err := fs.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		} else if pf, err := fs.Create(name, 1); err != nil {
+			t.Fatal(err)
+		} else if _, err := pf.Write(data[:1000]); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := fs.RemoveAll(filepath.Dir(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	} else if entries, _ := fs.Trash(); len(entries) != 10 {
+		t.Fatal("expected 10 trash entries, got", len(entries))
+	}
+}
@@ -0,0 +1,77 @@
+package renterutil
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+)
+
+// TruncateFile shrinks the metafile at filename to the specified size without
+// re-uploading any data (see renter.MetaFile.Truncate). The removed data is
+// recorded as garbage. If hosts is non-nil, full sectors that the file no
+// longer references are then deleted from those of its hosts that are in the
+// set, trimming their contracts; as with (PseudoFile).Free, partial sectors
+// are not deleted, since they may be shared with other files, and remain
+// recorded as garbage (see (PseudoFS).ReclaimGarbage). The metafile is locked
+// exclusively for the duration of the operation. The file should not be
+// open in a PseudoFS.
+func TruncateFile(filename string, size int64, hosts *HostSet) error {
+	l, err := renter.LockMetaFile(filename)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+	m, err := renter.ReadMetaFile(filename)
+	if err != nil {
+		return err
+	} else if err := m.Truncate(size); err != nil {
+		return err
+	}
+	m.ModTime = time.Now()
+	// write the truncated metafile before deleting anything, so that the
+	// garbage remains recorded if deletion fails
+	if err := renter.WriteMetaFile(filename, m); err != nil {
+		return err
+	} else if hosts == nil {
+		return nil
+	}
+
+	// the file may still reference some sectors, e.g. if it contains
+	// duplicate chunks
+	referenced := make(map[hostdb.HostPublicKey]map[crypto.Hash]bool)
+	for i, hostKey := range m.Hosts {
+		referenced[hostKey] = make(map[crypto.Hash]bool)
+		for _, ss := range m.Shards[i] {
+			referenced[hostKey][ss.MerkleRoot] = true
+		}
+	}
+	roots := make(map[hostdb.HostPublicKey][]crypto.Hash)
+	var remaining []renter.GarbageSlice
+	for _, g := range m.Garbage() {
+		switch {
+		case !hosts.HasHost(g.Host), g.Slice.NumSegments != merkle.SegmentsPerSector:
+			remaining = append(remaining, g)
+		case !referenced[g.Host][g.Slice.MerkleRoot]:
+			roots[g.Host] = append(roots[g.Host], g.Slice.MerkleRoot)
+		}
+	}
+	for hostKey, hostRoots := range roots {
+		err := func() error {
+			h, err := hosts.acquire(hostKey)
+			if err != nil {
+				return err
+			}
+			defer hosts.release(hostKey)
+			return h.DeleteSectors(hostRoots)
+		}()
+		if err != nil {
+			return errors.Wrapf(err, "%v: could not delete sectors", hostKey.ShortKey())
+		}
+	}
+	m.SetGarbage(remaining)
+	return renter.WriteMetaFile(filename, m)
+}
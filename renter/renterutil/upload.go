@@ -0,0 +1,328 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
+)
+
+// An UploadPipeline uploads files to hosts, overlapping each stage of the
+// upload: reading from the source, erasure-coding, encrypting (and computing
+// Merkle roots), and writing to each host all proceed concurrently, connected
+// by bounded queues. Thus, the upload proceeds at the speed of its slowest
+// stage rather than the sum of all of them, and no more than a few chunks
+// are held in memory at once.
+type UploadPipeline struct {
+	// Workers is the number of chunks that are erasure-coded and encrypted
+	// concurrently. If Workers is zero, runtime.NumCPU() is used.
+	Workers int
+
+	// QueueLen is the maximum number of chunks buffered between each pair of
+	// stages; a stage blocks when the queue in front of it is full. Each
+	// buffered chunk occupies up to renterhost.SectorSize bytes per host. If
+	// QueueLen is zero, Workers is used.
+	QueueLen int
+
+	hosts *HostSet
+}
+
+// Upload reads a file's plaintext from source until EOF and uploads it to the
+// hosts of m, which should be a new metafile, e.g. one returned by
+// renter.NewMetaFile. m's redundancy tiers, if any, are respected. On
+// success, m's shards, integrity manifest (see renter.ExtChunkHashes),
+// Filesize, and ModTime are updated; the caller is responsible for writing m
+// to disk. If any stage fails, the upload is aborted, and the first error is
+// returned.
+func (p *UploadPipeline) Upload(m *renter.MetaFile, source io.Reader) error {
+	return p.UploadContext(context.Background(), m, source)
+}
+
+// UploadContext is like Upload, but aborts the upload if ctx is cancelled,
+// and reports its progress to the ProgressFunc of ctx (see WithProgress). A
+// chunk counts towards the progress once it has been uploaded to every host.
+// If source has a Stat method, e.g. an *os.File, it is used to determine the
+// total size of the upload.
+func (p *UploadPipeline) UploadContext(ctx context.Context, m *renter.MetaFile, source io.Reader) error {
+	if _, ok := m.Extension(renter.ExtSiaCipher); ok {
+		return errors.New("cannot upload to a metafile imported from siad")
+	}
+	for _, h := range m.Hosts {
+		if !p.hosts.HasHost(h) {
+			return errors.Errorf("%v: no contract with host", h.ShortKey())
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	workers := p.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	queueLen := p.QueueLen
+	if queueLen <= 0 {
+		queueLen = workers
+	}
+
+	var total int64
+	if s, ok := source.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := s.Stat(); err == nil {
+			total = info.Size()
+		}
+	}
+	progress := newProgressTracker(ctx, total)
+
+	// the first error, or cancellation, aborts every stage
+	done := make(chan struct{})
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(done)
+		})
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			fail(ctx.Err())
+		case <-done:
+		case <-finished:
+		}
+	}()
+
+	// stage 1: read chunks from source
+	type plainChunk struct {
+		index     int
+		data      []byte
+		minShards int
+	}
+	plainChunks := make(chan plainChunk, queueLen)
+	var filesize int64
+	go func() {
+		defer close(plainChunks)
+		for i := 0; ; i++ {
+			k, size := m.NextChunk(filesize)
+			buf := make([]byte, size)
+			n, err := io.ReadFull(source, buf)
+			if err == io.EOF {
+				return
+			} else if err != nil && err != io.ErrUnexpectedEOF {
+				fail(errors.Wrap(err, "could not read source"))
+				return
+			}
+			filesize += int64(n)
+			select {
+			case plainChunks <- plainChunk{i, buf[:n], k}:
+			case <-done:
+				return
+			}
+			if n < len(buf) {
+				return
+			}
+		}
+	}()
+
+	// stage 2: erasure-code and encrypt each chunk, distributing the
+	// resulting sectors to the host queues
+	type sector struct {
+		index     int
+		chunkSize int
+		sb        *renter.SectorBuilder
+	}
+	hostQueues := make([]chan sector, len(m.Hosts))
+	for j := range hostQueues {
+		hostQueues[j] = make(chan sector, queueLen)
+	}
+	var hashMu sync.Mutex // guards hashes
+	var hashes []crypto.Hash
+	var workerWG sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerWG.Add(1)
+		go func() {
+			defer workerWG.Done()
+			for c := range plainChunks {
+				shards := make([][]byte, len(m.Hosts))
+				for j := range shards {
+					shards[j] = make([]byte, 0, renterhost.SectorSize)
+				}
+				rsc := m.ChunkErasureCode(c.minShards)
+				rsc.Encode(c.data, shards)
+				var padded bytes.Buffer
+				if err := rsc.Recover(&padded, shards, 0, len(shards[0])*c.minShards); err != nil {
+					fail(errors.Wrap(err, "could not encode chunk"))
+					return
+				}
+				hashMu.Lock()
+				for len(hashes) <= c.index {
+					hashes = append(hashes, crypto.Hash{})
+				}
+				hashes[c.index] = renter.HashChunk(padded.Bytes())
+				hashMu.Unlock()
+
+				for j := range shards {
+					sb := new(renter.SectorBuilder)
+					sb.Append(shards[j], m.MasterKey, m.Cipher())
+					sb.SetMerkleRoot(merkle.SectorRoot(sb.Finish()))
+					select {
+					case hostQueues[j] <- sector{c.index, len(c.data), sb}:
+					case <-done:
+						return
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		workerWG.Wait()
+		for _, q := range hostQueues {
+			close(q)
+		}
+	}()
+
+	// stage 3: upload each host's sectors
+	var hostsLeftMu sync.Mutex // guards hostsLeft
+	hostsLeft := make(map[int]int)
+	var hostWG sync.WaitGroup
+	for j := range m.Hosts {
+		hostWG.Add(1)
+		go func(j int) {
+			defer hostWG.Done()
+			hostKey := m.Hosts[j]
+			for s := range hostQueues[j] {
+				err := func() error {
+					h, err := p.hosts.acquire(hostKey)
+					if err != nil {
+						return err
+					}
+					defer p.hosts.release(hostKey)
+					_, err = h.Append(s.sb.Finish())
+					return err
+				}()
+				if err != nil {
+					fail(errors.Wrapf(&HostError{hostKey, err}, "could not upload chunk %v", s.index))
+					return
+				}
+				// each host's shard is only accessed by its own goroutine
+				for len(m.Shards[j]) <= s.index {
+					m.Shards[j] = append(m.Shards[j], renter.SectorSlice{})
+				}
+				m.Shards[j][s.index] = s.sb.Slices()[0]
+				// a chunk is done once every host has it
+				hostsLeftMu.Lock()
+				if _, ok := hostsLeft[s.index]; !ok {
+					hostsLeft[s.index] = len(m.Hosts)
+				}
+				hostsLeft[s.index]--
+				var n int64
+				if hostsLeft[s.index] == 0 {
+					n = int64(s.chunkSize)
+					delete(hostsLeft, s.index)
+				}
+				hostsLeftMu.Unlock()
+				progress.add(n, hostKey)
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}(j)
+	}
+	hostWG.Wait()
+	workerWG.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	m.Filesize = filesize
+	m.ModTime = time.Now()
+	m.SetChunkHashes(hashes)
+	return nil
+}
+
+// NewUploadPipeline returns an UploadPipeline that uploads using sessions
+// from hosts, with default concurrency.
+func NewUploadPipeline(hosts *HostSet) *UploadPipeline {
+	return &UploadPipeline{hosts: hosts}
+}
+
+// UploadStream uploads data of unknown length, such as a pipe or a live
+// capture, from source to the named file, creating it with the specified
+// mode and redundancy, or replacing it if it already exists. source is read
+// until EOF one chunk at a time, via an UploadPipeline, so at most a few
+// chunks are held in memory no matter how long the stream is. The metafile is
+// only written once source has been exhausted and every chunk has been
+// uploaded, so a failed or cancelled upload leaves any existing file
+// untouched; its data can be reclaimed with GC. A stream that ends before
+// exceeding the filesystem's inline threshold (see SetInlineThreshold) is
+// stored inline rather than uploaded.
+//
+// UploadStream returns the number of bytes uploaded. It is an error to call
+// UploadStream on a file that is currently open.
+func (fs *PseudoFS) UploadStream(ctx context.Context, name string, perm os.FileMode, minShards int, source io.Reader) (int64, error) {
+	fs.mu.RLock()
+	inlineSize := fs.inlineSize
+	open := fs.lookupFile(name) != nil
+	fs.mu.RUnlock()
+	if open {
+		return 0, errors.Errorf("upload %v: file is open", name)
+	} else if len(fs.hosts.sessions) < minShards {
+		return 0, errors.New("minShards cannot be greater than the number of hosts")
+	} else if _, err := os.Stat(filepath.Dir(fs.path(name))); err != nil {
+		return 0, errors.Wrapf(err, "upload %v", name)
+	}
+	hosts := make([]hostdb.HostPublicKey, 0, len(fs.hosts.sessions))
+	for hostKey := range fs.hosts.sessions {
+		hosts = append(hosts, hostKey)
+	}
+	m := renter.NewMetaFile(perm, 0, hosts, minShards)
+
+	// read just enough to determine whether the stream can be stored inline
+	prefix := make([]byte, inlineSize+1)
+	n, err := io.ReadFull(source, prefix)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if err := m.SetInlineData(prefix[:n]); err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, errors.Wrap(err, "could not read source")
+	} else {
+		source = io.MultiReader(bytes.NewReader(prefix), source)
+		if err := NewUploadPipeline(fs.hosts).UploadContext(ctx, m, source); err != nil {
+			return 0, err
+		}
+	}
+	m.ModTime = time.Now()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.lookupFile(name) != nil {
+		return 0, errors.Errorf("upload %v: file is open", name)
+	}
+	path := fs.path(name) + metafileExt
+	l, err := renter.LockMetaFile(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "upload %v", name)
+	}
+	defer l.Unlock()
+	if err := writeMetaFile(path, m, fs.metaKey); err != nil {
+		return 0, errors.Wrapf(err, "upload %v", name)
+	} else if err := fs.updateDirIndexesForFile(name, m); err != nil {
+		return 0, err
+	}
+	return m.Filesize, nil
+}
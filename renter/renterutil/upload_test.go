@@ -0,0 +1,231 @@
+package renterutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renterhost"
+)
+
+type errReader struct {
+	r io.Reader
+}
+
+func (er errReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrClosedPipe
+	}
+	return n, err
+}
+
+func TestUploadPipeline(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+	var hosts []hostdb.HostPublicKey
+	for hostKey := range fs.hosts.sessions {
+		hosts = append(hosts, hostKey)
+	}
+
+	// upload a 2-of-3 file spanning multiple chunks, with more chunks than
+	// can be buffered at once
+	p := NewUploadPipeline(fs.hosts)
+	p.Workers = 2
+	p.QueueLen = 1
+	m := renter.NewMetaFile(0666, 0, hosts, 2)
+	data := frand.Bytes(renterhost.SectorSize*2*3 + 1000)
+	if err := p.Upload(m, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	} else if m.Filesize != int64(len(data)) {
+		t.Fatal("wrong filesize:", m.Filesize)
+	} else if len(m.ChunkHashes()) != 4 {
+		t.Fatal("wrong number of chunk hashes:", len(m.ChunkHashes()))
+	}
+	for i := range m.Shards {
+		if len(m.Shards[i]) != 4 {
+			t.Fatal("wrong number of slices:", len(m.Shards[i]))
+		}
+	}
+	if err := renter.WriteMetaFile(filepath.Join(dir, "foo"+metafileExt), m); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file should be readable, and should pass integrity checks
+	pf, err := fs.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	if p, err := ioutil.ReadAll(pf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Fatal("contents do not match data")
+	}
+
+	// an empty source should produce an empty file
+	m = renter.NewMetaFile(0666, 0, hosts, 2)
+	if err := p.Upload(m, bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	} else if m.Filesize != 0 || len(m.Shards[0]) != 0 {
+		t.Fatal("expected empty file")
+	}
+
+	// a failing source should abort the upload
+	m = renter.NewMetaFile(0666, 0, hosts, 2)
+	err = p.Upload(m, errReader{bytes.NewReader(data)})
+	if err == nil || !strings.Contains(err.Error(), "could not read source") {
+		t.Fatal("expected read error, got", err)
+	}
+
+	// as should a missing host
+	m = renter.NewMetaFile(0666, 0, append(hosts, hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())), 2)
+	if err := p.Upload(m, bytes.NewReader(data)); err == nil {
+		t.Fatal("expected error for unknown host")
+	}
+
+	// progress should be reported to the context's ProgressFunc, using the
+	// size of the source if available
+	path := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var last TransferProgress
+	var calls int
+	ctx := WithProgress(context.Background(), func(tp TransferProgress) {
+		if tp.Done < last.Done {
+			t.Error("progress went backwards")
+		}
+		last = tp
+		calls++
+	})
+	m = renter.NewMetaFile(0666, 0, hosts, 2)
+	if err := p.UploadContext(ctx, m, f); err != nil {
+		t.Fatal(err)
+	} else if calls != len(hosts)*4 {
+		t.Fatal("expected one call per host per chunk, got", calls)
+	} else if last.Done != int64(len(data)) || last.Total != int64(len(data)) || last.ETA != 0 {
+		t.Fatalf("wrong final progress: %+v", last)
+	} else if last.Host == (hostdb.HostPublicKey{}) {
+		t.Fatal("expected host to be reported")
+	}
+
+	// a cancelled context should abort the upload
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m = renter.NewMetaFile(0666, 0, hosts, 2)
+	if err := p.UploadContext(ctx, m, bytes.NewReader(data)); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+}
+
+func TestUploadStream(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+	fs.SetInlineThreshold(100)
+
+	// stream data of unknown length through a pipe, in small writes
+	stream := func(data []byte) io.Reader {
+		pr, pw := io.Pipe()
+		go func() {
+			for len(data) > 0 {
+				n := 1 + frand.Intn(64<<10)
+				if n > len(data) {
+					n = len(data)
+				}
+				pw.Write(data[:n])
+				data = data[n:]
+			}
+			pw.Close()
+		}()
+		return pr
+	}
+	checkFile := func(name string, data []byte) {
+		t.Helper()
+		pf, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pf.Close()
+		if got, err := ioutil.ReadAll(pf); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatal("contents do not match data")
+		}
+	}
+
+	data := frand.Bytes(renterhost.SectorSize + 500)
+	if n, err := fs.UploadStream(context.Background(), "foo", 0600, 1, stream(data)); err != nil {
+		t.Fatal(err)
+	} else if n != int64(len(data)) {
+		t.Fatal("wrong size:", n)
+	} else if info, err := fs.Stat("foo"); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != int64(len(data)) || info.Mode() != 0600 {
+		t.Fatal("wrong file info:", info.Size(), info.Mode())
+	}
+	checkFile("foo", data)
+
+	// a short stream should be stored inline
+	small := frand.Bytes(50)
+	if _, err := fs.UploadStream(context.Background(), "bar", 0600, 1, stream(small)); err != nil {
+		t.Fatal(err)
+	} else if m, err := renter.ReadMetaFile(filepath.Join(dir, "bar"+metafileExt)); err != nil {
+		t.Fatal(err)
+	} else if !m.IsInline() {
+		t.Fatal("expected file to be stored inline")
+	}
+	checkFile("bar", small)
+
+	// a cancelled upload should leave the existing file untouched
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fs.UploadStream(ctx, "foo", 0600, 1, stream(frand.Bytes(1000))); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	checkFile("foo", data)
+
+	// open files cannot be replaced
+	pf, err := fs.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	if _, err := fs.UploadStream(context.Background(), "foo", 0600, 1, stream(small)); err == nil {
+		t.Fatal("expected error for open file")
+	}
+}
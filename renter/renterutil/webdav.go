@@ -0,0 +1,469 @@
+package renterutil
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/frand"
+)
+
+// A WebDAVHandler serves a PseudoFS over WebDAV (RFC 4918), allowing the
+// filesystem to be mapped as a network drive by Windows, macOS, and other
+// WebDAV clients.
+//
+// GET requests are served with http.ServeContent, so range requests download
+// only the sectors (and segments) covering the requested range, verified
+// against their Merkle roots. Files uploaded with PUT are buffered and
+// committed by the filesystem's next Flush, like any other PseudoFS write.
+//
+// Locks are not enforced: LOCK always succeeds, returning a fresh token, and
+// UNLOCK is a no-op. (Many clients refuse to write to servers that do not
+// support locking.) Similarly, dead properties are not supported; PROPPATCH
+// reports every property as forbidden.
+type WebDAVHandler struct {
+	fs        *PseudoFS
+	prefix    string
+	minShards int
+}
+
+// NewWebDAVHandler returns a WebDAVHandler that serves fs. The handler
+// expects request paths to begin with prefix, which is stripped to obtain the
+// name of a file within fs. Files created by the handler will be erasure-coded
+// with the specified minShards.
+func NewWebDAVHandler(fs *PseudoFS, prefix string, minShards int) *WebDAVHandler {
+	return &WebDAVHandler{
+		fs:        fs,
+		prefix:    strings.TrimSuffix(prefix, "/"),
+		minShards: minShards,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *WebDAVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := h.name(r.URL.Path)
+	if !ok {
+		http.Error(w, "path is outside WebDAV prefix", http.StatusNotFound)
+		return
+	}
+	var status int
+	var err error
+	switch r.Method {
+	case "OPTIONS":
+		status, err = h.serveOptions(w, r, name)
+	case "GET", "HEAD":
+		status, err = h.serveGet(w, r, name)
+	case "PUT":
+		status, err = h.servePut(w, r, name)
+	case "DELETE":
+		status, err = h.serveDelete(w, r, name)
+	case "MKCOL":
+		status, err = h.serveMkcol(w, r, name)
+	case "COPY", "MOVE":
+		status, err = h.serveCopyMove(w, r, name)
+	case "PROPFIND":
+		status, err = h.servePropfind(w, r, name)
+	case "PROPPATCH":
+		status, err = h.serveProppatch(w, r, name)
+	case "LOCK":
+		status, err = h.serveLock(w, r, name)
+	case "UNLOCK":
+		status = http.StatusNoContent
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+	if status != 0 {
+		msg := http.StatusText(status)
+		if err != nil {
+			msg = err.Error()
+		}
+		http.Error(w, msg, status)
+	}
+}
+
+// name converts a request path to a PseudoFS name.
+func (h *WebDAVHandler) name(p string) (string, bool) {
+	p = path.Clean("/" + p)
+	if h.prefix != "" {
+		if p != h.prefix && !strings.HasPrefix(p, h.prefix+"/") {
+			return "", false
+		}
+		p = path.Clean("/" + strings.TrimPrefix(p, h.prefix))
+	}
+	return strings.TrimPrefix(p, "/"), true
+}
+
+// href converts a PseudoFS name to an escaped request path.
+func (h *WebDAVHandler) href(name string, dir bool) string {
+	p := h.prefix + "/" + name
+	if dir && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// stat returns information about the named file, and an appropriate HTTP
+// status if the file cannot be accessed.
+func (h *WebDAVHandler) stat(name string) (os.FileInfo, int, error) {
+	info, err := h.fs.Stat(name)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, http.StatusNotFound, nil
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return info, 0, nil
+}
+
+// parentExists reports whether the parent directory of name exists.
+func (h *WebDAVHandler) parentExists(name string) bool {
+	return isDir(h.fs.path(path.Dir("/" + name)))
+}
+
+func (h *WebDAVHandler) serveOptions(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND, PROPPATCH, LOCK, UNLOCK")
+	w.Header().Set("DAV", "1, 2")
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.WriteHeader(http.StatusOK)
+	return 0, nil
+}
+
+func (h *WebDAVHandler) serveGet(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	info, status, err := h.stat(name)
+	if status != 0 {
+		return status, err
+	} else if info.IsDir() {
+		return http.StatusMethodNotAllowed, ErrDirectory
+	}
+	pf, err := h.fs.Open(name)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer pf.Close()
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeContent(w, r, path.Base("/"+name), info.ModTime(), pf)
+	return 0, nil
+}
+
+func (h *WebDAVHandler) servePut(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if !h.parentExists(name) {
+		return http.StatusConflict, nil
+	}
+	info, status, err := h.stat(name)
+	if status == http.StatusInternalServerError {
+		return status, err
+	} else if info != nil && info.IsDir() {
+		return http.StatusMethodNotAllowed, ErrDirectory
+	}
+	pf, err := h.fs.Create(name, h.minShards)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if _, err := io.Copy(pf, r.Body); err != nil {
+		pf.Close()
+		return http.StatusInternalServerError, err
+	} else if err := pf.Close(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if info != nil {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return 0, nil
+}
+
+func (h *WebDAVHandler) serveDelete(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if name == "" {
+		return http.StatusForbidden, errors.New("cannot delete root")
+	} else if _, status, err := h.stat(name); status != 0 {
+		return status, err
+	} else if err := h.fs.RemoveAll(name); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return 0, nil
+}
+
+func (h *WebDAVHandler) serveMkcol(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	if r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, nil
+	} else if !h.parentExists(name) {
+		return http.StatusConflict, nil
+	} else if _, status, err := h.stat(name); status == 0 {
+		return http.StatusMethodNotAllowed, errors.New("resource already exists")
+	} else if status != http.StatusNotFound {
+		return status, err
+	} else if err := h.fs.Mkdir(name, 0700); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.WriteHeader(http.StatusCreated)
+	return 0, nil
+}
+
+func (h *WebDAVHandler) serveCopyMove(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	dst, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dst.Path == "" {
+		return http.StatusBadRequest, errors.New("invalid Destination header")
+	}
+	dstName, ok := h.name(dst.Path)
+	if !ok {
+		return http.StatusBadGateway, errors.New("destination is outside WebDAV prefix")
+	} else if dstName == name {
+		return http.StatusForbidden, errors.New("source and destination are the same")
+	} else if name == "" || strings.HasPrefix(dstName+"/", name+"/") {
+		return http.StatusForbidden, errors.New("cannot copy or move a collection into itself")
+	}
+	info, status, err := h.stat(name)
+	if status != 0 {
+		return status, err
+	} else if !h.parentExists(dstName) {
+		return http.StatusConflict, nil
+	}
+	dstInfo, status, err := h.stat(dstName)
+	if status == http.StatusInternalServerError {
+		return status, err
+	} else if dstInfo != nil {
+		if r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed, nil
+		} else if err := h.fs.RemoveAll(dstName); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if r.Method == "MOVE" {
+		err = h.fs.Rename(name, dstName)
+	} else if info.IsDir() {
+		return http.StatusNotImplemented, errors.New("copying collections is not supported")
+	} else {
+		err = h.copyFile(name, dstName)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if dstInfo != nil {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return 0, nil
+}
+
+// copyFile copies the contents of the named file to a new file. The data is
+// downloaded and re-uploaded.
+func (h *WebDAVHandler) copyFile(name, dstName string) error {
+	src, err := h.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := h.fs.Create(dstName, h.minShards)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// WebDAV XML types. The "D:" prefix is bound to the DAV: namespace on the
+// root element of each response.
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"D:href"`
+	Propstat []davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string            `xml:"D:displayname,omitempty"`
+	ResourceType  *davResourceType  `xml:"D:resourcetype,omitempty"`
+	ContentLength string            `xml:"D:getcontentlength,omitempty"`
+	LastModified  string            `xml:"D:getlastmodified,omitempty"`
+	ETag          string            `xml:"D:getetag,omitempty"`
+	SupportedLock *davSupportedLock `xml:"D:supportedlock,omitempty"`
+	Other         []davAnyElement   `xml:",any"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+type davSupportedLock struct {
+	LockEntry struct {
+		LockScope struct {
+			Exclusive struct{} `xml:"D:exclusive"`
+		} `xml:"D:lockscope"`
+		LockType struct {
+			Write struct{} `xml:"D:write"`
+		} `xml:"D:locktype"`
+	} `xml:"D:lockentry"`
+}
+
+type davAnyElement struct {
+	XMLName xml.Name
+}
+
+type davPropertyUpdate struct {
+	Set    []davAnyProps `xml:"DAV: set>prop"`
+	Remove []davAnyProps `xml:"DAV: remove>prop"`
+}
+
+type davAnyProps struct {
+	Props []davAnyElement `xml:",any"`
+}
+
+func davStatus(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+// fileETag returns an ETag for the specified file, derived from its size and
+// modification time.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func (h *WebDAVHandler) propResponse(name string, info os.FileInfo) davResponse {
+	prop := davProp{
+		DisplayName:   path.Base("/" + name),
+		ResourceType:  new(davResourceType),
+		LastModified:  info.ModTime().UTC().Format(http.TimeFormat),
+		SupportedLock: new(davSupportedLock),
+	}
+	if name == "" {
+		prop.DisplayName = ""
+	}
+	if info.IsDir() {
+		prop.ResourceType.Collection = new(struct{})
+	} else {
+		prop.ContentLength = fmt.Sprint(info.Size())
+		prop.ETag = fileETag(info)
+	}
+	return davResponse{
+		Href: h.href(name, info.IsDir()),
+		Propstat: []davPropstat{{
+			Prop:   prop,
+			Status: davStatus(http.StatusOK),
+		}},
+	}
+}
+
+func writeMultistatus(w http.ResponseWriter, ms davMultistatus) error {
+	ms.XMLNS = "DAV:"
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	return xml.NewEncoder(w).Encode(ms)
+}
+
+func (h *WebDAVHandler) servePropfind(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	// all properties are returned, regardless of which were requested;
+	// unbounded depth is not supported (RFC 4918, section 9.1)
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		return http.StatusForbidden, errors.New("Depth must be 0 or 1")
+	}
+	info, status, err := h.stat(name)
+	if status != 0 {
+		return status, err
+	}
+	ms := davMultistatus{Responses: []davResponse{h.propResponse(name, info)}}
+	if depth == "1" && info.IsDir() {
+		d, err := h.fs.Open(name)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		infos, err := d.Readdir(-1)
+		d.Close()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		for _, info := range infos {
+			ms.Responses = append(ms.Responses, h.propResponse(path.Join(name, info.Name()), info))
+		}
+	}
+	writeMultistatus(w, ms)
+	return 0, nil
+}
+
+func (h *WebDAVHandler) serveProppatch(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	info, status, err := h.stat(name)
+	if status != 0 {
+		return status, err
+	}
+	var pu davPropertyUpdate
+	if err := xml.NewDecoder(r.Body).Decode(&pu); err != nil {
+		return http.StatusBadRequest, errors.Wrap(err, "invalid propertyupdate")
+	}
+	var prop davProp
+	for _, ps := range append(pu.Set, pu.Remove...) {
+		for _, p := range ps.Props {
+			prop.Other = append(prop.Other, davAnyElement{XMLName: p.XMLName})
+		}
+	}
+	writeMultistatus(w, davMultistatus{Responses: []davResponse{{
+		Href: h.href(name, info.IsDir()),
+		Propstat: []davPropstat{{
+			Prop:   prop,
+			Status: davStatus(http.StatusForbidden),
+		}},
+	}}})
+	return 0, nil
+}
+
+func (h *WebDAVHandler) serveLock(w http.ResponseWriter, r *http.Request, name string) (int, error) {
+	_, status, err := h.stat(name)
+	if status == http.StatusInternalServerError {
+		return status, err
+	}
+	created := status == http.StatusNotFound
+	if created {
+		// locking an unmapped URL creates an empty resource
+		if !h.parentExists(name) {
+			return http.StatusConflict, nil
+		}
+		pf, err := h.fs.Create(name, h.minShards)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		} else if err := pf.Close(); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	token := "opaquelocktoken:" + hex.EncodeToString(frand.Bytes(16))
+	timeout := "Second-" + fmt.Sprint(int(time.Hour.Seconds()))
+	var href strings.Builder
+	xml.EscapeText(&href, []byte(h.href(name, false)))
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Lock-Token", "<"+token+">")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	fmt.Fprintf(w, `%s<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`+
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>`+
+		`<D:depth>infinity</D:depth><D:timeout>%s</D:timeout>`+
+		`<D:locktoken><D:href>%s</D:href></D:locktoken>`+
+		`<D:lockroot><D:href>%s</D:href></D:lockroot>`+
+		`</D:activelock></D:lockdiscovery></D:prop>`, xml.Header, timeout, token, href.String())
+	return 0, nil
+}
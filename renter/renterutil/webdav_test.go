@@ -0,0 +1,206 @@
+package renterutil
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestWebDAV(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+
+	srv := httptest.NewServer(NewWebDAVHandler(fs, "/dav", 1))
+	defer srv.Close()
+	do := func(method, path string, body []byte, hdrs ...string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(hdrs); i += 2 {
+			req.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	expectStatus := func(resp *http.Response, status int) []byte {
+		t.Helper()
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != status {
+			t.Fatalf("expected status %v, got %v (%s)", status, resp.StatusCode, body)
+		}
+		return body
+	}
+	propfind := func(path, depth string) (hrefs []string) {
+		t.Helper()
+		body := expectStatus(do("PROPFIND", path, nil, "Depth", depth), http.StatusMultiStatus)
+		var ms struct {
+			Responses []struct {
+				Href string `xml:"href"`
+			} `xml:"response"`
+		}
+		if err := xml.Unmarshal(body, &ms); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range ms.Responses {
+			hrefs = append(hrefs, r.Href)
+		}
+		return hrefs
+	}
+
+	resp := do("OPTIONS", "/dav/", nil)
+	expectStatus(resp, http.StatusOK)
+	if !strings.Contains(resp.Header.Get("DAV"), "2") {
+		t.Fatal("expected class 2 compliance")
+	}
+
+	// create a collection and a file within it
+	expectStatus(do("MKCOL", "/dav/docs", nil), http.StatusCreated)
+	expectStatus(do("MKCOL", "/dav/docs", nil), http.StatusMethodNotAllowed)
+	expectStatus(do("MKCOL", "/dav/missing/docs", nil), http.StatusConflict)
+	data := frand.Bytes(10000)
+	expectStatus(do("PUT", "/dav/docs/foo%20bar.bin", data), http.StatusCreated)
+	expectStatus(do("PUT", "/dav/missing/foo", data), http.StatusConflict)
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// list the collection
+	if hrefs := propfind("/dav/docs", "1"); len(hrefs) != 2 || hrefs[0] != "/dav/docs/" || hrefs[1] != "/dav/docs/foo%20bar.bin" {
+		t.Fatal("wrong PROPFIND response:", hrefs)
+	}
+	expectStatus(do("PROPFIND", "/dav/docs", nil, "Depth", "infinity"), http.StatusForbidden)
+	expectStatus(do("PROPFIND", "/dav/nope", nil, "Depth", "0"), http.StatusNotFound)
+
+	// read the whole file, then a range
+	resp = do("GET", "/dav/docs/foo%20bar.bin", nil)
+	if body := expectStatus(resp, http.StatusOK); !bytes.Equal(body, data) {
+		t.Fatal("GET returned wrong data")
+	}
+	etag := resp.Header.Get("ETag")
+	if body := expectStatus(do("GET", "/dav/docs/foo%20bar.bin", nil, "Range", "bytes=5000-5099"), http.StatusPartialContent); !bytes.Equal(body, data[5000:5100]) {
+		t.Fatal("range GET returned wrong data")
+	}
+	expectStatus(do("GET", "/dav/docs/foo%20bar.bin", nil, "If-None-Match", etag), http.StatusNotModified)
+
+	// lock, copy, and move
+	resp = do("LOCK", "/dav/docs/foo%20bar.bin", []byte(`<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"/>`))
+	expectStatus(resp, http.StatusOK)
+	if !strings.HasPrefix(resp.Header.Get("Lock-Token"), "<opaquelocktoken:") {
+		t.Fatal("missing Lock-Token")
+	}
+	expectStatus(do("UNLOCK", "/dav/docs/foo%20bar.bin", nil, "Lock-Token", resp.Header.Get("Lock-Token")), http.StatusNoContent)
+	expectStatus(do("COPY", "/dav/docs/foo%20bar.bin", nil, "Destination", srv.URL+"/dav/copy"), http.StatusCreated)
+	expectStatus(do("MOVE", "/dav/docs/foo%20bar.bin", nil, "Destination", srv.URL+"/dav/copy", "Overwrite", "F"), http.StatusPreconditionFailed)
+	expectStatus(do("MOVE", "/dav/docs", nil, "Destination", srv.URL+"/dav/docs/sub"), http.StatusForbidden)
+	expectStatus(do("MOVE", "/dav/docs", nil, "Destination", srv.URL+"/dav/moved"), http.StatusCreated)
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/dav/copy", "/dav/moved/foo%20bar.bin"} {
+		if body := expectStatus(do("GET", path, nil), http.StatusOK); !bytes.Equal(body, data) {
+			t.Fatal("GET returned wrong data for", path)
+		}
+	}
+	if hrefs := propfind("/dav", "1"); len(hrefs) != 3 {
+		t.Fatal("wrong PROPFIND response:", hrefs)
+	}
+
+	// PROPPATCH is not supported, but should report as much
+	body := expectStatus(do("PROPPATCH", "/dav/copy", []byte(`<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:">
+<D:set><D:prop><Z:Win32FileAttributes>00000020</Z:Win32FileAttributes></D:prop></D:set>
+</D:propertyupdate>`)), http.StatusMultiStatus)
+	if !strings.Contains(string(body), "Win32FileAttributes") || !strings.Contains(string(body), "403") {
+		t.Fatal("wrong PROPPATCH response:", string(body))
+	}
+
+	// overwrite and delete
+	expectStatus(do("PUT", "/dav/copy", []byte("foo")), http.StatusNoContent)
+	if body := expectStatus(do("GET", "/dav/copy", nil), http.StatusOK); string(body) != "foo" {
+		t.Fatal("GET returned wrong data")
+	}
+	expectStatus(do("DELETE", "/dav/moved", nil), http.StatusNoContent)
+	expectStatus(do("DELETE", "/dav/moved", nil), http.StatusNotFound)
+	expectStatus(do("GET", "/elsewhere", nil), http.StatusNotFound)
+	resp = do("HEAD", "/dav/copy", nil)
+	if expectStatus(resp, http.StatusOK); resp.ContentLength != 3 {
+		t.Fatal("wrong Content-Length:", resp.ContentLength)
+	}
+}
+
+func TestWebDAVConcurrent(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 2)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs = NewFileSystem(dir, fs.hosts)
+	srv := httptest.NewServer(NewWebDAVHandler(fs, "/dav", 1))
+	defer srv.Close()
+
+	// PUT, GET, and DELETE files concurrently
+	data := frand.Bytes(1000)
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			errs <- func() error {
+				for j := 0; j < 20; j++ {
+					url := fmt.Sprintf("%v/dav/file%d-%d", srv.URL, i, j)
+					for _, method := range []string{"PUT", "GET", "DELETE"} {
+						req, err := http.NewRequest(method, url, bytes.NewReader(data))
+						if err != nil {
+							return err
+						}
+						resp, err := http.DefaultClient.Do(req)
+						if err != nil {
+							return err
+						}
+						body, _ := ioutil.ReadAll(resp.Body)
+						resp.Body.Close()
+						if resp.StatusCode >= 300 {
+							return fmt.Errorf("%v %v: %v (%s)", method, url, resp.Status, body)
+						} else if method == "GET" && !bytes.Equal(body, data) {
+							return fmt.Errorf("GET %v returned wrong data", url)
+						}
+					}
+				}
+				return nil
+			}()
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package renterutil
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The write-back log is a sequence of records, each consisting of a type
+// byte and the length-prefixed name of the file it applies to. A begin record
+// marks the point at which the file's metafile was committed to disk; any
+// earlier records for the file are obsolete. A write record is followed by
+// the offset and length-prefixed data of a buffered write.
+const (
+	writeBackBegin = 1
+	writeBackWrite = 2
+)
+
+type writeBackRecord struct {
+	typ    byte
+	name   string
+	offset int64
+	data   []byte
+}
+
+func appendWriteBackRecord(buf []byte, r writeBackRecord) []byte {
+	var u [8]byte
+	buf = append(buf, r.typ)
+	binary.LittleEndian.PutUint64(u[:], uint64(len(r.name)))
+	buf = append(buf, u[:]...)
+	buf = append(buf, r.name...)
+	if r.typ == writeBackWrite {
+		binary.LittleEndian.PutUint64(u[:], uint64(r.offset))
+		buf = append(buf, u[:]...)
+		binary.LittleEndian.PutUint64(u[:], uint64(len(r.data)))
+		buf = append(buf, u[:]...)
+		buf = append(buf, r.data...)
+	}
+	return buf
+}
+
+// readWriteBackLog reads the records of the write-back log at path. A
+// truncated final record, left by a crash, is ignored.
+func readWriteBackLog(path string) ([]writeBackRecord, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	next := func(n uint64) ([]byte, bool) {
+		if uint64(len(buf)) < n {
+			return nil, false
+		}
+		b := buf[:n]
+		buf = buf[n:]
+		return b, true
+	}
+	nextUint64 := func() (uint64, bool) {
+		b, ok := next(8)
+		if !ok {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint64(b), true
+	}
+	var recs []writeBackRecord
+	for len(buf) > 0 {
+		typ, _ := next(1)
+		r := writeBackRecord{typ: typ[0]}
+		nameLen, ok := nextUint64()
+		if !ok {
+			break
+		}
+		name, ok := next(nameLen)
+		if !ok {
+			break
+		}
+		r.name = string(name)
+		if r.typ == writeBackWrite {
+			offset, ok := nextUint64()
+			if !ok {
+				break
+			}
+			dataLen, ok := nextUint64()
+			if !ok {
+				break
+			}
+			if r.data, ok = next(dataLen); !ok {
+				break
+			}
+			r.offset = int64(offset)
+		} else if r.typ != writeBackBegin {
+			return nil, errors.Errorf("unknown record type %v", r.typ)
+		}
+		recs = append(recs, r)
+	}
+	return recs, nil
+}
+
+func (fs *PseudoFS) writeBackPath() string {
+	return filepath.Join(fs.root, writeBackFilename)
+}
+
+// logWrite records a write to f in the write-back log, if write-back caching
+// is enabled. The first time a file is logged, its metafile is committed, so
+// that the log need only record the file's data.
+func (fs *PseudoFS) logWrite(f *openMetaFile, p []byte, off int64) error {
+	if fs.writeBack == nil {
+		return nil
+	}
+	var buf []byte
+	if !f.logged {
+		if err := fs.commitChanges(f); err != nil {
+			return err
+		}
+		buf = appendWriteBackRecord(buf, writeBackRecord{typ: writeBackBegin, name: f.name})
+	}
+	buf = appendWriteBackRecord(buf, writeBackRecord{
+		typ:    writeBackWrite,
+		name:   f.name,
+		offset: off,
+		data:   p,
+	})
+	if _, err := fs.writeBack.Write(buf); err != nil {
+		return errors.Wrap(err, "could not write to write-back log")
+	}
+	f.logged = true
+	return nil
+}
+
+// rewriteWriteBack replaces the write-back log with one recording only the
+// current pending writes. It must be called whenever pending writes are
+// uploaded or discarded, so that the log neither grows without bound nor
+// resurrects discarded writes.
+func (fs *PseudoFS) rewriteWriteBack() error {
+	if fs.writeBack == nil {
+		return nil
+	}
+	var buf []byte
+	for _, f := range fs.files {
+		f.logged = false
+		if len(f.pendingWrites) == 0 {
+			continue
+		}
+		if err := fs.commitChanges(f); err != nil {
+			return err
+		}
+		buf = appendWriteBackRecord(buf, writeBackRecord{typ: writeBackBegin, name: f.name})
+		for _, pw := range f.pendingWrites {
+			buf = appendWriteBackRecord(buf, writeBackRecord{
+				typ:    writeBackWrite,
+				name:   f.name,
+				offset: pw.offset,
+				data:   pw.data,
+			})
+		}
+		f.logged = true
+	}
+
+	path := fs.writeBackPath()
+	if err := ioutil.WriteFile(path+"_tmp", buf, 0600); err != nil {
+		return errors.Wrap(err, "could not rewrite write-back log")
+	} else if err := os.Rename(path+"_tmp", path); err != nil {
+		return errors.Wrap(err, "could not rewrite write-back log")
+	}
+	fs.writeBack.Close()
+	wb, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fs.writeBack = nil
+		return errors.Wrap(err, "could not reopen write-back log")
+	}
+	fs.writeBack = wb
+	return nil
+}
+
+// replayWriteBack restores the pending writes recorded in the write-back log
+// left by a previous filesystem.
+func (fs *PseudoFS) replayWriteBack() error {
+	recs, err := readWriteBackLog(fs.writeBackPath())
+	if err != nil {
+		return err
+	}
+	last := make(map[string]int)
+	for i, r := range recs {
+		if r.typ == writeBackBegin {
+			last[r.name] = i
+		}
+	}
+	for i, r := range recs {
+		if r.typ != writeBackWrite || i < last[r.name] {
+			continue
+		}
+		f := fs.lookupFile(r.name)
+		if f == nil {
+			path := fs.path(r.name) + metafileExt
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				continue // file was removed
+			}
+			m, err := fs.loadMetaFile(r.name, path, os.O_RDWR)
+			if err != nil {
+				return err
+			}
+			f = &openMetaFile{name: r.name, m: m}
+			fs.files[fs.curFD] = f
+			fs.curFD++
+		}
+		if _, err := fs.fileWriteAt(f, r.data, r.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *PseudoFS) hasPendingWrites() bool {
+	for _, f := range fs.files {
+		if len(f.pendingWrites) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeBackLoop periodically uploads pending writes until stop is closed.
+func (fs *PseudoFS) writeBackLoop(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		fs.mu.Lock()
+		select {
+		case <-stop:
+			fs.mu.Unlock()
+			return
+		default:
+		}
+		if fs.hasPendingWrites() {
+			// if the upload fails, the writes remain pending, and the upload
+			// is retried at the next tick
+			_ = fs.flushSectors()
+		}
+		fs.mu.Unlock()
+	}
+}
+
+// closeWriteBack disables write-back caching, deleting the write-back log if
+// no writes are pending.
+func (fs *PseudoFS) closeWriteBack() error {
+	if fs.writeBackStop != nil {
+		close(fs.writeBackStop)
+		fs.writeBackStop = nil
+	}
+	if fs.writeBack == nil {
+		return nil
+	}
+	fs.writeBack.Close()
+	fs.writeBack = nil
+	if fs.hasPendingWrites() {
+		return nil
+	}
+	if err := os.Remove(fs.writeBackPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not remove write-back log")
+	}
+	return nil
+}
+
+// SetWriteBack enables write-back caching. Writes are always buffered in
+// memory until enough data accumulates to fill a sector, at which point the
+// buffered writes of every file are packed together and uploaded; this keeps
+// small writes cheap. With write-back caching, buffered writes are also
+// recorded in a log in the filesystem's root, and are uploaded once interval
+// has elapsed, even if they do not fill a sector. Sync and Flush still upload
+// immediately.
+//
+// If a previous filesystem rooted at the same directory crashed with writes
+// still buffered, SetWriteBack restores them from the log, and they are
+// uploaded along with subsequent writes. Thus SetWriteBack should be called
+// before any files are opened. The log is not synced to disk after each
+// write, so it protects against crashes of the process, but not of the
+// operating system.
+//
+// An interval of zero disables write-back caching, which is the default;
+// buffered writes are uploaded first.
+func (fs *PseudoFS) SetWriteBack(interval time.Duration) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if interval <= 0 {
+		if fs.writeBack != nil {
+			if err := fs.flushSectors(); err != nil {
+				return err
+			}
+		}
+		return fs.closeWriteBack()
+	}
+
+	if fs.writeBack == nil {
+		if err := fs.replayWriteBack(); err != nil {
+			return errors.Wrap(err, "could not replay write-back log")
+		}
+		wb, err := os.OpenFile(fs.writeBackPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.Wrap(err, "could not open write-back log")
+		}
+		fs.writeBack = wb
+		if err := fs.rewriteWriteBack(); err != nil {
+			return err
+		}
+	}
+	if fs.writeBackStop != nil {
+		close(fs.writeBackStop)
+	}
+	fs.writeBackStop = make(chan struct{})
+	go fs.writeBackLoop(interval, fs.writeBackStop)
+	return nil
+}
@@ -0,0 +1,81 @@
+package renter
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/renter/proto"
+)
+
+// SequenceSize is the size in bytes of an encoded proto.Sequence.
+const SequenceSize = 8 + 8 + 32
+
+// A SequenceDir is a directory-backed proto.SequenceStore. The sequence of
+// each contract is stored in a separate file, named after the contract ID.
+// Updates are atomic.
+type SequenceDir struct {
+	dir string
+}
+
+func (sd *SequenceDir) path(id types.FileContractID) string {
+	return filepath.Join(sd.dir, hex.EncodeToString(id[:])+".seq")
+}
+
+// LoadSequence implements proto.SequenceStore. If no sequence has been stored
+// for the contract, the zero Sequence is returned.
+func (sd *SequenceDir) LoadSequence(id types.FileContractID) (proto.Sequence, error) {
+	b, err := ioutil.ReadFile(sd.path(id))
+	if os.IsNotExist(err) {
+		return proto.Sequence{}, nil
+	} else if err != nil {
+		return proto.Sequence{}, errors.Wrap(err, "could not read sequence file")
+	} else if len(b) != SequenceSize {
+		return proto.Sequence{}, errors.Errorf("sequence file is invalid: wrong size (%v bytes)", len(b))
+	}
+	var seq proto.Sequence
+	seq.RevisionNumber = binary.LittleEndian.Uint64(b[0:8])
+	seq.Pending = binary.LittleEndian.Uint64(b[8:16])
+	copy(seq.Token[:], b[16:48])
+	return seq, nil
+}
+
+// SaveSequence implements proto.SequenceStore.
+func (sd *SequenceDir) SaveSequence(id types.FileContractID, seq proto.Sequence) error {
+	b := make([]byte, SequenceSize)
+	binary.LittleEndian.PutUint64(b[0:8], seq.RevisionNumber)
+	binary.LittleEndian.PutUint64(b[8:16], seq.Pending)
+	copy(b[16:48], seq.Token[:])
+
+	path := sd.path(id)
+	f, err := os.Create(path + "_tmp")
+	if err != nil {
+		return errors.Wrap(err, "could not create sequence file")
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return errors.Wrap(err, "could not write sequence file")
+	} else if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "could not sync sequence file")
+	} else if err := f.Close(); err != nil {
+		return errors.Wrap(err, "could not close sequence file")
+	} else if err := os.Rename(path+"_tmp", path); err != nil {
+		return errors.Wrap(err, "could not atomically replace sequence file")
+	}
+	return nil
+}
+
+// NewSequenceDir returns a SequenceDir that stores sequences in dir, creating
+// dir if necessary.
+func NewSequenceDir(dir string) (*SequenceDir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create sequence directory")
+	}
+	return &SequenceDir{dir: dir}, nil
+}
+
+var _ proto.SequenceStore = (*SequenceDir)(nil)
@@ -0,0 +1,82 @@
+package renter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renter/proto"
+)
+
+func TestSequenceDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seqDir := filepath.Join(dir, "sequences")
+
+	sd, err := NewSequenceDir(seqDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id, other types.FileContractID
+	frand.Read(id[:])
+	frand.Read(other[:])
+	if seq, err := sd.LoadSequence(id); err != nil {
+		t.Fatal(err)
+	} else if seq != (proto.Sequence{}) {
+		t.Fatal("expected zero sequence, got", seq)
+	}
+
+	seq := proto.Sequence{RevisionNumber: 7, Pending: 8}
+	frand.Read(seq.Token[:])
+	if err := sd.SaveSequence(id, seq); err != nil {
+		t.Fatal(err)
+	} else if loaded, err := sd.LoadSequence(id); err != nil {
+		t.Fatal(err)
+	} else if loaded != seq {
+		t.Fatal("loaded sequence does not match saved sequence:", loaded)
+	}
+
+	// sequences should persist across restarts, and should be stored
+	// separately for each contract
+	sd, err = NewSequenceDir(seqDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if loaded, err := sd.LoadSequence(id); err != nil {
+		t.Fatal(err)
+	} else if loaded != seq {
+		t.Fatal("sequence was not persisted:", loaded)
+	} else if loaded, err := sd.LoadSequence(other); err != nil {
+		t.Fatal(err)
+	} else if loaded != (proto.Sequence{}) {
+		t.Fatal("expected zero sequence for other contract, got", loaded)
+	}
+
+	// committing the pending revision should overwrite the sequence
+	seq = proto.Sequence{RevisionNumber: 8}
+	if err := sd.SaveSequence(id, seq); err != nil {
+		t.Fatal(err)
+	}
+	sd, err = NewSequenceDir(seqDir)
+	if err != nil {
+		t.Fatal(err)
+	} else if loaded, err := sd.LoadSequence(id); err != nil {
+		t.Fatal(err)
+	} else if loaded != seq {
+		t.Fatal("sequence was not updated:", loaded)
+	} else if _, err := os.Stat(sd.path(id) + "_tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary sequence file was not removed")
+	}
+
+	// a corrupted sequence file should be rejected
+	if err := ioutil.WriteFile(sd.path(id), make([]byte, SequenceSize-1), 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := sd.LoadSequence(id); err == nil {
+		t.Fatal("expected error for corrupted sequence file")
+	}
+}
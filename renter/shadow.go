@@ -0,0 +1,122 @@
+package renter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ShadowSuffix is appended to a metafile's filename to form the filename of
+// its shadow copy.
+const ShadowSuffix = ".shadow"
+
+// shadowMagic identifies a shadow copy.
+var shadowMagic = []byte("usshadow")
+
+// A ShadowRecovery describes a metafile that could not be read and was
+// recovered from its shadow copy.
+type ShadowRecovery struct {
+	Filename string
+	Err      error // the error encountered reading the metafile
+}
+
+// writeFileSynced writes data to filename and syncs it to stable storage.
+func writeFileSynced(filename string, data []byte) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileAtomic writes data to filename, replacing any existing file
+// atomically, and syncs it to stable storage.
+func writeFileAtomic(filename string, data []byte) error {
+	if err := writeFileSynced(filename+"_tmp", data); err != nil {
+		return err
+	} else if err := os.Rename(filename+"_tmp", filename); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// WriteMetaFileShadowed is like WriteMetaFile, but also writes a checksummed
+// shadow copy of m alongside filename. ReadMetaFileShadowed falls back to
+// the shadow copy if the metafile itself is damaged.
+func WriteMetaFileShadowed(filename string, m *MetaFile) error {
+	var buf bytes.Buffer
+	if err := encodeMetaArchive(&buf, m); err != nil {
+		return err
+	}
+	archive := buf.Bytes()
+	if err := writeFileAtomic(filename, archive); err != nil {
+		return errors.Wrap(err, "could not write archive")
+	}
+	sum := blake2b.Sum256(archive)
+	shadow := make([]byte, 0, len(shadowMagic)+len(sum)+len(archive))
+	shadow = append(shadow, shadowMagic...)
+	shadow = append(shadow, sum[:]...)
+	shadow = append(shadow, archive...)
+	if err := writeFileAtomic(filename+ShadowSuffix, shadow); err != nil {
+		return errors.Wrap(err, "could not write shadow copy")
+	}
+	return nil
+}
+
+// readShadow reads and verifies the shadow copy of filename, returning the
+// archive it contains.
+func readShadow(filename string) ([]byte, error) {
+	shadow, err := ioutil.ReadFile(filename + ShadowSuffix)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read shadow copy")
+	} else if len(shadow) < len(shadowMagic)+blake2b.Size256 || !bytes.Equal(shadow[:len(shadowMagic)], shadowMagic) {
+		return nil, errors.New("shadow copy is malformed")
+	}
+	sum, archive := shadow[len(shadowMagic):][:blake2b.Size256], shadow[len(shadowMagic)+blake2b.Size256:]
+	if check := blake2b.Sum256(archive); !bytes.Equal(check[:], sum) {
+		return nil, errors.New("shadow copy is corrupted")
+	}
+	return archive, nil
+}
+
+// ReadMetaFileShadowed is like ReadMetaFile, but if the metafile exists and
+// cannot be read, it falls back to the metafile's shadow copy (see
+// WriteMetaFileShadowed), restores the metafile from it, and returns a
+// ShadowRecovery describing the event. If the metafile was read
+// successfully, the returned ShadowRecovery is nil.
+//
+// Note that if a previous WriteMetaFileShadowed was interrupted after
+// writing the metafile, the shadow copy may be one write older than the
+// metafile.
+func ReadMetaFileShadowed(filename string) (*MetaFile, *ShadowRecovery, error) {
+	m, err := ReadMetaFile(filename)
+	if err == nil {
+		return m, nil, nil
+	} else if err == ErrMetaFileEncrypted {
+		return nil, nil, err
+	} else if _, statErr := os.Stat(filename); os.IsNotExist(statErr) {
+		return nil, nil, err
+	}
+	archive, shadowErr := readShadow(filename)
+	if shadowErr != nil {
+		return nil, nil, errors.Wrapf(err, "metafile is unreadable, and so is its shadow copy (%v)", shadowErr)
+	}
+	m, shadowErr = decodeMetaArchive(bytes.NewReader(archive))
+	if shadowErr != nil {
+		return nil, nil, errors.Wrapf(err, "metafile is unreadable, and so is its shadow copy (%v)", shadowErr)
+	}
+	if err := writeFileAtomic(filename, archive); err != nil {
+		return nil, nil, errors.Wrap(err, "could not restore metafile from shadow copy")
+	}
+	return m, &ShadowRecovery{Filename: filename, Err: err}, nil
+}
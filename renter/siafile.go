@@ -0,0 +1,213 @@
+package renter
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/modules/renter/siafile"
+	"gitlab.com/NebulousLabs/writeaheadlog"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+// ExtSiaCipher is a critical MetaExtension indicating that the metafile was
+// imported from a siad .sia file, and that its sectors are encrypted using
+// siad's scheme rather than being derived from the MasterKey. It contains the
+// siad cipher type (8 bytes) followed by the siad master key. The Nonce of
+// each SectorSlice holds the siad chunk and piece indices from which the
+// sector's key is derived, encoded as little-endian uint64s.
+//
+// Metafiles with this extension are read-only; to upload new data, convert
+// the file with renterutil.ReencodeFile.
+const ExtSiaCipher MetaExtensionType = 6
+
+func init() {
+	supportedExtensions[ExtSiaCipher] = true
+}
+
+// siad's ReedSolomon erasure code that encodes each 64-byte segment
+// separately, which is the same scheme as the one used by this package.
+var siaECSubShards64 = modules.ErasureCoderType{0, 0, 0, 2}
+
+// SiaKey returns the siad key used to encrypt m's sectors, or nil if m was not
+// imported from siad.
+func (m *MetaFile) SiaKey() crypto.CipherKey {
+	data, ok := m.Extension(ExtSiaCipher)
+	if !ok || len(data) < len(crypto.CipherType{}) {
+		return nil
+	}
+	var ct crypto.CipherType
+	copy(ct[:], data)
+	key, err := crypto.NewSiaKey(ct, data[len(ct):])
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// decryptSlice decrypts data, which contains the segments of s, in place. If
+// siaKey is non-nil, the siad key for s is used instead of key and c.
+func decryptSlice(key *KeySeed, c Cipher, siaKey crypto.CipherKey, data []byte, s SectorSlice) {
+	if siaKey != nil {
+		chunkIndex := binary.LittleEndian.Uint64(s.Nonce[0:])
+		pieceIndex := binary.LittleEndian.Uint64(s.Nonce[8:])
+		// data is a multiple of the Threefish block size, so this cannot fail
+		siaKey.Derive(chunkIndex, pieceIndex).DecryptBytesInPlace(data, uint64(s.SegmentIndex))
+		return
+	}
+	c.XORKeyStream(key, data, s.Nonce[:], uint64(s.SegmentIndex))
+}
+
+// ImportSiaFile converts the siad .sia file at siaFilePath to a MetaFile,
+// allowing data uploaded by siad to be downloaded using the same hosts and
+// contracts. The imported MetaFile is read-only; see ExtSiaCipher.
+//
+// Only files whose sectors can be decrypted and decoded segment-by-segment
+// can be imported: the file must be encrypted with Threefish (siad's default)
+// or not at all, and must use siad's default erasure code unless its data is
+// simply replicated. siad may store a piece on several hosts, or different
+// chunks of the same piece on different hosts; for each piece, the host
+// storing the most chunks is chosen, and the chunks it does not store are
+// marked missing.
+func ImportSiaFile(siaFilePath string) (*MetaFile, error) {
+	sf, err := siafile.LoadSiaFile(siaFilePath, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load siafile")
+	}
+	ec := sf.ErasureCode()
+	if ec.Type() != siaECSubShards64 && ec.MinPieces() != 1 {
+		return nil, errors.New("unsupported erasure code")
+	}
+	key := sf.MasterKey()
+	if t := key.Type(); t != crypto.TypeThreefish && t != crypto.TypePlain {
+		return nil, errors.Errorf("unsupported cipher %v", t)
+	} else if sf.PieceSize() != renterhost.SectorSize {
+		return nil, errors.Errorf("unsupported piece size %v", sf.PieceSize())
+	}
+
+	// load pieces, counting how many chunks of each piece each host stores
+	numChunks := int(sf.NumChunks())
+	chunks := make([][][]siafile.Piece, numChunks)
+	counts := make([]map[hostdb.HostPublicKey]int, ec.NumPieces())
+	for i := range counts {
+		counts[i] = make(map[hostdb.HostPublicKey]int)
+	}
+	for chunk := range chunks {
+		if chunks[chunk], err = sf.Pieces(uint64(chunk)); err != nil {
+			return nil, errors.Wrap(err, "could not load siafile pieces")
+		}
+		for i, pieces := range chunks[chunk] {
+			for _, p := range pieces {
+				counts[i][hostdb.HostKeyFromSiaPublicKey(p.HostPubKey)]++
+			}
+		}
+	}
+
+	// assign a distinct host to each piece
+	hosts := make([]hostdb.HostPublicKey, ec.NumPieces())
+	used := make(map[hostdb.HostPublicKey]bool)
+	for i := range hosts {
+		candidates := make([]hostdb.HostPublicKey, 0, len(counts[i]))
+		for h := range counts[i] {
+			if !used[h] {
+				candidates = append(candidates, h)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, errors.Errorf("no host stores piece %v", i)
+		}
+		sort.Slice(candidates, func(j, k int) bool {
+			if counts[i][candidates[j]] != counts[i][candidates[k]] {
+				return counts[i][candidates[j]] > counts[i][candidates[k]]
+			}
+			return candidates[j].Less(candidates[k])
+		})
+		hosts[i] = candidates[0]
+		used[hosts[i]] = true
+	}
+
+	m := NewMetaFile(sf.Mode(), int64(sf.Size()), hosts, ec.MinPieces())
+	m.ModTime = sf.ModTime()
+	m.SetCipher(CipherXChaCha20Poly1305) // unused; see decryptSlice
+	ct := key.Type()
+	m.SetExtension(ExtSiaCipher, true, append(ct[:], key.Key()...))
+	for chunk, pieces := range chunks {
+		for i := range pieces {
+			for _, p := range pieces[i] {
+				if hostdb.HostKeyFromSiaPublicKey(p.HostPubKey) != hosts[i] {
+					continue
+				}
+				ss := SectorSlice{
+					MerkleRoot:   p.MerkleRoot,
+					SegmentIndex: 0,
+					NumSegments:  merkle.SegmentsPerSector,
+				}
+				binary.LittleEndian.PutUint64(ss.Nonce[0:], uint64(chunk))
+				binary.LittleEndian.PutUint64(ss.Nonce[8:], uint64(i))
+				m.setSlice(i, chunk, ss)
+				break
+			}
+		}
+	}
+	return m, nil
+}
+
+// ExportSiaFile writes m to siaFilePath as a siad .sia file, with the
+// specified siaPath. Only metafiles created by ImportSiaFile can be exported,
+// since siad cannot decrypt sectors encrypted by this package; likewise, any
+// slices that were not imported from siad cause ExportSiaFile to fail.
+func ExportSiaFile(m *MetaFile, siaPath, siaFilePath string) error {
+	key := m.SiaKey()
+	if key == nil {
+		return errors.New("metafile was not imported from siad")
+	}
+	sp, err := modules.NewSiaPath(siaPath)
+	if err != nil {
+		return errors.Wrap(err, "invalid siapath")
+	}
+	ec, err := siafile.NewRSSubCode(m.MinShards, len(m.Hosts)-m.MinShards, merkle.SegmentSize)
+	if err != nil {
+		return errors.Wrap(err, "could not create erasure code")
+	}
+
+	// siafile updates are applied via a WAL; use a temporary one
+	dir, err := ioutil.TempDir("", "siafile-export")
+	if err != nil {
+		return errors.Wrap(err, "could not create WAL directory")
+	}
+	defer os.RemoveAll(dir)
+	_, wal, err := writeaheadlog.New(filepath.Join(dir, "export.wal"))
+	if err != nil {
+		return errors.Wrap(err, "could not create WAL")
+	}
+	defer wal.Close()
+
+	sf, err := siafile.New(sp, siaFilePath, "", wal, ec, key, uint64(m.Filesize), m.Mode)
+	if err != nil {
+		return errors.Wrap(err, "could not create siafile")
+	}
+	for i, shard := range m.Shards {
+		for chunk, ss := range shard {
+			if ss == (SectorSlice{}) {
+				continue // missing
+			}
+			var nonce [24]byte
+			binary.LittleEndian.PutUint64(nonce[0:], uint64(chunk))
+			binary.LittleEndian.PutUint64(nonce[8:], uint64(i))
+			if ss.SegmentIndex != 0 || ss.NumSegments != merkle.SegmentsPerSector || ss.Nonce != nonce {
+				return errors.Errorf("chunk %v of shard %v was not imported from siad", chunk, i)
+			}
+			if err := sf.AddPiece(m.Hosts[i].SiaPublicKey(), uint64(chunk), uint64(i), ss.MerkleRoot); err != nil {
+				return errors.Wrap(err, "could not add piece to siafile")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package renter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/modules/renter/siafile"
+	"gitlab.com/NebulousLabs/writeaheadlog"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestSiaFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, wal, err := writeaheadlog.New(filepath.Join(dir, "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	hosts := make([]hostdb.HostPublicKey, 4)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(ed25519.NewKeyFromSeed(frand.Bytes(32)).PublicKey())
+	}
+
+	// upload a 2-of-3 file the way siad would
+	ec, _ := siafile.NewRSSubCode(2, 1, merkle.SegmentSize)
+	key := crypto.GenerateSiaKey(crypto.TypeThreefish)
+	sp, _ := modules.NewSiaPath("foo")
+	siaFilePath := filepath.Join(dir, "foo.sia")
+	data := frand.Bytes(renterhost.SectorSize*3 - 1000)
+	sf, err := siafile.New(sp, siaFilePath, "", wal, ec, key, uint64(len(data)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sectors := make(map[crypto.Hash][]byte)
+	chunkSize := renterhost.SectorSize * 2
+	for chunk := 0; chunk*chunkSize < len(data); chunk++ {
+		chunkData := make([]byte, chunkSize)
+		copy(chunkData, data[chunk*chunkSize:])
+		pieces, err := ec.Encode(chunkData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, piece := range pieces {
+			ct := key.Derive(uint64(chunk), uint64(i)).EncryptBytes(piece)
+			root := crypto.MerkleRoot(ct)
+			sectors[root] = ct
+			if err := sf.AddPiece(hosts[i].SiaPublicKey(), uint64(chunk), uint64(i), root); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// store a redundant copy of one piece on another host
+	pieces, _ := sf.Pieces(0)
+	if err := sf.AddPiece(hosts[3].SiaPublicKey(), 0, 0, pieces[0][0].MerkleRoot); err != nil {
+		t.Fatal(err)
+	}
+
+	// import the file
+	m, err := ImportSiaFile(siaFilePath)
+	if err != nil {
+		t.Fatal(err)
+	} else if m.MinShards != 2 || len(m.Hosts) != 3 || m.Filesize != int64(len(data)) {
+		t.Fatal("imported metafile has wrong parameters")
+	}
+	for i, h := range m.Hosts {
+		if h != hosts[i] {
+			t.Fatalf("expected shard %v to be stored on %v, got %v", i, hosts[i].ShortKey(), h.ShortKey())
+		}
+	}
+	if err := validateShards(m.Shards); err != nil {
+		t.Fatal(err)
+	}
+
+	// recover the file, omitting one shard
+	siaKey := m.SiaKey()
+	if siaKey == nil {
+		t.Fatal("expected imported metafile to have a siad key")
+	}
+	var buf bytes.Buffer
+	for chunk := range m.Shards[0] {
+		shards := make([][]byte, len(m.Hosts))
+		for i := range shards {
+			shards[i] = make([]byte, 0, renterhost.SectorSize)
+			if i == 1 {
+				continue
+			}
+			ss := m.Shards[i][chunk]
+			shards[i] = append(shards[i], sectors[ss.MerkleRoot]...)
+			decryptSlice(&m.MasterKey, m.Cipher(), siaKey, shards[i], ss)
+		}
+		n := chunkSize
+		if rem := len(data) - chunk*chunkSize; rem < n {
+			n = rem
+		}
+		if err := m.ErasureCode().Recover(&buf, shards, 0, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("recovered data does not match")
+	}
+
+	// decrypting part of a sector should work too
+	ss := m.Shards[0][0]
+	full := append([]byte(nil), sectors[ss.MerkleRoot]...)
+	decryptSlice(&m.MasterKey, m.Cipher(), siaKey, full, ss)
+	part := ss
+	part.SegmentIndex, part.NumSegments = 5, 2
+	segs := append([]byte(nil), sectors[ss.MerkleRoot][5*merkle.SegmentSize:7*merkle.SegmentSize]...)
+	decryptSlice(&m.MasterKey, m.Cipher(), siaKey, segs, part)
+	if !bytes.Equal(segs, full[5*merkle.SegmentSize:7*merkle.SegmentSize]) {
+		t.Fatal("partial decryption does not match")
+	}
+
+	// export the file and compare pieces
+	exportPath := filepath.Join(dir, "bar.sia")
+	if err := ExportSiaFile(m, "bar", exportPath); err != nil {
+		t.Fatal(err)
+	}
+	sf2, err := siafile.LoadSiaFile(exportPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if sf2.Size() != uint64(len(data)) || sf2.NumChunks() != uint64(len(m.Shards[0])) {
+		t.Fatal("exported siafile has wrong parameters")
+	}
+	for chunk := range m.Shards[0] {
+		pieces, err := sf2.Pieces(uint64(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, ps := range pieces {
+			if len(ps) != 1 || ps[0].MerkleRoot != m.Shards[i][chunk].MerkleRoot ||
+				hostdb.HostKeyFromSiaPublicKey(ps[0].HostPubKey) != m.Hosts[i] {
+				t.Fatalf("chunk %v, piece %v was not exported correctly", chunk, i)
+			}
+		}
+	}
+
+	// metafiles not imported from siad cannot be exported
+	if err := ExportSiaFile(NewMetaFile(0666, 0, hosts[:3], 2), "baz", filepath.Join(dir, "baz.sia")); err == nil {
+		t.Fatal("expected error when exporting native metafile")
+	}
+}
@@ -0,0 +1,109 @@
+package renter
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/us/ed25519"
+)
+
+// ExtSignature is a MetaExtension containing an Ed25519 signature of the
+// metafile, allowing consumers to verify that it has not been tampered with.
+// It contains the signer's public key followed by the signature of
+// SigHash.
+const ExtSignature MetaExtensionType = 8
+
+// ErrUnsigned is returned by VerifySignature when a metafile is not signed.
+var ErrUnsigned = errors.New("metafile is not signed")
+
+// SigHash returns the hash of m that is signed by Sign. It covers all of m's
+// metadata, shards, and extensions (other than ExtSignature), but not its
+// Version. The MasterKey is only covered if it is stored in the metafile; if
+// it is derived or wrapped, the extension from which it is recovered is
+// covered instead.
+func (m *MetaFile) SigHash() crypto.Hash {
+	h, _ := blake2b.New256(nil)
+	buf := make([]byte, 8)
+	writeUint64 := func(n uint64) {
+		binary.LittleEndian.PutUint64(buf, n)
+		h.Write(buf)
+	}
+	h.Write([]byte("lukechampine.com/us/renter/metasig"))
+	writeUint64(uint64(m.Filesize))
+	writeUint64(uint64(m.Mode))
+	writeUint64(uint64(m.ModTime.UnixNano()))
+	if !m.keyOmitted() {
+		h.Write(m.MasterKey[:])
+	} else {
+		h.Write(make([]byte, len(m.MasterKey)))
+	}
+	writeUint64(uint64(m.MinShards))
+	writeUint64(uint64(len(m.Hosts)))
+	for _, hostKey := range m.Hosts {
+		b, _ := hostKey.MarshalBinary()
+		h.Write(b)
+	}
+	writeUint64(uint64(len(m.Shards)))
+	encSlice := make([]byte, SectorSliceSize)
+	for _, shard := range m.Shards {
+		writeUint64(uint64(len(shard)))
+		for _, ss := range shard {
+			encodeSectorSlice(encSlice, ss)
+			h.Write(encSlice)
+		}
+	}
+	// extensions are covered in type order, so that reordering them does not
+	// invalidate the signature
+	exts := make([]MetaExtension, 0, len(m.Extensions))
+	for _, ext := range m.Extensions {
+		if ext.Type != ExtSignature {
+			exts = append(exts, ext)
+		}
+	}
+	sort.Slice(exts, func(i, j int) bool { return exts[i].Type < exts[j].Type })
+	writeUint64(uint64(len(exts)))
+	for _, ext := range exts {
+		writeUint64(uint64(ext.Type))
+		if ext.Critical {
+			writeUint64(1)
+		} else {
+			writeUint64(0)
+		}
+		writeUint64(uint64(len(ext.Data)))
+		h.Write(ext.Data)
+	}
+	var sum crypto.Hash
+	h.Sum(sum[:0])
+	return sum
+}
+
+// Sign signs m with key, typically the renter key of one of the renter's
+// contracts. Any subsequent modification of m invalidates the signature, so
+// Sign should be called immediately before m is written to disk or shared.
+func (m *MetaFile) Sign(key ed25519.PrivateKey) {
+	data := make([]byte, 0, ed25519.PublicKeySize+ed25519.SignatureSize)
+	data = append(data, key.PublicKey()...)
+	data = append(data, key.SignHash(m.SigHash())...)
+	m.SetExtension(ExtSignature, false, data)
+}
+
+// VerifySignature verifies m's signature, returning the public key of the
+// signer. It returns ErrUnsigned if m is not signed. Callers must check that
+// the returned key belongs to a trusted signer; a valid signature merely
+// proves that m has not been modified since it was signed by that key.
+func (m *MetaFile) VerifySignature() (ed25519.PublicKey, error) {
+	data, ok := m.Extension(ExtSignature)
+	if !ok {
+		return nil, ErrUnsigned
+	} else if len(data) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, errors.New("signature has wrong length")
+	}
+	pub := ed25519.PublicKey(data[:ed25519.PublicKeySize])
+	if !pub.VerifyHash(m.SigHash(), data[ed25519.PublicKeySize:]) {
+		return nil, errors.New("invalid signature")
+	}
+	return pub, nil
+}
@@ -0,0 +1,16 @@
+// +build !windows
+
+package renter
+
+import "os"
+
+// syncDir syncs the directory at path, ensuring that any renames within it
+// are durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,7 @@
+package renter
+
+// syncDir is a no-op on Windows, where directories cannot be synced; NTFS
+// journals metadata changes such as renames.
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package renter
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+// ExtRedundancyTiers is a critical MetaExtension assigning greater redundancy
+// to specific byte ranges of the file. It contains a sequence of tiers, each
+// encoded as a little-endian offset (8 bytes), length (8 bytes), and
+// MinShards (4 bytes). Chunks beginning within a tier are erasure-coded
+// with the tier's MinShards rather than the file's; bytes outside of any tier
+// use the file's MinShards as usual.
+//
+// Every chunk is still stored on all of the file's hosts, so a tier may only
+// lower MinShards (i.e. raise redundancy). Since chunks are never padded
+// except at the end of the file, each tier, and each gap between tiers, must
+// either extend to the end of the file or contain a whole number of
+// segments' worth of data for its MinShards.
+const ExtRedundancyTiers MetaExtensionType = 9
+
+func init() {
+	supportedExtensions[ExtRedundancyTiers] = true
+}
+
+const redundancyTierSize = 8 + 8 + 4
+
+// A RedundancyTier assigns a MinShards value to a range of a file.
+type RedundancyTier struct {
+	Offset    int64
+	Length    int64
+	MinShards int
+}
+
+// RedundancyTiers returns m's redundancy tiers, sorted by offset. It returns
+// nil if m is uniformly encoded with m.MinShards.
+func (m *MetaFile) RedundancyTiers() []RedundancyTier {
+	data, _ := m.Extension(ExtRedundancyTiers)
+	tiers := make([]RedundancyTier, len(data)/redundancyTierSize)
+	for i := range tiers {
+		b := data[i*redundancyTierSize:]
+		tiers[i] = RedundancyTier{
+			Offset:    int64(binary.LittleEndian.Uint64(b[0:])),
+			Length:    int64(binary.LittleEndian.Uint64(b[8:])),
+			MinShards: int(binary.LittleEndian.Uint32(b[16:])),
+		}
+	}
+	if len(tiers) == 0 {
+		return nil
+	}
+	return tiers
+}
+
+// SetRedundancyTiers sets m's redundancy tiers. If tiers is empty, the
+// extension is removed. It returns an error if the tiers overlap, lower m's
+// redundancy, or do not fall on chunk boundaries; see ExtRedundancyTiers.
+//
+// SetRedundancyTiers only affects how data is subsequently uploaded, so it
+// should only be called before any chunks have been stored.
+func (m *MetaFile) SetRedundancyTiers(tiers []RedundancyTier) error {
+	if len(tiers) == 0 {
+		m.RemoveExtension(ExtRedundancyTiers)
+		return nil
+	}
+	tiers = append([]RedundancyTier(nil), tiers...)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Offset < tiers[j].Offset })
+	if err := validateTiers(tiers, m.MinShards, m.Filesize); err != nil {
+		return err
+	}
+	data := make([]byte, len(tiers)*redundancyTierSize)
+	for i, t := range tiers {
+		b := data[i*redundancyTierSize:]
+		binary.LittleEndian.PutUint64(b[0:], uint64(t.Offset))
+		binary.LittleEndian.PutUint64(b[8:], uint64(t.Length))
+		binary.LittleEndian.PutUint32(b[16:], uint32(t.MinShards))
+	}
+	m.SetExtension(ExtRedundancyTiers, true, data)
+	return nil
+}
+
+// validateTiers checks that the (sorted) tiers form a valid layout for a file
+// of the specified size and MinShards.
+func validateTiers(tiers []RedundancyTier, minShards int, filesize int64) error {
+	// each region (tier or gap) must end on a segment boundary for its
+	// MinShards, unless it extends to the end of the file
+	checkRegion := func(start, end int64, k int) error {
+		if end < filesize && (end-start)%(merkle.SegmentSize*int64(k)) != 0 {
+			return errors.Errorf("range [%v, %v) is not a multiple of %v bytes", start, end, merkle.SegmentSize*k)
+		}
+		return nil
+	}
+	var prevEnd int64
+	for _, t := range tiers {
+		if t.Offset < 0 || t.Length <= 0 {
+			return errors.Errorf("invalid tier range [%v, %v)", t.Offset, t.Offset+t.Length)
+		} else if t.MinShards <= 0 || t.MinShards > minShards {
+			return errors.Errorf("tier MinShards must be between 1 and %v, got %v", minShards, t.MinShards)
+		} else if t.Offset < prevEnd {
+			return errors.Errorf("tier at offset %v overlaps previous tier", t.Offset)
+		}
+		if t.Offset > prevEnd {
+			if err := checkRegion(prevEnd, t.Offset, minShards); err != nil {
+				return err
+			}
+		}
+		if err := checkRegion(t.Offset, t.Offset+t.Length, t.MinShards); err != nil {
+			return err
+		}
+		prevEnd = t.Offset + t.Length
+	}
+	return nil
+}
+
+// tierAt returns the MinShards of the region containing off, along with the
+// offset at which that region ends (or -1 if it extends to the end of the
+// file).
+func (m *MetaFile) tierAt(tiers []RedundancyTier, off int64) (minShards int, end int64) {
+	for _, t := range tiers {
+		if off < t.Offset {
+			return m.MinShards, t.Offset
+		} else if off < t.Offset+t.Length {
+			return t.MinShards, t.Offset + t.Length
+		}
+	}
+	return m.MinShards, -1
+}
+
+// NextChunk returns the MinShards and maximum size of a chunk beginning at
+// off, such that the chunk does not straddle a tier boundary. Uploaders of
+// tiered files should split their data accordingly.
+func (m *MetaFile) NextChunk(off int64) (minShards int, size int64) {
+	minShards, end := m.tierAt(m.RedundancyTiers(), off)
+	size = renterhost.SectorSize * int64(minShards)
+	if end != -1 && end-off < size {
+		size = end - off
+	}
+	return minShards, size
+}
+
+// ChunkLayout returns the ChunkBoundaries of m, along with the MinShards used
+// to encode each chunk.
+func (m *MetaFile) ChunkLayout() (bounds []int64, minShards []int) {
+	var numChunks int
+	for _, shard := range m.Shards {
+		if len(shard) > numChunks {
+			numChunks = len(shard)
+		}
+	}
+	tiers := m.RedundancyTiers()
+	bounds = make([]int64, numChunks+1)
+	minShards = make([]int, numChunks)
+	for i := 0; i < numChunks; i++ {
+		var numSegments uint32
+		for _, shard := range m.Shards {
+			if i < len(shard) && shard[i].NumSegments > numSegments {
+				numSegments = shard[i].NumSegments
+			}
+		}
+		minShards[i], _ = m.tierAt(tiers, bounds[i])
+		bounds[i+1] = bounds[i] + int64(numSegments)*merkle.SegmentSize*int64(minShards[i])
+	}
+	return bounds, minShards
+}
+
+// ChunkErasureCode returns the ErasureCoder for a chunk encoded with the
+// specified MinShards, as returned by ChunkLayout.
+func (m *MetaFile) ChunkErasureCode(minShards int) ErasureCoder {
+	if minShards == m.MinShards {
+		return m.ErasureCode()
+	}
+	return NewRSCode(minShards, len(m.Hosts))
+}
@@ -0,0 +1,76 @@
+package renter
+
+import (
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"lukechampine.com/us/merkle"
+)
+
+// Truncate shrinks m to the specified size without re-uploading any data.
+// Chunks that lie entirely beyond size are removed, and the final chunk is
+// trimmed to the fewest segments that cover size; the removed sector data is
+// recorded as garbage (see ExtGarbage), so that it can later be deleted from
+// hosts. Truncate returns an error if size exceeds m.Filesize.
+func (m *MetaFile) Truncate(size int64) error {
+	if size < 0 || size > m.Filesize {
+		return errors.Errorf("cannot truncate %v-byte file to %v bytes", m.Filesize, size)
+	} else if size == m.Filesize {
+		return nil
+	}
+	if m.IsInline() {
+		m.Filesize = size
+		data, err := m.InlineData()
+		if err != nil {
+			return err
+		}
+		return m.SetInlineData(data)
+	}
+
+	bounds, minShards := m.ChunkLayout()
+	numChunks := len(minShards)
+	for i := range minShards {
+		if bounds[i+1] >= size {
+			numChunks = i + 1
+			break
+		}
+	}
+	if size == 0 {
+		numChunks = 0
+	}
+	for i, shard := range m.Shards {
+		if len(shard) > numChunks {
+			for _, ss := range shard[numChunks:] {
+				m.AddGarbage(GarbageSlice{Host: m.Hosts[i], Slice: ss})
+			}
+			shard = shard[:numChunks]
+		}
+		if numChunks > 0 && len(shard) == numChunks {
+			// trim the final chunk
+			last := numChunks - 1
+			chunkSegmentSize := merkle.SegmentSize * int64(minShards[last])
+			numSegments := uint32((size - bounds[last] + chunkSegmentSize - 1) / chunkSegmentSize)
+			if ss := shard[last]; ss.NumSegments > numSegments {
+				m.AddGarbage(GarbageSlice{Host: m.Hosts[i], Slice: SectorSlice{
+					MerkleRoot:   ss.MerkleRoot,
+					SegmentIndex: ss.SegmentIndex + numSegments,
+					NumSegments:  ss.NumSegments - numSegments,
+					Nonce:        ss.Nonce,
+				}})
+				shard[last].NumSegments = numSegments
+			}
+		}
+		m.Shards[i] = shard
+	}
+	// the final chunk may have been trimmed, so it can no longer be verified
+	if hashes := m.ChunkHashes(); len(hashes) > 0 {
+		if len(hashes) > numChunks {
+			hashes = hashes[:numChunks]
+		}
+		if len(hashes) > 0 {
+			hashes[len(hashes)-1] = crypto.Hash{}
+		}
+		m.SetChunkHashes(hashes)
+	}
+	m.Filesize = size
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/types"
+	"golang.org/x/crypto/blake2b"
 	"lukechampine.com/frand"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
@@ -19,6 +20,7 @@ type SectorBuilder struct {
 	sector    [renterhost.SectorSize]byte
 	sectorLen int
 	slices    []SectorSlice
+	random    bool // whether any slice was appended with a random nonce
 }
 
 // Reset resets the SectorBuilder to its initial state.
@@ -28,6 +30,7 @@ type SectorBuilder struct {
 func (sb *SectorBuilder) Reset() {
 	sb.sectorLen = 0
 	sb.slices = nil // can't reuse capacity; Slices shares memory
+	sb.random = false
 }
 
 // SliceForAppend returns a slice into the unused capacity of the sector. This
@@ -37,13 +40,34 @@ func (sb *SectorBuilder) SliceForAppend() []byte {
 }
 
 // Append appends data to the sector being constructed, encrypting it with the
-// given key and chunkIndex. The data must be a multiple of merkle.SegmentSize.
+// given key and cipher. The data must be a multiple of merkle.SegmentSize.
 //
 // Each call to Append creates a SectorSlice that is accessible via the Slices
 // method, using the index returned by Append.
 //
 // Append panics if len(data) > sb.Remaining().
-func (sb *SectorBuilder) Append(data []byte, key KeySeed) int {
+func (sb *SectorBuilder) Append(data []byte, key KeySeed, c Cipher) int {
+	var nonce [24]byte
+	frand.Read(nonce[:])
+	sb.random = true
+	return sb.append(data, key, c, nonce)
+}
+
+// AppendConvergent is like Append, but derives the encryption nonce from key
+// and data rather than generating it randomly. Consequently, appending the
+// same data with the same key to an empty sector always produces the same
+// sector, allowing identical sectors to be deduplicated (see DedupIndex).
+// This reveals to anyone holding the same data and key that the data is
+// stored, so it should only be used when deduplication is desired.
+func (sb *SectorBuilder) AppendConvergent(data []byte, key KeySeed, c Cipher) int {
+	h, _ := blake2b.New(24, key[:])
+	h.Write(data)
+	var nonce [24]byte
+	copy(nonce[:], h.Sum(nil))
+	return sb.append(data, key, c, nonce)
+}
+
+func (sb *SectorBuilder) append(data []byte, key KeySeed, c Cipher, nonce [24]byte) int {
 	if len(data)%merkle.SegmentSize != 0 {
 		// NOTE: instead of panicking, we could silently pad the data; however,
 		// this is very dangerous, because the SectorSlice will not record the
@@ -63,9 +87,7 @@ func (sb *SectorBuilder) Append(data []byte, key KeySeed) int {
 
 	// encrypt the data in place
 	segmentIndex := sb.sectorLen / merkle.SegmentSize
-	var nonce [24]byte
-	frand.Read(nonce[:])
-	key.XORKeyStream(sectorSlice, nonce[:], uint64(segmentIndex))
+	c.XORKeyStream(&key, sectorSlice, nonce[:], uint64(segmentIndex))
 
 	// record the new slice and update sectorLen
 	sb.slices = append(sb.slices, SectorSlice{
@@ -89,7 +111,9 @@ func (sb *SectorBuilder) Remaining() int {
 }
 
 // Finish fills the remaining capacity of the sector with random bytes and
-// returns it.
+// returns it. If all of the sector's slices were appended with
+// AppendConvergent, the remaining capacity is instead filled with zeros, so
+// that the sector is deterministic.
 //
 // After calling Finish, Len returns renterhost.SectorSize and Remaining
 // returns 0; no more data can be appended until Reset is called.
@@ -98,7 +122,14 @@ func (sb *SectorBuilder) Remaining() int {
 // regarding such pointers apply. In particular, the pointer should not be
 // retained after Reset is called.
 func (sb *SectorBuilder) Finish() *[renterhost.SectorSize]byte {
-	frand.Read(sb.sector[sb.sectorLen:])
+	if sb.random || len(sb.slices) == 0 {
+		frand.Read(sb.sector[sb.sectorLen:])
+	} else {
+		rem := sb.sector[sb.sectorLen:]
+		for i := range rem {
+			rem[i] = 0
+		}
+	}
 	sb.sectorLen = len(sb.sector)
 	return &sb.sector
 }
@@ -120,22 +151,58 @@ func (sb *SectorBuilder) Slices() []SectorSlice {
 // A ShardUploader wraps a proto.Session to provide SectorSlice-based data
 // storage, transparently encrypting and checksumming all data before
 // transferring it to the host.
+//
+// If Dedup is non-nil, EncryptAndUpload encrypts data convergently, and skips
+// uploading any sector that the host is already storing according to Dedup.
+//
+// If Checkpoint is non-nil, the ShardUploader records its progress in the
+// metafile passed to NewShardUploader: before each sector is uploaded, its
+// slices are marked pending (see MetaFile.MarkPending), and once the upload
+// succeeds, they are marked confirmed. Checkpoint is called with the metafile
+// after each of these steps, and should typically write it to disk. If the
+// upload is interrupted, it can then be resumed by calling ResolvePending and
+// uploading the chunks reported by MetaFile.MissingChunks.
 type ShardUploader struct {
-	Uploader *proto.Session
-	Shard    *[]SectorSlice
-	Key      KeySeed
-	Sector   SectorBuilder
+	Uploader   *proto.Session
+	Shard      *[]SectorSlice
+	Key        KeySeed
+	Cipher     Cipher
+	Sector     SectorBuilder
+	Dedup      *DedupIndex
+	Checkpoint func(*MetaFile) error
+
+	meta       *MetaFile
+	shardIndex int
 }
 
 // Upload uploads u.Sector, writing the resulting SectorSlice(s) to u.Shard,
 // starting at offset chunkIndex. Upload does not call Reset on u.Sector.
 func (u *ShardUploader) Upload(chunkIndex int64) error {
-	err := u.Uploader.Write([]renterhost.RPCWriteAction{{
-		Type: renterhost.RPCWriteActionAppend,
-		Data: u.Sector.Finish()[:],
-	}})
-	if err != nil {
-		return err
+	sector := u.Sector.Finish()
+	root := merkle.SectorRoot(sector)
+	u.Sector.SetMerkleRoot(root)
+	checkpoint := u.Checkpoint != nil && u.meta != nil
+	if checkpoint {
+		for i, ss := range u.Sector.Slices() {
+			u.meta.MarkPending(u.shardIndex, int(chunkIndex)+i, ss)
+		}
+		if err := u.Checkpoint(u.meta); err != nil {
+			return errors.Wrap(err, "could not checkpoint upload")
+		}
+	}
+	if u.Dedup == nil || !u.Dedup.Has(u.HostKey(), root) {
+		err := u.Uploader.Write([]renterhost.RPCWriteAction{{
+			Type: renterhost.RPCWriteActionAppend,
+			Data: sector[:],
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	if u.Dedup != nil {
+		if err := u.Dedup.AddRef(u.HostKey(), root); err != nil {
+			return err
+		}
 	}
 	for i, ss := range u.Sector.Slices() {
 		sliceIndex := int(chunkIndex) + i
@@ -144,6 +211,32 @@ func (u *ShardUploader) Upload(chunkIndex int64) error {
 		}
 		(*u.Shard)[sliceIndex] = ss
 	}
+	if checkpoint {
+		for i := range u.Sector.Slices() {
+			u.meta.MarkConfirmed(u.shardIndex, int(chunkIndex)+i)
+		}
+		if err := u.Checkpoint(u.meta); err != nil {
+			return errors.Wrap(err, "could not checkpoint upload")
+		}
+	}
+	return nil
+}
+
+// ResolvePending resolves any pending chunks left by an interrupted upload,
+// by checking whether the host is storing their sectors. See
+// MetaFile.ResolvePending.
+func (u *ShardUploader) ResolvePending() error {
+	if u.meta == nil || len(u.meta.PendingChunks(u.shardIndex)) == 0 {
+		return nil
+	}
+	roots, err := u.Uploader.SectorRoots(0, u.Uploader.Revision().NumSectors())
+	if err != nil {
+		return errors.Wrap(err, "could not fetch sector roots")
+	}
+	u.meta.ResolvePending(u.shardIndex, roots)
+	if u.Checkpoint != nil {
+		return u.Checkpoint(u.meta)
+	}
 	return nil
 }
 
@@ -155,7 +248,11 @@ func (u *ShardUploader) EncryptAndUpload(data []byte, chunkIndex int64) (SectorS
 		return SectorSlice{}, errors.New("data exceeds sector size")
 	}
 	u.Sector.Reset()
-	u.Sector.Append(data, u.Key)
+	if u.Dedup != nil {
+		u.Sector.AppendConvergent(data, u.Key, u.Cipher)
+	} else {
+		u.Sector.Append(data, u.Key, u.Cipher)
+	}
 	if err := u.Upload(chunkIndex); err != nil {
 		return SectorSlice{}, err
 	}
@@ -181,6 +278,9 @@ func (u *ShardUploader) Close() error {
 // uploading m's data and writing to one of m's Shard files.
 func NewShardUploader(m *MetaFile, c Contract, hkr HostKeyResolver, currentHeight types.BlockHeight) (*ShardUploader, error) {
 	hostKey := c.HostKey
+	if _, ok := m.Extension(ExtSiaCipher); ok {
+		return nil, errors.New("cannot upload to a metafile imported from siad")
+	}
 	// get host IP
 	hostIP, err := hkr.ResolveHostKey(c.HostKey)
 	if err != nil {
@@ -192,8 +292,11 @@ func NewShardUploader(m *MetaFile, c Contract, hkr HostKeyResolver, currentHeigh
 		return nil, errors.Wrapf(err, "%v: could not initiate upload protocol with host", hostKey.ShortKey())
 	}
 	return &ShardUploader{
-		Uploader: u,
-		Shard:    &m.Shards[m.HostIndex(hostKey)],
-		Key:      m.MasterKey,
+		Uploader:   u,
+		Shard:      &m.Shards[m.HostIndex(hostKey)],
+		Key:        m.MasterKey,
+		Cipher:     m.Cipher(),
+		meta:       m,
+		shardIndex: m.HostIndex(hostKey),
 	}, nil
 }
@@ -0,0 +1,186 @@
+package renter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+)
+
+// ContractStats summarizes the observed behavior of a contract's host.
+type ContractStats struct {
+	RPCSuccesses   int
+	RPCFailures    int
+	SlowTransfers  int
+	PriceIncreases int
+	Desyncs        int
+	LastFailure    time.Time
+}
+
+// FailureRate returns the fraction of recorded RPCs that failed.
+func (cs ContractStats) FailureRate() float64 {
+	total := cs.RPCSuccesses + cs.RPCFailures
+	if total == 0 {
+		return 0
+	}
+	return float64(cs.RPCFailures) / float64(total)
+}
+
+// A UtilityPolicy defines the thresholds used to evaluate a contract's
+// utility.
+type UtilityPolicy struct {
+	// MinRPCs is the number of RPCs that must be recorded before
+	// MaxFailureRate is enforced.
+	MinRPCs        int
+	MaxFailureRate float64
+	// MinThroughput is the transfer rate, in bytes per second, below which a
+	// transfer is considered slow.
+	MinThroughput     float64
+	MaxSlowTransfers  int
+	MaxPriceIncreases int
+	MaxDesyncs        int
+}
+
+// DefaultUtilityPolicy is a reasonable UtilityPolicy for most renters.
+var DefaultUtilityPolicy = UtilityPolicy{
+	MinRPCs:           10,
+	MaxFailureRate:    0.25,
+	MinThroughput:     100e3, // 100 KB/s
+	MaxSlowTransfers:  5,
+	MaxPriceIncreases: 3,
+	MaxDesyncs:        0,
+}
+
+// A ContractUtility indicates whether a contract should be used for new
+// uploads, and whether it should be renewed. If either is false, Reasons
+// explains why.
+type ContractUtility struct {
+	GoodForUpload bool
+	GoodForRenew  bool
+	Reasons       []string
+}
+
+// Evaluate returns the utility of a contract with the specified stats.
+//
+// A contract whose host has lost state or raised its prices too often is not
+// worth renewing, and hence not worth uploading to either. A contract whose
+// host is unreliable or slow is still renewed, since its existing data remains
+// useful, but should not receive new uploads.
+func (p UtilityPolicy) Evaluate(cs ContractStats) ContractUtility {
+	u := ContractUtility{
+		GoodForUpload: true,
+		GoodForRenew:  true,
+	}
+	if cs.Desyncs > p.MaxDesyncs {
+		u.GoodForRenew = false
+		u.Reasons = append(u.Reasons, fmt.Sprintf("host desynced %v times (max %v)", cs.Desyncs, p.MaxDesyncs))
+	}
+	if cs.PriceIncreases > p.MaxPriceIncreases {
+		u.GoodForRenew = false
+		u.Reasons = append(u.Reasons, fmt.Sprintf("host raised prices %v times (max %v)", cs.PriceIncreases, p.MaxPriceIncreases))
+	}
+	if cs.RPCSuccesses+cs.RPCFailures >= p.MinRPCs && cs.FailureRate() > p.MaxFailureRate {
+		u.GoodForUpload = false
+		u.Reasons = append(u.Reasons, fmt.Sprintf("RPC failure rate is %.2f (max %.2f)", cs.FailureRate(), p.MaxFailureRate))
+	}
+	if cs.SlowTransfers > p.MaxSlowTransfers {
+		u.GoodForUpload = false
+		u.Reasons = append(u.Reasons, fmt.Sprintf("host was slow %v times (max %v)", cs.SlowTransfers, p.MaxSlowTransfers))
+	}
+	u.GoodForUpload = u.GoodForUpload && u.GoodForRenew
+	return u
+}
+
+// A UtilityTracker aggregates observations of contracts' hosts, allowing
+// higher layers to choose which contracts to upload to and renew. It is safe
+// for concurrent use.
+type UtilityTracker struct {
+	policy UtilityPolicy
+	mu     sync.Mutex
+	stats  map[types.FileContractID]ContractStats
+}
+
+func (ut *UtilityTracker) update(id types.FileContractID, fn func(*ContractStats)) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	cs := ut.stats[id]
+	fn(&cs)
+	ut.stats[id] = cs
+}
+
+// RecordRPC records the outcome of an RPC.
+func (ut *UtilityTracker) RecordRPC(id types.FileContractID, err error) {
+	ut.update(id, func(cs *ContractStats) {
+		if err != nil {
+			cs.RPCFailures++
+			cs.LastFailure = time.Now()
+		} else {
+			cs.RPCSuccesses++
+		}
+	})
+}
+
+// RecordTransfer records the transfer of n bytes over duration d.
+func (ut *UtilityTracker) RecordTransfer(id types.FileContractID, n int64, d time.Duration) {
+	if d <= 0 || float64(n)/d.Seconds() >= ut.policy.MinThroughput {
+		return
+	}
+	ut.update(id, func(cs *ContractStats) {
+		cs.SlowTransfers++
+	})
+}
+
+// RecordSettings records a change in the host's settings. If any of the
+// host's prices increased, a price increase is recorded.
+func (ut *UtilityTracker) RecordSettings(id types.FileContractID, old, new hostdb.HostSettings) {
+	increased := func(o, n types.Currency) bool { return n.Cmp(o) > 0 }
+	if increased(old.BaseRPCPrice, new.BaseRPCPrice) ||
+		increased(old.ContractPrice, new.ContractPrice) ||
+		increased(old.DownloadBandwidthPrice, new.DownloadBandwidthPrice) ||
+		increased(old.SectorAccessPrice, new.SectorAccessPrice) ||
+		increased(old.StoragePrice, new.StoragePrice) ||
+		increased(old.UploadBandwidthPrice, new.UploadBandwidthPrice) {
+		ut.update(id, func(cs *ContractStats) {
+			cs.PriceIncreases++
+		})
+	}
+}
+
+// RecordDesync records that the host's revision of the contract diverged from
+// the renter's.
+func (ut *UtilityTracker) RecordDesync(id types.FileContractID) {
+	ut.update(id, func(cs *ContractStats) {
+		cs.Desyncs++
+	})
+}
+
+// Stats returns the aggregated observations of the specified contract.
+func (ut *UtilityTracker) Stats(id types.FileContractID) ContractStats {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	return ut.stats[id]
+}
+
+// Utility evaluates the utility of the specified contract.
+func (ut *UtilityTracker) Utility(id types.FileContractID) ContractUtility {
+	return ut.policy.Evaluate(ut.Stats(id))
+}
+
+// Reset discards all observations of the specified contract, e.g. after it has
+// been renewed.
+func (ut *UtilityTracker) Reset(id types.FileContractID) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	delete(ut.stats, id)
+}
+
+// NewUtilityTracker returns a UtilityTracker that evaluates contracts using
+// the provided policy.
+func NewUtilityTracker(policy UtilityPolicy) *UtilityTracker {
+	return &UtilityTracker{
+		policy: policy,
+		stats:  make(map[types.FileContractID]ContractStats),
+	}
+}
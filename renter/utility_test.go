@@ -0,0 +1,69 @@
+package renter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+)
+
+func TestUtilityTracker(t *testing.T) {
+	policy := UtilityPolicy{
+		MinRPCs:           4,
+		MaxFailureRate:    0.5,
+		MinThroughput:     1000,
+		MaxSlowTransfers:  1,
+		MaxPriceIncreases: 1,
+		MaxDesyncs:        0,
+	}
+	ut := NewUtilityTracker(policy)
+	var id types.FileContractID
+	isGood := func(upload, renew bool) {
+		t.Helper()
+		u := ut.Utility(id)
+		if u.GoodForUpload != upload || u.GoodForRenew != renew {
+			t.Fatalf("expected utility (%v, %v), got (%v, %v): %v", upload, renew, u.GoodForUpload, u.GoodForRenew, u.Reasons)
+		}
+	}
+	isGood(true, true)
+
+	// failures should not count until MinRPCs is reached
+	for i := 0; i < 3; i++ {
+		ut.RecordRPC(id, errors.New("failed"))
+	}
+	isGood(true, true)
+	ut.RecordRPC(id, nil)
+	isGood(false, true)
+	for i := 0; i < 2; i++ {
+		ut.RecordRPC(id, nil)
+	}
+	isGood(true, true)
+
+	// slow transfers
+	ut.RecordTransfer(id, 1e6, time.Second)
+	ut.RecordTransfer(id, 1, time.Second)
+	isGood(true, true)
+	ut.RecordTransfer(id, 1, time.Second)
+	isGood(false, true)
+	if cs := ut.Stats(id); cs.SlowTransfers != 2 {
+		t.Fatal("wrong number of slow transfers:", cs.SlowTransfers)
+	}
+
+	// price increases
+	ut.Reset(id)
+	old := hostdb.HostSettings{StoragePrice: types.NewCurrency64(10)}
+	cheaper := hostdb.HostSettings{StoragePrice: types.NewCurrency64(5)}
+	pricier := hostdb.HostSettings{StoragePrice: types.NewCurrency64(20)}
+	ut.RecordSettings(id, old, cheaper)
+	ut.RecordSettings(id, old, pricier)
+	isGood(true, true)
+	ut.RecordSettings(id, old, pricier)
+	isGood(false, false)
+
+	// desyncs
+	ut.Reset(id)
+	ut.RecordDesync(id)
+	isGood(false, false)
+}
@@ -0,0 +1,68 @@
+package renterhost
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Message compression flags. When compression is enabled, the first byte of
+// each message indicates whether the remainder is compressed.
+const (
+	compressionNone    = 0
+	compressionDeflate = 1
+)
+
+// maxCompressSize is the size of the largest object that will be compressed.
+// Larger objects are typically sector data, which (being encrypted) does not
+// compress.
+const maxCompressSize = 1 << 20
+
+// Compressed reports whether the Session compresses RPC messages.
+func (s *Session) Compressed() bool {
+	return s.compress
+}
+
+// compressObject returns the compressed encoding of obj, or nil if obj is not
+// worth compressing. The returned slice is only valid until the next call.
+func (s *Session) compressObject(obj ProtocolObject) []byte {
+	size := obj.marshalledSize()
+	if size > maxCompressSize {
+		return nil
+	}
+	s.zbuf.reset()
+	s.zbuf.grow(size)
+	obj.marshalBuffer(&s.zbuf)
+	s.zout.Reset()
+	if s.zw == nil {
+		s.zw, _ = flate.NewWriter(&s.zout, flate.BestSpeed) // no error possible
+	} else {
+		s.zw.Reset(&s.zout)
+	}
+	s.zw.Write(s.zbuf.bytes())
+	s.zw.Close()
+	if s.zout.Len() >= size {
+		return nil
+	}
+	return s.zout.Bytes()
+}
+
+// decompressObject decompresses the remainder of s.inbuf into obj.
+func (s *Session) decompressObject(obj ProtocolObject, maxLen uint64) error {
+	r := bytes.NewReader(s.inbuf.bytes())
+	if s.zr == nil {
+		s.zr = flate.NewReader(r)
+	} else {
+		s.zr.(flate.Resetter).Reset(r, nil)
+	}
+	s.zbuf.reset()
+	n, err := s.zbuf.buf.ReadFrom(io.LimitReader(s.zr, int64(maxLen)+1))
+	if err != nil {
+		return errors.Wrap(err, "could not decompress message")
+	} else if uint64(n) > maxLen {
+		return errors.Errorf("decompressed message exceeds maxLen of %v bytes", maxLen)
+	}
+	return obj.unmarshalBuffer(&s.zbuf)
+}
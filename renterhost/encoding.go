@@ -642,6 +642,158 @@ func (r *RPCWriteResponse) unmarshalBuffer(b *objBuffer) error {
 	return b.Err()
 }
 
+// RPCFundAccount
+
+func (r *RPCFundAccountRequest) marshalledSize() int {
+	validSize := 8
+	for i := range r.NewValidProofValues {
+		validSize += (*objCurrency)(&r.NewValidProofValues[i]).marshalledSize()
+	}
+	missedSize := 8
+	for i := range r.NewMissedProofValues {
+		missedSize += (*objCurrency)(&r.NewMissedProofValues[i]).marshalledSize()
+	}
+	return len(r.Account) + 8 + validSize + missedSize + 8 + len(r.Signature)
+}
+
+func (r *RPCFundAccountRequest) marshalBuffer(b *objBuffer) {
+	b.write(r.Account[:])
+	b.writeUint64(r.NewRevisionNumber)
+	b.writePrefix(len(r.NewValidProofValues))
+	for i := range r.NewValidProofValues {
+		(*objCurrency)(&r.NewValidProofValues[i]).marshalBuffer(b)
+	}
+	b.writePrefix(len(r.NewMissedProofValues))
+	for i := range r.NewMissedProofValues {
+		(*objCurrency)(&r.NewMissedProofValues[i]).marshalBuffer(b)
+	}
+	b.writePrefixedBytes(r.Signature)
+}
+
+func (r *RPCFundAccountRequest) unmarshalBuffer(b *objBuffer) error {
+	b.read(r.Account[:])
+	r.NewRevisionNumber = b.readUint64()
+	r.NewValidProofValues = make([]types.Currency, b.readPrefix(sizeofCurrency))
+	for i := range r.NewValidProofValues {
+		(*objCurrency)(&r.NewValidProofValues[i]).unmarshalBuffer(b)
+	}
+	r.NewMissedProofValues = make([]types.Currency, b.readPrefix(sizeofCurrency))
+	for i := range r.NewMissedProofValues {
+		(*objCurrency)(&r.NewMissedProofValues[i]).unmarshalBuffer(b)
+	}
+	r.Signature = b.readPrefixedBytes()
+	return b.Err()
+}
+
+func (r *RPCFundAccountResponse) marshalledSize() int {
+	return (*objCurrency)(&r.Balance).marshalledSize() + 8 + len(r.Signature)
+}
+
+func (r *RPCFundAccountResponse) marshalBuffer(b *objBuffer) {
+	(*objCurrency)(&r.Balance).marshalBuffer(b)
+	b.writePrefixedBytes(r.Signature)
+}
+
+func (r *RPCFundAccountResponse) unmarshalBuffer(b *objBuffer) error {
+	(*objCurrency)(&r.Balance).unmarshalBuffer(b)
+	r.Signature = b.readPrefixedBytes()
+	return b.Err()
+}
+
+// RPCRevalidateSettings
+
+func (r *RPCRevalidateSettingsRequest) marshalledSize() int {
+	return 8
+}
+
+func (r *RPCRevalidateSettingsRequest) marshalBuffer(b *objBuffer) {
+	b.writeUint64(r.RevisionNumber)
+}
+
+func (r *RPCRevalidateSettingsRequest) unmarshalBuffer(b *objBuffer) error {
+	r.RevisionNumber = b.readUint64()
+	return b.Err()
+}
+
+func (r *RPCRevalidateSettingsResponse) marshalledSize() int {
+	return 1 + 8 + len(r.Settings)
+}
+
+func (r *RPCRevalidateSettingsResponse) marshalBuffer(b *objBuffer) {
+	b.writeBool(r.Unchanged)
+	b.writePrefixedBytes(r.Settings)
+}
+
+func (r *RPCRevalidateSettingsResponse) unmarshalBuffer(b *objBuffer) error {
+	r.Unchanged = b.readBool()
+	r.Settings = b.readPrefixedBytes()
+	return b.Err()
+}
+
+// RPCAccountBalance
+
+func (r *RPCAccountBalanceRequest) marshalledSize() int {
+	return len(r.Account)
+}
+
+func (r *RPCAccountBalanceRequest) marshalBuffer(b *objBuffer) {
+	b.write(r.Account[:])
+}
+
+func (r *RPCAccountBalanceRequest) unmarshalBuffer(b *objBuffer) error {
+	b.read(r.Account[:])
+	return b.Err()
+}
+
+func (r *RPCAccountBalanceResponse) marshalledSize() int {
+	return (*objCurrency)(&r.Balance).marshalledSize()
+}
+
+func (r *RPCAccountBalanceResponse) marshalBuffer(b *objBuffer) {
+	(*objCurrency)(&r.Balance).marshalBuffer(b)
+}
+
+func (r *RPCAccountBalanceResponse) unmarshalBuffer(b *objBuffer) error {
+	(*objCurrency)(&r.Balance).unmarshalBuffer(b)
+	return b.Err()
+}
+
+// RPCReadAccount
+
+func (r *RPCReadAccountRequest) marshalledSize() int {
+	sectionsSize := 8 + len(r.Sections)*(crypto.HashSize+8+8)
+	return sectionsSize + 1 + len(r.Account) + (*objCurrency)(&r.Amount).marshalledSize() + len(r.Nonce) + 8 + len(r.Signature)
+}
+
+func (r *RPCReadAccountRequest) marshalBuffer(b *objBuffer) {
+	b.writePrefix(len(r.Sections))
+	for i := range r.Sections {
+		b.write(r.Sections[i].MerkleRoot[:])
+		b.writeUint64(uint64(r.Sections[i].Offset))
+		b.writeUint64(uint64(r.Sections[i].Length))
+	}
+	b.writeBool(r.MerkleProof)
+	b.write(r.Account[:])
+	(*objCurrency)(&r.Amount).marshalBuffer(b)
+	b.write(r.Nonce[:])
+	b.writePrefixedBytes(r.Signature)
+}
+
+func (r *RPCReadAccountRequest) unmarshalBuffer(b *objBuffer) error {
+	r.Sections = make([]RPCReadRequestSection, b.readPrefix(crypto.HashSize+8+8))
+	for i := range r.Sections {
+		b.read(r.Sections[i].MerkleRoot[:])
+		r.Sections[i].Offset = uint32(b.readUint64())
+		r.Sections[i].Length = uint32(b.readUint64())
+	}
+	r.MerkleProof = b.readBool()
+	b.read(r.Account[:])
+	(*objCurrency)(&r.Amount).unmarshalBuffer(b)
+	b.read(r.Nonce[:])
+	r.Signature = b.readPrefixedBytes()
+	return b.Err()
+}
+
 // generic objects
 
 type objSiaPublicKey types.SiaPublicKey
@@ -1225,3 +1377,15 @@ func HashRevision(rev types.FileContractRevision) crypto.Hash {
 	or.marshalBuffer(&b)
 	return blake2b.Sum256(b.bytes())
 }
+
+// HashWithdrawal hashes an ephemeral account withdrawal. This is the hash
+// signed by the account owner when paying for an RPC with an account.
+func HashWithdrawal(account AccountID, amount types.Currency, nonce [16]byte) crypto.Hash {
+	oc := (*objCurrency)(&amount)
+	var b objBuffer
+	b.grow(len(account) + oc.marshalledSize() + len(nonce))
+	b.write(account[:])
+	oc.marshalBuffer(&b)
+	b.write(nonce[:])
+	return blake2b.Sum256(b.bytes())
+}
@@ -0,0 +1,425 @@
+package renterhost
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MuxSpecifier is sent by the renter at the beginning of a connection to
+// indicate that the connection will be multiplexed.
+var MuxSpecifier = newSpecifier("MuxEnter")
+
+const (
+	muxHeaderSize  = 4 + 2 + 2
+	muxMaxPayload  = 1<<16 - 1
+	muxFlagData    = 0
+	muxFlagClose   = 1
+	muxFlagOpen    = 2
+	muxFlagWindow  = 3
+	muxFlagReset   = 4
+	muxAcceptQueue = 16
+	muxMaxStreams  = 256
+	muxWindowSize  = 1 << 20
+)
+
+var (
+	// ErrMuxClosed is returned when using a Mux or Stream after the
+	// underlying connection has been closed.
+	ErrMuxClosed = errors.New("mux has been closed")
+
+	// ErrStreamRejected is returned when using a Stream that the host
+	// rejected because it had too many open or unaccepted Streams.
+	ErrStreamRejected = errors.New("stream was rejected by the host")
+)
+
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "stream deadline exceeded" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+// A Mux multiplexes multiple Streams over a single connection, allowing
+// several renter-host Sessions to share one TCP connection. Each Stream
+// conducts its own protocol handshake.
+//
+// Each Stream has its own flow-control window: at most muxWindowSize bytes of
+// unread data are buffered per Stream, after which writes on the remote end
+// block until the data is read. A slow reader therefore stalls only its own
+// Stream. The host rejects new Streams, rather than blocking, when too many
+// Streams are open or waiting to be accepted.
+type Mux struct {
+	conn     net.Conn
+	isClient bool
+
+	wmu sync.Mutex // serializes frame writes
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32 // client only
+	lastID   uint32 // server only
+	accept   chan *Stream
+	err      error
+	closeErr chan struct{}
+}
+
+// A Stream is a bidirectional byte stream within a Mux. It satisfies the
+// net.Conn interface. Write deadlines are checked before each frame is sent,
+// but cannot interrupt a frame that is already being written.
+type Stream struct {
+	m  *Mux
+	id uint32
+
+	mu           sync.Mutex
+	cond         sync.Cond
+	buf          []byte
+	err          error // set when the remote closes the stream or the Mux fails
+	closed       bool  // set when the local side closes the stream
+	rdeadline    time.Time
+	rtimer       *time.Timer
+	wdeadline    time.Time
+	wtimer       *time.Timer
+	remoteClosed bool
+	sendWindow   int // bytes that may be sent before the remote reads more
+	unacked      int // bytes read but not yet reported to the remote
+}
+
+func (m *Mux) writeFrame(id uint32, flags uint16, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:], id)
+	binary.LittleEndian.PutUint16(frame[4:], flags)
+	binary.LittleEndian.PutUint16(frame[6:], uint16(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	_, err := m.conn.Write(frame)
+	return err
+}
+
+func (m *Mux) newStream(id uint32) *Stream {
+	s := &Stream{m: m, id: id, sendWindow: muxWindowSize}
+	s.cond.L = &s.mu
+	m.streams[id] = s
+	return s
+}
+
+func (m *Mux) readLoop() {
+	header := make([]byte, muxHeaderSize)
+	var err error
+	for {
+		if _, err = io.ReadFull(m.conn, header); err != nil {
+			break
+		}
+		id := binary.LittleEndian.Uint32(header[0:])
+		flags := binary.LittleEndian.Uint16(header[4:])
+		payload := make([]byte, binary.LittleEndian.Uint16(header[6:]))
+		if _, err = io.ReadFull(m.conn, payload); err != nil {
+			break
+		}
+
+		m.mu.Lock()
+		s, ok := m.streams[id]
+		if !ok && !m.isClient && id > m.lastID && flags == muxFlagOpen {
+			// new stream; rather than blocking the read loop, reject it if
+			// there are too many streams or the accept queue is full
+			m.lastID = id
+			accepted := false
+			if len(m.streams) < muxMaxStreams {
+				s = m.newStream(id)
+				select {
+				case m.accept <- s:
+					accepted = true
+				default:
+					delete(m.streams, id)
+				}
+			}
+			m.mu.Unlock()
+			if !accepted {
+				if err = m.writeFrame(id, muxFlagReset, nil); err != nil {
+					break
+				}
+			}
+			continue
+		}
+		m.mu.Unlock()
+		if !ok {
+			continue // stream was already closed; discard
+		}
+
+		s.mu.Lock()
+		switch flags {
+		case muxFlagData:
+			if len(s.buf)+len(payload) > muxWindowSize {
+				err = errors.New("peer exceeded stream window")
+			} else if !s.closed {
+				s.buf = append(s.buf, payload...)
+			}
+		case muxFlagWindow:
+			if len(payload) == 4 {
+				s.sendWindow += int(binary.LittleEndian.Uint32(payload))
+			}
+		case muxFlagClose, muxFlagReset:
+			s.remoteClosed = true
+			if s.err == nil {
+				s.err = io.EOF
+				if flags == muxFlagReset {
+					s.err = ErrStreamRejected
+				}
+			}
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if err != nil {
+			break
+		} else if flags == muxFlagClose || flags == muxFlagReset {
+			m.removeIfDone(s)
+		}
+	}
+
+	// connection failed; notify all streams
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = errors.Wrap(err, "mux connection failed")
+		close(m.closeErr)
+	}
+	streams := m.streams
+	m.streams = make(map[uint32]*Stream)
+	m.mu.Unlock()
+	for _, s := range streams {
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = ErrMuxClosed
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// removeIfDone removes s from the Mux once both sides have closed it.
+func (m *Mux) removeIfDone(s *Stream) {
+	s.mu.Lock()
+	done := s.closed && s.remoteClosed
+	s.mu.Unlock()
+	if done {
+		m.mu.Lock()
+		delete(m.streams, s.id)
+		m.mu.Unlock()
+	}
+}
+
+// DialStream opens a new Stream. Only the renter may open Streams.
+func (m *Mux) DialStream() (*Stream, error) {
+	if !m.isClient {
+		return nil, errors.New("only the renter may open streams")
+	}
+	// hold the lock while sending the open frame, so that streams are opened
+	// in order of ID
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.nextID++
+	if err := m.writeFrame(m.nextID, muxFlagOpen, nil); err != nil {
+		return nil, errors.Wrap(err, "could not open stream")
+	}
+	return m.newStream(m.nextID), nil
+}
+
+// AcceptStream waits for the renter to open a new Stream.
+func (m *Mux) AcceptStream() (*Stream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.closeErr:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return nil, m.err
+	}
+}
+
+// Close closes the underlying connection, terminating all Streams.
+func (m *Mux) Close() error {
+	return m.conn.Close()
+}
+
+func newMux(conn net.Conn, isClient bool) *Mux {
+	m := &Mux{
+		conn:     conn,
+		isClient: isClient,
+		streams:  make(map[uint32]*Stream),
+		accept:   make(chan *Stream, muxAcceptQueue),
+		closeErr: make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+// NewRenterMux initiates a multiplexed connection with a host.
+func NewRenterMux(conn net.Conn) (*Mux, error) {
+	if _, err := conn.Write(MuxSpecifier[:]); err != nil {
+		return nil, errors.Wrap(err, "could not initiate mux")
+	}
+	return newMux(conn, true), nil
+}
+
+// NewHostMux accepts a multiplexed connection from a renter. The caller must
+// have already read the MuxSpecifier sent by the renter.
+func NewHostMux(conn net.Conn) *Mux {
+	return newMux(conn, false)
+}
+
+// Read implements net.Conn.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buf) == 0 {
+		if s.closed {
+			s.mu.Unlock()
+			return 0, ErrMuxClosed
+		} else if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		} else if !s.rdeadline.IsZero() && !time.Now().Before(s.rdeadline) {
+			s.mu.Unlock()
+			return 0, muxTimeoutError{}
+		}
+		s.cond.Wait()
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	// replenish the remote's window once half of it has been consumed
+	s.unacked += n
+	var ack uint32
+	if s.unacked >= muxWindowSize/2 && !s.remoteClosed {
+		ack = uint32(s.unacked)
+		s.unacked = 0
+	}
+	s.mu.Unlock()
+	if ack > 0 {
+		// if this fails, the read loop will also fail, terminating the stream
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], ack)
+		s.m.writeFrame(s.id, muxFlagWindow, buf[:])
+	}
+	return n, nil
+}
+
+// Write implements net.Conn.
+func (s *Stream) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		s.mu.Lock()
+		timedOut := func() bool {
+			return !s.wdeadline.IsZero() && !time.Now().Before(s.wdeadline)
+		}
+		// wait for the remote to read enough data to open the window; once
+		// the remote has closed the stream, any data sent is discarded
+		for s.sendWindow == 0 && !s.remoteClosed && !s.closed && s.err == nil && !timedOut() {
+			s.cond.Wait()
+		}
+		closed, err, timeout := s.closed, s.err, timedOut()
+		chunk := p
+		if len(chunk) > muxMaxPayload {
+			chunk = chunk[:muxMaxPayload]
+		}
+		if !s.remoteClosed {
+			if len(chunk) > s.sendWindow {
+				chunk = chunk[:s.sendWindow]
+			}
+			s.sendWindow -= len(chunk)
+		}
+		s.mu.Unlock()
+		if closed {
+			return n, ErrMuxClosed
+		} else if err == ErrMuxClosed || err == ErrStreamRejected {
+			return n, err
+		} else if timeout {
+			return n, muxTimeoutError{}
+		}
+		if err := s.m.writeFrame(s.id, muxFlagData, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close implements net.Conn.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.rtimer != nil {
+		s.rtimer.Stop()
+	}
+	if s.wtimer != nil {
+		s.wtimer.Stop()
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	err := s.m.writeFrame(s.id, muxFlagClose, nil)
+	s.m.removeIfDone(s)
+	return err
+}
+
+// LocalAddr implements net.Conn.
+func (s *Stream) LocalAddr() net.Addr { return s.m.conn.LocalAddr() }
+
+// RemoteAddr implements net.Conn.
+func (s *Stream) RemoteAddr() net.Addr { return s.m.conn.RemoteAddr() }
+
+// SetDeadline implements net.Conn.
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	s.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rdeadline = t
+	if s.rtimer != nil {
+		s.rtimer.Stop()
+		s.rtimer = nil
+	}
+	if !t.IsZero() {
+		s.rtimer = time.AfterFunc(time.Until(t), func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.wdeadline = t
+	if s.wtimer != nil {
+		s.wtimer.Stop()
+		s.wtimer = nil
+	}
+	if !t.IsZero() {
+		s.wtimer = time.AfterFunc(time.Until(t), func() {
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+	return nil
+}
+
+var _ net.Conn = (*Stream)(nil)
@@ -0,0 +1,219 @@
+package renterhost
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/frand"
+)
+
+func newTestingMuxPair(t *testing.T) (renter, host *Mux) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hostChan := make(chan *Mux, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			hostChan <- nil
+			return
+		}
+		var id Specifier
+		if _, err := io.ReadFull(conn, id[:]); err != nil || id != MuxSpecifier {
+			conn.Close()
+			hostChan <- nil
+			return
+		}
+		hostChan <- NewHostMux(conn)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	renter, err = NewRenterMux(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host = <-hostChan; host == nil {
+		t.Fatal("host failed to accept mux")
+	}
+	return renter, host
+}
+
+func TestMux(t *testing.T) {
+	renter, host := newTestingMuxPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	// host echoes each stream
+	go func() {
+		for {
+			s, err := host.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(s, s)
+				s.Close()
+			}()
+		}
+	}()
+
+	// send data on many streams concurrently
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := renter.DialStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+			data := frand.Bytes(200000)
+			go s.Write(data)
+			echoed := make([]byte, len(data))
+			if _, err := io.ReadFull(s, echoed); err != nil {
+				errs <- err
+			} else if !bytes.Equal(echoed, data) {
+				errs <- errors.New("echoed data does not match")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// read deadline
+	s, err := renter.DialStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := s.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected timeout")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("expected timeout error, got", err)
+	}
+
+	// closing the mux should terminate streams
+	renter.Close()
+	if _, err := s.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected error after closing mux")
+	}
+	if _, err := renter.DialStream(); err == nil {
+		t.Fatal("expected error after closing mux")
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	renter, host := newTestingMuxPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	rs, err := renter.DialStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	data := frand.Bytes(muxWindowSize * 3)
+	if _, err := rs.Write(data[:1]); err != nil {
+		t.Fatal(err)
+	}
+	hs, err := host.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+
+	// without a reader, writes should block once the window is exhausted
+	rs.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := rs.Write(data[1:])
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("expected timeout error, got", err)
+	} else if n != muxWindowSize-1 {
+		t.Fatalf("expected %v bytes to be written, got %v", muxWindowSize-1, n)
+	}
+	hs.mu.Lock()
+	buffered := len(hs.buf)
+	hs.mu.Unlock()
+	if buffered > muxWindowSize {
+		t.Fatal("host buffered more than the window:", buffered)
+	}
+
+	// reading should allow the rest of the data to be written
+	rs.SetWriteDeadline(time.Time{})
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := rs.Write(data[1+n:])
+		errCh <- err
+	}()
+	read := make([]byte, len(data))
+	if _, err := io.ReadFull(hs, read); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(read, data) {
+		t.Fatal("data does not match")
+	} else if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxReject(t *testing.T) {
+	renter, host := newTestingMuxPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	// fill the accept queue; further streams should be rejected without
+	// blocking the streams that are already queued
+	var streams []*Stream
+	for i := 0; i < muxAcceptQueue+1; i++ {
+		s, err := renter.DialStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		streams = append(streams, s)
+	}
+	if _, err := streams[muxAcceptQueue].Read(make([]byte, 1)); err != ErrStreamRejected {
+		t.Fatal("expected ErrStreamRejected, got", err)
+	} else if _, err := streams[muxAcceptQueue].Write([]byte("foo")); err != ErrStreamRejected {
+		t.Fatal("expected ErrStreamRejected, got", err)
+	}
+	if _, err := streams[0].Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	hs, err := host.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(hs, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "foo" {
+		t.Fatal("wrong data:", string(buf))
+	}
+
+	// once the queue has room, new streams should be accepted
+	if s, err := renter.DialStream(); err != nil {
+		t.Fatal(err)
+	} else if _, err := s.Write([]byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < muxAcceptQueue+1; i++ {
+		if _, err := host.AcceptStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package renterhost
+
+import (
+	"gitlab.com/NebulousLabs/Sia/encoding"
+)
+
+// A SiaObject wraps an arbitrary value, allowing it to be used as a
+// ProtocolObject. The value is serialized with the Sia encoding package. This
+// is less efficient than the built-in ProtocolObjects, but allows RPCs that
+// this package does not define to be implemented by callers.
+type SiaObject struct {
+	V   interface{}
+	enc []byte
+}
+
+func (o *SiaObject) marshalledSize() int {
+	o.enc = encoding.Marshal(o.V)
+	return len(o.enc)
+}
+
+func (o *SiaObject) marshalBuffer(b *objBuffer) {
+	if o.enc == nil {
+		o.enc = encoding.Marshal(o.V)
+	}
+	b.write(o.enc)
+	o.enc = nil
+}
+
+func (o *SiaObject) unmarshalBuffer(b *objBuffer) error {
+	// the buffer may contain padding, so use a Decoder rather than Unmarshal
+	return encoding.NewDecoder(&b.buf, b.buf.Len()).Decode(o.V)
+}
+
+// NewSiaObject returns a ProtocolObject that encodes v. When the object is
+// read, v must be a pointer.
+func NewSiaObject(v interface{}) *SiaObject {
+	return &SiaObject{V: v}
+}
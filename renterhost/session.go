@@ -4,6 +4,7 @@ package renterhost // import "lukechampine.com/us/renterhost"
 
 import (
 	"bytes"
+	"compress/flate"
 	"crypto/cipher"
 	"io"
 
@@ -62,6 +63,13 @@ type Session struct {
 	challenge [16]byte
 	closed    bool
 	isRenter  bool
+
+	shape    TrafficShape
+	compress bool
+	zbuf     objBuffer // scratch space for (de)compression
+	zout     bytes.Buffer
+	zw       *flate.Writer
+	zr       io.ReadCloser
 }
 
 // SetChallenge sets the current session challenge.
@@ -91,18 +99,36 @@ func (s *Session) writeMessage(obj ProtocolObject) error {
 	nonce := make([]byte, 256)[:s.aead.NonceSize()] // avoid heap alloc
 	frand.Read(nonce)
 
-	// pad short messages to MinMessageSize
-	msgSize := 8 + s.aead.NonceSize() + obj.marshalledSize() + s.aead.Overhead()
-	if msgSize < MinMessageSize {
-		msgSize = MinMessageSize
+	// if compression is enabled, each message is prefixed with a flag
+	// indicating whether it was actually compressed
+	objSize := obj.marshalledSize()
+	var compressed []byte
+	if s.compress {
+		compressed = s.compressObject(obj)
+		if compressed != nil {
+			objSize = len(compressed)
+		}
+		objSize++
 	}
 
+	// pad short messages to MinMessageSize, and all messages according to
+	// the TrafficShape
+	msgSize := s.paddedSize(8 + s.aead.NonceSize() + objSize + s.aead.Overhead())
+
 	// write length prefix, nonce, and object directly into buffer
 	s.outbuf.reset()
 	s.outbuf.grow(msgSize)
 	s.outbuf.writePrefix(msgSize - 8)
 	s.outbuf.write(nonce)
-	obj.marshalBuffer(&s.outbuf)
+	if !s.compress {
+		obj.marshalBuffer(&s.outbuf)
+	} else if compressed == nil {
+		s.outbuf.write([]byte{compressionNone})
+		obj.marshalBuffer(&s.outbuf)
+	} else {
+		s.outbuf.write([]byte{compressionDeflate})
+		s.outbuf.write(compressed)
+	}
 
 	// encrypt the object in-place
 	msg := s.outbuf.bytes()[:msgSize]
@@ -110,6 +136,7 @@ func (s *Session) writeMessage(obj ProtocolObject) error {
 	payload := msg[8+len(nonce) : msgSize-s.aead.Overhead()]
 	s.aead.Seal(payload[:0], msgNonce, payload, nil)
 
+	s.shapeDelay()
 	_, err := s.conn.Write(msg)
 	return err
 }
@@ -142,6 +169,11 @@ func (s *Session) readMessage(obj ProtocolObject, maxLen uint64) error {
 	if err != nil {
 		return err
 	}
+	if s.compress {
+		if flag := s.inbuf.next(1); len(flag) == 1 && flag[0] == compressionDeflate {
+			return s.decompressObject(obj, maxLen)
+		}
+	}
 	return obj.unmarshalBuffer(&s.inbuf)
 }
 
@@ -224,20 +256,26 @@ func NewHostSession(conn io.ReadWriteCloser, hs HashSigner) (_ *Session, err err
 		return nil, err
 	}
 
-	var supportsChaCha bool
+	var supportsChaCha, supportsDeflate bool
 	for _, c := range req.Ciphers {
-		if c == cipherChaCha20Poly1305 {
+		switch c {
+		case cipherChaCha20Poly1305:
 			supportsChaCha = true
+		case cipherChaCha20Deflate:
+			supportsDeflate = true
 		}
 	}
-	if !supportsChaCha {
+	cipher := cipherChaCha20Poly1305
+	if supportsDeflate {
+		cipher = cipherChaCha20Deflate
+	} else if !supportsChaCha {
 		(&loopKeyExchangeResponse{Cipher: cipherNoOverlap}).writeTo(conn)
 		return nil, errors.New("no supported ciphers")
 	}
 
 	xsk, xpk := crypto.GenerateX25519KeyPair()
 	resp := loopKeyExchangeResponse{
-		Cipher:    cipherChaCha20Poly1305,
+		Cipher:    cipher,
 		PublicKey: xpk,
 		Signature: hs.SignHash(hashKeys(req.PublicKey, xpk)),
 	}
@@ -251,6 +289,7 @@ func NewHostSession(conn io.ReadWriteCloser, hs HashSigner) (_ *Session, err err
 		conn:     conn,
 		aead:     aead,
 		isRenter: false,
+		compress: cipher == cipherChaCha20Deflate,
 	}
 	frand.Read(s.challenge[:])
 	// hack: cast challenge to Specifier to make it a ProtocolObject
@@ -266,12 +305,27 @@ func NewHostSession(conn io.ReadWriteCloser, hs HashSigner) (_ *Session, err err
 // Note that hostdb.HostPublicKey implements the HashVerifier interface.
 func NewRenterSession(conn io.ReadWriteCloser, hv HashVerifier) (_ *Session, err error) {
 	defer wrapErr(&err, "NewRenterSession")
+	return newRenterSession(conn, hv, false)
+}
+
+// NewRenterSessionCompressed is like NewRenterSession, but additionally
+// proposes that RPC messages be compressed. If the host does not support
+// compression, the Session falls back to uncompressed messages; see
+// (*Session).Compressed.
+func NewRenterSessionCompressed(conn io.ReadWriteCloser, hv HashVerifier) (_ *Session, err error) {
+	defer wrapErr(&err, "NewRenterSessionCompressed")
+	return newRenterSession(conn, hv, true)
+}
 
+func newRenterSession(conn io.ReadWriteCloser, hv HashVerifier, compress bool) (*Session, error) {
 	xsk, xpk := crypto.GenerateX25519KeyPair()
 	req := &loopKeyExchangeRequest{
 		PublicKey: xpk,
 		Ciphers:   []Specifier{cipherChaCha20Poly1305},
 	}
+	if compress {
+		req.Ciphers = []Specifier{cipherChaCha20Deflate, cipherChaCha20Poly1305}
+	}
 	if err := req.writeTo(conn); err != nil {
 		return nil, err
 	}
@@ -285,7 +339,7 @@ func NewRenterSession(conn io.ReadWriteCloser, hv HashVerifier) (_ *Session, err
 	}
 	if resp.Cipher == cipherNoOverlap {
 		return nil, errors.New("host does not support any of our proposed ciphers")
-	} else if resp.Cipher != cipherChaCha20Poly1305 {
+	} else if resp.Cipher != cipherChaCha20Poly1305 && !(compress && resp.Cipher == cipherChaCha20Deflate) {
 		return nil, errors.New("host selected unsupported cipher")
 	}
 
@@ -295,6 +349,7 @@ func NewRenterSession(conn io.ReadWriteCloser, hv HashVerifier) (_ *Session, err
 		conn:     conn,
 		aead:     aead,
 		isRenter: true,
+		compress: resp.Cipher == cipherChaCha20Deflate,
 	}
 	// hack: cast challenge to Specifier to make it a ProtocolObject
 	if err := s.readMessage((*Specifier)(&s.challenge), MinMessageSize); err != nil {
@@ -321,7 +376,14 @@ type (
 type Specifier [16]byte
 
 func (s Specifier) String() string {
-	return string(bytes.Trim(s[:], string(0)))
+	return string(bytes.Trim(s[:], "\x00"))
+}
+
+// NewSpecifier returns a Specifier containing str, which must be no longer
+// than 16 bytes. It is useful for defining the IDs of RPCs that this package
+// does not define.
+func NewSpecifier(str string) Specifier {
+	return newSpecifier(str)
 }
 
 func newSpecifier(str string) Specifier {
@@ -347,6 +409,11 @@ var ErrRenterClosed = errors.New("renter has terminated session")
 var (
 	cipherChaCha20Poly1305 = newSpecifier("ChaCha20Poly1305")
 	cipherNoOverlap        = newSpecifier("NoOverlap")
+
+	// cipherChaCha20Deflate is ChaCha20Poly1305 with DEFLATE-compressed
+	// messages. Hosts that do not recognize it will select
+	// cipherChaCha20Poly1305 instead.
+	cipherChaCha20Deflate = newSpecifier("ChaCha20Deflate")
 )
 
 // RPC IDs
@@ -359,6 +426,29 @@ var (
 	RPCSettingsID      = newSpecifier("LoopSettings")
 	RPCUnlockID        = newSpecifier("LoopUnlock")
 	RPCWriteID         = newSpecifier("LoopWrite")
+
+	// RPCLockReadOnlyID uses the same request and response objects as
+	// RPCLockID, but does not lock the contract exclusively. Instead, the
+	// renter may only read from the contract, paying via an ephemeral
+	// account. Hosts that do not permit read-only access respond with
+	// Acquired set to false.
+	RPCLockReadOnlyID = newSpecifier("LoopLockReadOnly")
+
+	// RPCRevalidateSettingsID is a lightweight alternative to RPCSettingsID:
+	// the host only sends its settings if they have changed since the
+	// revision specified by the renter.
+	RPCRevalidateSettingsID = newSpecifier("LoopRevalidate")
+
+	RPCFundAccountID    = newSpecifier("LoopFundAccount")
+	RPCAccountBalanceID = newSpecifier("LoopAcctBalance")
+	RPCReadAccountID    = newSpecifier("LoopReadAccount")
+)
+
+// RPC error types
+var (
+	// ErrTypeOutOfStorage indicates that the host does not have enough
+	// storage available to accept new sectors. The session remains usable.
+	ErrTypeOutOfStorage = newSpecifier("OutOfStorage")
 )
 
 // Read/Write actions
@@ -371,6 +461,10 @@ var (
 	RPCReadStop = newSpecifier("ReadStop")
 )
 
+// An AccountID identifies an ephemeral account. It is the Ed25519 public key
+// whose corresponding private key authorizes withdrawals from the account.
+type AccountID [32]byte
+
 // RPC request/response objects
 type (
 	// RPCFormContractRequest contains the request parameters for the
@@ -489,4 +583,63 @@ type (
 	RPCWriteResponse struct {
 		Signature []byte
 	}
+
+	// RPCFundAccountRequest contains the request parameters for the
+	// FundAccount RPC. The amount deposited is the amount transferred from
+	// the renter to the host by the new revision.
+	RPCFundAccountRequest struct {
+		Account AccountID
+
+		NewRevisionNumber    uint64
+		NewValidProofValues  []types.Currency
+		NewMissedProofValues []types.Currency
+		Signature            []byte
+	}
+
+	// RPCFundAccountResponse contains the response data for the FundAccount
+	// RPC.
+	RPCFundAccountResponse struct {
+		Balance   types.Currency
+		Signature []byte
+	}
+
+	// RPCRevalidateSettingsRequest contains the request parameters for the
+	// RevalidateSettings RPC.
+	RPCRevalidateSettingsRequest struct {
+		RevisionNumber uint64
+	}
+
+	// RPCRevalidateSettingsResponse contains the response data for the
+	// RevalidateSettings RPC. If Unchanged is true, Settings is empty.
+	RPCRevalidateSettingsResponse struct {
+		Unchanged bool
+		Settings  []byte
+	}
+
+	// RPCAccountBalanceRequest contains the request parameters for the
+	// AccountBalance RPC.
+	RPCAccountBalanceRequest struct {
+		Account AccountID
+	}
+
+	// RPCAccountBalanceResponse contains the response data for the
+	// AccountBalance RPC.
+	RPCAccountBalanceResponse struct {
+		Balance types.Currency
+	}
+
+	// RPCReadAccountRequest contains the request parameters for the
+	// ReadAccount RPC. Instead of revising a contract, the renter pays by
+	// withdrawing Amount from Account. The host responds with one
+	// RPCReadResponse per section; the Signature field of each response is
+	// empty.
+	RPCReadAccountRequest struct {
+		Sections    []RPCReadRequestSection
+		MerkleProof bool
+
+		Account   AccountID
+		Amount    types.Currency
+		Nonce     [16]byte
+		Signature []byte // signature of HashWithdrawal
+	}
 )
@@ -16,6 +16,11 @@ import (
 	"lukechampine.com/frand"
 )
 
+var randomAccount = func() (a AccountID) {
+	frand.Read(a[:])
+	return
+}()
+
 var randomTxn = func() types.Transaction {
 	txn := types.Transaction{
 		SiacoinInputs: []types.SiacoinInput{{
@@ -202,6 +207,113 @@ func TestSession(t *testing.T) {
 	}
 }
 
+func TestSiaObject(t *testing.T) {
+	type greeting struct {
+		Name  string
+		Count uint64
+		Tags  []string
+	}
+	in := greeting{"Foo", 3, []string{"bar", "baz"}}
+	o := NewSiaObject(in)
+	siaenc := encoding.Marshal(in)
+	if o.marshalledSize() != len(siaenc) {
+		t.Fatalf("marshalled size is incorrect: got %v, expected %v", o.marshalledSize(), len(siaenc))
+	}
+	var b objBuffer
+	o.marshalBuffer(&b)
+	if !bytes.Equal(b.bytes(), siaenc) {
+		t.Fatal("marshalled object is incorrect")
+	}
+
+	// padding after the object should be ignored
+	b.write(make([]byte, 16))
+	var out greeting
+	if err := NewSiaObject(&out).unmarshalBuffer(&b); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(out, in) {
+		t.Fatalf("objects differ after unmarshalling: %+v", out)
+	}
+
+	// unmarshalling requires a pointer
+	b = objBuffer{}
+	o.marshalBuffer(&b)
+	if err := NewSiaObject(out).unmarshalBuffer(&b); err == nil {
+		t.Fatal("expected error when unmarshalling into non-pointer")
+	}
+}
+
+func TestCompressedSession(t *testing.T) {
+	compressible := strings.Repeat("Foo", 10000)
+	incompressible := string(frand.Bytes(10000))
+
+	for _, compress := range []bool{true, false} {
+		renter, host := newFakeConns()
+		hostErr := make(chan error, 1)
+		go func() {
+			hostErr <- func() error {
+				hs, err := NewHostSession(host, dummyKey{})
+				if err != nil {
+					return err
+				}
+				defer hs.Close()
+				if hs.Compressed() != compress {
+					return errors.New("host did not negotiate compression correctly")
+				}
+				for {
+					_, err := hs.ReadID()
+					if errors.Cause(err) == ErrRenterClosed {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					var msg string
+					if err := hs.ReadRequest(NewSiaObject(&msg), 40000); err != nil {
+						return err
+					} else if err := hs.WriteResponse(NewSiaObject(msg), nil); err != nil {
+						return err
+					}
+				}
+			}()
+		}()
+
+		var rs *Session
+		var err error
+		if compress {
+			rs, err = NewRenterSessionCompressed(renter, dummyKey{})
+		} else {
+			rs, err = NewRenterSession(renter, dummyKey{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		} else if rs.Compressed() != compress {
+			t.Fatal("renter did not negotiate compression correctly")
+		}
+		for _, msg := range []string{"", compressible, incompressible} {
+			var resp string
+			if err := rs.WriteRequest(newSpecifier("Echo"), NewSiaObject(msg)); err != nil {
+				t.Fatal(err)
+			} else if err := rs.ReadResponse(NewSiaObject(&resp), 40000); err != nil {
+				t.Fatal(err)
+			} else if resp != msg {
+				t.Fatal("response does not match request")
+			}
+		}
+		// a compressed message must not be allowed to expand beyond maxLen
+		if compress {
+			var resp string
+			if err := rs.WriteRequest(newSpecifier("Echo"), NewSiaObject(compressible)); err != nil {
+				t.Fatal(err)
+			} else if err := rs.ReadResponse(NewSiaObject(&resp), 5000); err == nil || !strings.Contains(err.Error(), "exceeds maxLen") {
+				t.Fatal("expected maxLen error, got", err)
+			}
+		}
+		rs.Close()
+		if err := <-hostErr; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestFormContract(t *testing.T) {
 	renterReq := &RPCFormContractRequest{
 		Transactions: []types.Transaction{randomTxn, randomTxn},
@@ -383,6 +495,35 @@ func TestEncoding(t *testing.T) {
 		&RPCWriteResponse{
 			Signature: frand.Bytes(64),
 		},
+		&RPCFundAccountRequest{
+			Account:              randomAccount,
+			NewRevisionNumber:    frand.Uint64n(100),
+			NewValidProofValues:  randomTxn.MinerFees,
+			NewMissedProofValues: randomTxn.MinerFees,
+			Signature:            frand.Bytes(64),
+		},
+		&RPCFundAccountResponse{
+			Balance:   randomTxn.MinerFees[0],
+			Signature: frand.Bytes(64),
+		},
+		&RPCRevalidateSettingsRequest{
+			RevisionNumber: frand.Uint64n(100),
+		},
+		&RPCRevalidateSettingsResponse{
+			Settings: frand.Bytes(100),
+		},
+		&RPCAccountBalanceRequest{
+			Account: randomAccount,
+		},
+		&RPCAccountBalanceResponse{
+			Balance: randomTxn.MinerFees[0],
+		},
+		&RPCReadAccountRequest{
+			Sections:  []RPCReadRequestSection{{}},
+			Account:   randomAccount,
+			Amount:    randomTxn.MinerFees[0],
+			Signature: frand.Bytes(64),
+		},
 	}
 	for _, o := range objs {
 		siaenc := encoding.Marshal(reflect.ValueOf(o).Elem().Interface())
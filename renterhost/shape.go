@@ -0,0 +1,47 @@
+package renterhost
+
+import (
+	"time"
+
+	"lukechampine.com/frand"
+)
+
+// A TrafficShape describes how a Session disguises the size and timing of its
+// messages. Since messages are encrypted, an observer of the connection can
+// only learn their lengths and the times at which they were sent; however,
+// this is often enough to infer the sizes of files being transferred, or to
+// distinguish between different RPCs.
+type TrafficShape struct {
+	// If non-zero, each message is padded to a multiple of Padding bytes. The
+	// peer must be willing to accept the padded messages; in particular, a
+	// Padding larger than MinMessageSize will cause most RPCs to fail unless
+	// the peer is similarly configured.
+	Padding int
+	// If non-zero, the Session waits for a random duration in [0, MaxDelay)
+	// before sending each message.
+	MaxDelay time.Duration
+}
+
+// SetTrafficShape sets the TrafficShape used for all subsequent messages.
+func (s *Session) SetTrafficShape(ts TrafficShape) {
+	s.shape = ts
+}
+
+// paddedSize returns the size of a message of length n after padding.
+func (s *Session) paddedSize(n int) int {
+	if n < MinMessageSize {
+		n = MinMessageSize
+	}
+	if p := s.shape.Padding; p > 0 && n%p != 0 {
+		n += p - n%p
+	}
+	return n
+}
+
+// shapeDelay sleeps for a random duration, as specified by the Session's
+// TrafficShape.
+func (s *Session) shapeDelay() {
+	if s.shape.MaxDelay > 0 {
+		time.Sleep(time.Duration(frand.Uint64n(uint64(s.shape.MaxDelay))))
+	}
+}